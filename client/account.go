@@ -0,0 +1,450 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	maxAPIResponseBytes = 1024 * 1024 // Responses of the account and admin API may contain lists, e.g. users
+
+	apiUsersPath               = "/v1/users"
+	apiUsersAccessPath         = "/v1/users/access"
+	apiAccountPath             = "/v1/account"
+	apiAccountTokenPath        = "/v1/account/token"
+	apiAccountPasswordPath     = "/v1/account/password"
+	apiAccountSettingsPath     = "/v1/account/settings"
+	apiAccountSubscriptionPath = "/v1/account/subscription"
+	apiAccountReservationPath  = "/v1/account/reservation"
+	apiAccountWebhookPath      = "/v1/account/webhook"
+	apiAccountPhonePath        = "/v1/account/phone"
+	apiAccountPhoneVerifyPath  = "/v1/account/phone/verify"
+)
+
+// AccountCreateRequest is the request body to create a new account, see Client.CreateAccount
+type AccountCreateRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// AccountPasswordChangeRequest is the request body to change the password, see Client.ChangePassword
+type AccountPasswordChangeRequest struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+}
+
+// AccountDeleteRequest is the request body to delete the account, see Client.DeleteAccount
+type AccountDeleteRequest struct {
+	Password string `json:"password"`
+}
+
+// AccountTokenIssueRequest is the request body to create a new access token, see Client.CreateToken
+type AccountTokenIssueRequest struct {
+	Label   *string `json:"label,omitempty"`
+	Expires *int64  `json:"expires,omitempty"` // Unix timestamp
+}
+
+// AccountTokenUpdateRequest is the request body to update an access token, see Client.UpdateToken
+type AccountTokenUpdateRequest struct {
+	Token   string  `json:"token"`
+	Label   *string `json:"label,omitempty"`
+	Expires *int64  `json:"expires,omitempty"` // Unix timestamp
+}
+
+// AccountTokenResponse is an access token of an account
+type AccountTokenResponse struct {
+	Token      string `json:"token"`
+	Label      string `json:"label,omitempty"`
+	LastAccess int64  `json:"last_access,omitempty"`
+	LastOrigin string `json:"last_origin,omitempty"`
+	Expires    int64  `json:"expires,omitempty"` // Unix timestamp
+}
+
+// AccountSettings are the settings of an account, see Client.ChangeSettings
+type AccountSettings struct {
+	Language     *string                   `json:"language,omitempty"`
+	Notification *AccountNotificationPrefs `json:"notification,omitempty"`
+}
+
+// AccountNotificationPrefs are the notification settings of an account
+type AccountNotificationPrefs struct {
+	Sound       *string              `json:"sound,omitempty"`
+	MinPriority *int                 `json:"min_priority,omitempty"`
+	DeleteAfter *int                 `json:"delete_after,omitempty"`
+	QuietHours  []*AccountQuietHours `json:"quiet_hours,omitempty"`
+}
+
+// AccountQuietHours is a time window in which notifications are held back
+type AccountQuietHours struct {
+	Start       string   `json:"start"`                  // Time of day, e.g. "22:00"
+	End         string   `json:"end"`                    // Time of day, e.g. "07:00"
+	Timezone    string   `json:"timezone,omitempty"`     // IANA time zone, e.g. "Europe/Berlin" (default: UTC)
+	Days        []string `json:"days,omitempty"`         // Days of the week, e.g. "mon", "sat" (default: all days)
+	MinPriority int      `json:"min_priority,omitempty"` // Messages with at least this priority bypass the quiet hours (0 = none)
+	Summary     bool     `json:"summary,omitempty"`      // Send a summary of held back notifications when the quiet hours end
+}
+
+// AccountSubscription is a topic subscription that is synced across devices via the account
+type AccountSubscription struct {
+	BaseURL     string  `json:"base_url"`
+	Topic       string  `json:"topic"`
+	DisplayName *string `json:"display_name"`
+}
+
+// AccountReservationRequest is the request body to reserve a topic, see Client.AddReservation
+type AccountReservationRequest struct {
+	Topic    string `json:"topic"`
+	Everyone string `json:"everyone"` // Access for everyone else, e.g. "deny-all" or "read-only"
+}
+
+// AccountReservation is a topic reserved by the account
+type AccountReservation struct {
+	Topic    string `json:"topic"`
+	Everyone string `json:"everyone"`
+}
+
+// AccountWebhookRequest is the request body to add a webhook, see Client.AddWebhook
+type AccountWebhookRequest struct {
+	Topic    string `json:"topic"`
+	URL      string `json:"url"`
+	Template string `json:"template,omitempty"`
+}
+
+// AccountWebhook is a webhook of an account
+type AccountWebhook struct {
+	ID       string                `json:"id"`
+	Topic    string                `json:"topic"`
+	URL      string                `json:"url"`
+	Template string                `json:"template,omitempty"`
+	Secret   string                `json:"secret"`
+	Status   *AccountWebhookStatus `json:"status"`
+}
+
+// AccountWebhookStatus is the delivery status of a webhook
+type AccountWebhookStatus struct {
+	LastAttempt int64  `json:"last_attempt,omitempty"`
+	LastSuccess int64  `json:"last_success,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	Failures    int64  `json:"failures"`
+	Pending     int64  `json:"pending"`
+}
+
+// AccountPhoneNumberVerifyRequest is the request body to request a verification code, see Client.VerifyPhoneNumber
+type AccountPhoneNumberVerifyRequest struct {
+	Number  string `json:"number"`
+	Channel string `json:"channel"` // "sms" or "call"
+}
+
+// AccountPhoneNumberAddRequest is the request body to add a verified phone number, see Client.AddPhoneNumber
+type AccountPhoneNumberAddRequest struct {
+	Number string `json:"number"`
+	Code   string `json:"code"`
+}
+
+// AccountTier is the tier of an account
+type AccountTier struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+// AccountLimits are the limits of an account, either based on its tier or on the IP address
+type AccountLimits struct {
+	Basis                    string `json:"basis,omitempty"` // "ip" or "tier"
+	Messages                 int64  `json:"messages"`
+	MessagesExpiryDuration   int64  `json:"messages_expiry_duration"`
+	Emails                   int64  `json:"emails"`
+	Calls                    int64  `json:"calls"`
+	Reservations             int64  `json:"reservations"`
+	AttachmentTotalSize      int64  `json:"attachment_total_size"`
+	AttachmentFileSize       int64  `json:"attachment_file_size"`
+	AttachmentExpiryDuration int64  `json:"attachment_expiry_duration"`
+	AttachmentBandwidth      int64  `json:"attachment_bandwidth"`
+}
+
+// AccountStats are the usage stats of an account
+type AccountStats struct {
+	Messages                     int64 `json:"messages"`
+	MessagesRemaining            int64 `json:"messages_remaining"`
+	Emails                       int64 `json:"emails"`
+	EmailsRemaining              int64 `json:"emails_remaining"`
+	Calls                        int64 `json:"calls"`
+	CallsRemaining               int64 `json:"calls_remaining"`
+	Reservations                 int64 `json:"reservations"`
+	ReservationsRemaining        int64 `json:"reservations_remaining"`
+	AttachmentTotalSize          int64 `json:"attachment_total_size"`
+	AttachmentTotalSizeRemaining int64 `json:"attachment_total_size_remaining"`
+}
+
+// AccountBilling is the billing status of an account
+type AccountBilling struct {
+	Customer     bool   `json:"customer"`
+	Subscription bool   `json:"subscription"`
+	Status       string `json:"status,omitempty"`
+	Interval     string `json:"interval,omitempty"`
+	PaidUntil    int64  `json:"paid_until,omitempty"`
+	CancelAt     int64  `json:"cancel_at,omitempty"`
+}
+
+// AccountResponse is the account of the current user, see Client.Account
+type AccountResponse struct {
+	Username      string                    `json:"username"`
+	Role          string                    `json:"role,omitempty"`
+	SyncTopic     string                    `json:"sync_topic,omitempty"`
+	Language      string                    `json:"language,omitempty"`
+	Notification  *AccountNotificationPrefs `json:"notification,omitempty"`
+	Subscriptions []*AccountSubscription    `json:"subscriptions,omitempty"`
+	Reservations  []*AccountReservation     `json:"reservations,omitempty"`
+	Webhooks      []*AccountWebhook         `json:"webhooks,omitempty"`
+	Tokens        []*AccountTokenResponse   `json:"tokens,omitempty"`
+	PhoneNumbers  []string                  `json:"phone_numbers,omitempty"`
+	Tier          *AccountTier              `json:"tier,omitempty"`
+	Limits        *AccountLimits            `json:"limits,omitempty"`
+	Stats         *AccountStats             `json:"stats,omitempty"`
+	Billing       *AccountBilling           `json:"billing,omitempty"`
+}
+
+// UserAddRequest is the request body to add a user, see Client.AddUser
+type UserAddRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Tier     string `json:"tier,omitempty"`
+}
+
+// UserDeleteRequest is the request body to delete a user, see Client.DeleteUser
+type UserDeleteRequest struct {
+	Username string `json:"username"`
+}
+
+// UserResponse is a user as returned by the admin API, see Client.Users
+type UserResponse struct {
+	Username string               `json:"username"`
+	Role     string               `json:"role"`
+	Tier     string               `json:"tier,omitempty"`
+	Grants   []*UserGrantResponse `json:"grants,omitempty"`
+}
+
+// UserGrantResponse is an access control entry of a user
+type UserGrantResponse struct {
+	Topic      string `json:"topic"` // This may be a pattern
+	Permission string `json:"permission"`
+}
+
+// AccessAllowRequest is the request body to grant a user access to a topic, see Client.AllowAccess
+type AccessAllowRequest struct {
+	Username   string `json:"username"`
+	Topic      string `json:"topic"` // This may be a pattern
+	Permission string `json:"permission"`
+}
+
+// AccessResetRequest is the request body to reset a user's access to a topic, see Client.ResetAccess
+type AccessResetRequest struct {
+	Username string `json:"username"`
+	Topic    string `json:"topic"`
+}
+
+// CreateAccount creates a new account on the default host. This requires signup to be enabled on the server.
+//
+// All account and admin methods send their requests to the default host (see Config.DefaultHost). Credentials
+// must be passed via options, e.g. WithBasicAuth or WithBearerAuth.
+func (c *Client) CreateAccount(req *AccountCreateRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodPost, apiAccountPath, req, nil, options...)
+}
+
+// Account returns the account of the authenticated user, including its settings, tokens, reservations,
+// limits and stats. If no credentials are passed, the limits and stats of the anonymous user are returned.
+func (c *Client) Account(options ...RequestOption) (*AccountResponse, error) {
+	var account AccountResponse
+	if err := c.performAPIRequest(http.MethodGet, apiAccountPath, nil, &account, options...); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// DeleteAccount deletes the account of the authenticated user. The current password is required.
+func (c *Client) DeleteAccount(req *AccountDeleteRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodDelete, apiAccountPath, req, nil, options...)
+}
+
+// ChangePassword changes the password of the authenticated user
+func (c *Client) ChangePassword(req *AccountPasswordChangeRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodPost, apiAccountPasswordPath, req, nil, options...)
+}
+
+// ChangeSettings updates the settings of the authenticated user. Only fields that are set are changed.
+func (c *Client) ChangeSettings(req *AccountSettings, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodPatch, apiAccountSettingsPath, req, nil, options...)
+}
+
+// CreateToken creates a new access token for the authenticated user
+func (c *Client) CreateToken(req *AccountTokenIssueRequest, options ...RequestOption) (*AccountTokenResponse, error) {
+	var token AccountTokenResponse
+	if err := c.performAPIRequest(http.MethodPost, apiAccountTokenPath, req, &token, options...); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// UpdateToken changes the label and/or expiry date of an access token of the authenticated user
+func (c *Client) UpdateToken(req *AccountTokenUpdateRequest, options ...RequestOption) (*AccountTokenResponse, error) {
+	var token AccountTokenResponse
+	if err := c.performAPIRequest(http.MethodPatch, apiAccountTokenPath, req, &token, options...); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// DeleteToken deletes an access token of the authenticated user. If token is empty, the token used
+// to authenticate the request is deleted.
+func (c *Client) DeleteToken(token string, options ...RequestOption) error {
+	options = append(options, WithHeader("X-Token", token))
+	return c.performAPIRequest(http.MethodDelete, apiAccountTokenPath, nil, nil, options...)
+}
+
+// AddSubscription adds a topic subscription to the account of the authenticated user
+func (c *Client) AddSubscription(req *AccountSubscription, options ...RequestOption) (*AccountSubscription, error) {
+	var subscription AccountSubscription
+	if err := c.performAPIRequest(http.MethodPost, apiAccountSubscriptionPath, req, &subscription, options...); err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// UpdateSubscription changes the display name of a topic subscription of the authenticated user
+func (c *Client) UpdateSubscription(req *AccountSubscription, options ...RequestOption) (*AccountSubscription, error) {
+	var subscription AccountSubscription
+	if err := c.performAPIRequest(http.MethodPatch, apiAccountSubscriptionPath, req, &subscription, options...); err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// DeleteSubscription removes a topic subscription from the account of the authenticated user
+func (c *Client) DeleteSubscription(baseURL, topic string, options ...RequestOption) error {
+	options = append(options, WithHeader("X-BaseURL", baseURL), WithHeader("X-Topic", topic))
+	return c.performAPIRequest(http.MethodDelete, apiAccountSubscriptionPath, nil, nil, options...)
+}
+
+// AddReservation reserves a topic for the authenticated user, or changes the access of an existing reservation
+func (c *Client) AddReservation(req *AccountReservationRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodPost, apiAccountReservationPath, req, nil, options...)
+}
+
+// DeleteReservation removes a topic reservation of the authenticated user. If deleteMessages is true,
+// all cached messages of the topic are deleted as well.
+func (c *Client) DeleteReservation(topic string, deleteMessages bool, options ...RequestOption) error {
+	if deleteMessages {
+		options = append(options, WithHeader("X-Delete-Messages", "true"))
+	}
+	return c.performAPIRequest(http.MethodDelete, fmt.Sprintf("%s/%s", apiAccountReservationPath, url.PathEscape(topic)), nil, nil, options...)
+}
+
+// AddWebhook adds a webhook for a topic to the account of the authenticated user. This requires webhooks to be
+// enabled on the server. The returned webhook contains the secret used to sign the webhook requests.
+func (c *Client) AddWebhook(req *AccountWebhookRequest, options ...RequestOption) (*AccountWebhook, error) {
+	var webhook AccountWebhook
+	if err := c.performAPIRequest(http.MethodPost, apiAccountWebhookPath, req, &webhook, options...); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// DeleteWebhook removes a webhook from the account of the authenticated user
+func (c *Client) DeleteWebhook(id string, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodDelete, fmt.Sprintf("%s/%s", apiAccountWebhookPath, url.PathEscape(id)), nil, nil, options...)
+}
+
+// VerifyPhoneNumber sends a verification code to a phone number via SMS or call. The code can then be
+// used in AddPhoneNumber. This requires calls to be enabled on the server.
+func (c *Client) VerifyPhoneNumber(req *AccountPhoneNumberVerifyRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodPut, apiAccountPhoneVerifyPath, req, nil, options...)
+}
+
+// AddPhoneNumber adds a phone number to the account of the authenticated user, using the verification
+// code received after calling VerifyPhoneNumber
+func (c *Client) AddPhoneNumber(req *AccountPhoneNumberAddRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodPut, apiAccountPhonePath, req, nil, options...)
+}
+
+// DeletePhoneNumber removes a verified phone number from the account of the authenticated user
+func (c *Client) DeletePhoneNumber(number string, options ...RequestOption) error {
+	req := &AccountPhoneNumberAddRequest{Number: number}
+	return c.performAPIRequest(http.MethodDelete, apiAccountPhonePath, req, nil, options...)
+}
+
+// Users returns all users and their access control entries. This requires admin credentials.
+func (c *Client) Users(options ...RequestOption) ([]*UserResponse, error) {
+	users := make([]*UserResponse, 0)
+	if err := c.performAPIRequest(http.MethodGet, apiUsersPath, nil, &users, options...); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// AddUser adds a user with the role "user", optionally with a tier. This requires admin credentials.
+func (c *Client) AddUser(req *UserAddRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodPut, apiUsersPath, req, nil, options...)
+}
+
+// DeleteUser removes a user with the role "user". This requires admin credentials.
+func (c *Client) DeleteUser(req *UserDeleteRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodDelete, apiUsersPath, req, nil, options...)
+}
+
+// AllowAccess grants a user access to a topic or topic pattern. This requires admin credentials.
+func (c *Client) AllowAccess(req *AccessAllowRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodPut, apiUsersAccessPath, req, nil, options...)
+}
+
+// ResetAccess removes the access control entries of a user for a topic or topic pattern. If the topic is empty,
+// all entries of the user are removed. This requires admin credentials.
+func (c *Client) ResetAccess(req *AccessResetRequest, options ...RequestOption) error {
+	return c.performAPIRequest(http.MethodDelete, apiUsersAccessPath, req, nil, options...)
+}
+
+// performAPIRequest sends a JSON request to the given API path on the default host, and decodes the
+// JSON response into response, unless it is nil. Non-200 responses are returned as errors.
+func (c *Client) performAPIRequest(method, path string, body any, response any, options ...RequestOption) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.config.DefaultHost, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, option := range options {
+		if err := option(req); err != nil {
+			return err
+		}
+	}
+	log.Debug("%s %s", method, req.URL.String())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+		if err != nil {
+			return err
+		}
+		return errors.New(strings.TrimSpace(string(b)))
+	} else if response == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxAPIResponseBytes)).Decode(response)
+}
@@ -0,0 +1,153 @@
+package client_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/client"
+	"heckel.io/ntfy/v2/server"
+	"heckel.io/ntfy/v2/test"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"path/filepath"
+	"testing"
+)
+
+func TestClient_Account_TokensAndSubscriptions(t *testing.T) {
+	s, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	// Sign up and log in
+	require.Nil(t, c.CreateAccount(&client.AccountCreateRequest{Username: "phil", Password: "mypass"}))
+	account, err := c.Account(client.WithBasicAuth("phil", "mypass"))
+	require.Nil(t, err)
+	require.Equal(t, "phil", account.Username)
+	require.Equal(t, "user", account.Role)
+	require.NotNil(t, account.Limits)
+
+	// Tokens
+	token, err := c.CreateToken(&client.AccountTokenIssueRequest{Label: util.String("laptop")}, client.WithBasicAuth("phil", "mypass"))
+	require.Nil(t, err)
+	require.NotEmpty(t, token.Token)
+	require.Equal(t, "laptop", token.Label)
+
+	token, err = c.UpdateToken(&client.AccountTokenUpdateRequest{Token: token.Token, Label: util.String("desktop")}, client.WithBearerAuth(token.Token))
+	require.Nil(t, err)
+	require.Equal(t, "desktop", token.Label)
+
+	account, err = c.Account(client.WithBearerAuth(token.Token))
+	require.Nil(t, err)
+	require.Equal(t, "phil", account.Username)
+	require.Equal(t, 1, len(account.Tokens))
+	require.Equal(t, "desktop", account.Tokens[0].Label)
+
+	require.Nil(t, c.DeleteToken(token.Token, client.WithBasicAuth("phil", "mypass")))
+	_, err = c.Account(client.WithBearerAuth(token.Token))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "40101")
+
+	// Settings and subscriptions
+	require.Nil(t, c.ChangeSettings(&client.AccountSettings{
+		Language: util.String("de"),
+		Notification: &client.AccountNotificationPrefs{
+			QuietHours: []*client.AccountQuietHours{{Start: "22:00", End: "07:00"}},
+		},
+	}, client.WithBasicAuth("phil", "mypass")))
+	sub, err := c.AddSubscription(&client.AccountSubscription{BaseURL: "http://abc.com", Topic: "mytopic"}, client.WithBasicAuth("phil", "mypass"))
+	require.Nil(t, err)
+	require.Equal(t, "mytopic", sub.Topic)
+	sub, err = c.UpdateSubscription(&client.AccountSubscription{BaseURL: "http://abc.com", Topic: "mytopic", DisplayName: util.String("My Topic")}, client.WithBasicAuth("phil", "mypass"))
+	require.Nil(t, err)
+	require.Equal(t, "My Topic", *sub.DisplayName)
+
+	account, err = c.Account(client.WithBasicAuth("phil", "mypass"))
+	require.Nil(t, err)
+	require.Equal(t, "de", account.Language)
+	require.Equal(t, "22:00", account.Notification.QuietHours[0].Start)
+	require.Equal(t, 1, len(account.Subscriptions))
+	require.Equal(t, "My Topic", *account.Subscriptions[0].DisplayName)
+
+	require.Nil(t, c.DeleteSubscription("http://abc.com", "mytopic", client.WithBasicAuth("phil", "mypass")))
+	account, err = c.Account(client.WithBasicAuth("phil", "mypass"))
+	require.Nil(t, err)
+	require.Equal(t, 0, len(account.Subscriptions))
+
+	// Password change and deletion
+	require.Nil(t, c.ChangePassword(&client.AccountPasswordChangeRequest{Password: "mypass", NewPassword: "newpass"}, client.WithBasicAuth("phil", "mypass")))
+	require.Nil(t, c.DeleteAccount(&client.AccountDeleteRequest{Password: "newpass"}, client.WithBasicAuth("phil", "newpass")))
+	_, err = c.Account(client.WithBasicAuth("phil", "newpass"))
+	require.Error(t, err)
+}
+
+func TestClient_Account_Reservations(t *testing.T) {
+	s, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	require.Nil(t, c.AddReservation(&client.AccountReservationRequest{Topic: "mytopic", Everyone: "read-only"}, client.WithBasicAuth("admin", "admin")))
+	account, err := c.Account(client.WithBasicAuth("admin", "admin"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(account.Reservations))
+	require.Equal(t, "mytopic", account.Reservations[0].Topic)
+	require.Equal(t, "read-only", account.Reservations[0].Everyone)
+
+	_, err = c.Publish("mytopic", "some message", client.WithBasicAuth("admin", "admin"))
+	require.Nil(t, err)
+
+	require.Nil(t, c.DeleteReservation("mytopic", true, client.WithBasicAuth("admin", "admin")))
+	account, err = c.Account(client.WithBasicAuth("admin", "admin"))
+	require.Nil(t, err)
+	require.Equal(t, 0, len(account.Reservations))
+}
+
+func TestClient_Users(t *testing.T) {
+	s, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	require.Nil(t, c.AddUser(&client.UserAddRequest{Username: "ben", Password: "ben"}, client.WithBasicAuth("admin", "admin")))
+	require.Nil(t, c.AllowAccess(&client.AccessAllowRequest{Username: "ben", Topic: "sometopic*", Permission: "read-write"}, client.WithBasicAuth("admin", "admin")))
+
+	users, err := c.Users(client.WithBasicAuth("admin", "admin"))
+	require.Nil(t, err)
+	ben := findUser(users, "ben")
+	require.NotNil(t, ben)
+	require.Equal(t, "user", ben.Role)
+	require.Equal(t, 1, len(ben.Grants))
+	require.Equal(t, "sometopic*", ben.Grants[0].Topic)
+	require.Equal(t, "read-write", ben.Grants[0].Permission)
+
+	// Regular users cannot use the admin API
+	_, err = c.Users(client.WithBasicAuth("ben", "ben"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "40101")
+
+	require.Nil(t, c.ResetAccess(&client.AccessResetRequest{Username: "ben", Topic: "sometopic*"}, client.WithBasicAuth("admin", "admin")))
+	require.Nil(t, c.DeleteUser(&client.UserDeleteRequest{Username: "ben"}, client.WithBasicAuth("admin", "admin")))
+	users, err = c.Users(client.WithBasicAuth("admin", "admin"))
+	require.Nil(t, err)
+	require.Nil(t, findUser(users, "ben"))
+}
+
+func newTestServerWithAuth(t *testing.T) (s *server.Server, port int) {
+	conf := server.NewConfig()
+	conf.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.EnableSignup = true
+	conf.EnableLogin = true
+	conf.EnableReservations = true
+	s, port = test.StartServerWithConfig(t, conf)
+	manager, err := user.NewManager(conf.AuthFile, "", conf.AuthDefault, user.DefaultUserPasswordBcryptCost, user.DefaultUserStatsQueueWriterInterval)
+	require.Nil(t, err)
+	require.Nil(t, manager.AddUser("admin", "admin", user.RoleAdmin))
+	require.Nil(t, manager.Close())
+	return s, port
+}
+
+func findUser(users []*client.UserResponse, username string) *client.UserResponse {
+	for _, u := range users {
+		if u.Username == username {
+			return u
+		}
+	}
+	return nil
+}
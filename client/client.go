@@ -3,13 +3,16 @@ package client
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gorilla/websocket"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
 	"io"
+	"math/rand"
 	"net/http"
 	"regexp"
 	"strings"
@@ -22,8 +25,18 @@ const (
 	MessageEvent = "message"
 )
 
+// Transports that can be used to subscribe to topics, see Config.Transport
 const (
-	maxResponseBytes = 4096
+	TransportJSON      = "json" // JSON stream (/json), default
+	TransportSSE       = "sse"  // Server-sent events (/sse)
+	TransportWebSocket = "ws"   // WebSocket (/ws)
+)
+
+const (
+	maxResponseBytes         = 4096
+	retryBackoffMin          = time.Second
+	retryBackoffMax          = time.Minute
+	retryBackoffMaxDoublings = 16 // Avoids overflows when shifting
 )
 
 var (
@@ -35,27 +48,35 @@ type Client struct {
 	Messages      chan *Message
 	config        *Config
 	subscriptions map[string]*subscription
+	lastIDs       map[string]string    // Subscription key -> last seen message ID, see subscriptionKey
+	keys          map[string]*TopicKey // Topic URL -> key for end-to-end encryption, see topicKey
 	mu            sync.Mutex
 }
 
 // Message is a struct that represents a ntfy message
 type Message struct { // TODO combine with server.message
-	ID         string
-	Event      string
-	Time       int64
-	Topic      string
-	Message    string
-	Title      string
-	Priority   int
-	Tags       []string
-	Click      string
-	Icon       string
-	Attachment *Attachment
+	ID          string      `json:"id"`
+	Event       string      `json:"event"`
+	Time        int64       `json:"time"`
+	Expires     int64       `json:"expires,omitempty"`
+	Topic       string      `json:"topic"`
+	Message     string      `json:"message,omitempty"`
+	Title       string      `json:"title,omitempty"`
+	Priority    int         `json:"priority,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	Click       string      `json:"click,omitempty"`
+	Icon        string      `json:"icon,omitempty"`
+	Actions     []*Action   `json:"actions,omitempty"`
+	Attachment  *Attachment `json:"attachment,omitempty"`
+	PollID      string      `json:"poll_id,omitempty"`
+	ContentType string      `json:"content_type,omitempty"` // text/plain by default (if empty), or text/markdown
+	Encoding    string      `json:"encoding,omitempty"`     // empty for raw UTF-8, "base64" for encoded bytes, or "jwe" for encrypted messages
 
 	// Additional fields
-	TopicURL       string
-	SubscriptionID string
-	Raw            string
+	TopicURL       string `json:"-"`
+	SubscriptionID string `json:"-"`
+	Raw            string `json:"-"`
+	Encrypted      bool   `json:"-"` // True if the message was end-to-end encrypted, and has been decrypted
 }
 
 // Attachment represents a message attachment
@@ -65,7 +86,41 @@ type Attachment struct {
 	Size    int64  `json:"size,omitempty"`
 	Expires int64  `json:"expires,omitempty"`
 	URL     string `json:"url"`
-	Owner   string `json:"-"` // IP address of uploader, used for rate limiting
+	Preview string `json:"preview,omitempty"` // URL of a downscaled preview image, if available
+	Owner   string `json:"-"`                 // IP address of uploader, used for rate limiting
+}
+
+// Action represents a user action button of a message, see https://ntfy.sh/docs/publish/#action-buttons
+type Action struct {
+	ID      string            `json:"id,omitempty"`
+	Action  string            `json:"action"`            // "view", "broadcast", "http" or "ack"
+	Label   string            `json:"label"`             // action button label
+	Clear   bool              `json:"clear,omitempty"`   // clear notification after successful execution
+	URL     string            `json:"url,omitempty"`     // used in "view" and "http" actions, set by the server for "ack" actions
+	Method  string            `json:"method,omitempty"`  // used in "http" action, default is POST (!)
+	Headers map[string]string `json:"headers,omitempty"` // used in "http" action
+	Body    string            `json:"body,omitempty"`    // used in "http" action
+	Intent  string            `json:"intent,omitempty"`  // used in "broadcast" action
+	Extras  map[string]string `json:"extras,omitempty"`  // used in "broadcast" action
+}
+
+// PublishMessage is the message that is sent to the server when publishing as JSON, see Client.PublishJSON
+type PublishMessage struct {
+	Topic    string    `json:"topic"`
+	Title    string    `json:"title,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Priority int       `json:"priority,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	Click    string    `json:"click,omitempty"`
+	Icon     string    `json:"icon,omitempty"`
+	Actions  []*Action `json:"actions,omitempty"`
+	Attach   string    `json:"attach,omitempty"`
+	Markdown bool      `json:"markdown,omitempty"`
+	Filename string    `json:"filename,omitempty"`
+	Email    string    `json:"email,omitempty"`
+	Call     string    `json:"call,omitempty"`
+	Delay    string    `json:"delay,omitempty"`
+	Encoding string    `json:"encoding,omitempty"`
 }
 
 type subscription struct {
@@ -74,12 +129,21 @@ type subscription struct {
 	cancel   context.CancelFunc
 }
 
-// New creates a new Client using a given Config
+// New creates a new Client using a given Config. If Config.StateFile is set, the last seen message ID of every
+// subscription is loaded from and stored in this file, so that subscriptions resume where they left off, even
+// after the process was restarted.
 func New(config *Config) *Client {
+	lastIDs, err := loadState(config.StateFile)
+	if err != nil {
+		log.Warn("Cannot load client state from %s, starting with empty state: %s", config.StateFile, err.Error())
+		lastIDs = make(map[string]string)
+	}
 	return &Client{
 		Messages:      make(chan *Message, 50), // Allow reading a few messages
 		config:        config,
 		subscriptions: make(map[string]*subscription),
+		lastIDs:       lastIDs,
+		keys:          make(map[string]*TopicKey),
 	}
 }
 
@@ -97,6 +161,9 @@ func (c *Client) Publish(topic, message string, options ...PublishOption) (*Mess
 //
 // To pass title, priority and tags, check out WithTitle, WithPriority, WithTagsList, WithDelay, WithNoCache,
 // WithNoFirebase, and the generic WithHeader.
+//
+// If a key for the topic is configured (see Config.Keys), the message is end-to-end encrypted: title, message
+// and attachment are encrypted with the key, so that the server cannot read them.
 func (c *Client) PublishReader(topic string, body io.Reader, options ...PublishOption) (*Message, error) {
 	topicURL, err := c.expandTopicURL(topic)
 	if err != nil {
@@ -111,7 +178,73 @@ func (c *Client) PublishReader(topic string, body io.Reader, options ...PublishO
 			return nil, err
 		}
 	}
+	key, err := c.topicKey(topicURL)
+	if err != nil {
+		return nil, err
+	} else if key != nil {
+		if err := encryptRequest(req, key); err != nil {
+			return nil, err
+		}
+	}
 	log.Debug("%s Publishing message with headers %s", util.ShortTopicURL(topicURL), req.Header)
+	m, err := performPublishRequest(req, topicURL)
+	if err != nil {
+		return nil, err
+	}
+	c.maybeDecryptMessage(m)
+	return m, nil
+}
+
+// PublishJSON sends a message as JSON to the root URL of the server, instead of using HTTP headers. This is
+// useful if the message contains characters that cannot be represented in HTTP headers. The topic of the message
+// follows the same rules as in PublishReader, i.e. it can be a full URL, a short URL or a short topic name.
+//
+// Options can be used to pass additional headers, e.g. WithBasicAuth, WithNoCache or WithTemplate.
+func (c *Client) PublishJSON(m *PublishMessage, options ...PublishOption) (*Message, error) {
+	topicURL, err := c.expandTopicURL(m.Topic)
+	if err != nil {
+		return nil, err
+	}
+	baseURL, topic, err := splitTopicURL(topicURL)
+	if err != nil {
+		return nil, err
+	}
+	pm := *m
+	pm.Topic = topic
+	key, err := c.topicKey(topicURL)
+	if err != nil {
+		return nil, err
+	} else if key != nil {
+		if pm.Message, err = encryptMessage(key, pm.Title, pm.Message, ""); err != nil {
+			return nil, err
+		}
+		pm.Title = ""
+		pm.Encoding = EncodingJWE
+	}
+	b, err := json.Marshal(&pm)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", baseURL, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, option := range options {
+		if err := option(req); err != nil {
+			return nil, err
+		}
+	}
+	log.Debug("%s Publishing message as JSON", util.ShortTopicURL(topicURL))
+	published, err := performPublishRequest(req, topicURL)
+	if err != nil {
+		return nil, err
+	}
+	c.maybeDecryptMessage(published)
+	return published, nil
+}
+
+func performPublishRequest(req *http.Request, topicURL string) (*Message, error) {
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -152,7 +285,13 @@ func (c *Client) Poll(topic string, options ...SubscribeOption) ([]*Message, err
 	log.Debug("%s Polling from topic", util.ShortTopicURL(topicURL))
 	options = append(options, WithPoll())
 	go func() {
-		err := performSubscribeRequest(ctx, msgChan, topicURL, "", options...)
+		err := performSubscribeRequest(ctx, topicURL, "", TransportJSON, func(m *Message) error {
+			if m.Event == MessageEvent {
+				c.maybeDecryptMessage(m)
+				msgChan <- m
+			}
+			return nil
+		}, options...)
 		close(msgChan)
 		errChan <- err
 	}()
@@ -196,7 +335,7 @@ func (c *Client) Subscribe(topic string, options ...SubscribeOption) (string, er
 		topicURL: topicURL,
 		cancel:   cancel,
 	}
-	go handleSubscribeConnLoop(ctx, c.Messages, topicURL, subscriptionID, options...)
+	go c.handleSubscribeConnLoop(ctx, topicURL, subscriptionID, options...)
 	return subscriptionID, nil
 }
 
@@ -213,6 +352,152 @@ func (c *Client) Unsubscribe(subscriptionID string) {
 	sub.cancel()
 }
 
+// DownloadAttachment downloads the attachment of the given message. If the message was end-to-end encrypted,
+// the attachment is decrypted with the topic key.
+func (c *Client) DownloadAttachment(m *Message, options ...RequestOption) ([]byte, error) {
+	if m.Attachment == nil || m.Attachment.URL == "" {
+		return nil, errors.New("message has no attachment")
+	}
+	req, err := http.NewRequest(http.MethodGet, m.Attachment.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		if err := option(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New(strings.TrimSpace(string(b)))
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	} else if !m.Encrypted {
+		return b, nil
+	}
+	key, err := c.topicKey(messageTopicURL(m))
+	if err != nil {
+		return nil, err
+	} else if key == nil {
+		return nil, fmt.Errorf("no key for topic %s", m.Topic)
+	}
+	return Decrypt(key, string(b))
+}
+
+// topicKey returns the key used to encrypt and decrypt messages of the given topic, or nil if no key is
+// configured for the topic. Keys are cached, since deriving a key from a passphrase is deliberately slow.
+func (c *Client) topicKey(topicURL string) (*TopicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[topicURL]; ok {
+		return key, nil
+	}
+	for _, k := range c.config.Keys {
+		keyTopicURL, err := c.expandTopicURL(k.Topic)
+		if err != nil {
+			return nil, err
+		} else if keyTopicURL != topicURL {
+			continue
+		}
+		var key *TopicKey
+		if k.KeyFile != "" {
+			b, err := LoadKeyFile(k.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			if key, err = NewTopicKey(b); err != nil {
+				return nil, err
+			}
+		} else {
+			key = NewPassphraseTopicKey(k.Passphrase)
+		}
+		c.keys[topicURL] = key
+		return key, nil
+	}
+	c.keys[topicURL] = nil
+	return nil, nil
+}
+
+// maybeDecryptMessage decrypts the message if it is end-to-end encrypted, and a key for its topic is configured.
+// If the message cannot be decrypted, it is passed on as is.
+func (c *Client) maybeDecryptMessage(m *Message) {
+	if m.Encoding != EncodingJWE {
+		return
+	}
+	topicURL := messageTopicURL(m)
+	key, err := c.topicKey(topicURL)
+	if err != nil {
+		log.Warn("%s Cannot load key: %s", util.ShortTopicURL(topicURL), err.Error())
+		return
+	} else if key == nil {
+		log.Debug("%s Message %s is encrypted, but no key is configured", util.ShortTopicURL(topicURL), m.ID)
+		return
+	}
+	if err := decryptMessage(key, m); err != nil {
+		log.Warn("%s Cannot decrypt message %s: %s", util.ShortTopicURL(topicURL), m.ID, err.Error())
+	}
+}
+
+// messageTopicURL returns the URL of the message's topic. This may differ from the subscription's topic URL
+// for wildcard subscriptions, e.g. https://ntfy.sh/alerts-* -> https://ntfy.sh/alerts-db
+func messageTopicURL(m *Message) string {
+	if i := strings.LastIndex(m.TopicURL, "/"); i != -1 && m.Topic != "" {
+		return m.TopicURL[:i+1] + m.Topic
+	}
+	return m.TopicURL
+}
+
+// encryptRequest encrypts title, message and attachment of a publish request with the topic key. If a filename
+// is passed, the body is an attachment, which is encrypted as a whole, and the encrypted message is passed in the
+// X-Message header. Otherwise, the body is the message.
+func encryptRequest(req *http.Request, key *TopicKey) error {
+	if req.Header.Get("X-Template") != "" {
+		return errors.New("templates cannot be used with encrypted messages")
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return err
+		}
+	}
+	title, message, filename := req.Header.Get("X-Title"), req.Header.Get("X-Message"), req.Header.Get("X-Filename")
+	if filename == "" && len(body) > 0 {
+		message = string(body)
+	}
+	encrypted, err := encryptMessage(key, title, message, filename)
+	if err != nil {
+		return err
+	}
+	if filename != "" {
+		attachment, err := Encrypt(key, body)
+		if err != nil {
+			return err
+		}
+		body = []byte(attachment)
+		req.Header.Set("X-Message", encrypted)
+		req.Header.Set("X-Filename", jweEncryptedAttachment) // The file name is part of the encrypted message
+	} else {
+		body = []byte(encrypted)
+		req.Header.Del("X-Message")
+	}
+	req.Header.Del("X-Title")
+	req.Header.Set("X-Encoding", EncodingJWE)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return nil
+}
+
 func (c *Client) expandTopicURL(topic string) (string, error) {
 	if strings.HasPrefix(topic, "http://") || strings.HasPrefix(topic, "https://") {
 		return topic, nil
@@ -225,24 +510,94 @@ func (c *Client) expandTopicURL(topic string) (string, error) {
 	return fmt.Sprintf("%s/%s", c.config.DefaultHost, topic), nil
 }
 
-func handleSubscribeConnLoop(ctx context.Context, msgChan chan *Message, topicURL, subcriptionID string, options ...SubscribeOption) {
+// splitTopicURL splits a topic URL (e.g. https://ntfy.sh/mytopic) into the base URL (https://ntfy.sh)
+// and the topic name (mytopic)
+func splitTopicURL(topicURL string) (baseURL string, topic string, err error) {
+	i := strings.LastIndex(topicURL, "/")
+	if i == -1 || !topicRegex.MatchString(topicURL[i+1:]) {
+		return "", "", fmt.Errorf("invalid topic URL: %s", topicURL)
+	}
+	return topicURL[:i], topicURL[i+1:], nil
+}
+
+func (c *Client) handleSubscribeConnLoop(ctx context.Context, topicURL, subscriptionID string, options ...SubscribeOption) {
+	key, err := subscriptionKey(topicURL, options...)
+	if err != nil {
+		log.Warn("%s Cannot subscribe: %s", util.ShortTopicURL(topicURL), err.Error())
+		return
+	}
+	attempt := 0
 	for {
-		// TODO The retry logic is crude and may lose messages. It should record the last message like the
-		//      Android client, use since=, and do incremental backoff too
-		if err := performSubscribeRequest(ctx, msgChan, topicURL, subcriptionID, options...); err != nil {
+		connected, err := c.performSubscribeConn(ctx, topicURL, subscriptionID, key, options...)
+		if err != nil && ctx.Err() == nil {
 			log.Warn("%s Connection failed: %s", util.ShortTopicURL(topicURL), err.Error())
 		}
+		if connected {
+			attempt = 0 // Reset backoff if the connection was successfully established
+		}
+		delay := retryBackoff(attempt)
+		attempt++
 		select {
 		case <-ctx.Done():
 			log.Info("%s Connection exited", util.ShortTopicURL(topicURL))
 			return
-		case <-time.After(10 * time.Second): // TODO Add incremental backoff
+		case <-time.After(delay):
+			log.Debug("%s Reconnecting after %s", util.ShortTopicURL(topicURL), delay.String())
+		}
+	}
+}
+
+// performSubscribeConn opens a single connection using the configured transport, and forwards all messages
+// to the Messages channel until the connection fails. If the client has seen messages of this subscription
+// before, it resumes after the last seen message (since=<id>), so that no messages are lost when reconnecting.
+// If no event (including keepalive events) arrives within the keepalive timeout, the connection is considered
+// dead and closed. It returns true if the connection was established, i.e. at least one event was received.
+func (c *Client) performSubscribeConn(ctx context.Context, topicURL, subscriptionID, key string, options ...SubscribeOption) (connected bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var watchdog *time.Timer
+	if c.config.KeepaliveTimeout > 0 {
+		watchdog = time.AfterFunc(c.config.KeepaliveTimeout, func() {
+			log.Info("%s No keepalive received within %s, closing connection", util.ShortTopicURL(topicURL), c.config.KeepaliveTimeout.String())
+			cancel()
+		})
+		defer watchdog.Stop()
+	}
+	if lastID := c.lastMessageID(key); lastID != "" {
+		log.Debug("%s Resuming after message %s", util.ShortTopicURL(topicURL), lastID)
+		options = append(options, withSinceReplaced(lastID))
+	}
+	handle := func(m *Message) error {
+		connected = true
+		if watchdog != nil {
+			watchdog.Reset(c.config.KeepaliveTimeout)
+		}
+		if m.Event != MessageEvent {
+			return nil
+		}
+		c.maybeDecryptMessage(m)
+		select {
+		case c.Messages <- m:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+		c.setLastMessageID(key, m.ID)
+		return nil
 	}
+	switch c.config.Transport {
+	case TransportWebSocket:
+		err = performWebSocketRequest(ctx, topicURL, subscriptionID, handle, options...)
+	case TransportSSE:
+		err = performSubscribeRequest(ctx, topicURL, subscriptionID, TransportSSE, handle, options...)
+	default:
+		err = performSubscribeRequest(ctx, topicURL, subscriptionID, TransportJSON, handle, options...)
+	}
+	return connected, err
 }
 
-func performSubscribeRequest(ctx context.Context, msgChan chan *Message, topicURL string, subscriptionID string, options ...SubscribeOption) error {
-	streamURL := fmt.Sprintf("%s/json", topicURL)
+// performSubscribeRequest reads a JSON (/json) or server-sent events (/sse) stream, and calls handle for every event
+func performSubscribeRequest(ctx context.Context, topicURL, subscriptionID, transport string, handle func(m *Message) error, options ...SubscribeOption) error {
+	streamURL := fmt.Sprintf("%s/%s", topicURL, transport)
 	log.Debug("%s Listening to %s", util.ShortTopicURL(topicURL), streamURL)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
 	if err != nil {
@@ -268,16 +623,82 @@ func performSubscribeRequest(ctx context.Context, msgChan chan *Message, topicUR
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
 		messageJSON := scanner.Text()
+		if transport == TransportSSE {
+			if !strings.HasPrefix(messageJSON, "data: ") {
+				continue // Skip "event:" lines and empty lines
+			}
+			messageJSON = strings.TrimPrefix(messageJSON, "data: ")
+		}
 		m, err := toMessage(messageJSON, topicURL, subscriptionID)
 		if err != nil {
 			return err
 		}
 		log.Trace("%s Message received: %s", util.ShortTopicURL(topicURL), messageJSON)
-		if m.Event == MessageEvent {
-			msgChan <- m
+		if err := handle(m); err != nil {
+			return err
 		}
 	}
-	return nil
+	return scanner.Err()
+}
+
+// performWebSocketRequest reads from the WebSocket (/ws) endpoint, and calls handle for every event
+func performWebSocketRequest(ctx context.Context, topicURL, subscriptionID string, handle func(m *Message) error, options ...SubscribeOption) error {
+	streamURL := fmt.Sprintf("%s/ws", topicURL)
+	log.Debug("%s Listening to %s", util.ShortTopicURL(topicURL), streamURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if err != nil {
+		return err
+	}
+	for _, option := range options {
+		if err := option(req); err != nil {
+			return err
+		}
+	}
+	wsURL := *req.URL
+	if wsURL.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	} else {
+		wsURL.Scheme = "ws"
+	}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL.String(), req.Header)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			defer resp.Body.Close()
+			if b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes)); err == nil && len(b) > 0 {
+				return errors.New(strings.TrimSpace(string(b)))
+			}
+		}
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close() // Unblocks ReadMessage if the context is cancelled, e.g. by the keepalive watchdog
+	}()
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		m, err := toMessage(string(b), topicURL, subscriptionID)
+		if err != nil {
+			return err
+		}
+		log.Trace("%s Message received: %s", util.ShortTopicURL(topicURL), string(b))
+		if err := handle(m); err != nil {
+			return err
+		}
+	}
+}
+
+// retryBackoff returns the delay before the next connection attempt: the delay doubles with every
+// failed attempt (up to retryBackoffMax), and is randomized to avoid many clients reconnecting at the same time
+func retryBackoff(attempt int) time.Duration {
+	backoff := retryBackoffMax
+	if attempt < retryBackoffMaxDoublings && retryBackoffMin<<attempt < retryBackoffMax {
+		backoff = retryBackoffMin << attempt
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
 }
 
 func toMessage(s, topicURL, subscriptionID string) (*Message, error) {
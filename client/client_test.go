@@ -6,7 +6,12 @@ import (
 	"heckel.io/ntfy/v2/client"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/test"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -101,12 +106,264 @@ func TestClient_Publish_Poll(t *testing.T) {
 	require.Equal(t, "some delayed message", messages[1].Message)
 }
 
+func TestClient_Publish_Options(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	msg, err := c.Publish("mytopic", "**some** message",
+		client.WithMarkdown(),
+		client.WithActionButtons([]*client.Action{
+			{Action: "view", Label: "Open portal", URL: "https://door.lan", Clear: true},
+			{Action: "http", Label: "Open door", URL: "https://door.lan/open", Method: "PUT", Headers: map[string]string{"X-Door": "front"}},
+		}))
+	require.Nil(t, err)
+	require.Equal(t, "text/markdown", msg.ContentType)
+	require.Equal(t, 2, len(msg.Actions))
+	require.Equal(t, "view", msg.Actions[0].Action)
+	require.Equal(t, "Open portal", msg.Actions[0].Label)
+	require.True(t, msg.Actions[0].Clear)
+	require.Equal(t, "PUT", msg.Actions[1].Method)
+	require.Equal(t, "front", msg.Actions[1].Headers["X-Door"])
+	require.True(t, msg.Expires > time.Now().Unix())
+
+	msg, err = c.Publish("mytopic", `{"temperature": 65}`,
+		client.WithTemplate(),
+		client.WithTitle("Temperature"),
+		client.WithMessage("It is {{.temperature}} degrees"))
+	require.Nil(t, err)
+	require.Equal(t, "It is 65 degrees", msg.Message)
+
+	msg, err = c.Publish("mytopic", "", client.WithPollID("abc123"))
+	require.Nil(t, err)
+	require.Equal(t, "poll_request", msg.Event)
+	require.Equal(t, "abc123", msg.PollID)
+
+	msg, err = c.Publish("mytopic", "\x00\x01\xff", client.WithUnifiedPush())
+	require.Nil(t, err)
+	require.Equal(t, "base64", msg.Encoding)
+
+	_, err = c.Publish("mytopic", "some message", client.WithCall("+12223334444"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "40032")
+}
+
+func TestClient_PublishJSON(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	msg, err := c.PublishJSON(&client.PublishMessage{
+		Topic:    "mytopic",
+		Title:    "some title",
+		Message:  "some message",
+		Priority: 5,
+		Tags:     []string{"tag1", "tag2"},
+		Click:    "https://example.com",
+		Actions: []*client.Action{
+			{Action: "broadcast", Label: "Do it", Extras: map[string]string{"cmd": "pause"}},
+		},
+	}, client.WithNoFirebase())
+	require.Nil(t, err)
+	require.Equal(t, "mytopic", msg.Topic)
+	require.Equal(t, "some title", msg.Title)
+	require.Equal(t, "some message", msg.Message)
+	require.Equal(t, 5, msg.Priority)
+	require.Equal(t, []string{"tag1", "tag2"}, msg.Tags)
+	require.Equal(t, "https://example.com", msg.Click)
+	require.Equal(t, 1, len(msg.Actions))
+	require.Equal(t, "pause", msg.Actions[0].Extras["cmd"])
+
+	// Full topic URL
+	msg, err = c.PublishJSON(&client.PublishMessage{
+		Topic:    fmt.Sprintf("http://127.0.0.1:%d/othertopic", port),
+		Message:  "some *markdown*",
+		Markdown: true,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "othertopic", msg.Topic)
+	require.Equal(t, "text/markdown", msg.ContentType)
+
+	messages, err := c.Poll("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "some *markdown*", messages[0].Message)
+
+	_, err = c.PublishJSON(&client.PublishMessage{Topic: "invalid topic!"})
+	require.Error(t, err)
+}
+
+func TestClient_Publish_Subscribe_Encrypted(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	conf := newTestConfig(port)
+	conf.Keys = []client.Key{{Topic: "secret", Passphrase: "correct horse battery staple"}}
+	c := client.New(conf)
+
+	subscriptionID, _ := c.Subscribe("secret")
+	time.Sleep(time.Second)
+
+	msg, err := c.Publish("secret", "the eagle has landed", client.WithTitle("Top secret"), client.WithPriority("high"))
+	require.Nil(t, err)
+	require.Equal(t, "the eagle has landed", msg.Message)
+	require.Equal(t, "Top secret", msg.Title)
+	require.True(t, msg.Encrypted)
+
+	msg = waitForMessage(t, c)
+	require.Equal(t, "the eagle has landed", msg.Message)
+	require.Equal(t, "Top secret", msg.Title)
+	require.Equal(t, 4, msg.Priority)
+	require.Equal(t, "", msg.Encoding)
+	require.True(t, msg.Encrypted)
+	require.NotContains(t, msg.Raw, "eyJ") // Raw JSON of the decrypted message
+	c.Unsubscribe(subscriptionID)
+
+	// The server (and clients without the key) only see the encrypted message
+	messages, err := client.New(newTestConfig(port)).Poll("secret")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, client.EncodingJWE, messages[0].Encoding)
+	require.Equal(t, "", messages[0].Title)
+	require.NotContains(t, messages[0].Message, "eagle")
+	require.False(t, messages[0].Encrypted)
+
+	// Clients with the wrong key cannot decrypt the message
+	wrongConf := newTestConfig(port)
+	wrongConf.Keys = []client.Key{{Topic: "secret", Passphrase: "wrong passphrase"}}
+	messages, err = client.New(wrongConf).Poll("secret")
+	require.Nil(t, err)
+	require.Equal(t, client.EncodingJWE, messages[0].Encoding)
+
+	// Publishing as JSON
+	msg, err = c.PublishJSON(&client.PublishMessage{
+		Topic:   "secret",
+		Title:   "JSON title",
+		Message: "JSON message",
+	})
+	require.Nil(t, err)
+	require.Equal(t, "JSON message", msg.Message)
+	require.Equal(t, "JSON title", msg.Title)
+	messages, err = c.Poll("secret")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "JSON message", messages[1].Message)
+
+	// Templates cannot be used with encrypted messages
+	_, err = c.Publish("secret", `{"a":1}`, client.WithTemplate())
+	require.Error(t, err)
+}
+
+func TestClient_Subscribe_Transports(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+
+	for _, transport := range []string{client.TransportJSON, client.TransportSSE, client.TransportWebSocket} {
+		conf := newTestConfig(port)
+		conf.Transport = transport
+		c := client.New(conf)
+		subscriptionID, err := c.Subscribe("mytopic-" + transport)
+		require.Nil(t, err)
+		time.Sleep(300 * time.Millisecond)
+
+		_, err = c.Publish("mytopic-"+transport, "message via "+transport, client.WithTitle("some title"))
+		require.Nil(t, err)
+
+		msg := waitForMessage(t, c)
+		require.Equal(t, "message via "+transport, msg.Message, transport)
+		require.Equal(t, "some title", msg.Title, transport)
+		require.Equal(t, subscriptionID, msg.SubscriptionID, transport)
+		c.Unsubscribe(subscriptionID)
+	}
+}
+
+func TestClient_Subscribe_ResumeAfterReconnect(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch connections.Add(1) {
+		case 1:
+			require.Equal(t, "all", r.URL.Query().Get("since"))
+			fmt.Fprintln(w, `{"id":"open00000001","time":1,"event":"open","topic":"mytopic"}`)
+			fmt.Fprintln(w, `{"id":"msg000000001","time":2,"event":"message","topic":"mytopic","message":"message 1"}`)
+			// Connection is closed here, e.g. because of a network blip
+		case 2:
+			require.Equal(t, "msg000000001", r.URL.Query().Get("since"))
+			require.Equal(t, "4", r.URL.Query().Get("priority"))
+			fmt.Fprintln(w, `{"id":"open00000002","time":3,"event":"open","topic":"mytopic"}`)
+			fmt.Fprintln(w, `{"id":"msg000000002","time":4,"event":"message","topic":"mytopic","message":"message 2"}`)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	conf := client.NewConfig()
+	conf.StateFile = filepath.Join(t.TempDir(), "state.json")
+	c := client.New(conf)
+	subscriptionID, err := c.Subscribe(server.URL+"/mytopic", client.WithPriorityFilter(4), client.WithSinceAll())
+	require.Nil(t, err)
+	require.Equal(t, "message 1", waitForMessage(t, c).Message)
+	require.Equal(t, "message 2", waitForMessage(t, c).Message)
+	c.Unsubscribe(subscriptionID)
+	require.Equal(t, int32(2), connections.Load())
+
+	// State is persisted, a new client resumes after the last message
+	state, err := os.ReadFile(conf.StateFile)
+	require.Nil(t, err)
+	require.Contains(t, string(state), `"msg000000002"`)
+
+	var since atomic.Value
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since.Store(r.URL.Query().Get("since"))
+		<-r.Context().Done()
+	}))
+	defer server2.Close()
+	require.Nil(t, os.WriteFile(conf.StateFile, []byte(strings.ReplaceAll(string(state), server.URL, server2.URL)), 0600))
+	c = client.New(conf)
+	subscriptionID, err = c.Subscribe(server2.URL+"/mytopic", client.WithPriorityFilter(4), client.WithSinceAll())
+	require.Nil(t, err)
+	defer c.Unsubscribe(subscriptionID)
+	require.Eventually(t, func() bool {
+		return since.Load() == "msg000000002"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestClient_Subscribe_KeepaliveTimeout(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections.Add(1)
+		fmt.Fprintln(w, `{"id":"open00000001","time":1,"event":"open","topic":"mytopic"}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // Dead connection: no keepalive messages
+	}))
+	defer server.Close()
+
+	conf := client.NewConfig()
+	conf.KeepaliveTimeout = 300 * time.Millisecond
+	c := client.New(conf)
+	subscriptionID, err := c.Subscribe(server.URL + "/mytopic")
+	require.Nil(t, err)
+	defer c.Unsubscribe(subscriptionID)
+	require.Eventually(t, func() bool {
+		return connections.Load() >= 2
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
 func newTestConfig(port int) *client.Config {
 	c := client.NewConfig()
 	c.DefaultHost = fmt.Sprintf("http://127.0.0.1:%d", port)
 	return c
 }
 
+func waitForMessage(t *testing.T, c *client.Client) *client.Message {
+	select {
+	case m := <-c.Messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for message")
+		return nil
+	}
+}
+
 func nextMessage(c *client.Client) *client.Message {
 	select {
 	case m := <-c.Messages:
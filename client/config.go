@@ -1,24 +1,43 @@
 package client
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"heckel.io/ntfy/v2/log"
 	"os"
+	"time"
 )
 
 const (
 	// DefaultBaseURL is the base URL used to expand short topic names
 	DefaultBaseURL = "https://ntfy.sh"
+
+	// DefaultKeepaliveTimeout is the time after which a subscription connection is considered dead if no
+	// keepalive was received. It is a little more than twice the server's default keepalive interval (45s).
+	DefaultKeepaliveTimeout = 100 * time.Second
 )
 
 // Config is the config struct for a Client
 type Config struct {
-	DefaultHost     string      `yaml:"default-host"`
-	DefaultUser     string      `yaml:"default-user"`
-	DefaultPassword *string     `yaml:"default-password"`
-	DefaultToken    string      `yaml:"default-token"`
-	DefaultCommand  string      `yaml:"default-command"`
-	Subscribe       []Subscribe `yaml:"subscribe"`
+	DefaultHost      string        `yaml:"default-host"`
+	DefaultUser      string        `yaml:"default-user"`
+	DefaultPassword  *string       `yaml:"default-password"`
+	DefaultToken     string        `yaml:"default-token"`
+	DefaultCommand   string        `yaml:"default-command"`
+	Transport        string        `yaml:"transport"`         // Subscription transport, see TransportJSON, TransportSSE and TransportWebSocket
+	KeepaliveTimeout time.Duration `yaml:"keepalive-timeout"` // Reconnect if no keepalive was received in this time, 0 to disable
+	StateFile        string        `yaml:"state-file"`        // File to persist last seen message IDs, empty to keep them in memory only
+	Keys             []Key         `yaml:"keys"`              // Topic keys for end-to-end encryption
+	Subscribe        []Subscribe   `yaml:"subscribe"`
+}
+
+// Key is the struct for an end-to-end encryption key within Config. Messages published to the topic are encrypted
+// with the key, and messages received from the topic are decrypted. The key is either read from a key file,
+// or derived from a passphrase, see LoadKeyFile and DeriveKey.
+type Key struct {
+	Topic      string `yaml:"topic"`
+	KeyFile    string `yaml:"key-file"`
+	Passphrase string `yaml:"passphrase"`
 }
 
 // Subscribe is the struct for a Subscription within Config
@@ -34,12 +53,16 @@ type Subscribe struct {
 // NewConfig creates a new Config struct for a Client
 func NewConfig() *Config {
 	return &Config{
-		DefaultHost:     DefaultBaseURL,
-		DefaultUser:     "",
-		DefaultPassword: nil,
-		DefaultToken:    "",
-		DefaultCommand:  "",
-		Subscribe:       nil,
+		DefaultHost:      DefaultBaseURL,
+		DefaultUser:      "",
+		DefaultPassword:  nil,
+		DefaultToken:     "",
+		DefaultCommand:   "",
+		Transport:        TransportJSON,
+		KeepaliveTimeout: DefaultKeepaliveTimeout,
+		StateFile:        "",
+		Keys:             nil,
+		Subscribe:        nil,
 	}
 }
 
@@ -54,5 +77,13 @@ func LoadConfig(filename string) (*Config, error) {
 	if err := yaml.Unmarshal(b, c); err != nil {
 		return nil, err
 	}
+	if c.Transport != TransportJSON && c.Transport != TransportSSE && c.Transport != TransportWebSocket {
+		return nil, fmt.Errorf("invalid transport %s, must be json, sse or ws", c.Transport)
+	}
+	for _, k := range c.Keys {
+		if k.Topic == "" || (k.KeyFile == "") == (k.Passphrase == "") {
+			return nil, fmt.Errorf("invalid key for topic %s, must have a topic, and either a key-file or a passphrase", k.Topic)
+		}
+	}
 	return c, nil
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestConfig_Load(t *testing.T) {
@@ -138,3 +139,60 @@ subscribe:
 	require.Nil(t, conf.Subscribe[0].Password)
 	require.Nil(t, conf.Subscribe[0].Token)
 }
+
+func TestConfig_TransportAndState(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "client.yml")
+	require.Nil(t, os.WriteFile(filename, []byte(`
+default-host: http://localhost
+transport: ws
+keepalive-timeout: 3m
+state-file: /var/lib/ntfy/client-state.json
+`), 0600))
+
+	conf, err := client.LoadConfig(filename)
+	require.Nil(t, err)
+	require.Equal(t, client.TransportWebSocket, conf.Transport)
+	require.Equal(t, 3*time.Minute, conf.KeepaliveTimeout)
+	require.Equal(t, "/var/lib/ntfy/client-state.json", conf.StateFile)
+
+	require.Nil(t, os.WriteFile(filename, []byte(`
+transport: carrier-pigeon
+`), 0600))
+	_, err = client.LoadConfig(filename)
+	require.Equal(t, "invalid transport carrier-pigeon, must be json, sse or ws", err.Error())
+}
+
+func TestConfig_Keys(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "client.yml")
+	require.Nil(t, os.WriteFile(filename, []byte(`
+keys:
+  - topic: mytopic
+    key-file: /etc/ntfy/mytopic.key
+  - topic: ntfy.example.com/alerts
+    passphrase: correct horse battery staple
+`), 0600))
+
+	conf, err := client.LoadConfig(filename)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(conf.Keys))
+	require.Equal(t, "mytopic", conf.Keys[0].Topic)
+	require.Equal(t, "/etc/ntfy/mytopic.key", conf.Keys[0].KeyFile)
+	require.Equal(t, "ntfy.example.com/alerts", conf.Keys[1].Topic)
+	require.Equal(t, "correct horse battery staple", conf.Keys[1].Passphrase)
+
+	require.Nil(t, os.WriteFile(filename, []byte(`
+keys:
+  - topic: mytopic
+    key-file: /etc/ntfy/mytopic.key
+    passphrase: correct horse battery staple
+`), 0600))
+	_, err = client.LoadConfig(filename)
+	require.Equal(t, "invalid key for topic mytopic, must have a topic, and either a key-file or a passphrase", err.Error())
+}
+
+func TestConfig_Defaults(t *testing.T) {
+	conf := client.NewConfig()
+	require.Equal(t, client.TransportJSON, conf.Transport)
+	require.Equal(t, client.DefaultKeepaliveTimeout, conf.KeepaliveTimeout)
+	require.Equal(t, "", conf.StateFile)
+}
@@ -0,0 +1,288 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// EncodingJWE identifies an end-to-end encrypted message, see Message.Encoding
+	EncodingJWE = "jwe"
+
+	// KeySize is the size of a topic key in bytes (AES-256)
+	KeySize = 32
+)
+
+const (
+	jweAlgorithm           = "dir"     // The topic key is used directly as content encryption key
+	jweEncryption          = "A256GCM" // AES-256 in GCM mode
+	jweEncryptedAttachment = "attachment.jwe"
+
+	// Argon2id parameters for keys derived from a passphrase, see RFC 9106, section 4 (second recommended option)
+	keyDerivationTime    = 3
+	keyDerivationMemory  = 64 * 1024 // In KiB
+	keyDerivationThreads = 4
+
+	keyDerivationSaltSize   = 16
+	keyDerivationCachedKeys = 100 // Max. number of derived keys cached for decryption, see TopicKey.decryptionKey
+)
+
+var (
+	errInvalidJWE = errors.New("invalid JWE, must be compact serialization with alg \"dir\" and enc \"A256GCM\"")
+)
+
+// jweHeader is the protected header of a JWE, see RFC 7516. If the key was derived from a passphrase, the random
+// salt is passed in the (non-standard) "salt" field, so that the recipient can derive the same key.
+type jweHeader struct {
+	Alg  string `json:"alg"`
+	Enc  string `json:"enc"`
+	Salt string `json:"salt,omitempty"`
+}
+
+// TopicKey is the key used to encrypt and decrypt the messages of a topic. It is either a fixed key (e.g. read from
+// a key file, see LoadKeyFile), or derived from a passphrase. For passphrases, a random salt is chosen when the first
+// message is encrypted, and passed along with every message. Recipients derive (and cache) the key for each salt.
+type TopicKey struct {
+	key        []byte            // Fixed key, or key derived with salt (for encryption)
+	salt       []byte            // Salt of key, nil for fixed keys or if no message was encrypted yet
+	passphrase string            // Passphrase, empty for fixed keys
+	derived    map[string][]byte // Salt -> derived key, for decryption
+	mu         sync.Mutex
+}
+
+// encryptedMessage is the plaintext of an encrypted message. Title and attachment metadata are encrypted along
+// with the message, so that the server does not learn anything about the content.
+type encryptedMessage struct {
+	Title      string               `json:"title,omitempty"`
+	Message    string               `json:"message"`
+	Attachment *encryptedAttachment `json:"attachment,omitempty"`
+}
+
+type encryptedAttachment struct {
+	Name string `json:"name"`
+}
+
+// NewTopicKey creates a topic key from a fixed 32-byte key
+func NewTopicKey(key []byte) (*TopicKey, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key, must be %d bytes", KeySize)
+	}
+	return &TopicKey{key: key}, nil
+}
+
+// NewPassphraseTopicKey creates a topic key from a passphrase. The key itself is only derived when it is first
+// needed, see DeriveKey.
+func NewPassphraseTopicKey(passphrase string) *TopicKey {
+	return &TopicKey{
+		passphrase: passphrase,
+		derived:    make(map[string][]byte),
+	}
+}
+
+// DeriveKey derives a key from a passphrase and a salt, using Argon2id. Deriving a key is deliberately slow
+// and memory-intensive, to make guessing the passphrase expensive.
+func DeriveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, keyDerivationTime, keyDerivationMemory, keyDerivationThreads, KeySize)
+}
+
+// encryptionKey returns the key and the salt (nil for fixed keys) used to encrypt messages. The salt is chosen
+// randomly the first time, and then reused, so that the key is only derived once.
+func (k *TopicKey) encryptionKey() (key []byte, salt []byte, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.passphrase == "" || k.salt != nil {
+		return k.key, k.salt, nil
+	}
+	salt = make([]byte, keyDerivationSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	k.key, k.salt = DeriveKey(k.passphrase, salt), salt
+	return k.key, k.salt, nil
+}
+
+// decryptionKey returns the key to decrypt a message with the given salt (nil if the message has none). Keys
+// derived from a passphrase are cached per salt, since all messages of a publisher usually share the same salt.
+func (k *TopicKey) decryptionKey(salt []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.passphrase == "" {
+		if salt != nil {
+			return nil, errors.New("cannot decrypt message, message was encrypted with a passphrase, but key is not")
+		}
+		return k.key, nil
+	} else if len(salt) != keyDerivationSaltSize {
+		return nil, errors.New("cannot decrypt message, salt missing or invalid")
+	}
+	if key, ok := k.derived[string(salt)]; ok {
+		return key, nil
+	}
+	if len(k.derived) >= keyDerivationCachedKeys {
+		clear(k.derived)
+	}
+	key := DeriveKey(k.passphrase, salt)
+	k.derived[string(salt)] = key
+	return key, nil
+}
+
+// LoadKeyFile reads a topic key from a file. The file must contain the base64-encoded 32-byte key,
+// e.g. as created by "head -c 32 /dev/urandom | base64".
+func LoadKeyFile(filename string) ([]byte, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	encoded := strings.TrimRight(strings.TrimSpace(string(b)), "=")
+	key, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file %s, key must be base64-encoded", filename)
+		}
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key file %s, key must be %d bytes, but is %d bytes", filename, KeySize, len(key))
+	}
+	return key, nil
+}
+
+// Encrypt encrypts the plaintext with the given topic key, and returns a JWE in compact serialization
+// (RFC 7516), using direct encryption with AES-256-GCM
+func Encrypt(topicKey *TopicKey, plaintext []byte) (string, error) {
+	key, salt, err := topicKey.encryptionKey()
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	header := &jweHeader{Alg: jweAlgorithm, Enc: jweEncryption}
+	if salt != nil {
+		header.Salt = base64.RawURLEncoding.EncodeToString(salt)
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	encodedHeader := base64.RawURLEncoding.EncodeToString(headerJSON)
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(encodedHeader)) // The encoded header is the additional authenticated data
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	return strings.Join([]string{
+		encodedHeader,
+		"", // No encrypted key for direct encryption
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// Decrypt decrypts a JWE in compact serialization that was created with Encrypt
+func Decrypt(topicKey *TopicKey, jwe string) ([]byte, error) {
+	parts := strings.Split(strings.TrimSpace(jwe), ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return nil, errInvalidJWE
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidJWE
+	}
+	var header jweHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != jweAlgorithm || header.Enc != jweEncryption {
+		return nil, errInvalidJWE
+	}
+	var salt []byte
+	if header.Salt != "" {
+		if salt, err = base64.RawURLEncoding.DecodeString(header.Salt); err != nil {
+			return nil, errInvalidJWE
+		}
+	}
+	key, err := topicKey.decryptionKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(iv) != gcm.NonceSize() {
+		return nil, errInvalidJWE
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, errInvalidJWE
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil || len(tag) != gcm.Overhead() {
+		return nil, errInvalidJWE
+	}
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return nil, errors.New("cannot decrypt message, wrong key or message was tampered with")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key, must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptMessage encrypts title, message and attachment name of a message into a single JWE
+func encryptMessage(key *TopicKey, title, message, attachmentName string) (string, error) {
+	em := &encryptedMessage{
+		Title:   title,
+		Message: message,
+	}
+	if attachmentName != "" {
+		em.Attachment = &encryptedAttachment{Name: attachmentName}
+	}
+	b, err := json.Marshal(em)
+	if err != nil {
+		return "", err
+	}
+	return Encrypt(key, b)
+}
+
+// decryptMessage decrypts an encrypted message in place, see encryptMessage
+func decryptMessage(key *TopicKey, m *Message) error {
+	b, err := Decrypt(key, m.Message)
+	if err != nil {
+		return err
+	}
+	var em encryptedMessage
+	if err := json.Unmarshal(b, &em); err != nil {
+		return err
+	}
+	m.Title = em.Title
+	m.Message = em.Message
+	if m.Attachment != nil && em.Attachment != nil {
+		m.Attachment.Name = em.Attachment.Name
+	}
+	m.Encoding = ""
+	m.Encrypted = true
+	if raw, err := json.Marshal(m); err == nil {
+		m.Raw = string(raw) // Raw JSON of the decrypted message, e.g. printed by "ntfy subscribe"
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package client_test
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/client"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := client.NewPassphraseTopicKey("correct horse battery staple")
+
+	jwe, err := client.Encrypt(key, []byte("secret message"))
+	require.Nil(t, err)
+	require.Equal(t, 5, len(strings.Split(jwe, ".")))
+	require.NotContains(t, jwe, "secret")
+
+	plaintext, err := client.Decrypt(key, jwe)
+	require.Nil(t, err)
+	require.Equal(t, "secret message", string(plaintext))
+
+	// Other clients with the same passphrase can decrypt the message (the salt is part of the header)
+	plaintext, err = client.Decrypt(client.NewPassphraseTopicKey("correct horse battery staple"), jwe)
+	require.Nil(t, err)
+	require.Equal(t, "secret message", string(plaintext))
+
+	// Wrong passphrase, fixed key, tampered message, and not a JWE
+	_, err = client.Decrypt(client.NewPassphraseTopicKey("wrong passphrase"), jwe)
+	require.Error(t, err)
+	fixedKey, err := client.NewTopicKey(make([]byte, client.KeySize))
+	require.Nil(t, err)
+	_, err = client.Decrypt(fixedKey, jwe)
+	require.Error(t, err)
+	parts := strings.Split(jwe, ".")
+	parts[3] = base64.RawURLEncoding.EncodeToString([]byte("tampered message"))
+	_, err = client.Decrypt(key, strings.Join(parts, "."))
+	require.Error(t, err)
+	_, err = client.Decrypt(key, "not a JWE")
+	require.Error(t, err)
+	_, err = client.NewTopicKey([]byte("too short"))
+	require.Error(t, err)
+}
+
+func TestEncryptDecrypt_FixedKey(t *testing.T) {
+	key, err := client.NewTopicKey(make([]byte, client.KeySize))
+	require.Nil(t, err)
+	jwe, err := client.Encrypt(key, []byte("secret message"))
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(jwe, "eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIn0.")) // {"alg":"dir","enc":"A256GCM"}, no salt
+	plaintext, err := client.Decrypt(key, jwe)
+	require.Nil(t, err)
+	require.Equal(t, "secret message", string(plaintext))
+
+	// Passphrase keys cannot decrypt messages without salt
+	_, err = client.Decrypt(client.NewPassphraseTopicKey("correct horse battery staple"), jwe)
+	require.Error(t, err)
+}
+
+func TestEncrypt_RandomSalt(t *testing.T) {
+	key1 := client.NewPassphraseTopicKey("passphrase")
+	key2 := client.NewPassphraseTopicKey("passphrase")
+	jwe1, err := client.Encrypt(key1, []byte("message 1"))
+	require.Nil(t, err)
+	jwe2, err := client.Encrypt(key1, []byte("message 2"))
+	require.Nil(t, err)
+	jwe3, err := client.Encrypt(key2, []byte("message 3"))
+	require.Nil(t, err)
+	header := func(jwe string) string {
+		return strings.Split(jwe, ".")[0]
+	}
+	require.Equal(t, header(jwe1), header(jwe2))    // The salt is reused for the same key
+	require.NotEqual(t, header(jwe1), header(jwe3)) // ... but is random for every key
+}
+
+func TestDeriveKey(t *testing.T) {
+	key1 := client.DeriveKey("passphrase", []byte("salt1234salt1234"))
+	key2 := client.DeriveKey("passphrase", []byte("salt1234salt1234"))
+	key3 := client.DeriveKey("passphrase", []byte("othersaltothersa"))
+	require.Equal(t, client.KeySize, len(key1))
+	require.Equal(t, key1, key2)
+	require.NotEqual(t, key1, key3)
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	key := make([]byte, client.KeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	filename := filepath.Join(t.TempDir(), "mytopic.key")
+	require.Nil(t, os.WriteFile(filename, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	loaded, err := client.LoadKeyFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, key, loaded)
+
+	require.Nil(t, os.WriteFile(filename, []byte(base64.RawURLEncoding.EncodeToString(key)), 0600))
+	loaded, err = client.LoadKeyFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, key, loaded)
+
+	require.Nil(t, os.WriteFile(filename, []byte(base64.StdEncoding.EncodeToString(key[:16])), 0600))
+	_, err = client.LoadKeyFile(filename)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "key must be 32 bytes")
+
+	require.Nil(t, os.WriteFile(filename, []byte("not base64!"), 0600))
+	_, err = client.LoadKeyFile(filename)
+	require.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"encoding/json"
 	"fmt"
 	"heckel.io/ntfy/v2/util"
 	"net/http"
@@ -67,6 +68,22 @@ func WithActions(value string) PublishOption {
 	return WithHeader("X-Actions", value)
 }
 
+// WithActionButtons adds custom user actions to the notification. Unlike WithActions, this option takes
+// a list of typed actions, which are sent to the server as JSON.
+func WithActionButtons(actions []*Action) PublishOption {
+	return func(r *http.Request) error {
+		if len(actions) == 0 {
+			return nil
+		}
+		b, err := json.Marshal(actions)
+		if err != nil {
+			return err
+		}
+		r.Header.Set("X-Actions", string(b))
+		return nil
+	}
+}
+
 // WithAttach sets a URL that will be used by the client to download an attachment
 func WithAttach(attach string) PublishOption {
 	return WithHeader("X-Attach", attach)
@@ -77,6 +94,18 @@ func WithMarkdown() PublishOption {
 	return WithHeader("X-Markdown", "yes")
 }
 
+// WithContentType sets the content type of the message, e.g. "text/markdown". Note that the HTTP body is treated
+// as an attachment if the content type is not a text type.
+func WithContentType(contentType string) PublishOption {
+	return WithHeader("Content-Type", contentType)
+}
+
+// WithTemplate instructs the server to interpret the message and title as templates, and fill them with
+// the values of the JSON body. See https://ntfy.sh/docs/publish/#message-templating for details.
+func WithTemplate() PublishOption {
+	return WithHeader("X-Template", "yes")
+}
+
 // WithFilename sets a filename for the attachment, and/or forces the HTTP body to interpreted as an attachment
 func WithFilename(filename string) PublishOption {
 	return WithHeader("X-Filename", filename)
@@ -87,6 +116,24 @@ func WithEmail(email string) PublishOption {
 	return WithHeader("X-Email", email)
 }
 
+// WithCall instructs the server to also call the given phone number and read the message out loud. The number
+// must be verified in the user's account. Use "yes" to call the first verified phone number.
+func WithCall(number string) PublishOption {
+	return WithHeader("X-Call", number)
+}
+
+// WithUnifiedPush marks the message as a UnifiedPush message. These messages are not cached or forwarded to
+// Firebase, and binary message bodies are passed through as base64-encoded messages.
+func WithUnifiedPush() PublishOption {
+	return WithHeader("X-UnifiedPush", "1")
+}
+
+// WithPollID turns the message into a poll request, which instructs clients to poll the message with the given ID
+// from the server. This is used by servers to forward messages to iOS devices, and rarely needed otherwise.
+func WithPollID(pollID string) PublishOption {
+	return WithHeader("X-Poll-ID", pollID)
+}
+
 // WithBasicAuth adds the Authorization header for basic auth to the request
 func WithBasicAuth(user, pass string) PublishOption {
 	return WithHeader("Authorization", util.BasicAuth(user, pass))
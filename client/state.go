@@ -0,0 +1,100 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"heckel.io/ntfy/v2/log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// state is the content of the state file, see Config.StateFile
+type state struct {
+	LastIDs map[string]string `json:"last_ids"` // Subscription key -> last seen message ID
+}
+
+// loadState reads the last seen message IDs from the state file. A missing state file is not an error.
+func loadState(filename string) (map[string]string, error) {
+	if filename == "" {
+		return make(map[string]string), nil
+	}
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]string), nil
+	} else if err != nil {
+		return nil, err
+	}
+	var s state
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if s.LastIDs == nil {
+		s.LastIDs = make(map[string]string)
+	}
+	return s.LastIDs, nil
+}
+
+// saveState writes the last seen message IDs to the state file. The file is replaced atomically,
+// so that it is never corrupted if the process is killed while writing.
+func saveState(filename string, lastIDs map[string]string) error {
+	b, err := json.Marshal(&state{LastIDs: lastIDs})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	tmpFile := filename + ".tmp"
+	if err := os.WriteFile(tmpFile, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+func (c *Client) lastMessageID(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastIDs[key]
+}
+
+func (c *Client) setLastMessageID(key, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastIDs[key] = id
+	if c.config.StateFile == "" {
+		return
+	}
+	if err := saveState(c.config.StateFile, c.lastIDs); err != nil {
+		log.Warn("Cannot write client state to %s: %s", c.config.StateFile, err.Error())
+	}
+}
+
+// subscriptionKey identifies a subscription in the state file. It is the topic URL, including all query
+// parameters set by the subscribe options (e.g. filters), except for the "since" parameter.
+func subscriptionKey(topicURL string, options ...SubscribeOption) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, topicURL, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, option := range options {
+		if err := option(req); err != nil {
+			return "", err
+		}
+	}
+	q := req.URL.Query()
+	q.Del("since")
+	req.URL.RawQuery = q.Encode()
+	return req.URL.String(), nil
+}
+
+// withSinceReplaced replaces the "since" parameter set by other options, so that a
+// subscription resumes after the given message ID
+func withSinceReplaced(id string) SubscribeOption {
+	return func(r *http.Request) error {
+		q := r.URL.Query()
+		q.Set("since", id)
+		r.URL.RawQuery = q.Encode()
+		return nil
+	}
+}
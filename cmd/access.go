@@ -8,6 +8,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"sort"
 )
 
 func init() {
@@ -47,7 +48,9 @@ Usage:
 
 Arguments:
   USERNAME     an existing user, as created with 'ntfy user add', or "everyone"/"*"
-               to define access rules for anonymous/unauthenticated clients
+               to define access rules for anonymous/unauthenticated clients, or
+               "group:NAME" to define access rules for a group, as created with
+               'ntfy group add', or for an LDAP group
   TOPIC        name of a topic with optional wildcards, e.g. "mytopic*"
   PERMISSION   one of the following:
                - read-write (alias: rw) 
@@ -61,6 +64,7 @@ Examples:
   ntfy access phil mytopic rw        # Allow read-write access to mytopic for user phil
   ntfy access everyone mytopic rw    # Allow anonymous read-write access to mytopic
   ntfy access everyone "up*" write   # Allow anonymous write-only access to topics "up..." 
+  ntfy access group:ops "alerts*" rw # Allow read-write access to topics "alerts..." for group ops
   ntfy access --reset                # Reset entire access control list
   ntfy access --reset phil           # Reset all access for user phil
   ntfy access --reset phil mytopic   # Reset access for user phil and topic mytopic
@@ -104,11 +108,13 @@ func changeAccess(c *cli.Context, manager *user.Manager, username string, topic
 	if err != nil {
 		return err
 	}
-	u, err := manager.User(username)
-	if err == user.ErrUserNotFound {
-		return fmt.Errorf("user %s does not exist", username)
-	} else if u.Role == user.RoleAdmin {
-		return fmt.Errorf("user %s is an admin user, access control entries have no effect", username)
+	if _, ok := user.GroupPrincipal(username); !ok {
+		u, err := manager.User(username)
+		if err == user.ErrUserNotFound {
+			return fmt.Errorf("user %s does not exist", username)
+		} else if u.Role == user.RoleAdmin {
+			return fmt.Errorf("user %s is an admin user, access control entries have no effect", username)
+		}
 	}
 	if err := manager.AllowAccess(username, topic, permission); err != nil {
 		return err
@@ -170,10 +176,48 @@ func showAllAccess(c *cli.Context, manager *user.Manager) error {
 	if err != nil {
 		return err
 	}
-	return showUsers(c, manager, users)
+	if err := showUsers(c, manager, users); err != nil {
+		return err
+	}
+	groups, err := manager.Groups()
+	if err != nil {
+		return err
+	}
+	groupGrants, err := manager.AllGroupGrants()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		printGroup(c, group, groupGrants[group.Name])
+		delete(groupGrants, group.Name)
+	}
+	directoryGroups := make([]string, 0, len(groupGrants)) // Groups with grants, but no local group, e.g. LDAP groups
+	for group := range groupGrants {
+		directoryGroups = append(directoryGroups, group)
+	}
+	sort.Strings(directoryGroups)
+	for _, group := range directoryGroups {
+		showGroup(c, group, groupGrants[group])
+	}
+	return nil
 }
 
 func showUserAccess(c *cli.Context, manager *user.Manager, username string) error {
+	if group, ok := user.GroupPrincipal(username); ok {
+		grants, err := manager.Grants(username)
+		if err != nil {
+			return err
+		}
+		localGroup, err := manager.Group(group)
+		if errors.Is(err, user.ErrGroupNotFound) {
+			showGroup(c, group, grants) // May be an LDAP group
+			return nil
+		} else if err != nil {
+			return err
+		}
+		printGroup(c, localGroup, grants)
+		return nil
+	}
 	users, err := manager.User(username)
 	if err == user.ErrUserNotFound {
 		return fmt.Errorf("user %s does not exist", username)
@@ -194,22 +238,13 @@ func showUsers(c *cli.Context, manager *user.Manager, users []*user.User) error
 			tier = u.Tier.Name
 		}
 		fmt.Fprintf(c.App.ErrWriter, "user %s (role: %s, tier: %s)\n", u.Name, u.Role, tier)
+		if len(u.AllowedIPs) > 0 {
+			fmt.Fprintf(c.App.ErrWriter, "- login only allowed from %s\n", formatAllowedIPs(u.AllowedIPs))
+		}
 		if u.Role == user.RoleAdmin {
 			fmt.Fprintf(c.App.ErrWriter, "- read-write access to all topics (admin role)\n")
-		} else if len(grants) > 0 {
-			for _, grant := range grants {
-				if grant.Allow.IsReadWrite() {
-					fmt.Fprintf(c.App.ErrWriter, "- read-write access to topic %s\n", grant.TopicPattern)
-				} else if grant.Allow.IsRead() {
-					fmt.Fprintf(c.App.ErrWriter, "- read-only access to topic %s\n", grant.TopicPattern)
-				} else if grant.Allow.IsWrite() {
-					fmt.Fprintf(c.App.ErrWriter, "- write-only access to topic %s\n", grant.TopicPattern)
-				} else {
-					fmt.Fprintf(c.App.ErrWriter, "- no access to topic %s\n", grant.TopicPattern)
-				}
-			}
 		} else {
-			fmt.Fprintf(c.App.ErrWriter, "- no topic-specific permissions\n")
+			showGrants(c, grants)
 		}
 		if u.Name == user.Everyone {
 			access := manager.DefaultAccess()
@@ -226,3 +261,26 @@ func showUsers(c *cli.Context, manager *user.Manager, users []*user.User) error
 	}
 	return nil
 }
+
+func showGroup(c *cli.Context, group string, grants []user.Grant) {
+	fmt.Fprintf(c.App.ErrWriter, "group %s\n", group)
+	showGrants(c, grants)
+}
+
+func showGrants(c *cli.Context, grants []user.Grant) {
+	if len(grants) == 0 {
+		fmt.Fprintf(c.App.ErrWriter, "- no topic-specific permissions\n")
+		return
+	}
+	for _, grant := range grants {
+		if grant.Allow.IsReadWrite() {
+			fmt.Fprintf(c.App.ErrWriter, "- read-write access to topic %s\n", grant.TopicPattern)
+		} else if grant.Allow.IsRead() {
+			fmt.Fprintf(c.App.ErrWriter, "- read-only access to topic %s\n", grant.TopicPattern)
+		} else if grant.Allow.IsWrite() {
+			fmt.Fprintf(c.App.ErrWriter, "- write-only access to topic %s\n", grant.TopicPattern)
+		} else {
+			fmt.Fprintf(c.App.ErrWriter, "- no access to topic %s\n", grant.TopicPattern)
+		}
+	}
+}
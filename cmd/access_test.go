@@ -76,6 +76,28 @@ user * (role: anonymous, tier: none)
 	}))
 }
 
+func TestCLI_Access_Group(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "group:ops", "alerts*", "rw"))
+	require.Nil(t, runAccessCommand(app, conf, "group:Domain Users", "alerts", "read"))
+	require.Error(t, runAccessCommand(app, conf, "group:(ops)", "alerts", "read"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "group:ops"))
+	require.Equal(t, "group ops\n- read-write access to topic alerts*\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf))
+	require.Contains(t, stderr.String(), "group Domain Users\n- read-only access to topic alerts\ngroup ops\n- read-write access to topic alerts*\n")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--reset", "group:ops"))
+	require.Contains(t, stderr.String(), "group ops\n- no topic-specific permissions\n")
+}
+
 func runAccessCommand(app *cli.App, conf *server.Config, args ...string) error {
 	userArgs := []string{
 		"ntfy",
@@ -0,0 +1,151 @@
+//go:build !noserver
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+	"heckel.io/ntfy/v2/server"
+	"heckel.io/ntfy/v2/util"
+)
+
+func init() {
+	commands = append(commands, cmdEncryption)
+}
+
+var flagsEncryption = append(
+	append([]cli.Flag{}, flagsDefault...),
+	&cli.StringFlag{Name: "config", Aliases: []string{"c"}, EnvVars: []string{"NTFY_CONFIG_FILE"}, Value: defaultServerConfigFile, DefaultText: defaultServerConfigFile, Usage: "config file"},
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "encryption-key-file", Aliases: []string{"encryption_key_file"}, EnvVars: []string{"NTFY_ENCRYPTION_KEY_FILE"}, Usage: "file with the keys used to encrypt messages and attachments at rest"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-file", Aliases: []string{"cache_file", "C"}, EnvVars: []string{"NTFY_CACHE_FILE"}, Usage: "cache file used for message caching, or PostgreSQL connection URL (postgres://...)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-duration", Aliases: []string{"cache_duration", "b"}, EnvVars: []string{"NTFY_CACHE_DURATION"}, Value: util.FormatDuration(server.DefaultCacheDuration), Usage: "buffer messages for this time to allow `since` requests"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-startup-queries", Aliases: []string{"cache_startup_queries"}, EnvVars: []string{"NTFY_CACHE_STARTUP_QUERIES"}, Usage: "queries run when the cache database is initialized"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-cache-dir", Aliases: []string{"attachment_cache_dir"}, EnvVars: []string{"NTFY_ATTACHMENT_CACHE_DIR"}, Usage: "cache directory for attached files"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-s3-url", Aliases: []string{"attachment_s3_url"}, EnvVars: []string{"NTFY_ATTACHMENT_S3_URL"}, Usage: "S3-compatible bucket for attached files"}),
+)
+
+var cmdEncryption = &cli.Command{
+	Name:      "encryption",
+	Usage:     "Rotate encryption keys and re-encrypt messages and attachments at rest",
+	UsageText: "ntfy encryption [rotate|reencrypt]",
+	Flags:     flagsEncryption,
+	Before:    initConfigFileInputSourceFunc("config", flagsEncryption, initLogFunc),
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "rotate",
+			Usage:     "Generates a new encryption key and re-encrypts all data with it",
+			UsageText: "ntfy encryption rotate",
+			Action:    execEncryptionRotate,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "no-reencrypt", Usage: "only generate the new key, do not re-encrypt existing data"},
+			},
+			Description: `Generate a new encryption key, and re-encrypt all messages and attachments with it.
+
+The new key is added to the top of the encryption key file, making it the primary key. The
+previous keys are kept in the file, so that data encrypted with them can still be decrypted. The
+key file is created if it does not exist.
+
+The ntfy server must be stopped while the keys are rotated, and started again afterwards. After
+a successful rotation, no data is encrypted with the previous keys anymore, so they may be
+removed from the key file.
+
+This is a server-only command. It directly reads from the cache file and attachment cache
+directory (or S3 bucket) as defined in the server config file server.yml. The command only works if
+'encryption-key-file' is properly defined.
+
+Examples:
+  ntfy encryption rotate                  # Generate a new key and re-encrypt all data
+  ntfy encryption rotate --no-reencrypt   # Only generate a new key, e.g. to enable encryption
+`,
+		},
+		{
+			Name:      "reencrypt",
+			Usage:     "Re-encrypts all data with the primary encryption key",
+			UsageText: "ntfy encryption reencrypt",
+			Action:    execEncryptionReencrypt,
+			Description: `Re-encrypt all messages and attachments with the primary encryption key.
+
+Messages and attachments that are not yet encrypted are encrypted, e.g. after encryption at rest
+was enabled for an existing server. The ntfy server should be stopped while data is re-encrypted.
+
+This is a server-only command. It directly reads from the cache file and attachment cache
+directory (or S3 bucket) as defined in the server config file server.yml. The command only works if
+'encryption-key-file' is properly defined.
+
+Example:
+  ntfy encryption reencrypt
+`,
+		},
+	},
+	Description: `Manage the encryption of messages and attachments at rest.
+
+If 'encryption-key-file' is set in the server config, message fields and attachments are
+encrypted before they are written to disk. Use these commands to rotate the encryption keys,
+and to re-encrypt existing data.
+
+This is a server-only command. It directly reads from the cache file and attachment cache
+directory (or S3 bucket) as defined in the server config file server.yml. The command only works if
+'encryption-key-file' is properly defined.
+
+Examples:
+  ntfy encryption rotate      # Generate a new key and re-encrypt all data
+  ntfy encryption reencrypt   # Re-encrypt all data with the primary key
+`,
+}
+
+func execEncryptionRotate(c *cli.Context) error {
+	conf, err := encryptionConfig(c)
+	if err != nil {
+		return err
+	}
+	keyID, err := server.RotateEncryptionKey(conf.EncryptionKeyFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "new encryption key %s added to %s\n", keyID, conf.EncryptionKeyFile)
+	if c.Bool("no-reencrypt") {
+		return nil
+	}
+	return reencrypt(c, conf)
+}
+
+func execEncryptionReencrypt(c *cli.Context) error {
+	conf, err := encryptionConfig(c)
+	if err != nil {
+		return err
+	} else if !util.FileExists(conf.EncryptionKeyFile) {
+		return errors.New("encryption-key-file does not exist; use 'ntfy encryption rotate' to create it")
+	}
+	return reencrypt(c, conf)
+}
+
+func reencrypt(c *cli.Context, conf *server.Config) error {
+	messages, attachments, err := server.Reencrypt(conf)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "re-encrypted %d message(s) and %d attachment(s)\n", messages, attachments)
+	return nil
+}
+
+func encryptionConfig(c *cli.Context) (*server.Config, error) {
+	encryptionKeyFile := c.String("encryption-key-file")
+	cacheDuration, err := util.ParseDuration(c.String("cache-duration"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache duration: %s", c.String("cache-duration"))
+	} else if encryptionKeyFile == "" {
+		return nil, errors.New("option encryption-key-file not set; encryption at rest is unconfigured for this server")
+	}
+	conf := server.NewConfig()
+	conf.EncryptionKeyFile = encryptionKeyFile
+	conf.CacheFile = c.String("cache-file")
+	conf.CacheDuration = cacheDuration
+	conf.CacheStartupQueries = c.String("cache-startup-queries")
+	conf.AttachmentCacheDir = c.String("attachment-cache-dir")
+	conf.AttachmentS3URL = c.String("attachment-s3-url")
+	return conf, nil
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/v2/server"
+)
+
+func TestCLI_Encryption_RotateReencrypt(t *testing.T) {
+	conf := newTestEncryptionConfig(t)
+	conf.EncryptionKeyFile = filepath.Join(t.TempDir(), "encryption.keys")
+	conf.CacheFile = filepath.Join(t.TempDir(), "cache.db")
+	conf.AttachmentCacheDir = t.TempDir()
+
+	app, _, _, _ := newTestApp()
+	err := runEncryptionCommand(app, conf, "reencrypt")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "encryption-key-file does not exist")
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runEncryptionCommand(app, conf, "rotate"))
+	require.Contains(t, stderr.String(), "new encryption key ")
+	require.Contains(t, stderr.String(), "re-encrypted 0 message(s) and 0 attachment(s)")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runEncryptionCommand(app, conf, "rotate", "--no-reencrypt"))
+	require.Contains(t, stderr.String(), "new encryption key ")
+	require.NotContains(t, stderr.String(), "re-encrypted")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runEncryptionCommand(app, conf, "reencrypt"))
+	require.Equal(t, "re-encrypted 0 message(s) and 0 attachment(s)\n", stderr.String())
+}
+
+func TestCLI_Encryption_NoKeyFile(t *testing.T) {
+	app, _, _, _ := newTestApp()
+	err := runEncryptionCommand(app, newTestEncryptionConfig(t), "rotate")
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "option encryption-key-file not set"))
+}
+
+func newTestEncryptionConfig(t *testing.T) *server.Config {
+	configFile := filepath.Join(t.TempDir(), "server-dummy.yml")
+	require.Nil(t, os.WriteFile(configFile, []byte(""), 0600)) // Dummy config file to avoid lookup of real server.yml
+	conf := server.NewConfig()
+	conf.File = configFile
+	return conf
+}
+
+func runEncryptionCommand(app *cli.App, conf *server.Config, args ...string) error {
+	encryptionArgs := []string{
+		"ntfy",
+		"--log-level=ERROR",
+		"encryption",
+		"--config=" + conf.File, // Dummy config file to avoid lookups of real file
+		"--encryption-key-file=" + conf.EncryptionKeyFile,
+		"--cache-file=" + conf.CacheFile,
+		"--attachment-cache-dir=" + conf.AttachmentCacheDir,
+	}
+	return app.Run(append(encryptionArgs, args...))
+}
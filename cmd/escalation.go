@@ -0,0 +1,198 @@
+//go:build !noserver
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func init() {
+	commands = append(commands, cmdEscalation)
+}
+
+var flagsEscalation = append([]cli.Flag{}, flagsUser...)
+
+var cmdEscalation = &cli.Command{
+	Name:      "escalation",
+	Usage:     "Manage/show escalation policies",
+	UsageText: "ntfy escalation [list|add|remove] ...",
+	Flags:     flagsEscalation,
+	Before:    initConfigFileInputSourceFunc("config", flagsEscalation, initLogFunc),
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Adds a new escalation policy",
+			UsageText: "ntfy escalation add TOPIC STEP...",
+			Action:    execEscalationAdd,
+			Description: `Add a new escalation policy to the ntfy user database.
+
+For every message published to a topic matching TOPIC, the steps are executed one after the
+other, until the message is acknowledged via its "ack" action. TOPIC may contain '*' wildcards.
+Each step has the format [DELAY:]TYPE:TARGET, where DELAY is the time to wait after the previous
+step (or after the message was published), and TYPE is one of:
+
+  call     Call the phone number TARGET via Twilio (requires Twilio to be configured)
+  email    Send the message to the e-mail address TARGET (requires SMTP to be configured)
+  publish  Republish the message to the topic TARGET
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Examples:
+  ntfy escalation add pager 5m:call:+12223334444 email:oncall@example.com
+  ntfy escalation add "alerts-*" 10m:publish:oncall 30m:call:+12223334444
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes an escalation policy",
+			UsageText: "ntfy escalation remove ID",
+			Action:    execEscalationDel,
+			Description: `Remove an escalation policy from the ntfy user database.
+
+Running escalations of this policy are stopped.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Example:
+  ntfy escalation del es_Gk5Rxc3SIHeJ
+`,
+		},
+		{
+			Name:    "list",
+			Aliases: []string{"l"},
+			Usage:   "Shows a list of escalation policies",
+			Action:  execEscalationList,
+			Description: `Shows a list of all escalation policies.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+`,
+		},
+	},
+	Description: `Manage escalation policies of the ntfy server.
+
+Escalation policies define what happens if a message is not acknowledged: e.g. call a phone
+number if a message was not acknowledged within 5 minutes, and then send an e-mail. Messages
+published to a topic with an escalation policy get an "ack" action button, which stops the
+escalation.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Examples:
+  ntfy escalation list                                              # Shows all escalation policies
+  ntfy escalation add pager 5m:call:+12223334444 email:c@example.com   # Call, then e-mail
+  ntfy escalation del es_Gk5Rxc3SIHeJ                               # Delete an escalation policy
+`,
+}
+
+func execEscalationAdd(c *cli.Context) error {
+	topic := c.Args().Get(0)
+	if topic == "" || c.Args().Len() < 2 {
+		return errors.New("topic and at least one step expected, type 'ntfy escalation add --help' for help")
+	} else if !user.AllowedTopicPattern(topic) {
+		return errors.New("topic must consist only of numbers, letters, dashes, underscores and wildcards (*)")
+	}
+	policy := &user.EscalationPolicy{
+		Topic: topic,
+		Steps: make([]*user.EscalationStep, 0),
+	}
+	for _, s := range c.Args().Slice()[1:] {
+		step, err := parseEscalationStep(s)
+		if err != nil {
+			return err
+		}
+		policy.Steps = append(policy.Steps, step)
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.AddEscalationPolicy(policy); errors.Is(err, user.ErrInvalidArgument) {
+		return errors.New("invalid escalation policy, type 'ntfy escalation add --help' for help")
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "escalation policy added\n\n")
+	printEscalationPolicy(c, policy)
+	return nil
+}
+
+func execEscalationDel(c *cli.Context) error {
+	id := c.Args().Get(0)
+	if id == "" {
+		return errors.New("escalation policy ID expected, type 'ntfy escalation del --help' for help")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.RemoveEscalationPolicy(id); errors.Is(err, user.ErrEscalationPolicyNotFound) {
+		return fmt.Errorf("escalation policy %s does not exist", id)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "escalation policy %s removed\n", id)
+	return nil
+}
+
+func execEscalationList(c *cli.Context) error {
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	policies, err := manager.EscalationPolicies()
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		fmt.Fprintf(c.App.ErrWriter, "no escalation policies\n")
+		return nil
+	}
+	for _, policy := range policies {
+		printEscalationPolicy(c, policy)
+	}
+	return nil
+}
+
+// parseEscalationStep parses a step in the format [DELAY:]TYPE:TARGET, e.g. "5m:call:+12223334444"
+func parseEscalationStep(s string) (*user.EscalationStep, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) == 2 {
+		parts = append([]string{"0"}, parts...)
+	} else if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid step %s, expected format [DELAY:]TYPE:TARGET", s)
+	}
+	delay, err := util.ParseDuration(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid delay in step %s", s)
+	}
+	step := &user.EscalationStep{
+		Delay:  delay,
+		Type:   parts[1],
+		Target: parts[2],
+	}
+	if !user.AllowedEscalationStep(step) {
+		return nil, fmt.Errorf("invalid step %s, type must be call, email or publish with a valid target", s)
+	}
+	return step, nil
+}
+
+func printEscalationPolicy(c *cli.Context, policy *user.EscalationPolicy) {
+	fmt.Fprintf(c.App.ErrWriter, "escalation policy for %s (id: %s)\n", policy.Topic, policy.ID)
+	for i, step := range policy.Steps {
+		fmt.Fprintf(c.App.ErrWriter, "- Step %d: %s %s after %s\n", i+1, step.Type, step.Target, step.Delay.Round(time.Second).String())
+	}
+}
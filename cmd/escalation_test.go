@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/v2/server"
+	"heckel.io/ntfy/v2/test"
+	"regexp"
+	"testing"
+)
+
+func TestCLI_Escalation_AddListRemove(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runEscalationCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "no escalation policies")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runEscalationCommand(app, conf, "add", "pager", "5m:call:+12223334444", "email:oncall@example.com"))
+	require.Contains(t, stderr.String(), "escalation policy added\n\nescalation policy for pager (id: es_")
+	require.Contains(t, stderr.String(), "- Step 1: call +12223334444 after 5m0s")
+	require.Contains(t, stderr.String(), "- Step 2: email oncall@example.com after 0s")
+	id := regexp.MustCompile(`\(id: (es_[A-Za-z0-9]+)\)`).FindStringSubmatch(stderr.String())[1]
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runEscalationCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "escalation policy for pager (id: "+id+")")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runEscalationCommand(app, conf, "remove", id))
+	require.Contains(t, stderr.String(), "escalation policy "+id+" removed")
+
+	app, _, _, _ = newTestApp()
+	err := runEscalationCommand(app, conf, "remove", id)
+	require.NotNil(t, err)
+	require.Equal(t, "escalation policy "+id+" does not exist", err.Error())
+}
+
+func TestCLI_Escalation_AddInvalid(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	err := runEscalationCommand(app, conf, "add", "pager")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "topic and at least one step expected")
+
+	app, _, _, _ = newTestApp()
+	err = runEscalationCommand(app, conf, "add", "pager", "5m:sms:+12223334444")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid step 5m:sms:+12223334444")
+
+	app, _, _, _ = newTestApp()
+	err = runEscalationCommand(app, conf, "add", "pager", "soon:publish:oncall")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid delay")
+}
+
+func runEscalationCommand(app *cli.App, conf *server.Config, args ...string) error {
+	userArgs := []string{
+		"ntfy",
+		"--log-level=ERROR",
+		"escalation",
+		"--config=" + conf.File, // Dummy config file to avoid lookups of real file
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + conf.AuthDefault.String(),
+	}
+	return app.Run(append(userArgs, args...))
+}
@@ -0,0 +1,231 @@
+//go:build !noserver
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/v2/user"
+	"strings"
+)
+
+func init() {
+	commands = append(commands, cmdGroup)
+}
+
+var cmdGroup = &cli.Command{
+	Name:      "group",
+	Usage:     "Manage/show groups",
+	UsageText: "ntfy group [list|add|remove|add-member|remove-member] ...",
+	Flags:     flagsUser,
+	Before:    initConfigFileInputSourceFunc("config", flagsUser, initLogFunc),
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Adds a new group",
+			UsageText: "ntfy group add GROUP [USERNAME...]",
+			Action:    execGroupAdd,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "ignore-exists", Usage: "if the group already exists, perform no action and exit"},
+			},
+			Description: `Add a new group to the ntfy user database, optionally with members.
+
+Access control entries can be granted to the group with 'ntfy access group:GROUP TOPIC PERMISSION'.
+They apply to all members of the group.
+
+Examples:
+  ntfy group add oncall             # Add group oncall
+  ntfy group add oncall phil ben    # Add group oncall with members phil and ben
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes a group",
+			UsageText: "ntfy group remove GROUP",
+			Action:    execGroupDel,
+			Description: `Remove a group from the ntfy user database.
+
+This also removes all access control entries of the group. Users are not removed.
+
+Example:
+  ntfy group del oncall
+`,
+		},
+		{
+			Name:      "add-member",
+			Aliases:   []string{"am"},
+			Usage:     "Adds users to a group",
+			UsageText: "ntfy group add-member GROUP USERNAME...",
+			Action:    execGroupAddMember,
+			Description: `Add one or more users to an existing group.
+
+Examples:
+  ntfy group add-member oncall phil       # Add user phil to group oncall
+  ntfy group add-member oncall ben emma   # Add users ben and emma to group oncall
+`,
+		},
+		{
+			Name:      "remove-member",
+			Aliases:   []string{"rm-member", "rmm"},
+			Usage:     "Removes users from a group",
+			UsageText: "ntfy group remove-member GROUP USERNAME...",
+			Action:    execGroupRemoveMember,
+			Description: `Remove one or more users from a group.
+
+Example:
+  ntfy group remove-member oncall phil
+`,
+		},
+		{
+			Name:    "list",
+			Aliases: []string{"l"},
+			Usage:   "Shows a list of groups",
+			Action:  execGroupList,
+			Description: `Shows a list of all groups, their members and access control entries.
+`,
+		},
+	},
+	Description: `Manage groups of the ntfy server.
+
+The command allows you to add/remove groups in the ntfy user database, and to add/remove
+group members. Access control entries granted to a group apply to all of its members, see
+'ntfy access'. Entries of a user take precedence over entries of the user's groups, which
+take precedence over entries of everyone.
+
+If LDAP authentication is enabled, access control entries can also be granted to LDAP groups.
+They do not have to be added with this command.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Examples:
+  ntfy group add oncall phil ben         # Add group oncall with members phil and ben
+  ntfy access group:oncall "alerts*" rw  # Allow read-write access to topics "alerts..." for group oncall
+  ntfy group add-member oncall emma      # Add user emma to group oncall
+  ntfy group remove-member oncall ben    # Remove user ben from group oncall
+  ntfy group del oncall                  # Delete group oncall
+`,
+}
+
+func execGroupAdd(c *cli.Context) error {
+	name := c.Args().Get(0)
+	if name == "" {
+		return errors.New("group name expected, type 'ntfy group add --help' for help")
+	} else if !user.AllowedGroup(name) {
+		return errors.New("group name invalid")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.AddGroup(name); errors.Is(err, user.ErrGroupExists) {
+		if c.Bool("ignore-exists") {
+			fmt.Fprintf(c.App.ErrWriter, "group %s already exists (exited successfully)\n", name)
+			return nil
+		}
+		return fmt.Errorf("group %s already exists", name)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "group %s added\n", name)
+	return addGroupMembers(c, manager, name, c.Args().Slice()[1:])
+}
+
+func execGroupDel(c *cli.Context) error {
+	name := c.Args().Get(0)
+	if name == "" {
+		return errors.New("group name expected, type 'ntfy group del --help' for help")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.RemoveGroup(name); errors.Is(err, user.ErrGroupNotFound) {
+		return fmt.Errorf("group %s does not exist", name)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "group %s removed\n", name)
+	return nil
+}
+
+func execGroupAddMember(c *cli.Context) error {
+	name := c.Args().Get(0)
+	if name == "" || c.NArg() < 2 {
+		return errors.New("group name and username(s) expected, type 'ntfy group add-member --help' for help")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	return addGroupMembers(c, manager, name, c.Args().Slice()[1:])
+}
+
+func execGroupRemoveMember(c *cli.Context) error {
+	name := c.Args().Get(0)
+	if name == "" || c.NArg() < 2 {
+		return errors.New("group name and username(s) expected, type 'ntfy group remove-member --help' for help")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	for _, username := range c.Args().Slice()[1:] {
+		if err := manager.RemoveGroupMember(name, username); errors.Is(err, user.ErrGroupNotFound) {
+			return fmt.Errorf("group %s does not exist", name)
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "user %s removed from group %s\n", username, name)
+	}
+	return nil
+}
+
+func execGroupList(c *cli.Context) error {
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	groups, err := manager.Groups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		grants, err := manager.Grants(user.GroupPrefix + group.Name)
+		if err != nil {
+			return err
+		}
+		printGroup(c, group, grants)
+	}
+	return nil
+}
+
+func addGroupMembers(c *cli.Context, manager *user.Manager, name string, usernames []string) error {
+	for _, username := range usernames {
+		if username == userEveryone || username == user.Everyone {
+			return errors.New("username not allowed")
+		}
+		if err := manager.AddGroupMember(name, username); errors.Is(err, user.ErrGroupNotFound) {
+			return fmt.Errorf("group %s does not exist", name)
+		} else if errors.Is(err, user.ErrUserNotFound) {
+			return fmt.Errorf("user %s does not exist", username)
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "user %s added to group %s\n", username, name)
+	}
+	return nil
+}
+
+func printGroup(c *cli.Context, group *user.Group, grants []user.Grant) {
+	members := "none"
+	if len(group.Members) > 0 {
+		members = strings.Join(group.Members, ", ")
+	}
+	fmt.Fprintf(c.App.ErrWriter, "group %s (members: %s)\n", group.Name, members)
+	showGrants(c, grants)
+}
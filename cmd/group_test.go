@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/v2/server"
+	"heckel.io/ntfy/v2/test"
+	"testing"
+)
+
+func TestCLI_Group_AddListRemove(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("philpass\nphilpass\nbenpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "add", "oncall", "phil"))
+	require.Equal(t, "group oncall added\nuser phil added to group oncall\n", stderr.String())
+	require.Nil(t, runGroupCommand(app, conf, "add-member", "oncall", "ben"))
+	require.Nil(t, runAccessCommand(app, conf, "group:oncall", "alerts*", "rw"))
+
+	err := runGroupCommand(app, conf, "add", "oncall")
+	require.NotNil(t, err)
+	require.Equal(t, "group oncall already exists", err.Error())
+	err = runGroupCommand(app, conf, "add-member", "oncall", "nobody")
+	require.NotNil(t, err)
+	require.Equal(t, "user nobody does not exist", err.Error())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "list"))
+	require.Equal(t, "group oncall (members: ben, phil)\n- read-write access to topic alerts*\n", stderr.String())
+
+	// Group members have access
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "ben:benpass",
+		fmt.Sprintf("http://127.0.0.1:%d/alerts-db", port),
+	}))
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "remove-member", "oncall", "ben"))
+	require.Nil(t, runAccessCommand(app, conf, "group:oncall"))
+	require.Contains(t, stderr.String(), "group oncall (members: phil)\n- read-write access to topic alerts*\n")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runGroupCommand(app, conf, "del", "oncall"))
+	require.Equal(t, "group oncall removed\n", stderr.String())
+	err = runGroupCommand(app, conf, "del", "oncall")
+	require.NotNil(t, err)
+	require.Equal(t, "group oncall does not exist", err.Error())
+}
+
+func runGroupCommand(app *cli.App, conf *server.Config, args ...string) error {
+	userArgs := []string{
+		"ntfy",
+		"--log-level=ERROR",
+		"group",
+		"--config=" + conf.File, // Dummy config file to avoid lookups of real file
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + conf.AuthDefault.String(),
+	}
+	return app.Run(append(userArgs, args...))
+}
@@ -50,6 +50,34 @@ func TestCLI_Publish_Subscribe_Poll(t *testing.T) {
 	require.Equal(t, "some message", m.Message)
 }
 
+func TestCLI_Publish_Subscribe_Poll_Encrypted(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	topic := fmt.Sprintf("http://127.0.0.1:%d/mytopic", port)
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--passphrase", "secret", "--title", "some title", topic, "some message"}))
+	m := toMessage(t, stdout.String())
+	require.Equal(t, "some message", m.Message)
+	require.Equal(t, "some title", m.Title)
+
+	app2, _, stdout, _ := newTestApp()
+	require.Nil(t, app2.Run([]string{"ntfy", "subscribe", "--poll", topic}))
+	m = toMessage(t, stdout.String())
+	require.Equal(t, "jwe", m.Encoding)
+	require.Equal(t, "", m.Title)
+
+	app3, _, stdout, _ := newTestApp()
+	require.Nil(t, app3.Run([]string{"ntfy", "subscribe", "--poll", "--passphrase", "secret", topic}))
+	m = toMessage(t, stdout.String())
+	require.Equal(t, "some message", m.Message)
+	require.Equal(t, "some title", m.Title)
+
+	app4, _, _, _ := newTestApp()
+	err := app4.Run([]string{"ntfy", "publish", "--passphrase", "secret", "--key-file", "secret.key", topic, "some message"})
+	require.Equal(t, "cannot set both --key-file and --passphrase", err.Error())
+}
+
 func TestCLI_Publish_All_The_Things(t *testing.T) {
 	s, port := test.StartServer(t)
 	defer test.StopServer(t, s, port)
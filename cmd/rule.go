@@ -0,0 +1,181 @@
+//go:build !noserver
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/v2/server"
+	"heckel.io/ntfy/v2/user"
+)
+
+func init() {
+	commands = append(commands, cmdRule)
+}
+
+var flagsRule = append([]cli.Flag{}, flagsUser...)
+
+var cmdRule = &cli.Command{
+	Name:      "rule",
+	Usage:     "Manage/show topic routing rules",
+	UsageText: "ntfy rule [list|add|remove] ...",
+	Flags:     flagsRule,
+	Before:    initConfigFileInputSourceFunc("config", flagsRule, initLogFunc),
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Adds a new routing rule",
+			UsageText: "ntfy rule add [OPTIONS] TOPIC TARGET",
+			Action:    execRuleAdd,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "filter", Aliases: []string{"f"}, Usage: "only route messages matching this filter expression"},
+				&cli.StringFlag{Name: "template", Aliases: []string{"t"}, Usage: "template for the routed message text"},
+				&cli.IntFlag{Name: "rate-limit", Usage: "max. number of routed messages per hour and publisher (default: 60)"},
+			},
+			Description: `Add a new routing rule to the ntfy user database.
+
+Messages published to a topic matching TOPIC are republished to the TARGET topic. TOPIC
+may contain '*' wildcards. If --filter is set, only messages matching the filter expression
+are routed (see https://ntfy.sh/docs/subscribe/api/#filter-expressions). If --template is set,
+the text of the routed message is rendered from the original message.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Examples:
+  ntfy rule add --filter="priority>=4" "ci-*" oncall       # Route high priority CI messages to oncall
+  ntfy rule add --filter="tags~db" alerts dba-team        # Route messages tagged "db" to dba-team
+  ntfy rule add --template="{{.topic}}: {{.message}}" \   # Route messages with the topic name prepended
+    "backup-*" backups
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes a routing rule",
+			UsageText: "ntfy rule remove ID",
+			Action:    execRuleDel,
+			Description: `Remove a routing rule from the ntfy user database.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Example:
+  ntfy rule del ru_SIHeJnGk5Rxc
+`,
+		},
+		{
+			Name:    "list",
+			Aliases: []string{"l"},
+			Usage:   "Shows a list of routing rules",
+			Action:  execRuleList,
+			Description: `Shows a list of all routing rules.
+
+This is a server-only command. It directly reads from user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+`,
+		},
+	},
+	Description: `Manage topic routing rules of the ntfy server.
+
+Routing rules republish messages from one topic to another topic, optionally only if they
+match a filter expression, and optionally transformed using a template. Rules are evaluated
+for every published message. Loops are detected, and routed messages are rate limited per
+rule and publisher.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' is properly defined.
+
+Examples:
+  ntfy rule list                                         # Shows all routing rules
+  ntfy rule add --filter="priority>=4" "ci-*" oncall     # Route high priority CI messages to oncall
+  ntfy rule del ru_SIHeJnGk5Rxc                          # Delete a routing rule
+`,
+}
+
+func execRuleAdd(c *cli.Context) error {
+	topic, target := c.Args().Get(0), c.Args().Get(1)
+	if topic == "" || target == "" {
+		return errors.New("topic and target expected, type 'ntfy rule add --help' for help")
+	} else if !user.AllowedTopicPattern(topic) {
+		return errors.New("topic must consist only of numbers, letters, dashes, underscores and wildcards (*)")
+	} else if !user.AllowedTopic(target) {
+		return errors.New("target must consist only of numbers, letters, dashes and underscores")
+	} else if c.Int("rate-limit") < 0 {
+		return errors.New("rate-limit must not be negative")
+	}
+	rule := &user.Rule{
+		Topic:     topic,
+		Target:    target,
+		Filter:    c.String("filter"),
+		Template:  c.String("template"),
+		RateLimit: c.Int("rate-limit"),
+	}
+	if err := server.ValidateRule(rule); err != nil {
+		return err
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.AddRule(rule); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "rule added\n\n")
+	printRule(c, rule)
+	return nil
+}
+
+func execRuleDel(c *cli.Context) error {
+	id := c.Args().Get(0)
+	if id == "" {
+		return errors.New("rule ID expected, type 'ntfy rule del --help' for help")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if err := manager.RemoveRule(id); errors.Is(err, user.ErrRuleNotFound) {
+		return fmt.Errorf("rule %s does not exist", id)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "rule %s removed\n", id)
+	return nil
+}
+
+func execRuleList(c *cli.Context) error {
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	rules, err := manager.Rules()
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		fmt.Fprintf(c.App.ErrWriter, "no routing rules\n")
+		return nil
+	}
+	for _, rule := range rules {
+		printRule(c, rule)
+	}
+	return nil
+}
+
+func printRule(c *cli.Context, rule *user.Rule) {
+	filter, template := "(none)", "(none)"
+	if rule.Filter != "" {
+		filter = rule.Filter
+	}
+	if rule.Template != "" {
+		template = rule.Template
+	}
+	fmt.Fprintf(c.App.ErrWriter, "rule %s -> %s (id: %s)\n", rule.Topic, rule.Target, rule.ID)
+	fmt.Fprintf(c.App.ErrWriter, "- Filter: %s\n", filter)
+	fmt.Fprintf(c.App.ErrWriter, "- Template: %s\n", template)
+	fmt.Fprintf(c.App.ErrWriter, "- Rate limit: %d messages per hour and publisher\n", rule.RateLimit)
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/v2/server"
+	"heckel.io/ntfy/v2/test"
+	"regexp"
+	"testing"
+)
+
+func TestCLI_Rule_AddListRemove(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runRuleCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "no routing rules")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runRuleCommand(app, conf, "add", "--filter=priority>=4", "--rate-limit=10", "ci-*", "oncall"))
+	require.Contains(t, stderr.String(), "rule added\n\nrule ci-* -> oncall (id: ru_")
+	require.Contains(t, stderr.String(), "- Filter: priority>=4")
+	require.Contains(t, stderr.String(), "- Rate limit: 10 messages per hour and publisher")
+	id := regexp.MustCompile(`\(id: (ru_[A-Za-z0-9]+)\)`).FindStringSubmatch(stderr.String())[1]
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runRuleCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "rule ci-* -> oncall (id: "+id+")")
+	require.Contains(t, stderr.String(), "- Template: (none)")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runRuleCommand(app, conf, "remove", id))
+	require.Contains(t, stderr.String(), "rule "+id+" removed")
+
+	app, _, _, _ = newTestApp()
+	err := runRuleCommand(app, conf, "remove", id)
+	require.NotNil(t, err)
+	require.Equal(t, "rule "+id+" does not exist", err.Error())
+}
+
+func TestCLI_Rule_AddInvalid(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	err := runRuleCommand(app, conf, "add", "--filter=priority>>4", "ci-*", "oncall")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid filter")
+
+	app, _, _, _ = newTestApp()
+	err = runRuleCommand(app, conf, "add", "ci-*", "on*")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "target must consist only of")
+}
+
+func runRuleCommand(app *cli.App, conf *server.Config, args ...string) error {
+	userArgs := []string{
+		"ntfy",
+		"--log-level=ERROR",
+		"rule",
+		"--config=" + conf.File, // Dummy config file to avoid lookups of real file
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + conf.AuthDefault.String(),
+	}
+	return app.Run(append(userArgs, args...))
+}
@@ -31,9 +31,12 @@ var flagsSubscribe = append(
 	&cli.StringFlag{Name: "since", Aliases: []string{"s"}, Usage: "return events since `SINCE` (Unix timestamp, or all)"},
 	&cli.StringFlag{Name: "user", Aliases: []string{"u"}, EnvVars: []string{"NTFY_USER"}, Usage: "username[:password] used to auth against the server"},
 	&cli.StringFlag{Name: "token", Aliases: []string{"k"}, EnvVars: []string{"NTFY_TOKEN"}, Usage: "access token used to auth against the server"},
+	&cli.StringFlag{Name: "key-file", EnvVars: []string{"NTFY_KEY_FILE"}, Usage: "file with the topic key used to decrypt end-to-end encrypted messages"},
+	&cli.StringFlag{Name: "passphrase", EnvVars: []string{"NTFY_PASSPHRASE"}, Usage: "passphrase to derive the topic key from, used to decrypt end-to-end encrypted messages"},
 	&cli.BoolFlag{Name: "from-config", Aliases: []string{"from_config", "C"}, Usage: "read subscriptions from config file (service mode)"},
 	&cli.BoolFlag{Name: "poll", Aliases: []string{"p"}, Usage: "return events and exit, do not listen for new events"},
 	&cli.BoolFlag{Name: "scheduled", Aliases: []string{"sched", "S"}, Usage: "also return scheduled/delayed events"},
+	&cli.StringFlag{Name: "transport", Aliases: []string{"T"}, Usage: "subscription transport: json (default), sse or ws"},
 )
 
 var cmdSubscribe = &cli.Command{
@@ -58,6 +61,8 @@ ntfy subscribe TOPIC
     ntfy sub home.lan/backups         # Subscribe to topic on different server
     ntfy sub --poll home.lan/backups  # Just query for latest messages and exit
     ntfy sub -u phil:mypass secret    # Subscribe with username/password
+    ntfy sub --key-file=s.key secret  # Decrypt end-to-end encrypted messages with topic key
+    ntfy sub --transport=ws mytopic   # Subscribe via WebSocket instead of a JSON stream
   
 ntfy subscribe TOPIC COMMAND
   This executes COMMAND for every incoming messages. The message fields are passed to the
@@ -80,7 +85,9 @@ ntfy subscribe TOPIC COMMAND
 
 ntfy subscribe --from-config
   Service mode (used in ntfy-client.service). This reads the config file and sets up 
-  subscriptions for every topic in the "subscribe:" block (see config file).
+  subscriptions for every topic in the "subscribe:" block (see config file). Connections
+  are re-established automatically, and resume after the last received message. Set 
+  "state-file" in the config file to also resume after a restart.
 
   Examples: 
     ntfy sub --from-config                           # Read topics from config file
@@ -95,6 +102,16 @@ func execSubscribe(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	transport := c.String("transport")
+	if transport != "" {
+		if transport != client.TransportJSON && transport != client.TransportSSE && transport != client.TransportWebSocket {
+			return errors.New("invalid transport, must be json, sse or ws")
+		}
+		conf.Transport = transport
+	}
+	if err := maybeAddKey(c, conf, c.Args().Get(0)); err != nil {
+		return err
+	}
 	cl := client.New(conf)
 	since := c.String("since")
 	user := c.String("user")
@@ -248,6 +265,26 @@ func maybeAddAuthHeader(s client.Subscribe, conf *client.Config) client.Subscrib
 	return nil
 }
 
+// maybeAddKey adds the topic key passed via --key-file or --passphrase to the config, so that messages of the
+// topic are encrypted and decrypted end-to-end. It takes precedence over the keys in the config file.
+func maybeAddKey(c *cli.Context, conf *client.Config, topic string) error {
+	keyFile, passphrase := c.String("key-file"), c.String("passphrase")
+	if keyFile == "" && passphrase == "" {
+		return nil
+	} else if keyFile != "" && passphrase != "" {
+		return errors.New("cannot set both --key-file and --passphrase")
+	} else if topic == "" {
+		return errors.New("must specify topic when --key-file or --passphrase is passed")
+	}
+	key := client.Key{
+		Topic:      topic,
+		KeyFile:    keyFile,
+		Passphrase: passphrase,
+	}
+	conf.Keys = append([]client.Key{key}, conf.Keys...)
+	return nil
+}
+
 func printMessageOrRunCommand(c *cli.Context, m *client.Message, command string) {
 	if command != "" {
 		runCommand(c, command, m)
@@ -311,6 +311,13 @@ func TestCLI_Subscribe_Token_And_UserPass(t *testing.T) {
 	require.Equal(t, "cannot set both --user and --token", err.Error())
 }
 
+func TestCLI_Subscribe_Invalid_Transport(t *testing.T) {
+	app, _, _, _ := newTestApp()
+	err := app.Run([]string{"ntfy", "subscribe", "--transport", "carrier-pigeon", "mytopic"})
+	require.Error(t, err)
+	require.Equal(t, "invalid transport, must be json, sse or ws", err.Error())
+}
+
 func TestCLI_Subscribe_Default_Token(t *testing.T) {
 	message := `{"id":"RXIQBFaieLVr","time":124,"expires":1124,"event":"message","topic":"mytopic","message":"triggered"}`
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -55,6 +55,7 @@ var cmdTier = &cli.Command{
 				&cli.StringFlag{Name: "attachment-total-size-limit", Value: defaultAttachmentTotalSizeLimit, Usage: "total size limit of attachments for the user"},
 				&cli.StringFlag{Name: "attachment-expiry-duration", Value: defaultAttachmentExpiryDuration, Usage: "duration after which attachments are deleted"},
 				&cli.StringFlag{Name: "attachment-bandwidth-limit", Value: defaultAttachmentBandwidthLimit, Usage: "daily bandwidth limit for attachment uploads/downloads"},
+				&cli.BoolFlag{Name: "attachment-image-processing", Usage: "generate previews and strip metadata of image attachments"},
 				&cli.StringFlag{Name: "stripe-monthly-price-id", Usage: "Monthly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.StringFlag{Name: "stripe-yearly-price-id", Usage: "Yearly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.BoolFlag{Name: "ignore-exists", Usage: "if the tier already exists, perform no action and exit"},
@@ -79,6 +80,7 @@ Examples:
     --attachment-total-size-limit=1G \
     --attachment-expiry-duration=12h \
     --attachment-bandwidth-limit=5G \
+    --attachment-image-processing \
     pro
 `,
 		},
@@ -99,6 +101,7 @@ Examples:
 				&cli.StringFlag{Name: "attachment-total-size-limit", Usage: "total size limit of attachments for the user"},
 				&cli.StringFlag{Name: "attachment-expiry-duration", Usage: "duration after which attachments are deleted"},
 				&cli.StringFlag{Name: "attachment-bandwidth-limit", Usage: "daily bandwidth limit for attachment uploads/downloads"},
+				&cli.BoolFlag{Name: "attachment-image-processing", Usage: "generate previews and strip metadata of image attachments"},
 				&cli.StringFlag{Name: "stripe-monthly-price-id", Usage: "Monthly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.StringFlag{Name: "stripe-yearly-price-id", Usage: "Yearly Stripe price ID for paid tiers (e.g. price_12345)"},
 			},
@@ -212,20 +215,21 @@ func execTierAdd(c *cli.Context) error {
 		return err
 	}
 	tier := &user.Tier{
-		ID:                       "", // Generated
-		Code:                     code,
-		Name:                     name,
-		MessageLimit:             c.Int64("message-limit"),
-		MessageExpiryDuration:    messageExpiryDuration,
-		EmailLimit:               c.Int64("email-limit"),
-		CallLimit:                c.Int64("call-limit"),
-		ReservationLimit:         c.Int64("reservation-limit"),
-		AttachmentFileSizeLimit:  attachmentFileSizeLimit,
-		AttachmentTotalSizeLimit: attachmentTotalSizeLimit,
-		AttachmentExpiryDuration: attachmentExpiryDuration,
-		AttachmentBandwidthLimit: attachmentBandwidthLimit,
-		StripeMonthlyPriceID:     c.String("stripe-monthly-price-id"),
-		StripeYearlyPriceID:      c.String("stripe-yearly-price-id"),
+		ID:                        "", // Generated
+		Code:                      code,
+		Name:                      name,
+		MessageLimit:              c.Int64("message-limit"),
+		MessageExpiryDuration:     messageExpiryDuration,
+		EmailLimit:                c.Int64("email-limit"),
+		CallLimit:                 c.Int64("call-limit"),
+		ReservationLimit:          c.Int64("reservation-limit"),
+		AttachmentFileSizeLimit:   attachmentFileSizeLimit,
+		AttachmentTotalSizeLimit:  attachmentTotalSizeLimit,
+		AttachmentExpiryDuration:  attachmentExpiryDuration,
+		AttachmentBandwidthLimit:  attachmentBandwidthLimit,
+		AttachmentImageProcessing: c.Bool("attachment-image-processing"),
+		StripeMonthlyPriceID:      c.String("stripe-monthly-price-id"),
+		StripeYearlyPriceID:       c.String("stripe-yearly-price-id"),
 	}
 	if err := manager.AddTier(tier); err != nil {
 		return err
@@ -301,6 +305,9 @@ func execTierChange(c *cli.Context) error {
 			return err
 		}
 	}
+	if c.IsSet("attachment-image-processing") {
+		tier.AttachmentImageProcessing = c.Bool("attachment-image-processing")
+	}
 	if c.IsSet("stripe-monthly-price-id") {
 		tier.StripeMonthlyPriceID = c.String("stripe-monthly-price-id")
 	}
@@ -370,5 +377,6 @@ func printTier(c *cli.Context, tier *user.Tier) {
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment total size limit: %s\n", util.FormatSizeHuman(tier.AttachmentTotalSizeLimit))
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment expiry duration: %s (%d seconds)\n", tier.AttachmentExpiryDuration.String(), int64(tier.AttachmentExpiryDuration.Seconds()))
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment daily bandwidth limit: %s\n", util.FormatSizeHuman(tier.AttachmentBandwidthLimit))
+	fmt.Fprintf(c.App.ErrWriter, "- Attachment image processing: %t\n", tier.AttachmentImageProcessing)
 	fmt.Fprintf(c.App.ErrWriter, "- Stripe prices (monthly/yearly): %s\n", prices)
 }
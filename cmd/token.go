@@ -30,17 +30,32 @@ var cmdToken = &cli.Command{
 			Name:      "add",
 			Aliases:   []string{"a"},
 			Usage:     "Create a new token",
-			UsageText: "ntfy token add [--expires=<duration>] [--label=..] USERNAME",
+			UsageText: "ntfy token add [--expires=<duration>] [--label=..] [--scope=TOPIC:PERMISSION...] [--publish-only] [--no-account] [--allow-ip=IP|CIDR...] USERNAME",
 			Action:    execTokenAdd,
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "expires", Aliases: []string{"e"}, Value: "", Usage: "token expires after"},
 				&cli.StringFlag{Name: "label", Aliases: []string{"l"}, Value: "", Usage: "token label"},
+				&cli.StringSliceFlag{Name: "scope", Aliases: []string{"s"}, Usage: "restrict token to topic pattern with permission, e.g. 'alerts*:rw' (may be repeated)"},
+				&cli.BoolFlag{Name: "publish-only", Usage: "restrict token to publishing, no subscribing and no account API"},
+				&cli.BoolFlag{Name: "no-account", Usage: "restrict token from using the account API"},
+				&cli.StringSliceFlag{Name: "allow-ip", Aliases: []string{"i"}, Usage: "restrict token to IP address or CIDR range, e.g. '10.0.0.0/8' (may be repeated)"},
 			},
 			Description: `Create a new user access token.
 
 User access tokens can be used to publish, subscribe, or perform any other user-specific tasks.
-Tokens have full access, and can perform any task a user can do. They are meant to be used to 
-avoid spreading the password to various places.
+Unless restricted, tokens have full access, and can perform any task a user can do. They are
+meant to be used to avoid spreading the password to various places.
+
+Tokens can be restricted (scoped): With --scope, the token can only access topics matching one
+of the given topic patterns, with the given permission (read-write, read-only, write-only or
+deny-all). If multiple patterns match, the most specific (longest) one is used. With
+--publish-only, the token can only be used to publish. With --no-account, the token cannot be
+used for the account API (e.g. to change settings, or to create other tokens). A scoped token
+can never do more than the user can do.
+
+Tokens can also be restricted to IP addresses or IP ranges: With --allow-ip, the token can only
+be used from the given IP addresses or ranges (in CIDR notation). Requests from other IP addresses
+are rejected with "403 Forbidden".
 
 This is a server-only command. It directly reads from user.db as defined in the server config
 file server.yml. The command only works if 'auth-file' is properly defined.
@@ -49,7 +64,10 @@ Examples:
   ntfy token add phil                   # Create token for user phil which never expires
   ntfy token add --expires=2d phil      # Create token for user phil which expires in 2 days
   ntfy token add -e "tuesday, 8pm" phil # Create token for user phil which expires next Tuesday
-  ntfy token add -l backups phil        # Create token for user phil with label "backups"`,
+  ntfy token add -l backups phil        # Create token for user phil with label "backups"
+  ntfy token add --scope "ci-*:wo" --publish-only phil   # Create token that can only publish to topics "ci-..."
+  ntfy token add -s alerts:ro -s "backup*:rw" phil       # Create token that can only read "alerts" and use "backup..."
+  ntfy token add --allow-ip 10.0.0.0/8 phil              # Create token that can only be used from 10.x.x.x`,
 		},
 		{
 			Name:      "remove",
@@ -61,6 +79,21 @@ Examples:
 
 Example:
   ntfy token del phil tk_th2srHVlxrANQHAso5t0HuQ1J1TjN`,
+		},
+		{
+			Name:      "change-allowed-ips",
+			Aliases:   []string{"chip"},
+			Usage:     "Changes the IP ranges a token can be used from",
+			UsageText: "ntfy token change-allowed-ips USERNAME TOKEN [IP|CIDR...]",
+			Action:    execTokenChangeAllowedIPs,
+			Description: `Change the IP addresses and ranges a token can be used from.
+
+If set, the token can only be used from the given IP addresses or IP ranges (in CIDR notation).
+If no IP addresses are given, the restriction is removed.
+
+Examples:
+  ntfy token change-allowed-ips phil tk_th2srHVlxr... 10.0.0.0/8   # Only allow using the token from 10.x.x.x
+  ntfy token change-allowed-ips phil tk_th2srHVlxr...              # Allow using the token from any IP address`,
 		},
 		{
 			Name:    "list",
@@ -76,8 +109,8 @@ file server.yml. The command only works if 'auth-file' is properly defined.`,
 	Description: `Manage access tokens for individual users.
 
 User access tokens can be used to publish, subscribe, or perform any other user-specific tasks.
-Tokens have full access, and can perform any task a user can do. They are meant to be used to 
-avoid spreading the password to various places.
+Unless restricted with a scope, tokens have full access, and can perform any task a user can do.
+They are meant to be used to avoid spreading the password to various places.
 
 This is a server-only command. It directly manages the user.db as defined in the server config
 file server.yml. The command only works if 'auth-file' is properly defined.
@@ -87,6 +120,8 @@ Examples:
   ntfy token list phil                          # Shows list of tokens for user phil
   ntfy token add phil                           # Create token for user phil which never expires
   ntfy token add --expires=2d phil              # Create token for user phil which expires in 2 days
+  ntfy token add --scope "ci-*:wo" phil         # Create token for user phil which can only publish to "ci-..."
+  ntfy token add --allow-ip 10.0.0.0/8 phil     # Create token for user phil which can only be used from 10.x.x.x
   ntfy token remove phil tk_th2srHVlxr...       # Delete token`,
 }
 
@@ -107,6 +142,20 @@ func execTokenAdd(c *cli.Context) error {
 			return err
 		}
 	}
+	allowedIPs, err := user.ParseAllowedIPs(c.StringSlice("allow-ip"))
+	if err != nil {
+		return err
+	}
+	scope, err := user.ParseTokenScope(c.StringSlice("scope"))
+	if err != nil {
+		return err
+	} else if c.Bool("publish-only") || c.Bool("no-account") {
+		if scope == nil {
+			scope = &user.TokenScope{}
+		}
+		scope.PublishOnly = scope.PublishOnly || c.Bool("publish-only")
+		scope.NoAccount = scope.NoAccount || c.Bool("no-account")
+	}
 	manager, err := createUserManager(c)
 	if err != nil {
 		return err
@@ -117,14 +166,21 @@ func execTokenAdd(c *cli.Context) error {
 	} else if err != nil {
 		return err
 	}
-	token, err := manager.CreateToken(u.ID, label, expires, netip.IPv4Unspecified())
+	token, err := manager.CreateScopedToken(u.ID, label, expires, netip.IPv4Unspecified(), scope, allowedIPs)
 	if err != nil {
 		return err
 	}
+	var restrictions string
+	if scope != nil {
+		restrictions = fmt.Sprintf(", scope %s", scope.String())
+	}
+	if len(allowedIPs) > 0 {
+		restrictions += fmt.Sprintf(", allowed from %s", formatAllowedIPs(allowedIPs))
+	}
 	if expires.Unix() == 0 {
-		fmt.Fprintf(c.App.ErrWriter, "token %s created for user %s, never expires\n", token.Value, u.Name)
+		fmt.Fprintf(c.App.ErrWriter, "token %s created for user %s, never expires%s\n", token.Value, u.Name, restrictions)
 	} else {
-		fmt.Fprintf(c.App.ErrWriter, "token %s created for user %s, expires %v\n", token.Value, u.Name, expires.Format(time.UnixDate))
+		fmt.Fprintf(c.App.ErrWriter, "token %s created for user %s, expires %v%s\n", token.Value, u.Name, expires.Format(time.UnixDate), restrictions)
 	}
 	return nil
 }
@@ -153,6 +209,40 @@ func execTokenDel(c *cli.Context) error {
 	return nil
 }
 
+func execTokenChangeAllowedIPs(c *cli.Context) error {
+	username, token := c.Args().Get(0), c.Args().Get(1)
+	if username == "" || token == "" {
+		return errors.New("username and token expected, type 'ntfy token change-allowed-ips --help' for help")
+	} else if username == userEveryone || username == user.Everyone {
+		return errors.New("username not allowed")
+	}
+	allowedIPs, err := user.ParseAllowedIPs(c.Args().Slice()[2:])
+	if err != nil {
+		return err
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	u, err := manager.User(username)
+	if err == user.ErrUserNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	if _, err := manager.ChangeTokenAllowedIPs(u.ID, token, allowedIPs); err == user.ErrTokenNotFound {
+		return fmt.Errorf("token %s for user %s does not exist", token, username)
+	} else if err != nil {
+		return err
+	}
+	if len(allowedIPs) == 0 {
+		fmt.Fprintf(c.App.ErrWriter, "token %s for user %s can now be used from any IP address\n", token, username)
+	} else {
+		fmt.Fprintf(c.App.ErrWriter, "token %s for user %s can now only be used from %s\n", token, username, formatAllowedIPs(allowedIPs))
+	}
+	return nil
+}
+
 func execTokenList(c *cli.Context) error {
 	username := c.Args().Get(0)
 	if username == userEveryone || username == user.Everyone {
@@ -191,7 +281,7 @@ func execTokenList(c *cli.Context) error {
 		usersWithTokens++
 		fmt.Fprintf(c.App.ErrWriter, "user %s\n", u.Name)
 		for _, t := range tokens {
-			var label, expires string
+			var label, expires, restrictions string
 			if t.Label != "" {
 				label = fmt.Sprintf(" (%s)", t.Label)
 			}
@@ -200,7 +290,13 @@ func execTokenList(c *cli.Context) error {
 			} else {
 				expires = fmt.Sprintf("expires %s", t.Expires.Format(time.RFC822))
 			}
-			fmt.Fprintf(c.App.ErrWriter, "- %s%s, %s, accessed from %s at %s\n", t.Value, label, expires, t.LastOrigin.String(), t.LastAccess.Format(time.RFC822))
+			if t.Scope != nil {
+				restrictions = fmt.Sprintf(", scope %s", t.Scope.String())
+			}
+			if len(t.AllowedIPs) > 0 {
+				restrictions += fmt.Sprintf(", allowed from %s", formatAllowedIPs(t.AllowedIPs))
+			}
+			fmt.Fprintf(c.App.ErrWriter, "- %s%s, %s%s, accessed from %s at %s\n", t.Value, label, expires, restrictions, t.LastOrigin.String(), t.LastAccess.Format(time.RFC822))
 		}
 	}
 	if usersWithTokens == 0 {
@@ -38,6 +38,71 @@ func TestCLI_Token_AddListRemove(t *testing.T) {
 	require.Equal(t, "no users with tokens\n", stderr.String())
 }
 
+func TestCLI_Token_AddScoped(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	require.Nil(t, runAccessCommand(app, conf, "phil", "ci-*", "rw"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "--scope", "ci-results:wo", "--publish-only", "phil"))
+	require.Regexp(t, `token tk_.+ created for user phil, never expires, scope ci-results:write-only,publish-only`, stderr.String())
+	token := regexp.MustCompile(`tk_\w+`).FindString(stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
+	require.Regexp(t, `user phil\n- tk_.+, never expires, scope ci-results:write-only,publish-only, accessed from 0.0.0.0 at .+`, stderr.String())
+
+	// Topic in scope can be published to, other topics cannot
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--token", token, fmt.Sprintf("http://127.0.0.1:%d/ci-results", port), "passed"}))
+	app, _, _, _ = newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", "--token", token, fmt.Sprintf("http://127.0.0.1:%d/ci-builds", port), "passed"}))
+
+	app, _, _, _ = newTestApp()
+	err := runTokenCommand(app, conf, "add", "--scope", "ci-results", "phil")
+	require.NotNil(t, err)
+	require.Equal(t, "invalid token scope", err.Error())
+}
+
+func TestCLI_Token_AllowedIPs(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	require.Nil(t, runAccessCommand(app, conf, "phil", "mytopic", "rw"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "--allow-ip", "10.0.0.0/8", "phil"))
+	require.Regexp(t, `token tk_.+ created for user phil, never expires, allowed from 10.0.0.0/8`, stderr.String())
+	token := regexp.MustCompile(`tk_\w+`).FindString(stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
+	require.Regexp(t, `- tk_.+, never expires, allowed from 10.0.0.0/8, accessed from 0.0.0.0 at .+`, stderr.String())
+
+	// Token cannot be used from 127.0.0.1
+	app, _, _, _ = newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", "--token", token, fmt.Sprintf("http://127.0.0.1:%d/mytopic", port), "test"}))
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "change-allowed-ips", "phil", token, "127.0.0.0/8"))
+	require.Equal(t, fmt.Sprintf("token %s for user phil can now only be used from 127.0.0.0/8\n", token), stderr.String())
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--token", token, fmt.Sprintf("http://127.0.0.1:%d/mytopic", port), "test"}))
+
+	app, _, _, _ = newTestApp()
+	err := runTokenCommand(app, conf, "change-allowed-ips", "phil", "tk_doesnotexist")
+	require.NotNil(t, err)
+	require.Equal(t, "token tk_doesnotexist for user phil does not exist", err.Error())
+}
+
 func runTokenCommand(app *cli.App, conf *server.Config, args ...string) error {
 	userArgs := []string{
 		"ntfy",
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"heckel.io/ntfy/v2/user"
+	"net/netip"
 	"os"
 	"strings"
 
@@ -26,7 +27,7 @@ func init() {
 var flagsUser = append(
 	append([]cli.Flag{}, flagsDefault...),
 	&cli.StringFlag{Name: "config", Aliases: []string{"c"}, EnvVars: []string{"NTFY_CONFIG_FILE"}, Value: defaultServerConfigFile, DefaultText: defaultServerConfigFile, Usage: "config file"},
-	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-file", Aliases: []string{"auth_file", "H"}, EnvVars: []string{"NTFY_AUTH_FILE"}, Usage: "auth database file used for access control"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-file", Aliases: []string{"auth_file", "H"}, EnvVars: []string{"NTFY_AUTH_FILE"}, Usage: "auth database file used for access control, or PostgreSQL connection URL (postgres://...)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-default-access", Aliases: []string{"auth_default_access", "p"}, EnvVars: []string{"NTFY_AUTH_DEFAULT_ACCESS"}, Value: "read-write", Usage: "default permissions if no matching entries in the auth database are found"}),
 )
 
@@ -131,6 +132,24 @@ as messages per day, attachment file sizes, etc.
 Example:
   ntfy user change-tier phil pro   # Change tier to "pro" for user "phil"  
   ntfy user change-tier phil -     # Remove tier from user "phil" entirely 
+`,
+		},
+		{
+			Name:      "change-allowed-ips",
+			Aliases:   []string{"chip"},
+			Usage:     "Changes the IP ranges a user can log in from",
+			UsageText: "ntfy user change-allowed-ips USERNAME [IP|CIDR...]",
+			Action:    execUserChangeAllowedIPs,
+			Description: `Change the IP addresses and ranges the given user can log in from.
+
+If set, the user can only log in from the given IP addresses or IP ranges (in CIDR notation),
+with the password and with any of the user's access tokens. Logins from other IP addresses are
+rejected with "403 Forbidden". Access tokens may also be restricted individually, see
+'ntfy token add --allow-ip'. If no IP addresses are given, the restriction is removed.
+
+Example:
+  ntfy user change-allowed-ips phil 10.0.0.0/8 192.168.1.5   # Only allow logins from 10.x.x.x and 192.168.1.5
+  ntfy user change-allowed-ips phil                          # Allow logins from any IP address
 `,
 		},
 		{
@@ -165,6 +184,7 @@ Examples:
   ntfy user change-pass phil                   # Change password for user phil
   NTFY_PASSWORD=.. ntfy user change-pass phil  # As above, using env variable to set password (for scripts)
   ntfy user change-role phil admin             # Make user phil an admin 
+  ntfy user change-allowed-ips phil 10.0.0.0/8 # Only allow logins of user phil from 10.x.x.x
 
 For the 'ntfy user add' and 'ntfy user change-pass' commands, you may set the NTFY_PASSWORD environment
 variable to pass the new password. This is useful if you are creating/updating users via scripts.
@@ -309,6 +329,35 @@ func execUserChangeTier(c *cli.Context) error {
 	return nil
 }
 
+func execUserChangeAllowedIPs(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == "" {
+		return errors.New("username expected, type 'ntfy user change-allowed-ips --help' for help")
+	} else if username == userEveryone || username == user.Everyone {
+		return errors.New("username not allowed")
+	}
+	allowedIPs, err := user.ParseAllowedIPs(c.Args().Slice()[1:])
+	if err != nil {
+		return err
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == user.ErrUserNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if err := manager.ChangeAllowedIPs(username, allowedIPs); err != nil {
+		return err
+	}
+	if len(allowedIPs) == 0 {
+		fmt.Fprintf(c.App.ErrWriter, "user %s can now log in from any IP address\n", username)
+	} else {
+		fmt.Fprintf(c.App.ErrWriter, "user %s can now only log in from %s\n", username, formatAllowedIPs(allowedIPs))
+	}
+	return nil
+}
+
 func execUserList(c *cli.Context) error {
 	manager, err := createUserManager(c)
 	if err != nil {
@@ -321,13 +370,17 @@ func execUserList(c *cli.Context) error {
 	return showUsers(c, manager, users)
 }
 
+func formatAllowedIPs(allowedIPs []netip.Prefix) string {
+	return strings.ReplaceAll(user.AllowedIPsString(allowedIPs), ",", ", ")
+}
+
 func createUserManager(c *cli.Context) (*user.Manager, error) {
 	authFile := c.String("auth-file")
 	authStartupQueries := c.String("auth-startup-queries")
 	authDefaultAccess := c.String("auth-default-access")
 	if authFile == "" {
 		return nil, errors.New("option auth-file not set; auth is unconfigured for this server")
-	} else if !util.FileExists(authFile) {
+	} else if !util.IsPostgresURL(authFile) && !util.FileExists(authFile) {
 		return nil, errors.New("auth-file does not exist; please start the server at least once to create it")
 	}
 	authDefault, err := user.ParsePermission(authDefaultAccess)
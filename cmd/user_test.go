@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli/v2"
 	"heckel.io/ntfy/v2/server"
@@ -91,6 +92,34 @@ func TestCLI_User_ChangeRole(t *testing.T) {
 	require.Contains(t, stderr.String(), "changed role for user phil to admin")
 }
 
+func TestCLI_User_ChangeAllowedIPs(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-allowed-ips", "phil", "10.1.2.3/8", "192.168.1.5"))
+	require.Contains(t, stderr.String(), "user phil can now only log in from 10.0.0.0/8, 192.168.1.5/32")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "phil"))
+	require.Contains(t, stderr.String(), "user phil (role: user, tier: none)\n- login only allowed from 10.0.0.0/8, 192.168.1.5/32\n")
+
+	// Publishing from outside the allowed ranges is forbidden
+	app, _, _, _ = newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", "-u", "phil:mypass", fmt.Sprintf("http://127.0.0.1:%d/mytopic", port), "test"}))
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-allowed-ips", "phil"))
+	require.Contains(t, stderr.String(), "user phil can now log in from any IP address")
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, runUserCommand(app, conf, "change-allowed-ips", "phil", "not-an-ip"))
+}
+
 func TestCLI_User_Delete(t *testing.T) {
 	s, conf, port := newTestServerWithAuth(t)
 	defer test.StopServer(t, s, port)
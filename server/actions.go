@@ -20,10 +20,11 @@ const (
 	actionView      = "view"
 	actionBroadcast = "broadcast"
 	actionHTTP      = "http"
+	actionAck       = "ack"
 )
 
 var (
-	actionsAll      = []string{actionView, actionBroadcast, actionHTTP}
+	actionsAll      = []string{actionView, actionBroadcast, actionHTTP, actionAck}
 	actionsWithURL  = []string{actionView, actionHTTP}
 	actionsKeyRegex = regexp.MustCompile(`^([-.\w]+)\s*=\s*`)
 )
@@ -61,7 +62,7 @@ func parseActions(s string) (actions []*action, err error) {
 	}
 	for _, action := range actions {
 		if !util.Contains(actionsAll, action.Action) {
-			return nil, fmt.Errorf("parameter 'action' cannot be '%s', valid values are 'view', 'broadcast' and 'http'", action.Action)
+			return nil, fmt.Errorf("parameter 'action' cannot be '%s', valid values are 'view', 'broadcast', 'http' and 'ack'", action.Action)
 		} else if action.Label == "" {
 			return nil, fmt.Errorf("parameter 'label' is required")
 		} else if util.Contains(actionsWithURL, action.Action) && action.URL == "" {
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	"heckel.io/ntfy/v2/util"
+)
+
+// Image processing constants, see processImage
+const (
+	imagePreviewMaxDimension      = 320              // Max. width and height of preview images (pixels)
+	imagePreviewJPEGQuality       = 80               // JPEG quality of preview images
+	imageReencodeJPEGQuality      = 90               // JPEG quality of downscaled or rotated images
+	imageProcessingMaxPixels      = 50_000_000       // Larger images are not processed, to protect against decompression bombs
+	imageProcessingInputSizeLimit = 50 * 1024 * 1024 // Max. size of images before they are downscaled (bytes)
+	imagePreviewFileSuffix        = "_preview"       // Appended to the message ID to form the file ID of a preview image
+	imagePreviewExtension         = ".jpg"
+)
+
+const (
+	jpegMarkerSOI     = 0xd8
+	jpegMarkerEOI     = 0xd9
+	jpegMarkerSOS     = 0xda
+	jpegMarkerAPP0    = 0xe0
+	jpegMarkerAPP1    = 0xe1
+	jpegMarkerAPP2    = 0xe2
+	jpegMarkerAPP14   = 0xee
+	jpegMarkerAPP15   = 0xef
+	jpegMarkerCOM     = 0xfe
+	exifOrientation   = 0x0112
+	pngSignatureBytes = "\x89PNG\r\n\x1a\n"
+)
+
+var (
+	errImageFormatNotSupported = errors.New("image format not supported")
+	errImageTooLarge           = errors.New("image too large to process")
+	errImageInvalid            = errors.New("invalid image")
+
+	// pngMetadataChunks are the PNG chunks removed by stripPNGMetadata
+	pngMetadataChunks = []string{"tEXt", "zTXt", "iTXt", "eXIf", "tIME"}
+)
+
+// processedImage is the result of processImage
+type processedImage struct {
+	Data    []byte // Image without metadata, downscaled if requested
+	Preview []byte // Preview image (JPEG), at most imagePreviewMaxDimension pixels wide and high
+}
+
+// imageProcessingSupported returns true if processImage can process images of the given content type
+func imageProcessingSupported(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png"
+}
+
+// processImage strips all metadata (EXIF incl. GPS location, XMP, comments, ...) from a JPEG or PNG image, and
+// generates a preview image. If maxDimension is positive, images that are wider or higher are downscaled to fit.
+//
+// If possible, metadata is removed without re-encoding the image. JPEG images with an EXIF orientation are
+// rotated, since the orientation is lost along with the rest of the EXIF data.
+func processImage(data []byte, contentType string, maxDimension int) (*processedImage, error) {
+	if !imageProcessingSupported(contentType) {
+		return nil, errImageFormatNotSupported
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	} else if config.Width*config.Height > imageProcessingMaxPixels {
+		return nil, errImageTooLarge
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	img := orientImage(imageToRGBA(decoded), orientation)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	var processed []byte
+	if maxDimension > 0 && (width > maxDimension || height > maxDimension) {
+		img = resizeImage(img, maxDimension)
+		processed, err = encodeImage(img, contentType, imageReencodeJPEGQuality)
+	} else if orientation != 1 {
+		processed, err = encodeImage(img, contentType, imageReencodeJPEGQuality)
+	} else if contentType == "image/jpeg" {
+		processed, err = stripJPEGMetadata(data)
+	} else {
+		processed, err = stripPNGMetadata(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	preview, err := encodeImage(flattenImage(resizeImage(img, imagePreviewMaxDimension)), "image/jpeg", imagePreviewJPEGQuality)
+	if err != nil {
+		return nil, err
+	}
+	return &processedImage{
+		Data:    processed,
+		Preview: preview,
+	}, nil
+}
+
+func encodeImage(img image.Image, contentType string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+	} else if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func imageToRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// flattenImage draws the image on a white background, since JPEG does not support transparency
+func flattenImage(img *image.RGBA) *image.RGBA {
+	flattened := image.NewRGBA(img.Bounds())
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flattened
+}
+
+// resizeImage downscales the image so that it is at most maxDimension pixels wide and high, keeping its aspect
+// ratio. It uses a box filter, i.e. each pixel is the average of the source pixels it covers.
+func resizeImage(src *image.RGBA, maxDimension int) *image.RGBA {
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	if srcWidth <= maxDimension && srcHeight <= maxDimension {
+		return src
+	}
+	width, height := maxDimension, maxDimension
+	if srcWidth > srcHeight {
+		height = max(1, srcHeight*maxDimension/srcWidth)
+	} else {
+		width = max(1, srcWidth*maxDimension/srcHeight)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy0, sy1 := y*srcHeight/height, max((y+1)*srcHeight/height, y*srcHeight/height+1)
+		for x := 0; x < width; x++ {
+			sx0, sx1 := x*srcWidth/width, max((x+1)*srcWidth/width, x*srcWidth/width+1)
+			var r, g, b, a uint32
+			for sy := sy0; sy < sy1; sy++ {
+				i := src.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					b += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					i += 4
+				}
+			}
+			n := uint32((sy1 - sy0) * (sx1 - sx0))
+			j := dst.PixOffset(x, y)
+			dst.Pix[j], dst.Pix[j+1], dst.Pix[j+2], dst.Pix[j+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// orientImage rotates and/or flips the image according to the EXIF orientation (1-8), so that it is displayed
+// correctly without the orientation tag
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dstWidth, dstHeight := w, h
+	if orientation >= 5 {
+		dstWidth, dstHeight = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for dy := 0; dy < dstHeight; dy++ {
+		for dx := 0; dx < dstWidth; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Flip horizontally
+				sx, sy = w-1-dx, dy
+			case 3: // Rotate 180°
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // Flip vertically
+				sx, sy = dx, h-1-dy
+			case 5: // Transpose
+				sx, sy = dy, dx
+			case 6: // Rotate 90° clockwise
+				sx, sy = dy, h-1-dx
+			case 7: // Transverse
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // Rotate 90° counter-clockwise
+				sx, sy = w-1-dy, dx
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG image, or 1 (the default) if there is none
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	_ = walkJPEGSegments(data, func(marker byte, segment []byte) bool {
+		payload := segment[4:]
+		if marker != jpegMarkerAPP1 || !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return true
+		}
+		if o := exifOrientationTag(payload[6:]); o > 0 {
+			orientation = o
+		}
+		return false
+	})
+	return orientation
+}
+
+// exifOrientationTag reads the orientation tag from the first IFD of the given TIFF structure, or returns 0
+func exifOrientationTag(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		} else if order.Uint16(tiff[entry:]) == exifOrientation {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// stripJPEGMetadata removes all metadata segments (EXIF, XMP, IPTC, comments, ...) from a JPEG image without
+// re-encoding it. Only the JFIF header, ICC color profiles and the Adobe segment (needed to decode CMYK images)
+// are kept. Any trailing data after the end of the image (e.g. embedded images) is removed as well.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	stripped := make([]byte, 0, len(data))
+	stripped = append(stripped, 0xff, jpegMarkerSOI)
+	err := walkJPEGSegments(data, func(marker byte, segment []byte) bool {
+		if marker == jpegMarkerSOS {
+			// Entropy-coded data cannot contain 0xFF 0xD9 (0xFF bytes are escaped), so this is the end of the image
+			start := len(data) - len(segment)
+			end := bytes.Index(data[start:], []byte{0xff, jpegMarkerEOI})
+			if end == -1 {
+				stripped = append(stripped, data[start:]...)
+			} else {
+				stripped = append(stripped, data[start:start+end+2]...)
+			}
+			return false
+		}
+		if keepJPEGSegment(marker, segment[4:]) {
+			stripped = append(stripped, segment...)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stripped, nil
+}
+
+func keepJPEGSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == jpegMarkerAPP0, marker == jpegMarkerAPP14:
+		return true
+	case marker == jpegMarkerAPP2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker >= jpegMarkerAPP1 && marker <= jpegMarkerAPP15, marker == jpegMarkerCOM:
+		return false
+	default:
+		return true
+	}
+}
+
+// walkJPEGSegments calls fn for each marker segment (including marker and length) of a JPEG image, up to and
+// including the first start-of-scan segment. For the start-of-scan segment, the segment is the rest of the file.
+// Walking stops if fn returns false.
+func walkJPEGSegments(data []byte, fn func(marker byte, segment []byte) bool) error {
+	if len(data) < 4 || data[0] != 0xff || data[1] != jpegMarkerSOI {
+		return errImageInvalid
+	}
+	for i := 2; i < len(data); {
+		if data[i] != 0xff {
+			return errImageInvalid
+		} else if i+1 < len(data) && data[i+1] == 0xff {
+			i++ // Fill byte
+			continue
+		} else if i+4 > len(data) {
+			return errImageInvalid
+		}
+		marker := data[i+1]
+		if marker == jpegMarkerSOS {
+			fn(marker, data[i:])
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return errImageInvalid
+		}
+		if !fn(marker, data[i:i+2+length]) {
+			return nil
+		}
+		i += 2 + length
+	}
+	return errImageInvalid
+}
+
+// stripPNGMetadata removes the metadata chunks (text, EXIF, modification time) from a PNG image without
+// re-encoding it, see pngMetadataChunks
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(pngSignatureBytes)) {
+		return nil, errImageInvalid
+	}
+	stripped := make([]byte, 0, len(data))
+	stripped = append(stripped, pngSignatureBytes...)
+	for i := len(pngSignatureBytes); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errImageInvalid
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		chunkType := string(data[i+4 : i+8])
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errImageInvalid
+		}
+		if !util.Contains(pngMetadataChunks, chunkType) {
+			stripped = append(stripped, data[i:end]...)
+		}
+		if chunkType == "IEND" {
+			return stripped, nil
+		}
+		i = end
+	}
+	return nil, errImageInvalid
+}
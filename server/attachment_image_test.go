@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessImage_JPEG_StripMetadata(t *testing.T) {
+	data := testJPEGWithMetadata(t, testImage(64, 48, color.RGBA{R: 255, A: 255}), 1)
+	require.Contains(t, string(data), "Exif")
+	require.Contains(t, string(data), "secret location")
+
+	processed, err := processImage(data, "image/jpeg", 0)
+	require.Nil(t, err)
+	require.NotContains(t, string(processed.Data), "Exif")
+	require.NotContains(t, string(processed.Data), "secret location")
+	require.Less(t, len(processed.Data), len(data))
+	config, format, err := image.DecodeConfig(bytes.NewReader(processed.Data))
+	require.Nil(t, err)
+	require.Equal(t, "jpeg", format)
+	require.Equal(t, 64, config.Width)
+	require.Equal(t, 48, config.Height)
+
+	preview, format, err := image.Decode(bytes.NewReader(processed.Preview))
+	require.Nil(t, err)
+	require.Equal(t, "jpeg", format)
+	require.Equal(t, image.Rect(0, 0, 64, 48), preview.Bounds()) // Not upscaled
+}
+
+func TestProcessImage_JPEG_Orientation(t *testing.T) {
+	img := testImage(40, 20, color.RGBA{B: 255, A: 255})
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			img.Set(x, y, color.RGBA{R: 255, A: 255}) // Red top left corner
+		}
+	}
+	data := testJPEGWithMetadata(t, img, 6) // Rotate 90° clockwise
+
+	processed, err := processImage(data, "image/jpeg", 0)
+	require.Nil(t, err)
+	require.NotContains(t, string(processed.Data), "Exif")
+	rotated, _, err := image.Decode(bytes.NewReader(processed.Data))
+	require.Nil(t, err)
+	require.Equal(t, 20, rotated.Bounds().Dx())
+	require.Equal(t, 40, rotated.Bounds().Dy())
+	r, _, b, _ := rotated.At(15, 5).RGBA() // Red corner is now top right
+	require.Greater(t, r, b)
+	r, _, b, _ = rotated.At(5, 5).RGBA()
+	require.Greater(t, b, r)
+}
+
+func TestProcessImage_PNG_StripMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, testImage(30, 20, color.RGBA{G: 255, A: 128})))
+	original := buf.Bytes()
+	data := testPNGWithChunk(original, "tEXt", []byte("Comment\x00secret location"))
+	require.Contains(t, string(data), "secret location")
+
+	processed, err := processImage(data, "image/png", 0)
+	require.Nil(t, err)
+	require.Equal(t, original, processed.Data) // Removed without re-encoding
+	preview, format, err := image.Decode(bytes.NewReader(processed.Preview))
+	require.Nil(t, err)
+	require.Equal(t, "jpeg", format)
+	require.Equal(t, image.Rect(0, 0, 30, 20), preview.Bounds())
+}
+
+func TestProcessImage_Downscale(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, testImage(1000, 500, color.RGBA{R: 10, G: 20, B: 30, A: 255})))
+
+	processed, err := processImage(buf.Bytes(), "image/png", 400)
+	require.Nil(t, err)
+	img, format, err := image.Decode(bytes.NewReader(processed.Data))
+	require.Nil(t, err)
+	require.Equal(t, "png", format)
+	require.Equal(t, image.Rect(0, 0, 400, 200), img.Bounds())
+	require.Equal(t, color.NRGBA{R: 10, G: 20, B: 30, A: 255}, color.NRGBAModel.Convert(img.At(200, 100)))
+
+	preview, _, err := image.Decode(bytes.NewReader(processed.Preview))
+	require.Nil(t, err)
+	require.Equal(t, image.Rect(0, 0, imagePreviewMaxDimension, 160), preview.Bounds())
+}
+
+func TestProcessImage_Errors(t *testing.T) {
+	_, err := processImage([]byte("GIF89a..."), "image/gif", 0)
+	require.Equal(t, errImageFormatNotSupported, err)
+	_, err = processImage([]byte("not an image"), "image/jpeg", 0)
+	require.Error(t, err)
+
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, testImage(1, 1, color.Black)))
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:20], 100_000)                         // Width in IHDR chunk
+	binary.BigEndian.PutUint32(data[20:24], 1_000)                           // Height in IHDR chunk
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29])) // Checksum of IHDR chunk
+	_, err = processImage(data, "image/png", 0)
+	require.Equal(t, errImageTooLarge, err)
+}
+
+func TestResizeImage(t *testing.T) {
+	img := imageToRGBA(testImage(8, 2, color.White))
+	require.Equal(t, image.Rect(0, 0, 4, 1), resizeImage(img, 4).Bounds())
+	require.Equal(t, image.Rect(0, 0, 1, 4), resizeImage(imageToRGBA(testImage(2, 8, color.White)), 4).Bounds())
+	require.Same(t, img, resizeImage(img, 8))
+}
+
+func testImage(width, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// testJPEGWithMetadata encodes the image as JPEG, and inserts an EXIF segment with the given orientation,
+// an XMP segment and a comment right after the SOI marker
+func testJPEGWithMetadata(t *testing.T, img image.Image, orientation uint16) []byte {
+	var buf bytes.Buffer
+	require.Nil(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}))
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01")    // Big-endian TIFF header, IFD with one entry
+	exif = append(exif, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01) // Orientation, SHORT, count 1
+	exif = binary.BigEndian.AppendUint16(exif, orientation)
+	exif = append(exif, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Padding, no next IFD
+	segments := append(testJPEGSegment(0xe1, exif), testJPEGSegment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>secret location</x:xmpmeta>"))...)
+	segments = append(segments, testJPEGSegment(0xfe, []byte("secret location"))...)
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), segments...), data[2:]...)
+}
+
+func testJPEGSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// testPNGWithChunk inserts a chunk right after the IHDR chunk, i.e. after the 8 byte signature and the 25 byte IHDR chunk
+func testPNGWithChunk(data []byte, chunkType string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	return append(append(append([]byte{}, data[:33]...), chunk...), data[33:]...)
+}
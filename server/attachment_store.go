@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	errPresignedURLsNotSupported = errors.New("attachment store does not support presigned URLs")
+)
+
+// attachmentStore is the storage backend of the fileCache, i.e. a local directory (see Config.AttachmentCacheDir)
+// or an S3-compatible bucket (see Config.AttachmentS3URL). Stores only deal with raw objects; size limits and
+// encryption at rest are handled by the fileCache.
+//
+// Implementations must be safe for concurrent use.
+type attachmentStore interface {
+	// Create returns a writer for the attachment with the given ID. The attachment is only stored (or replaced,
+	// if it exists) once the writer is closed successfully; until then, it is not visible to readers.
+	Create(id string) (attachmentWriter, error)
+
+	// Open returns a reader for the attachment with the given ID, and its size as stored. If the attachment
+	// does not exist, the returned error is os.ErrNotExist.
+	Open(id string) (io.ReadCloser, int64, error)
+
+	// Remove deletes the attachment with the given ID. It is not an error if the attachment does not exist.
+	Remove(id string) error
+}
+
+// attachmentWriter writes an attachment to an attachmentStore, see attachmentStore.Create
+type attachmentWriter interface {
+	io.WriteCloser
+
+	// Abort discards everything written so far. The writer must not be used afterwards.
+	Abort()
+}
+
+// attachmentPresigner is implemented by attachment stores that can create URLs that allow clients to
+// download an attachment directly from the store, see Config.AttachmentS3Redirect
+type attachmentPresigner interface {
+	// PresignedURL returns a URL to download the attachment, valid for the given duration. If set, the
+	// filename and content type are returned in the Content-Disposition and Content-Type headers.
+	PresignedURL(id, filename, contentType string, expires time.Duration) (string, error)
+}
+
+// createAttachmentStore creates the attachment store defined in the config, i.e. an S3 store if
+// AttachmentS3URL is set, or a local store in AttachmentCacheDir otherwise
+func createAttachmentStore(conf *Config) (attachmentStore, error) {
+	if conf.AttachmentS3URL != "" {
+		return newS3AttachmentStore(conf.AttachmentS3URL)
+	}
+	return newLocalAttachmentStore(conf.AttachmentCacheDir)
+}
+
+// localAttachmentStore stores attachments as files in a local directory, using the message ID as filename
+type localAttachmentStore struct {
+	dir string
+}
+
+var _ attachmentStore = (*localAttachmentStore)(nil)
+
+func newLocalAttachmentStore(dir string) (*localAttachmentStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &localAttachmentStore{
+		dir: dir,
+	}, nil
+}
+
+// Create writes the attachment to a temporary file, which is renamed once the writer is closed, so that
+// partially written attachments are never served
+func (s *localAttachmentStore) Create(id string) (attachmentWriter, error) {
+	file := filepath.Join(s.dir, id)
+	f, err := os.OpenFile(file+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &localAttachmentWriter{
+		f:    f,
+		file: file,
+	}, nil
+}
+
+func (s *localAttachmentStore) Open(id string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(s.dir, id))
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+func (s *localAttachmentStore) Remove(id string) error {
+	if err := os.Remove(filepath.Join(s.dir, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+type localAttachmentWriter struct {
+	f    *os.File
+	file string
+}
+
+func (w *localAttachmentWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *localAttachmentWriter) Close() error {
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return os.Rename(w.f.Name(), w.file)
+}
+
+func (w *localAttachmentWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
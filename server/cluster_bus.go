@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	errClusterBusClosed = errors.New("cluster bus closed")
+)
+
+// clusterBus is a message bus connecting the replicas of a cluster, see Config.ClusterURL. Messages published
+// to a channel are delivered to all subscribers of that channel, including the publishing replica. Leases are
+// used to elect a single replica to run background tasks that must not run more than once in the cluster.
+//
+// Implementations must be safe for concurrent use.
+type clusterBus interface {
+	// Publish sends the payload to all subscribers of the channel
+	Publish(channel string, payload []byte) error
+
+	// Subscribe calls the handler for every payload published to the channel, until the bus is closed.
+	// Implementations re-subscribe automatically if the connection to the bus is lost.
+	Subscribe(channel string, handler func(payload []byte)) error
+
+	// Lease acquires the lease with the given key for the owner, or extends it if the owner already holds it.
+	// It returns false if the lease is held by another owner.
+	Lease(key, owner string, ttl time.Duration) (bool, error)
+
+	// Close disconnects from the bus and stops all subscriptions
+	Close() error
+}
+
+// newClusterBus creates a cluster bus from the given URL. Supported schemes are redis:// and rediss:// (Redis,
+// or any server speaking the Redis protocol, e.g. Valkey), as well as memory:// (an in-process bus, used for tests).
+func newClusterBus(rawURL string) (clusterBus, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		return newRedisClusterBus(u)
+	case "memory":
+		return newMemClusterBus(u.Host), nil
+	default:
+		return nil, fmt.Errorf("invalid cluster URL %s, scheme must be redis://, rediss:// or memory://", rawURL)
+	}
+}
+
+// memClusterHubs contains all in-memory buses, keyed by name, so that multiple servers in the same process
+// (e.g. in tests) can be connected to the same bus
+var (
+	memClusterHubs   = make(map[string]*memClusterHub)
+	memClusterHubsMu sync.Mutex
+)
+
+// memClusterHub is the shared state of an in-memory bus
+type memClusterHub struct {
+	subscribers map[*memClusterBus]map[string]func(payload []byte) // Bus -> channel -> handler
+	leases      map[string]*memClusterLease
+	mu          sync.Mutex
+}
+
+type memClusterLease struct {
+	owner   string
+	expires time.Time
+}
+
+// memClusterBus is a clusterBus connected to an in-memory hub. All buses with the same name share the same hub.
+type memClusterBus struct {
+	hub *memClusterHub
+}
+
+var _ clusterBus = (*memClusterBus)(nil)
+
+func newMemClusterBus(name string) *memClusterBus {
+	memClusterHubsMu.Lock()
+	defer memClusterHubsMu.Unlock()
+	hub, ok := memClusterHubs[name]
+	if !ok {
+		hub = &memClusterHub{
+			subscribers: make(map[*memClusterBus]map[string]func(payload []byte)),
+			leases:      make(map[string]*memClusterLease),
+		}
+		memClusterHubs[name] = hub
+	}
+	return &memClusterBus{hub: hub}
+}
+
+func (b *memClusterBus) Publish(channel string, payload []byte) error {
+	b.hub.mu.Lock()
+	handlers := make([]func(payload []byte), 0)
+	for _, channels := range b.hub.subscribers {
+		if handler, ok := channels[channel]; ok {
+			handlers = append(handlers, handler)
+		}
+	}
+	b.hub.mu.Unlock()
+	for _, handler := range handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (b *memClusterBus) Subscribe(channel string, handler func(payload []byte)) error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	if _, ok := b.hub.subscribers[b]; !ok {
+		b.hub.subscribers[b] = make(map[string]func(payload []byte))
+	}
+	b.hub.subscribers[b][channel] = handler
+	return nil
+}
+
+func (b *memClusterBus) Lease(key, owner string, ttl time.Duration) (bool, error) {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	lease, ok := b.hub.leases[key]
+	if ok && lease.owner != owner && time.Now().Before(lease.expires) {
+		return false, nil
+	}
+	b.hub.leases[key] = &memClusterLease{
+		owner:   owner,
+		expires: time.Now().Add(ttl),
+	}
+	return true, nil
+}
+
+func (b *memClusterBus) Close() error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	delete(b.hub.subscribers, b)
+	return nil
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestNewClusterBus_InvalidURL(t *testing.T) {
+	_, err := newClusterBus("http://localhost:6379")
+	require.Error(t, err)
+	_, err = newClusterBus("redis://localhost:6379/abc")
+	require.Error(t, err)
+}
+
+func TestMemClusterBus(t *testing.T) {
+	name := util.RandomString(10)
+	testClusterBus(t, func() clusterBus {
+		return newMemClusterBus(name)
+	})
+}
+
+func TestRedisClusterBus(t *testing.T) {
+	redis := newFakeRedisServer(t, "")
+	testClusterBus(t, func() clusterBus {
+		b, err := newClusterBus("redis://" + redis.addr + "/2")
+		require.Nil(t, err)
+		return b
+	})
+}
+
+func TestRedisClusterBus_Auth(t *testing.T) {
+	redis := newFakeRedisServer(t, "secret")
+	_, err := newClusterBus("redis://" + redis.addr)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "NOAUTH")
+	_, err = newClusterBus("redis://:wrong@" + redis.addr)
+	require.Error(t, err)
+	b, err := newClusterBus("redis://:secret@" + redis.addr)
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+}
+
+func TestRedisClusterBus_Resubscribe(t *testing.T) {
+	redis := newFakeRedisServer(t, "")
+	b, err := newClusterBus("redis://" + redis.addr)
+	require.Nil(t, err)
+	defer b.Close()
+
+	received := make(chan string, 10)
+	require.Nil(t, b.Subscribe("ntfy:messages", func(payload []byte) {
+		received <- string(payload)
+	}))
+	require.Nil(t, b.Publish("ntfy:messages", []byte("before")))
+	require.Equal(t, "before", receiveClusterPayload(t, received))
+
+	// Connections are re-established after the connection is lost
+	redis.CloseConns()
+	waitFor(t, func() bool {
+		return redis.Subscribers("ntfy:messages") == 1
+	})
+	require.Nil(t, b.Publish("ntfy:messages", []byte("after")))
+	require.Equal(t, "after", receiveClusterPayload(t, received))
+}
+
+func TestReadRedisReply(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("+OK\r\n:42\r\n$5\r\nhe\r\no\r\n$-1\r\n*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$0\r\n\r\n-ERR oops\r\n"))
+	reply, err := readRedisReply(r)
+	require.Nil(t, err)
+	require.Equal(t, "OK", reply)
+	reply, err = readRedisReply(r)
+	require.Nil(t, err)
+	require.Equal(t, int64(42), reply)
+	reply, err = readRedisReply(r)
+	require.Nil(t, err)
+	require.Equal(t, "he\r\no", reply)
+	reply, err = readRedisReply(r)
+	require.Nil(t, err)
+	require.Nil(t, reply)
+	reply, err = readRedisReply(r)
+	require.Nil(t, err)
+	require.Equal(t, []any{"message", "ch", ""}, reply)
+	_, err = readRedisReply(r)
+	require.Equal(t, redisError("ERR oops"), err)
+
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("?what\r\n")))
+	require.Error(t, err)
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader(fmt.Sprintf("$%d\r\n", redisMaxBulkBytes+1))))
+	require.Error(t, err)
+}
+
+func testClusterBus(t *testing.T, newBus func() clusterBus) {
+	b1, b2 := newBus(), newBus()
+	defer b1.Close()
+	defer b2.Close()
+
+	// Messages are delivered to all subscribers of the channel, including the publisher
+	received1, received2 := make(chan string, 10), make(chan string, 10)
+	require.Nil(t, b1.Subscribe("ntfy:messages", func(payload []byte) {
+		received1 <- string(payload)
+	}))
+	require.Nil(t, b2.Subscribe("ntfy:messages", func(payload []byte) {
+		received2 <- string(payload)
+	}))
+	require.Nil(t, b1.Publish("ntfy:messages", []byte(`{"message":"hi"}`)))
+	require.Nil(t, b2.Publish("ntfy:other", []byte("not received")))
+	require.Equal(t, `{"message":"hi"}`, receiveClusterPayload(t, received1))
+	require.Equal(t, `{"message":"hi"}`, receiveClusterPayload(t, received2))
+
+	// Leases are held by a single owner, until they expire
+	acquired, err := b1.Lease("ntfy:leader", "node1", 300*time.Millisecond)
+	require.Nil(t, err)
+	require.True(t, acquired)
+	acquired, err = b2.Lease("ntfy:leader", "node2", 300*time.Millisecond)
+	require.Nil(t, err)
+	require.False(t, acquired)
+	acquired, err = b1.Lease("ntfy:leader", "node1", 300*time.Millisecond) // Renewed
+	require.Nil(t, err)
+	require.True(t, acquired)
+	time.Sleep(400 * time.Millisecond)
+	acquired, err = b2.Lease("ntfy:leader", "node2", 300*time.Millisecond)
+	require.Nil(t, err)
+	require.True(t, acquired)
+
+	// No messages are delivered after closing the bus
+	require.Nil(t, b2.Close())
+	require.Nil(t, b1.Publish("ntfy:messages", []byte("after close")))
+	require.Equal(t, "after close", receiveClusterPayload(t, received1))
+	select {
+	case payload := <-received2:
+		t.Fatalf("unexpected message after close: %s", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func receiveClusterPayload(t *testing.T, received chan string) string {
+	select {
+	case payload := <-received:
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for cluster message")
+		return ""
+	}
+}
+
+// fakeRedisServer implements the subset of the Redis protocol used by redisClusterBus
+type fakeRedisServer struct {
+	addr        string
+	password    string
+	listener    net.Listener
+	conns       map[net.Conn]bool
+	subscribers map[string]map[*fakeRedisConn]bool
+	leases      map[string]*memClusterLease
+	mu          sync.Mutex
+}
+
+type fakeRedisConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func newFakeRedisServer(t *testing.T, password string) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &fakeRedisServer{
+		addr:        listener.Addr().String(),
+		password:    password,
+		listener:    listener,
+		conns:       make(map[net.Conn]bool),
+		subscribers: make(map[string]map[*fakeRedisConn]bool),
+		leases:      make(map[string]*memClusterLease),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = true
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		s.CloseConns()
+	})
+	return s
+}
+
+func (s *fakeRedisServer) CloseConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = make(map[net.Conn]bool)
+	s.subscribers = make(map[string]map[*fakeRedisConn]bool)
+}
+
+func (s *fakeRedisServer) Subscribers(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers[channel])
+}
+
+func (s *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &fakeRedisConn{conn: conn}
+	r := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		items, ok := reply.([]any)
+		if !ok || len(items) == 0 {
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = item.(string)
+		}
+		command := strings.ToUpper(args[0])
+		if command == "AUTH" {
+			authenticated = args[len(args)-1] == s.password
+			if authenticated {
+				c.write("+OK\r\n")
+			} else {
+				c.write("-WRONGPASS invalid password\r\n")
+			}
+			continue
+		} else if !authenticated {
+			c.write("-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		switch command {
+		case "PING":
+			c.write("+PONG\r\n")
+		case "SELECT":
+			c.write("+OK\r\n")
+		case "SUBSCRIBE":
+			s.mu.Lock()
+			if _, ok := s.subscribers[args[1]]; !ok {
+				s.subscribers[args[1]] = make(map[*fakeRedisConn]bool)
+			}
+			s.subscribers[args[1]][c] = true
+			s.mu.Unlock()
+			c.write(fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1]))
+		case "PUBLISH":
+			s.mu.Lock()
+			subscribers := make([]*fakeRedisConn, 0)
+			for sub := range s.subscribers[args[1]] {
+				subscribers = append(subscribers, sub)
+			}
+			s.mu.Unlock()
+			for _, sub := range subscribers {
+				sub.write(fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(args[2]), args[2]))
+			}
+			c.write(fmt.Sprintf(":%d\r\n", len(subscribers)))
+		case "EVAL": // Only the lease script is supported
+			ttl, _ := strconv.Atoi(args[5])
+			s.mu.Lock()
+			lease, ok := s.leases[args[3]]
+			acquired := !ok || lease.owner == args[4] || time.Now().After(lease.expires)
+			if acquired {
+				s.leases[args[3]] = &memClusterLease{owner: args[4], expires: time.Now().Add(time.Duration(ttl) * time.Millisecond)}
+			}
+			s.mu.Unlock()
+			if acquired {
+				c.write(":1\r\n")
+			} else {
+				c.write(":0\r\n")
+			}
+		default:
+			c.write(fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0]))
+		}
+	}
+}
+
+func (c *fakeRedisConn) write(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write([]byte(s))
+}
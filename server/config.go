@@ -16,6 +16,11 @@ const (
 	DefaultKeepaliveInterval                    = 45 * time.Second // Not too frequently to save battery (Android read timeout used to be 77s!)
 	DefaultManagerInterval                      = time.Minute
 	DefaultDelayedSenderInterval                = 10 * time.Second
+	DefaultWebhookSenderInterval                = 5 * time.Second
+	DefaultEscalationSenderInterval             = 10 * time.Second
+	DefaultWebhookRetryDelay                    = 30 * time.Second // Doubled for every failed attempt
+	DefaultFederationRetryDelay                 = 5 * time.Second  // Doubled for every failed attempt to connect or push to a federation peer
+	DefaultDigestWindow                         = 10 * time.Minute // Time that push notifications for digest topics are accumulated
 	DefaultMessageDelayMin                      = 10 * time.Second
 	DefaultMessageDelayMax                      = 3 * 24 * time.Hour
 	DefaultFirebaseKeepaliveInterval            = 3 * time.Hour    // ~control topic (Android), not too frequently to save battery
@@ -30,6 +35,19 @@ const (
 	DefaultWebPushExpiryDuration        = 9 * 24 * time.Hour
 )
 
+// Defines default OpenID Connect settings
+const (
+	DefaultOIDCUsernameClaim = "preferred_username"
+	DefaultOIDCGroupsClaim   = "groups"
+)
+
+// Defines default LDAP settings
+const (
+	DefaultLDAPUserFilter     = "(uid=%s)"
+	DefaultLDAPGroupFilter    = "(member=%s)"
+	DefaultLDAPGroupAttribute = "cn"
+)
+
 // Defines all global and per-visitor limits
 // - message size limit: the max number of bytes for a message
 // - total topic limit: max number of topics overall
@@ -70,6 +88,9 @@ var (
 	// DefaultDisallowedTopics defines the topics that are forbidden, because they are used elsewhere. This array can be
 	// extended using the server.yml config. If updated, also update in Android and web app.
 	DefaultDisallowedTopics = []string{"docs", "static", "file", "app", "metrics", "account", "settings", "signup", "login", "v1"}
+
+	// DefaultOIDCScopes defines the scopes requested from the OpenID Connect provider during login
+	DefaultOIDCScopes = []string{"openid", "profile", "email"}
 )
 
 // Config is the main config struct for the application. Use New to instantiate a default config struct.
@@ -93,20 +114,52 @@ type Config struct {
 	AuthDefault                          user.Permission
 	AuthBcryptCost                       int
 	AuthStatsQueueWriterInterval         time.Duration
+	OIDCIssuer                           string // OpenID Connect provider for single sign-on, disabled if empty
+	OIDCClientID                         string
+	OIDCClientSecret                     string
+	OIDCScopes                           []string
+	OIDCAudience                         string // Expected audience of JWT access tokens, defaults to OIDCClientID
+	OIDCUsernameClaim                    string
+	OIDCGroupsClaim                      string
+	OIDCAdminGroups                      []string // Members of these groups are admins, see provisionOIDCUser
+	OIDCTierGroups                       []*OIDCTierGroup
+	LDAPURL                              string // LDAP server to authenticate users against, disabled if empty
+	LDAPBindDN                           string
+	LDAPBindPassword                     string
+	LDAPUserBaseDN                       string
+	LDAPUserFilter                       string
+	LDAPGroupBaseDN                      string // Group lookups are disabled if empty
+	LDAPGroupFilter                      string
+	LDAPGroupAttribute                   string
+	LDAPCacheDuration                    time.Duration
 	AttachmentCacheDir                   string
+	AttachmentS3URL                      string // S3-compatible bucket for attachments, alternative to AttachmentCacheDir
+	AttachmentS3Redirect                 bool   // Redirect downloads to presigned URLs instead of streaming them
 	AttachmentTotalSizeLimit             int64
 	AttachmentFileSizeLimit              int64
 	AttachmentExpiryDuration             time.Duration
+	AttachmentImageProcessing            bool   // Strip metadata from images and generate previews, for visitors without a tier
+	AttachmentImageMaxDimension          int    // Downscale processed images to this max. width and height, disabled if zero
+	EncryptionKeyFile                    string // Keys to encrypt messages and attachments at rest, encryption at rest is disabled if empty
 	KeepaliveInterval                    time.Duration
 	ManagerInterval                      time.Duration
 	DisallowedTopics                     []string
 	WebRoot                              string // empty to disable
 	DelayedSenderInterval                time.Duration
+	WebhookSenderInterval                time.Duration
+	WebhookRetryDelay                    time.Duration
+	WebhookAllowedIPs                    []netip.Prefix // Private IP ranges webhooks may be sent to, see webhookDialControl
+	EscalationSenderInterval             time.Duration
+	DigestTopics                         []string // Topic patterns for which push notifications are sent as digest
+	DigestWindow                         time.Duration
 	FirebaseKeepaliveInterval            time.Duration
 	FirebasePollInterval                 time.Duration
 	FirebaseQuotaExceededPenaltyDuration time.Duration
 	UpstreamBaseURL                      string
 	UpstreamAccessToken                  string
+	FederationPeers                      []*FederationPeer // Servers to mirror topics from, or push topics to
+	FederationRetryDelay                 time.Duration
+	ClusterURL                           string // Message bus shared by all replicas (redis://...), cluster mode is disabled if empty
 	SMTPSenderAddr                       string
 	SMTPSenderUser                       string
 	SMTPSenderPass                       string
@@ -151,6 +204,9 @@ type Config struct {
 	EnableSignup                         bool // Enable creation of accounts via API and UI
 	EnableLogin                          bool
 	EnableReservations                   bool // Allow users with role "user" to own/reserve topics
+	EnableWebhooks                       bool // Allow users to forward messages to HTTP endpoints
+	EnableWildcardSubscriptions          bool // Allow subscribing to topic patterns, e.g. /alerts-*/json
+	EnableFederation                     bool // Allow other ntfy servers to push messages to this server
 	EnableMetrics                        bool
 	AccessControlAllowOrigin             string // CORS header field to restrict access from web clients
 	Version                              string // injected by App
@@ -185,20 +241,52 @@ func NewConfig() *Config {
 		AuthDefault:                          user.PermissionReadWrite,
 		AuthBcryptCost:                       user.DefaultUserPasswordBcryptCost,
 		AuthStatsQueueWriterInterval:         user.DefaultUserStatsQueueWriterInterval,
+		OIDCIssuer:                           "",
+		OIDCClientID:                         "",
+		OIDCClientSecret:                     "",
+		OIDCScopes:                           DefaultOIDCScopes,
+		OIDCAudience:                         "",
+		OIDCUsernameClaim:                    DefaultOIDCUsernameClaim,
+		OIDCGroupsClaim:                      DefaultOIDCGroupsClaim,
+		OIDCAdminGroups:                      nil,
+		OIDCTierGroups:                       nil,
+		LDAPURL:                              "",
+		LDAPBindDN:                           "",
+		LDAPBindPassword:                     "",
+		LDAPUserBaseDN:                       "",
+		LDAPUserFilter:                       DefaultLDAPUserFilter,
+		LDAPGroupBaseDN:                      "",
+		LDAPGroupFilter:                      DefaultLDAPGroupFilter,
+		LDAPGroupAttribute:                   DefaultLDAPGroupAttribute,
+		LDAPCacheDuration:                    user.DefaultDirectoryGroupsCacheDuration,
 		AttachmentCacheDir:                   "",
+		AttachmentS3URL:                      "",
+		AttachmentS3Redirect:                 false,
 		AttachmentTotalSizeLimit:             DefaultAttachmentTotalSizeLimit,
 		AttachmentFileSizeLimit:              DefaultAttachmentFileSizeLimit,
 		AttachmentExpiryDuration:             DefaultAttachmentExpiryDuration,
+		AttachmentImageProcessing:            false,
+		AttachmentImageMaxDimension:          0,
+		EncryptionKeyFile:                    "",
 		KeepaliveInterval:                    DefaultKeepaliveInterval,
 		ManagerInterval:                      DefaultManagerInterval,
 		DisallowedTopics:                     DefaultDisallowedTopics,
 		WebRoot:                              "/",
 		DelayedSenderInterval:                DefaultDelayedSenderInterval,
+		WebhookSenderInterval:                DefaultWebhookSenderInterval,
+		WebhookRetryDelay:                    DefaultWebhookRetryDelay,
+		WebhookAllowedIPs:                    nil,
+		EscalationSenderInterval:             DefaultEscalationSenderInterval,
+		DigestTopics:                         nil,
+		DigestWindow:                         DefaultDigestWindow,
 		FirebaseKeepaliveInterval:            DefaultFirebaseKeepaliveInterval,
 		FirebasePollInterval:                 DefaultFirebasePollInterval,
 		FirebaseQuotaExceededPenaltyDuration: DefaultFirebaseQuotaExceededPenaltyDuration,
 		UpstreamBaseURL:                      "",
 		UpstreamAccessToken:                  "",
+		FederationPeers:                      nil,
+		FederationRetryDelay:                 DefaultFederationRetryDelay,
+		ClusterURL:                           "",
 		SMTPSenderAddr:                       "",
 		SMTPSenderUser:                       "",
 		SMTPSenderPass:                       "",
@@ -240,6 +328,9 @@ func NewConfig() *Config {
 		EnableSignup:                         false,
 		EnableLogin:                          false,
 		EnableReservations:                   false,
+		EnableWebhooks:                       false,
+		EnableWildcardSubscriptions:          false,
+		EnableFederation:                     false,
 		AccessControlAllowOrigin:             "*",
 		Version:                              "",
 		WebPushPrivateKey:                    "",
@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encryption at rest: If an encryption key file is configured, message fields (see messageCache) and attachment
+// files (see fileCache) are encrypted with AES-256-GCM before they are written to disk. The key file contains one
+// base64-encoded 32-byte key per line. The first key is the primary key, which is used to encrypt new data. All
+// other keys are only used to decrypt existing data, so that keys can be rotated without downtime, see
+// RotateEncryptionKey and Reencrypt.
+//
+// Encrypted strings have the format "ntfyenc1:<key ID>:<base64(nonce + ciphertext)>". Whether the fields of a
+// message are encrypted is stored in the message cache ("encrypted" column), so that plaintext that happens to
+// start with the prefix is never mistaken for ciphertext, and existing data can still be read after encryption
+// was enabled.
+//
+// Encrypted files start with a header ("ntfyenc1", key ID, nonce prefix), followed by the plaintext in chunks of
+// 64 KiB, each of which is encrypted separately. This allows streaming large files without loading them into
+// memory. The nonce of each chunk contains a counter and a "last chunk" flag, so that chunks cannot be reordered,
+// and the file cannot be truncated without being noticed. Like for messages, whether a file is encrypted is stored
+// in the message cache ("attachment_encrypted" column, and "encrypted" column for uploads), and not derived from
+// the header.
+
+const (
+	encryptionKeySize         = 32 // AES-256
+	encryptionKeyIDLength     = 8  // Hex characters of the SHA-256 of the key
+	encryptionPrefix          = "ntfyenc1"
+	encryptionChunkSize       = 64 * 1024
+	encryptionNoncePrefixSize = 7
+	encryptionHeaderSize      = len(encryptionPrefix) + encryptionKeyIDLength + encryptionNoncePrefixSize
+)
+
+var (
+	errEncryptionKeyFileEmpty  = errors.New("encryption key file does not contain any keys")
+	errEncryptionKeyUnknown    = errors.New("data was encrypted with an unknown key, is the key missing in the encryption key file?")
+	errEncryptedValueInvalid   = errors.New("encrypted value invalid")
+	errEncryptedFileInvalid    = errors.New("encrypted file invalid or truncated")
+	errEncryptedFileWithoutKey = errors.New("file is encrypted, but no encryption key file is configured")
+)
+
+// keyring holds the keys used to encrypt and decrypt data at rest. All methods may be called on a nil keyring,
+// in which case strings are passed through unencrypted.
+type keyring struct {
+	primary *encryptionKey
+	keys    map[string]*encryptionKey
+}
+
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// loadKeyring reads the keys from the given key file, see parseKeyring
+func loadKeyring(filename string) (*keyring, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	k, err := parseKeyring(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key file %s: %w", filename, err)
+	}
+	return k, nil
+}
+
+// parseKeyring parses a list of base64-encoded keys, one per line. Empty lines and lines starting with "#" are
+// ignored. The first key is the primary key.
+func parseKeyring(s string) (*keyring, error) {
+	k := &keyring{
+		keys: make(map[string]*encryptionKey),
+	}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, errors.New("keys must be base64-encoded")
+		} else if len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("keys must be %d bytes, but key is %d bytes", encryptionKeySize, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		ek := &encryptionKey{
+			id:   encryptionKeyID(key),
+			aead: aead,
+		}
+		if k.primary == nil {
+			k.primary = ek
+		}
+		k.keys[ek.id] = ek
+	}
+	if k.primary == nil {
+		return nil, errEncryptionKeyFileEmpty
+	}
+	return k, nil
+}
+
+func encryptionKeyID(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:])[:encryptionKeyIDLength]
+}
+
+// EncryptString encrypts the given string with the primary key. Empty strings are not encrypted.
+func (k *keyring) EncryptString(s string) (string, error) {
+	if k == nil || s == "" {
+		return s, nil
+	}
+	nonce := make([]byte, k.primary.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.primary.aead.Seal(nonce, nonce, []byte(s), nil)
+	return fmt.Sprintf("%s:%s:%s", encryptionPrefix, k.primary.id, base64.RawStdEncoding.EncodeToString(sealed)), nil
+}
+
+// DecryptString decrypts a string that was encrypted with EncryptString. Since EncryptString does not
+// encrypt empty strings, they are returned as is.
+func (k *keyring) DecryptString(s string) (string, error) {
+	if s == "" {
+		return s, nil
+	} else if k == nil {
+		return "", errEncryptionKeyUnknown
+	} else if !strings.HasPrefix(s, encryptionPrefix+":") {
+		return "", errEncryptedValueInvalid
+	}
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return "", errEncryptedValueInvalid
+	}
+	key, ok := k.keys[parts[1]]
+	if !ok {
+		return "", errEncryptionKeyUnknown
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(sealed) < key.aead.NonceSize() {
+		return "", errEncryptedValueInvalid
+	}
+	plaintext, err := key.aead.Open(nil, sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():], nil)
+	if err != nil {
+		return "", errEncryptedValueInvalid
+	}
+	return string(plaintext), nil
+}
+
+// NewWriter returns a writer that encrypts everything written to it with the primary key, and writes it
+// to w. Close must be called to write the final chunk. It does not close w.
+func (k *keyring) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	noncePrefix := make([]byte, encryptionNoncePrefixSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptionPrefix+k.primary.id), noncePrefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:           w,
+		aead:        k.primary.aead,
+		noncePrefix: noncePrefix,
+		buf:         make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+// NewReader returns a reader that decrypts the encrypted file contents read from r, along with the size of the
+// plaintext. The size is the size of the file as stored on disk.
+func (k *keyring) NewReader(r io.Reader, size int64) (io.Reader, int64, error) {
+	if k == nil {
+		return nil, 0, errEncryptedFileWithoutKey
+	}
+	br := bufio.NewReaderSize(r, encryptionChunkSize+encryptionHeaderSize)
+	header, err := br.Peek(encryptionHeaderSize)
+	if errors.Is(err, io.EOF) || (err == nil && !bytes.HasPrefix(header, []byte(encryptionPrefix))) {
+		return nil, 0, errEncryptedFileInvalid
+	} else if err != nil {
+		return nil, 0, err
+	}
+	key, ok := k.keys[string(header[len(encryptionPrefix):len(encryptionPrefix)+encryptionKeyIDLength])]
+	if !ok {
+		return nil, 0, errEncryptionKeyUnknown
+	}
+	plaintextSize, err := encryptedFilePlaintextSize(size, key.aead.Overhead())
+	if err != nil {
+		return nil, 0, err
+	}
+	noncePrefix := make([]byte, encryptionNoncePrefixSize)
+	copy(noncePrefix, header[len(encryptionPrefix)+encryptionKeyIDLength:])
+	if _, err := br.Discard(encryptionHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	return &decryptReader{
+		r:           br,
+		aead:        key.aead,
+		noncePrefix: noncePrefix,
+		chunk:       make([]byte, encryptionChunkSize+key.aead.Overhead()),
+	}, plaintextSize, nil
+}
+
+// PrimaryKeyID returns the ID of the key used to encrypt new data
+func (k *keyring) PrimaryKeyID() string {
+	return k.primary.id
+}
+
+// encryptedFileKeyID returns the ID of the key the encrypted file contents were encrypted with
+func encryptedFileKeyID(r io.Reader) (string, error) {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(r, header); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", errEncryptedFileInvalid
+	} else if err != nil {
+		return "", err
+	} else if !bytes.HasPrefix(header, []byte(encryptionPrefix)) {
+		return "", errEncryptedFileInvalid
+	}
+	return string(header[len(encryptionPrefix) : len(encryptionPrefix)+encryptionKeyIDLength]), nil
+}
+
+// encryptedFilePlaintextSize calculates the plaintext size of an encrypted file from its size on disk. Every
+// file has at least one (possibly empty) chunk, and only the last chunk may be smaller than the chunk size.
+func encryptedFilePlaintextSize(size int64, overhead int) (int64, error) {
+	payload := size - int64(encryptionHeaderSize)
+	sealedChunkSize := int64(encryptionChunkSize + overhead)
+	chunks := (payload + sealedChunkSize - 1) / sealedChunkSize
+	if payload < int64(overhead) || payload-(chunks-1)*sealedChunkSize < int64(overhead) {
+		return 0, errEncryptedFileInvalid
+	}
+	return payload - chunks*int64(overhead), nil
+}
+
+func chunkNonce(noncePrefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, encryptionNoncePrefixSize+5)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w           io.Writer
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	buf         []byte
+	closed      bool
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, io.ErrClosedPipe
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == encryptionChunkSize {
+			// Only write a full chunk if more data follows, since the last chunk must be sealed with the last flag
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(encryptionChunkSize-len(e.buf), len(p))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.noncePrefix, e.counter, last), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+type decryptReader struct {
+	r           *bufio.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	chunk       []byte
+	plaintext   []byte
+	done        bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plaintext) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plaintext)
+	d.plaintext = d.plaintext[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	last := false
+	if errors.Is(err, io.EOF) {
+		return errEncryptedFileInvalid // The last chunk is missing
+	} else if errors.Is(err, io.ErrUnexpectedEOF) {
+		last = true
+	} else if err != nil {
+		return err
+	} else if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+		last = true
+	} else if err != nil {
+		return err
+	}
+	plaintext, err := d.aead.Open(d.chunk[:0], chunkNonce(d.noncePrefix, d.counter, last), d.chunk[:n], nil)
+	if err != nil {
+		return errEncryptedFileInvalid
+	}
+	d.plaintext = plaintext
+	d.counter++
+	d.done = last
+	return nil
+}
+
+// RotateEncryptionKey generates a new encryption key, and adds it to the top of the given key file, making it
+// the primary key. Existing keys are kept, so that data encrypted with them can still be decrypted. The file is
+// created if it does not exist. It returns the ID of the new key.
+//
+// The server only reads the key file on startup, so it must be restarted for the new key to be used. Existing
+// data can then be re-encrypted with the new key using Reencrypt, after which the old keys may be removed.
+func RotateEncryptionKey(filename string) (string, error) {
+	existing, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	} else if len(existing) > 0 {
+		if _, err := parseKeyring(string(existing)); err != nil {
+			return "", fmt.Errorf("invalid encryption key file %s: %w", filename, err)
+		}
+	}
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	contents := base64.StdEncoding.EncodeToString(key) + "\n" + string(existing)
+	if err := os.WriteFile(filename, []byte(contents), 0600); err != nil {
+		return "", err
+	}
+	return encryptionKeyID(key), nil
+}
+
+// Reencrypt re-encrypts all messages in the message cache, and all attachments in the attachment cache
+// directory with the primary key of the configured encryption key file. Data that is not yet encrypted is
+// encrypted. It returns the number of re-encrypted messages and attachments.
+//
+// The server should not be running while data is re-encrypted, since messages and attachments written in
+// the meantime may still be encrypted with the previous key.
+func Reencrypt(conf *Config) (messages int, attachments int, err error) {
+	if conf.EncryptionKeyFile == "" {
+		return 0, 0, errors.New("no encryption key file configured")
+	}
+	keys, err := loadKeyring(conf.EncryptionKeyFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	if conf.CacheDuration > 0 && conf.CacheFile != "" {
+		cache, err := createMessageCache(conf, keys)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer cache.Close()
+		if messages, err = cache.Reencrypt(); err != nil {
+			return messages, 0, err
+		}
+	}
+	if conf.AttachmentCacheDir != "" || conf.AttachmentS3URL != "" {
+		if conf.CacheDuration == 0 || conf.CacheFile == "" {
+			return messages, 0, errors.New("cannot re-encrypt attachments without a cache file")
+		}
+		cache, err := createMessageCache(conf, keys)
+		if err != nil {
+			return messages, 0, err
+		}
+		defer cache.Close()
+		stored, err := cache.AttachmentsEncrypted()
+		if err != nil {
+			return messages, 0, err
+		}
+		store, err := createAttachmentStore(conf)
+		if err != nil {
+			return messages, 0, err
+		}
+		fileCache := newFileCache(store, conf.AttachmentTotalSizeLimit, keys)
+		if attachments, err = fileCache.Reencrypt(stored, cache.MarkAttachmentEncrypted); err != nil {
+			return messages, attachments, err
+		}
+	}
+	return messages, attachments, nil
+}
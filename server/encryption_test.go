@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring_EncryptDecryptString(t *testing.T) {
+	k := newTestKeyring(t)
+	encrypted, err := k.EncryptString("this is a secret message")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(encrypted, "ntfyenc1:"+k.PrimaryKeyID()+":"))
+	require.NotContains(t, encrypted, "secret")
+
+	decrypted, err := k.DecryptString(encrypted)
+	require.Nil(t, err)
+	require.Equal(t, "this is a secret message", decrypted)
+
+	// Empty strings are not encrypted, plaintext strings are rejected
+	encrypted, err = k.EncryptString("")
+	require.Nil(t, err)
+	require.Equal(t, "", encrypted)
+	decrypted, err = k.DecryptString("")
+	require.Nil(t, err)
+	require.Equal(t, "", decrypted)
+	_, err = k.DecryptString("not encrypted")
+	require.Equal(t, errEncryptedValueInvalid, err)
+
+	// A nil keyring passes through strings, but cannot decrypt
+	var nilKeyring *keyring
+	encrypted, err = nilKeyring.EncryptString("hi")
+	require.Nil(t, err)
+	require.Equal(t, "hi", encrypted)
+	encrypted, _ = k.EncryptString("hi")
+	_, err = nilKeyring.DecryptString(encrypted)
+	require.Equal(t, errEncryptionKeyUnknown, err)
+
+	// Tampered values are rejected
+	tampered := encrypted[:len(encrypted)-1] + "A"
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-1] + "B"
+	}
+	_, err = k.DecryptString(tampered)
+	require.Equal(t, errEncryptedValueInvalid, err)
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	oldKeyring, err := parseKeyring(oldKey)
+	require.Nil(t, err)
+	encrypted, err := oldKeyring.EncryptString("encrypted with old key")
+	require.Nil(t, err)
+
+	// Data encrypted with the previous keys can still be decrypted
+	rotatedKeyring, err := parseKeyring("# Primary key\n" + newKey + "\n\n" + oldKey + "\n")
+	require.Nil(t, err)
+	require.NotEqual(t, oldKeyring.PrimaryKeyID(), rotatedKeyring.PrimaryKeyID())
+	decrypted, err := rotatedKeyring.DecryptString(encrypted)
+	require.Nil(t, err)
+	require.Equal(t, "encrypted with old key", decrypted)
+
+	// Unless the key was removed
+	newKeyring, err := parseKeyring(newKey)
+	require.Nil(t, err)
+	_, err = newKeyring.DecryptString(encrypted)
+	require.Equal(t, errEncryptionKeyUnknown, err)
+}
+
+func TestKeyring_ParseInvalid(t *testing.T) {
+	_, err := parseKeyring("")
+	require.Equal(t, errEncryptionKeyFileEmpty, err)
+	_, err = parseKeyring("# only a comment\n")
+	require.Equal(t, errEncryptionKeyFileEmpty, err)
+	_, err = parseKeyring("not base64!")
+	require.Error(t, err)
+	_, err = parseKeyring(base64.StdEncoding.EncodeToString([]byte("too short")))
+	require.Error(t, err)
+}
+
+func TestKeyring_EncryptDecryptStream(t *testing.T) {
+	k := newTestKeyring(t)
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 17} {
+		plaintext := make([]byte, size)
+		_, err := rand.Read(plaintext)
+		require.Nil(t, err)
+
+		var buf bytes.Buffer
+		w, err := k.NewWriter(&buf)
+		require.Nil(t, err)
+		_, err = w.Write(plaintext)
+		require.Nil(t, err)
+		require.Nil(t, w.Close())
+
+		r, plaintextSize, err := k.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.Nil(t, err)
+		require.Equal(t, int64(size), plaintextSize)
+		decrypted, err := io.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, plaintext, decrypted)
+	}
+}
+
+func TestKeyring_DecryptStream_Truncated(t *testing.T) {
+	k := newTestKeyring(t)
+	var buf bytes.Buffer
+	w, err := k.NewWriter(&buf)
+	require.Nil(t, err)
+	_, err = w.Write(make([]byte, 2*encryptionChunkSize+100))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+
+	// Truncated at a chunk boundary, i.e. the last chunk is missing
+	truncated := buf.Bytes()[:encryptionHeaderSize+2*(encryptionChunkSize+16)]
+	r, _, err := k.NewReader(bytes.NewReader(truncated), int64(len(truncated)))
+	require.Nil(t, err)
+	_, err = io.ReadAll(r)
+	require.Equal(t, errEncryptedFileInvalid, err)
+
+	// Truncated in the middle of a chunk
+	truncated = buf.Bytes()[:buf.Len()-10]
+	r, _, err = k.NewReader(bytes.NewReader(truncated), int64(len(truncated)))
+	require.Nil(t, err)
+	_, err = io.ReadAll(r)
+	require.Equal(t, errEncryptedFileInvalid, err)
+}
+
+func TestKeyring_DecryptStream_NotEncrypted(t *testing.T) {
+	k := newTestKeyring(t)
+	_, _, err := k.NewReader(strings.NewReader("plain file"), 10)
+	require.Equal(t, errEncryptedFileInvalid, err)
+	_, _, err = k.NewReader(strings.NewReader(""), 0)
+	require.Equal(t, errEncryptedFileInvalid, err)
+
+	// Whether a file is encrypted is not derived from its contents, see fileCache
+	_, _, err = (*keyring)(nil).NewReader(strings.NewReader(encryptionPrefix), 8)
+	require.Equal(t, errEncryptedFileWithoutKey, err)
+}
+
+func TestRotateEncryptionKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "encryption.keys")
+	firstKeyID, err := RotateEncryptionKey(filename)
+	require.Nil(t, err)
+	secondKeyID, err := RotateEncryptionKey(filename)
+	require.Nil(t, err)
+	require.NotEqual(t, firstKeyID, secondKeyID)
+
+	k, err := loadKeyring(filename)
+	require.Nil(t, err)
+	require.Equal(t, secondKeyID, k.PrimaryKeyID())
+	require.Equal(t, 2, len(k.keys))
+	stat, err := os.Stat(filename)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	require.Nil(t, os.WriteFile(filename, []byte("invalid"), 0600))
+	_, err = RotateEncryptionKey(filename)
+	require.Error(t, err)
+}
+
+func newTestKey(t *testing.T) string {
+	key := make([]byte, encryptionKeySize)
+	_, err := rand.Read(key)
+	require.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func newTestKeyring(t *testing.T) *keyring {
+	k, err := parseKeyring(newTestKey(t))
+	require.Nil(t, err)
+	return k
+}
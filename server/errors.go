@@ -123,17 +123,48 @@ var (
 	errHTTPBadRequestTemplateDisallowedFunctionCalls = &errHTTP{40044, http.StatusBadRequest, "invalid request: template contains disallowed function calls, e.g. template, call, or define", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestTemplateExecuteFailed           = &errHTTP{40045, http.StatusBadRequest, "invalid request: template execution failed", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestInvalidUsername                 = &errHTTP{40046, http.StatusBadRequest, "invalid request: invalid username", "", nil}
+	errHTTPBadRequestMessageUpdateInvalid            = &errHTTP{40047, http.StatusBadRequest, "invalid request: attachments, delays, e-mails, phone calls and UnifiedPush are not supported when updating a message", "https://ntfy.sh/docs/publish/#updating-and-deleting-messages", nil}
+	errHTTPBadRequestSearchInvalid                   = &errHTTP{40048, http.StatusBadRequest, "invalid request: invalid search parameters", "https://ntfy.sh/docs/subscribe/api/#search-messages", nil}
+	errHTTPBadRequestFilterInvalid                   = &errHTTP{40049, http.StatusBadRequest, "invalid request: invalid filter expression", "https://ntfy.sh/docs/subscribe/api/#filter-expressions", nil}
+	errHTTPBadRequestWebhookInvalid                  = &errHTTP{40050, http.StatusBadRequest, "invalid request: invalid webhook", "https://ntfy.sh/docs/config/#webhooks", nil}
+	errHTTPBadRequestRuleInvalid                     = &errHTTP{40051, http.StatusBadRequest, "invalid request: invalid routing rule", "https://ntfy.sh/docs/config/#routing-rules", nil}
+	errHTTPBadRequestQuietHoursInvalid               = &errHTTP{40052, http.StatusBadRequest, "invalid request: invalid quiet hours schedule", "https://ntfy.sh/docs/config/#quiet-hours", nil}
+	errHTTPBadRequestEscalationInvalid               = &errHTTP{40053, http.StatusBadRequest, "invalid request: invalid escalation policy", "https://ntfy.sh/docs/config/#escalations", nil}
+	errHTTPBadRequestWildcardSubscriptionsDisabled   = &errHTTP{40054, http.StatusBadRequest, "invalid request: wildcard subscriptions are not enabled", "https://ntfy.sh/docs/config/#wildcard-subscriptions", nil}
+	errHTTPBadRequestFederationMessageInvalid        = &errHTTP{40055, http.StatusBadRequest, "invalid request: invalid federated message", "https://ntfy.sh/docs/config/#federation", nil}
+	errHTTPBadRequestEncodingInvalid                 = &errHTTP{40056, http.StatusBadRequest, "invalid request: encoding invalid, only 'jwe' is supported", "https://ntfy.sh/docs/publish/#end-to-end-encryption", nil}
+	errHTTPBadRequestEncryptedMessageInvalid         = &errHTTP{40057, http.StatusBadRequest, "invalid request: encrypted message must be a JWE in compact serialization", "https://ntfy.sh/docs/publish/#end-to-end-encryption", nil}
+	errHTTPBadRequestSearchTextNotSupported          = &errHTTP{40058, http.StatusBadRequest, "invalid request: text search is not supported if encryption at rest is enabled", "https://ntfy.sh/docs/config/#encryption-at-rest", nil}
+	errHTTPBadRequestUploadLengthInvalid             = &errHTTP{40059, http.StatusBadRequest, "invalid request: Upload-Length header missing or invalid", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPBadRequestUploadOffsetInvalid             = &errHTTP{40060, http.StatusBadRequest, "invalid request: Upload-Offset header missing or invalid", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPBadRequestUploadIncomplete                = &errHTTP{40061, http.StatusBadRequest, "invalid request: upload is not complete", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPBadRequestUploadTooManyChunks             = &errHTTP{40062, http.StatusBadRequest, "invalid request: too many chunks for this upload", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPBadRequestOIDCLoginFailed                 = &errHTTP{40063, http.StatusBadRequest, "invalid request: single sign-on failed", "https://ntfy.sh/docs/config/#openid-connect-sso", nil}
+	errHTTPBadRequestGroupInvalid                    = &errHTTP{40064, http.StatusBadRequest, "invalid request: invalid group name", "https://ntfy.sh/docs/config/#groups", nil}
+	errHTTPBadRequestTokenScopeInvalid               = &errHTTP{40065, http.StatusBadRequest, "invalid request: invalid token scope", "https://ntfy.sh/docs/config/#access-tokens", nil}
+	errHTTPBadRequestAllowedIPsInvalid               = &errHTTP{40066, http.StatusBadRequest, "invalid request: invalid IP address or range in allowlist", "https://ntfy.sh/docs/config/#ip-allowlists", nil}
 	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", "", nil}
+	errHTTPNotFoundMessage                           = &errHTTP{40402, http.StatusNotFound, "message not found", "https://ntfy.sh/docs/publish/#updating-and-deleting-messages", nil}
+	errHTTPNotFoundWebhook                           = &errHTTP{40403, http.StatusNotFound, "webhook not found", "https://ntfy.sh/docs/config/#webhooks", nil}
+	errHTTPNotFoundRule                              = &errHTTP{40404, http.StatusNotFound, "routing rule not found", "https://ntfy.sh/docs/config/#routing-rules", nil}
+	errHTTPNotFoundEscalation                        = &errHTTP{40405, http.StatusNotFound, "escalation not found or already acknowledged", "https://ntfy.sh/docs/config/#escalations", nil}
+	errHTTPNotFoundUpload                            = &errHTTP{40406, http.StatusNotFound, "upload not found or expired", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPNotFoundGroup                             = &errHTTP{40407, http.StatusNotFound, "group not found", "https://ntfy.sh/docs/config/#groups", nil}
 	errHTTPUnauthorized                              = &errHTTP{40101, http.StatusUnauthorized, "unauthorized", "https://ntfy.sh/docs/publish/#authentication", nil}
 	errHTTPForbidden                                 = &errHTTP{40301, http.StatusForbidden, "forbidden", "https://ntfy.sh/docs/publish/#authentication", nil}
+	errHTTPForbiddenTokenScope                       = &errHTTP{40302, http.StatusForbidden, "forbidden: the scope of the access token does not allow this request", "https://ntfy.sh/docs/config/#access-tokens", nil}
+	errHTTPForbiddenIPNotAllowed                     = &errHTTP{40303, http.StatusForbidden, "forbidden: login not allowed from this IP address", "https://ntfy.sh/docs/config/#ip-allowlists", nil}
 	errHTTPConflictUserExists                        = &errHTTP{40901, http.StatusConflict, "conflict: user already exists", "", nil}
 	errHTTPConflictTopicReserved                     = &errHTTP{40902, http.StatusConflict, "conflict: access control entry for topic or topic pattern already exists", "", nil}
 	errHTTPConflictSubscriptionExists                = &errHTTP{40903, http.StatusConflict, "conflict: topic subscription already exists", "", nil}
 	errHTTPConflictPhoneNumberExists                 = &errHTTP{40904, http.StatusConflict, "conflict: phone number already exists", "", nil}
+	errHTTPConflictUploadOffset                      = &errHTTP{40905, http.StatusConflict, "conflict: Upload-Offset does not match the number of bytes received", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPConflictGroupExists                       = &errHTTP{40906, http.StatusConflict, "conflict: group already exists", "https://ntfy.sh/docs/config/#groups", nil}
 	errHTTPGonePhoneVerificationExpired              = &errHTTP{41001, http.StatusGone, "phone number verification expired or does not exist", "", nil}
 	errHTTPEntityTooLargeAttachment                  = &errHTTP{41301, http.StatusRequestEntityTooLarge, "attachment too large, or bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPEntityTooLargeMatrixRequest               = &errHTTP{41302, http.StatusRequestEntityTooLarge, "Matrix request is larger than the max allowed length", "", nil}
 	errHTTPEntityTooLargeJSONBody                    = &errHTTP{41303, http.StatusRequestEntityTooLarge, "JSON body too large", "", nil}
+	errHTTPEntityTooLargeEncryptedMessage            = &errHTTP{41304, http.StatusRequestEntityTooLarge, "encrypted message too large", "https://ntfy.sh/docs/publish/#end-to-end-encryption", nil}
 	errHTTPTooManyRequestsLimitRequests              = &errHTTP{42901, http.StatusTooManyRequests, "limit reached: too many requests", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitEmails                = &errHTTP{42902, http.StatusTooManyRequests, "limit reached: too many emails", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitSubscriptions         = &errHTTP{42903, http.StatusTooManyRequests, "limit reached: too many active subscriptions", "https://ntfy.sh/docs/publish/#limitations", nil}
@@ -144,6 +175,7 @@ var (
 	errHTTPTooManyRequestsLimitMessages              = &errHTTP{42908, http.StatusTooManyRequests, "limit reached: daily message quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitAuthFailure           = &errHTTP{42909, http.StatusTooManyRequests, "limit reached: too many auth failures", "https://ntfy.sh/docs/publish/#limitations", nil} // FIXME document limit
 	errHTTPTooManyRequestsLimitCalls                 = &errHTTP{42910, http.StatusTooManyRequests, "limit reached: daily phone call quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
+	errHTTPTooManyRequestsLimitWebhooks              = &errHTTP{42911, http.StatusTooManyRequests, "limit reached: too many webhooks for this user", "https://ntfy.sh/docs/config/#webhooks", nil}
 	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", "", nil}
 	errHTTPInternalErrorInvalidPath                  = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid path", "", nil}
 	errHTTPInternalErrorMissingBaseURL               = &errHTTP{50003, http.StatusInternalServerError, "internal server error: base-url must be be configured for this feature", "https://ntfy.sh/docs/config/", nil}
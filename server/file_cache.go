@@ -7,62 +7,94 @@ import (
 	"heckel.io/ntfy/v2/util"
 	"io"
 	"os"
-	"path/filepath"
 	"regexp"
+	"sort"
 	"sync"
+	"time"
 )
 
 var (
-	fileIDRegex      = regexp.MustCompile(fmt.Sprintf(`^[-_A-Za-z0-9]{%d}$`, messageIDLength))
-	errInvalidFileID = errors.New("invalid file ID")
-	errFileExists    = errors.New("file exists")
+	fileIDRegex        = regexp.MustCompile(fmt.Sprintf(`^[-_A-Za-z0-9]{%d}(%s)?$`, messageIDLength, imagePreviewFileSuffix))
+	uploadChunkIDRegex = regexp.MustCompile(fmt.Sprintf(`^[A-Za-z0-9]{%d}_[A-Za-z0-9]{%d}$`, uploadIDLength, uploadChunkSuffixLength))
+	errInvalidFileID   = errors.New("invalid file ID")
 )
 
+// fileCache stores attachments in an attachmentStore, enforces the total size limit, and encrypts attachments
+// at rest if a keyring is set. Whether a file is encrypted is not derived from its contents, since a plaintext file
+// may look like an encrypted one; callers pass it when opening files (see attachment.Encrypted and
+// upload.Encrypted). The total size of all attachments is tracked in the message cache (see
+// messageCache.AttachmentsSize), so that it is shared by all replicas; it is updated via SetSize.
 type fileCache struct {
-	dir              string
+	store            attachmentStore
 	totalSizeCurrent int64
 	totalSizeLimit   int64
+	keyring          *keyring // Encrypts attachments at rest, may be nil
 	mu               sync.Mutex
 }
 
-func newFileCache(dir string, totalSizeLimit int64) (*fileCache, error) {
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return nil, err
-	}
-	size, err := dirSize(dir)
-	if err != nil {
-		return nil, err
-	}
+func newFileCache(store attachmentStore, totalSizeLimit int64, keyring *keyring) *fileCache {
 	return &fileCache{
-		dir:              dir,
-		totalSizeCurrent: size,
-		totalSizeLimit:   totalSizeLimit,
-	}, nil
+		store:          store,
+		totalSizeLimit: totalSizeLimit,
+		keyring:        keyring,
+	}
 }
 
+// Write stores an attachment, encrypted if a keyring is set, see Encrypted
 func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (int64, error) {
 	if !fileIDRegex.MatchString(id) {
 		return 0, errInvalidFileID
 	}
-	log.Tag(tagFileCache).Field("message_id", id).Debug("Writing attachment")
-	file := filepath.Join(c.dir, id)
-	if _, err := os.Stat(file); err == nil {
-		return 0, errFileExists
+	return c.write(id, c.Encrypted(), in, limiters...)
+}
+
+// WriteChunk stores a chunk of a resumable upload, see handleUploadAppend. Like attachments, chunks count
+// towards the total size limit. All chunks of an upload must be encrypted or not, as recorded when the upload
+// was created, even if the encryption key file was added (or removed) in the meantime.
+func (c *fileCache) WriteChunk(id string, encrypted bool, in io.Reader, limiters ...util.Limiter) (int64, error) {
+	if !uploadChunkIDRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	} else if encrypted && c.keyring == nil {
+		return 0, errEncryptedFileWithoutKey
 	}
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	return c.write(id, encrypted, in, limiters...)
+}
+
+// Encrypted returns true if attachments are encrypted when they are written
+func (c *fileCache) Encrypted() bool {
+	return c.keyring != nil
+}
+
+func (c *fileCache) write(id string, encrypted bool, in io.Reader, limiters ...util.Limiter) (int64, error) {
+	log.Tag(tagFileCache).Field("message_id", id).Debug("Writing attachment")
+	f, err := c.store.Create(id)
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
+	var w io.Writer = f
+	var encryptWriter io.WriteCloser
+	if encrypted {
+		encryptWriter, err = c.keyring.NewWriter(f)
+		if err != nil {
+			f.Abort()
+			return 0, err
+		}
+		w = encryptWriter
+	}
 	limiters = append(limiters, util.NewFixedLimiter(c.Remaining()))
-	limitWriter := util.NewLimitWriter(f, limiters...)
+	limitWriter := util.NewLimitWriter(w, limiters...)
 	size, err := io.Copy(limitWriter, in)
 	if err != nil {
-		os.Remove(file)
+		f.Abort()
 		return 0, err
 	}
+	if encryptWriter != nil {
+		if err := encryptWriter.Close(); err != nil {
+			f.Abort()
+			return 0, err
+		}
+	}
 	if err := f.Close(); err != nil {
-		os.Remove(file)
 		return 0, err
 	}
 	c.mu.Lock()
@@ -72,26 +104,191 @@ func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (in
 	return size, nil
 }
 
+// Open opens the attachment with the given ID for reading, and returns a reader and the size of its contents.
+// Encrypted attachments are decrypted while they are read, so they are never loaded into memory as a whole.
+func (c *fileCache) Open(id string, encrypted bool) (io.ReadCloser, int64, error) {
+	if !fileIDRegex.MatchString(id) {
+		return nil, 0, errInvalidFileID
+	}
+	return c.open(id, encrypted)
+}
+
+// OpenChunks returns a reader for the given chunks of a resumable upload, which reads them one after the other.
+// Chunks are only opened once they are read.
+func (c *fileCache) OpenChunks(ids []string, encrypted bool) (io.ReadCloser, error) {
+	for _, id := range ids {
+		if !uploadChunkIDRegex.MatchString(id) {
+			return nil, errInvalidFileID
+		}
+	}
+	return &chunkReader{cache: c, ids: ids, encrypted: encrypted}, nil
+}
+
+func (c *fileCache) open(id string, encrypted bool) (io.ReadCloser, int64, error) {
+	f, size, err := c.store.Open(id)
+	if err != nil {
+		return nil, 0, err
+	} else if !encrypted {
+		return f, size, nil
+	}
+	r, size, err := c.keyring.NewReader(f, size)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return &struct {
+		io.Reader
+		io.Closer
+	}{r, f}, size, nil
+}
+
+// PresignedURL returns a URL that allows downloading the attachment directly from the store, if the store
+// supports it (see attachmentPresigner). Encrypted attachments cannot be downloaded directly.
+func (c *fileCache) PresignedURL(id, filename, contentType string, expires time.Duration) (string, error) {
+	presigner, ok := c.store.(attachmentPresigner)
+	if !ok || c.keyring != nil {
+		return "", errPresignedURLsNotSupported
+	} else if !fileIDRegex.MatchString(id) {
+		return "", errInvalidFileID
+	}
+	return presigner.PresignedURL(id, filename, contentType, expires)
+}
+
+// Reencrypt encrypts the given attachments (and their preview images) with the primary key of the keyring, unless
+// they are already encrypted with it, and returns the number of re-encrypted attachments. The map contains whether
+// each attachment is currently encrypted, see messageCache.AttachmentsEncrypted. Attachments that do not exist
+// (anymore) are skipped, and attachments are replaced atomically. The done function is called for every attachment
+// that is encrypted now, so that it can be marked as such right away.
+//
+// Attachments that cannot be re-encrypted are logged and skipped, so that a single broken file does not prevent
+// all others from being re-encrypted. If any attachment failed, an error is returned after all were processed.
+func (c *fileCache) Reencrypt(attachments map[string]bool, done func(id string) error) (int, error) {
+	ids := make([]string, 0, len(attachments))
+	for id := range attachments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	count, failed := 0, 0
+	for _, id := range ids {
+		encrypted := attachments[id]
+		reencrypted, err := c.reencrypt(id, encrypted)
+		if err != nil {
+			log.Tag(tagFileCache).Field("message_id", id).Err(err).Warn("Cannot re-encrypt attachment, skipping it")
+			failed++
+			continue
+		}
+		previewReencrypted, err := c.reencrypt(id+imagePreviewFileSuffix, encrypted)
+		if err != nil && reencrypted && !encrypted {
+			// The preview could not be read anymore once the attachment is marked as encrypted
+			log.Tag(tagFileCache).Field("message_id", id).Err(err).Warn("Cannot encrypt preview of attachment, removing it")
+			if err := c.store.Remove(id + imagePreviewFileSuffix); err != nil {
+				log.Tag(tagFileCache).Field("message_id", id).Err(err).Warn("Cannot remove preview of attachment")
+			}
+		} else if err != nil {
+			log.Tag(tagFileCache).Field("message_id", id).Err(err).Warn("Cannot re-encrypt preview of attachment, skipping it")
+			failed++
+		}
+		if reencrypted || previewReencrypted {
+			if err := done(id); err != nil {
+				return count, err
+			}
+		}
+		if reencrypted {
+			count++
+		}
+	}
+	if failed > 0 {
+		return count, fmt.Errorf("cannot re-encrypt %d attachment(s), see log for details", failed)
+	}
+	return count, nil
+}
+
+func (c *fileCache) reencrypt(id string, encrypted bool) (bool, error) {
+	if !fileIDRegex.MatchString(id) {
+		return false, errInvalidFileID
+	}
+	f, _, err := c.store.Open(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if encrypted {
+		keyID, err := encryptedFileKeyID(f)
+		f.Close()
+		if err != nil {
+			return false, err
+		} else if keyID == c.keyring.PrimaryKeyID() {
+			return false, nil
+		}
+	} else {
+		f.Close()
+	}
+	r, _, err := c.open(id, encrypted)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	out, err := c.store.Create(id)
+	if err != nil {
+		return false, err
+	}
+	w, err := c.keyring.NewWriter(out)
+	if err != nil {
+		out.Abort()
+		return false, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		out.Abort()
+		return false, err
+	} else if err := w.Close(); err != nil {
+		out.Abort()
+		return false, err
+	} else if err := out.Close(); err != nil {
+		return false, err
+	}
+	log.Tag(tagFileCache).Field("message_id", id).Debug("Re-encrypted attachment")
+	return true, nil
+}
+
+// Remove deletes the given attachments and their preview images from the store. The total size is not updated
+// until SetSize is called, since the size of the removed attachments is only known to the message cache.
 func (c *fileCache) Remove(ids ...string) error {
 	for _, id := range ids {
 		if !fileIDRegex.MatchString(id) {
 			return errInvalidFileID
 		}
 		log.Tag(tagFileCache).Field("message_id", id).Debug("Deleting attachment")
-		file := filepath.Join(c.dir, id)
-		if err := os.Remove(file); err != nil {
-			log.Tag(tagFileCache).Field("message_id", id).Err(err).Debug("Error deleting attachment")
+		for _, fileID := range []string{id, id + imagePreviewFileSuffix} {
+			if err := c.store.Remove(fileID); err != nil {
+				log.Tag(tagFileCache).Field("message_id", id).Err(err).Debug("Error deleting attachment")
+			}
 		}
 	}
-	size, err := dirSize(c.dir)
-	if err != nil {
-		return err
+	return nil
+}
+
+// RemoveChunks deletes the given chunks of a resumable upload from the store. Like Remove, it does not
+// update the total size.
+func (c *fileCache) RemoveChunks(ids ...string) error {
+	for _, id := range ids {
+		if !uploadChunkIDRegex.MatchString(id) {
+			return errInvalidFileID
+		}
+		log.Tag(tagFileCache).Field("upload_chunk_id", id).Debug("Deleting upload chunk")
+		if err := c.store.Remove(id); err != nil {
+			log.Tag(tagFileCache).Field("upload_chunk_id", id).Err(err).Debug("Error deleting upload chunk")
+		}
 	}
+	return nil
+}
+
+// SetSize sets the total size of all attachments, as tracked by the message cache
+func (c *fileCache) SetSize(size int64) {
 	c.mu.Lock()
 	c.totalSizeCurrent = size
 	c.mu.Unlock()
 	mset(metricAttachmentsTotalSize, size)
-	return nil
 }
 
 func (c *fileCache) Size() int64 {
@@ -110,18 +307,42 @@ func (c *fileCache) Remaining() int64 {
 	return remaining
 }
 
-func dirSize(dir string) (int64, error) {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return 0, err
-	}
-	var size int64
-	for _, e := range entries {
-		info, err := e.Info()
-		if err != nil {
-			return 0, err
+// chunkReader reads the chunks of a resumable upload, see fileCache.OpenChunks
+type chunkReader struct {
+	cache     *fileCache
+	ids       []string
+	encrypted bool
+	current   io.ReadCloser // Chunk that is currently read, may be nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.ids) == 0 {
+				return 0, io.EOF
+			}
+			f, _, err := r.cache.open(r.ids[0], r.encrypted)
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.ids = f, r.ids[1:]
+		}
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
 		}
-		size += info.Size()
+		return n, err
 	}
-	return size, nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
 }
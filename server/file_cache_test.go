@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/util"
+	"io"
 	"os"
 	"strings"
 	"testing"
@@ -24,6 +25,46 @@ func TestFileCache_Write_Success(t *testing.T) {
 	require.Equal(t, int64(10229), c.Remaining())
 }
 
+func TestFileCache_Write_Open_Encrypted(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newLocalAttachmentStore(dir)
+	require.Nil(t, err)
+	c := newFileCache(store, 10*1024, newTestKeyring(t))
+	size, err := c.Write("abcdefghijkl", strings.NewReader("secret file"), util.NewFixedLimiter(999))
+	require.Nil(t, err)
+	require.Equal(t, int64(11), size)
+	require.NotContains(t, readFile(t, dir+"/abcdefghijkl"), "secret file")
+
+	r, size, err := c.Open("abcdefghijkl", true)
+	require.Nil(t, err)
+	defer r.Close()
+	require.Equal(t, int64(11), size)
+	b, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, "secret file", string(b))
+
+	_, _, err = c.Open("notexistent1", true)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestFileCache_Open_PlaintextWithPrefix(t *testing.T) {
+	// Plaintext files written before encryption was enabled are read as is, even if they look encrypted
+	dir, c := newTestFileCache(t)
+	content := encryptionPrefix + "deadbeef" + strings.Repeat("x", 100)
+	_, err := c.Write("abcdefghijkl", strings.NewReader(content))
+	require.Nil(t, err)
+	c = newFileCache(c.store, 10*1024, newTestKeyring(t))
+
+	r, size, err := c.Open("abcdefghijkl", false)
+	require.Nil(t, err)
+	defer r.Close()
+	require.Equal(t, int64(len(content)), size)
+	b, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, content, string(b))
+	require.Equal(t, content, readFile(t, dir+"/abcdefghijkl"))
+}
+
 func TestFileCache_Write_Remove_Success(t *testing.T) {
 	dir, c := newTestFileCache(t) // max = 10k (10240), each = 1k (1024)
 	for i := 0; i < 10; i++ {     // 10x999 = 9990
@@ -39,6 +80,9 @@ func TestFileCache_Write_Remove_Success(t *testing.T) {
 	require.Nil(t, c.Remove("abcdefghijk1", "abcdefghijk5"))
 	require.NoFileExists(t, dir+"/abcdefghijk1")
 	require.NoFileExists(t, dir+"/abcdefghijk5")
+	require.Equal(t, int64(9990), c.Size()) // Size is tracked in the message cache, see SetSize
+
+	c.SetSize(7992)
 	require.Equal(t, int64(7992), c.Size())
 	require.Equal(t, int64(2248), c.Remaining())
 }
@@ -60,13 +104,14 @@ func TestFileCache_Write_FailedAdditionalLimiter(t *testing.T) {
 	_, err := c.Write("abcdefghijkl", bytes.NewReader(make([]byte, 1001)), util.NewFixedLimiter(1000))
 	require.Equal(t, util.ErrLimitReached, err)
 	require.NoFileExists(t, dir+"/abcdefghijkl")
+	require.NoFileExists(t, dir+"/abcdefghijkl.tmp")
 }
 
 func newTestFileCache(t *testing.T) (dir string, cache *fileCache) {
 	dir = t.TempDir()
-	cache, err := newFileCache(dir, 10*1024)
+	store, err := newLocalAttachmentStore(dir)
 	require.Nil(t, err)
-	return dir, cache
+	return dir, newFileCache(store, 10*1024, nil)
 }
 
 func readFile(t *testing.T, f string) string {
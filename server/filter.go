@@ -0,0 +1,445 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/v2/util"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	filterEOF       = rune(0)
+	filterMaxLength = 1024
+	filterMaxDepth  = 16
+)
+
+const (
+	filterFieldID       = "id"
+	filterFieldTopic    = "topic"
+	filterFieldTitle    = "title"
+	filterFieldMessage  = "message"
+	filterFieldTags     = "tags"
+	filterFieldPriority = "priority"
+)
+
+const (
+	filterOpEqual          = "="
+	filterOpNotEqual       = "!="
+	filterOpContains       = "~"
+	filterOpNotContains    = "!~"
+	filterOpRegex          = "=~"
+	filterOpLess           = "<"
+	filterOpLessOrEqual    = "<="
+	filterOpGreater        = ">"
+	filterOpGreaterOrEqual = ">="
+)
+
+var (
+	// filterOps is ordered so that longer operators are matched first
+	filterOps = []string{
+		filterOpRegex,
+		filterOpNotEqual,
+		filterOpNotContains,
+		filterOpLessOrEqual,
+		filterOpGreaterOrEqual,
+		filterOpEqual,
+		filterOpContains,
+		filterOpLess,
+		filterOpGreater,
+	}
+	filterFieldAliases = map[string]string{
+		"id":       filterFieldID,
+		"topic":    filterFieldTopic,
+		"title":    filterFieldTitle,
+		"t":        filterFieldTitle,
+		"message":  filterFieldMessage,
+		"m":        filterFieldMessage,
+		"tags":     filterFieldTags,
+		"tag":      filterFieldTags,
+		"ta":       filterFieldTags,
+		"priority": filterFieldPriority,
+		"prio":     filterFieldPriority,
+		"p":        filterFieldPriority,
+	}
+	filterTextOps          = []string{filterOpEqual, filterOpNotEqual, filterOpContains, filterOpNotContains, filterOpRegex}
+	filterPriorityOps      = []string{filterOpEqual, filterOpNotEqual, filterOpLess, filterOpLessOrEqual, filterOpGreater, filterOpGreaterOrEqual}
+	filterFieldKeyRegex    = regexp.MustCompile(`^[a-zA-Z]+`)
+	errFilterUnexpectedEnd = errors.New("unexpected end of filter expression")
+)
+
+// filterExpr is a node of a parsed filter expression, see parseFilter
+type filterExpr interface {
+	Matches(m *message) bool
+}
+
+type filterAnd struct {
+	left, right filterExpr
+}
+
+func (f *filterAnd) Matches(m *message) bool {
+	return f.left.Matches(m) && f.right.Matches(m)
+}
+
+type filterOr struct {
+	left, right filterExpr
+}
+
+func (f *filterOr) Matches(m *message) bool {
+	return f.left.Matches(m) || f.right.Matches(m)
+}
+
+type filterNot struct {
+	expr filterExpr
+}
+
+func (f *filterNot) Matches(m *message) bool {
+	return !f.expr.Matches(m)
+}
+
+// filterCondition compares a single message field against a value, e.g. "priority>=4" or "title~backup"
+type filterCondition struct {
+	field      string
+	op         string
+	value      string
+	values     []string       // Comma-separated values, for tags
+	priorities []int          // Comma-separated values, for priority
+	regex      *regexp.Regexp // For the =~ operator
+}
+
+func (f *filterCondition) Matches(m *message) bool {
+	switch f.field {
+	case filterFieldTags:
+		return f.matchesTags(m.Tags)
+	case filterFieldPriority:
+		return f.matchesPriority(m.Priority)
+	case filterFieldID:
+		return f.matchesText(m.ID)
+	case filterFieldTopic:
+		return f.matchesText(m.Topic)
+	case filterFieldTitle:
+		if m.Encoding == encodingJWE {
+			return true // The title is encrypted along with the message, so conditions on it are ignored as well
+		}
+		return f.matchesText(m.Title)
+	default:
+		if m.Encoding == encodingJWE {
+			return true // The server cannot read encrypted messages, so conditions on the message text are ignored
+		}
+		return f.matchesText(m.Message)
+	}
+}
+
+func (f *filterCondition) matchesText(s string) bool {
+	switch f.op {
+	case filterOpEqual:
+		return s == f.value
+	case filterOpNotEqual:
+		return s != f.value
+	case filterOpContains:
+		return strings.Contains(strings.ToLower(s), strings.ToLower(f.value))
+	case filterOpNotContains:
+		return !strings.Contains(strings.ToLower(s), strings.ToLower(f.value))
+	default:
+		return f.regex.MatchString(s)
+	}
+}
+
+func (f *filterCondition) matchesTags(tags []string) bool {
+	switch f.op {
+	case filterOpEqual:
+		return util.ContainsAll(tags, f.values)
+	case filterOpNotEqual:
+		return !util.ContainsAll(tags, f.values)
+	case filterOpContains:
+		return containsAny(tags, f.values)
+	case filterOpNotContains:
+		return !containsAny(tags, f.values)
+	default:
+		for _, tag := range tags {
+			if f.regex.MatchString(tag) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (f *filterCondition) matchesPriority(priority int) bool {
+	if priority == 0 {
+		priority = 3 // For query filters, default priority (3) is the same as "not set" (0)
+	}
+	switch f.op {
+	case filterOpEqual:
+		return util.Contains(f.priorities, priority)
+	case filterOpNotEqual:
+		return !util.Contains(f.priorities, priority)
+	case filterOpLess:
+		return priority < f.priorities[0]
+	case filterOpLessOrEqual:
+		return priority <= f.priorities[0]
+	case filterOpGreater:
+		return priority > f.priorities[0]
+	default:
+		return priority >= f.priorities[0]
+	}
+}
+
+func containsAny(haystack []string, needles []string) bool {
+	for _, needle := range needles {
+		if util.Contains(haystack, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+type filterParser struct {
+	input string
+	pos   int
+	depth int
+}
+
+// parseFilter parses a filter expression as described in https://ntfy.sh/docs/subscribe/api/#filter-expressions,
+// e.g. `priority>=4 AND (title~backup OR tags~warning,error) AND NOT message~"dry run"`.
+//
+// Conditions are combined with AND (or &&), OR (or ||), NOT (or !) and parentheses. AND binds stronger than OR.
+func parseFilter(s string) (filterExpr, error) {
+	if len(s) > filterMaxLength {
+		return nil, fmt.Errorf("filter expression too long, must be at most %d characters", filterMaxLength)
+	}
+	p := &filterParser{input: s}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.slurpSpaces()
+	if !p.eof() {
+		return nil, fmt.Errorf("unexpected character '%c' at position %d", p.input[p.pos], p.pos)
+	}
+	return expr, nil
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.consumeKeyword("||", "or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.consumeKeyword("&&", "and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > filterMaxDepth {
+		return nil, fmt.Errorf("filter expression too deeply nested, must be at most %d levels", filterMaxDepth)
+	}
+	p.slurpSpaces()
+	if p.eof() {
+		return nil, errFilterUnexpectedEnd
+	}
+	if p.consumeKeyword("!", "not") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{expr: expr}, nil
+	} else if r, w := p.peek(); r == '(' {
+		p.pos += w
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.slurpSpaces()
+		if r, w := p.peek(); r != ')' {
+			return nil, fmt.Errorf("missing closing parenthesis at position %d", p.pos)
+		} else {
+			p.pos += w
+		}
+		return expr, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *filterParser) parseCondition() (filterExpr, error) {
+	start := p.pos
+	key := filterFieldKeyRegex.FindString(p.input[p.pos:])
+	if key == "" {
+		return nil, fmt.Errorf("expected field name at position %d", start)
+	}
+	field, ok := filterFieldAliases[strings.ToLower(key)]
+	if !ok {
+		return nil, fmt.Errorf("unknown field '%s' at position %d, valid fields are id, topic, title, message, tags and priority", key, start)
+	}
+	p.pos += len(key)
+	p.slurpSpaces()
+	op := p.parseOp()
+	if op == "" {
+		return nil, fmt.Errorf("expected operator after field '%s' at position %d", key, p.pos)
+	}
+	p.slurpSpaces()
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return newFilterCondition(field, op, value)
+}
+
+func newFilterCondition(field, op, value string) (*filterCondition, error) {
+	c := &filterCondition{
+		field: field,
+		op:    op,
+		value: value,
+	}
+	switch field {
+	case filterFieldPriority:
+		if !util.Contains(filterPriorityOps, op) {
+			return nil, fmt.Errorf("operator '%s' not supported for field '%s'", op, field)
+		}
+		for _, v := range util.SplitNoEmpty(value, ",") {
+			priority, err := util.ParsePriority(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority '%s'", v)
+			}
+			c.priorities = append(c.priorities, priority)
+		}
+		if len(c.priorities) == 0 {
+			return nil, fmt.Errorf("missing priority value")
+		} else if len(c.priorities) > 1 && op != filterOpEqual && op != filterOpNotEqual {
+			return nil, fmt.Errorf("operator '%s' only accepts a single priority", op)
+		}
+	case filterFieldTags:
+		if !util.Contains(filterTextOps, op) {
+			return nil, fmt.Errorf("operator '%s' not supported for field '%s'", op, field)
+		}
+		c.values = util.SplitNoEmpty(value, ",")
+		if len(c.values) == 0 && op != filterOpRegex {
+			return nil, fmt.Errorf("missing tags value")
+		}
+	default:
+		if !util.Contains(filterTextOps, op) {
+			return nil, fmt.Errorf("operator '%s' not supported for field '%s'", op, field)
+		}
+	}
+	if op == filterOpRegex {
+		regex, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression '%s'", value)
+		}
+		c.regex = regex
+	}
+	return c, nil
+}
+
+func (p *filterParser) parseOp() string {
+	for _, op := range filterOps {
+		if strings.HasPrefix(p.input[p.pos:], op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+// parseValue parses a quoted value (with \" and \\ escapes), or an unquoted value up to
+// the next whitespace or closing parenthesis
+func (p *filterParser) parseValue() (string, error) {
+	if r, w := p.peek(); r == '"' || r == '\'' {
+		p.pos += w
+		return p.parseQuotedValue(r)
+	}
+	start := p.pos
+	for {
+		r, w := p.peek()
+		if r == filterEOF || unicode.IsSpace(r) || r == ')' {
+			break
+		}
+		p.pos += w
+	}
+	return p.input[start:p.pos], nil
+}
+
+func (p *filterParser) parseQuotedValue(quote rune) (string, error) {
+	var value strings.Builder
+	for {
+		if p.eof() {
+			return "", fmt.Errorf("missing closing quote (%c)", quote)
+		}
+		r, w := p.peek()
+		p.pos += w
+		if r == quote {
+			return value.String(), nil
+		} else if r == '\\' {
+			next, nw := p.peek()
+			if next == quote || next == '\\' {
+				value.WriteRune(next)
+				p.pos += nw
+				continue
+			}
+		}
+		value.WriteRune(r)
+	}
+}
+
+// consumeKeyword skips spaces and consumes one of the given symbol or word keyword (case-insensitive),
+// e.g. "&&" or "and". Word keywords must be followed by a non-letter, so that "android" is not read as "and".
+func (p *filterParser) consumeKeyword(symbol, word string) bool {
+	p.slurpSpaces()
+	rest := p.input[p.pos:]
+	if strings.HasPrefix(rest, symbol) && !strings.HasPrefix(rest, symbol+"=") && !strings.HasPrefix(rest, symbol+"~") {
+		p.pos += len(symbol)
+		return true
+	} else if len(rest) > len(word) && strings.EqualFold(rest[:len(word)], word) {
+		next, _ := utf8.DecodeRuneInString(rest[len(word):])
+		if unicode.IsSpace(next) || next == '(' || next == '!' {
+			p.pos += len(word)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *filterParser) slurpSpaces() {
+	for {
+		r, w := p.peek()
+		if r == filterEOF || !unicode.IsSpace(r) {
+			return
+		}
+		p.pos += w
+	}
+}
+
+func (p *filterParser) peek() (rune, int) {
+	if p.eof() {
+		return filterEOF, 0
+	}
+	return utf8.DecodeRuneInString(p.input[p.pos:])
+}
+
+func (p *filterParser) eof() bool {
+	return p.pos >= len(p.input)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	backup := &message{Event: messageEvent, Topic: "mytopic", Title: "Backup failed", Message: "Backup of /home failed: disk full", Priority: 5, Tags: []string{"backup", "error"}}
+	dryRun := &message{Event: messageEvent, Topic: "mytopic", Title: "Backup succeeded", Message: "Dry run completed", Tags: []string{"backup", "dry-run"}}
+	plain := &message{Event: messageEvent, Topic: "othertopic", Message: "Hello world", Priority: 2}
+
+	tests := []struct {
+		filter  string
+		matches []*message
+	}{
+		{`title~backup`, []*message{backup, dryRun}},
+		{`title~"backup failed"`, []*message{backup}},
+		{`title="Backup failed"`, []*message{backup}},
+		{`title!="Backup failed"`, []*message{dryRun, plain}},
+		{`message!~backup`, []*message{dryRun, plain}},
+		{`message=~"^Backup of /\w+ failed"`, []*message{backup}},
+		{`m=~'(?i)^hello'`, []*message{plain}},
+		{`topic=othertopic`, []*message{plain}},
+		{`priority>=4`, []*message{backup}},
+		{`priority>=default`, []*message{backup, dryRun}},
+		{`priority<3`, []*message{plain}},
+		{`p<=low || p=max`, []*message{backup, plain}},
+		{`priority=2,5`, []*message{backup, plain}},
+		{`priority!=3`, []*message{backup, plain}},
+		{`tags=backup,error`, []*message{backup}},
+		{`tags~error,dry-run`, []*message{backup, dryRun}},
+		{`tags!~error,dry-run`, []*message{plain}},
+		{`tags!=backup,error`, []*message{dryRun, plain}},
+		{`tags=~^dry`, []*message{dryRun}},
+		{`tags~backup AND NOT tags~error`, []*message{dryRun}},
+		{`tags~backup and !tags~error`, []*message{dryRun}},
+		{`priority>=4 OR message~hello`, []*message{backup, plain}},
+		{`title~backup && (priority=5 || message~"dry run")`, []*message{backup, dryRun}},
+		{`title~backup && priority=5 || message~"dry run"`, []*message{backup, dryRun}},
+		{`NOT (title~backup OR topic=othertopic)`, []*message{}},
+		{`not(title~backup)`, []*message{plain}},
+		{`TITLE~BACKUP And Not Tags~error`, []*message{dryRun}},
+		{`message~"say \"hi\""`, []*message{}},
+	}
+	for _, test := range tests {
+		expr, err := parseFilter(test.filter)
+		require.Nil(t, err, "Filter failed: "+test.filter)
+		for _, m := range []*message{backup, dryRun, plain} {
+			expected := false
+			for _, expectedMatch := range test.matches {
+				if m == expectedMatch {
+					expected = true
+				}
+			}
+			require.Equal(t, expected, expr.Matches(m), "Filter failed: %s, message: %s", test.filter, m.Message)
+		}
+	}
+}
+
+func TestParseFilter_QuotedValue(t *testing.T) {
+	expr, err := parseFilter(`message="say \"hi\" (or not)" OR title='it\'s \\ here'`)
+	require.Nil(t, err)
+	require.True(t, expr.Matches(&message{Message: `say "hi" (or not)`}))
+	require.True(t, expr.Matches(&message{Title: `it's \ here`}))
+	require.False(t, expr.Matches(&message{Message: `say "hi"`}))
+}
+
+func TestParseFilter_Errors(t *testing.T) {
+	invalid := []string{
+		``,
+		`title`,
+		`title backup`,
+		`foo=bar`,
+		`(title~backup`,
+		`title~backup)`,
+		`title~backup AND`,
+		`title~backup OR OR title~x`,
+		`title~backup title~x`,
+		`message~"unterminated`,
+		`message=~"(unclosed"`,
+		`priority~4`,
+		`priority=~4`,
+		`priority>=4,5`,
+		`priority=6`,
+		`priority=`,
+		`tags>=a`,
+		`tags=`,
+		`NOT`,
+		`((((((((((((((((((title~a))))))))))))))))))`,
+	}
+	for _, filter := range invalid {
+		_, err := parseFilter(filter)
+		require.Error(t, err, "Filter should fail: "+filter)
+	}
+}
@@ -30,6 +30,15 @@ const (
 	tagWebsocket    = "websocket"
 	tagMatrix       = "matrix"
 	tagWebPush      = "webpush"
+	tagSearch       = "search"
+	tagWebhook      = "webhook"
+	tagRule         = "rule"
+	tagQuietHours   = "quiet_hours"
+	tagEscalation   = "escalation"
+	tagFederation   = "federation"
+	tagCluster      = "cluster"
+	tagUpload       = "upload"
+	tagOIDC         = "oidc"
 )
 
 var (
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/netip"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
@@ -17,9 +19,17 @@ import (
 var (
 	errUnexpectedMessageType = errors.New("unexpected message type")
 	errMessageNotFound       = errors.New("message not found")
+	errEscalationNotFound    = errors.New("escalation not found")
+	errUploadNotFound        = errors.New("upload not found")
+	errUploadConflict        = errors.New("upload was modified concurrently")
 	errNoRows                = errors.New("no rows found")
 )
 
+const (
+	reencryptMessagesBatchSize = 1000 // Max. number of messages loaded into memory at once, see Reencrypt
+	deleteMessagesBatchSize    = 100  // Max. number of messages deleted in one transaction, see DeleteMessages
+)
+
 // Messages cache
 const (
 	createMessagesTableQuery = `
@@ -42,14 +52,21 @@ const (
 			attachment_size INT NOT NULL,
 			attachment_expires INT NOT NULL,
 			attachment_url TEXT NOT NULL,
+			attachment_preview TEXT NOT NULL,
 			attachment_deleted INT NOT NULL,
+			attachment_encrypted INT NOT NULL,
 			sender TEXT NOT NULL,
 			user TEXT NOT NULL,
 			content_type TEXT NOT NULL,
 			encoding TEXT NOT NULL,
+			origin TEXT NOT NULL,
+			encrypted INT NOT NULL,
+			event TEXT NOT NULL,
+			message_id TEXT NOT NULL,
 			published INT NOT NULL
 		);
 		CREATE INDEX IF NOT EXISTS idx_mid ON messages (mid);
+		CREATE INDEX IF NOT EXISTS idx_message_id ON messages (message_id);
 		CREATE INDEX IF NOT EXISTS idx_time ON messages (time);
 		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
 		CREATE INDEX IF NOT EXISTS idx_expires ON messages (expires);
@@ -61,68 +78,191 @@ const (
 			value INT
 		);
 		INSERT INTO stats (key, value) VALUES ('messages', 0);
+		CREATE TABLE IF NOT EXISTS escalations (
+			mid TEXT PRIMARY KEY,
+			policy_id TEXT NOT NULL,
+			token TEXT NOT NULL,
+			step INT NOT NULL,
+			next INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_escalations_next ON escalations (next);
+		CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			secret TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			user TEXT NOT NULL,
+			size INT NOT NULL,
+			received INT NOT NULL,
+			chunks TEXT NOT NULL,
+			encrypted INT NOT NULL,
+			expires INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_uploads_expires ON uploads (expires);
 		COMMIT;
 	`
 	insertMessageQuery = `
-		INSERT INTO messages (mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_deleted, sender, user, content_type, encoding, published)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_deleted, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id, published)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	deleteMessageQuery                = `DELETE FROM messages WHERE mid = ?`
+	deleteMessageChangesQuery         = `DELETE FROM messages WHERE message_id = ?` // Separate from deleteMessageQuery, so that both use an index
 	updateMessagesForTopicExpiryQuery = `UPDATE messages SET expires = ? WHERE topic = ?`
 	selectRowIDFromMessageID          = `SELECT id FROM messages WHERE mid = ?` // Do not include topic, see #336 and TestServer_PollSinceID_MultipleTopics
 	selectMessagesByIDQuery           = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
 		FROM messages 
 		WHERE mid = ?
 	`
 	selectMessagesSinceTimeQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
 		FROM messages 
 		WHERE topic = ? AND time >= ? AND published = 1
 		ORDER BY time, id
 	`
 	selectMessagesSinceTimeIncludeScheduledQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
 		FROM messages 
 		WHERE topic = ? AND time >= ?
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
 		FROM messages 
 		WHERE topic = ? AND id > ? AND published = 1 
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDIncludeScheduledQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
 		FROM messages 
 		WHERE topic = ? AND (id > ? OR published = 0)
 		ORDER BY time, id
 	`
 	selectMessagesDueQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
 		FROM messages 
 		WHERE time <= ? AND published = 0
 		ORDER BY time, id
 	`
-	selectMessagesExpiredQuery      = `SELECT mid FROM messages WHERE expires <= ? AND published = 1`
+	selectMessagesExpiredQuery        = `SELECT mid FROM messages WHERE expires <= ? AND published = 1`
+	selectMessagesAfterMessageIDQuery = `
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
+		FROM messages
+		WHERE mid > ?
+		ORDER BY mid
+		LIMIT ?
+	`
 	updateMessagePublishedQuery     = `UPDATE messages SET published = 1 WHERE mid = ?`
+	updateMessageQuery              = `UPDATE messages SET message = ?, title = ?, priority = ?, tags = ?, click = ?, icon = ?, actions = ?, content_type = ?, encoding = ?, encrypted = ? WHERE mid = ?`
+	updateMessageEncryptionQuery    = `UPDATE messages SET message = ?, title = ?, tags = ?, click = ?, icon = ?, actions = ?, attachment_name = ?, encrypted = 1 WHERE mid = ?`
 	selectMessagesCountQuery        = `SELECT COUNT(*) FROM messages`
 	selectMessageCountPerTopicQuery = `SELECT topic, COUNT(*) FROM messages GROUP BY topic`
 	selectTopicsQuery               = `SELECT topic FROM messages GROUP BY topic`
 
 	updateAttachmentDeleted            = `UPDATE messages SET attachment_deleted = 1 WHERE mid = ?`
+	updateAttachmentEncrypted          = `UPDATE messages SET attachment_encrypted = 1 WHERE mid = ?`
 	selectAttachmentsExpiredQuery      = `SELECT mid FROM messages WHERE attachment_expires > 0 AND attachment_expires <= ? AND attachment_deleted = 0`
-	selectAttachmentsSizeBySenderQuery = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = '' AND sender = ? AND attachment_expires >= ?`
-	selectAttachmentsSizeByUserIDQuery = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = ? AND attachment_expires >= ?`
+	selectAttachmentsSizeBySenderQuery = `
+		SELECT
+			(SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = '' AND sender = ? AND attachment_expires >= ?) +
+			(SELECT IFNULL(SUM(size), 0) FROM uploads WHERE user = '' AND sender = ?)
+	`
+	selectAttachmentsSizeByUserIDQuery = `
+		SELECT
+			(SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = ? AND attachment_expires >= ?) +
+			(SELECT IFNULL(SUM(size), 0) FROM uploads WHERE user = ?)
+	`
+	selectAttachmentsStoredQuery     = `SELECT mid FROM messages WHERE attachment_expires > 0 AND attachment_deleted = 0 AND origin = ''`
+	selectAttachmentsEncryptedQuery  = `SELECT mid, attachment_encrypted FROM messages WHERE attachment_expires > 0 AND attachment_deleted = 0 AND origin = ''`
+	selectAttachmentsSizeStoredQuery = `
+		SELECT
+			(SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE attachment_expires > 0 AND attachment_deleted = 0 AND origin = '') +
+			(SELECT IFNULL(SUM(received), 0) FROM uploads)
+	`
 
 	selectStatsQuery = `SELECT value FROM stats WHERE key = 'messages'`
 	updateStatsQuery = `UPDATE stats SET value = ? WHERE key = 'messages'`
+
+	insertEscalationQuery     = `INSERT INTO escalations (mid, policy_id, token, step, next) VALUES (?, ?, ?, ?, ?)`
+	selectEscalationQuery     = `SELECT mid, policy_id, token, step, next FROM escalations WHERE mid = ?`
+	selectEscalationsDueQuery = `SELECT mid, policy_id, token, step, next FROM escalations WHERE next <= ? ORDER BY next, mid`
+	updateEscalationQuery     = `UPDATE escalations SET step = ?, next = ? WHERE mid = ?`
+	deleteEscalationQuery     = `DELETE FROM escalations WHERE mid = ?`
+
+	insertUploadQuery         = `INSERT INTO uploads (id, secret, sender, user, size, received, chunks, encrypted, expires) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	selectUploadQuery         = `SELECT id, secret, sender, user, size, received, chunks, encrypted, expires FROM uploads WHERE id = ? AND expires > ?`
+	selectUploadsExpiredQuery = `SELECT id, secret, sender, user, size, received, chunks, encrypted, expires FROM uploads WHERE expires <= ?`
+	updateUploadQuery         = `UPDATE uploads SET received = ?, chunks = ? WHERE id = ? AND received = ?`
+	deleteUploadQuery         = `DELETE FROM uploads WHERE id = ?`
+
+	searchMessagesQuery = `
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
+		FROM messages
+		WHERE instr(',' || ? || ',', ',' || topic || ',') > 0 AND time >= ? AND time <= ? AND (time < ? OR (time = ? AND mid < ?)) AND published = 1 AND event = 'message'
+		ORDER BY time DESC, mid DESC
+		LIMIT ?
+	`
+	searchMessagesTextQuery = `
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
+		FROM messages
+		WHERE instr(',' || ? || ',', ',' || topic || ',') > 0 AND time >= ? AND time <= ? AND (time < ? OR (time = ? AND mid < ?)) AND published = 1 AND event = 'message'
+			AND id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)
+		ORDER BY time DESC, mid DESC
+		LIMIT ?
+	`
+	searchMessagesTextNoFTSQuery = `
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_preview, attachment_encrypted, sender, user, content_type, encoding, origin, encrypted, event, message_id
+		FROM messages
+		WHERE instr(',' || ? || ',', ',' || topic || ',') > 0 AND time >= ? AND time <= ? AND (time < ? OR (time = ? AND mid < ?)) AND published = 1 AND event = 'message'
+			AND (title || ' ' || message || ' ' || tags) LIKE ? ESCAPE '\'
+		ORDER BY time DESC, mid DESC
+		LIMIT ?
+	`
+)
+
+// Full-text search index
+//
+// The FTS5 index is not part of the versioned schema, because FTS5 is only available if ntfy is built with the
+// "sqlite_fts5" build tag. If it is available, the index and the triggers that keep it up-to-date are created on
+// startup, and the index is rebuilt if the triggers were missing. If it is not available, the triggers are removed
+// (they would otherwise fail on every insert), and search falls back to a LIKE query. If encryption at rest is
+// enabled, the index is removed as well, since it would only contain ciphertext (and plaintext of older messages).
+const (
+	selectFTS5AvailableQuery           = `SELECT sqlite_compileoption_used('ENABLE_FTS5')`
+	selectMessagesFTSTriggerCountQuery = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'messages_fts_insert'`
+	createMessagesFTSQuery             = `
+		BEGIN;
+		CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(title, message, tags, content = 'messages', content_rowid = 'id');
+		CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, title, message, tags) VALUES (new.id, new.title, new.message, new.tags);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, title, message, tags) VALUES ('delete', old.id, old.title, old.message, old.tags);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF title, message, tags ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, title, message, tags) VALUES ('delete', old.id, old.title, old.message, old.tags);
+			INSERT INTO messages_fts (rowid, title, message, tags) VALUES (new.id, new.title, new.message, new.tags);
+		END;
+		INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');
+		COMMIT;
+	`
+	dropMessagesFTSTriggersQuery = `
+		DROP TRIGGER IF EXISTS messages_fts_insert;
+		DROP TRIGGER IF EXISTS messages_fts_delete;
+		DROP TRIGGER IF EXISTS messages_fts_update;
+	`
+	dropMessagesFTSQuery = `
+		BEGIN;
+		DROP TRIGGER IF EXISTS messages_fts_insert;
+		DROP TRIGGER IF EXISTS messages_fts_delete;
+		DROP TRIGGER IF EXISTS messages_fts_update;
+		DROP TABLE IF EXISTS messages_fts;
+		COMMIT;
+	`
 )
 
 // Schema management queries
 const (
-	currentSchemaVersion          = 13
+	currentSchemaVersion          = 21
 	createSchemaVersionTableQuery = `
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
@@ -251,6 +391,71 @@ const (
 	migrate12To13AlterMessagesTableQuery = `
 		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
 	`
+
+	// 13 -> 14
+	migrate13To14CreateEscalationsTableQuery = `
+		CREATE TABLE IF NOT EXISTS escalations (
+			mid TEXT PRIMARY KEY,
+			policy_id TEXT NOT NULL,
+			token TEXT NOT NULL,
+			step INT NOT NULL,
+			next INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_escalations_next ON escalations (next);
+	`
+
+	// 14 -> 15
+	migrate14To15AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN origin TEXT NOT NULL DEFAULT('');
+	`
+
+	// 15 -> 16
+	migrate15To16AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN attachment_preview TEXT NOT NULL DEFAULT('');
+	`
+
+	// 16 -> 17
+	migrate16To17CreateUploadsTableQuery = `
+		CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			sender TEXT NOT NULL,
+			user TEXT NOT NULL,
+			size INT NOT NULL,
+			received INT NOT NULL,
+			chunks TEXT NOT NULL,
+			expires INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_uploads_expires ON uploads (expires);
+	`
+
+	// 17 -> 18
+	migrate17To18AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN encrypted INT NOT NULL DEFAULT('0');
+	`
+	migrate17To18UpdateMessagesEncryptedQuery = `
+		UPDATE messages SET encrypted = 1 WHERE substr(message, 1, 9) = 'ntfyenc1:' OR substr(title, 1, 9) = 'ntfyenc1:'
+	`
+
+	// 18 -> 19
+	migrate18To19AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN event TEXT NOT NULL DEFAULT('message');
+		ALTER TABLE messages ADD COLUMN message_id TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_message_id ON messages (message_id);
+	`
+
+	// 19 -> 20
+	migrate19To20AlterUploadsTableQuery = `
+		ALTER TABLE uploads ADD COLUMN secret TEXT NOT NULL DEFAULT('');
+		UPDATE uploads SET expires = 0;
+	`
+
+	// 20 -> 21
+	migrate20To21AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN attachment_encrypted INT NOT NULL DEFAULT('0');
+		UPDATE messages SET attachment_encrypted = encrypted WHERE attachment_expires > 0 AND origin = '';
+		ALTER TABLE uploads ADD COLUMN encrypted INT NOT NULL DEFAULT('0');
+		UPDATE uploads SET expires = 0;
+	`
 )
 
 var (
@@ -268,46 +473,181 @@ var (
 		10: migrateFrom10,
 		11: migrateFrom11,
 		12: migrateFrom12,
+		13: migrateFrom13,
+		14: migrateFrom14,
+		15: migrateFrom15,
+		16: migrateFrom16,
+		17: migrateFrom17,
+		18: migrateFrom18,
+		19: migrateFrom19,
+		20: migrateFrom20,
 	}
 )
 
+// messageCacheQueries holds the dialect-specific queries used by the messageCache. This allows
+// the same cache implementation to be used with different database backends (SQLite, PostgreSQL).
+type messageCacheQueries struct {
+	insertMessage                           string
+	deleteMessage                           string
+	deleteMessageChanges                    string
+	updateMessagesForTopicExpiry            string
+	selectRowIDFromMessageID                string
+	selectMessagesByID                      string
+	selectMessagesSinceTime                 string
+	selectMessagesSinceTimeIncludeScheduled string
+	selectMessagesSinceID                   string
+	selectMessagesSinceIDIncludeScheduled   string
+	selectMessagesDue                       string
+	selectMessagesExpired                   string
+	selectMessagesAfterMessageID            string
+	updateMessagePublished                  string
+	updateMessage                           string
+	updateMessageEncryption                 string
+	selectMessageCountPerTopic              string
+	selectTopics                            string
+	updateAttachmentDeleted                 string
+	updateAttachmentEncrypted               string
+	selectAttachmentsExpired                string
+	selectAttachmentsSizeBySender           string
+	selectAttachmentsSizeByUserID           string
+	selectAttachmentsStored                 string
+	selectAttachmentsEncrypted              string
+	selectAttachmentsSizeStored             string
+	selectStats                             string
+	updateStats                             string
+	insertEscalation                        string
+	selectEscalation                        string
+	selectEscalationsDue                    string
+	updateEscalation                        string
+	deleteEscalation                        string
+	insertUpload                            string
+	selectUpload                            string
+	selectUploadsExpired                    string
+	updateUpload                            string
+	deleteUpload                            string
+	searchMessages                          string
+	searchMessagesText                      string
+	searchText                              func(text string) string // Converts the search text to the query argument
+}
+
+var sqliteQueries = &messageCacheQueries{
+	insertMessage:                           insertMessageQuery,
+	deleteMessage:                           deleteMessageQuery,
+	deleteMessageChanges:                    deleteMessageChangesQuery,
+	updateMessagesForTopicExpiry:            updateMessagesForTopicExpiryQuery,
+	selectRowIDFromMessageID:                selectRowIDFromMessageID,
+	selectMessagesByID:                      selectMessagesByIDQuery,
+	selectMessagesSinceTime:                 selectMessagesSinceTimeQuery,
+	selectMessagesSinceTimeIncludeScheduled: selectMessagesSinceTimeIncludeScheduledQuery,
+	selectMessagesSinceID:                   selectMessagesSinceIDQuery,
+	selectMessagesSinceIDIncludeScheduled:   selectMessagesSinceIDIncludeScheduledQuery,
+	selectMessagesDue:                       selectMessagesDueQuery,
+	selectMessagesExpired:                   selectMessagesExpiredQuery,
+	selectMessagesAfterMessageID:            selectMessagesAfterMessageIDQuery,
+	updateMessagePublished:                  updateMessagePublishedQuery,
+	updateMessage:                           updateMessageQuery,
+	updateMessageEncryption:                 updateMessageEncryptionQuery,
+	selectMessageCountPerTopic:              selectMessageCountPerTopicQuery,
+	selectTopics:                            selectTopicsQuery,
+	updateAttachmentDeleted:                 updateAttachmentDeleted,
+	updateAttachmentEncrypted:               updateAttachmentEncrypted,
+	selectAttachmentsExpired:                selectAttachmentsExpiredQuery,
+	selectAttachmentsSizeBySender:           selectAttachmentsSizeBySenderQuery,
+	selectAttachmentsSizeByUserID:           selectAttachmentsSizeByUserIDQuery,
+	selectAttachmentsStored:                 selectAttachmentsStoredQuery,
+	selectAttachmentsEncrypted:              selectAttachmentsEncryptedQuery,
+	selectAttachmentsSizeStored:             selectAttachmentsSizeStoredQuery,
+	selectStats:                             selectStatsQuery,
+	updateStats:                             updateStatsQuery,
+	insertEscalation:                        insertEscalationQuery,
+	selectEscalation:                        selectEscalationQuery,
+	selectEscalationsDue:                    selectEscalationsDueQuery,
+	updateEscalation:                        updateEscalationQuery,
+	deleteEscalation:                        deleteEscalationQuery,
+	insertUpload:                            insertUploadQuery,
+	selectUpload:                            selectUploadQuery,
+	selectUploadsExpired:                    selectUploadsExpiredQuery,
+	updateUpload:                            updateUploadQuery,
+	deleteUpload:                            deleteUploadQuery,
+	searchMessages:                          searchMessagesQuery,
+	searchMessagesText:                      searchMessagesTextQuery,
+	searchText:                              ftsSearchText,
+}
+
+// sqliteQueriesNoFTS are the SQLite queries used if SQLite was built without FTS5, see setupMessagesFTS
+var sqliteQueriesNoFTS = func() *messageCacheQueries {
+	queries := *sqliteQueries
+	queries.searchMessagesText = searchMessagesTextNoFTSQuery
+	queries.searchText = likeSearchText
+	return &queries
+}()
+
 type messageCache struct {
-	db    *sql.DB
-	queue *util.BatchingQueue[*message]
-	nop   bool
+	db      *sql.DB
+	queries *messageCacheQueries
+	queue   *util.BatchingQueue[*message]
+	keyring *keyring // Encrypts message fields at rest, may be nil, see encryptedFields
+	nop     bool
+	writeMu sync.Mutex // Serializes adding and deleting messages, so that publishers get their turn, see DeleteMessages
 }
 
-// newSqliteCache creates a SQLite file-backed cache
-func newSqliteCache(filename, startupQueries string, cacheDuration time.Duration, batchSize int, batchTimeout time.Duration, nop bool) (*messageCache, error) {
-	db, err := sql.Open("sqlite3", filename)
+// newSqliteCache creates a SQLite file-backed cache. If a keyring is passed, message fields are encrypted at rest.
+func newSqliteCache(filename, startupQueries string, cacheDuration time.Duration, batchSize int, batchTimeout time.Duration, nop bool, keyring *keyring) (*messageCache, error) {
+	db, err := sql.Open("sqlite3", sqliteFilenameWithImmediateTx(filename))
 	if err != nil {
 		return nil, err
 	}
 	if err := setupMessagesDB(db, startupQueries, cacheDuration); err != nil {
 		return nil, err
 	}
+	fts, err := setupMessagesFTS(db, keyring != nil)
+	if err != nil {
+		return nil, err
+	}
+	queries := sqliteQueries
+	if !fts {
+		queries = sqliteQueriesNoFTS
+	}
+	return newMessageCache(db, queries, batchSize, batchTimeout, nop, keyring), nil
+}
+
+// sqliteFilenameWithImmediateTx makes all transactions start with "BEGIN IMMEDIATE", so that a transaction that
+// writes waits for other writers (up to SQLite's busy_timeout) instead of failing with "database is locked". Without
+// it, a transaction that reads before it writes (preparing an insert into a table with a full-text index does) fails
+// right away if another connection commits in between, e.g. while expired messages are deleted in batches.
+func sqliteFilenameWithImmediateTx(filename string) string {
+	if strings.Contains(filename, "?") {
+		return filename + "&_txlock=immediate"
+	}
+	return filename + "?_txlock=immediate"
+}
+
+// newMessageCache creates a message cache for an already set up database, using the given dialect-specific queries
+func newMessageCache(db *sql.DB, queries *messageCacheQueries, batchSize int, batchTimeout time.Duration, nop bool, keyring *keyring) *messageCache {
 	var queue *util.BatchingQueue[*message]
 	if batchSize > 0 || batchTimeout > 0 {
 		queue = util.NewBatchingQueue[*message](batchSize, batchTimeout)
 	}
 	cache := &messageCache{
-		db:    db,
-		queue: queue,
-		nop:   nop,
+		db:      db,
+		queries: queries,
+		queue:   queue,
+		keyring: keyring,
+		nop:     nop,
 	}
 	go cache.processMessageBatches()
-	return cache, nil
+	return cache
 }
 
 // newMemCache creates an in-memory cache
 func newMemCache() (*messageCache, error) {
-	return newSqliteCache(createMemoryFilename(), "", 0, 0, 0, false)
+	return newSqliteCache(createMemoryFilename(), "", 0, 0, 0, false, nil)
 }
 
 // newNopCache creates an in-memory cache that discards all messages;
 // it is always empty and can be used if caching is entirely disabled
 func newNopCache() (*messageCache, error) {
-	return newSqliteCache(createMemoryFilename(), "", 0, 0, 0, true)
+	return newSqliteCache(createMemoryFilename(), "", 0, 0, 0, true, nil)
 }
 
 // createMemoryFilename creates a unique memory filename to use for the SQLite backend.
@@ -340,65 +680,70 @@ func (c *messageCache) addMessages(ms []*message) error {
 		return nil
 	}
 	start := time.Now()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	tx, err := c.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
-	stmt, err := tx.Prepare(insertMessageQuery)
+	stmt, err := tx.Prepare(c.queries.insertMessage)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 	for _, m := range ms {
-		if m.Event != messageEvent {
+		if m.Event != messageEvent && m.Event != messageUpdateEvent && m.Event != messageDeleteEvent {
 			return errUnexpectedMessageType
 		}
 		published := m.Time <= time.Now().Unix()
-		tags := strings.Join(m.Tags, ",")
-		var attachmentName, attachmentType, attachmentURL string
-		var attachmentSize, attachmentExpires, attachmentDeleted int64
+		var attachmentType, attachmentURL, attachmentPreview string
+		var attachmentSize, attachmentExpires int64
+		var attachmentEncrypted bool
 		if m.Attachment != nil {
-			attachmentName = m.Attachment.Name
 			attachmentType = m.Attachment.Type
 			attachmentSize = m.Attachment.Size
 			attachmentExpires = m.Attachment.Expires
 			attachmentURL = m.Attachment.URL
+			attachmentPreview = m.Attachment.Preview
+			attachmentEncrypted = m.Attachment.Encrypted
 		}
-		var actionsStr string
-		if len(m.Actions) > 0 {
-			actionsBytes, err := json.Marshal(m.Actions)
-			if err != nil {
-				return err
-			}
-			actionsStr = string(actionsBytes)
+		fields, err := c.encryptedFields(m)
+		if err != nil {
+			return err
 		}
 		var sender string
 		if m.Sender.IsValid() {
 			sender = m.Sender.String()
 		}
-		_, err := stmt.Exec(
+		_, err = stmt.Exec(
 			m.ID,
 			m.Time,
 			m.Expires,
 			m.Topic,
-			m.Message,
-			m.Title,
+			fields.message,
+			fields.title,
 			m.Priority,
-			tags,
-			m.Click,
-			m.Icon,
-			actionsStr,
-			attachmentName,
+			fields.tags,
+			fields.click,
+			fields.icon,
+			fields.actions,
+			fields.attachmentName,
 			attachmentType,
 			attachmentSize,
 			attachmentExpires,
 			attachmentURL,
-			attachmentDeleted, // Always zero
+			attachmentPreview,
+			false, // attachment_deleted
+			attachmentEncrypted,
 			sender,
 			m.User,
 			m.ContentType,
 			m.Encoding,
+			strings.Join(m.Origin, ","),
+			c.keyring != nil, // encrypted
+			m.Event,
+			m.MessageID,
 			published,
 		)
 		if err != nil {
@@ -426,18 +771,18 @@ func (c *messageCache) messagesSinceTime(topic string, since sinceMarker, schedu
 	var rows *sql.Rows
 	var err error
 	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceTimeIncludeScheduledQuery, topic, since.Time().Unix())
+		rows, err = c.db.Query(c.queries.selectMessagesSinceTimeIncludeScheduled, topic, since.Time().Unix())
 	} else {
-		rows, err = c.db.Query(selectMessagesSinceTimeQuery, topic, since.Time().Unix())
+		rows, err = c.db.Query(c.queries.selectMessagesSinceTime, topic, since.Time().Unix())
 	}
 	if err != nil {
 		return nil, err
 	}
-	return readMessages(rows)
+	return c.readMessages(rows)
 }
 
 func (c *messageCache) messagesSinceID(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
-	idrows, err := c.db.Query(selectRowIDFromMessageID, since.ID())
+	idrows, err := c.db.Query(c.queries.selectRowIDFromMessageID, since.ID())
 	if err != nil {
 		return nil, err
 	}
@@ -452,27 +797,27 @@ func (c *messageCache) messagesSinceID(topic string, since sinceMarker, schedule
 	idrows.Close()
 	var rows *sql.Rows
 	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceIDIncludeScheduledQuery, topic, rowID)
+		rows, err = c.db.Query(c.queries.selectMessagesSinceIDIncludeScheduled, topic, rowID)
 	} else {
-		rows, err = c.db.Query(selectMessagesSinceIDQuery, topic, rowID)
+		rows, err = c.db.Query(c.queries.selectMessagesSinceID, topic, rowID)
 	}
 	if err != nil {
 		return nil, err
 	}
-	return readMessages(rows)
+	return c.readMessages(rows)
 }
 
 func (c *messageCache) MessagesDue() ([]*message, error) {
-	rows, err := c.db.Query(selectMessagesDueQuery, time.Now().Unix())
+	rows, err := c.db.Query(c.queries.selectMessagesDue, time.Now().Unix())
 	if err != nil {
 		return nil, err
 	}
-	return readMessages(rows)
+	return c.readMessages(rows)
 }
 
 // MessagesExpired returns a list of IDs for messages that have expires (should be deleted)
 func (c *messageCache) MessagesExpired() ([]string, error) {
-	rows, err := c.db.Query(selectMessagesExpiredQuery, time.Now().Unix())
+	rows, err := c.db.Query(c.queries.selectMessagesExpired, time.Now().Unix())
 	if err != nil {
 		return nil, err
 	}
@@ -492,24 +837,176 @@ func (c *messageCache) MessagesExpired() ([]string, error) {
 }
 
 func (c *messageCache) Message(id string) (*message, error) {
-	rows, err := c.db.Query(selectMessagesByIDQuery, id)
+	rows, err := c.db.Query(c.queries.selectMessagesByID, id)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	if !rows.Next() {
 		return nil, errMessageNotFound
 	}
-	defer rows.Close()
-	return readMessage(rows)
+	return c.readMessage(rows)
 }
 
 func (c *messageCache) MarkPublished(m *message) error {
-	_, err := c.db.Exec(updateMessagePublishedQuery, m.ID)
+	_, err := c.db.Exec(c.queries.updateMessagePublished, m.ID)
 	return err
 }
 
+// Search returns the messages matching the given search, newest first. Only published messages are returned.
+func (c *messageCache) Search(q *messageSearch) ([]*message, error) {
+	cursorTime, cursorID := int64(math.MaxInt64), ""
+	if q.Cursor != nil {
+		cursorTime, cursorID = q.Cursor.Time, q.Cursor.ID
+	}
+	query := c.queries.searchMessages
+	args := []any{strings.Join(q.Topics, ","), q.Since.Unix(), q.Until.Unix(), cursorTime, cursorTime, cursorID}
+	if strings.TrimSpace(q.Text) != "" {
+		query = c.queries.searchMessagesText
+		args = append(args, c.queries.searchText(q.Text))
+	}
+	args = append(args, q.Limit)
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(rows)
+}
+
+// UpdateMessage replaces the content of an existing message, i.e. the message body, title, priority, tags,
+// click action, icon, actions, content type and encoding. All other fields (time, expiry, attachment, ...) are
+// left untouched.
+func (c *messageCache) UpdateMessage(m *message) error {
+	if c.nop {
+		return nil
+	}
+	fields, err := c.encryptedFields(m)
+	if err != nil {
+		return err
+	}
+	result, err := c.db.Exec(
+		c.queries.updateMessage,
+		fields.message,
+		fields.title,
+		m.Priority,
+		fields.tags,
+		fields.click,
+		fields.icon,
+		fields.actions,
+		m.ContentType,
+		m.Encoding,
+		c.keyring != nil, // encrypted
+		m.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+// Reencrypt re-encrypts the fields of all messages with the primary key of the keyring, and returns the
+// number of messages. Messages that are not yet encrypted are encrypted. Messages are processed in batches
+// of reencryptMessagesBatchSize, so that large caches do not have to be loaded into memory.
+func (c *messageCache) Reencrypt() (int, error) {
+	count, after := 0, ""
+	for {
+		rows, err := c.db.Query(c.queries.selectMessagesAfterMessageID, after, reencryptMessagesBatchSize)
+		if err != nil {
+			return count, err
+		}
+		messages, err := c.readMessages(rows)
+		if err != nil {
+			return count, err
+		} else if len(messages) == 0 {
+			return count, nil
+		}
+		if err := c.reencryptMessages(messages); err != nil {
+			return count, err
+		}
+		count += len(messages)
+		after = messages[len(messages)-1].ID
+	}
+}
+
+func (c *messageCache) reencryptMessages(messages []*message) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range messages {
+		fields, err := c.encryptedFields(m)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			c.queries.updateMessageEncryption,
+			fields.message,
+			fields.title,
+			fields.tags,
+			fields.click,
+			fields.icon,
+			fields.actions,
+			fields.attachmentName,
+			m.ID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// messageFields are the message fields that are encrypted at rest, as they are stored in the database
+type messageFields struct {
+	message        string
+	title          string
+	tags           string
+	click          string
+	icon           string
+	actions        string
+	attachmentName string
+}
+
+// encryptedFields returns the fields of the message that contain user content, encrypted with the primary key
+// of the keyring. If encryption at rest is disabled, they are returned as is.
+func (c *messageCache) encryptedFields(m *message) (*messageFields, error) {
+	var actions string
+	if len(m.Actions) > 0 {
+		actionsBytes, err := json.Marshal(m.Actions)
+		if err != nil {
+			return nil, err
+		}
+		actions = string(actionsBytes)
+	}
+	fields := &messageFields{
+		message: m.Message,
+		title:   m.Title,
+		tags:    strings.Join(m.Tags, ","),
+		click:   m.Click,
+		icon:    m.Icon,
+		actions: actions,
+	}
+	if m.Attachment != nil {
+		fields.attachmentName = m.Attachment.Name
+	}
+	for _, field := range []*string{&fields.message, &fields.title, &fields.tags, &fields.click, &fields.icon, &fields.actions, &fields.attachmentName} {
+		encrypted, err := c.keyring.EncryptString(*field)
+		if err != nil {
+			return nil, err
+		}
+		*field = encrypted
+	}
+	return fields, nil
+}
+
 func (c *messageCache) MessageCounts() (map[string]int, error) {
-	rows, err := c.db.Query(selectMessageCountPerTopicQuery)
+	rows, err := c.db.Query(c.queries.selectMessageCountPerTopic)
 	if err != nil {
 		return nil, err
 	}
@@ -529,7 +1026,7 @@ func (c *messageCache) MessageCounts() (map[string]int, error) {
 }
 
 func (c *messageCache) Topics() (map[string]*topic, error) {
-	rows, err := c.db.Query(selectTopicsQuery)
+	rows, err := c.db.Query(c.queries.selectTopics)
 	if err != nil {
 		return nil, err
 	}
@@ -548,20 +1045,177 @@ func (c *messageCache) Topics() (map[string]*topic, error) {
 	return topics, nil
 }
 
+// DeleteMessages deletes the given messages, their updates and their escalations. Messages are deleted in batches,
+// each in its own short transaction, so that publishing is not blocked for long if many messages expire at once.
+// SQLite's busy handler polls and does not queue writers, so writeMu makes sure that waiting publishers get their
+// turn in between.
 func (c *messageCache) DeleteMessages(ids ...string) error {
+	for i := 0; i < len(ids); i += deleteMessagesBatchSize {
+		if err := c.deleteMessages(ids[i:min(i+deleteMessagesBatchSize, len(ids))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *messageCache) deleteMessages(ids []string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	tx, err := c.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 	for _, id := range ids {
-		if _, err := tx.Exec(deleteMessageQuery, id); err != nil {
+		if _, err := tx.Exec(c.queries.deleteMessage, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(c.queries.deleteMessageChanges, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(c.queries.deleteEscalation, id); err != nil {
 			return err
 		}
 	}
 	return tx.Commit()
 }
 
+// AddEscalation stores the state of a new escalation
+func (c *messageCache) AddEscalation(e *escalation) error {
+	_, err := c.db.Exec(c.queries.insertEscalation, e.MessageID, e.PolicyID, e.Token, e.Step, e.Next)
+	return err
+}
+
+// Escalation returns the escalation state of the given message, or errEscalationNotFound
+func (c *messageCache) Escalation(messageID string) (*escalation, error) {
+	rows, err := c.db.Query(c.queries.selectEscalation, messageID)
+	if err != nil {
+		return nil, err
+	}
+	escalations, err := readEscalations(rows)
+	if err != nil {
+		return nil, err
+	} else if len(escalations) == 0 {
+		return nil, errEscalationNotFound
+	}
+	return escalations[0], nil
+}
+
+// EscalationsDue returns all escalations whose next step is due
+func (c *messageCache) EscalationsDue() ([]*escalation, error) {
+	rows, err := c.db.Query(c.queries.selectEscalationsDue, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return readEscalations(rows)
+}
+
+// UpdateEscalation stores the step and due time of the escalation
+func (c *messageCache) UpdateEscalation(e *escalation) error {
+	_, err := c.db.Exec(c.queries.updateEscalation, e.Step, e.Next, e.MessageID)
+	return err
+}
+
+// RemoveEscalation deletes the escalation state of the given message, e.g. when it was acknowledged
+func (c *messageCache) RemoveEscalation(messageID string) error {
+	_, err := c.db.Exec(c.queries.deleteEscalation, messageID)
+	return err
+}
+
+func readEscalations(rows *sql.Rows) ([]*escalation, error) {
+	defer rows.Close()
+	escalations := make([]*escalation, 0)
+	for rows.Next() {
+		var e escalation
+		if err := rows.Scan(&e.MessageID, &e.PolicyID, &e.Token, &e.Step, &e.Next); err != nil {
+			return nil, err
+		}
+		escalations = append(escalations, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return escalations, nil
+}
+
+// AddUpload stores the state of a new resumable upload
+func (c *messageCache) AddUpload(u *upload) error {
+	_, err := c.db.Exec(c.queries.insertUpload, u.ID, u.Secret, u.Sender.String(), u.User, u.Size, u.Received, strings.Join(u.Chunks, ","), u.Encrypted, u.Expires)
+	return err
+}
+
+// Upload returns the resumable upload with the given ID, or errUploadNotFound if it does not exist or is expired
+func (c *messageCache) Upload(id string) (*upload, error) {
+	rows, err := c.db.Query(c.queries.selectUpload, id, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := readUploads(rows)
+	if err != nil {
+		return nil, err
+	} else if len(uploads) == 0 {
+		return nil, errUploadNotFound
+	}
+	return uploads[0], nil
+}
+
+// UploadsExpired returns all resumable uploads that have expired
+func (c *messageCache) UploadsExpired() ([]*upload, error) {
+	rows, err := c.db.Query(c.queries.selectUploadsExpired, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return readUploads(rows)
+}
+
+// UpdateUpload stores the number of bytes received and the chunk IDs. To detect concurrent appends (e.g. on another
+// replica), the update only succeeds if the number of bytes received in the database is still previousReceived;
+// otherwise errUploadConflict is returned.
+func (c *messageCache) UpdateUpload(u *upload, previousReceived int64) error {
+	result, err := c.db.Exec(c.queries.updateUpload, u.Received, strings.Join(u.Chunks, ","), u.ID, previousReceived)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if updated == 0 {
+		return errUploadConflict
+	}
+	return nil
+}
+
+// RemoveUpload deletes the state of a resumable upload, e.g. after it was attached to a message
+func (c *messageCache) RemoveUpload(id string) error {
+	_, err := c.db.Exec(c.queries.deleteUpload, id)
+	return err
+}
+
+func readUploads(rows *sql.Rows) ([]*upload, error) {
+	defer rows.Close()
+	uploads := make([]*upload, 0)
+	for rows.Next() {
+		var u upload
+		var sender, chunks string
+		if err := rows.Scan(&u.ID, &u.Secret, &sender, &u.User, &u.Size, &u.Received, &chunks, &u.Encrypted, &u.Expires); err != nil {
+			return nil, err
+		}
+		if chunks != "" {
+			u.Chunks = strings.Split(chunks, ",")
+		}
+		senderIP, err := netip.ParseAddr(sender)
+		if err != nil {
+			senderIP = netip.Addr{} // if no IP stored in database, return invalid address
+		}
+		u.Sender = senderIP
+		uploads = append(uploads, &u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
 func (c *messageCache) ExpireMessages(topics ...string) error {
 	tx, err := c.db.Begin()
 	if err != nil {
@@ -569,7 +1223,7 @@ func (c *messageCache) ExpireMessages(topics ...string) error {
 	}
 	defer tx.Rollback()
 	for _, t := range topics {
-		if _, err := tx.Exec(updateMessagesForTopicExpiryQuery, time.Now().Unix()-1, t); err != nil {
+		if _, err := tx.Exec(c.queries.updateMessagesForTopicExpiry, time.Now().Unix()-1, t); err != nil {
 			return err
 		}
 	}
@@ -577,10 +1231,35 @@ func (c *messageCache) ExpireMessages(topics ...string) error {
 }
 
 func (c *messageCache) AttachmentsExpired() ([]string, error) {
-	rows, err := c.db.Query(selectAttachmentsExpiredQuery, time.Now().Unix())
+	rows, err := c.db.Query(c.queries.selectAttachmentsExpired, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return readMessageIDs(rows)
+}
+
+// AttachmentsStored returns the IDs of all messages with an attachment in the attachment store, i.e. all uploaded
+// attachments that were not yet deleted. Attachments of messages received from federation peers are not included,
+// since they are stored by the peer.
+func (c *messageCache) AttachmentsStored() ([]string, error) {
+	rows, err := c.db.Query(c.queries.selectAttachmentsStored)
 	if err != nil {
 		return nil, err
 	}
+	return readMessageIDs(rows)
+}
+
+// AttachmentsSize returns the total size of all attachments in the attachment store (see AttachmentsStored), including
+// the chunks of resumable uploads
+func (c *messageCache) AttachmentsSize() (int64, error) {
+	rows, err := c.db.Query(c.queries.selectAttachmentsSizeStored)
+	if err != nil {
+		return 0, err
+	}
+	return c.readAttachmentBytesUsed(rows)
+}
+
+func readMessageIDs(rows *sql.Rows) ([]string, error) {
 	defer rows.Close()
 	ids := make([]string, 0)
 	for rows.Next() {
@@ -596,6 +1275,35 @@ func (c *messageCache) AttachmentsExpired() ([]string, error) {
 	return ids, nil
 }
 
+// AttachmentsEncrypted returns the IDs of all attachments in the attachment store (see AttachmentsStored), and whether
+// they are encrypted at rest
+func (c *messageCache) AttachmentsEncrypted() (map[string]bool, error) {
+	rows, err := c.db.Query(c.queries.selectAttachmentsEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attachments := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		var encrypted bool
+		if err := rows.Scan(&id, &encrypted); err != nil {
+			return nil, err
+		}
+		attachments[id] = encrypted
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// MarkAttachmentEncrypted records that the given attachment is encrypted at rest, see fileCache.Reencrypt
+func (c *messageCache) MarkAttachmentEncrypted(id string) error {
+	_, err := c.db.Exec(c.queries.updateAttachmentEncrypted, id)
+	return err
+}
+
 func (c *messageCache) MarkAttachmentsDeleted(ids ...string) error {
 	tx, err := c.db.Begin()
 	if err != nil {
@@ -603,7 +1311,7 @@ func (c *messageCache) MarkAttachmentsDeleted(ids ...string) error {
 	}
 	defer tx.Rollback()
 	for _, id := range ids {
-		if _, err := tx.Exec(updateAttachmentDeleted, id); err != nil {
+		if _, err := tx.Exec(c.queries.updateAttachmentDeleted, id); err != nil {
 			return err
 		}
 	}
@@ -611,7 +1319,7 @@ func (c *messageCache) MarkAttachmentsDeleted(ids ...string) error {
 }
 
 func (c *messageCache) AttachmentBytesUsedBySender(sender string) (int64, error) {
-	rows, err := c.db.Query(selectAttachmentsSizeBySenderQuery, sender, time.Now().Unix())
+	rows, err := c.db.Query(c.queries.selectAttachmentsSizeBySender, sender, time.Now().Unix(), sender)
 	if err != nil {
 		return 0, err
 	}
@@ -619,7 +1327,7 @@ func (c *messageCache) AttachmentBytesUsedBySender(sender string) (int64, error)
 }
 
 func (c *messageCache) AttachmentBytesUsedByUser(userID string) (int64, error) {
-	rows, err := c.db.Query(selectAttachmentsSizeByUserIDQuery, userID, time.Now().Unix())
+	rows, err := c.db.Query(c.queries.selectAttachmentsSizeByUserID, userID, time.Now().Unix(), userID)
 	if err != nil {
 		return 0, err
 	}
@@ -651,11 +1359,11 @@ func (c *messageCache) processMessageBatches() {
 	}
 }
 
-func readMessages(rows *sql.Rows) ([]*message, error) {
+func (c *messageCache) readMessages(rows *sql.Rows) ([]*message, error) {
 	defer rows.Close()
 	messages := make([]*message, 0)
 	for rows.Next() {
-		m, err := readMessage(rows)
+		m, err := c.readMessage(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -667,10 +1375,11 @@ func readMessages(rows *sql.Rows) ([]*message, error) {
 	return messages, nil
 }
 
-func readMessage(rows *sql.Rows) (*message, error) {
+func (c *messageCache) readMessage(rows *sql.Rows) (*message, error) {
 	var timestamp, expires, attachmentSize, attachmentExpires int64
 	var priority int
-	var id, topic, msg, title, tagsStr, click, icon, actionsStr, attachmentName, attachmentType, attachmentURL, sender, user, contentType, encoding string
+	var encrypted, attachmentEncrypted bool
+	var id, topic, msg, title, tagsStr, click, icon, actionsStr, attachmentName, attachmentType, attachmentURL, attachmentPreview, sender, user, contentType, encoding, originStr, event, messageID string
 	err := rows.Scan(
 		&id,
 		&timestamp,
@@ -688,18 +1397,35 @@ func readMessage(rows *sql.Rows) (*message, error) {
 		&attachmentSize,
 		&attachmentExpires,
 		&attachmentURL,
+		&attachmentPreview,
+		&attachmentEncrypted,
 		&sender,
 		&user,
 		&contentType,
 		&encoding,
+		&originStr,
+		&encrypted,
+		&event,
+		&messageID,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if encrypted {
+		for _, field := range []*string{&msg, &title, &tagsStr, &click, &icon, &actionsStr, &attachmentName} {
+			if *field, err = c.keyring.DecryptString(*field); err != nil {
+				return nil, fmt.Errorf("cannot decrypt message %s: %w", id, err)
+			}
+		}
+	}
 	var tags []string
 	if tagsStr != "" {
 		tags = strings.Split(tagsStr, ",")
 	}
+	var origin []string
+	if originStr != "" {
+		origin = strings.Split(originStr, ",")
+	}
 	var actions []*action
 	if actionsStr != "" {
 		if err := json.Unmarshal([]byte(actionsStr), &actions); err != nil {
@@ -713,18 +1439,20 @@ func readMessage(rows *sql.Rows) (*message, error) {
 	var att *attachment
 	if attachmentName != "" && attachmentURL != "" {
 		att = &attachment{
-			Name:    attachmentName,
-			Type:    attachmentType,
-			Size:    attachmentSize,
-			Expires: attachmentExpires,
-			URL:     attachmentURL,
+			Name:      attachmentName,
+			Type:      attachmentType,
+			Size:      attachmentSize,
+			Expires:   attachmentExpires,
+			URL:       attachmentURL,
+			Preview:   attachmentPreview,
+			Encrypted: attachmentEncrypted,
 		}
 	}
 	return &message{
 		ID:          id,
 		Time:        timestamp,
 		Expires:     expires,
-		Event:       messageEvent,
+		Event:       event,
 		Topic:       topic,
 		Message:     msg,
 		Title:       title,
@@ -738,16 +1466,18 @@ func readMessage(rows *sql.Rows) (*message, error) {
 		User:        user,
 		ContentType: contentType,
 		Encoding:    encoding,
+		Origin:      origin,
+		MessageID:   messageID,
 	}, nil
 }
 
 func (c *messageCache) UpdateStats(messages int64) error {
-	_, err := c.db.Exec(updateStatsQuery, messages)
+	_, err := c.db.Exec(c.queries.updateStats, messages)
 	return err
 }
 
 func (c *messageCache) Stats() (messages int64, err error) {
-	rows, err := c.db.Query(selectStatsQuery)
+	rows, err := c.db.Query(c.queries.selectStats)
 	if err != nil {
 		return 0, err
 	}
@@ -811,6 +1541,55 @@ func setupMessagesDB(db *sql.DB, startupQueries string, cacheDuration time.Durat
 	return nil
 }
 
+// setupMessagesFTS creates the full-text search index if SQLite was built with FTS5 and the message cache is not
+// encrypted, and returns whether it is available. See createMessagesFTSQuery for details.
+func setupMessagesFTS(db *sql.DB, encrypted bool) (bool, error) {
+	var available bool
+	if err := db.QueryRow(selectFTS5AvailableQuery).Scan(&available); err != nil {
+		return false, err
+	}
+	if available && encrypted {
+		log.Tag(tagMessageCache).Debug("Encryption at rest is enabled, removing full-text search index")
+		if _, err := db.Exec(dropMessagesFTSQuery); err != nil {
+			return false, err
+		}
+		return false, nil
+	} else if !available {
+		log.Tag(tagMessageCache).Debug("SQLite was built without FTS5, message search will be slow")
+		if _, err := db.Exec(dropMessagesFTSTriggersQuery); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	var triggers int
+	if err := db.QueryRow(selectMessagesFTSTriggerCountQuery).Scan(&triggers); err != nil {
+		return false, err
+	} else if triggers > 0 {
+		return true, nil
+	}
+	log.Tag(tagMessageCache).Info("Creating full-text search index for message cache")
+	if _, err := db.Exec(createMessagesFTSQuery); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ftsSearchText turns the search text into an FTS5 query in which all words must match. Every word is quoted,
+// so that FTS5 operators and special characters in the search text are not interpreted.
+func ftsSearchText(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// likeSearchText turns the search text into a LIKE pattern, see searchMessagesTextNoFTSQuery
+func likeSearchText(text string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + escaper.Replace(strings.TrimSpace(text)) + "%"
+}
+
 func setupNewCacheDB(db *sql.DB) error {
 	if _, err := db.Exec(createMessagesTableQuery); err != nil {
 		return err
@@ -992,3 +1771,139 @@ func migrateFrom12(db *sql.DB, _ time.Duration) error {
 	}
 	return tx.Commit()
 }
+
+func migrateFrom13(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 13 to 14")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate13To14CreateEscalationsTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 14); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom14(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 14 to 15")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate14To15AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 15); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom15(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 15 to 16")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate15To16AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 16); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom16(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 16 to 17")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate16To17CreateUploadsTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 17); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom17(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 17 to 18")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate17To18AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(migrate17To18UpdateMessagesEncryptedQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 18); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom18(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 18 to 19")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate18To19AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 19); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateFrom19 adds the upload secret. Uploads created before cannot be resumed without it, so they are expired
+// right away, which removes their chunks, see Server.pruneAttachments.
+func migrateFrom19(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 19 to 20")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate19To20AlterUploadsTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 20); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateFrom20 records whether attachments are encrypted at rest, instead of guessing it from the file contents.
+// Attachments are written by the same server as their message, so they are encrypted if the message is. Uploads
+// are expired, since it is not known whether their chunks are encrypted.
+func migrateFrom20(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 20 to 21")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate20To21AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 21); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
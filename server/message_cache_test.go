@@ -4,11 +4,14 @@ import (
 	"database/sql"
 	"fmt"
 	"net/netip"
+	"net/url"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/util"
 )
 
 func TestSqliteCache_Messages(t *testing.T) {
@@ -19,6 +22,10 @@ func TestMemCache_Messages(t *testing.T) {
 	testCacheMessages(t, newMemTestCache(t))
 }
 
+func TestPostgresCache_Messages(t *testing.T) {
+	testCacheMessages(t, newPostgresTestCache(t))
+}
+
 func testCacheMessages(t *testing.T, c *messageCache) {
 	m1 := newDefaultMessage("mytopic", "my message")
 	m1.Time = 1
@@ -85,6 +92,184 @@ func testCacheMessages(t *testing.T, c *messageCache) {
 	require.Empty(t, messages)
 }
 
+func TestSqliteCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newMemTestCache(t))
+}
+
+func TestPostgresCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newPostgresTestCache(t))
+}
+
+func testCacheUpdateMessage(t *testing.T, c *messageCache) {
+	m := newDefaultMessage("mytopic", "deploying")
+	m.Attachment = &attachment{
+		Name:    "log.txt",
+		Size:    1234,
+		Expires: time.Now().Add(time.Hour).Unix(),
+		URL:     "https://ntfy.sh/file/abcdefghijkl.txt",
+	}
+	require.Nil(t, c.AddMessage(m))
+
+	m.Message = "deployed"
+	m.Title = "Deployment"
+	m.Priority = 4
+	m.Tags = []string{"tag1", "tag2"}
+	m.Actions = []*action{{ID: "1", Action: "view", Label: "Open", URL: "https://example.com"}}
+	m.ContentType = "text/markdown"
+	require.Nil(t, c.UpdateMessage(m))
+
+	updated, err := c.Message(m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "deployed", updated.Message)
+	require.Equal(t, "Deployment", updated.Title)
+	require.Equal(t, 4, updated.Priority)
+	require.Equal(t, []string{"tag1", "tag2"}, updated.Tags)
+	require.Equal(t, 1, len(updated.Actions))
+	require.Equal(t, "https://example.com", updated.Actions[0].URL)
+	require.Equal(t, "text/markdown", updated.ContentType)
+	require.Equal(t, m.Time, updated.Time)
+	require.Equal(t, "log.txt", updated.Attachment.Name) // Unchanged
+
+	unknown := newDefaultMessage("mytopic", "does not exist")
+	require.Equal(t, errMessageNotFound, c.UpdateMessage(unknown))
+
+	// Update events are stored along with the message, and deleted with it
+	update := newMessageUpdateMessage(m)
+	require.Nil(t, c.AddMessage(update))
+	event, err := c.Message(update.ID)
+	require.Nil(t, err)
+	require.Equal(t, messageUpdateEvent, event.Event)
+	require.Equal(t, m.ID, event.MessageID)
+	require.Equal(t, "deployed", event.Message)
+	require.Nil(t, event.Attachment)
+	require.Nil(t, c.DeleteMessages(m.ID))
+	require.Nil(t, c.AddMessage(newMessageDeleteMessage(m)))
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, messageDeleteEvent, messages[0].Event)
+	require.Equal(t, m.ID, messages[0].MessageID)
+}
+
+func TestSqliteCache_Search(t *testing.T) {
+	testCacheSearch(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Search(t *testing.T) {
+	testCacheSearch(t, newMemTestCache(t))
+}
+
+func TestPostgresCache_Search(t *testing.T) {
+	testCacheSearch(t, newPostgresTestCache(t))
+}
+
+func testCacheSearch(t *testing.T, c *messageCache) {
+	now := time.Now().Unix()
+	m1 := newDefaultMessage("alerts", "Disk full on /dev/sda1")
+	m1.Time = now - 3600
+	m1.Tags = []string{"warning"}
+	m2 := newDefaultMessage("alerts", "CPU load is high")
+	m2.Time = now - 1800
+	m2.Title = "Disk usage"
+	m3 := newDefaultMessage("backups", "Backup failed: disk full")
+	m3.Time = now - 600
+	m4 := newDefaultMessage("alerts", "Memory 100% used")
+	m4.Time = now - 60
+	m5 := newDefaultMessage("alerts", "Scheduled disk check") // Not published yet, never returned
+	m5.Time = now + 3600
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(m4))
+	require.Nil(t, c.AddMessage(m5))
+
+	search := func(topics []string, text string, since time.Time, limit int, cursor *searchCursor) []string {
+		messages, err := c.Search(&messageSearch{
+			Topics: topics,
+			Text:   text,
+			Since:  since,
+			Until:  time.Now(),
+			Cursor: cursor,
+			Limit:  limit,
+		})
+		require.Nil(t, err)
+		ids := make([]string, 0)
+		for _, m := range messages {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	// Text matches message, title (case-insensitive), newest first
+	require.Equal(t, []string{m2.ID, m1.ID}, search([]string{"alerts"}, "disk", time.Unix(0, 0), 10, nil))
+	require.Equal(t, []string{m3.ID, m2.ID, m1.ID}, search([]string{"alerts", "backups"}, "DISK", time.Unix(0, 0), 10, nil))
+	require.Equal(t, []string{m1.ID}, search([]string{"alerts", "backups"}, "full on", time.Unix(0, 0), 10, nil))
+	require.Equal(t, []string{m1.ID}, search([]string{"alerts"}, "warning", time.Unix(0, 0), 10, nil))
+	require.Equal(t, []string{m4.ID}, search([]string{"alerts"}, "100%", time.Unix(0, 0), 10, nil))
+	require.Equal(t, []string{}, search([]string{"alerts"}, "does-not-exist", time.Unix(0, 0), 10, nil))
+	require.Equal(t, []string{}, search([]string{"other"}, "disk", time.Unix(0, 0), 10, nil))
+
+	// Time range
+	require.Equal(t, []string{m3.ID, m2.ID}, search([]string{"alerts", "backups"}, "disk", time.Unix(now-2000, 0), 10, nil))
+
+	// No text, pagination
+	require.Equal(t, []string{m4.ID, m2.ID}, search([]string{"alerts"}, "", time.Unix(0, 0), 2, nil))
+	require.Equal(t, []string{m1.ID}, search([]string{"alerts"}, "", time.Unix(0, 0), 2, &searchCursor{Time: m2.Time, ID: m2.ID}))
+
+	// Updates and deletes are reflected in the index
+	m2.Message = "CPU load is normal again"
+	m2.Title = ""
+	require.Nil(t, c.UpdateMessage(m2))
+	require.Nil(t, c.DeleteMessages(m3.ID))
+	require.Equal(t, []string{m1.ID}, search([]string{"alerts", "backups"}, "disk", time.Unix(0, 0), 10, nil))
+	require.Equal(t, []string{m2.ID}, search([]string{"alerts"}, "normal", time.Unix(0, 0), 10, nil))
+}
+
+func TestSqliteCache_Search_RebuildIndex(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename, "")
+	m1 := newDefaultMessage("alerts", "disk full")
+	m1.Time = time.Now().Unix() - 10
+	require.Nil(t, c.AddMessage(m1))
+	_, err := c.db.Exec(dropMessagesFTSTriggersQuery) // Simulate running without FTS5
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", "disk still full")))
+	require.Nil(t, c.Close())
+
+	c = newSqliteTestCacheFromFile(t, filename, "")
+	messages, err := c.Search(&messageSearch{
+		Topics: []string{"alerts"},
+		Text:   "disk",
+		Since:  time.Unix(0, 0),
+		Until:  time.Now(),
+		Limit:  10,
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "disk still full", messages[0].Message)
+	require.Equal(t, "disk full", messages[1].Message)
+}
+
+func TestSqliteCache_Search_Encrypted(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename, "")
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", "disk full")))
+	require.Nil(t, c.Close())
+
+	// The full-text index would contain ciphertext (and the plaintext of older messages), so it is removed
+	c, err := newSqliteCache(filename, "", time.Hour, 0, 0, false, newTestKeyring(t))
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", "disk still full")))
+	var count int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name LIKE 'messages_fts%'`).Scan(&count))
+	require.Equal(t, 0, count)
+	require.Nil(t, c.Close())
+}
+
 func TestSqliteCache_MessagesScheduled(t *testing.T) {
 	testCacheMessagesScheduled(t, newSqliteTestCache(t))
 }
@@ -93,6 +278,10 @@ func TestMemCache_MessagesScheduled(t *testing.T) {
 	testCacheMessagesScheduled(t, newMemTestCache(t))
 }
 
+func TestPostgresCache_MessagesScheduled(t *testing.T) {
+	testCacheMessagesScheduled(t, newPostgresTestCache(t))
+}
+
 func testCacheMessagesScheduled(t *testing.T, c *messageCache) {
 	m1 := newDefaultMessage("mytopic", "message 1")
 	m2 := newDefaultMessage("mytopic", "message 2")
@@ -119,6 +308,117 @@ func testCacheMessagesScheduled(t *testing.T, c *messageCache) {
 	require.Empty(t, messages)
 }
 
+func TestSqliteCache_Escalations(t *testing.T) {
+	testCacheEscalations(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Escalations(t *testing.T) {
+	testCacheEscalations(t, newMemTestCache(t))
+}
+
+func TestPostgresCache_Escalations(t *testing.T) {
+	testCacheEscalations(t, newPostgresTestCache(t))
+}
+
+func testCacheEscalations(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddEscalation(&escalation{MessageID: m1.ID, PolicyID: "es_1", Token: "token1", Step: 0, Next: time.Now().Add(-time.Minute).Unix()}))
+	require.Nil(t, c.AddEscalation(&escalation{MessageID: m2.ID, PolicyID: "es_2", Token: "token2", Step: 0, Next: time.Now().Add(time.Hour).Unix()}))
+
+	escalations, err := c.EscalationsDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(escalations))
+	require.Equal(t, m1.ID, escalations[0].MessageID)
+	require.Equal(t, "es_1", escalations[0].PolicyID)
+	require.Equal(t, "token1", escalations[0].Token)
+
+	// Advance to next step
+	escalations[0].Step = 1
+	escalations[0].Next = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.UpdateEscalation(escalations[0]))
+	escalations, err = c.EscalationsDue()
+	require.Nil(t, err)
+	require.Empty(t, escalations)
+	e, err := c.Escalation(m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, e.Step)
+
+	// Remove (acknowledge) and delete message
+	require.Nil(t, c.RemoveEscalation(m1.ID))
+	_, err = c.Escalation(m1.ID)
+	require.Equal(t, errEscalationNotFound, err)
+	require.Nil(t, c.DeleteMessages(m2.ID))
+	_, err = c.Escalation(m2.ID)
+	require.Equal(t, errEscalationNotFound, err)
+}
+
+func TestSqliteCache_Uploads(t *testing.T) {
+	testCacheUploads(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Uploads(t *testing.T) {
+	testCacheUploads(t, newMemTestCache(t))
+}
+
+func TestPostgresCache_Uploads(t *testing.T) {
+	testCacheUploads(t, newPostgresTestCache(t))
+}
+
+func testCacheUploads(t *testing.T, c *messageCache) {
+	sender := netip.MustParseAddr("1.2.3.4")
+	u1 := &upload{ID: "upload1", Secret: "secret1", Sender: sender, Size: 1000, Encrypted: true, Expires: time.Now().Add(time.Hour).Unix()}
+	u2 := &upload{ID: "upload2", Sender: sender, User: "u_phil", Size: 500, Expires: time.Now().Add(-time.Minute).Unix()}
+	require.Nil(t, c.AddUpload(u1))
+	require.Nil(t, c.AddUpload(u2))
+
+	// Append chunks
+	u1.Received, u1.Chunks = 300, []string{"upload1_aaaaaaaa"}
+	require.Nil(t, c.UpdateUpload(u1, 0))
+	u1.Received, u1.Chunks = 400, []string{"upload1_aaaaaaaa", "upload1_bbbbbbbb"}
+	require.Equal(t, errUploadConflict, c.UpdateUpload(u1, 0)) // Concurrent append
+	require.Nil(t, c.UpdateUpload(u1, 300))
+	u, err := c.Upload("upload1")
+	require.Nil(t, err)
+	require.Equal(t, "secret1", u.Secret)
+	require.Equal(t, sender, u.Sender)
+	require.Equal(t, "", u.User)
+	require.Equal(t, int64(1000), u.Size)
+	require.Equal(t, int64(400), u.Received)
+	require.Equal(t, []string{"upload1_aaaaaaaa", "upload1_bbbbbbbb"}, u.Chunks)
+	require.True(t, u.Encrypted)
+
+	// Uploads count towards the visitor's attachment size with their reserved size (until they are removed),
+	// and towards the attachment store size with the bytes received
+	size, err := c.AttachmentBytesUsedBySender("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(1000), size)
+	size, err = c.AttachmentBytesUsedByUser("u_phil")
+	require.Nil(t, err)
+	require.Equal(t, int64(500), size)
+	size, err = c.AttachmentsSize()
+	require.Nil(t, err)
+	require.Equal(t, int64(400), size)
+
+	// Expired uploads
+	_, err = c.Upload("upload2")
+	require.Equal(t, errUploadNotFound, err)
+	uploads, err := c.UploadsExpired()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(uploads))
+	require.Equal(t, "upload2", uploads[0].ID)
+	require.Equal(t, "u_phil", uploads[0].User)
+	require.Nil(t, uploads[0].Chunks)
+	require.False(t, uploads[0].Encrypted)
+
+	// Remove
+	require.Nil(t, c.RemoveUpload("upload1"))
+	_, err = c.Upload("upload1")
+	require.Equal(t, errUploadNotFound, err)
+}
+
 func TestSqliteCache_Topics(t *testing.T) {
 	testCacheTopics(t, newSqliteTestCache(t))
 }
@@ -127,6 +427,10 @@ func TestMemCache_Topics(t *testing.T) {
 	testCacheTopics(t, newMemTestCache(t))
 }
 
+func TestPostgresCache_Topics(t *testing.T) {
+	testCacheTopics(t, newPostgresTestCache(t))
+}
+
 func testCacheTopics(t *testing.T, c *messageCache) {
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic1", "my example message")))
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 1")))
@@ -150,6 +454,10 @@ func TestMemCache_MessagesTagsPrioAndTitle(t *testing.T) {
 	testCacheMessagesTagsPrioAndTitle(t, newMemTestCache(t))
 }
 
+func TestPostgresCache_MessagesTagsPrioAndTitle(t *testing.T) {
+	testCacheMessagesTagsPrioAndTitle(t, newPostgresTestCache(t))
+}
+
 func testCacheMessagesTagsPrioAndTitle(t *testing.T, c *messageCache) {
 	m := newDefaultMessage("mytopic", "some message")
 	m.Tags = []string{"tag1", "tag2"}
@@ -171,6 +479,10 @@ func TestMemCache_MessagesSinceID(t *testing.T) {
 	testCacheMessagesSinceID(t, newMemTestCache(t))
 }
 
+func TestPostgresCache_MessagesSinceID(t *testing.T) {
+	testCacheMessagesSinceID(t, newPostgresTestCache(t))
+}
+
 func testCacheMessagesSinceID(t *testing.T, c *messageCache) {
 	m1 := newDefaultMessage("mytopic", "message 1")
 	m1.Time = 100
@@ -241,6 +553,10 @@ func TestMemCache_Prune(t *testing.T) {
 	testCachePrune(t, newMemTestCache(t))
 }
 
+func TestPostgresCache_Prune(t *testing.T) {
+	testCachePrune(t, newPostgresTestCache(t))
+}
+
 func testCachePrune(t *testing.T, c *messageCache) {
 	now := time.Now().Unix()
 
@@ -288,6 +604,10 @@ func TestMemCache_Attachments(t *testing.T) {
 	testCacheAttachments(t, newMemTestCache(t))
 }
 
+func TestPostgresCache_Attachments(t *testing.T) {
+	testCacheAttachments(t, newPostgresTestCache(t))
+}
+
 func testCacheAttachments(t *testing.T, c *messageCache) {
 	expires1 := time.Now().Add(-4 * time.Hour).Unix() // Expired
 	m := newDefaultMessage("mytopic", "flower for you")
@@ -307,11 +627,12 @@ func testCacheAttachments(t *testing.T, c *messageCache) {
 	m.ID = "m2"
 	m.Sender = netip.MustParseAddr("1.2.3.4")
 	m.Attachment = &attachment{
-		Name:    "car.jpg",
-		Type:    "image/jpeg",
-		Size:    10000,
-		Expires: expires2,
-		URL:     "https://ntfy.sh/file/aCaRURL.jpg",
+		Name:      "car.jpg",
+		Type:      "image/jpeg",
+		Size:      10000,
+		Expires:   expires2,
+		URL:       "https://ntfy.sh/file/aCaRURL.jpg",
+		Encrypted: true,
 	}
 	require.Nil(t, c.AddMessage(m))
 
@@ -339,6 +660,7 @@ func testCacheAttachments(t *testing.T, c *messageCache) {
 	require.Equal(t, int64(5000), messages[0].Attachment.Size)
 	require.Equal(t, expires1, messages[0].Attachment.Expires)
 	require.Equal(t, "https://ntfy.sh/file/AbDeFgJhal.jpg", messages[0].Attachment.URL)
+	require.False(t, messages[0].Attachment.Encrypted)
 	require.Equal(t, "1.2.3.4", messages[0].Sender.String())
 
 	require.Equal(t, "sending you a car", messages[1].Message)
@@ -347,8 +669,17 @@ func testCacheAttachments(t *testing.T, c *messageCache) {
 	require.Equal(t, int64(10000), messages[1].Attachment.Size)
 	require.Equal(t, expires2, messages[1].Attachment.Expires)
 	require.Equal(t, "https://ntfy.sh/file/aCaRURL.jpg", messages[1].Attachment.URL)
+	require.True(t, messages[1].Attachment.Encrypted)
 	require.Equal(t, "1.2.3.4", messages[1].Sender.String())
 
+	encrypted, err := c.AttachmentsEncrypted()
+	require.Nil(t, err)
+	require.Equal(t, map[string]bool{"m1": false, "m2": true, "m3": false}, encrypted)
+	require.Nil(t, c.MarkAttachmentEncrypted("m3"))
+	encrypted, err = c.AttachmentsEncrypted()
+	require.Nil(t, err)
+	require.True(t, encrypted["m3"])
+
 	size, err := c.AttachmentBytesUsedBySender("1.2.3.4")
 	require.Nil(t, err)
 	require.Equal(t, int64(10000), size)
@@ -370,6 +701,10 @@ func TestMemCache_Attachments_Expired(t *testing.T) {
 	testCacheAttachmentsExpired(t, newMemTestCache(t))
 }
 
+func TestPostgresCache_Attachments_Expired(t *testing.T) {
+	testCacheAttachmentsExpired(t, newPostgresTestCache(t))
+}
+
 func testCacheAttachmentsExpired(t *testing.T, c *messageCache) {
 	m := newDefaultMessage("mytopic", "flower for you")
 	m.ID = "m1"
@@ -594,7 +929,7 @@ func TestSqliteCache_Migration_From9(t *testing.T) {
 
 	// Create cache to trigger migration
 	cacheDuration := 17 * time.Hour
-	c, err := newSqliteCache(filename, "", cacheDuration, 0, 0, false)
+	c, err := newSqliteCache(filename, "", cacheDuration, 0, 0, false, nil)
 	require.Nil(t, err)
 	checkSchemaVersion(t, c.db)
 
@@ -620,7 +955,7 @@ func TestSqliteCache_StartupQueries_WAL(t *testing.T) {
 	startupQueries := `pragma journal_mode = WAL; 
 pragma synchronous = normal; 
 pragma temp_store = memory;`
-	db, err := newSqliteCache(filename, startupQueries, time.Hour, 0, 0, false)
+	db, err := newSqliteCache(filename, startupQueries, time.Hour, 0, 0, false, nil)
 	require.Nil(t, err)
 	require.Nil(t, db.AddMessage(newDefaultMessage("mytopic", "some message")))
 	require.FileExists(t, filename)
@@ -631,7 +966,7 @@ pragma temp_store = memory;`
 func TestSqliteCache_StartupQueries_None(t *testing.T) {
 	filename := newSqliteTestCacheFile(t)
 	startupQueries := ""
-	db, err := newSqliteCache(filename, startupQueries, time.Hour, 0, 0, false)
+	db, err := newSqliteCache(filename, startupQueries, time.Hour, 0, 0, false, nil)
 	require.Nil(t, err)
 	require.Nil(t, db.AddMessage(newDefaultMessage("mytopic", "some message")))
 	require.FileExists(t, filename)
@@ -642,7 +977,7 @@ func TestSqliteCache_StartupQueries_None(t *testing.T) {
 func TestSqliteCache_StartupQueries_Fail(t *testing.T) {
 	filename := newSqliteTestCacheFile(t)
 	startupQueries := `xx error`
-	_, err := newSqliteCache(filename, startupQueries, time.Hour, 0, 0, false)
+	_, err := newSqliteCache(filename, startupQueries, time.Hour, 0, 0, false, nil)
 	require.Error(t, err)
 }
 
@@ -654,6 +989,10 @@ func TestMemCache_Sender(t *testing.T) {
 	testSender(t, newMemTestCache(t))
 }
 
+func TestPostgresCache_Sender(t *testing.T) {
+	testSender(t, newPostgresTestCache(t))
+}
+
 func testSender(t *testing.T, c *messageCache) {
 	m1 := newDefaultMessage("mytopic", "mymessage")
 	m1.Sender = netip.MustParseAddr("1.2.3.4")
@@ -669,6 +1008,84 @@ func testSender(t *testing.T, c *messageCache) {
 	require.Equal(t, messages[1].Sender, netip.Addr{})
 }
 
+func TestSqliteCache_Origin(t *testing.T) {
+	testOrigin(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Origin(t *testing.T) {
+	testOrigin(t, newMemTestCache(t))
+}
+
+func TestPostgresCache_Origin(t *testing.T) {
+	testOrigin(t, newPostgresTestCache(t))
+}
+
+func testOrigin(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "relayed message")
+	m1.Origin = []string{"https://ntfy1.example.com", "https://ntfy2.example.com"}
+	require.Nil(t, c.AddMessage(m1))
+
+	m2 := newDefaultMessage("mytopic", "local message")
+	require.Nil(t, c.AddMessage(m2))
+
+	m, err := c.Message(m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, []string{"https://ntfy1.example.com", "https://ntfy2.example.com"}, m.Origin)
+	m, err = c.Message(m2.ID)
+	require.Nil(t, err)
+	require.Nil(t, m.Origin)
+}
+
+func TestSqliteCache_Encrypted(t *testing.T) {
+	testCacheEncrypted(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Encrypted(t *testing.T) {
+	testCacheEncrypted(t, newMemTestCache(t))
+}
+
+func TestPostgresCache_Encrypted(t *testing.T) {
+	testCacheEncrypted(t, newPostgresTestCache(t))
+}
+
+func testCacheEncrypted(t *testing.T, c *messageCache) {
+	// Plaintext that looks like ciphertext is never decrypted
+	m1 := newDefaultMessage("mytopic", "ntfyenc1:deadbeef:AAAA")
+	require.Nil(t, c.AddMessage(m1))
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "ntfyenc1:deadbeef:AAAA", messages[0].Message)
+
+	// After encryption was enabled, old messages are still readable
+	c.keyring = newTestKeyring(t)
+	ms := make([]*message, 0)
+	for i := 0; i < reencryptMessagesBatchSize; i++ {
+		ms = append(ms, newDefaultMessage("mytopic", fmt.Sprintf("secret %d", i)))
+	}
+	require.Nil(t, c.addMessages(ms))
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, reencryptMessagesBatchSize+1, len(messages))
+	require.Equal(t, "ntfyenc1:deadbeef:AAAA", messages[0].Message)
+
+	// Re-encryption processes messages in batches, and encrypts the old messages
+	count, err := c.Reencrypt()
+	require.Nil(t, err)
+	require.Equal(t, reencryptMessagesBatchSize+1, count)
+	m, err := c.Message(m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "ntfyenc1:deadbeef:AAAA", m.Message)
+	var stored string
+	require.Nil(t, c.db.QueryRow(`SELECT message FROM messages WHERE mid = '`+m1.ID+`'`).Scan(&stored))
+	require.NotEqual(t, "ntfyenc1:deadbeef:AAAA", stored)
+
+	// Encrypted messages cannot be read without the key
+	c.keyring = nil
+	_, err = c.Message(m1.ID)
+	require.ErrorIs(t, err, errEncryptionKeyUnknown)
+}
+
 func checkSchemaVersion(t *testing.T, db *sql.DB) {
 	rows, err := db.Query(`SELECT version FROM schemaVersion`)
 	require.Nil(t, err)
@@ -680,6 +1097,26 @@ func checkSchemaVersion(t *testing.T, db *sql.DB) {
 	require.Nil(t, rows.Close())
 }
 
+func TestPostgresCache_SchemaVersion(t *testing.T) {
+	dsn := newPostgresTestDSN(t)
+	c, err := newPostgresCache(dsn, "", time.Hour, 0, 0, false, nil)
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+	require.Nil(t, c.Close())
+
+	// Re-opening must not re-create the schema or lose messages
+	c, err = newPostgresCache(dsn, "", time.Hour, 0, 0, false, nil)
+	require.Nil(t, err)
+	defer c.Close()
+	var schemaVersion int
+	require.Nil(t, c.db.QueryRow(postgresSelectSchemaVersionQuery, postgresSchemaVersionStore).Scan(&schemaVersion))
+	require.Equal(t, currentSchemaVersion, schemaVersion)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "my message", messages[0].Message)
+}
+
 func TestMemCache_NopCache(t *testing.T) {
 	c, _ := newNopCache()
 	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
@@ -694,7 +1131,7 @@ func TestMemCache_NopCache(t *testing.T) {
 }
 
 func newSqliteTestCache(t *testing.T) *messageCache {
-	c, err := newSqliteCache(newSqliteTestCacheFile(t), "", time.Hour, 0, 0, false)
+	c, err := newSqliteCache(newSqliteTestCacheFile(t), "", time.Hour, 0, 0, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -706,7 +1143,7 @@ func newSqliteTestCacheFile(t *testing.T) string {
 }
 
 func newSqliteTestCacheFromFile(t *testing.T, filename, startupQueries string) *messageCache {
-	c, err := newSqliteCache(filename, startupQueries, time.Hour, 0, 0, false)
+	c, err := newSqliteCache(filename, startupQueries, time.Hour, 0, 0, false, nil)
 	require.Nil(t, err)
 	return c
 }
@@ -716,3 +1153,35 @@ func newMemTestCache(t *testing.T) *messageCache {
 	require.Nil(t, err)
 	return c
 }
+
+func newPostgresTestCache(t *testing.T) *messageCache {
+	c, err := newPostgresCache(newPostgresTestDSN(t), "", time.Hour, 0, 0, false, nil)
+	require.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// newPostgresTestDSN returns a connection URL pointing to a new, empty schema in the PostgreSQL database
+// defined by NTFY_TEST_DATABASE_URL. The schema is dropped after the test. If the environment variable
+// is not set, the test is skipped; use "make test-postgres" to run the tests against a PostgreSQL container.
+func newPostgresTestDSN(t *testing.T) string {
+	dsn := os.Getenv("NTFY_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("NTFY_TEST_DATABASE_URL not set, skipping PostgreSQL test")
+	}
+	schema := util.RandomLowerStringPrefix("ntfy_test_", 10)
+	db, err := sql.Open("pgx", dsn)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		db.Exec(fmt.Sprintf("DROP SCHEMA %s CASCADE", schema))
+		db.Close()
+	})
+	_, err = db.Exec(fmt.Sprintf("CREATE SCHEMA %s", schema))
+	require.Nil(t, err)
+	u, err := url.Parse(dsn)
+	require.Nil(t, err)
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	oidcRequestTimeout      = 10 * time.Second
+	oidcResponseBytesLimit  = 1024 * 1024
+	oidcKeysCacheDuration   = time.Hour
+	oidcKeysRefreshInterval = time.Minute     // Min. time between refreshes of the signing keys if a token has an unknown key ID
+	oidcClockSkew           = 2 * time.Minute // Leeway when checking token expiry
+	oidcDiscoveryPath       = "/.well-known/openid-configuration"
+)
+
+var (
+	errOIDCTokenInvalid   = errors.New("invalid token")
+	errOIDCTokenExpired   = errors.New("token expired")
+	errOIDCKeyNotFound    = errors.New("signing key not found")
+	errOIDCAlgUnsupported = errors.New("signing algorithm not supported")
+)
+
+// oidcSigningAlgorithms are the accepted JWS algorithms. Only asymmetric algorithms are supported, in
+// particular "none" and the HMAC algorithms are rejected.
+var oidcSigningAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// oidcProvider talks to an OpenID Connect identity provider: it exchanges authorization codes for ID tokens
+// (see handleOIDCCallback), and verifies the signature and claims of ID tokens and JWT access tokens. The
+// provider metadata and signing keys (JWKS) are fetched lazily and cached.
+type oidcProvider struct {
+	issuer        string
+	clientID      string
+	clientSecret  string
+	audience      string // Expected audience of access tokens
+	usernameClaim string
+	groupsClaim   string
+	client        *http.Client
+	discovery     *util.LookupCache[*oidcDiscovery]
+	jwks          *keyfunc.JWKS // Signing keys, refreshed in the background, see keys
+	mu            sync.Mutex
+}
+
+// oidcDiscovery is the subset of the provider metadata that is used, see OpenID Connect Discovery 1.0
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IDToken     string `json:"id_token"`
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// oidcClaims are the verified claims of an ID token or access token
+type oidcClaims struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Groups   []string
+	Nonce    string
+}
+
+// ProviderID returns the stable ID of the user at the provider. Unlike the username, the issuer and subject
+// uniquely identify the user and can never be reassigned, see user.Manager.AddProviderUser.
+func (c *oidcClaims) ProviderID() string {
+	return c.Issuer + "|" + c.Subject
+}
+
+func newOIDCProvider(conf *Config) *oidcProvider {
+	p := &oidcProvider{
+		issuer:        strings.TrimSuffix(conf.OIDCIssuer, "/"),
+		clientID:      conf.OIDCClientID,
+		clientSecret:  conf.OIDCClientSecret,
+		audience:      conf.OIDCAudience,
+		usernameClaim: conf.OIDCUsernameClaim,
+		groupsClaim:   conf.OIDCGroupsClaim,
+		client:        &http.Client{Timeout: oidcRequestTimeout},
+	}
+	if p.audience == "" {
+		p.audience = p.clientID
+	}
+	p.discovery = util.NewLookupCache(p.fetchDiscovery, oidcKeysCacheDuration)
+	return p
+}
+
+// AuthorizationURL returns the URL the user is redirected to for login, using the authorization code flow with PKCE
+func (p *oidcProvider) AuthorizationURL(redirectURL string, scopes []string, state, nonce, codeVerifier string) (string, error) {
+	discovery, err := p.discovery.Value()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientID)
+	query.Set("redirect_uri", redirectURL)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Exchange exchanges the authorization code for tokens, and returns the verified claims of the ID token. The
+// nonce must match the nonce passed to AuthorizationURL.
+func (p *oidcProvider) Exchange(code, redirectURL, codeVerifier, nonce string) (*oidcClaims, error) {
+	discovery, err := p.discovery.Value()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", p.clientID)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	var token oidcTokenResponse
+	if err := p.do(req, &token); err != nil {
+		return nil, err
+	} else if token.IDToken == "" {
+		return nil, errors.New("token response does not contain an ID token")
+	}
+	claims, err := p.Verify(token.IDToken, p.clientID)
+	if err != nil {
+		return nil, err
+	} else if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", errOIDCTokenInvalid)
+	}
+	return claims, nil
+}
+
+// Verify verifies the signature of a JWT (ID token or access token) against the provider's signing keys, and
+// checks its issuer, audience and expiry. It returns the claims of the token.
+func (p *oidcProvider) Verify(token, audience string) (*oidcClaims, error) {
+	jwks, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation()) // Claims are checked in checkClaims, with leeway
+	_, err = parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		if !util.Contains(oidcSigningAlgorithms, t.Method.Alg()) {
+			return nil, errOIDCAlgUnsupported
+		}
+		return jwks.Keyfunc(t)
+	})
+	if errors.Is(err, errOIDCAlgUnsupported) || errors.Is(err, keyfunc.ErrJWKAlgMismatch) || errors.Is(err, jwt.ErrInvalidKeyType) {
+		return nil, errOIDCAlgUnsupported
+	} else if errors.Is(err, keyfunc.ErrKIDNotFound) || errors.Is(err, keyfunc.ErrKID) {
+		return nil, errOIDCKeyNotFound
+	} else if err != nil {
+		return nil, errOIDCTokenInvalid
+	}
+	return p.checkClaims(claims, audience)
+}
+
+func (p *oidcProvider) checkClaims(claims jwt.MapClaims, audience string) (*oidcClaims, error) {
+	now := time.Now()
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %s", errOIDCTokenInvalid, iss)
+	} else if !claims.VerifyAudience(audience, true) {
+		return nil, fmt.Errorf("%w: audience does not contain %s", errOIDCTokenInvalid, audience)
+	} else if !claims.VerifyExpiresAt(now.Add(-oidcClockSkew).Unix(), true) {
+		return nil, errOIDCTokenExpired
+	} else if !claims.VerifyNotBefore(now.Add(oidcClockSkew).Unix(), false) {
+		return nil, fmt.Errorf("%w: token not yet valid", errOIDCTokenInvalid)
+	}
+	subject, _ := claims["sub"].(string)
+	username, _ := claims[p.usernameClaim].(string)
+	nonce, _ := claims["nonce"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: claim sub is missing", errOIDCTokenInvalid)
+	} else if username == "" {
+		return nil, fmt.Errorf("%w: claim %s is missing", errOIDCTokenInvalid, p.usernameClaim)
+	}
+	return &oidcClaims{
+		Issuer:   p.issuer,
+		Subject:  subject,
+		Username: username,
+		Groups:   oidcStrings(claims[p.groupsClaim]),
+		Nonce:    nonce,
+	}, nil
+}
+
+// keys returns the provider's signing keys. The keys are fetched on first use, and then refreshed in the
+// background: periodically, and if a token has an unknown key ID (at most once per oidcKeysRefreshInterval),
+// since the provider may have rotated its keys.
+func (p *oidcProvider) keys() (*keyfunc.JWKS, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.jwks != nil {
+		return p.jwks, nil
+	}
+	discovery, err := p.discovery.Value()
+	if err != nil {
+		return nil, err
+	}
+	jwks, err := keyfunc.Get(discovery.JWKSURI, keyfunc.Options{
+		Client:            p.client,
+		RefreshInterval:   oidcKeysCacheDuration,
+		RefreshRateLimit:  oidcKeysRefreshInterval,
+		RefreshTimeout:    oidcRequestTimeout,
+		RefreshUnknownKID: true,
+		RefreshErrorHandler: func(err error) {
+			log.Tag(tagOIDC).Err(err).Warn("Cannot refresh OpenID Connect signing keys")
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("oidc: cannot fetch signing keys: %w", err)
+	}
+	p.jwks = jwks
+	return jwks, nil
+}
+
+// Close stops the background refresh of the signing keys
+func (p *oidcProvider) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.jwks != nil {
+		p.jwks.EndBackground()
+	}
+}
+
+func (p *oidcProvider) fetchDiscovery() (*oidcDiscovery, error) {
+	req, err := http.NewRequest(http.MethodGet, p.issuer+oidcDiscoveryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	var discovery oidcDiscovery
+	if err := p.do(req, &discovery); err != nil {
+		return nil, err
+	} else if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("oidc: issuer %s in provider metadata does not match %s", discovery.Issuer, p.issuer)
+	} else if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("oidc: provider metadata is missing authorization_endpoint, token_endpoint or jwks_uri")
+	}
+	return &discovery, nil
+}
+
+func (p *oidcProvider) do(req *http.Request, v any) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, oidcResponseBytesLimit))
+	if err != nil {
+		return err
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: unexpected response %s for %s %s: %s", resp.Status, req.Method, req.URL.String(), strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// oidcStrings converts a claim that is either a string or an array of strings (e.g. "aud" or "groups") to a slice
+func oidcStrings(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// isJWT returns true if the token looks like a JWT in compact serialization, as opposed to a ntfy access token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && !strings.HasPrefix(token, "tk_")
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestOIDCProvider_Verify(t *testing.T) {
+	idp := newTestOIDCServer(t)
+	p := newOIDCProvider(idp.config(NewConfig()))
+
+	claims, err := p.Verify(idp.token(t, idp.claims("phil", "admins", "pro")), testOIDCClientID)
+	require.Nil(t, err)
+	require.Equal(t, "phil", claims.Username)
+	require.Equal(t, "sub-phil", claims.Subject)
+	require.Equal(t, []string{"admins", "pro"}, claims.Groups)
+
+	// Audience may be an array, groups may be a string
+	c := idp.claims("phil")
+	c["aud"] = []any{"other", testOIDCClientID}
+	c["groups"] = "admins"
+	claims, err = p.Verify(idp.token(t, c), testOIDCClientID)
+	require.Nil(t, err)
+	require.Equal(t, []string{"admins"}, claims.Groups)
+
+	// EC keys
+	claims, err = p.Verify(idp.tokenWithKey(t, "ES256", idp.ecKey, "ec-key", idp.claims("ben")), testOIDCClientID)
+	require.Nil(t, err)
+	require.Equal(t, "ben", claims.Username)
+}
+
+func TestOIDCProvider_Verify_Invalid(t *testing.T) {
+	idp := newTestOIDCServer(t)
+	p := newOIDCProvider(idp.config(NewConfig()))
+
+	expired := idp.claims("phil")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err := p.Verify(idp.token(t, expired), testOIDCClientID)
+	require.Equal(t, errOIDCTokenExpired, err)
+
+	notYetValid := idp.claims("phil")
+	notYetValid["nbf"] = time.Now().Add(time.Hour).Unix()
+	_, err = p.Verify(idp.token(t, notYetValid), testOIDCClientID)
+	require.ErrorIs(t, err, errOIDCTokenInvalid)
+
+	wrongIssuer := idp.claims("phil")
+	wrongIssuer["iss"] = "https://evil.example.com"
+	_, err = p.Verify(idp.token(t, wrongIssuer), testOIDCClientID)
+	require.ErrorIs(t, err, errOIDCTokenInvalid)
+
+	_, err = p.Verify(idp.token(t, idp.claims("phil")), "another-client")
+	require.ErrorIs(t, err, errOIDCTokenInvalid)
+
+	noUsername := idp.claims("phil")
+	delete(noUsername, "preferred_username")
+	_, err = p.Verify(idp.token(t, noUsername), testOIDCClientID)
+	require.ErrorIs(t, err, errOIDCTokenInvalid)
+
+	// Signature must match, and must not be stripped via alg "none" or "HS256"
+	token := idp.token(t, idp.claims("phil"))
+	parts := strings.Split(token, ".")
+	forged := idp.claims("phil")
+	forged["groups"] = []string{"admins"}
+	b, _ := json.Marshal(forged)
+	_, err = p.Verify(parts[0]+"."+base64.RawURLEncoding.EncodeToString(b)+"."+parts[2], testOIDCClientID)
+	require.Equal(t, errOIDCTokenInvalid, err)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa-key"}`))
+	_, err = p.Verify(none+"."+parts[1]+".", testOIDCClientID)
+	require.Equal(t, errOIDCAlgUnsupported, err)
+	hs := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"rsa-key"}`))
+	_, err = p.Verify(hs+"."+parts[1]+"."+parts[2], testOIDCClientID)
+	require.Equal(t, errOIDCAlgUnsupported, err)
+
+	// Key type must match the algorithm
+	_, err = p.Verify(idp.tokenWithKey(t, "RS256", idp.rsaKey, "ec-key", idp.claims("phil")), testOIDCClientID)
+	require.Equal(t, errOIDCAlgUnsupported, err)
+
+	_, err = p.Verify("not-a-jwt", testOIDCClientID)
+	require.Equal(t, errOIDCTokenInvalid, err)
+}
+
+func TestOIDCProvider_Verify_KeyRotation(t *testing.T) {
+	idp := newTestOIDCServer(t)
+	p := newOIDCProvider(idp.config(NewConfig()))
+
+	_, err := p.Verify(idp.token(t, idp.claims("phil")), testOIDCClientID)
+	require.Nil(t, err)
+	require.Equal(t, 1, idp.jwksRequests())
+
+	// Keys are refreshed if a token is signed with an unknown key
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	idp.addRSAKey("new-key", newKey)
+	_, err = p.Verify(idp.tokenWithKey(t, "RS256", newKey, "new-key", idp.claims("phil")), testOIDCClientID)
+	require.Nil(t, err)
+	require.Equal(t, 2, idp.jwksRequests())
+
+	// ... but not more than once per refresh interval
+	_, err = p.Verify(idp.tokenWithKey(t, "RS256", newKey, "unknown-key", idp.claims("phil")), testOIDCClientID)
+	require.Equal(t, errOIDCKeyNotFound, err)
+	require.Equal(t, 2, idp.jwksRequests())
+}
+
+func TestOIDCProvider_Discovery_IssuerMismatch(t *testing.T) {
+	idp := newTestOIDCServer(t)
+	idp.issuerOverride = "https://evil.example.com"
+	p := newOIDCProvider(idp.config(NewConfig()))
+
+	_, err := p.AuthorizationURL("http://127.0.0.1:12345/v1/auth/oidc/callback", DefaultOIDCScopes, "state", "nonce", "verifier")
+	require.ErrorContains(t, err, "does not match")
+}
+
+const testOIDCClientID = "ntfy-client"
+
+// testOIDCServer is a fake OpenID Connect provider that issues tokens for any user, see authorize
+type testOIDCServer struct {
+	*httptest.Server
+	t              *testing.T
+	rsaKey         *rsa.PrivateKey
+	ecKey          *ecdsa.PrivateKey
+	keys           map[string]crypto.PublicKey
+	codes          map[string]*testOIDCCode
+	issuerOverride string // Issuer returned in the provider metadata, if set
+	jwksCount      int
+	mu             sync.Mutex
+}
+
+type oidcJWKS struct {
+	Keys []*oidcJWK `json:"keys"`
+}
+
+type oidcJWK struct {
+	KeyID   string `json:"kid"`
+	KeyType string `json:"kty"`
+	Use     string `json:"use,omitempty"`
+	N       string `json:"n,omitempty"`   // RSA modulus
+	E       string `json:"e,omitempty"`   // RSA exponent
+	Curve   string `json:"crv,omitempty"` // EC curve
+	X       string `json:"x,omitempty"`
+	Y       string `json:"y,omitempty"`
+}
+
+type testOIDCCode struct {
+	claims        map[string]any
+	redirectURI   string
+	codeChallenge string
+}
+
+func newTestOIDCServer(t *testing.T) *testOIDCServer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	idp := &testOIDCServer{
+		t:      t,
+		rsaKey: rsaKey,
+		ecKey:  ecKey,
+		keys: map[string]crypto.PublicKey{
+			"rsa-key": &rsaKey.PublicKey,
+			"ec-key":  &ecKey.PublicKey,
+		},
+		codes: make(map[string]*testOIDCCode),
+	}
+	idp.Server = httptest.NewServer(http.HandlerFunc(idp.handle))
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testOIDCServer) config(conf *Config) *Config {
+	conf.OIDCIssuer = idp.URL
+	conf.OIDCClientID = testOIDCClientID
+	conf.OIDCClientSecret = "secret"
+	return conf
+}
+
+func (idp *testOIDCServer) claims(username string, groups ...string) map[string]any {
+	return map[string]any{
+		"iss":                idp.URL,
+		"sub":                "sub-" + username,
+		"aud":                testOIDCClientID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"preferred_username": username,
+		"groups":             groups,
+	}
+}
+
+func (idp *testOIDCServer) token(t *testing.T, claims map[string]any) string {
+	return idp.tokenWithKey(t, "RS256", idp.rsaKey, "rsa-key", claims)
+}
+
+func (idp *testOIDCServer) tokenWithKey(t *testing.T, alg string, key crypto.Signer, keyID string, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": keyID, "typ": "JWT"})
+	require.Nil(t, err)
+	payload, err := json.Marshal(claims)
+	require.Nil(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.Nil(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		require.Nil(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authorize simulates a successful login of the user with the given claims at the authorization URL,
+// and returns the URL the provider redirects back to
+func (idp *testOIDCServer) authorize(authorizationURL string, claims map[string]any) string {
+	u, err := url.Parse(authorizationURL)
+	require.Nil(idp.t, err)
+	query := u.Query()
+	require.Equal(idp.t, idp.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	require.Equal(idp.t, "code", query.Get("response_type"))
+	require.Equal(idp.t, testOIDCClientID, query.Get("client_id"))
+	require.Equal(idp.t, "S256", query.Get("code_challenge_method"))
+	claims["nonce"] = query.Get("nonce")
+	code := util.RandomString(16)
+	idp.mu.Lock()
+	idp.codes[code] = &testOIDCCode{
+		claims:        claims,
+		redirectURI:   query.Get("redirect_uri"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	idp.mu.Unlock()
+	callback := url.Values{}
+	callback.Set("code", code)
+	callback.Set("state", query.Get("state"))
+	return query.Get("redirect_uri") + "?" + callback.Encode()
+}
+
+func (idp *testOIDCServer) addRSAKey(keyID string, key *rsa.PrivateKey) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys[keyID] = &key.PublicKey
+}
+
+func (idp *testOIDCServer) jwksRequests() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.jwksCount
+}
+
+func (idp *testOIDCServer) handle(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		issuer := idp.URL
+		if idp.issuerOverride != "" {
+			issuer = idp.issuerOverride
+		}
+		json.NewEncoder(w).Encode(&oidcDiscovery{
+			Issuer:                issuer,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/jwks",
+		})
+	case "/jwks":
+		idp.jwksCount++
+		jwks := &oidcJWKS{Keys: make([]*oidcJWK, 0)}
+		for keyID, key := range idp.keys {
+			switch k := key.(type) {
+			case *rsa.PublicKey:
+				jwks.Keys = append(jwks.Keys, &oidcJWK{
+					KeyID:   keyID,
+					KeyType: "RSA",
+					Use:     "sig",
+					N:       base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+					E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+				})
+			case *ecdsa.PublicKey:
+				jwks.Keys = append(jwks.Keys, &oidcJWK{
+					KeyID:   keyID,
+					KeyType: "EC",
+					Curve:   "P-256",
+					X:       base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+					Y:       base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32))),
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(jwks)
+	case "/token":
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != testOIDCClientID || clientSecret != "secret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		code, ok := idp.codes[r.PostFormValue("code")]
+		if !ok {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		delete(idp.codes, r.PostFormValue("code"))
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if code.codeChallenge != base64.RawURLEncoding.EncodeToString(challenge[:]) || code.redirectURI != r.PostFormValue("redirect_uri") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&oidcTokenResponse{
+			IDToken:     idp.token(idp.t, code.claims),
+			AccessToken: "opaque",
+			TokenType:   "Bearer",
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
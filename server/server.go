@@ -17,7 +17,6 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -38,29 +37,44 @@ import (
 
 // Server is the main server, providing the UI and API for ntfy
 type Server struct {
-	config            *Config
-	httpServer        *http.Server
-	httpsServer       *http.Server
-	httpMetricsServer *http.Server
-	httpProfileServer *http.Server
-	unixListener      net.Listener
-	smtpServer        *smtp.Server
-	smtpServerBackend *smtpBackend
-	smtpSender        mailer
-	topics            map[string]*topic
-	visitors          map[string]*visitor // ip:<ip> or user:<user>
-	firebaseClient    *firebaseClient
-	messages          int64                               // Total number of messages (persisted if messageCache enabled)
-	messagesHistory   []int64                             // Last n values of the messages counter, used to determine rate
-	userManager       *user.Manager                       // Might be nil!
-	messageCache      *messageCache                       // Database that stores the messages
-	webPush           *webPushStore                       // Database that stores web push subscriptions
-	fileCache         *fileCache                          // File system based cache that stores attachments
-	stripe            stripeAPI                           // Stripe API, can be replaced with a mock
-	priceCache        *util.LookupCache[map[string]int64] // Stripe price ID -> price as cents (USD implied!)
-	metricsHandler    http.Handler                        // Handles /metrics if enable-metrics set, and listen-metrics-http not set
-	closeChan         chan bool
-	mu                sync.RWMutex
+	config             *Config
+	httpServer         *http.Server
+	httpsServer        *http.Server
+	httpMetricsServer  *http.Server
+	httpProfileServer  *http.Server
+	unixListener       net.Listener
+	smtpServer         *smtp.Server
+	smtpServerBackend  *smtpBackend
+	smtpSender         mailer
+	topics             map[string]*topic
+	visitors           map[string]*visitor // ip:<ip> or user:<user>
+	firebaseClient     *firebaseClient
+	messages           int64                               // Total number of messages (persisted if messageCache enabled)
+	messagesHistory    []int64                             // Last n values of the messages counter, used to determine rate
+	userManager        *user.Manager                       // Might be nil!
+	messageCache       *messageCache                       // Database that stores the messages
+	webPush            *webPushStore                       // Database that stores web push subscriptions
+	fileCache          *fileCache                          // Stores attachments on disk or in an S3 bucket
+	stripe             stripeAPI                           // Stripe API, can be replaced with a mock
+	priceCache         *util.LookupCache[map[string]int64] // Stripe price ID -> price as cents (USD implied!)
+	metricsHandler     http.Handler                        // Handles /metrics if enable-metrics set, and listen-metrics-http not set
+	webhookTrigger     chan struct{}                       // Wakes up the webhook sender when new deliveries are queued
+	webhookClient      *http.Client                        // HTTP client for webhook requests, see newWebhookClient
+	quietHoursBacklogs map[string]*quietHoursBacklog       // User ID/topic -> push notifications held back during quiet hours
+	digestQueue        *util.BatchingQueue[*digestEntry]   // Messages held back from push transports, nil if no digest topics are configured
+	digestTopicsRegex  *regexp.Regexp                      // Topics for which push notifications are sent as digest
+	topicPatternSubs   map[int]*topicPatternSubscription   // Wildcard subscriptions, attached to matching topics as they are created
+	topicPatternSubID  int                                 // Last ID used in topicPatternSubs
+	ruleFilters        map[string]filterExpr               // Rule ID -> parsed filter expression, see ruleFilter
+	oidc               *oidcProvider                       // OpenID Connect provider for single sign-on, nil if disabled
+	federationPeers    []*federationPeer                   // Servers to mirror topics from, or push topics to
+	federationClient   *http.Client                        // HTTP client for federation pushes and mirror connections, see newFederationClient
+	federationMu       sync.Mutex                          // Serializes deduplication of federated messages
+	clusterBus         clusterBus                          // Message bus connecting the replicas of a cluster, nil if cluster mode is disabled
+	clusterNode        string                              // Random ID of this replica, used to ignore own messages on the cluster bus
+	clusterLeader      bool                                // True if this replica holds the cluster leader lease, see isClusterLeader
+	closeChan          chan bool
+	mu                 sync.RWMutex
 }
 
 // handleFunc extends the normal http.HandlerFunc to be able to easily return errors
@@ -71,32 +85,47 @@ var (
 	topicRegex             = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)               // No /!
 	topicPathRegex         = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}$`)              // Regex must match JS & Android app!
 	externalTopicPathRegex = regexp.MustCompile(`^/[^/]+\.[^/]+/[-_A-Za-z0-9]{1,64}$`) // Extended topic path, for web-app, e.g. /example.com/mytopic
-	jsonPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/json$`)
-	ssePathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/sse$`)
-	rawPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/raw$`)
-	wsPathRegex            = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/ws$`)
+	jsonPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/json$`)
+	ssePathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/sse$`)
+	rawPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/raw$`)
+	wsPathRegex            = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/ws$`)
 	authPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/auth$`)
 	publishPathRegex       = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/(publish|send|trigger)$`)
+	messagePathRegex       = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/([-_A-Za-z0-9]{12})$`)
+	ackPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/([-_A-Za-z0-9]{12})/ack$`)
 
 	webConfigPath                                        = "/config.js"
 	webManifestPath                                      = "/manifest.webmanifest"
 	webRootHTMLPath                                      = "/app.html"
 	webServiceWorkerPath                                 = "/sw.js"
 	accountPath                                          = "/account"
+	webLoginPath                                         = "/login"
 	matrixPushPath                                       = "/_matrix/push/v1/notify"
 	metricsPath                                          = "/metrics"
 	apiHealthPath                                        = "/v1/health"
 	apiStatsPath                                         = "/v1/stats"
 	apiWebPushPath                                       = "/v1/webpush"
 	apiTiersPath                                         = "/v1/tiers"
+	apiSearchPath                                        = "/v1/search"
 	apiUsersPath                                         = "/v1/users"
 	apiUsersAccessPath                                   = "/v1/users/access"
+	apiGroupsPath                                        = "/v1/groups"
+	apiGroupsMembersPath                                 = "/v1/groups/members"
+	apiGroupsAccessPath                                  = "/v1/groups/access"
+	apiRulesPath                                         = "/v1/rules"
+	apiEscalationsPath                                   = "/v1/escalations"
+	apiFederationMessagesPath                            = "/v1/federation/messages"
+	apiUploadsPath                                       = "/v1/uploads"
+	apiAuthOIDCPath                                      = "/v1/auth/oidc"
+	apiAuthOIDCLoginPath                                 = "/v1/auth/oidc/login"
+	apiAuthOIDCCallbackPath                              = "/v1/auth/oidc/callback"
 	apiAccountPath                                       = "/v1/account"
 	apiAccountTokenPath                                  = "/v1/account/token"
 	apiAccountPasswordPath                               = "/v1/account/password"
 	apiAccountSettingsPath                               = "/v1/account/settings"
 	apiAccountSubscriptionPath                           = "/v1/account/subscription"
 	apiAccountReservationPath                            = "/v1/account/reservation"
+	apiAccountWebhookPath                                = "/v1/account/webhook"
 	apiAccountPhonePath                                  = "/v1/account/phone"
 	apiAccountPhoneVerifyPath                            = "/v1/account/phone/verify"
 	apiAccountBillingPortalPath                          = "/v1/account/billing/portal"
@@ -105,6 +134,8 @@ var (
 	apiAccountBillingSubscriptionCheckoutSuccessTemplate = "/v1/account/billing/subscription/success/{CHECKOUT_SESSION_ID}"
 	apiAccountBillingSubscriptionCheckoutSuccessRegex    = regexp.MustCompile(`/v1/account/billing/subscription/success/(.+)$`)
 	apiAccountReservationSingleRegex                     = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})$`)
+	apiAccountWebhookSingleRegex                         = regexp.MustCompile(`/v1/account/webhook/([-_A-Za-z0-9]{1,64})$`)
+	apiUploadsSingleRegex                                = regexp.MustCompile(`^/v1/uploads/([A-Za-z0-9]{1,64})$`)
 	staticRegex                                          = regexp.MustCompile(`^/static/.+`)
 	docsRegex                                            = regexp.MustCompile(`^/docs(|/.*)$`)
 	fileRegex                                            = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
@@ -123,17 +154,20 @@ var (
 )
 
 const (
-	firebaseControlTopic     = "~control"                // See Android if changed
-	firebasePollTopic        = "~poll"                   // See iOS if changed (DISABLED for now)
-	emptyMessageBody         = "triggered"               // Used if message body is empty
-	newMessageBody           = "New message"             // Used in poll requests as generic message
-	defaultAttachmentMessage = "You received a file: %s" // Used if message body is empty, and there is an attachment
-	encodingBase64           = "base64"                  // Used mainly for binary UnifiedPush messages
-	jsonBodyBytesLimit       = 32768                     // Max number of bytes for a request bodys (unless MessageLimit is higher)
-	unifiedPushTopicPrefix   = "up"                      // Temporarily, we rate limit all "up*" topics based on the subscriber
-	unifiedPushTopicLength   = 14                        // Length of UnifiedPush topics, including the "up" part
-	messagesHistoryMax       = 10                        // Number of message count values to keep in memory
-	templateMaxExecutionTime = 100 * time.Millisecond
+	firebaseControlTopic         = "~control"                // See Android if changed
+	firebasePollTopic            = "~poll"                   // See iOS if changed (DISABLED for now)
+	emptyMessageBody             = "triggered"               // Used if message body is empty
+	newMessageBody               = "New message"             // Used in poll requests as generic message
+	defaultAttachmentMessage     = "You received a file: %s" // Used if message body is empty, and there is an attachment
+	encodingBase64               = "base64"                  // Used mainly for binary UnifiedPush messages
+	encodingJWE                  = "jwe"                     // End-to-end encrypted messages, the message is a JWE compact serialization
+	encryptedMessageBody         = "Encrypted message"       // Used in e-mails and phone calls instead of an encrypted message
+	jsonBodyBytesLimit           = 32768                     // Max number of bytes for a request bodys (unless MessageLimit is higher)
+	unifiedPushTopicPrefix       = "up"                      // Temporarily, we rate limit all "up*" topics based on the subscriber
+	unifiedPushTopicLength       = 14                        // Length of UnifiedPush topics, including the "up" part
+	messagesHistoryMax           = 10                        // Number of message count values to keep in memory
+	templateMaxExecutionTime     = 100 * time.Millisecond
+	attachmentPresignedURLExpiry = 10 * time.Minute // Validity of presigned URLs, see Config.AttachmentS3Redirect
 )
 
 var (
@@ -161,7 +195,15 @@ func New(conf *Config) (*Server, error) {
 	if conf.StripeSecretKey != "" {
 		stripe = newStripeAPI()
 	}
-	messageCache, err := createMessageCache(conf)
+	var keys *keyring
+	if conf.EncryptionKeyFile != "" {
+		var err error
+		keys, err = loadKeyring(conf.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	messageCache, err := createMessageCache(conf, keys)
 	if err != nil {
 		return nil, err
 	}
@@ -181,11 +223,17 @@ func New(conf *Config) (*Server, error) {
 		return nil, err
 	}
 	var fileCache *fileCache
-	if conf.AttachmentCacheDir != "" {
-		fileCache, err = newFileCache(conf.AttachmentCacheDir, conf.AttachmentTotalSizeLimit)
+	if conf.AttachmentCacheDir != "" || conf.AttachmentS3URL != "" {
+		store, err := createAttachmentStore(conf)
 		if err != nil {
 			return nil, err
 		}
+		attachmentsSize, err := messageCache.AttachmentsSize()
+		if err != nil {
+			return nil, err
+		}
+		fileCache = newFileCache(store, conf.AttachmentTotalSizeLimit, keys)
+		fileCache.SetSize(attachmentsSize)
 	}
 	var userManager *user.Manager
 	if conf.AuthFile != "" {
@@ -193,6 +241,22 @@ func New(conf *Config) (*Server, error) {
 		if err != nil {
 			return nil, err
 		}
+		if conf.LDAPURL != "" {
+			directory, err := user.NewLDAPDirectory(&user.LDAPConfig{
+				URL:            conf.LDAPURL,
+				BindDN:         conf.LDAPBindDN,
+				BindPassword:   conf.LDAPBindPassword,
+				UserBaseDN:     conf.LDAPUserBaseDN,
+				UserFilter:     conf.LDAPUserFilter,
+				GroupBaseDN:    conf.LDAPGroupBaseDN,
+				GroupFilter:    conf.LDAPGroupFilter,
+				GroupAttribute: conf.LDAPGroupAttribute,
+			})
+			if err != nil {
+				return nil, err
+			}
+			userManager.UseDirectory(directory, conf.LDAPCacheDuration)
+		}
 	}
 	var firebaseClient *firebaseClient
 	if conf.FirebaseKeyFile != "" {
@@ -209,28 +273,61 @@ func New(conf *Config) (*Server, error) {
 		firebaseClient = newFirebaseClient(sender, auther)
 	}
 	s := &Server{
-		config:          conf,
-		messageCache:    messageCache,
-		webPush:         webPush,
-		fileCache:       fileCache,
-		firebaseClient:  firebaseClient,
-		smtpSender:      mailer,
-		topics:          topics,
-		userManager:     userManager,
-		messages:        messages,
-		messagesHistory: []int64{messages},
-		visitors:        make(map[string]*visitor),
-		stripe:          stripe,
+		config:             conf,
+		messageCache:       messageCache,
+		webPush:            webPush,
+		fileCache:          fileCache,
+		firebaseClient:     firebaseClient,
+		smtpSender:         mailer,
+		topics:             topics,
+		userManager:        userManager,
+		messages:           messages,
+		messagesHistory:    []int64{messages},
+		visitors:           make(map[string]*visitor),
+		stripe:             stripe,
+		webhookTrigger:     make(chan struct{}, 1),
+		quietHoursBacklogs: make(map[string]*quietHoursBacklog),
+		topicPatternSubs:   make(map[int]*topicPatternSubscription),
+		ruleFilters:        make(map[string]filterExpr),
+	}
+	if conf.EnableWebhooks {
+		s.webhookClient = s.newWebhookClient()
+	}
+	if conf.OIDCIssuer != "" && userManager != nil {
+		s.oidc = newOIDCProvider(conf)
+	}
+	for _, peer := range conf.FederationPeers {
+		s.federationPeers = append(s.federationPeers, newFederationPeer(peer))
+	}
+	if len(s.federationPeers) > 0 {
+		s.federationClient = newFederationClient()
+	}
+	if len(conf.DigestTopics) > 0 {
+		s.digestTopicsRegex = newTopicPatternsRegex(conf.DigestTopics)
+		s.digestQueue = util.NewBatchingQueue[*digestEntry](0, conf.DigestWindow)
+		go s.runDigestSender()
 	}
 	s.priceCache = util.NewLookupCache(s.fetchStripePrices, conf.StripePriceCacheDuration)
+	if conf.ClusterURL != "" {
+		s.clusterNode = util.RandomString(clusterNodeIDLength)
+		s.clusterBus, err = newClusterBus(conf.ClusterURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.clusterBus.Subscribe(clusterMessagesChannel, s.receiveClusterMessage); err != nil {
+			return nil, err
+		}
+	}
 	return s, nil
 }
 
-func createMessageCache(conf *Config) (*messageCache, error) {
+func createMessageCache(conf *Config, keyring *keyring) (*messageCache, error) {
 	if conf.CacheDuration == 0 {
 		return newNopCache()
+	} else if util.IsPostgresURL(conf.CacheFile) {
+		return newPostgresCache(conf.CacheFile, conf.CacheStartupQueries, conf.CacheDuration, conf.CacheBatchSize, conf.CacheBatchTimeout, false, keyring)
 	} else if conf.CacheFile != "" {
-		return newSqliteCache(conf.CacheFile, conf.CacheStartupQueries, conf.CacheDuration, conf.CacheBatchSize, conf.CacheBatchTimeout, false)
+		return newSqliteCache(conf.CacheFile, conf.CacheStartupQueries, conf.CacheDuration, conf.CacheBatchSize, conf.CacheBatchTimeout, false, keyring)
 	}
 	return newMemCache()
 }
@@ -335,6 +432,10 @@ func (s *Server) Run() error {
 	go s.runStatsResetter()
 	go s.runDelayedSender()
 	go s.runFirebaseKeepaliver()
+	go s.runWebhookSender()
+	go s.runEscalationSender()
+	go s.runFederation()
+	go s.runClusterLeaderElection()
 
 	return <-errChan
 }
@@ -355,6 +456,12 @@ func (s *Server) Stop() {
 	if s.smtpServer != nil {
 		s.smtpServer.Close()
 	}
+	if s.clusterBus != nil {
+		s.clusterBus.Close()
+	}
+	if s.oidc != nil {
+		s.oidc.Close()
+	}
 	s.closeDatabases()
 	close(s.closeChan)
 }
@@ -371,11 +478,14 @@ func (s *Server) closeDatabases() {
 
 // handle is the main entry point for all HTTP requests
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
-	v, err := s.maybeAuthenticate(r) // Note: Always returns v, even when error is returned
+	v, u, err := s.maybeAuthenticate(r) // Note: Always returns v, even when error is returned
 	if err != nil {
 		s.handleError(w, r, v, err)
 		return
 	}
+	r = withContext(r, map[contextKey]any{
+		contextUser: u,
+	})
 	ev := logvr(v, r)
 	if ev.IsTrace() {
 		ev.Field("http_request", renderHTTPRequest(r)).Trace("HTTP request started")
@@ -433,6 +543,9 @@ func (s *Server) handleError(w http.ResponseWriter, r *http.Request, v *visitor,
 }
 
 func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if err := s.authorizeTokenScope(r, v); err != nil {
+		return err
+	}
 	if r.Method == http.MethodGet && r.URL.Path == "/" && s.config.WebRoot == "/" {
 		return s.ensureWebEnabled(s.handleRoot)(w, r, v)
 	} else if r.Method == http.MethodHead && r.URL.Path == "/" {
@@ -453,6 +566,38 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureAdmin(s.handleAccessAllow)(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiUsersAccessPath {
 		return s.ensureAdmin(s.handleAccessReset)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiGroupsPath {
+		return s.ensureAdmin(s.handleGroupsGet)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiGroupsPath {
+		return s.ensureAdmin(s.handleGroupsAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiGroupsPath {
+		return s.ensureAdmin(s.handleGroupsDelete)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiGroupsMembersPath {
+		return s.ensureAdmin(s.handleGroupMembersAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiGroupsMembersPath {
+		return s.ensureAdmin(s.handleGroupMembersDelete)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiGroupsAccessPath {
+		return s.ensureAdmin(s.handleGroupAccessAllow)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiGroupsAccessPath {
+		return s.ensureAdmin(s.handleGroupAccessReset)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiRulesPath {
+		return s.ensureAdmin(s.handleRulesGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiRulesPath {
+		return s.ensureAdmin(s.handleRulesAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiRulesPath {
+		return s.ensureAdmin(s.handleRulesDelete)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiEscalationsPath {
+		return s.ensureAdmin(s.handleEscalationPoliciesGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiEscalationsPath {
+		return s.ensureAdmin(s.handleEscalationPoliciesAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiEscalationsPath {
+		return s.ensureAdmin(s.handleEscalationPoliciesDelete)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiFederationMessagesPath {
+		return s.ensureFederationEnabled(s.limitRequests(s.ensureUser(s.handleFederationMessage)))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAuthOIDCLoginPath {
+		return s.ensureOIDCEnabled(s.limitRequests(s.handleOIDCLogin))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAuthOIDCCallbackPath {
+		return s.ensureOIDCEnabled(s.limitRequests(s.handleOIDCCallback))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPath {
 		return s.ensureUserManager(s.handleAccountCreate)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountPath {
@@ -479,6 +624,10 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureUser(s.withAccountSync(s.handleAccountReservationAdd))(w, r, v)
 	} else if r.Method == http.MethodDelete && apiAccountReservationSingleRegex.MatchString(r.URL.Path) {
 		return s.ensureUser(s.withAccountSync(s.handleAccountReservationDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountWebhookPath {
+		return s.ensureWebhooksEnabled(s.ensureUser(s.withAccountSync(s.handleAccountWebhookAdd)))(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAccountWebhookSingleRegex.MatchString(r.URL.Path) {
+		return s.ensureWebhooksEnabled(s.ensureUser(s.withAccountSync(s.handleAccountWebhookDelete)))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountBillingSubscriptionPath {
 		return s.ensurePaymentsEnabled(s.ensureUser(s.handleAccountBillingSubscriptionCreate))(w, r, v) // Account sync via incoming Stripe webhook
 	} else if r.Method == http.MethodGet && apiAccountBillingSubscriptionCheckoutSuccessRegex.MatchString(r.URL.Path) {
@@ -501,8 +650,18 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureWebPushEnabled(s.limitRequests(s.handleWebPushUpdate))(w, r, v)
 	} else if r.Method == http.MethodDelete && apiWebPushPath == r.URL.Path {
 		return s.ensureWebPushEnabled(s.limitRequests(s.handleWebPushDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiUploadsPath {
+		return s.ensureAttachmentsEnabled(s.limitRequests(s.handleUploadCreate))(w, r, v)
+	} else if r.Method == http.MethodHead && apiUploadsSingleRegex.MatchString(r.URL.Path) {
+		return s.ensureAttachmentsEnabled(s.limitRequests(s.handleUploadHead))(w, r, v)
+	} else if r.Method == http.MethodPatch && apiUploadsSingleRegex.MatchString(r.URL.Path) {
+		return s.ensureAttachmentsEnabled(s.limitRequests(s.handleUploadAppend))(w, r, v)
+	} else if r.Method == http.MethodDelete && apiUploadsSingleRegex.MatchString(r.URL.Path) {
+		return s.ensureAttachmentsEnabled(s.limitRequests(s.handleUploadDelete))(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiStatsPath {
 		return s.handleStats(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiSearchPath {
+		return s.limitRequests(s.handleSearch)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiTiersPath {
 		return s.ensurePaymentsEnabled(s.handleBillingTiersGet)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == matrixPushPath {
@@ -513,7 +672,7 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureWebEnabled(s.handleStatic)(w, r, v)
 	} else if r.Method == http.MethodGet && docsRegex.MatchString(r.URL.Path) {
 		return s.ensureWebEnabled(s.handleDocs)(w, r, v)
-	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && fileRegex.MatchString(r.URL.Path) && s.config.AttachmentCacheDir != "" {
+	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && fileRegex.MatchString(r.URL.Path) && s.fileCache != nil {
 		return s.limitRequests(s.handleFile)(w, r, v)
 	} else if r.Method == http.MethodOptions {
 		return s.limitRequests(s.handleOptions)(w, r, v) // Should work even if the web app is not enabled, see #598
@@ -525,6 +684,12 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish))(w, r, v)
 	} else if r.Method == http.MethodGet && publishPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish))(w, r, v)
+	} else if r.Method == http.MethodPut && messagePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handleMessageUpdate))(w, r, v)
+	} else if r.Method == http.MethodDelete && messagePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handleMessageDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && ackPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.handleMessageAck)(w, r, v) // Authorized by the escalation token, not by topic ACL
 	} else if r.Method == http.MethodGet && jsonPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeJSON))(w, r, v)
 	} else if r.Method == http.MethodGet && ssePathRegex.MatchString(r.URL.Path) {
@@ -583,7 +748,9 @@ func (s *Server) handleWebConfig(w http.ResponseWriter, _ *http.Request, _ *visi
 		EnableCalls:        s.config.TwilioAccount != "",
 		EnableEmails:       s.config.SMTPSenderFrom != "",
 		EnableReservations: s.config.EnableReservations,
+		EnableWebhooks:     s.config.EnableWebhooks,
 		EnableWebPush:      s.config.WebPushPublicKey != "",
+		EnableOIDC:         s.oidc != nil,
 		BillingContact:     s.config.BillingContact,
 		WebPushPublicKey:   s.config.WebPushPublicKey,
 		DisallowedTopics:   s.config.DisallowedTopics,
@@ -654,33 +821,84 @@ func (s *Server) handleStats(w http.ResponseWriter, _ *http.Request, _ *visitor)
 
 // handleFile processes the download of attachment files. The method handles GET and HEAD requests against a file.
 // Before streaming the file to a client, it locates uploader (m.Sender or m.User) in the message cache, so it
-// can associate the download bandwidth with the uploader.
+// can associate the download bandwidth with the uploader. If Config.AttachmentS3Redirect is set, GET requests
+// are redirected to a presigned URL, so that the file is downloaded directly from the S3 bucket.
+//
+// Preview images (see Config.AttachmentImageProcessing) are served like attachments, using the file ID
+// <message-id>_preview. They are small, so they are never redirected.
 func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	if s.config.AttachmentCacheDir == "" {
+	if s.fileCache == nil {
 		return errHTTPInternalError
 	}
 	matches := fileRegex.FindStringSubmatch(r.URL.Path)
 	if len(matches) != 2 {
 		return errHTTPInternalErrorInvalidPath
 	}
-	messageID := matches[1]
-	file := filepath.Join(s.config.AttachmentCacheDir, messageID)
-	stat, err := os.Stat(file)
+	fileID := matches[1]
+	messageID := strings.TrimSuffix(fileID, imagePreviewFileSuffix)
+	preview := fileID != messageID
+	if s.config.AttachmentS3Redirect && r.Method == http.MethodGet && !preview {
+		return s.handleFileRedirect(w, r, v, messageID)
+	}
+	m, err := s.fileMessage(messageID)
 	if err != nil {
+		return err
+	}
+	f, size, err := s.fileCache.Open(fileID, m.Attachment != nil && m.Attachment.Encrypted)
+	if errors.Is(err, os.ErrNotExist) {
 		return errHTTPNotFound.Fields(log.Context{
 			"message_id":    messageID,
 			"error_context": "filesystem",
 		})
+	} else if err != nil {
+		return err
 	}
+	defer f.Close()
 	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
 	if r.Method == http.MethodHead {
 		return nil
 	}
-	// Find message in database, and associate bandwidth to the uploader user
-	// This is an easy way to
-	//   - avoid abuse (e.g. 1 uploader, 1k downloaders)
-	//   - and also uses the higher bandwidth limits of a paying user
+	if err := s.fileBandwidthAllowed(v, m, size); err != nil {
+		return err
+	}
+	// Actually send file; encrypted files are decrypted while streaming
+	if m.Attachment != nil && m.Attachment.Name != "" && !preview {
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(m.Attachment.Name))
+	}
+	_, err = io.Copy(util.NewContentTypeWriter(w, r.URL.Path), f)
+	return err
+}
+
+// handleFileRedirect redirects the download of an attachment file to a presigned URL of the attachment store.
+// Since the file itself is not touched, the bandwidth is accounted for using the attachment size in the message cache.
+func (s *Server) handleFileRedirect(w http.ResponseWriter, r *http.Request, v *visitor, messageID string) error {
+	m, err := s.fileMessage(messageID)
+	if err != nil {
+		return err
+	} else if m.Attachment == nil || m.Attachment.Expires < time.Now().Unix() {
+		return errHTTPNotFound.Fields(log.Context{
+			"message_id":    messageID,
+			"error_context": "message_cache",
+		})
+	}
+	if err := s.fileBandwidthAllowed(v, m, m.Attachment.Size); err != nil {
+		return err
+	}
+	presignedURL, err := s.fileCache.PresignedURL(messageID, m.Attachment.Name, m.Attachment.Type, attachmentPresignedURLExpiry)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	http.Redirect(w, r, presignedURL, http.StatusFound)
+	return nil
+}
+
+// fileMessage finds the message of an attachment file in the message cache, so that the download bandwidth can
+// be associated to the uploader user. This is an easy way to
+//   - avoid abuse (e.g. 1 uploader, 1k downloaders)
+//   - and also uses the higher bandwidth limits of a paying user
+func (s *Server) fileMessage(messageID string) (*message, error) {
 	m, err := s.messageCache.Message(messageID)
 	if errors.Is(err, errMessageNotFound) {
 		if s.config.CacheBatchTimeout > 0 {
@@ -691,14 +909,19 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 			}, s.config.CacheBatchTimeout, 100*time.Millisecond, 300*time.Millisecond, 600*time.Millisecond)
 		}
 		if err != nil {
-			return errHTTPNotFound.Fields(log.Context{
+			return nil, errHTTPNotFound.Fields(log.Context{
 				"message_id":    messageID,
 				"error_context": "message_cache",
 			})
 		}
 	} else if err != nil {
-		return err
+		return nil, err
 	}
+	return m, nil
+}
+
+// fileBandwidthAllowed checks and accounts the download bandwidth of an attachment file, see fileMessage
+func (s *Server) fileBandwidthAllowed(v *visitor, m *message, size int64) error {
 	bandwidthVisitor := v
 	if s.userManager != nil && m.User != "" {
 		u, err := s.userManager.UserByID(m.User)
@@ -709,20 +932,10 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	} else if m.Sender.IsValid() {
 		bandwidthVisitor = s.visitor(m.Sender, nil)
 	}
-	if !bandwidthVisitor.BandwidthAllowed(stat.Size()) {
+	if !bandwidthVisitor.BandwidthAllowed(size) {
 		return errHTTPTooManyRequestsLimitAttachmentBandwidth.With(m)
 	}
-	// Actually send file
-	f, err := os.Open(file)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if m.Attachment.Name != "" {
-		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(m.Attachment.Name))
-	}
-	_, err = io.Copy(util.NewContentTypeWriter(w, r.URL.Path), f)
-	return err
+	return nil
 }
 
 func (s *Server) handleMatrixDiscovery(w http.ResponseWriter) error {
@@ -784,6 +997,10 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	if m.Message == "" {
 		m.Message = emptyMessageBody
 	}
+	var esc *escalation
+	if cache && !unifiedpush {
+		esc = s.maybePrepareEscalation(v, m) // Must be before publishing, since it adds the "ack" action
+	}
 	delayed := m.Time > time.Now().Unix()
 	ev := logvrm(v, r, m).
 		Tag(tagPublish).
@@ -804,21 +1021,29 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 		if err := t.Publish(v, m); err != nil {
 			return nil, err
 		}
-		if s.firebaseClient != nil && firebase {
+		s.publishToCluster(v, m, true)
+		digested := !unifiedpush && s.maybeEnqueueDigest(v, m, firebase) // Push transports are handled by digest sender
+		if s.firebaseClient != nil && firebase && !digested {
 			go s.sendToFirebase(v, m)
 		}
 		if s.smtpSender != nil && email != "" {
 			go s.sendEmail(v, m, email)
 		}
 		if s.config.TwilioAccount != "" && call != "" {
-			go s.callPhone(v, r, m, call)
+			go s.callPhone(v, m, call)
 		}
-		if s.config.UpstreamBaseURL != "" && !unifiedpush { // UP messages are not sent to upstream
+		if s.config.UpstreamBaseURL != "" && !unifiedpush && !digested { // UP messages are not sent to upstream
 			go s.forwardPollRequest(v, m)
 		}
-		if s.config.WebPushPublicKey != "" {
+		if s.config.WebPushPublicKey != "" && !digested {
 			go s.publishToWebPushEndpoints(v, m)
 		}
+		if s.config.EnableWebhooks && s.userManager != nil {
+			go s.enqueueWebhooks(v, m)
+		}
+		if !unifiedpush { // UP messages are not federated
+			s.enqueueFederationPushes(v, m)
+		}
 	} else {
 		logvrm(v, r, m).Tag(tagPublish).Debug("Message delayed, will process later")
 	}
@@ -828,6 +1053,15 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 			return nil, err
 		}
 	}
+	if esc != nil {
+		logvrm(v, r, m).Tag(tagEscalation).Field("escalation_policy_id", esc.PolicyID).Debug("Starting escalation")
+		if err := s.messageCache.AddEscalation(esc); err != nil {
+			return nil, err
+		}
+	}
+	if !delayed && !unifiedpush {
+		s.routeMessage(v, m, cache, nil)
+	}
 	u := v.User()
 	if s.userManager != nil && u != nil && u.Tier != nil {
 		go s.userManager.EnqueueUserStats(u.ID, v.Stats())
@@ -877,7 +1111,159 @@ func (s *Server) handlePublishMatrix(w http.ResponseWriter, r *http.Request, v *
 	return writeMatrixSuccess(w)
 }
 
+// handleMessageUpdate replaces the content of a previously published message (PUT /<topic>/<message-id>),
+// and sends a "message_update" event to all subscribers, so that clients can replace the existing notification.
+// The title, message, priority, tags, click action, icon, actions, content type and encoding are replaced; the ID, time,
+// expiry and attachment of the original message are kept. The event is stored in the message cache as well, so that
+// clients that were offline receive it when they poll, see newMessageUpdateMessage.
+func (s *Server) handleMessageUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, m, err := s.messageFromPath(r, v)
+	if err != nil {
+		return err
+	}
+	vrate, err := fromContext[*visitor](r, contextRateVisitor)
+	if err != nil {
+		return err
+	}
+	body, err := util.Peek(r.Body, s.config.MessageSizeLimit)
+	if err != nil {
+		return err
+	}
+	update := newMessage(messageUpdateEvent, t.ID, "")
+	now := update.Time
+	_, firebase, email, call, template, unifiedpush, e := s.parsePublishParams(r, update)
+	if e != nil {
+		return e.With(t)
+	} else if email != "" || call != "" || unifiedpush || update.Attachment != nil || update.PollID != "" || update.Time != now {
+		return errHTTPBadRequestMessageUpdateInvalid.With(t)
+	} else if !util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) && !vrate.MessageAllowed() {
+		return errHTTPTooManyRequestsLimitMessages.With(t)
+	}
+	if update.Encoding == encodingJWE {
+		err = s.handleBodyAsEncryptedMessage(r, v, update, body)
+	} else if template {
+		err = s.handleBodyAsTemplatedTextMessage(update, body)
+	} else {
+		err = s.handleBodyAsTextMessage(update, body)
+	}
+	if err != nil {
+		return err
+	}
+	if update.Message == "" {
+		update.Message = emptyMessageBody
+	}
+	m.Title = update.Title
+	m.Message = update.Message
+	m.Priority = update.Priority
+	m.Tags = update.Tags
+	m.Click = update.Click
+	m.Icon = update.Icon
+	m.Actions = update.Actions
+	m.ContentType = update.ContentType
+	m.Encoding = update.Encoding
+	logvrm(v, r, m).Tag(tagPublish).With(t).Debug("Updating message")
+	if err := s.messageCache.UpdateMessage(m); errors.Is(err, errMessageNotFound) {
+		return errHTTPNotFoundMessage.With(t)
+	} else if err != nil {
+		return err
+	}
+	if m.Time <= time.Now().Unix() { // Scheduled messages have not been sent to anyone yet
+		if err := s.publishMessageChange(v, t, newMessageUpdateMessage(m), firebase); err != nil {
+			return err
+		}
+	}
+	u := v.User()
+	if s.userManager != nil && u != nil && u.Tier != nil {
+		go s.userManager.EnqueueUserStats(u.ID, v.Stats())
+	}
+	return s.writeJSON(w, m)
+}
+
+// handleMessageDelete deletes a previously published message (DELETE /<topic>/<message-id>) from the message cache,
+// along with its attachment and updates, and sends a "message_delete" event to all subscribers, so that clients can
+// remove the existing notification. The event is stored in the message cache in place of the message (as a tombstone),
+// so that clients that were offline receive it when they poll. If the message is scheduled, it is simply never sent.
+func (s *Server) handleMessageDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, m, err := s.messageFromPath(r, v)
+	if err != nil {
+		return err
+	}
+	logvrm(v, r, m).Tag(tagPublish).With(t).Debug("Deleting message")
+	if err := s.messageCache.DeleteMessages(m.ID); err != nil {
+		return err
+	}
+	if m.Attachment != nil && s.fileCache != nil && strings.HasPrefix(m.Attachment.URL, s.config.BaseURL+"/file/") {
+		if err := s.fileCache.Remove(m.ID); err != nil {
+			logvrm(v, r, m).Tag(tagPublish).Err(err).Warn("Unable to delete attachment")
+		}
+	}
+	if m.Time <= time.Now().Unix() { // Scheduled messages have not been sent to anyone yet
+		firebase := readBoolParam(r, true, "x-firebase", "firebase")
+		if err := s.publishMessageChange(v, t, newMessageDeleteMessage(m), firebase); err != nil {
+			return err
+		}
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// publishMessageChange stores a "message_update" or "message_delete" event in the message cache, and sends it to the
+// live subscribers of the topic, as well as to Firebase and Web Push subscribers. Other transports (e-mail, phone calls,
+// upstream poll requests) are not notified.
+func (s *Server) publishMessageChange(v *visitor, t *topic, m *message, firebase bool) error {
+	if err := s.messageCache.AddMessage(m); err != nil {
+		return err
+	}
+	if err := t.Publish(v, m); err != nil {
+		logvm(v, m).Tag(tagPublish).Err(err).Warn("Unable to publish message change")
+	}
+	s.publishToCluster(v, m, false)
+	if s.firebaseClient != nil && firebase {
+		go s.sendToFirebase(v, m)
+	}
+	if s.config.WebPushPublicKey != "" {
+		go s.publishToWebPushEndpoints(v, m)
+	}
+	return nil
+}
+
+// messageFromPath reads the message referenced in the request path (/<topic>/<message-id>) from the message cache,
+// and checks that the visitor is allowed to modify it: Messages published by a user can only be modified by that
+// user, and anonymous messages can only be modified from the IP address they were published from. Admins can
+// modify all messages.
+func (s *Server) messageFromPath(r *http.Request, v *visitor) (*topic, *message, error) {
+	t, err := fromContext[*topic](r, contextTopic)
+	if err != nil {
+		return nil, nil, err
+	}
+	matches := messagePathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return nil, nil, errHTTPInternalErrorInvalidPath
+	}
+	m, err := s.messageCache.Message(matches[1])
+	if errors.Is(err, errMessageNotFound) {
+		return nil, nil, errHTTPNotFoundMessage.With(t)
+	} else if err != nil {
+		return nil, nil, err
+	} else if m.Topic != t.ID || m.Event != messageEvent {
+		return nil, nil, errHTTPNotFoundMessage.With(t)
+	}
+	u := v.User()
+	if u != nil && u.IsAdmin() {
+		return t, m, nil
+	} else if m.User != "" && (u == nil || u.ID != m.User) {
+		return nil, nil, errHTTPForbidden.With(t)
+	} else if m.User == "" && m.Sender != v.IP() {
+		return nil, nil, errHTTPForbidden.With(t)
+	}
+	return t, m, nil
+}
+
 func (s *Server) sendToFirebase(v *visitor, m *message) {
+	if owner, q := s.topicOwnerQuietHours(v, m); q != nil {
+		logvm(v, m).Tag(tagQuietHours).Debug("Not publishing to Firebase, quiet hours of topic owner %s active", owner.Name)
+		s.holdForQuietHours(owner, q, m, true, false)
+		return
+	}
 	logvm(v, m).Tag(tagFirebase).Debug("Publishing to Firebase")
 	if err := s.firebaseClient.Send(v, m); err != nil {
 		minc(metricFirebasePublishedFailure)
@@ -892,6 +1278,10 @@ func (s *Server) sendToFirebase(v *visitor, m *message) {
 }
 
 func (s *Server) sendEmail(v *visitor, m *message, email string) {
+	if s.quietHours(v.User(), m) != nil {
+		logvm(v, m).Tag(tagQuietHours).Field("email", email).Debug("Not sending email to %s, quiet hours active", email)
+		return
+	}
 	logvm(v, m).Tag(tagEmail).Field("email", email).Debug("Sending email to %s", email)
 	if err := s.smtpSender.Send(v, m, email); err != nil {
 		logvm(v, m).Tag(tagEmail).Field("email", email).Err(err).Warn("Unable to send email to %s: %v", email, err.Error())
@@ -905,6 +1295,11 @@ func (s *Server) forwardPollRequest(v *visitor, m *message) {
 	topicURL := fmt.Sprintf("%s/%s", s.config.BaseURL, m.Topic)
 	topicHash := fmt.Sprintf("%x", sha256.Sum256([]byte(topicURL)))
 	forwardURL := fmt.Sprintf("%s/%s", s.config.UpstreamBaseURL, topicHash)
+	if owner, q := s.topicOwnerQuietHours(v, m); q != nil {
+		logvm(v, m).Tag(tagQuietHours).Debug("Not publishing poll request, quiet hours of topic owner %s active", owner.Name)
+		s.holdForQuietHours(owner, q, m, true, false)
+		return
+	}
 	logvm(v, m).Debug("Publishing poll request to %s", forwardURL)
 	req, err := http.NewRequest("POST", forwardURL, strings.NewReader(""))
 	if err != nil {
@@ -1024,10 +1419,20 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 		m.ContentType = "text/markdown"
 	}
 	template = readBoolParam(r, false, "x-template", "template", "tpl")
+	encoding := readParam(r, "x-encoding", "encoding")
+	if encoding == encodingJWE {
+		m.Encoding = encodingJWE
+		template = false // The server cannot read encrypted messages, so it cannot render templates either
+	} else if encoding != "" {
+		return false, false, "", "", false, false, errHTTPBadRequestEncodingInvalid
+	}
 	unifiedpush = readBoolParam(r, false, "x-unifiedpush", "unifiedpush", "up") // see GET too!
 	if unifiedpush {
 		firebase = false
 		unifiedpush = true
+		if m.Encoding != "" {
+			return false, false, "", "", false, false, errHTTPBadRequestEncodingInvalid // UnifiedPush messages are encrypted by the app server
+		}
 	}
 	m.PollID = readParam(r, "x-poll-id", "poll-id")
 	if m.PollID != "" {
@@ -1044,31 +1449,39 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 //     If a message is flagged as poll request, the body does not matter and is discarded
 //  2. curl -T somebinarydata.bin "ntfy.sh/mytopic?up=1"
 //     If UnifiedPush is enabled, encode as base64 if body is binary, and do not trim
-//  3. curl -H "Attach: http://example.com/file.jpg" ntfy.sh/mytopic
+//  3. curl -X POST -H "Upload: 3tiTKwkzjkBrm7j0mEKfxMWn" -H "Filename: video.mp4" ntfy.sh/mytopic
+//     If a resumable upload is passed, it is attached to the message, and the body is the message
+//  4. curl -H "Encoding: jwe" -d "eyJhbGciOi..." ntfy.sh/mytopic
+//     If the message is end-to-end encrypted, the body must be a JWE, or an attachment if a filename is passed
+//  5. curl -H "Attach: http://example.com/file.jpg" ntfy.sh/mytopic
 //     Body must be a message, because we attached an external URL
-//  4. curl -T short.txt -H "Filename: short.txt" ntfy.sh/mytopic
+//  6. curl -T short.txt -H "Filename: short.txt" ntfy.sh/mytopic
 //     Body must be attachment, because we passed a filename
-//  5. curl -H "Template: yes" -T file.txt ntfy.sh/mytopic
+//  7. curl -H "Template: yes" -T file.txt ntfy.sh/mytopic
 //     If templating is enabled, read up to 32k and treat message body as JSON
-//  6. curl -T file.txt ntfy.sh/mytopic
+//  8. curl -T file.txt ntfy.sh/mytopic
 //     If file.txt is <= 4096 (message limit) and valid UTF-8, treat it as a message
-//  7. curl -T file.txt ntfy.sh/mytopic
+//  9. curl -T file.txt ntfy.sh/mytopic
 //     In all other cases, mostly if file.txt is > message limit, treat it as an attachment
 func (s *Server) handlePublishBody(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser, template, unifiedpush bool) error {
 	if m.Event == pollRequestEvent { // Case 1
 		return s.handleBodyDiscard(body)
 	} else if unifiedpush {
 		return s.handleBodyAsMessageAutoDetect(m, body) // Case 2
+	} else if uploadID := readParam(r, "x-upload", "upload"); uploadID != "" {
+		return s.handleUploadAsAttachment(r, v, m, body, uploadID) // Case 3
+	} else if m.Encoding == encodingJWE {
+		return s.handleBodyAsEncryptedMessage(r, v, m, body) // Case 4
 	} else if m.Attachment != nil && m.Attachment.URL != "" {
-		return s.handleBodyAsTextMessage(m, body) // Case 3
+		return s.handleBodyAsTextMessage(m, body) // Case 5
 	} else if m.Attachment != nil && m.Attachment.Name != "" {
-		return s.handleBodyAsAttachment(r, v, m, body) // Case 4
+		return s.handleBodyAsAttachment(r, v, m, body) // Case 6
 	} else if template {
-		return s.handleBodyAsTemplatedTextMessage(m, body) // Case 5
+		return s.handleBodyAsTemplatedTextMessage(m, body) // Case 7
 	} else if !body.LimitReached && utf8.Valid(body.PeekedBytes) {
-		return s.handleBodyAsTextMessage(m, body) // Case 6
+		return s.handleBodyAsTextMessage(m, body) // Case 8
 	}
-	return s.handleBodyAsAttachment(r, v, m, body) // Case 7
+	return s.handleBodyAsAttachment(r, v, m, body) // Case 9
 }
 
 func (s *Server) handleBodyDiscard(body *util.PeekedReadCloser) error {
@@ -1100,6 +1513,28 @@ func (s *Server) handleBodyAsTextMessage(m *message, body *util.PeekedReadCloser
 	return nil
 }
 
+// handleBodyAsEncryptedMessage handles end-to-end encrypted messages. Since the server cannot read them, the message
+// is stored as is: it is never truncated, and a body that is too large is not turned into an attachment. Encrypted
+// attachments are uploaded with a filename, and the encrypted message must then be passed in the Message header.
+func (s *Server) handleBodyAsEncryptedMessage(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser) error {
+	if m.Attachment != nil && m.Attachment.Name != "" {
+		if !isJWE(m.Message) {
+			return errHTTPBadRequestEncryptedMessageInvalid.With(m)
+		}
+		return s.handleBodyAsAttachment(r, v, m, body)
+	}
+	if len(body.PeekedBytes) > 0 { // Empty body should not override message (publish via GET!)
+		if body.LimitReached {
+			return errHTTPEntityTooLargeEncryptedMessage.With(m)
+		}
+		m.Message = strings.TrimSpace(string(body.PeekedBytes))
+	}
+	if !isJWE(m.Message) {
+		return errHTTPBadRequestEncryptedMessageInvalid.With(m)
+	}
+	return nil
+}
+
 func (s *Server) handleBodyAsTemplatedTextMessage(m *message, body *util.PeekedReadCloser) error {
 	body, err := util.Peek(body, max(s.config.MessageSizeLimit, jsonBodyBytesLimit))
 	if err != nil {
@@ -1140,19 +1575,16 @@ func replaceTemplate(tpl string, source string) (string, error) {
 }
 
 func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser) error {
-	if s.fileCache == nil || s.config.BaseURL == "" || s.config.AttachmentCacheDir == "" {
+	if s.fileCache == nil || s.config.BaseURL == "" {
 		return errHTTPBadRequestAttachmentsDisallowed.With(m)
 	}
 	vinfo, err := v.Info()
 	if err != nil {
 		return err
 	}
-	attachmentExpiry := time.Now().Add(vinfo.Limits.AttachmentExpiryDuration).Unix()
-	if m.Time > attachmentExpiry {
-		return errHTTPBadRequestAttachmentsExpiryBeforeDelivery.With(m)
-	}
+	downscaleImages := vinfo.Limits.AttachmentImageProcessing && s.config.AttachmentImageMaxDimension > 0
 	contentLengthStr := r.Header.Get("Content-Length")
-	if contentLengthStr != "" { // Early "do-not-trust" check, hard limit see below
+	if contentLengthStr != "" && !downscaleImages { // Early "do-not-trust" check, hard limit see below
 		contentLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
 		if err == nil && (contentLength > vinfo.Stats.AttachmentTotalSizeRemaining || contentLength > vinfo.Limits.AttachmentFileSizeLimit) {
 			return errHTTPEntityTooLargeAttachment.With(m).Fields(log.Context{
@@ -1162,11 +1594,23 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 			})
 		}
 	}
+	return s.writeAttachment(v, vinfo, m, body, v.BandwidthLimiter())
+}
+
+// writeAttachment sets the attachment fields of the message, and stores the attachment in the file cache. The
+// given limiters are applied in addition to the visitor's attachment size limits, see handleUploadAsAttachment.
+func (s *Server) writeAttachment(v *visitor, vinfo *visitorInfo, m *message, body *util.PeekedReadCloser, limiters ...util.Limiter) error {
+	attachmentExpiry := time.Now().Add(vinfo.Limits.AttachmentExpiryDuration).Unix()
+	if m.Time > attachmentExpiry {
+		return errHTTPBadRequestAttachmentsExpiryBeforeDelivery.With(m)
+	}
 	if m.Attachment == nil {
 		m.Attachment = &attachment{}
 	}
 	var ext string
+	var err error
 	m.Attachment.Expires = attachmentExpiry
+	m.Attachment.Encrypted = s.fileCache.Encrypted()
 	m.Attachment.Type, ext = util.DetectContentType(body.PeekedBytes, m.Attachment.Name)
 	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", s.config.BaseURL, m.ID, ext)
 	if m.Attachment.Name == "" {
@@ -1175,11 +1619,13 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 	if m.Message == "" {
 		m.Message = fmt.Sprintf(defaultAttachmentMessage, m.Attachment.Name)
 	}
-	limiters := []util.Limiter{
-		v.BandwidthLimiter(),
+	if vinfo.Limits.AttachmentImageProcessing && imageProcessingSupported(m.Attachment.Type) {
+		return s.writeImageAttachment(v, vinfo, m, body, limiters...)
+	}
+	limiters = append(limiters,
 		util.NewFixedLimiter(vinfo.Limits.AttachmentFileSizeLimit),
 		util.NewFixedLimiter(vinfo.Stats.AttachmentTotalSizeRemaining),
-	}
+	)
 	m.Attachment.Size, err = s.fileCache.Write(m.ID, body, limiters...)
 	if errors.Is(err, util.ErrLimitReached) {
 		return errHTTPEntityTooLargeAttachment.With(m)
@@ -1189,6 +1635,54 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 	return nil
 }
 
+// writeImageAttachment reads an image attachment into memory, strips its metadata, downscales it (if
+// Config.AttachmentImageMaxDimension is set), and stores it along with a preview image. Since the file size limit
+// applies to the processed image, larger images are accepted if they are downscaled (see attachmentInputSizeLimit).
+// Images that cannot be processed are stored as they are.
+func (s *Server) writeImageAttachment(v *visitor, vinfo *visitorInfo, m *message, body io.Reader, limiters ...util.Limiter) error {
+	var buf bytes.Buffer
+	limitWriter := util.NewLimitWriter(&buf, append(limiters, util.NewFixedLimiter(s.attachmentInputSizeLimit(vinfo)))...)
+	if _, err := io.Copy(limitWriter, body); errors.Is(err, util.ErrLimitReached) {
+		return errHTTPEntityTooLargeAttachment.With(m)
+	} else if err != nil {
+		return err
+	}
+	data, preview := buf.Bytes(), []byte(nil)
+	processed, err := processImage(data, m.Attachment.Type, s.config.AttachmentImageMaxDimension)
+	if err != nil {
+		logvm(v, m).Tag(tagPublish).Err(err).Debug("Cannot process image attachment, storing it unprocessed")
+	} else {
+		data, preview = processed.Data, processed.Preview
+	}
+	sizeLimiters := []util.Limiter{
+		util.NewFixedLimiter(vinfo.Limits.AttachmentFileSizeLimit),
+		util.NewFixedLimiter(vinfo.Stats.AttachmentTotalSizeRemaining),
+	}
+	m.Attachment.Size, err = s.fileCache.Write(m.ID, bytes.NewReader(data), sizeLimiters...)
+	if errors.Is(err, util.ErrLimitReached) {
+		return errHTTPEntityTooLargeAttachment.With(m)
+	} else if err != nil {
+		return err
+	}
+	if preview != nil {
+		if _, err := s.fileCache.Write(m.ID+imagePreviewFileSuffix, bytes.NewReader(preview)); err != nil {
+			logvm(v, m).Tag(tagPublish).Err(err).Warn("Cannot store preview of image attachment")
+		} else {
+			m.Attachment.Preview = fmt.Sprintf("%s/file/%s%s%s", s.config.BaseURL, m.ID, imagePreviewFileSuffix, imagePreviewExtension)
+		}
+	}
+	return nil
+}
+
+// attachmentInputSizeLimit returns the max. size of an uploaded attachment. If images are downscaled for the
+// visitor, larger uploads are accepted, since the file size limit then applies to the processed image.
+func (s *Server) attachmentInputSizeLimit(vinfo *visitorInfo) int64 {
+	if vinfo.Limits.AttachmentImageProcessing && s.config.AttachmentImageMaxDimension > 0 {
+		return max(vinfo.Limits.AttachmentFileSizeLimit, imageProcessingInputSizeLimit)
+	}
+	return vinfo.Limits.AttachmentFileSizeLimit
+}
+
 func (s *Server) handleSubscribeJSON(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	encoder := func(msg *message) (string, error) {
 		var buf bytes.Buffer
@@ -1235,6 +1729,10 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err != nil {
 		return err
 	}
+	patterns, err := s.topicPatternsFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
 	poll, since, scheduled, filters, err := parseSubscribeParams(r)
 	if err != nil {
 		return err
@@ -1274,7 +1772,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 		for _, t := range topics {
 			t.Keepalive()
 		}
-		return s.sendOldMessages(topics, since, scheduled, v, sub)
+		return s.sendOldMessages(topics, patterns, since, scheduled, v, requestUser(r), sub)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -1287,10 +1785,14 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 			topics[i].Unsubscribe(subscriberID) // Order!
 		}
 	}()
+	if len(patterns) > 0 {
+		patternSub := s.subscribeTopicPatterns(v, requestUser(r), patterns, topics, sub, cancel)
+		defer s.unsubscribeTopicPatterns(patternSub)
+	}
 	if err := sub(v, newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
+	if err := s.sendOldMessages(topics, patterns, since, scheduled, v, requestUser(r), sub); err != nil {
 		return err
 	}
 	for {
@@ -1331,6 +1833,10 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err != nil {
 		return err
 	}
+	patterns, err := s.topicPatternsFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
 	poll, since, scheduled, filters, err := parseSubscribeParams(r)
 	if err != nil {
 		return err
@@ -1425,7 +1931,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 		for _, t := range topics {
 			t.Keepalive()
 		}
-		return s.sendOldMessages(topics, since, scheduled, v, sub)
+		return s.sendOldMessages(topics, patterns, since, scheduled, v, requestUser(r), sub)
 	}
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
@@ -1436,10 +1942,14 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			topics[i].Unsubscribe(subscriberID) // Order!
 		}
 	}()
+	if len(patterns) > 0 {
+		patternSub := s.subscribeTopicPatterns(v, requestUser(r), patterns, topics, sub, cancel)
+		defer s.unsubscribeTopicPatterns(patternSub)
+	}
 	if err := sub(v, newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
+	if err := s.sendOldMessages(topics, patterns, since, scheduled, v, requestUser(r), sub); err != nil {
 		return err
 	}
 	err = g.Wait()
@@ -1508,7 +2018,7 @@ func (s *Server) maybeSetRateVisitors(r *http.Request, v *visitor, topics []*top
 			return err
 		}
 		if ownerUserID == "" {
-			if err := s.userManager.Authorize(v.User(), t.ID, user.PermissionWrite); err == nil {
+			if err := s.userManager.Authorize(requestUser(r), t.ID, user.PermissionWrite); err == nil {
 				writableRateTopics = append(writableRateTopics, t)
 			}
 		} else if ownerUserID == v.MaybeUserID() {
@@ -1530,20 +2040,32 @@ func (s *Server) setRateVisitors(r *http.Request, v *visitor, rateTopics []*topi
 }
 
 // sendOldMessages selects old messages from the messageCache and calls sub for each of them. It uses since as the
-// marker, returning only messages that are newer than the marker.
-func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled bool, v *visitor, sub subscriber) error {
+// marker, returning only messages that are newer than the marker. Messages of all topics matching the given topic
+// patterns are included as well, if the visitor is allowed to read them. Messages are sent in time order.
+func (s *Server) sendOldMessages(topics []*topic, patterns []string, since sinceMarker, scheduled bool, v *visitor, u *user.User, sub subscriber) error {
 	if since.IsNone() {
 		return nil
 	}
-	messages := make([]*message, 0)
+	topicIDs := make([]string, 0)
 	for _, t := range topics {
-		topicMessages, err := s.messageCache.Messages(t.ID, since, scheduled)
+		topicIDs = append(topicIDs, t.ID)
+	}
+	if len(patterns) > 0 {
+		patternTopicIDs, err := s.cachedTopicIDsFromPatterns(u, patterns, topicIDs)
+		if err != nil {
+			return err
+		}
+		topicIDs = append(topicIDs, patternTopicIDs...)
+	}
+	messages := make([]*message, 0)
+	for _, topicID := range topicIDs {
+		topicMessages, err := s.messageCache.Messages(topicID, since, scheduled)
 		if err != nil {
 			return err
 		}
 		messages = append(messages, topicMessages...)
 	}
-	sort.Slice(messages, func(i, j int) bool {
+	sort.SliceStable(messages, func(i, j int) bool {
 		return messages[i].Time < messages[j].Time
 	})
 	for _, m := range messages {
@@ -1601,12 +2123,18 @@ func (s *Server) topicFromPath(path string) (*topic, error) {
 }
 
 // topicsFromPath returns the topic from a root path (e.g. /mytopic,mytopic2), creating it if it doesn't exist.
+// Topic patterns (e.g. alerts-*) are skipped, see topicPatternsFromPath.
 func (s *Server) topicsFromPath(path string) ([]*topic, string, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
 		return nil, "", errHTTPBadRequestTopicInvalid
 	}
-	topicIDs := util.SplitNoEmpty(parts[1], ",")
+	topicIDs := make([]string, 0)
+	for _, id := range util.SplitNoEmpty(parts[1], ",") {
+		if !isTopicPattern(id) {
+			topicIDs = append(topicIDs, id)
+		}
+	}
 	topics, err := s.topicsFromIDs(topicIDs...)
 	if err != nil {
 		return nil, "", errHTTPBadRequestTopicInvalid
@@ -1614,24 +2142,37 @@ func (s *Server) topicsFromPath(path string) ([]*topic, string, error) {
 	return topics, parts[1], nil
 }
 
-// topicsFromIDs returns the topics with the given IDs, creating them if they don't exist.
+// topicsFromIDs returns the topics with the given IDs, creating them if they don't exist. Wildcard subscriptions
+// matching newly created topics are attached to them before the topics are returned.
 func (s *Server) topicsFromIDs(ids ...string) ([]*topic, error) {
+	topics, created, err := s.topicsFromIDsLocked(ids...)
+	if err != nil {
+		return nil, err
+	}
+	if len(created) > 0 {
+		s.attachTopicPatternSubscriptions(created)
+	}
+	return topics, nil
+}
+
+func (s *Server) topicsFromIDsLocked(ids ...string) (topics []*topic, created []*topic, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	topics := make([]*topic, 0)
+	topics, created = make([]*topic, 0), make([]*topic, 0)
 	for _, id := range ids {
 		if util.Contains(s.config.DisallowedTopics, id) {
-			return nil, errHTTPBadRequestTopicDisallowed
+			return nil, nil, errHTTPBadRequestTopicDisallowed
 		}
 		if _, ok := s.topics[id]; !ok {
 			if len(s.topics) >= s.config.TotalTopicLimit {
-				return nil, errHTTPTooManyRequestsLimitTotalTopics
+				return nil, nil, errHTTPTooManyRequestsLimitTotalTopics
 			}
 			s.topics[id] = newTopic(id)
+			created = append(created, s.topics[id])
 		}
 		topics = append(topics, s.topics[id])
 	}
-	return topics, nil
+	return topics, created, nil
 }
 
 // topicFromID returns the topic with the given ID, creating it if it doesn't exist.
@@ -1747,6 +2288,9 @@ func (s *Server) runDelayedSender() {
 	for {
 		select {
 		case <-time.After(s.config.DelayedSenderInterval):
+			if !s.isClusterLeader() {
+				continue
+			}
 			if err := s.sendDelayedMessages(); err != nil {
 				log.Tag(tagPublish).Err(err).Warn("Error sending delayed messages")
 			}
@@ -1791,15 +2335,22 @@ func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 			}
 		}()
 	}
-	if s.firebaseClient != nil { // Firebase subscribers may not show up in topics map
+	s.publishToCluster(v, m, false) // Subscribers of other replicas may not show up in topics map
+	digested := s.maybeEnqueueDigest(v, m, true)
+	if s.firebaseClient != nil && !digested { // Firebase subscribers may not show up in topics map
 		go s.sendToFirebase(v, m)
 	}
-	if s.config.UpstreamBaseURL != "" {
+	if s.config.UpstreamBaseURL != "" && !digested {
 		go s.forwardPollRequest(v, m)
 	}
-	if s.config.WebPushPublicKey != "" {
+	if s.config.WebPushPublicKey != "" && !digested {
 		go s.publishToWebPushEndpoints(v, m)
 	}
+	if s.config.EnableWebhooks && s.userManager != nil {
+		go s.enqueueWebhooks(v, m)
+	}
+	s.enqueueFederationPushes(v, m)
+	s.routeMessage(v, m, true, nil)
 	if err := s.messageCache.MarkPublished(m); err != nil {
 		return err
 	}
@@ -1862,6 +2413,9 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		if m.Call != "" {
 			r.Header.Set("X-Call", m.Call)
 		}
+		if m.Encoding != "" {
+			r.Header.Set("X-Encoding", m.Encoding)
+		}
 		return next(w, r, v)
 	}
 }
@@ -1901,17 +2455,40 @@ func (s *Server) autorizeTopic(next handleFunc, perm user.Permission) handleFunc
 		if err != nil {
 			return err
 		}
-		u := v.User()
-		for _, t := range topics {
-			if err := s.userManager.Authorize(u, t.ID, perm); err != nil {
-				logvr(v, r).With(t).Err(err).Debug("Access to topic %s not authorized", t.ID)
-				return errHTTPForbidden.With(t)
-			}
+		if err := s.authorizeTopics(r, v, topics, perm); err != nil {
+			return err
 		}
 		return next(w, r, v)
 	}
 }
 
+// authorizeTopics checks if the visitor has the given permission on all the given topics.
+// It must only be called if the user manager is configured.
+func (s *Server) authorizeTopics(r *http.Request, v *visitor, topics []*topic, perm user.Permission) error {
+	u := requestUser(r)
+	for _, t := range topics {
+		if err := s.userManager.Authorize(u, t.ID, perm); err != nil {
+			logvr(v, r).With(t).Err(err).Debug("Access to topic %s not authorized", t.ID)
+			return errHTTPForbidden.With(t)
+		}
+	}
+	return nil
+}
+
+// authorizeTokenScope checks if the scope of the token the visitor logged in with allows the request. Tokens that
+// are restricted to publishing, or that have no account access, cannot be used for the account API. Access to
+// topics is checked in user.Manager.Authorize, and access to the admin API in ensureAdmin.
+func (s *Server) authorizeTokenScope(r *http.Request, v *visitor) error {
+	u := requestUser(r)
+	if u == nil || u.TokenScope.AccountAllowed() {
+		return nil
+	} else if r.URL.Path == apiAccountPath || strings.HasPrefix(r.URL.Path, apiAccountPath+"/") {
+		logvr(v, r).Debug("Access to account API not allowed by token scope")
+		return errHTTPForbiddenTokenScope
+	}
+	return nil
+}
+
 // maybeAuthenticate reads the "Authorization" header and will try to authenticate the user
 // if it is set.
 //
@@ -1922,32 +2499,44 @@ func (s *Server) autorizeTopic(next handleFunc, perm user.Permission) handleFunc
 //     or the token (Bearer auth), and read the user from the database
 //
 // This function will ALWAYS return a visitor, even if an error occurs (e.g. unauthorized), so
-// that subsequent logging calls still have a visitor context.
-func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, error) {
+// that subsequent logging calls still have a visitor context. The authenticated user is returned
+// as well (nil if anonymous), see requestUser.
+func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, *user.User, error) {
 	// Read "Authorization" header value, and exit out early if it's not set
 	ip := extractIPAddress(r, s.config.BehindProxy)
 	vip := s.visitor(ip, nil)
 	if s.userManager == nil {
-		return vip, nil
+		return vip, nil, nil
 	}
 	header, err := readAuthHeader(r)
 	if err != nil {
-		return vip, err
+		return vip, nil, err
 	} else if !supportedAuthHeader(header) {
-		return vip, nil
+		return vip, nil, nil
 	}
 	// If we're trying to auth, check the rate limiter first
 	if !vip.AuthAllowed() {
-		return vip, errHTTPTooManyRequestsLimitAuthFailure // Always return visitor, even when error occurs!
+		return vip, nil, errHTTPTooManyRequestsLimitAuthFailure // Always return visitor, even when error occurs!
 	}
 	u, err := s.authenticate(r, header)
 	if err != nil {
 		vip.AuthFailed()
 		logr(r).Err(err).Debug("Authentication failed")
-		return vip, errHTTPUnauthorized // Always return visitor, even when error occurs!
+		if errors.Is(err, errHTTPForbiddenIPNotAllowed) {
+			return vip, nil, err // Credentials are valid, but not from this IP address
+		}
+		return vip, nil, errHTTPUnauthorized // Always return visitor, even when error occurs!
 	}
 	// Authentication with user was successful
-	return s.visitor(ip, u), nil
+	return s.visitor(ip, u), u, nil
+}
+
+// requestUser returns the user the request was authenticated as (nil if anonymous), see maybeAuthenticate.
+// The restrictions of the token used for the request (user.User.TokenScope) must be read from this user, and not
+// from v.User(): Visitors are shared between requests, and the requests of a user may use different credentials.
+func requestUser(r *http.Request) *user.User {
+	u, _ := fromContext[*user.User](r, contextUser)
+	return u
 }
 
 // authenticate a user based on basic auth username/password (Authorization: Basic ...), or token auth (Authorization: Bearer ...).
@@ -1992,22 +2581,48 @@ func (s *Server) authenticateBasicAuth(r *http.Request, value string) (user *use
 	} else if username == "" {
 		return s.authenticateBearerAuth(r, password) // Treat password as token
 	}
-	return s.userManager.Authenticate(username, password)
+	u, err := s.userManager.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	} else if err := s.authorizeIP(r, u); err != nil {
+		return nil, err
+	}
+	return u, nil
 }
 
 func (s *Server) authenticateBearerAuth(r *http.Request, token string) (*user.User, error) {
-	u, err := s.userManager.AuthenticateToken(token)
+	var u *user.User
+	var err error
+	if s.oidc != nil && isJWT(token) {
+		u, err = s.authenticateOIDCToken(token)
+	} else {
+		u, err = s.userManager.AuthenticateToken(token)
+	}
 	if err != nil {
 		return nil, err
+	} else if err := s.authorizeIP(r, u); err != nil {
+		return nil, err
+	}
+	if u.Token != "" {
+		go s.userManager.EnqueueTokenUpdate(token, &user.TokenUpdate{
+			LastAccess: time.Now(),
+			LastOrigin: extractIPAddress(r, s.config.BehindProxy),
+		})
 	}
-	ip := extractIPAddress(r, s.config.BehindProxy)
-	go s.userManager.EnqueueTokenUpdate(token, &user.TokenUpdate{
-		LastAccess: time.Now(),
-		LastOrigin: ip,
-	})
 	return u, nil
 }
 
+// authorizeIP returns errHTTPForbiddenIPNotAllowed if the user, or the token the user logged in with, is
+// restricted to certain IP ranges, and the request does not come from one of them (see user.User.AllowedFrom)
+func (s *Server) authorizeIP(r *http.Request, u *user.User) error {
+	ip := extractIPAddress(r, s.config.BehindProxy)
+	if !u.AllowedFrom(ip) {
+		logr(r).Tag(tagAccount).Debug("Login of user %s not allowed from IP address %s", u.Name, ip.String())
+		return errHTTPForbiddenIPNotAllowed
+	}
+	return nil
+}
+
 func (s *Server) visitor(ip netip.Addr, user *user.User) *visitor {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -56,16 +56,17 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 	limits, stats := info.Limits, info.Stats
 	response := &apiAccountResponse{
 		Limits: &apiAccountLimits{
-			Basis:                    string(limits.Basis),
-			Messages:                 limits.MessageLimit,
-			MessagesExpiryDuration:   int64(limits.MessageExpiryDuration.Seconds()),
-			Emails:                   limits.EmailLimit,
-			Calls:                    limits.CallLimit,
-			Reservations:             limits.ReservationsLimit,
-			AttachmentTotalSize:      limits.AttachmentTotalSizeLimit,
-			AttachmentFileSize:       limits.AttachmentFileSizeLimit,
-			AttachmentExpiryDuration: int64(limits.AttachmentExpiryDuration.Seconds()),
-			AttachmentBandwidth:      limits.AttachmentBandwidthLimit,
+			Basis:                     string(limits.Basis),
+			Messages:                  limits.MessageLimit,
+			MessagesExpiryDuration:    int64(limits.MessageExpiryDuration.Seconds()),
+			Emails:                    limits.EmailLimit,
+			Calls:                     limits.CallLimit,
+			Reservations:              limits.ReservationsLimit,
+			AttachmentTotalSize:       limits.AttachmentTotalSizeLimit,
+			AttachmentFileSize:        limits.AttachmentFileSizeLimit,
+			AttachmentExpiryDuration:  int64(limits.AttachmentExpiryDuration.Seconds()),
+			AttachmentBandwidth:       limits.AttachmentBandwidthLimit,
+			AttachmentImageProcessing: limits.AttachmentImageProcessing,
 		},
 		Stats: &apiAccountStats{
 			Messages:                     stats.Messages,
@@ -127,6 +128,18 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 				}
 			}
 		}
+		if s.config.EnableWebhooks {
+			webhooks, err := s.userManager.Webhooks(u.ID)
+			if err != nil {
+				return err
+			}
+			if len(webhooks) > 0 {
+				response.Webhooks = make([]*apiAccountWebhook, 0)
+				for _, webhook := range webhooks {
+					response.Webhooks = append(response.Webhooks, newAPIAccountWebhook(webhook))
+				}
+			}
+		}
 		tokens, err := s.userManager.Tokens(u.ID)
 		if err != nil {
 			return err
@@ -144,6 +157,8 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 					LastAccess: t.LastAccess.Unix(),
 					LastOrigin: lastOrigin,
 					Expires:    t.Expires.Unix(),
+					Scope:      newAPIAccountTokenScope(t.Scope),
+					AllowedIPs: newAPIAllowedIPs(t.AllowedIPs),
 				})
 			}
 		}
@@ -226,15 +241,28 @@ func (s *Server) handleAccountTokenCreate(w http.ResponseWriter, r *http.Request
 	if req.Expires != nil {
 		expires = time.Unix(*req.Expires, 0)
 	}
-	u := v.User()
+	scope, err := newTokenScope(req.Scope)
+	if err != nil {
+		return errHTTPBadRequestTokenScopeInvalid
+	}
+	allowedIPs, err := user.ParseAllowedIPs(req.AllowedIPs)
+	if err != nil {
+		return errHTTPBadRequestAllowedIPsInvalid
+	}
+	u := requestUser(r)
+	if isRestrictedToken(u) {
+		return errHTTPForbiddenTokenScope // A restricted token must not be able to create a less restricted token
+	}
 	logvr(v, r).
 		Tag(tagAccount).
 		Fields(log.Context{
-			"token_label":   label,
-			"token_expires": expires,
+			"token_label":       label,
+			"token_expires":     expires,
+			"token_scope":       scope.String(),
+			"token_allowed_ips": user.AllowedIPsString(allowedIPs),
 		}).
 		Debug("Creating token for user %s", u.Name)
-	token, err := s.userManager.CreateToken(u.ID, label, expires, v.IP())
+	token, err := s.userManager.CreateScopedToken(u.ID, label, expires, v.IP(), scope, allowedIPs)
 	if err != nil {
 		return err
 	}
@@ -244,12 +272,14 @@ func (s *Server) handleAccountTokenCreate(w http.ResponseWriter, r *http.Request
 		LastAccess: token.LastAccess.Unix(),
 		LastOrigin: token.LastOrigin.String(),
 		Expires:    token.Expires.Unix(),
+		Scope:      newAPIAccountTokenScope(token.Scope),
+		AllowedIPs: newAPIAllowedIPs(token.AllowedIPs),
 	}
 	return s.writeJSON(w, response)
 }
 
 func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	u := v.User()
+	u := requestUser(r)
 	req, err := readJSONWithLimit[apiAccountTokenUpdateRequest](r.Body, jsonBodyBytesLimit, true) // Allow empty body!
 	if err != nil {
 		return err
@@ -258,20 +288,34 @@ func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request
 		if req.Token == "" {
 			return errHTTPBadRequestNoTokenProvided
 		}
+	} else if isRestrictedToken(u) && req.Token != u.Token {
+		return errHTTPForbiddenTokenScope // Restricted tokens can only change themselves
+	}
+	if req.AllowedIPs != nil && isRestrictedToken(u) {
+		return errHTTPForbiddenTokenScope // Restricted tokens cannot lift their own restrictions
 	}
 	var expires *time.Time
 	if req.Expires != nil {
 		expires = util.Time(time.Unix(*req.Expires, 0))
-	} else if req.Label == nil {
-		expires = util.Time(time.Now().Add(tokenExpiryDuration)) // If label/expires not set, extend token by 72 hours
+	} else if req.Label == nil && req.AllowedIPs == nil {
+		expires = util.Time(time.Now().Add(tokenExpiryDuration)) // If label/expires/allowlist not set, extend token by 72 hours
 	}
 	logvr(v, r).
 		Tag(tagAccount).
 		Fields(log.Context{
-			"token_label":   req.Label,
-			"token_expires": expires,
+			"token_label":       req.Label,
+			"token_expires":     expires,
+			"token_allowed_ips": req.AllowedIPs,
 		}).
 		Debug("Updating token for user %s as deleted", u.Name)
+	if req.AllowedIPs != nil {
+		allowedIPs, err := user.ParseAllowedIPs(req.AllowedIPs)
+		if err != nil {
+			return errHTTPBadRequestAllowedIPsInvalid
+		} else if _, err := s.userManager.ChangeTokenAllowedIPs(u.ID, req.Token, allowedIPs); err != nil {
+			return err
+		}
+	}
 	token, err := s.userManager.ChangeToken(u.ID, req.Token, req.Label, expires)
 	if err != nil {
 		return err
@@ -282,18 +326,22 @@ func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request
 		LastAccess: token.LastAccess.Unix(),
 		LastOrigin: token.LastOrigin.String(),
 		Expires:    token.Expires.Unix(),
+		Scope:      newAPIAccountTokenScope(token.Scope),
+		AllowedIPs: newAPIAllowedIPs(token.AllowedIPs),
 	}
 	return s.writeJSON(w, response)
 }
 
 func (s *Server) handleAccountTokenDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	u := v.User()
+	u := requestUser(r)
 	token := readParam(r, "X-Token", "Token") // DELETEs cannot have a body, and we don't want it in the path
 	if token == "" {
 		token = u.Token
 		if token == "" {
 			return errHTTPBadRequestNoTokenProvided
 		}
+	} else if isRestrictedToken(u) && token != u.Token {
+		return errHTTPForbiddenTokenScope // Restricted tokens can only delete themselves
 	}
 	if err := s.userManager.RemoveToken(u.ID, token); err != nil {
 		return err
@@ -305,6 +353,66 @@ func (s *Server) handleAccountTokenDelete(w http.ResponseWriter, r *http.Request
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// isRestrictedToken returns true if the user logged in with a scoped token, or with a token with an IP allowlist.
+// Such tokens cannot be used to create or change other tokens, since those may be less restricted.
+func isRestrictedToken(u *user.User) bool {
+	return u.TokenScope != nil || len(u.TokenAllowedIPs) > 0
+}
+
+// newTokenScope converts the scope of a token request to a user.TokenScope. It returns nil if
+// the scope is nil or empty, i.e. if the token is not restricted.
+func newTokenScope(scope *apiAccountTokenScope) (*user.TokenScope, error) {
+	if scope == nil {
+		return nil, nil
+	}
+	tokenScope := &user.TokenScope{
+		PublishOnly: scope.PublishOnly,
+		NoAccount:   scope.NoAccount,
+	}
+	for _, t := range scope.Topics {
+		if t == nil || !user.AllowedTopicPattern(t.Topic) {
+			return nil, user.ErrInvalidTokenScope
+		}
+		permission, err := user.ParsePermission(t.Permission)
+		if err != nil {
+			return nil, user.ErrInvalidTokenScope
+		}
+		tokenScope.Topics = append(tokenScope.Topics, user.Grant{TopicPattern: t.Topic, Allow: permission})
+	}
+	if len(tokenScope.Topics) == 0 && !tokenScope.PublishOnly && !tokenScope.NoAccount {
+		return nil, nil
+	}
+	return tokenScope, nil
+}
+
+func newAPIAccountTokenScope(scope *user.TokenScope) *apiAccountTokenScope {
+	if scope == nil {
+		return nil
+	}
+	response := &apiAccountTokenScope{
+		PublishOnly: scope.PublishOnly,
+		NoAccount:   scope.NoAccount,
+	}
+	for _, grant := range scope.Topics {
+		response.Topics = append(response.Topics, &apiAccountTokenScopeTopic{
+			Topic:      grant.TopicPattern,
+			Permission: grant.Allow.String(),
+		})
+	}
+	return response
+}
+
+func newAPIAllowedIPs(prefixes []netip.Prefix) []string {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	allowedIPs := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		allowedIPs = append(allowedIPs, prefix.String())
+	}
+	return allowedIPs
+}
+
 func (s *Server) handleAccountSettingsChange(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	newPrefs, err := readJSONWithLimit[user.Prefs](r.Body, jsonBodyBytesLimit, false)
 	if err != nil {
@@ -331,6 +439,14 @@ func (s *Server) handleAccountSettingsChange(w http.ResponseWriter, r *http.Requ
 		if newPrefs.Notification.MinPriority != nil {
 			prefs.Notification.MinPriority = newPrefs.Notification.MinPriority
 		}
+		if newPrefs.Notification.QuietHours != nil {
+			for _, q := range newPrefs.Notification.QuietHours {
+				if q == nil || q.Validate() != nil {
+					return errHTTPBadRequestQuietHoursInvalid
+				}
+			}
+			prefs.Notification.QuietHours = newPrefs.Notification.QuietHours
+		}
 	}
 	logvr(v, r).Tag(tagAccount).Debug("Changing account settings for user %s", u.Name)
 	if err := s.userManager.ChangeSettings(u.ID, prefs); err != nil {
@@ -628,5 +744,6 @@ func (s *Server) publishSyncEvent(v *visitor) error {
 	if err := syncTopic.Publish(v, m); err != nil {
 		return err
 	}
+	s.publishToCluster(v, m, false)
 	return nil
 }
@@ -7,9 +7,11 @@ import (
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
 	"io"
+	"net/http"
 	"net/netip"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -381,6 +383,295 @@ func TestAccount_DeleteToken(t *testing.T) {
 	require.Equal(t, 401, rr.Code)
 }
 
+func TestAccount_CreateToken_Scoped(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "ci-*", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("phil", "alerts", user.PermissionReadWrite))
+
+	body := `{"label":"ci","scope":{"topics":[{"topic":"ci-*","permission":"rw"},{"topic":"ci-results","permission":"wo"}]}}`
+	rr := request(t, s, "POST", "/v1/account/token", body, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(token.Scope.Topics))
+	require.Equal(t, "ci-results", token.Scope.Topics[1].Topic)
+	require.Equal(t, "write-only", token.Scope.Topics[1].Permission)
+
+	// Topics in scope
+	rr = request(t, s, "PUT", "/ci-results", "build passed", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/ci-results/json?poll=1", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "GET", "/ci-builds/json?poll=1", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Topic not in scope, even though the user has access
+	rr = request(t, s, "PUT", "/alerts", "test", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "PUT", "/alerts", "test", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Account API can be used, but scoped tokens cannot create new tokens
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, err := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(account.Tokens))
+	require.Equal(t, "ci-*", account.Tokens[0].Scope.Topics[0].Topic)
+
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+
+	// Invalid scope
+	rr = request(t, s, "POST", "/v1/account/token", `{"scope":{"topics":[{"topic":"ci-*","permission":"rwx"}]}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40065, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestAccount_CreateToken_Scoped_ConcurrentCredentials(t *testing.T) {
+	t.Parallel()
+	conf := newTestConfigWithAuthFile(t)
+	conf.VisitorRequestLimitBurst = 10000
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	// Users with a tier share one visitor for all of their requests, no matter which credentials they use
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "pro",
+		MessageLimit: 10000,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	require.Nil(t, s.userManager.AllowAccess("phil", "*", user.PermissionReadWrite))
+	rr := request(t, s, "POST", "/v1/account/token", `{"scope":{"topics":[{"topic":"ci-*","permission":"rw"}]}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	fullToken, err := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+
+	// A request with the full token updates the shared visitor before a request with the scoped token is authorized
+	newRequest := func(token string) *http.Request {
+		r, err := http.NewRequest("PUT", "/alerts", nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "9.9.9.9"
+		r.Header.Set("Authorization", util.BearerAuth(token))
+		return r
+	}
+	scopedRequest := newRequest(token.Token)
+	v1, u1, err := s.maybeAuthenticate(scopedRequest)
+	require.Nil(t, err)
+	v2, _, err := s.maybeAuthenticate(newRequest(fullToken.Value))
+	require.Nil(t, err)
+	require.Same(t, v1, v2)
+	topics, err := s.topicsFromIDs("alerts")
+	require.Nil(t, err)
+	scopedRequest = withContext(scopedRequest, map[contextKey]any{contextUser: u1})
+	require.NotNil(t, s.authorizeTopics(scopedRequest, v1, topics, user.PermissionWrite))
+
+	// The scope of the token must only apply to the requests made with the token
+	var wg sync.WaitGroup
+	scopedCodes := make(chan int, 400)
+	fullCodes := make(chan int, 400)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				scopedCodes <- request(t, s, "PUT", "/alerts", "test", map[string]string{
+					"Authorization": util.BearerAuth(token.Token),
+				}).Code
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				fullCodes <- request(t, s, "PUT", "/alerts", "test", map[string]string{
+					"Authorization": util.BearerAuth(fullToken.Value),
+				}).Code
+			}
+		}()
+	}
+	wg.Wait()
+	close(scopedCodes)
+	close(fullCodes)
+	for code := range scopedCodes {
+		require.Equal(t, 403, code)
+	}
+	for code := range fullCodes {
+		require.Equal(t, 200, code)
+	}
+}
+
+func TestAccount_CreateToken_PublishOnly_NoAccount(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	rr := request(t, s, "POST", "/v1/account/token", `{"scope":{"publish_only":true}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	publishToken, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.True(t, publishToken.Scope.PublishOnly)
+
+	rr = request(t, s, "POST", "/v1/account/token", `{"scope":{"no_account":true}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	noAccountToken, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+
+	// Publish-only: publishing works, subscribing does not
+	rr = request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BearerAuth(publishToken.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Authorization": util.BearerAuth(publishToken.Token),
+	})
+	require.Equal(t, 403, rr.Code)
+
+	// No account: publishing and subscribing works
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Authorization": util.BearerAuth(noAccountToken.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Neither can use the account API, or the admin API
+	for _, token := range []string{publishToken.Token, noAccountToken.Token} {
+		rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(token),
+		})
+		require.Equal(t, 403, rr.Code)
+		require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+
+		rr = request(t, s, "DELETE", "/v1/account/token", "", map[string]string{
+			"Authorization": util.BearerAuth(token),
+		})
+		require.Equal(t, 403, rr.Code)
+
+		rr = request(t, s, "GET", "/v1/users", "", map[string]string{
+			"Authorization": util.BearerAuth(token),
+		})
+		require.Equal(t, 403, rr.Code)
+		require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+	}
+
+	// Password login can still use both
+	rr = request(t, s, "GET", "/v1/users", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestAccount_Token_AllowedIPs(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	fromInternal := func(r *http.Request) {
+		r.RemoteAddr = "10.1.2.3"
+	}
+
+	rr := request(t, s, "POST", "/v1/account/token", `{"allowed_ips":["10.0.0.0/8"]}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.0/8"}, token.AllowedIPs)
+
+	// Token can only be used from allowed IP range
+	rr = request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40303, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	}, fromInternal)
+	require.Equal(t, 200, rr.Code)
+
+	// Restricted token cannot create other tokens, or lift its own restriction
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	}, fromInternal)
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PATCH", "/v1/account/token", `{"allowed_ips":[]}`, map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	}, fromInternal)
+	require.Equal(t, 403, rr.Code)
+
+	// Password login can lift it
+	rr = request(t, s, "PATCH", "/v1/account/token", fmt.Sprintf(`{"token":"%s","allowed_ips":["300.0.0.0/8"]}`, token.Token), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40066, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PATCH", "/v1/account/token", fmt.Sprintf(`{"token":"%s","allowed_ips":[]}`, token.Token), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	updatedToken, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Nil(t, updatedToken.AllowedIPs)
+	require.Equal(t, token.Expires, updatedToken.Expires)
+	rr = request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// User allowlist applies to password and token logins
+	require.Nil(t, s.userManager.ChangeAllowedIPs("phil", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}))
+	rr = request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40303, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}, fromInternal)
+	require.Equal(t, 200, rr.Code)
+}
+
 func TestAccount_Delete_Success(t *testing.T) {
 	conf := newTestConfigWithAuthFile(t)
 	conf.EnableSignup = true
@@ -132,6 +132,193 @@ func (s *Server) handleAccessReset(w http.ResponseWriter, r *http.Request, v *vi
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+func (s *Server) handleGroupsGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	groups, err := s.userManager.Groups()
+	if err != nil {
+		return err
+	}
+	grants, err := s.userManager.AllGroupGrants()
+	if err != nil {
+		return err
+	}
+	groupsResponse := make([]*apiGroupResponse, len(groups))
+	for i, g := range groups {
+		groupGrants := make([]*apiUserGrantResponse, len(grants[g.Name]))
+		for i, grant := range grants[g.Name] {
+			groupGrants[i] = &apiUserGrantResponse{
+				Topic:      grant.TopicPattern,
+				Permission: grant.Allow.String(),
+			}
+		}
+		groupsResponse[i] = &apiGroupResponse{
+			Name:    g.Name,
+			Members: g.Members,
+			Grants:  groupGrants,
+		}
+	}
+	return s.writeJSON(w, groupsResponse)
+}
+
+func (s *Server) handleGroupsAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupAddRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !user.AllowedGroup(req.Name) {
+		return errHTTPBadRequestGroupInvalid
+	}
+	for _, username := range req.Members {
+		if _, err := s.userManager.User(username); errors.Is(err, user.ErrUserNotFound) {
+			return errHTTPBadRequestUserNotFound
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := s.userManager.AddGroup(req.Name); errors.Is(err, user.ErrGroupExists) {
+		return errHTTPConflictGroupExists
+	} else if err != nil {
+		return err
+	}
+	for _, username := range req.Members {
+		if err := s.userManager.AddGroupMember(req.Name, username); err != nil {
+			return err
+		}
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupsDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupDeleteRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	group, err := s.userManager.Group(req.Name)
+	if errors.Is(err, user.ErrGroupNotFound) {
+		return errHTTPNotFoundGroup
+	} else if err != nil {
+		return err
+	}
+	grants, err := s.userManager.Grants(user.GroupPrefix + group.Name)
+	if err != nil {
+		return err
+	}
+	if err := s.userManager.RemoveGroup(group.Name); err != nil {
+		return err
+	}
+	for _, grant := range grants {
+		if err := s.killGroupSubscribers(group, grant.TopicPattern); err != nil {
+			return err
+		}
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupMembersAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupMemberRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	if err := s.userManager.AddGroupMember(req.Group, req.Username); errors.Is(err, user.ErrGroupNotFound) {
+		return errHTTPNotFoundGroup
+	} else if errors.Is(err, user.ErrUserNotFound) || errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupMembersDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupMemberRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	u, err := s.userManager.User(req.Username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := s.userManager.RemoveGroupMember(req.Group, req.Username); errors.Is(err, user.ErrGroupNotFound) || errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPNotFoundGroup
+	} else if err != nil {
+		return err
+	}
+	grants, err := s.userManager.Grants(user.GroupPrefix + req.Group)
+	if err != nil {
+		return err
+	}
+	for _, grant := range grants {
+		if err := s.killUserSubscriber(u, grant.TopicPattern); err != nil {
+			return err
+		}
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupAccessAllow(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupAccessAllowRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !user.AllowedGroup(req.Group) {
+		return errHTTPBadRequestGroupInvalid
+	}
+	permission, err := user.ParsePermission(req.Permission)
+	if err != nil {
+		return errHTTPBadRequestPermissionInvalid
+	}
+	if err := s.userManager.AllowAccess(user.GroupPrefix+req.Group, req.Topic, permission); errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestTopicInvalid
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleGroupAccessReset(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiGroupAccessResetRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !user.AllowedGroup(req.Group) {
+		return errHTTPBadRequestGroupInvalid
+	}
+	if err := s.userManager.ResetAccess(user.GroupPrefix+req.Group, req.Topic); errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestTopicInvalid
+	} else if err != nil {
+		return err
+	}
+	group, err := s.userManager.Group(req.Group)
+	if errors.Is(err, user.ErrGroupNotFound) {
+		return s.writeJSON(w, newSuccessResponse()) // Directory group, members are unknown
+	} else if err != nil {
+		return err
+	}
+	topicPattern := req.Topic
+	if topicPattern == "" {
+		topicPattern = "*"
+	}
+	if err := s.killGroupSubscribers(group, topicPattern); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// killGroupSubscribers cancels the subscriptions of all members of the group to topics matching the pattern,
+// so that they have to re-subscribe, and their access is checked again
+func (s *Server) killGroupSubscribers(group *user.Group, topicPattern string) error {
+	for _, username := range group.Members {
+		u, err := s.userManager.User(username)
+		if errors.Is(err, user.ErrUserNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := s.killUserSubscriber(u, topicPattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Server) killUserSubscriber(u *user.User, topicPattern string) error {
 	topics, err := s.topicsFromPattern(topicPattern)
 	if err != nil {
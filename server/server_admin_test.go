@@ -4,6 +4,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"io"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -179,3 +180,99 @@ func TestAccess_AllowReset_KillConnection(t *testing.T) {
 		return timeTaken.Load() >= 500
 	})
 }
+
+func TestGroups_AdminAPI(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("emma", "emma", user.RoleUser))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	ben := map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}
+
+	// Create group, add member, grant access
+	rr := request(t, s, "POST", "/v1/groups", `{"name":"oncall","members":["ben"]}`, admin)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/v1/groups/members", `{"group":"oncall","username":"emma"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/v1/groups/access", `{"group":"oncall","topic":"alerts*","permission":"read-write"}`, admin)
+	require.Equal(t, 200, rr.Code)
+
+	// List groups
+	rr = request(t, s, "GET", "/v1/groups", "", admin)
+	require.Equal(t, 200, rr.Code)
+	groups, err := util.UnmarshalJSON[[]*apiGroupResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(*groups))
+	require.Equal(t, "oncall", (*groups)[0].Name)
+	require.Equal(t, []string{"ben", "emma"}, (*groups)[0].Members)
+	require.Equal(t, "alerts*", (*groups)[0].Grants[0].Topic)
+	require.Equal(t, "read-write", (*groups)[0].Grants[0].Permission)
+
+	// Members have access, regular users cannot manage groups
+	rr = request(t, s, "PUT", "/alerts-db", "hi", ben)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/groups", "", ben)
+	require.Equal(t, 401, rr.Code)
+
+	// Remove member
+	rr = request(t, s, "DELETE", "/v1/groups/members", `{"group":"oncall","username":"ben"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/alerts-db", "hi", ben)
+	require.Equal(t, 403, rr.Code)
+
+	// Reset access, delete group
+	rr = request(t, s, "DELETE", "/v1/groups/access", `{"group":"oncall","topic":"alerts*"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/alerts-db", "hi", map[string]string{
+		"Authorization": util.BasicAuth("emma", "emma"),
+	})
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "DELETE", "/v1/groups", `{"name":"oncall"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "DELETE", "/v1/groups", `{"name":"oncall"}`, admin)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, 40407, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestGroups_AdminAPI_Failures(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddGroup("oncall"))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	rr := request(t, s, "POST", "/v1/groups", `{"name":"oncall"}`, admin)
+	require.Equal(t, 409, rr.Code)
+	require.Equal(t, 40906, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/groups", `{"name":"a,b"}`, admin)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40064, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/groups", `{"name":"ops","members":["nobody"]}`, admin)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40031, toHTTPError(t, rr.Body.String()).Code)
+	_, err := s.userManager.Group("ops")
+	require.Equal(t, user.ErrGroupNotFound, err)
+
+	rr = request(t, s, "PUT", "/v1/groups/members", `{"group":"ops","username":"phil"}`, admin)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, 40407, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "PUT", "/v1/groups/members", `{"group":"oncall","username":"nobody"}`, admin)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40031, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "PUT", "/v1/groups/access", `{"group":"oncall","topic":"alerts","permission":"everything"}`, admin)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40025, toHTTPError(t, rr.Body.String()).Code)
+}
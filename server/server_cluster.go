@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"net/netip"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+const (
+	clusterMessagesChannel    = "ntfy:messages"
+	clusterLeaderLeaseKey     = "ntfy:leader"
+	clusterLeaseDuration      = 15 * time.Second // Another replica becomes leader if the lease is not renewed in time, e.g. if the leader crashed
+	clusterLeaseRenewInterval = 5 * time.Second
+	clusterNodeIDLength       = 12
+)
+
+// clusterMessage is sent over the cluster bus to deliver a message to the subscribers of the other replicas
+type clusterMessage struct {
+	Node    string   `json:"node"`              // ID of the replica the message was published on
+	Sender  string   `json:"sender,omitempty"`  // IP address of the publisher, see message.Sender
+	User    string   `json:"user,omitempty"`    // User ID of the publisher, see message.User
+	Visitor string   `json:"visitor,omitempty"` // Visitor ID of the publisher, only set if the message counts against its limits
+	Message *message `json:"message"`
+}
+
+// publishToCluster broadcasts the message to the other replicas of the cluster, which deliver it to their
+// own subscribers. If limited is true, the message counts against the visitor's limits on the other replicas.
+// This is a no-op if cluster mode is disabled.
+func (s *Server) publishToCluster(v *visitor, m *message, limited bool) {
+	if s.clusterBus == nil {
+		return
+	}
+	cm := &clusterMessage{
+		Node:    s.clusterNode,
+		User:    m.User,
+		Message: m,
+	}
+	if m.Sender.IsValid() {
+		cm.Sender = m.Sender.String()
+	}
+	if limited {
+		cm.Visitor = visitorID(v.IP(), v.User())
+	}
+	payload, err := json.Marshal(cm)
+	if err != nil {
+		logvm(v, m).Tag(tagCluster).Err(err).Warn("Unable to encode message for cluster")
+		return
+	}
+	if err := s.clusterBus.Publish(clusterMessagesChannel, payload); err != nil {
+		logvm(v, m).Tag(tagCluster).Err(err).Warn("Unable to publish message to cluster")
+		return
+	}
+	logvm(v, m).Tag(tagCluster).Trace("Published message to cluster")
+	minc(metricClusterMessagesPublished)
+}
+
+// receiveClusterMessage delivers a message that was published on another replica to the subscribers of this
+// replica. The message is not cached, and not sent to any other transports, since the publishing replica does that.
+func (s *Server) receiveClusterMessage(payload []byte) {
+	var cm clusterMessage
+	if err := json.Unmarshal(payload, &cm); err != nil {
+		log.Tag(tagCluster).Err(err).Warn("Unable to decode cluster message")
+		return
+	} else if cm.Node == s.clusterNode || cm.Message == nil {
+		return
+	}
+	m := cm.Message
+	m.Sender, _ = netip.ParseAddr(cm.Sender) // Invalid address if empty
+	m.User = cm.User
+	v := s.clusterVisitor(&cm)
+	// The topic is created if it does not exist, so that wildcard subscriptions are attached to it, and
+	// so that the global topic limit applies to all topics in the cluster
+	t, err := s.topicFromID(m.Topic)
+	if err != nil {
+		logvm(v, m).Tag(tagCluster).Err(err).Debug("Unable to deliver cluster message")
+		return
+	}
+	logvm(v, m).Tag(tagCluster).Trace("Received message from cluster")
+	if err := t.Publish(v, m); err != nil {
+		logvm(v, m).Tag(tagCluster).Err(err).Warn("Unable to publish cluster message")
+		return
+	}
+	minc(metricClusterMessagesReceived)
+}
+
+// clusterVisitor returns the visitor that published the cluster message. If the message counts against
+// the visitor's limits, and the visitor is known to this replica, the message is counted against its limits
+// here as well, so that rate limits apply (roughly) across the cluster. Otherwise, a temporary visitor is returned.
+func (s *Server) clusterVisitor(cm *clusterMessage) *visitor {
+	if cm.Visitor != "" {
+		s.mu.RLock()
+		v, ok := s.visitors[cm.Visitor]
+		s.mu.RUnlock()
+		if ok {
+			v.CountRemoteMessage()
+			return v
+		}
+	}
+	return newVisitor(s.config, s.messageCache, s.userManager, cm.Message.Sender, nil)
+}
+
+// runClusterLeaderElection periodically acquires or renews the cluster leader lease. Background tasks that must
+// not run more than once in the cluster (sending delayed messages, escalations and webhooks, and mirroring
+// federation peers) only run on the leader, see isClusterLeader.
+func (s *Server) runClusterLeaderElection() {
+	if s.clusterBus == nil {
+		return
+	}
+	for {
+		s.updateClusterLeader()
+		select {
+		case <-time.After(clusterLeaseRenewInterval):
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+func (s *Server) updateClusterLeader() {
+	leader, err := s.clusterBus.Lease(clusterLeaderLeaseKey, s.clusterNode, clusterLeaseDuration)
+	if err != nil {
+		log.Tag(tagCluster).Err(err).Warn("Unable to acquire or renew cluster leader lease")
+		leader = false
+	}
+	s.mu.Lock()
+	changed := s.clusterLeader != leader
+	s.clusterLeader = leader
+	s.mu.Unlock()
+	if leader {
+		mset(metricClusterLeader, 1)
+	} else {
+		mset(metricClusterLeader, 0)
+	}
+	if changed && leader {
+		log.Tag(tagCluster).Field("cluster_node", s.clusterNode).Info("This server is now the cluster leader")
+	} else if changed {
+		log.Tag(tagCluster).Field("cluster_node", s.clusterNode).Info("This server is no longer the cluster leader")
+	}
+}
+
+// isClusterLeader returns true if this server is the cluster leader, or if cluster mode is disabled
+func (s *Server) isClusterLeader() bool {
+	if s.clusterBus == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clusterLeader
+}
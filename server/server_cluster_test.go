@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_Cluster_PublishSubscribe(t *testing.T) {
+	s1, s2 := newTestClusterServers(t)
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s2, "/mytopic/json", subscribeRR)
+
+	response := request(t, s1, "PUT", "/mytopic", "from replica 1", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	request(t, s1, "PUT", "/othertopic", "other topic", nil)
+	time.Sleep(200 * time.Millisecond)
+	subscribeCancel()
+
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, m.ID, messages[1].ID)
+	require.Equal(t, "from replica 1", messages[1].Message)
+
+	// Topics of other replicas count towards the topic limit
+	s2.mu.RLock()
+	_, ok := s2.topics["othertopic"]
+	s2.mu.RUnlock()
+	require.True(t, ok)
+}
+
+func TestServer_Cluster_WildcardSubscription(t *testing.T) {
+	c1, c2 := newTestClusterConfigs(t)
+	c2.EnableWildcardSubscriptions = true
+	s1, s2 := newTestServer(t, c1), newTestServer(t, c2)
+	defer s1.clusterBus.Close()
+	defer s2.clusterBus.Close()
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s2, "/alerts-*/json", subscribeRR)
+	request(t, s1, "PUT", "/alerts-db", "new topic on replica 1", nil)
+	time.Sleep(200 * time.Millisecond)
+	subscribeCancel()
+
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "alerts-db", messages[1].Topic)
+	require.Equal(t, "new topic on replica 1", messages[1].Message)
+}
+
+func TestServer_Cluster_RateLimits(t *testing.T) {
+	c1, c2 := newTestClusterConfigs(t)
+	for _, c := range []*Config{c1, c2} {
+		c.VisitorRequestLimitBurst = 3
+		c.VisitorRequestLimitReplenish = time.Hour
+	}
+	s1, s2 := newTestServer(t, c1), newTestServer(t, c2)
+	defer s1.clusterBus.Close()
+	defer s2.clusterBus.Close()
+
+	// Messages published on other replicas count against the visitor's limits
+	require.Equal(t, 200, request(t, s2, "PUT", "/mytopic", "replica 2", nil).Code)
+	require.Equal(t, 200, request(t, s1, "PUT", "/mytopic", "replica 1", nil).Code)
+	require.Equal(t, 200, request(t, s1, "PUT", "/mytopic", "replica 1", nil).Code)
+	response := request(t, s2, "PUT", "/mytopic", "replica 2", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42901, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Cluster_Leader(t *testing.T) {
+	s1, s2 := newTestClusterServers(t)
+	require.True(t, newTestServer(t, newTestConfig(t)).isClusterLeader()) // Cluster mode disabled
+	require.False(t, s1.isClusterLeader())
+	require.False(t, s2.isClusterLeader())
+
+	s1.updateClusterLeader()
+	s2.updateClusterLeader()
+	require.True(t, s1.isClusterLeader())
+	require.False(t, s2.isClusterLeader())
+
+	s1.updateClusterLeader() // Renewed
+	s2.updateClusterLeader()
+	require.True(t, s1.isClusterLeader())
+	require.False(t, s2.isClusterLeader())
+}
+
+func TestServer_Cluster_DelayedMessage(t *testing.T) {
+	s1, s2 := newTestClusterServers(t)
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s2, "/mytopic/json", subscribeRR)
+
+	// Delayed messages are delivered to other replicas, even if the topic has no local subscribers
+	response := request(t, s1, "PUT", "/mytopic", "delayed", map[string]string{
+		"Delay": "10s",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	m.Time = time.Now().Unix()
+	require.Nil(t, s1.sendDelayedMessage(s1.visitor(m.Sender, nil), m))
+	time.Sleep(200 * time.Millisecond)
+	subscribeCancel()
+
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, m.ID, messages[1].ID)
+	require.Equal(t, "delayed", messages[1].Message)
+}
+
+func newTestClusterServers(t *testing.T) (*Server, *Server) {
+	c1, c2 := newTestClusterConfigs(t)
+	s1, s2 := newTestServer(t, c1), newTestServer(t, c2)
+	t.Cleanup(func() {
+		s1.clusterBus.Close()
+		s2.clusterBus.Close()
+	})
+	return s1, s2
+}
+
+func newTestClusterConfigs(t *testing.T) (*Config, *Config) {
+	c1, c2 := newTestConfig(t), newTestConfig(t)
+	c1.ClusterURL = "memory://" + util.RandomString(10)
+	c2.ClusterURL = c1.ClusterURL
+	return c1, c2
+}
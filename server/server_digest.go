@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	digestMaxPriority   = 3  // Messages with a higher priority are never added to a digest
+	digestMaxLines      = 5  // Number of messages listed in the digest message, others are summarized
+	digestMaxLineLength = 80 // Max. number of characters per listed message
+)
+
+// digestEntry is a message that is held back from the push transports (Firebase, Web Push, upstream server),
+// until it is sent as part of a digest message, see runDigestSender
+type digestEntry struct {
+	v        *visitor
+	m        *message
+	firebase bool // Message may be sent to Firebase (X-Firebase header)
+}
+
+// newTopicPatternsRegex converts topic patterns (e.g. the digest topics) to a single regex, or returns nil if
+// there are none. Patterns may contain '*' wildcards, matching zero or more characters.
+func newTopicPatternsRegex(patterns []string) *regexp.Regexp {
+	if len(patterns) == 0 {
+		return nil
+	}
+	expressions := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		expressions[i] = strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+	}
+	return regexp.MustCompile(fmt.Sprintf("^(%s)$", strings.Join(expressions, "|")))
+}
+
+// maybeEnqueueDigest adds the message to the digest queue if its topic is a digest topic. If it returns
+// true, the message must not be sent to the push transports, since this is done by the digest sender.
+// Streaming subscribers and the message cache are not affected. UnifiedPush messages must not be passed here.
+func (s *Server) maybeEnqueueDigest(v *visitor, m *message, firebase bool) bool {
+	if s.digestQueue == nil || m.Event != messageEvent || m.Priority > digestMaxPriority || !s.digestTopicsRegex.MatchString(m.Topic) {
+		return false
+	}
+	logvm(v, m).Tag(tagPublish).Debug("Adding message to digest")
+	s.digestQueue.Enqueue(&digestEntry{
+		v:        v,
+		m:        m,
+		firebase: firebase,
+	})
+	return true
+}
+
+// runDigestSender sends one digest message per topic to the push transports whenever the
+// digest window elapses. It runs for the lifetime of the digest queue.
+func (s *Server) runDigestSender() {
+	for entries := range s.digestQueue.Dequeue() {
+		topics := make([]string, 0)
+		byTopic := make(map[string][]*digestEntry)
+		for _, entry := range entries {
+			if _, ok := byTopic[entry.m.Topic]; !ok {
+				topics = append(topics, entry.m.Topic)
+			}
+			byTopic[entry.m.Topic] = append(byTopic[entry.m.Topic], entry)
+		}
+		for _, topic := range topics {
+			s.sendDigest(byTopic[topic])
+		}
+	}
+}
+
+func (s *Server) sendDigest(entries []*digestEntry) {
+	last := entries[len(entries)-1]
+	m := last.m
+	firebase := false
+	for _, entry := range entries {
+		firebase = firebase || entry.firebase
+	}
+	if len(entries) > 1 {
+		messages := make([]*message, len(entries))
+		for i, entry := range entries {
+			messages[i] = entry.m
+		}
+		m = newDigestMessage(messages)
+	}
+	logvm(last.v, m).Tag(tagPublish).Debug("Sending digest of %d message(s)", len(entries))
+	if s.firebaseClient != nil && firebase {
+		go s.sendToFirebase(last.v, m)
+	}
+	if s.config.UpstreamBaseURL != "" {
+		go s.forwardPollRequest(last.v, last.m) // Poll request must refer to a cached message
+	}
+	if s.config.WebPushPublicKey != "" {
+		go s.publishToWebPushEndpoints(last.v, m)
+	}
+}
+
+// newDigestMessage creates a message summarizing the given messages. It lists the first few messages,
+// and has the highest priority of all messages. The message is only sent to push transports, and not cached.
+func newDigestMessage(messages []*message) *message {
+	last := messages[len(messages)-1]
+	m := newDefaultMessage(last.Topic, "")
+	m.Expires = last.Expires
+	m.Title = fmt.Sprintf("%d new messages", len(messages))
+	lines := make([]string, 0)
+	for i, dm := range messages {
+		if i == digestMaxLines {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(messages)-i))
+			break
+		}
+		lines = append(lines, "- "+digestLine(dm))
+	}
+	for _, dm := range messages {
+		m.Priority = util.Max(m.Priority, dm.Priority)
+	}
+	m.Message = strings.Join(lines, "\n")
+	return m
+}
+
+func digestLine(m *message) string {
+	line := m.Message
+	if m.Encoding == encodingJWE {
+		line = "(encrypted message)"
+	} else if m.Encoding != "" {
+		line = "(binary message)"
+	} else if m.Title != "" {
+		line = m.Title
+	}
+	line = strings.Join(strings.Fields(line), " ")
+	if runes := []rune(line); len(runes) > digestMaxLineLength {
+		line = string(runes[:digestMaxLineLength-3]) + "..."
+	}
+	return line
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Digest_PublishWithFirebase(t *testing.T) {
+	sender := newTestFirebaseSender(10)
+	c := newTestConfig(t)
+	c.DigestTopics = []string{"backups", "ci-*"}
+	c.DigestWindow = 500 * time.Millisecond
+	s := newTestServer(t, c)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+
+	request(t, s, "PUT", "/ci-build", "build 1 succeeded", nil)
+	request(t, s, "PUT", "/ci-build", "build 2 succeeded", map[string]string{"Title": "Build 2"})
+	request(t, s, "PUT", "/ci-build", "build 3 failed", map[string]string{"Priority": "high"})
+	request(t, s, "PUT", "/backups", "backup done", map[string]string{"Priority": "low"})
+	request(t, s, "PUT", "/mytopic", "not a digest topic", nil)
+
+	// High priority messages and other topics are sent right away
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 2, len(sender.Messages()))
+	require.Equal(t, "build 3 failed", sender.Messages()[0].Data["message"])
+	require.Equal(t, "not a digest topic", sender.Messages()[1].Data["message"])
+
+	// All messages are in the cache
+	response := request(t, s, "GET", "/ci-build/json?poll=1", "", nil)
+	require.Equal(t, 3, len(toMessages(t, response.Body.String())))
+
+	// Digest is sent after the window, a single message is sent as-is
+	time.Sleep(time.Second)
+	messages := sender.Messages()
+	require.Equal(t, 4, len(messages))
+	digests := map[string]map[string]string{
+		messages[2].Topic: messages[2].Data,
+		messages[3].Topic: messages[3].Data,
+	}
+	require.Equal(t, "2 new messages", digests["ci-build"]["title"])
+	require.Equal(t, "- build 1 succeeded\n- Build 2", digests["ci-build"]["message"])
+	require.Equal(t, "", digests["backups"]["title"])
+	require.Equal(t, "backup done", digests["backups"]["message"])
+	require.Equal(t, "2", digests["backups"]["priority"])
+}
+
+func TestServer_Digest_NewDigestMessage(t *testing.T) {
+	messages := make([]*message, 0)
+	for i := 1; i <= 8; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Priority = i % 4
+		messages = append(messages, m)
+	}
+	messages[1].Encoding = encodingBase64
+	messages[2].Message = "this is a very long\nmessage that spans multiple lines and will be truncated because it is longer than 80 characters"
+
+	m := newDigestMessage(messages)
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, "8 new messages", m.Title)
+	require.Equal(t, 3, m.Priority)
+	require.Equal(t, `- message 1
+- (binary message)
+- this is a very long message that spans multiple lines and will be truncated b...
+- message 4
+- message 5
+... and 3 more`, m.Message)
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	escalationTokenLength = 32
+	escalationAckLabel    = "Acknowledge" // Label of the "ack" action, if it is added automatically
+)
+
+// maybePrepareEscalation returns a new escalation if an escalation policy matches the message's topic, or nil otherwise.
+// It also sets the URL of the message's "ack" action, so that subscribers can stop the escalation. If the message has no
+// "ack" action, one is added (unless the max. number of actions is reached). The escalation must be stored after the
+// message was added to the cache. Since the escalation state is kept in the message cache, the cache must be enabled.
+func (s *Server) maybePrepareEscalation(v *visitor, m *message) *escalation {
+	if s.userManager == nil || s.messageCache.nop || m.Event != messageEvent {
+		return nil
+	}
+	policies, err := s.userManager.EscalationPoliciesForTopic(m.Topic)
+	if err != nil {
+		logvm(v, m).Tag(tagEscalation).Err(err).Warn("Unable to retrieve escalation policies")
+		return nil
+	} else if len(policies) == 0 {
+		return nil
+	}
+	policy := policies[0] // If multiple policies match, the first one wins
+	e := &escalation{
+		MessageID: m.ID,
+		PolicyID:  policy.ID,
+		Token:     util.RandomSecretString(escalationTokenLength),
+		Step:      0,
+		Next:      time.Unix(m.Time, 0).Add(policy.Steps[0].Delay).Unix(),
+	}
+	ackURL := fmt.Sprintf("%s/%s/%s/ack?token=%s", s.config.BaseURL, m.Topic, m.ID, e.Token)
+	found := false
+	for _, a := range m.Actions {
+		if a.Action == actionAck {
+			a.URL = ackURL
+			a.Method = http.MethodPost
+			found = true
+		}
+	}
+	if !found && len(m.Actions) < actionsMax {
+		a := newAction()
+		a.ID = util.RandomString(actionIDLength)
+		a.Action = actionAck
+		a.Label = escalationAckLabel
+		a.URL = ackURL
+		a.Method = http.MethodPost
+		m.Actions = append(m.Actions, a)
+	} else if !found {
+		logvm(v, m).Tag(tagEscalation).Debug("Not adding ack action to message, max. number of actions reached")
+	}
+	return e
+}
+
+// handleMessageAck acknowledges a message, and thereby stops its escalation. The request is authorized by the
+// escalation token in the ack URL, so that anyone who received the message can acknowledge it.
+func (s *Server) handleMessageAck(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := ackPathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	e, err := s.messageCache.Escalation(matches[1])
+	if errors.Is(err, errEscalationNotFound) {
+		return errHTTPNotFoundEscalation
+	} else if err != nil {
+		return err
+	}
+	m, err := s.messageCache.Message(e.MessageID)
+	if errors.Is(err, errMessageNotFound) {
+		return errHTTPNotFoundEscalation
+	} else if err != nil {
+		return err
+	}
+	token := readParam(r, "x-token", "token")
+	if r.URL.Path != fmt.Sprintf("/%s/%s/ack", m.Topic, m.ID) || subtle.ConstantTimeCompare([]byte(token), []byte(e.Token)) != 1 {
+		return errHTTPNotFoundEscalation
+	}
+	logvrm(v, r, m).Tag(tagEscalation).Field("escalation_policy_id", e.PolicyID).Info("Message acknowledged, stopping escalation")
+	if err := s.messageCache.RemoveEscalation(e.MessageID); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// runEscalationSender periodically executes the escalation steps that are due, see sendEscalations
+func (s *Server) runEscalationSender() {
+	if s.userManager == nil {
+		return
+	}
+	for {
+		select {
+		case <-time.After(s.config.EscalationSenderInterval):
+			if !s.isClusterLeader() {
+				continue
+			}
+			if err := s.sendEscalations(); err != nil {
+				log.Tag(tagEscalation).Err(err).Warn("Error sending escalations")
+			}
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+func (s *Server) sendEscalations() error {
+	escalations, err := s.messageCache.EscalationsDue()
+	if err != nil {
+		return err
+	}
+	for _, e := range escalations {
+		if err := s.sendEscalation(e); err != nil {
+			log.Tag(tagEscalation).Field("message_id", e.MessageID).Err(err).Warn("Error sending escalation")
+		}
+	}
+	return nil
+}
+
+// sendEscalation executes the current step of the escalation, and advances it to the next step. The escalation
+// is removed after the last step, or if the message or the escalation policy no longer exist.
+func (s *Server) sendEscalation(e *escalation) error {
+	m, err := s.messageCache.Message(e.MessageID)
+	if errors.Is(err, errMessageNotFound) {
+		return s.messageCache.RemoveEscalation(e.MessageID)
+	} else if err != nil {
+		return err
+	}
+	policy, err := s.userManager.EscalationPolicy(e.PolicyID)
+	if errors.Is(err, user.ErrEscalationPolicyNotFound) {
+		return s.messageCache.RemoveEscalation(e.MessageID)
+	} else if err != nil {
+		return err
+	} else if e.Step >= len(policy.Steps) {
+		return s.messageCache.RemoveEscalation(e.MessageID)
+	}
+	var u *user.User
+	if m.User != "" {
+		u, err = s.userManager.UserByID(m.User)
+		if err != nil {
+			return err
+		}
+	}
+	v := s.visitor(m.Sender, u)
+	step := policy.Steps[e.Step]
+	logvm(v, m).
+		Tag(tagEscalation).
+		Fields(log.Context{
+			"escalation_policy_id": policy.ID,
+			"escalation_step":      e.Step,
+			"escalation_type":      step.Type,
+		}).
+		Debug("Escalating message to %s", step.Target)
+	s.sendEscalationStep(v, m, step)
+	e.Step++
+	if e.Step >= len(policy.Steps) {
+		return s.messageCache.RemoveEscalation(e.MessageID)
+	}
+	e.Next = time.Now().Add(policy.Steps[e.Step].Delay).Unix()
+	return s.messageCache.UpdateEscalation(e)
+}
+
+func (s *Server) sendEscalationStep(v *visitor, m *message, step *user.EscalationStep) {
+	switch step.Type {
+	case user.EscalationCall:
+		if s.config.TwilioAccount == "" {
+			logvm(v, m).Tag(tagEscalation).Warn("Cannot escalate message via phone call, Twilio is not configured")
+			return
+		}
+		go s.callPhone(v, m, step.Target)
+	case user.EscalationEmail:
+		if s.smtpSender == nil {
+			logvm(v, m).Tag(tagEscalation).Warn("Cannot escalate message via e-mail, SMTP is not configured")
+			return
+		}
+		go s.sendEmail(v, m, step.Target)
+	case user.EscalationPublish:
+		escalated, err := newRoutedMessage(&user.Rule{Target: step.Target}, m)
+		if err != nil {
+			logvm(v, m).Tag(tagEscalation).Err(err).Warn("Unable to escalate message to topic %s", step.Target)
+			return
+		}
+		if err := s.publishRoutedMessage(v, escalated, true); err != nil {
+			logvm(v, m).Tag(tagEscalation).Err(err).Warn("Unable to escalate message to topic %s", step.Target)
+		}
+	}
+}
+
+func (s *Server) handleEscalationPoliciesGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	policies, err := s.userManager.EscalationPolicies()
+	if err != nil {
+		return err
+	}
+	response := make([]*apiEscalationPolicyResponse, len(policies))
+	for i, policy := range policies {
+		response[i] = newAPIEscalationPolicyResponse(policy)
+	}
+	return s.writeJSON(w, response)
+}
+
+func (s *Server) handleEscalationPoliciesAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiEscalationPolicyAddRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	policy := &user.EscalationPolicy{
+		Topic: req.Topic,
+		Steps: make([]*user.EscalationStep, len(req.Steps)),
+	}
+	for i, step := range req.Steps {
+		if step == nil {
+			return errHTTPBadRequestEscalationInvalid
+		}
+		delay := time.Duration(0)
+		if step.Delay != "" {
+			delay, err = util.ParseDuration(step.Delay)
+			if err != nil {
+				return errHTTPBadRequestEscalationInvalid.Wrap("invalid delay %s", step.Delay)
+			}
+		}
+		policy.Steps[i] = &user.EscalationStep{
+			Delay:  delay,
+			Type:   step.Type,
+			Target: step.Target,
+		}
+	}
+	logvr(v, r).
+		Tag(tagEscalation).
+		Fields(log.Context{
+			"escalation_topic": policy.Topic,
+			"escalation_steps": len(policy.Steps),
+		}).
+		Debug("Adding escalation policy")
+	if err := s.userManager.AddEscalationPolicy(policy); errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestEscalationInvalid
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newAPIEscalationPolicyResponse(policy))
+}
+
+func (s *Server) handleEscalationPoliciesDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiEscalationPolicyDeleteRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagEscalation).Field("escalation_policy_id", req.ID).Debug("Removing escalation policy")
+	if err := s.userManager.RemoveEscalationPolicy(req.ID); errors.Is(err, user.ErrEscalationPolicyNotFound) || errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPNotFoundEscalation
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func newAPIEscalationPolicyResponse(policy *user.EscalationPolicy) *apiEscalationPolicyResponse {
+	steps := make([]*apiEscalationStepModel, len(policy.Steps))
+	for i, step := range policy.Steps {
+		steps[i] = &apiEscalationStepModel{
+			Delay:  step.Delay.String(),
+			Type:   step.Type,
+			Target: step.Target,
+		}
+	}
+	return &apiEscalationPolicyResponse{
+		ID:    policy.ID,
+		Topic: policy.Topic,
+		Steps: steps,
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_Escalations_AdminAPI(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Add policy
+	rr := request(t, s, "POST", "/v1/escalations", `{"topic":"alerts-*","steps":[{"delay":"5m","type":"call","target":"+12223334444"},{"type":"email","target":"oncall@example.com"}]}`, admin)
+	require.Equal(t, 200, rr.Code)
+	var policy apiEscalationPolicyResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&policy))
+	require.Equal(t, "alerts-*", policy.Topic)
+	require.Equal(t, 2, len(policy.Steps))
+	require.Equal(t, "5m0s", policy.Steps[0].Delay)
+	require.Equal(t, "call", policy.Steps[0].Type)
+	require.Equal(t, "+12223334444", policy.Steps[0].Target)
+	require.Equal(t, "0s", policy.Steps[1].Delay)
+
+	// List policies
+	rr = request(t, s, "GET", "/v1/escalations", "", admin)
+	require.Equal(t, 200, rr.Code)
+	var policies []*apiEscalationPolicyResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&policies))
+	require.Equal(t, 1, len(policies))
+	require.Equal(t, policy.ID, policies[0].ID)
+
+	// Regular users cannot manage policies
+	rr = request(t, s, "GET", "/v1/escalations", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Delete policy
+	rr = request(t, s, "DELETE", "/v1/escalations", `{"id":"`+policy.ID+`"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "DELETE", "/v1/escalations", `{"id":"`+policy.ID+`"}`, admin)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, 40405, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_Escalations_AdminAPI_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	for _, body := range []string{
+		`{"topic":"alerts","steps":[]}`,
+		`{"topic":"","steps":[{"type":"publish","target":"oncall"}]}`,
+		`{"topic":"alerts","steps":[{"delay":"soon","type":"publish","target":"oncall"}]}`,
+		`{"topic":"alerts","steps":[{"type":"sms","target":"+12223334444"}]}`,
+		`{"topic":"alerts","steps":[{"type":"call","target":"12223334444"}]}`,
+		`{"topic":"alerts","steps":[{"type":"email","target":"not an email"}]}`,
+		`{"topic":"alerts","steps":[{"type":"publish","target":"on*"}]}`,
+	} {
+		rr := request(t, s, "POST", "/v1/escalations", body, admin)
+		require.Equal(t, 400, rr.Code, body)
+		require.Equal(t, 40053, toHTTPError(t, rr.Body.String()).Code, body)
+	}
+}
+
+func TestServer_Escalations_StepsUntilDone(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	mailer := &testMailer{}
+	s.smtpSender = mailer
+	require.Nil(t, s.userManager.AddEscalationPolicy(&user.EscalationPolicy{
+		Topic: "alerts",
+		Steps: []*user.EscalationStep{
+			{Delay: 0, Type: user.EscalationPublish, Target: "oncall"},
+			{Delay: 5 * time.Minute, Type: user.EscalationEmail, Target: "oncall@example.com"},
+		},
+	}))
+
+	// Message gets an ack action
+	response := request(t, s, "PUT", "/alerts", "disk full", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, 1, len(m.Actions))
+	require.Equal(t, "ack", m.Actions[0].Action)
+	require.Equal(t, "Acknowledge", m.Actions[0].Label)
+	require.Equal(t, "POST", m.Actions[0].Method)
+
+	// First step: republish
+	require.Nil(t, s.sendEscalations())
+	response = request(t, s, "GET", "/oncall/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "disk full", messages[0].Message)
+	require.Equal(t, 0, mailer.Count())
+
+	// Second step is not due yet
+	require.Nil(t, s.sendEscalations())
+	e, err := s.messageCache.Escalation(m.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, e.Step)
+	require.Equal(t, 0, mailer.Count())
+
+	// Second step: email, then the escalation is done
+	e.Next = time.Now().Unix()
+	require.Nil(t, s.messageCache.UpdateEscalation(e))
+	require.Nil(t, s.sendEscalations())
+	waitFor(t, func() bool {
+		return mailer.Count() == 1
+	})
+	_, err = s.messageCache.Escalation(m.ID)
+	require.Equal(t, errEscalationNotFound, err)
+}
+
+func TestServer_Escalations_Ack(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddEscalationPolicy(&user.EscalationPolicy{
+		Topic: "alerts-*",
+		Steps: []*user.EscalationStep{
+			{Delay: 5 * time.Minute, Type: user.EscalationPublish, Target: "oncall"},
+		},
+	}))
+
+	// Existing ack action is used
+	response := request(t, s, "PUT", "/alerts-db", "replica lag", map[string]string{
+		"Actions": "view, Open dashboard, https://example.com; ack, Got it",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, 2, len(m.Actions))
+	require.Equal(t, "Got it", m.Actions[1].Label)
+	ackURL, err := url.Parse(m.Actions[1].URL)
+	require.Nil(t, err)
+	require.Equal(t, "/alerts-db/"+m.ID+"/ack", ackURL.Path)
+
+	// Wrong token or topic
+	response = request(t, s, "POST", "/alerts-db/"+m.ID+"/ack?token=wrong", "", nil)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40405, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/alerts-web/"+m.ID+"/ack?"+ackURL.RawQuery, "", nil)
+	require.Equal(t, 404, response.Code)
+
+	// Acknowledge
+	response = request(t, s, "POST", ackURL.RequestURI(), "", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", ackURL.RequestURI(), "", nil)
+	require.Equal(t, 404, response.Code)
+
+	// Escalation does not continue
+	require.Nil(t, s.sendEscalations())
+	response = request(t, s, "GET", "/oncall/json?poll=1", "", nil)
+	require.Equal(t, 0, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_Escalations_MessageDeleted(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddEscalationPolicy(&user.EscalationPolicy{
+		Topic: "alerts",
+		Steps: []*user.EscalationStep{
+			{Delay: 0, Type: user.EscalationPublish, Target: "oncall"},
+		},
+	}))
+	response := request(t, s, "PUT", "/alerts", "disk full", nil)
+	m := toMessage(t, response.Body.String())
+	response = request(t, s, "DELETE", "/alerts/"+m.ID, "", nil)
+	require.Equal(t, 200, response.Code)
+
+	require.Nil(t, s.sendEscalations())
+	response = request(t, s, "GET", "/oncall/json?poll=1", "", nil)
+	require.Equal(t, 0, len(toMessages(t, response.Body.String())))
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	federationPushQueueSize    = 1000             // Max. number of messages waiting to be pushed to a peer, messages are dropped if exceeded
+	federationPushMaxAttempts  = 5                // Pushes are dropped after this many failed attempts
+	federationMaxRetryDelay    = 5 * time.Minute  // Upper bound for the exponential backoff between attempts/reconnects
+	federationRequestTimeout   = 15 * time.Second // Timeout for a single push request
+	federationReadTimeout      = 3 * time.Minute  // Mirror connections are re-established if nothing (not even a keepalive) is received
+	federationMaxLineBytes     = 1024 * 1024      // Max. size of a single line in the JSON stream of a peer
+	federationResponseBytes    = 4096             // Number of response body bytes read per push request
+	federationPeerNameMaxChars = 64
+)
+
+var (
+	federationPeerNameRegex = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+)
+
+// FederationPeer is another ntfy server that topics are mirrored from (by subscribing to the topics
+// on the peer), or pushed to (by publishing messages to the peer's federation endpoint), see ParseFederationPeer
+type FederationPeer struct {
+	Name         string   // Used in logs and metrics
+	BaseURL      string   // Base URL of the peer, e.g. https://ntfy2.example.com
+	Token        string   // Access token used to authenticate with the peer, may be empty
+	User         string   // Local user the peer pushes messages as, see handleFederationMessage; may be empty
+	MirrorTopics []string // Topics subscribed to on the peer, messages are republished locally
+	PushTopics   []string // Topic patterns (may contain '*' wildcards) whose messages are pushed to the peer
+}
+
+// ParseFederationPeer parses a federation peer definition, consisting of space-separated key=value pairs, e.g.
+// "name=dc2 url=https://ntfy2.example.com token=tk_... mirror=alerts,backups push=alerts-* user=dc2". The name and
+// url are required, as well as at least one of mirror, push or user.
+func ParseFederationPeer(s string) (*FederationPeer, error) {
+	peer := &FederationPeer{}
+	for _, field := range strings.Fields(s) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid federation peer %s: expected key=value, got %s", s, field)
+		}
+		switch key {
+		case "name":
+			peer.Name = value
+		case "url":
+			peer.BaseURL = value
+		case "token":
+			peer.Token = value
+		case "user":
+			peer.User = value
+		case "mirror":
+			peer.MirrorTopics = util.SplitNoEmpty(value, ",")
+		case "push":
+			peer.PushTopics = util.SplitNoEmpty(value, ",")
+		default:
+			return nil, fmt.Errorf("invalid federation peer %s: unknown key %s", s, key)
+		}
+	}
+	if !federationPeerNameRegex.MatchString(peer.Name) {
+		return nil, fmt.Errorf("invalid federation peer %s: name must be set, and may only contain numbers, letters, dashes and underscores (max. %d characters)", s, federationPeerNameMaxChars)
+	} else if !strings.HasPrefix(peer.BaseURL, "http://") && !strings.HasPrefix(peer.BaseURL, "https://") {
+		return nil, fmt.Errorf("invalid federation peer %s: url must start with http:// or https://", s)
+	} else if strings.HasSuffix(peer.BaseURL, "/") {
+		return nil, fmt.Errorf("invalid federation peer %s: url must not end with a slash (/)", s)
+	} else if len(peer.MirrorTopics) == 0 && len(peer.PushTopics) == 0 && peer.User == "" {
+		return nil, fmt.Errorf("invalid federation peer %s: at least one of mirror, push or user must be set", s)
+	} else if peer.User != "" && !user.AllowedUsername(peer.User) {
+		return nil, fmt.Errorf("invalid federation peer %s: invalid user %s", s, peer.User)
+	}
+	for _, topic := range peer.MirrorTopics {
+		if !topicRegex.MatchString(topic) {
+			return nil, fmt.Errorf("invalid federation peer %s: invalid mirror topic %s", s, topic)
+		}
+	}
+	for _, topic := range peer.PushTopics {
+		if !user.AllowedTopicPattern(topic) {
+			return nil, fmt.Errorf("invalid federation peer %s: invalid push topic %s", s, topic)
+		}
+	}
+	return peer, nil
+}
+
+// federationPeer holds the runtime state of a configured federation peer
+type federationPeer struct {
+	*FederationPeer
+	pushRegex *regexp.Regexp // Nil if no topics are pushed to this peer
+	queue     chan *message  // Messages to be pushed to this peer, see runFederationPusher
+	lastID    string         // ID of the last message received from the peer, used to resume mirroring
+	mu        sync.Mutex
+}
+
+func newFederationPeer(peer *FederationPeer) *federationPeer {
+	return &federationPeer{
+		FederationPeer: peer,
+		pushRegex:      newTopicPatternsRegex(peer.PushTopics),
+		queue:          make(chan *message, federationPushQueueSize),
+	}
+}
+
+func (p *federationPeer) Context() log.Context {
+	return log.Context{
+		"federation_peer":     p.Name,
+		"federation_peer_url": p.BaseURL,
+	}
+}
+
+// handleFederationMessage receives a message pushed by another ntfy server, see runFederationPusher. Only users
+// of configured peers (see FederationPeer.User) may push messages, and they must be allowed to write to the message's
+// topic. The message keeps its ID, so that it can be deduplicated, and counts towards the peer user's message limit.
+func (s *Server) handleFederationMessage(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := requestUser(r)
+	p := s.federationPeerByUser(u.Name)
+	if p == nil {
+		return errHTTPForbidden
+	}
+	m, err := readJSONWithLimit[message](r.Body, jsonBodyBytesLimit+s.config.MessageSizeLimit, false)
+	if err != nil {
+		return err
+	}
+	if m.Event != messageEvent || !validMessageID(m.ID) || !topicRegex.MatchString(m.Topic) {
+		return errHTTPBadRequestFederationMessageInvalid
+	} else if util.Contains(s.config.DisallowedTopics, m.Topic) {
+		return errHTTPBadRequestTopicDisallowed
+	}
+	if err := s.userManager.Authorize(u, m.Topic, user.PermissionWrite); err != nil {
+		return errHTTPForbidden.With(m)
+	} else if !util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) && !v.MessageAllowed() {
+		return errHTTPTooManyRequestsLimitMessages.With(m)
+	}
+	if _, err := s.publishFederatedMessage(v, p.Name, m); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// federationPeerByUser returns the peer that pushes messages as the given user, or nil if there is none
+func (s *Server) federationPeerByUser(username string) *federationPeer {
+	for _, p := range s.federationPeers {
+		if p.User != "" && p.User == username {
+			return p
+		}
+	}
+	return nil
+}
+
+// sanitizeFederatedMessage validates a message received from a federation peer, and resets all fields that are
+// controlled by this server: the sender and user, the expiry (according to the visitor's limits), and the attachment
+// expiry. Attachments are always treated as external attachments, since the file is hosted by the peer.
+func (s *Server) sanitizeFederatedMessage(v *visitor, m *message) error {
+	if len(m.Message) > s.config.MessageSizeLimit || len(m.Title) > s.config.MessageSizeLimit {
+		return errHTTPEntityTooLargeJSONBody
+	} else if m.Priority < 0 || m.Priority > 5 {
+		return errHTTPBadRequestFederationMessageInvalid
+	} else if m.Attachment != nil && !strings.HasPrefix(m.Attachment.URL, "http://") && !strings.HasPrefix(m.Attachment.URL, "https://") {
+		return errHTTPBadRequestFederationMessageInvalid
+	}
+	now := time.Now().Unix()
+	if m.Time > now || m.Time <= 0 {
+		m.Time = now // Clocks may be skewed, but a future time would mark the message as scheduled
+	}
+	if m.Expires > 0 { // Messages published with "Cache: no" have no expiry
+		m.Expires = time.Unix(m.Time, 0).Add(v.Limits().MessageExpiryDuration).Unix()
+	}
+	if m.Attachment != nil {
+		m.Attachment.Expires = 0
+	}
+	m.PollID = ""
+	m.Sender = v.IP()
+	m.User = v.MaybeUserID()
+	return nil
+}
+
+// publishFederatedMessage publishes a message received from a federation peer to local subscribers and push
+// transports. Messages that have passed through this server before (according to their origin), or that are
+// already in the message cache, are skipped to prevent loops; in that case, false is returned.
+func (s *Server) publishFederatedMessage(v *visitor, peer string, m *message) (bool, error) {
+	ev := logvm(v, m).Tag(tagFederation).Field("federation_peer", peer)
+	if s.config.BaseURL != "" && slices.Contains(m.Origin, s.config.BaseURL) {
+		ev.Trace("Ignoring federated message, it originated from this server")
+		return false, nil
+	}
+	s.federationMu.Lock()
+	defer s.federationMu.Unlock()
+	if _, err := s.messageCache.Message(m.ID); err == nil {
+		ev.Trace("Ignoring federated message, it has already been received")
+		return false, nil
+	} else if !errors.Is(err, errMessageNotFound) {
+		return false, err
+	}
+	if err := s.sanitizeFederatedMessage(v, m); err != nil {
+		return false, err
+	}
+	ev.Debug("Publishing federated message")
+	if err := s.publishRoutedMessage(v, m, m.Expires > 0); err != nil {
+		return false, err
+	}
+	if metricFederationMessagesReceived != nil {
+		metricFederationMessagesReceived.WithLabelValues(peer).Inc()
+	}
+	return true, nil
+}
+
+// enqueueFederationPushes queues the message to be pushed to all peers that the topic is pushed to, unless
+// the message has passed through that peer before (according to its origin)
+func (s *Server) enqueueFederationPushes(v *visitor, m *message) {
+	if m.Event != messageEvent {
+		return
+	}
+	for _, p := range s.federationPeers {
+		if p.pushRegex == nil || !p.pushRegex.MatchString(m.Topic) || slices.Contains(m.Origin, p.BaseURL) {
+			continue
+		}
+		select {
+		case p.queue <- m:
+		default:
+			logvm(v, m).Tag(tagFederation).With(p).Warn("Federation push queue is full, dropping message")
+			if metricFederationMessagesPushedFailure != nil {
+				metricFederationMessagesPushedFailure.WithLabelValues(p.Name).Inc()
+			}
+		}
+	}
+}
+
+// runFederation starts mirroring topics from, and pushing topics to all configured federation peers
+func (s *Server) runFederation() {
+	for _, p := range s.federationPeers {
+		if len(p.MirrorTopics) > 0 {
+			go s.runFederationMirror(p)
+		}
+		if p.pushRegex != nil {
+			go s.runFederationPusher(p)
+		}
+	}
+}
+
+// runFederationPusher sends the queued messages to the peer, one at a time to preserve their order. Failed
+// pushes are retried with an exponential backoff, and dropped after federationPushMaxAttempts attempts.
+func (s *Server) runFederationPusher(p *federationPeer) {
+	for {
+		var m *message
+		select {
+		case m = <-p.queue:
+		case <-s.closeChan:
+			return
+		}
+		for attempt := 0; attempt < federationPushMaxAttempts; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-time.After(federationRetryDelay(s.config.FederationRetryDelay, attempt-1)):
+				case <-s.closeChan:
+					return
+				}
+			}
+			ev := log.Tag(tagFederation).With(m, p).Field("federation_attempt", attempt+1)
+			retry, err := s.pushFederatedMessage(p, m)
+			if err == nil {
+				ev.Debug("Pushed message to federation peer")
+				if metricFederationMessagesPushedSuccess != nil {
+					metricFederationMessagesPushedSuccess.WithLabelValues(p.Name).Inc()
+				}
+				break
+			} else if !retry || attempt+1 == federationPushMaxAttempts {
+				ev.Err(err).Warn("Unable to push message to federation peer, giving up")
+				if metricFederationMessagesPushedFailure != nil {
+					metricFederationMessagesPushedFailure.WithLabelValues(p.Name).Inc()
+				}
+				break
+			}
+			ev.Err(err).Debug("Unable to push message to federation peer, retrying")
+		}
+	}
+}
+
+// pushFederatedMessage publishes the message to the peer's federation endpoint, adding this server to the
+// message's origin. If it fails, it returns whether the push should be retried.
+func (s *Server) pushFederatedMessage(p *federationPeer, m *message) (retry bool, err error) {
+	federated := *m
+	federated.Origin = append(slices.Clone(m.Origin), s.config.BaseURL)
+	body, err := json.Marshal(&federated)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), federationRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL+apiFederationMessagesPath, strings.NewReader(string(body)))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	req.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", util.BearerAuth(p.Token))
+	}
+	resp, err := s.federationClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, federationResponseBytes))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return false, fmt.Errorf("unexpected response status: %s, %s", resp.Status, strings.TrimSpace(string(response)))
+	} else if resp.StatusCode != http.StatusOK {
+		return true, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return false, nil
+}
+
+// runFederationMirror subscribes to the mirrored topics on the peer, and keeps re-connecting (with an
+// exponential backoff) until the server is stopped. In cluster mode, only the cluster leader mirrors peers.
+func (s *Server) runFederationMirror(p *federationPeer) {
+	attempt := 0
+	for {
+		if !s.isClusterLeader() {
+			select {
+			case <-time.After(clusterLeaseRenewInterval):
+				continue
+			case <-s.closeChan:
+				return
+			}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			for {
+				select {
+				case <-s.closeChan:
+					cancel()
+					return
+				case <-ctx.Done():
+					return
+				case <-time.After(clusterLeaseRenewInterval):
+					if !s.isClusterLeader() {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+		connected, err := s.mirrorFederationPeer(ctx, p)
+		cancel()
+		select {
+		case <-s.closeChan:
+			return
+		default:
+		}
+		if connected {
+			attempt = 0
+		}
+		delay := federationRetryDelay(s.config.FederationRetryDelay, attempt)
+		log.Tag(tagFederation).With(p).Err(err).Info("Connection to federation peer lost, reconnecting in %s", delay)
+		attempt++
+		select {
+		case <-time.After(delay):
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+// mirrorFederationPeer subscribes to the mirrored topics on the peer, and publishes all received messages
+// locally, until the context is cancelled or the connection fails. It returns whether a connection was established.
+func (s *Server) mirrorFederationPeer(ctx context.Context, p *federationPeer) (connected bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.federationMirrorURL(p), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	if p.Token != "" {
+		req.Header.Set("Authorization", util.BearerAuth(p.Token))
+	}
+	resp, err := s.federationClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	if metricFederationPeersConnected != nil {
+		metricFederationPeersConnected.WithLabelValues(p.Name).Set(1)
+		defer metricFederationPeersConnected.WithLabelValues(p.Name).Set(0)
+	}
+	log.Tag(tagFederation).With(p).Info("Connected to federation peer, mirroring topics %s", strings.Join(p.MirrorTopics, ","))
+	timeout := time.AfterFunc(federationReadTimeout, cancel) // Reset for every line, see below
+	defer timeout.Stop()
+	v := s.visitor(netip.IPv4Unspecified(), nil)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 4096), federationMaxLineBytes)
+	for scanner.Scan() {
+		timeout.Reset(federationReadTimeout)
+		var m message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return true, err
+		} else if m.Event != messageEvent {
+			continue // open, keepalive, message updates, ...
+		} else if !validMessageID(m.ID) || !slices.Contains(p.MirrorTopics, m.Topic) {
+			log.Tag(tagFederation).With(p).Debug("Ignoring invalid message %s from federation peer", m.ID)
+			continue
+		}
+		if !slices.Contains(m.Origin, p.BaseURL) {
+			m.Origin = append(m.Origin, p.BaseURL)
+		}
+		if _, err := s.publishFederatedMessage(v, p.Name, &m); err != nil {
+			logvm(v, &m).Tag(tagFederation).With(p).Err(err).Warn("Unable to publish federated message")
+		}
+		p.mu.Lock()
+		p.lastID = m.ID
+		p.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, errors.New("connection closed by peer")
+}
+
+// newFederationClient creates the HTTP client shared by all federation pushes and mirror connections. Since mirror
+// connections are long-lived streams, the client has no overall timeout. Instead, connecting and waiting for the
+// response headers are limited by the transport, pushes are limited as a whole (see pushFederatedMessage), and
+// mirror connections are closed if nothing is received for a while (see mirrorFederationPeer).
+func newFederationClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: federationRequestTimeout,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   federationRequestTimeout,
+			ResponseHeaderTimeout: federationRequestTimeout,
+			MaxIdleConnsPerHost:   2,
+			IdleConnTimeout:       time.Minute,
+		},
+	}
+}
+
+// federationMirrorURL returns the subscribe URL for the mirrored topics. After a reconnect, messages are requested
+// since the last received message. On the first connect, messages are only requested since now, unless the message
+// cache is persistent: in that case, all cached messages are requested, and the ones already received are skipped.
+func (s *Server) federationMirrorURL(p *federationPeer) string {
+	p.mu.Lock()
+	since := p.lastID
+	p.mu.Unlock()
+	if since == "" && s.config.CacheFile != "" && s.config.CacheDuration > 0 {
+		since = "all"
+	} else if since == "" {
+		since = fmt.Sprintf("%d", time.Now().Unix())
+	}
+	return fmt.Sprintf("%s/%s/json?since=%s", p.BaseURL, strings.Join(p.MirrorTopics, ","), url.QueryEscape(since))
+}
+
+// federationRetryDelay returns the delay before the next attempt, doubling the base delay for every failed attempt
+func federationRetryDelay(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 0; i < attempts && delay < federationMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > federationMaxRetryDelay {
+		return federationMaxRetryDelay
+	}
+	return delay
+}
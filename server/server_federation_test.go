@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestParseFederationPeer(t *testing.T) {
+	peer, err := ParseFederationPeer("name=dc2 url=https://ntfy2.example.com token=tk_abc mirror=alerts,backups push=alerts-*")
+	require.Nil(t, err)
+	require.Equal(t, "dc2", peer.Name)
+	require.Equal(t, "https://ntfy2.example.com", peer.BaseURL)
+	require.Equal(t, "tk_abc", peer.Token)
+	require.Equal(t, []string{"alerts", "backups"}, peer.MirrorTopics)
+	require.Equal(t, []string{"alerts-*"}, peer.PushTopics)
+
+	peer, err = ParseFederationPeer("  name=dc3   url=http://10.0.0.3:8080 push=*  ")
+	require.Nil(t, err)
+	require.Equal(t, "dc3", peer.Name)
+	require.Equal(t, "", peer.Token)
+	require.Nil(t, peer.MirrorTopics)
+	require.Equal(t, []string{"*"}, peer.PushTopics)
+
+	peer, err = ParseFederationPeer("name=dc4 url=https://ntfy4.example.com user=dc4")
+	require.Nil(t, err)
+	require.Equal(t, "dc4", peer.User)
+	require.Nil(t, peer.PushTopics)
+
+	for _, definition := range []string{
+		"",
+		"url=https://ntfy2.example.com mirror=alerts",              // Missing name
+		"name=dc2 mirror=alerts",                                   // Missing URL
+		"name=dc2 url=ntfy2.example.com mirror=alerts",             // Invalid URL
+		"name=dc2 url=https://ntfy2.example.com/ mirror=alerts",    // Trailing slash
+		"name=dc2 url=https://ntfy2.example.com",                   // No topics or user
+		"name=dc2 url=https://ntfy2.example.com user=dc/2",         // Invalid user
+		"name=dc2 url=https://ntfy2.example.com mirror=alerts-*",   // Mirror topics cannot be patterns
+		"name=dc2 url=https://ntfy2.example.com push=alerts/x",     // Invalid push topic
+		"name=dc2 url=https://ntfy2.example.com mirror=alerts x=1", // Unknown key
+		"name=dc2 url=https://ntfy2.example.com mirror",            // Missing value
+		"name=dc/2 url=https://ntfy2.example.com mirror=alerts",    // Invalid name
+	} {
+		_, err := ParseFederationPeer(definition)
+		require.Error(t, err, definition)
+	}
+}
+
+func TestServer_Federation_ReceivePush(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithFederation(t))
+	require.Nil(t, s.userManager.AddUser("dc1", "dc1", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("dc1", "alerts*", user.PermissionReadWrite))
+	u, err := s.userManager.User("dc1")
+	require.Nil(t, err)
+	token, err := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	headers := map[string]string{
+		"Authorization": util.BearerAuth(token.Value),
+	}
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/alerts/json?auth="+base64.RawURLEncoding.EncodeToString([]byte(util.BearerAuth(token.Value))), subscribeRR)
+
+	// Message keeps its ID and origin
+	body := `{"id":"abcdefghijkl","time":1700000000,"expires":1700043200,"event":"message","topic":"alerts","message":"hi from dc1","origin":["http://dc1.example.com"]}`
+	response := request(t, s, "POST", "/v1/federation/messages", body, headers)
+	require.Equal(t, 200, response.Code)
+
+	// Duplicates and messages that passed through this server are ignored
+	response = request(t, s, "POST", "/v1/federation/messages", body, headers)
+	require.Equal(t, 200, response.Code)
+	body = fmt.Sprintf(`{"id":"mnopqrstuvwx","time":1700000000,"event":"message","topic":"alerts","message":"loop","origin":["%s","http://dc1.example.com"]}`, s.config.BaseURL)
+	response = request(t, s, "POST", "/v1/federation/messages", body, headers)
+	require.Equal(t, 200, response.Code)
+	subscribeCancel()
+
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "abcdefghijkl", messages[1].ID)
+	require.Equal(t, "hi from dc1", messages[1].Message)
+
+	m, err := s.messageCache.Message("abcdefghijkl")
+	require.Nil(t, err)
+	require.Equal(t, []string{"http://dc1.example.com"}, m.Origin)
+	require.Equal(t, u.ID, m.User)
+
+	// Invalid messages, and topics without write access
+	response = request(t, s, "POST", "/v1/federation/messages", `{"id":"short","event":"message","topic":"alerts"}`, headers)
+	require.Equal(t, 40055, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/federation/messages", `{"id":"abcdefghijkz","event":"message","topic":"secret"}`, headers)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/v1/federation/messages", `{"id":"abcdefghijkz","event":"message","topic":"alerts"}`, nil)
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_Federation_ReceivePush_NotPeer(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithFederation(t))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "alerts", user.PermissionReadWrite))
+
+	// Users with write access can publish, but not push federated messages
+	response := request(t, s, "POST", "/v1/federation/messages", `{"id":"abcdefghijkl","event":"message","topic":"alerts"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 403, response.Code)
+	_, err := s.messageCache.Message("abcdefghijkl")
+	require.Equal(t, errMessageNotFound, err)
+}
+
+func TestServer_Federation_ReceivePush_Sanitized(t *testing.T) {
+	conf := newTestConfigWithFederation(t)
+	conf.VisitorMessageDailyLimit = 4
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddUser("dc1", "dc1", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("dc1", "alerts", user.PermissionReadWrite))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("dc1", "dc1"),
+	}
+
+	// Expiry is derived from the local limits, and attachments are external
+	future := time.Now().Add(100 * 24 * time.Hour).Unix()
+	body := fmt.Sprintf(`{"id":"abcdefghijkl","time":1700000000,"expires":%d,"event":"message","topic":"alerts","message":"hi","attachment":{"name":"a.jpg","url":"http://dc1.example.com/file/abcdefghijkl.jpg","size":1000,"expires":%d}}`, future, future)
+	response := request(t, s, "POST", "/v1/federation/messages", body, headers)
+	require.Equal(t, 200, response.Code)
+	m, err := s.messageCache.Message("abcdefghijkl")
+	require.Nil(t, err)
+	require.Equal(t, time.Unix(1700000000, 0).Add(conf.CacheDuration).Unix(), m.Expires)
+	require.Equal(t, int64(0), m.Attachment.Expires)
+	require.Equal(t, "http://dc1.example.com/file/abcdefghijkl.jpg", m.Attachment.URL)
+
+	// Invalid attachment URLs, and messages that are too large
+	response = request(t, s, "POST", "/v1/federation/messages", `{"id":"mnopqrstuvwx","event":"message","topic":"alerts","attachment":{"name":"a.jpg","url":"file:///etc/passwd"}}`, headers)
+	require.Equal(t, 40055, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/federation/messages", fmt.Sprintf(`{"id":"mnopqrstuvwx","event":"message","topic":"alerts","message":"%s"}`, strings.Repeat("x", conf.MessageSizeLimit+1)), headers)
+	require.Equal(t, 41303, toHTTPError(t, response.Body.String()).Code)
+
+	// Pushed messages count towards the message limit (including the rejected ones above)
+	response = request(t, s, "POST", "/v1/federation/messages", `{"id":"mnopqrstuvw1","event":"message","topic":"alerts","message":"2"}`, headers)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/federation/messages", `{"id":"mnopqrstuvw2","event":"message","topic":"alerts","message":"3"}`, headers)
+	require.Equal(t, 429, response.Code)
+}
+
+func TestServer_Federation_ReceivePush_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	require.Nil(t, s.userManager.AddUser("dc1", "dc1", user.RoleAdmin))
+	response := request(t, s, "POST", "/v1/federation/messages", `{"id":"abcdefghijkl","event":"message","topic":"alerts"}`, map[string]string{
+		"Authorization": util.BasicAuth("dc1", "dc1"),
+	})
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_Federation_Push(t *testing.T) {
+	// Peer server, allowing "dc1" to push to alerts*
+	peer := newTestServer(t, newTestConfigWithFederation(t))
+	require.Nil(t, peer.userManager.AddUser("dc1", "dc1", user.RoleUser))
+	require.Nil(t, peer.userManager.AllowAccess("dc1", "alerts*", user.PermissionReadWrite))
+	u, err := peer.userManager.User("dc1")
+	require.Nil(t, err)
+	token, err := peer.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	peerServer := httptest.NewServer(http.HandlerFunc(peer.handle))
+	defer peerServer.Close()
+
+	// Local server, pushing alerts* and secret to the peer
+	c := newTestConfig(t)
+	c.BaseURL = "http://dc1.example.com"
+	c.FederationPeers = []*FederationPeer{
+		{Name: "dc2", BaseURL: peerServer.URL, Token: token.Value, PushTopics: []string{"alerts*", "secret"}},
+	}
+	s := newTestServer(t, c)
+	p := s.federationPeers[0]
+
+	response := request(t, s, "PUT", "/alerts-db", "disk full", nil)
+	require.Equal(t, 200, response.Code)
+	local := toMessage(t, response.Body.String())
+	request(t, s, "PUT", "/mytopic", "not pushed", nil)
+
+	m := receiveFederationPush(t, p)
+	require.Equal(t, local.ID, m.ID)
+	retry, err := s.pushFederatedMessage(p, m)
+	require.Nil(t, err)
+	require.False(t, retry)
+	retry, err = s.pushFederatedMessage(p, m) // Duplicate is accepted, but ignored
+	require.Nil(t, err)
+	require.False(t, retry)
+
+	response = request(t, peer, "GET", "/alerts-db/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("dc1", "dc1"),
+	})
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, local.ID, messages[0].ID)
+	require.Equal(t, "disk full", messages[0].Message)
+	require.Equal(t, []string{"http://dc1.example.com"}, messages[0].Origin)
+
+	// Messages that passed through the peer are not pushed back
+	looped := newDefaultMessage("alerts-db", "from dc2")
+	looped.Origin = []string{peerServer.URL}
+	s.enqueueFederationPushes(s.visitor(netip.IPv4Unspecified(), nil), looped)
+	require.Equal(t, 0, len(p.queue))
+
+	// Permanent errors are not retried
+	request(t, s, "PUT", "/secret", "secret message", nil)
+	m = receiveFederationPush(t, p)
+	retry, err = s.pushFederatedMessage(p, m)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "40301")
+	require.False(t, retry)
+}
+
+func TestServer_Federation_Mirror(t *testing.T) {
+	peerConf := newTestConfig(t)
+	peerConf.BaseURL = "http://dc2.example.com"
+	peer := newTestServer(t, peerConf)
+	peerServer := httptest.NewServer(http.HandlerFunc(peer.handle))
+	defer peerServer.Close()
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://dc1.example.com"
+	c.FederationPeers = []*FederationPeer{
+		{Name: "dc2", BaseURL: peerServer.URL, MirrorTopics: []string{"alerts", "backups"}},
+	}
+	s := newTestServer(t, c)
+	p := s.federationPeers[0]
+
+	// Messages published before the mirror connects are fetched from the peer's cache
+	response := request(t, peer, "PUT", "/alerts", "before connect", nil)
+	before := toMessage(t, response.Body.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		connected, err := s.mirrorFederationPeer(ctx, p)
+		require.True(t, connected)
+		require.Error(t, err)
+		done <- true
+	}()
+	waitFor(t, func() bool {
+		peer.mu.RLock()
+		t, ok := peer.topics["backups"] // Topic is created by the mirror subscription
+		peer.mu.RUnlock()
+		if !ok {
+			return false
+		}
+		subscribers, _ := t.Stats()
+		return subscribers == 1
+	})
+
+	request(t, peer, "PUT", "/backups", "backup done", nil)
+	request(t, peer, "PUT", "/mytopic", "not mirrored", nil)
+	waitFor(t, func() bool {
+		response := request(t, s, "GET", "/alerts,backups/json?poll=1", "", nil)
+		return len(toMessages(t, response.Body.String())) == 2
+	})
+	cancel()
+	<-done
+
+	response = request(t, s, "GET", "/alerts,backups,mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, before.ID, messages[0].ID)
+	require.Equal(t, "before connect", messages[0].Message)
+	require.Equal(t, []string{peerServer.URL}, messages[0].Origin)
+	require.Equal(t, "backup done", messages[1].Message)
+	require.Equal(t, messages[1].ID, p.lastID)
+
+	// Reconnects resume after the last received message
+	require.Equal(t, fmt.Sprintf("%s/alerts,backups/json?since=%s", peerServer.URL, messages[1].ID), s.federationMirrorURL(p))
+}
+
+func newTestConfigWithFederation(t *testing.T) *Config {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.EnableFederation = true
+	conf.FederationPeers = []*FederationPeer{
+		{Name: "dc1", BaseURL: "http://dc1.example.com", User: "dc1"},
+	}
+	return conf
+}
+
+func receiveFederationPush(t *testing.T, p *federationPeer) *message {
+	select {
+	case m := <-p.queue:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for federation push")
+		return nil
+	}
+}
@@ -103,6 +103,12 @@ func (c *firebaseSenderImpl) Send(m *messaging.Message) error {
 //   - On iOS, we are not allowed to receive data-only messages, so we build messages with an "alert" (with title and
 //     message), and still send the rest of the data along in the "aps" attribute. We can then locally modify the
 //     message in the Notification Service Extension.
+//   - Message updates ("message_update") are sent just like normal messages; the clients replace the existing
+//     notification with the ID in the "message_id" field.
+//
+// Message deletions ("message_delete"):
+//   - These only carry the ID of the deleted message ("message_id"), so they are sent like keepalive messages.
+//     The clients remove the notification.
 //
 // Keepalive messages ("keepalive"):
 //   - On Android, we subscribe to the "~control" topic, which is used to restart the foreground service (if it died,
@@ -127,6 +133,15 @@ func toFirebaseMessage(m *message, auther user.Auther) (*messaging.Message, erro
 			"topic": m.Topic,
 		}
 		apnsConfig = createAPNSBackgroundConfig(data)
+	case messageDeleteEvent:
+		data = map[string]string{
+			"id":         m.ID,
+			"time":       fmt.Sprintf("%d", m.Time),
+			"event":      m.Event,
+			"topic":      m.Topic,
+			"message_id": m.MessageID,
+		}
+		apnsConfig = createAPNSBackgroundConfig(data)
 	case pollRequestEvent:
 		data = map[string]string{
 			"id":      m.ID,
@@ -137,7 +152,7 @@ func toFirebaseMessage(m *message, auther user.Auther) (*messaging.Message, erro
 			"poll_id": m.PollID,
 		}
 		apnsConfig = createAPNSAlertConfig(m, data)
-	case messageEvent:
+	case messageEvent, messageUpdateEvent:
 		allowForward := true
 		if auther != nil {
 			allowForward = auther.Authorize(nil, m.Topic, user.PermissionRead) == nil
@@ -157,6 +172,9 @@ func toFirebaseMessage(m *message, auther user.Auther) (*messaging.Message, erro
 				"content_type": m.ContentType,
 				"encoding":     m.Encoding,
 			}
+			if m.MessageID != "" {
+				data["message_id"] = m.MessageID
+			}
 			if len(m.Actions) > 0 {
 				actions, err := json.Marshal(m.Actions)
 				if err != nil {
@@ -233,6 +233,39 @@ func TestToFirebaseMessage_Message_Normal_Not_Allowed(t *testing.T) {
 	}, fbm.Data)
 }
 
+func TestToFirebaseMessage_MessageUpdate(t *testing.T) {
+	original := newDefaultMessage("mytopic", "updated message")
+	original.Title = "some title"
+	m := newMessageUpdateMessage(original)
+	fbm, err := toFirebaseMessage(m, nil)
+	require.Nil(t, err)
+	require.Equal(t, "mytopic", fbm.Topic)
+	require.Equal(t, "message_update", fbm.Data["event"])
+	require.Equal(t, m.ID, fbm.Data["id"])
+	require.Equal(t, original.ID, fbm.Data["message_id"])
+	require.Equal(t, "updated message", fbm.Data["message"])
+	require.Equal(t, "some title", fbm.Data["title"])
+	require.Equal(t, "updated message", fbm.APNS.Payload.Aps.Alert.Body)
+}
+
+func TestToFirebaseMessage_MessageDelete(t *testing.T) {
+	original := newDefaultMessage("mytopic", "deleted message")
+	original.ID = "fOv6k1QbCzo6"
+	m := newMessageDeleteMessage(original)
+	fbm, err := toFirebaseMessage(m, nil)
+	require.Nil(t, err)
+	require.Equal(t, "mytopic", fbm.Topic)
+	require.Nil(t, fbm.Android)
+	require.Equal(t, "background", fbm.APNS.Headers["apns-push-type"])
+	require.Equal(t, map[string]string{
+		"id":         m.ID,
+		"time":       fmt.Sprintf("%d", m.Time),
+		"event":      "message_delete",
+		"topic":      "mytopic",
+		"message_id": "fOv6k1QbCzo6",
+	}, fbm.Data)
+}
+
 func TestToFirebaseMessage_PollRequest(t *testing.T) {
 	m := newPollRequestMessage("mytopic", "fOv6k1QbCzo6")
 	fbm, err := toFirebaseMessage(m, nil)
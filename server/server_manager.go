@@ -17,6 +17,9 @@ func (s *Server) execManager() {
 	s.pruneMessages()
 	s.pruneAndNotifyWebPushSubscriptions()
 
+	// Send summaries for quiet hours that have ended
+	s.sendQuietHoursSummaries()
+
 	// Message count per topic
 	var messagesCached int
 	messageCounts, err := s.messageCache.MessageCounts()
@@ -164,6 +167,23 @@ func (s *Server) pruneAttachments() {
 			} else {
 				log.Tag(tagManager).Debug("No expired attachments to delete")
 			}
+			uploads, err := s.messageCache.UploadsExpired()
+			if err != nil {
+				log.Tag(tagManager).Err(err).Warn("Error retrieving expired uploads")
+			}
+			for _, u := range uploads {
+				log.Tag(tagManager).Field("upload_id", u.ID).Debug("Deleting expired upload (%d of %d bytes received)", u.Received, u.Size)
+				if err := s.removeUpload(u); err != nil {
+					log.Tag(tagManager).Err(err).Field("upload_id", u.ID).Warn("Error deleting expired upload")
+				}
+			}
+			// The total size of all attachments is tracked in the database, so that it is shared by all replicas,
+			// and includes attachments uploaded or deleted by other replicas
+			if size, err := s.messageCache.AttachmentsSize(); err != nil {
+				log.Tag(tagManager).Err(err).Warn("Error retrieving total attachments size")
+			} else {
+				s.fileCache.SetSize(size)
+			}
 		}).
 		Debug("Deleted expired attachments")
 }
@@ -177,7 +197,11 @@ func (s *Server) pruneMessages() {
 				log.Tag(tagManager).Err(err).Warn("Error retrieving expired messages")
 			} else if len(expiredMessageIDs) > 0 {
 				if s.fileCache != nil {
-					if err := s.fileCache.Remove(expiredMessageIDs...); err != nil {
+					// Only remove attachments that are actually stored, to avoid needless requests to S3
+					storedIDs, err := s.messageCache.AttachmentsStored()
+					if err != nil {
+						log.Tag(tagManager).Err(err).Warn("Error retrieving stored attachments")
+					} else if err := s.fileCache.Remove(intersectIDs(expiredMessageIDs, storedIDs)...); err != nil {
 						log.Tag(tagManager).Err(err).Warn("Error deleting attachments for expired messages")
 					}
 				}
@@ -190,3 +214,18 @@ func (s *Server) pruneMessages() {
 		}).
 		Debug("Pruned messages")
 }
+
+// intersectIDs returns the IDs in a that are also in b
+func intersectIDs(a, b []string) []string {
+	set := make(map[string]struct{}, len(b))
+	for _, id := range b {
+		set[id] = struct{}{}
+	}
+	ids := make([]string, 0)
+	for _, id := range a {
+		if _, ok := set[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -5,27 +5,34 @@ import (
 )
 
 var (
-	metricMessagesPublishedSuccess     prometheus.Counter
-	metricMessagesPublishedFailure     prometheus.Counter
-	metricMessagesCached               prometheus.Gauge
-	metricMessagePublishDurationMillis prometheus.Gauge
-	metricFirebasePublishedSuccess     prometheus.Counter
-	metricFirebasePublishedFailure     prometheus.Counter
-	metricEmailsPublishedSuccess       prometheus.Counter
-	metricEmailsPublishedFailure       prometheus.Counter
-	metricEmailsReceivedSuccess        prometheus.Counter
-	metricEmailsReceivedFailure        prometheus.Counter
-	metricCallsMadeSuccess             prometheus.Counter
-	metricCallsMadeFailure             prometheus.Counter
-	metricUnifiedPushPublishedSuccess  prometheus.Counter
-	metricMatrixPublishedSuccess       prometheus.Counter
-	metricMatrixPublishedFailure       prometheus.Counter
-	metricAttachmentsTotalSize         prometheus.Gauge
-	metricVisitors                     prometheus.Gauge
-	metricSubscribers                  prometheus.Gauge
-	metricTopics                       prometheus.Gauge
-	metricUsers                        prometheus.Gauge
-	metricHTTPRequests                 *prometheus.CounterVec
+	metricMessagesPublishedSuccess        prometheus.Counter
+	metricMessagesPublishedFailure        prometheus.Counter
+	metricMessagesCached                  prometheus.Gauge
+	metricMessagePublishDurationMillis    prometheus.Gauge
+	metricFirebasePublishedSuccess        prometheus.Counter
+	metricFirebasePublishedFailure        prometheus.Counter
+	metricEmailsPublishedSuccess          prometheus.Counter
+	metricEmailsPublishedFailure          prometheus.Counter
+	metricEmailsReceivedSuccess           prometheus.Counter
+	metricEmailsReceivedFailure           prometheus.Counter
+	metricCallsMadeSuccess                prometheus.Counter
+	metricCallsMadeFailure                prometheus.Counter
+	metricUnifiedPushPublishedSuccess     prometheus.Counter
+	metricMatrixPublishedSuccess          prometheus.Counter
+	metricMatrixPublishedFailure          prometheus.Counter
+	metricAttachmentsTotalSize            prometheus.Gauge
+	metricVisitors                        prometheus.Gauge
+	metricSubscribers                     prometheus.Gauge
+	metricTopics                          prometheus.Gauge
+	metricUsers                           prometheus.Gauge
+	metricHTTPRequests                    *prometheus.CounterVec
+	metricFederationMessagesReceived      *prometheus.CounterVec
+	metricFederationMessagesPushedSuccess *prometheus.CounterVec
+	metricFederationMessagesPushedFailure *prometheus.CounterVec
+	metricFederationPeersConnected        *prometheus.GaugeVec
+	metricClusterMessagesPublished        prometheus.Counter
+	metricClusterMessagesReceived         prometheus.Counter
+	metricClusterLeader                   prometheus.Gauge
 )
 
 func initMetrics() {
@@ -92,6 +99,27 @@ func initMetrics() {
 	metricHTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "ntfy_http_requests_total",
 	}, []string{"http_code", "ntfy_code", "http_method"})
+	metricFederationMessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntfy_federation_messages_received",
+	}, []string{"peer"})
+	metricFederationMessagesPushedSuccess = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntfy_federation_messages_pushed_success",
+	}, []string{"peer"})
+	metricFederationMessagesPushedFailure = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntfy_federation_messages_pushed_failure",
+	}, []string{"peer"})
+	metricFederationPeersConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntfy_federation_peer_connected",
+	}, []string{"peer"})
+	metricClusterMessagesPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_cluster_messages_published",
+	})
+	metricClusterMessagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_cluster_messages_received",
+	})
+	metricClusterLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntfy_cluster_leader",
+	})
 	prometheus.MustRegister(
 		metricMessagesPublishedSuccess,
 		metricMessagesPublishedFailure,
@@ -114,6 +142,13 @@ func initMetrics() {
 		metricSubscribers,
 		metricTopics,
 		metricHTTPRequests,
+		metricFederationMessagesReceived,
+		metricFederationMessagesPushedSuccess,
+		metricFederationMessagesPushedFailure,
+		metricFederationPeersConnected,
+		metricClusterMessagesPublished,
+		metricClusterMessagesReceived,
+		metricClusterLeader,
 	)
 }
 
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	oidcCookieName         = "ntfy_oidc"
+	oidcCookieDuration     = 10 * time.Minute // Time the user has to log in with the identity provider
+	oidcStateLength        = 32
+	oidcCodeVerifierLength = 64
+	oidcPasswordLength     = 32 // Random password of provisioned users, they can only log in via single sign-on
+)
+
+// OIDCTierGroup maps a group of the OpenID Connect provider to a tier, see ParseOIDCTierGroup
+type OIDCTierGroup struct {
+	Group string // Group, as listed in the groups claim of the ID token
+	Tier  string // Tier code
+}
+
+// ParseOIDCTierGroup parses a group to tier mapping of the form "group=tier", e.g. "ntfy-pro=pro"
+func ParseOIDCTierGroup(s string) (*OIDCTierGroup, error) {
+	group, tier, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(group) == "" || strings.TrimSpace(tier) == "" {
+		return nil, fmt.Errorf("invalid OIDC tier group %s: expected group=tier", s)
+	}
+	return &OIDCTierGroup{
+		Group: strings.TrimSpace(group),
+		Tier:  strings.TrimSpace(tier),
+	}, nil
+}
+
+// oidcLoginState is stored in a cookie between handleOIDCLogin and handleOIDCCallback
+type oidcLoginState struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"verifier"`
+}
+
+// handleOIDCLogin redirects the user to the OpenID Connect provider to log in. The state, nonce and PKCE code
+// verifier are kept in a short-lived cookie, and checked in handleOIDCCallback.
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	state := &oidcLoginState{
+		State:        util.RandomSecretString(oidcStateLength),
+		Nonce:        util.RandomSecretString(oidcStateLength),
+		CodeVerifier: util.RandomSecretString(oidcCodeVerifierLength),
+	}
+	authorizationURL, err := s.oidc.AuthorizationURL(s.oidcRedirectURL(), s.config.OIDCScopes, state.State, state.Nonce, state.CodeVerifier)
+	if err != nil {
+		logvr(v, r).Tag(tagOIDC).Err(err).Warn("Cannot retrieve OpenID Connect provider metadata")
+		return errHTTPBadRequestOIDCLoginFailed.Wrap("identity provider not available")
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	s.setOIDCCookie(w, base64.RawURLEncoding.EncodeToString(b), int(oidcCookieDuration.Seconds()))
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, authorizationURL, http.StatusFound)
+	return nil
+}
+
+// handleOIDCCallback is called by the OpenID Connect provider after the user logged in. It exchanges the
+// authorization code for an ID token, provisions the user (see provisionOIDCUser), and creates an access
+// token. The user is then redirected to the web app, which picks up the token from the URL fragment. If
+// the web app is disabled, the token is returned as JSON instead.
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	state, err := readOIDCCookie(r)
+	s.setOIDCCookie(w, "", -1) // Delete cookie, the state can only be used once
+	if err != nil {
+		return errHTTPBadRequestOIDCLoginFailed.Wrap("login expired or not started via %s", apiAuthOIDCLoginPath)
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		return errHTTPBadRequestOIDCLoginFailed.Wrap("identity provider returned error %s", e)
+	} else if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		return errHTTPBadRequestOIDCLoginFailed.Wrap("state mismatch")
+	} else if query.Get("code") == "" {
+		return errHTTPBadRequestOIDCLoginFailed.Wrap("code missing")
+	}
+	claims, err := s.oidc.Exchange(query.Get("code"), s.oidcRedirectURL(), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		logvr(v, r).Tag(tagOIDC).Err(err).Debug("Cannot exchange authorization code")
+		return errHTTPBadRequestOIDCLoginFailed.Wrap("cannot verify ID token")
+	}
+	u, err := s.provisionOIDCUser(claims)
+	if err != nil {
+		return err
+	}
+	token, err := s.userManager.CreateToken(u.ID, "", time.Now().Add(tokenExpiryDuration), v.IP())
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagOIDC).Field("oidc_subject", claims.Subject).Info("User %s logged in via single sign-on", u.Name)
+	w.Header().Set("Cache-Control", "no-store")
+	if s.config.WebRoot == "" {
+		return s.writeJSON(w, &apiAccountTokenResponse{
+			Token:      token.Value,
+			Label:      token.Label,
+			LastAccess: token.LastAccess.Unix(),
+			LastOrigin: token.LastOrigin.String(),
+			Expires:    token.Expires.Unix(),
+		})
+	}
+	fragment := url.Values{}
+	fragment.Set("username", u.Name)
+	fragment.Set("token", token.Value)
+	http.Redirect(w, r, fmt.Sprintf("%s%s#%s", s.config.BaseURL, webLoginPath, fragment.Encode()), http.StatusFound)
+	return nil
+}
+
+// authenticateOIDCToken authenticates a user with a JWT access token issued by the OpenID Connect provider,
+// see authenticateBearerAuth. Users are provisioned on first use, just like on login.
+func (s *Server) authenticateOIDCToken(token string) (*user.User, error) {
+	claims, err := s.oidc.Verify(token, s.oidc.audience)
+	if err != nil {
+		return nil, err
+	}
+	return s.provisionOIDCUser(claims)
+}
+
+// provisionOIDCUser returns the user bound to the issuer and subject of the given OpenID Connect claims, and
+// creates it if it does not exist. Existing accounts are never linked by username, since the username claim
+// can often be changed by the user at the identity provider: if a local, directory or other single sign-on user
+// with that name exists, login is refused. If admin groups or tier groups are configured, the role and tier of
+// the user are synced with the user's groups, so that changes in the identity provider are applied on the next
+// login. Tokens without a groups claim are treated like tokens without any groups.
+func (s *Server) provisionOIDCUser(claims *oidcClaims) (*user.User, error) {
+	role := user.RoleUser
+	if util.ContainsAny(claims.Groups, s.config.OIDCAdminGroups) {
+		role = user.RoleAdmin
+	}
+	u, err := s.userManager.UserByProviderID(user.ProviderOIDC, claims.ProviderID())
+	if errors.Is(err, user.ErrUserNotFound) {
+		return s.addOIDCUser(claims, role)
+	} else if err != nil {
+		return nil, err
+	} else if u.Deleted || u.Provider != user.ProviderOIDC {
+		return nil, user.ErrUserNotFound // Never issue tokens for local users (e.g. local admins) via single sign-on
+	}
+	changed := false
+	if len(s.config.OIDCAdminGroups) > 0 && u.Role != role {
+		log.Tag(tagOIDC).Field("user_name", u.Name).Info("Changing role of user %s to %s, based on single sign-on groups", u.Name, role)
+		if err := s.userManager.ChangeRole(u.Name, role); err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+	if len(s.config.OIDCTierGroups) > 0 {
+		tierChanged, err := s.syncOIDCTier(u.Name, u.Tier, claims.Groups)
+		if err != nil {
+			return nil, err
+		}
+		changed = changed || tierChanged
+	}
+	if changed {
+		return s.userManager.UserByID(u.ID)
+	}
+	return u, nil
+}
+
+// addOIDCUser creates a user for the given claims, bound to the issuer and subject, see provisionOIDCUser
+func (s *Server) addOIDCUser(claims *oidcClaims, role user.Role) (*user.User, error) {
+	if !user.AllowedUsername(claims.Username) {
+		return nil, errHTTPBadRequestOIDCLoginFailed.Wrap("username %s not allowed", claims.Username)
+	}
+	ev := log.Tag(tagOIDC).Fields(log.Context{"user_name": claims.Username, "user_role": role, "oidc_subject": claims.Subject})
+	err := s.userManager.AddProviderUser(claims.Username, util.RandomSecretString(oidcPasswordLength), role, user.ProviderOIDC, claims.ProviderID())
+	if errors.Is(err, user.ErrUserExists) {
+		ev.Warn("Refusing single sign-on for user %s, a user with that name already exists", claims.Username)
+		return nil, errHTTPBadRequestOIDCLoginFailed.Wrap("user %s already exists", claims.Username)
+	} else if err != nil {
+		return nil, err
+	}
+	ev.Info("Provisioned user %s from single sign-on", claims.Username)
+	if _, err := s.syncOIDCTier(claims.Username, nil, claims.Groups); err != nil {
+		return nil, err
+	}
+	return s.userManager.UserByProviderID(user.ProviderOIDC, claims.ProviderID())
+}
+
+// syncOIDCTier sets the tier of the first tier group the user is a member of, or removes the user's tier
+// if the user is not a member of any tier group. It returns true if the tier was changed.
+func (s *Server) syncOIDCTier(username string, current *user.Tier, groups []string) (bool, error) {
+	if len(s.config.OIDCTierGroups) == 0 {
+		return false, nil
+	}
+	var tier string
+	for _, tierGroup := range s.config.OIDCTierGroups {
+		if util.Contains(groups, tierGroup.Group) {
+			tier = tierGroup.Tier
+			break
+		}
+	}
+	if current != nil && current.Code == tier || current == nil && tier == "" {
+		return false, nil
+	}
+	ev := log.Tag(tagOIDC).Fields(log.Context{"user_name": username, "tier": tier})
+	if tier == "" {
+		ev.Info("Removing tier of user %s, based on single sign-on groups", username)
+		return true, s.userManager.ResetTier(username)
+	}
+	ev.Info("Changing tier of user %s to %s, based on single sign-on groups", username, tier)
+	if err := s.userManager.ChangeTier(username, tier); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Server) oidcRedirectURL() string {
+	return s.config.BaseURL + apiAuthOIDCCallbackPath
+}
+
+func (s *Server) setOIDCCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     apiAuthOIDCPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.config.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode, // Sent on the redirect from the identity provider
+	})
+}
+
+func readOIDCCookie(r *http.Request) (*oidcLoginState, error) {
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	var state oidcLoginState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	} else if state.State == "" || state.Nonce == "" || state.CodeVerifier == "" {
+		return nil, errors.New("invalid login state")
+	}
+	return &state, nil
+}
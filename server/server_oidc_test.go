@@ -0,0 +1,257 @@
+package server
+
+import (
+	"io"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_OIDC_Login(t *testing.T) {
+	idp := newTestOIDCServer(t)
+	conf := idp.config(newTestConfigWithAuthFile(t))
+	conf.OIDCAdminGroups = []string{"ntfy-admins"}
+	conf.OIDCTierGroups = []*OIDCTierGroup{{Group: "ntfy-pro", Tier: "pro"}}
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", Name: "Pro"}))
+
+	response := request(t, s, "GET", "/config.js", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Contains(t, response.Body.String(), `"enable_oidc": true`)
+
+	// First login provisions the user, with role and tier derived from the groups
+	username, token := testOIDCLogin(t, s, idp, idp.claims("phil@example.com", "ntfy-pro"))
+	require.Equal(t, "phil@example.com", username)
+	require.True(t, strings.HasPrefix(token, "tk_"))
+	account := testOIDCAccount(t, s, token)
+	require.Equal(t, "phil@example.com", account.Username)
+	require.Equal(t, "user", account.Role)
+	require.Equal(t, "pro", account.Tier.Code)
+
+	// Group changes are applied on the next login
+	_, token = testOIDCLogin(t, s, idp, idp.claims("phil@example.com", "ntfy-admins"))
+	account = testOIDCAccount(t, s, token)
+	require.Equal(t, "admin", account.Role)
+	require.Nil(t, account.Tier)
+
+	u, err := s.userManager.User("phil@example.com")
+	require.Nil(t, err)
+	tokens, err := s.userManager.Tokens(u.ID)
+	require.Nil(t, err)
+	require.Len(t, tokens, 2)
+}
+
+func TestServer_OIDC_Login_BoundToSubject(t *testing.T) {
+	idp := newTestOIDCServer(t)
+	conf := idp.config(newTestConfigWithAuthFile(t))
+	conf.OIDCAdminGroups = []string{"ntfy-admins"}
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	// Local users (here: an admin) cannot be taken over by a user with the same name at the provider
+	response := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 302, response.Code)
+	response = request(t, s, "GET", idp.authorize(response.Header().Get("Location"), idp.claims("phil", "ntfy-admins")), "", map[string]string{
+		"Cookie": response.Header().Get("Set-Cookie"),
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40063, toHTTPError(t, response.Body.String()).Code)
+	phil, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	tokens, err := s.userManager.Tokens(phil.ID)
+	require.Nil(t, err)
+	require.Len(t, tokens, 0)
+
+	// The account is bound to the subject, so renaming the user at the provider does not change the account ...
+	username, _ := testOIDCLogin(t, s, idp, idp.claims("ben"))
+	require.Equal(t, "ben", username)
+	renamed := idp.claims("ben")
+	renamed["preferred_username"] = "benjamin"
+	username, token := testOIDCLogin(t, s, idp, renamed)
+	require.Equal(t, "ben", username)
+	require.Equal(t, "ben", testOIDCAccount(t, s, token).Username)
+
+	// ... and another subject with the same username is refused
+	other := idp.claims("ben")
+	other["sub"] = "sub-other"
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": "Bearer " + idp.token(t, other),
+	})
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_OIDC_Login_WebDisabled(t *testing.T) {
+	idp := newTestOIDCServer(t)
+	conf := idp.config(newTestConfigWithAuthFile(t))
+	conf.WebRoot = ""
+	s := newTestServer(t, conf)
+
+	response := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 302, response.Code)
+	response = request(t, s, "GET", idp.authorize(response.Header().Get("Location"), idp.claims("phil")), "", map[string]string{
+		"Cookie": response.Header().Get("Set-Cookie"),
+	})
+	require.Equal(t, 200, response.Code)
+	token, _ := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(response.Body))
+	require.Equal(t, "phil", testOIDCAccount(t, s, token.Token).Username)
+}
+
+func TestServer_OIDC_Callback_Invalid(t *testing.T) {
+	idp := newTestOIDCServer(t)
+	s := newTestServer(t, idp.config(newTestConfigWithAuthFile(t)))
+
+	// No cookie
+	response := request(t, s, "GET", "/v1/auth/oidc/callback?code=abc&state=def", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40063, toHTTPError(t, response.Body.String()).Code)
+
+	// State mismatch
+	response = request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 302, response.Code)
+	cookie := response.Header().Get("Set-Cookie")
+	require.Contains(t, cookie, "HttpOnly")
+	require.Contains(t, cookie, "Path=/v1/auth/oidc")
+	callback := idp.authorize(response.Header().Get("Location"), idp.claims("phil"))
+	response = request(t, s, "GET", strings.Replace(callback, "state=", "state=x", 1), "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40063, toHTTPError(t, response.Body.String()).Code)
+
+	// Code cannot be exchanged with another login's code verifier
+	response = request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 302, response.Code)
+	otherCookie := response.Header().Get("Set-Cookie")
+	otherState := testOIDCState(t, response.Header().Get("Location"))
+	callbackURL, err := url.Parse(callback)
+	require.Nil(t, err)
+	query := callbackURL.Query()
+	query.Set("state", otherState)
+	response = request(t, s, "GET", "/v1/auth/oidc/callback?"+query.Encode(), "", map[string]string{
+		"Cookie": otherCookie,
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40063, toHTTPError(t, response.Body.String()).Code)
+
+	// Error from identity provider
+	response = request(t, s, "GET", "/v1/auth/oidc/callback?error=access_denied&state="+otherState, "", map[string]string{
+		"Cookie": otherCookie,
+	})
+	require.Equal(t, 400, response.Code)
+	require.Contains(t, toHTTPError(t, response.Body.String()).Message, "access_denied")
+
+	_, err = s.userManager.User("phil")
+	require.Equal(t, user.ErrUserNotFound, err)
+}
+
+func TestServer_OIDC_BearerToken(t *testing.T) {
+	idp := newTestOIDCServer(t)
+	conf := idp.config(newTestConfigWithAuthFile(t))
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.OIDCAudience = "ntfy-api"
+	conf.OIDCAdminGroups = []string{"ntfy-admins"}
+	s := newTestServer(t, conf)
+
+	// Access tokens issued by the provider are accepted, and provision the user
+	claims := idp.claims("ben", "ntfy-admins")
+	claims["aud"] = "ntfy-api"
+	token := idp.tokenWithKey(t, "ES256", idp.ecKey, "ec-key", claims)
+	response := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": "Bearer " + token,
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "admin", testOIDCAccount(t, s, token).Role)
+
+	// Basic auth with empty username works too, like ntfy tokens
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("", token),
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Expired tokens, and tokens for other audiences (e.g. ID tokens) are rejected
+	expired := idp.claims("ben")
+	expired["aud"] = "ntfy-api"
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	for _, invalid := range []string{idp.token(t, expired), idp.token(t, idp.claims("ben"))} {
+		response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Authorization": "Bearer " + invalid,
+		})
+		require.Equal(t, 401, response.Code)
+	}
+
+	// ntfy tokens still work
+	u, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	ntfyToken, err := s.userManager.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.MustParseAddr("9.9.9.9"))
+	require.Nil(t, err)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": "Bearer " + ntfyToken.Value,
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Tokens without groups claim are treated like tokens without groups
+	noGroups := idp.claims("ben")
+	noGroups["aud"] = "ntfy-api"
+	delete(noGroups, "groups")
+	require.Equal(t, "user", testOIDCAccount(t, s, idp.token(t, noGroups)).Role)
+}
+
+func TestServer_OIDC_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	response := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "GET", "/config.js", "", nil)
+	require.Contains(t, response.Body.String(), `"enable_oidc": false`)
+}
+
+func TestParseOIDCTierGroup(t *testing.T) {
+	tierGroup, err := ParseOIDCTierGroup("ntfy-pro = pro")
+	require.Nil(t, err)
+	require.Equal(t, &OIDCTierGroup{Group: "ntfy-pro", Tier: "pro"}, tierGroup)
+
+	_, err = ParseOIDCTierGroup("ntfy-pro")
+	require.Error(t, err)
+	_, err = ParseOIDCTierGroup("=pro")
+	require.Error(t, err)
+}
+
+// testOIDCLogin runs through the login flow, and returns the username and token from the redirect to the web app
+func testOIDCLogin(t *testing.T, s *Server, idp *testOIDCServer, claims map[string]any) (string, string) {
+	response := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 302, response.Code)
+	callback := idp.authorize(response.Header().Get("Location"), claims)
+	require.True(t, strings.HasPrefix(callback, "http://127.0.0.1:12345/v1/auth/oidc/callback?"))
+	response = request(t, s, "GET", callback, "", map[string]string{
+		"Cookie": response.Header().Get("Set-Cookie"),
+	})
+	require.Equal(t, 302, response.Code)
+	require.Contains(t, response.Header().Get("Set-Cookie"), "Max-Age=0")
+	location, err := url.Parse(response.Header().Get("Location"))
+	require.Nil(t, err)
+	require.Equal(t, "/login", location.Path)
+	fragment, err := url.ParseQuery(location.Fragment)
+	require.Nil(t, err)
+	return fragment.Get("username"), fragment.Get("token")
+}
+
+func testOIDCAccount(t *testing.T, s *Server, token string) *apiAccountResponse {
+	response := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": "Bearer " + token,
+	})
+	require.Equal(t, 200, response.Code)
+	account, err := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	return account
+}
+
+func testOIDCState(t *testing.T, authorizationURL string) string {
+	u, err := url.Parse(authorizationURL)
+	require.Nil(t, err)
+	return u.Query().Get("state")
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// quietHoursBacklog counts the push notifications of a topic that were held back for a user
+// during quiet hours. If the user's schedule asks for it, a summary is sent when the quiet hours end.
+type quietHoursBacklog struct {
+	userID   string
+	topic    string
+	messages map[string]struct{} // IDs of held back messages, a message may be held back from multiple transports
+	firebase bool                // Held back from Firebase/upstream, because the user owns the topic
+	webPush  bool                // Held back from the user's Web Push subscriptions
+}
+
+// quietHours returns the active quiet hours schedule of the given user, or nil if the message should be
+// delivered. Only regular messages are ever held back; keepalive and poll request messages are always delivered.
+func (s *Server) quietHours(u *user.User, m *message) *user.QuietHours {
+	if u == nil || m.Event != messageEvent {
+		return nil
+	}
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3
+	}
+	return u.ActiveQuietHours(time.Now(), priority)
+}
+
+// topicOwnerQuietHours returns the topic owner and their active quiet hours schedule, if the topic is reserved.
+// Firebase and upstream messages are sent to all subscribers of a topic, so only the owner's schedule applies.
+func (s *Server) topicOwnerQuietHours(v *visitor, m *message) (*user.User, *user.QuietHours) {
+	if s.userManager == nil || m.Event != messageEvent {
+		return nil, nil
+	}
+	ownerID, err := s.userManager.ReservationOwner(m.Topic)
+	if err != nil {
+		logvm(v, m).Err(err).Warn("Unable to determine topic owner for quiet hours")
+		return nil, nil
+	} else if ownerID == "" {
+		return nil, nil
+	}
+	owner, err := s.userManager.UserByID(ownerID)
+	if err != nil {
+		logvm(v, m).Err(err).Warn("Unable to determine topic owner for quiet hours")
+		return nil, nil
+	}
+	return owner, s.quietHours(owner, m)
+}
+
+// holdForQuietHours records a held back push notification, so that a summary can be sent once the
+// quiet hours end (if the schedule asks for it)
+func (s *Server) holdForQuietHours(u *user.User, q *user.QuietHours, m *message, firebase, webPush bool) {
+	if !q.Summary {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", u.ID, m.Topic)
+	backlog, ok := s.quietHoursBacklogs[key]
+	if !ok {
+		backlog = &quietHoursBacklog{
+			userID:   u.ID,
+			topic:    m.Topic,
+			messages: make(map[string]struct{}),
+		}
+		s.quietHoursBacklogs[key] = backlog
+	}
+	backlog.messages[m.ID] = struct{}{}
+	backlog.firebase = backlog.firebase || firebase
+	backlog.webPush = backlog.webPush || webPush
+}
+
+// sendQuietHoursSummaries sends a summary notification for all held back notifications of users whose
+// quiet hours have ended. It is called periodically by the manager.
+func (s *Server) sendQuietHoursSummaries() {
+	if s.userManager == nil {
+		return
+	}
+	s.mu.RLock()
+	backlogs := make([]*quietHoursBacklog, 0)
+	for _, backlog := range s.quietHoursBacklogs {
+		backlogs = append(backlogs, backlog)
+	}
+	s.mu.RUnlock()
+	for _, backlog := range backlogs {
+		ev := log.Tag(tagQuietHours).Fields(log.Context{
+			"user_id":       backlog.userID,
+			"message_topic": backlog.topic,
+		})
+		u, err := s.userManager.UserByID(backlog.userID)
+		if err != nil {
+			ev.Err(err).Warn("Unable to retrieve user, discarding quiet hours summary")
+			s.removeQuietHoursBacklog(backlog)
+			continue
+		} else if u.ActiveQuietHours(time.Now(), 0) != nil {
+			continue // Still quiet
+		}
+		count := s.removeQuietHoursBacklog(backlog)
+		ev.Debug("Sending quiet hours summary for %d message(s)", count)
+		v := s.visitor(netip.IPv4Unspecified(), u)
+		m := newQuietHoursSummaryMessage(backlog.topic, count)
+		if backlog.firebase && s.firebaseClient != nil {
+			go s.sendToFirebase(v, m)
+		}
+		if backlog.webPush && s.config.WebPushPublicKey != "" {
+			go s.publishToUserWebPushEndpoints(v, m, u.ID)
+		}
+	}
+}
+
+// removeQuietHoursBacklog removes the backlog and returns the number of held back messages
+func (s *Server) removeQuietHoursBacklog(backlog *quietHoursBacklog) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.quietHoursBacklogs, fmt.Sprintf("%s/%s", backlog.userID, backlog.topic))
+	return len(backlog.messages)
+}
+
+func newQuietHoursSummaryMessage(topic string, count int) *message {
+	m := newDefaultMessage(topic, fmt.Sprintf("%d message(s) were published to %s during your quiet hours", count, topic))
+	m.Title = "Quiet hours ended"
+	return m
+}
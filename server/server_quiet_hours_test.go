@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_QuietHours_SettingsChange(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	rr := request(t, s, "PATCH", "/v1/account/settings", `{"notification": {"quiet_hours": [{"start":"22:00","end":"07:00","timezone":"Europe/Berlin","days":["mon","tue"],"min_priority":5,"summary":true}]}}`, headers)
+	require.Equal(t, 200, rr.Code)
+	account := getAccount(t, s, "phil", "phil")
+	require.Equal(t, 1, len(account.Notification.QuietHours))
+	require.Equal(t, &user.QuietHours{
+		Start:       "22:00",
+		End:         "07:00",
+		Timezone:    "Europe/Berlin",
+		Days:        []string{"mon", "tue"},
+		MinPriority: 5,
+		Summary:     true,
+	}, account.Notification.QuietHours[0])
+
+	for _, body := range []string{
+		`{"notification": {"quiet_hours": [{"start":"22:00","end":"25:00"}]}}`,
+		`{"notification": {"quiet_hours": [{"start":"22:00","end":"22:00"}]}}`,
+		`{"notification": {"quiet_hours": [{"start":"22:00","end":"07:00","timezone":"Mars/Olympus"}]}}`,
+		`{"notification": {"quiet_hours": [{"start":"22:00","end":"07:00","days":["someday"]}]}}`,
+		`{"notification": {"quiet_hours": [{"start":"22:00","end":"07:00","min_priority":6}]}}`,
+	} {
+		rr = request(t, s, "PATCH", "/v1/account/settings", body, headers)
+		require.Equal(t, 400, rr.Code, body)
+		require.Equal(t, 40052, toHTTPError(t, rr.Body.String()).Code, body)
+	}
+
+	rr = request(t, s, "PATCH", "/v1/account/settings", `{"notification": {"quiet_hours": []}}`, headers)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, 0, len(getAccount(t, s, "phil", "phil").Notification.QuietHours))
+}
+
+func TestServer_QuietHours_WebPushWithSummary(t *testing.T) {
+	conf := newTestConfigWithWebPush(t)
+	conf.AuthFile = newTestConfigWithAuthFile(t).AuthFile
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+
+	var received atomic.Int32
+	pushService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		received.Add(1)
+	}))
+	defer pushService.Close()
+	require.Nil(t, s.webPush.UpsertSubscription(pushService.URL+"/push-receive", "kSC3T8aN1JCQxxPdrFLrZg", "BMKKbxdUU_xLS7G1Wh5AN8PvWOjCzkCuKZYb8apcqYrDxjOF_2piggBnoJLQYx9IeSD70fNuwawI3e9Y8m3S3PE", u.ID, netip.MustParseAddr("1.2.3.4"), []string{"mytopic"}))
+
+	// Quiet hours active: only urgent messages are delivered
+	now := time.Now().UTC()
+	require.Nil(t, s.userManager.ChangeSettings(u.ID, &user.Prefs{
+		Notification: &user.NotificationPrefs{
+			QuietHours: []*user.QuietHours{
+				{Start: now.Add(-time.Hour).Format("15:04"), End: now.Add(time.Hour).Format("15:04"), MinPriority: 5, Summary: true},
+			},
+		},
+	}))
+	request(t, s, "PUT", "/mytopic", "message 1", nil)
+	request(t, s, "PUT", "/mytopic", "message 2", nil)
+	request(t, s, "PUT", "/mytopic", "urgent message", map[string]string{"Priority": "5"})
+	waitFor(t, func() bool {
+		return received.Load() == 1
+	})
+
+	// Messages are still cached
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 3, len(toMessages(t, response.Body.String())))
+
+	// No summary while quiet hours are active
+	s.sendQuietHoursSummaries()
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(1), received.Load())
+
+	// Summary is sent after quiet hours ended
+	require.Nil(t, s.userManager.ChangeSettings(u.ID, &user.Prefs{
+		Notification: &user.NotificationPrefs{
+			QuietHours: []*user.QuietHours{
+				{Start: now.Add(2 * time.Hour).Format("15:04"), End: now.Add(3 * time.Hour).Format("15:04"), Summary: true},
+			},
+		},
+	}))
+	s.sendQuietHoursSummaries()
+	waitFor(t, func() bool {
+		return received.Load() == 2
+	})
+	require.Equal(t, 0, len(s.quietHoursBacklogs))
+}
+
+func TestServer_QuietHours_SummaryMessage(t *testing.T) {
+	m := newQuietHoursSummaryMessage("mytopic", 12)
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, "Quiet hours ended", m.Title)
+	require.Equal(t, "12 message(s) were published to mytopic during your quiet hours", m.Message)
+}
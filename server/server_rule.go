@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	// ruleMaxHops is the max. number of topics a message can pass through via routing rules, including
+	// the topic it was originally published to. Together with the loop detection, this bounds the fan-out.
+	ruleMaxHops = 4
+)
+
+// ValidateRule checks that the filter expression and the template of a routing rule can be parsed.
+// It is used by the admin API and the "ntfy rule" command before a rule is stored.
+func ValidateRule(rule *user.Rule) error {
+	if rule.Filter != "" {
+		if _, err := parseFilter(rule.Filter); err != nil {
+			return fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+	if rule.Template != "" {
+		sample, err := json.Marshal(newDefaultMessage(rule.Target, "This is a test message"))
+		if err != nil {
+			return err
+		}
+		if _, err := replaceTemplate(rule.Template, string(sample)); err != nil {
+			return fmt.Errorf("invalid template: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleRulesGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	rules, err := s.userManager.Rules()
+	if err != nil {
+		return err
+	}
+	response := make([]*apiRuleResponse, len(rules))
+	for i, rule := range rules {
+		response[i] = newAPIRuleResponse(rule)
+	}
+	return s.writeJSON(w, response)
+}
+
+func (s *Server) handleRulesAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiRuleAddRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	rule := &user.Rule{
+		Topic:     req.Topic,
+		Target:    req.Target,
+		Filter:    req.Filter,
+		Template:  req.Template,
+		RateLimit: req.RateLimit,
+	}
+	if err := ValidateRule(rule); err != nil {
+		return errHTTPBadRequestRuleInvalid.Wrap("%s", err.Error())
+	}
+	logvr(v, r).
+		Tag(tagRule).
+		Fields(log.Context{
+			"rule_topic":  rule.Topic,
+			"rule_target": rule.Target,
+		}).
+		Debug("Adding routing rule")
+	if err := s.userManager.AddRule(rule); errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestRuleInvalid
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newAPIRuleResponse(rule))
+}
+
+func (s *Server) handleRulesDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiRuleDeleteRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagRule).Field("rule_id", req.ID).Debug("Removing routing rule")
+	if err := s.userManager.RemoveRule(req.ID); errors.Is(err, user.ErrRuleNotFound) || errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPNotFoundRule
+	} else if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.ruleFilters, req.ID)
+	s.mu.Unlock()
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// routeMessage republishes a message to the target topics of all matching routing rules. Routed messages are
+// routed again, unless the target topic was already visited by the message (loop detection), or ruleMaxHops is
+// reached. Routed messages count against the per-rule rate limit of the visitor that published the original message.
+func (s *Server) routeMessage(v *visitor, m *message, cache bool, visited []string) {
+	if s.userManager == nil || m.Event != messageEvent {
+		return
+	}
+	visited = append(slices.Clone(visited), m.Topic)
+	if len(visited) >= ruleMaxHops {
+		logvm(v, m).Tag(tagRule).Debug("Not routing message, max hops reached (%s)", visited)
+		return
+	}
+	rules, err := s.userManager.RulesForTopic(m.Topic)
+	if err != nil {
+		logvm(v, m).Tag(tagRule).Err(err).Warn("Unable to retrieve routing rules")
+		return
+	}
+	for _, rule := range rules {
+		ev := logvm(v, m).Tag(tagRule).Fields(log.Context{
+			"rule_id":     rule.ID,
+			"rule_target": rule.Target,
+		})
+		if slices.Contains(visited, rule.Target) {
+			ev.Debug("Not routing message, loop detected (%s)", visited)
+			continue
+		}
+		if expr, err := s.ruleFilter(rule); err != nil {
+			ev.Err(err).Warn("Invalid filter in routing rule")
+			continue
+		} else if expr != nil && !expr.Matches(m) {
+			continue
+		}
+		if !v.RuleAllowed(rule.ID, rule.RateLimit) {
+			ev.Info("Not routing message, rule rate limit reached")
+			continue
+		}
+		routed, err := newRoutedMessage(rule, m)
+		if err != nil {
+			ev.Err(err).Warn("Unable to render routing rule template")
+			continue
+		}
+		ev.Debug("Routing message to %s", rule.Target)
+		if err := s.publishRoutedMessage(v, routed, cache); err != nil {
+			ev.Err(err).Warn("Unable to publish routed message")
+			continue
+		}
+		s.routeMessage(v, routed, cache, visited)
+	}
+}
+
+// ruleFilter returns the parsed filter expression of the rule, or nil if the rule has no filter. Since rules cannot
+// be changed, only added and removed, each filter is parsed only once, the first time the rule is loaded.
+func (s *Server) ruleFilter(rule *user.Rule) (filterExpr, error) {
+	if rule.Filter == "" {
+		return nil, nil
+	}
+	s.mu.RLock()
+	expr, ok := s.ruleFilters[rule.ID]
+	s.mu.RUnlock()
+	if ok {
+		return expr, nil
+	}
+	expr, err := parseFilter(rule.Filter)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.ruleFilters[rule.ID] = expr
+	s.mu.Unlock()
+	return expr, nil
+}
+
+// publishRoutedMessage publishes a routed, escalated or federated message to subscribers, push transports and
+// federation peers, similar to a delayed message
+func (s *Server) publishRoutedMessage(v *visitor, m *message, cache bool) error {
+	t, err := s.topicFromID(m.Topic)
+	if err != nil {
+		return err
+	}
+	if err := t.Publish(v, m); err != nil {
+		return err
+	}
+	s.publishToCluster(v, m, false)
+	digested := s.maybeEnqueueDigest(v, m, true)
+	if s.firebaseClient != nil && !digested {
+		go s.sendToFirebase(v, m)
+	}
+	if s.config.UpstreamBaseURL != "" && !digested {
+		go s.forwardPollRequest(v, m)
+	}
+	if s.config.WebPushPublicKey != "" && !digested {
+		go s.publishToWebPushEndpoints(v, m)
+	}
+	if s.config.EnableWebhooks {
+		go s.enqueueWebhooks(v, m)
+	}
+	s.enqueueFederationPushes(v, m)
+	if cache {
+		if err := s.messageCache.AddMessage(m); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.messages++
+	s.mu.Unlock()
+	return nil
+}
+
+// newRoutedMessage creates a copy of the message for the rule's target topic, with a new ID. If the rule
+// has a template, the message text is rendered from the original message (as JSON), unless the message is encrypted.
+//
+// Attachments that were uploaded to the server are not copied, since the file belongs to the original message: it would
+// count twice towards the publisher's attachment limits, and is removed along with the original message. External
+// attachments (URLs) are copied as is.
+func newRoutedMessage(rule *user.Rule, m *message) (*message, error) {
+	routed := newDefaultMessage(rule.Target, m.Message)
+	routed.Expires = m.Expires
+	routed.Title = m.Title
+	routed.Priority = m.Priority
+	routed.Tags = m.Tags
+	routed.Click = m.Click
+	routed.Icon = m.Icon
+	routed.Actions = m.Actions
+	if m.Attachment != nil && m.Attachment.Expires == 0 { // Only external attachments, see above
+		attachment := *m.Attachment
+		routed.Attachment = &attachment
+	}
+	routed.ContentType = m.ContentType
+	routed.Encoding = m.Encoding
+	routed.Sender = m.Sender
+	routed.User = m.User
+	if rule.Template != "" && m.Encoding != encodingJWE { // Encrypted messages are routed as is
+		source, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		routed.Message, err = replaceTemplate(rule.Template, string(source))
+		if err != nil {
+			return nil, err
+		}
+		routed.Encoding = ""
+	}
+	return routed, nil
+}
+
+func newAPIRuleResponse(rule *user.Rule) *apiRuleResponse {
+	return &apiRuleResponse{
+		ID:        rule.ID,
+		Topic:     rule.Topic,
+		Target:    rule.Target,
+		Filter:    rule.Filter,
+		Template:  rule.Template,
+		RateLimit: rule.RateLimit,
+	}
+}
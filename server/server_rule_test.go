@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_Rules_AdminAPI(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Add rule
+	rr := request(t, s, "POST", "/v1/rules", `{"topic":"ci-*","target":"oncall","filter":"priority>=4"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	var rule apiRuleResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&rule))
+	require.Equal(t, "ci-*", rule.Topic)
+	require.Equal(t, "oncall", rule.Target)
+	require.Equal(t, "priority>=4", rule.Filter)
+	require.Equal(t, 60, rule.RateLimit)
+
+	// List rules
+	rr = request(t, s, "GET", "/v1/rules", "", admin)
+	require.Equal(t, 200, rr.Code)
+	var rules []*apiRuleResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&rules))
+	require.Equal(t, 1, len(rules))
+	require.Equal(t, rule.ID, rules[0].ID)
+
+	// Regular users cannot manage rules
+	rr = request(t, s, "GET", "/v1/rules", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Delete rule
+	rr = request(t, s, "DELETE", "/v1/rules", `{"id":"`+rule.ID+`"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "DELETE", "/v1/rules", `{"id":"`+rule.ID+`"}`, admin)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, 40404, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_Rules_AdminAPI_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	for _, body := range []string{
+		`{"topic":"ci-*","target":"oncall","filter":"priority>>4"}`,
+		`{"topic":"ci-*","target":"oncall","template":"{{.title"}`,
+		`{"topic":"ci-*","target":"on*"}`,
+		`{"topic":"","target":"oncall"}`,
+		`{"topic":"ci-*","target":"oncall","rate_limit":-1}`,
+	} {
+		rr := request(t, s, "POST", "/v1/rules", body, admin)
+		require.Equal(t, 400, rr.Code, body)
+		require.Equal(t, 40051, toHTTPError(t, rr.Body.String()).Code, body)
+	}
+}
+
+func TestServer_Rules_RouteWithFilterAndTemplate(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddRule(&user.Rule{Topic: "ci-*", Target: "oncall", Filter: "priority>=4"}))
+	require.Nil(t, s.userManager.AddRule(&user.Rule{Topic: "alerts", Target: "dba-team", Filter: "tags~db", Template: "{{.topic}}: {{.message}}"}))
+
+	request(t, s, "PUT", "/ci-build", "build failed", map[string]string{"Priority": "5", "Title": "CI"})
+	request(t, s, "PUT", "/ci-build", "build succeeded", map[string]string{"Priority": "2"})
+	request(t, s, "PUT", "/alerts", "replica lag", map[string]string{"Tags": "db,warning"})
+	request(t, s, "PUT", "/alerts", "disk full", map[string]string{"Tags": "disk"})
+
+	response := request(t, s, "GET", "/oncall/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "build failed", messages[0].Message)
+	require.Equal(t, "CI", messages[0].Title)
+	require.Equal(t, 5, messages[0].Priority)
+
+	response = request(t, s, "GET", "/dba-team/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "alerts: replica lag", messages[0].Message)
+	require.Equal(t, []string{"db", "warning"}, messages[0].Tags)
+}
+
+func TestServer_Rules_LoopDetection(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddRule(&user.Rule{Topic: "a", Target: "b"}))
+	require.Nil(t, s.userManager.AddRule(&user.Rule{Topic: "b", Target: "a"}))
+	require.Nil(t, s.userManager.AddRule(&user.Rule{Topic: "b", Target: "c"}))
+	require.Nil(t, s.userManager.AddRule(&user.Rule{Topic: "c", Target: "d"}))
+	require.Nil(t, s.userManager.AddRule(&user.Rule{Topic: "d", Target: "e"}))
+
+	request(t, s, "PUT", "/a", "ping", nil)
+	for topic, count := range map[string]int{"a": 1, "b": 1, "c": 1, "d": 1, "e": 0} {
+		response := request(t, s, "GET", "/"+topic+"/json?poll=1", "", nil)
+		require.Equal(t, count, len(toMessages(t, response.Body.String())), topic)
+	}
+}
+
+func TestServer_Rules_RateLimit(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddRule(&user.Rule{Topic: "source", Target: "target", RateLimit: 2}))
+
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "PUT", "/source", "message", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "GET", "/source/json?poll=1", "", nil)
+	require.Equal(t, 5, len(toMessages(t, response.Body.String())))
+	response = request(t, s, "GET", "/target/json?poll=1", "", nil)
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+
+	// Other publishers have their own limit
+	response = request(t, s, "PUT", "/source", "message", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4:1234"
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/target/json?poll=1", "", nil)
+	require.Equal(t, 3, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_Rules_FilterParsedOnce(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	rule := &user.Rule{Topic: "ci-*", Target: "oncall", Filter: "priority>=4"}
+	require.Nil(t, s.userManager.AddRule(rule))
+
+	request(t, s, "PUT", "/ci-build", "build failed", map[string]string{"Priority": "5"})
+	expr := s.ruleFilters[rule.ID]
+	require.NotNil(t, expr)
+	request(t, s, "PUT", "/ci-build", "build failed again", map[string]string{"Priority": "5"})
+	require.Same(t, expr, s.ruleFilters[rule.ID])
+
+	response := request(t, s, "GET", "/oncall/json?poll=1", "", nil)
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+
+	// Filter is forgotten when the rule is removed
+	rr := request(t, s, "DELETE", "/v1/rules", `{"id":"`+rule.ID+`"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Empty(t, s.ruleFilters)
+}
+
+func TestServer_Rules_RouteWithAttachment(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddRule(&user.Rule{Topic: "source", Target: "target"}))
+
+	// Uploaded attachments are not copied
+	response := request(t, s, "PUT", "/source", "some file", map[string]string{"Filename": "file.txt"})
+	require.Equal(t, 200, response.Code)
+	require.NotNil(t, toMessage(t, response.Body.String()).Attachment)
+
+	// External attachments are copied
+	response = request(t, s, "PUT", "/source", "some link", map[string]string{"Attach": "https://example.com/file.jpg"})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/target/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "You received a file: file.txt", messages[0].Message)
+	require.Nil(t, messages[0].Attachment)
+	require.Equal(t, "https://example.com/file.jpg", messages[1].Attachment.URL)
+	require.Equal(t, "file.jpg", messages[1].Attachment.Name)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	searchLimitDefault = 50
+	searchLimitMax     = 200
+)
+
+// handleSearch searches the cached messages of one or more topics (GET /v1/search). Parameters:
+//
+//   - topic: comma-separated list of topics to search (required); the visitor must have read access to all of them
+//   - q: free text to search for in the message, title and tags; all words must match (optional)
+//   - since/until: time range, as Unix timestamp or duration (e.g. "2d" for two days ago) (optional)
+//   - limit: maximum number of messages to return (optional, default 50, max 200)
+//   - cursor: next_cursor value of the previous response, to get the next page (optional)
+//
+// Messages are returned newest first.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	search, err := parseSearchParams(r)
+	if err != nil {
+		return err
+	}
+	if s.config.EncryptionKeyFile != "" && strings.TrimSpace(search.Text) != "" {
+		return errHTTPBadRequestSearchTextNotSupported // Message fields are encrypted in the database, see keyring
+	}
+	topics, err := s.topicsFromIDs(search.Topics...)
+	if err != nil {
+		return err
+	}
+	if s.userManager != nil {
+		if err := s.authorizeTopics(r, v, topics, user.PermissionRead); err != nil {
+			return err
+		}
+	}
+	search.Limit++ // Fetch one more message to determine if there is a next page
+	messages, err := s.messageCache.Search(search)
+	if err != nil {
+		return err
+	}
+	response := &apiSearchResponse{
+		Messages: messages,
+	}
+	if len(messages) == search.Limit {
+		response.Messages = messages[:len(messages)-1]
+		last := response.Messages[len(response.Messages)-1]
+		response.NextCursor = encodeSearchCursor(&searchCursor{Time: last.Time, ID: last.ID})
+	}
+	logvr(v, r).
+		Tag(tagSearch).
+		Fields(map[string]any{
+			"search_topics":   strings.Join(search.Topics, ","),
+			"search_messages": len(response.Messages),
+		}).
+		Debug("Searched messages")
+	return s.writeJSON(w, response)
+}
+
+func parseSearchParams(r *http.Request) (*messageSearch, error) {
+	topicIDs := util.SplitNoEmpty(readQueryParam(r, "topic", "topics"), ",")
+	if len(topicIDs) == 0 {
+		return nil, errHTTPBadRequestSearchInvalid.Wrap("topic is required")
+	}
+	for _, topicID := range topicIDs {
+		if !topicRegex.MatchString(topicID) {
+			return nil, errHTTPBadRequestTopicInvalid
+		}
+	}
+	now := time.Now()
+	since, err := parseSearchTime(readQueryParam(r, "since"), time.Unix(0, 0), now)
+	if err != nil {
+		return nil, errHTTPBadRequestSearchInvalid.Wrap("invalid since parameter")
+	}
+	until, err := parseSearchTime(readQueryParam(r, "until"), now, now)
+	if err != nil {
+		return nil, errHTTPBadRequestSearchInvalid.Wrap("invalid until parameter")
+	}
+	limit := searchLimitDefault
+	if limitStr := readQueryParam(r, "limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > searchLimitMax {
+			return nil, errHTTPBadRequestSearchInvalid.Wrap("limit must be between 1 and %d", searchLimitMax)
+		}
+	}
+	var cursor *searchCursor
+	if cursorStr := readQueryParam(r, "cursor"); cursorStr != "" {
+		cursor, err = decodeSearchCursor(cursorStr)
+		if err != nil {
+			return nil, errHTTPBadRequestSearchInvalid.Wrap("invalid cursor")
+		}
+	}
+	return &messageSearch{
+		Topics: topicIDs,
+		Text:   readQueryParam(r, "q"),
+		Since:  since,
+		Until:  until,
+		Cursor: cursor,
+		Limit:  limit,
+	}, nil
+}
+
+// parseSearchTime parses a Unix timestamp, or a duration relative to now (e.g. "2d" for two days ago).
+// If the value is empty, the default is returned.
+func parseSearchTime(value string, defaultValue, now time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultValue, nil
+	} else if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(timestamp, 0), nil
+	}
+	d, err := util.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(-1 * d), nil
+}
+
+func encodeSearchCursor(c *searchCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", c.Time, c.ID)))
+}
+
+func decodeSearchCursor(s string) (*searchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	timeStr, id, found := strings.Cut(string(b), ":")
+	if !found || !validMessageID(id) {
+		return nil, errHTTPBadRequestSearchInvalid
+	}
+	t, err := strconv.ParseInt(timeStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &searchCursor{Time: t, ID: id}, nil
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
@@ -9,10 +10,14 @@ import (
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"heckel.io/ntfy/v2/user"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime/debug"
@@ -777,6 +782,83 @@ func TestServer_SubscribeWithQueryFilters(t *testing.T) {
 	require.Equal(t, keepaliveEvent, messages[2].Event)
 }
 
+func TestServer_PollWithFilterExpression(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/mytopic?tags=backup,error&priority=5&title=Backup+failed", "Backup of /home failed", nil)
+	request(t, s, "PUT", "/mytopic?tags=backup&title=Backup+succeeded", "Dry run completed", nil)
+	request(t, s, "PUT", "/mytopic?priority=2", "Hello world", nil)
+
+	queries := map[string][]string{
+		`priority>=4`:                                    {"Backup of /home failed"},
+		`title~backup AND NOT tags~error`:                {"Dry run completed"},
+		`tags!~backup OR message=~"^Backup of /\w+ "`:    {"Backup of /home failed", "Hello world"},
+		`(priority<3 || priority=max) && !title~succeed`: {"Backup of /home failed", "Hello world"},
+		`message~"dry run"`:                              {"Dry run completed"},
+		`tags~warning,info`:                              {},
+	}
+	for filter, expected := range queries {
+		response := request(t, s, "GET", "/mytopic/json?poll=1&filter="+url.QueryEscape(filter), "", nil)
+		require.Equal(t, 200, response.Code, filter)
+		messages := toMessages(t, response.Body.String())
+		require.Equal(t, len(expected), len(messages), "Filter failed: "+filter)
+		for i, m := range messages {
+			require.Equal(t, expected[i], m.Message, "Filter failed: "+filter)
+		}
+	}
+
+	// Header, combined with the classic query filters
+	response := request(t, s, "GET", "/mytopic/json?poll=1&tags=backup", "", map[string]string{
+		"X-Filter": "priority<=3",
+	})
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Dry run completed", messages[0].Message)
+}
+
+func TestServer_SubscribeWithFilterExpression(t *testing.T) {
+	t.Parallel()
+	c := newTestConfig(t)
+	c.KeepaliveInterval = 800 * time.Millisecond
+	s := newTestServer(t, c)
+
+	request(t, s, "PUT", "/mytopic?priority=5", "old urgent message", nil)
+	request(t, s, "PUT", "/mytopic", "old normal message", nil)
+
+	subscribeResponse := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/sse?since=all&filter="+url.QueryEscape("priority>=4 OR title~zfs"), subscribeResponse)
+
+	response := request(t, s, "PUT", "/mytopic", "my first message", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "ZFS scrub failed", map[string]string{
+		"Title": "ZFS pool",
+	})
+	require.Equal(t, 200, response.Code)
+
+	time.Sleep(850 * time.Millisecond)
+	subscribeCancel()
+
+	body := subscribeResponse.Body.String()
+	require.Contains(t, body, "old urgent message")
+	require.Contains(t, body, "ZFS scrub failed")
+	require.NotContains(t, body, "old normal message")
+	require.NotContains(t, body, "my first message")
+}
+
+func TestServer_SubscribeWithFilterExpression_Invalid(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	for _, filter := range []string{"priority>=", "title~a AND", "foo=bar", "(title~a", `message=~"(unclosed"`} {
+		for _, format := range []string{"json", "sse", "raw"} {
+			response := request(t, s, "GET", "/mytopic/"+format+"?poll=1&filter="+url.QueryEscape(filter), "", nil)
+			require.Equal(t, 400, response.Code, filter)
+			require.Equal(t, 40049, toHTTPError(t, response.Body.String()).Code, filter)
+		}
+	}
+}
+
 func TestServer_Auth_Success_Admin(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
 	s := newTestServer(t, c)
@@ -1408,6 +1490,152 @@ func TestServer_PublishUnifiedPushText(t *testing.T) {
 	require.Equal(t, "this is a unifiedpush text message", m.Message)
 }
 
+func TestServer_PublishEncrypted(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	jwe := "eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIn0..aXZpdml2aXZpdml2.Y2lwaGVydGV4dA.dGFndGFndGFndGFndGFn"
+
+	// Encrypted messages are stored and relayed as is
+	response := request(t, s, "PUT", "/mytopic", jwe, map[string]string{
+		"Encoding": "jwe",
+		"Priority": "high",
+		"Template": "yes", // Ignored, templates cannot be rendered for encrypted messages
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, encodingJWE, m.Encoding)
+	require.Equal(t, jwe, m.Message)
+	require.Equal(t, 4, m.Priority)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, encodingJWE, messages[0].Encoding)
+	require.Equal(t, jwe, messages[0].Message)
+
+	// Publishing via GET and as JSON
+	response = request(t, s, "GET", "/mytopic/publish?encoding=jwe&message="+jwe, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, jwe, toMessage(t, response.Body.String()).Message)
+	response = request(t, s, "PUT", "/", `{"topic":"mytopic","message":"`+jwe+`","encoding":"jwe"}`, nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, encodingJWE, toMessage(t, response.Body.String()).Encoding)
+}
+
+func TestServer_PublishEncrypted_Invalid(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageSizeLimit = 100
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "not encrypted", map[string]string{"Encoding": "jwe"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40057, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "eyJhbGciOiJkaXIifQ....", map[string]string{"Encoding": "jwe"}) // Missing "enc"
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40057, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{"Encoding": "jwe"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40057, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "some message", map[string]string{"Encoding": "base64"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40056, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic?up=1", "some message", map[string]string{"Encoding": "jwe"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40056, toHTTPError(t, response.Body.String()).Code)
+
+	// Encrypted messages are never turned into attachments
+	response = request(t, s, "PUT", "/mytopic", "eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIn0.."+strings.Repeat("a", 100)+"..", map[string]string{"Encoding": "jwe"})
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, 41304, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishEncrypted_Attachment(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	jwe := "eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIn0..aXZpdml2aXZpdml2.Y2lwaGVydGV4dA.dGFndGFndGFndGFndGFn"
+	encryptedFile := "eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIn0..aXZpdml2aXZpdml2." + util.RandomString(5000) + ".dGFndGFndGFndGFndGFn"
+
+	response := request(t, s, "PUT", "/mytopic", encryptedFile, map[string]string{
+		"Encoding": "jwe",
+		"Filename": "attachment.jwe",
+		"Message":  jwe,
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, jwe, m.Message)
+	require.Equal(t, "attachment.jwe", m.Attachment.Name)
+	require.Equal(t, int64(len(encryptedFile)), m.Attachment.Size)
+
+	// The encrypted message is required, since it contains the attachment metadata
+	response = request(t, s, "PUT", "/mytopic", encryptedFile, map[string]string{
+		"Encoding": "jwe",
+		"Filename": "attachment.jwe",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40057, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishEncrypted_Filter(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	jwe := "eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIn0..aXZpdml2aXZpdml2.Y2lwaGVydGV4dA.dGFndGFndGFndGFndGFn"
+	request(t, s, "PUT", "/mytopic", "plain text", map[string]string{"Priority": "high"})
+	request(t, s, "PUT", "/mytopic", jwe, map[string]string{"Encoding": "jwe", "Priority": "high"})
+	request(t, s, "PUT", "/mytopic", jwe, map[string]string{"Encoding": "jwe", "Priority": "low"})
+
+	// Filters on the message text are ignored for encrypted messages, other filters still apply
+	response := request(t, s, "GET", "/mytopic/json?poll=1&message=backup", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, encodingJWE, messages[0].Encoding)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&filter="+url.QueryEscape("message~backup AND priority>=4"), "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, encodingJWE, messages[0].Encoding)
+	require.Equal(t, 4, messages[0].Priority)
+
+	// The title is encrypted as well, so title filters are ignored too, even if a plaintext title was passed
+	request(t, s, "PUT", "/othertopic", "plain text", map[string]string{"Title": "Backup"})
+	request(t, s, "PUT", "/othertopic", jwe, map[string]string{"Encoding": "jwe", "Title": "Backup"})
+	request(t, s, "PUT", "/othertopic", jwe, map[string]string{"Encoding": "jwe", "Title": "Something else"})
+	response = request(t, s, "GET", "/othertopic/json?poll=1&title=Backup", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+
+	response = request(t, s, "GET", "/othertopic/json?poll=1&title=Other", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, encodingJWE, messages[0].Encoding)
+	require.Equal(t, encodingJWE, messages[1].Encoding)
+
+	response = request(t, s, "GET", "/othertopic/json?poll=1&filter="+url.QueryEscape("title=Other"), "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, encodingJWE, messages[0].Encoding)
+}
+
+func TestServer_MessageUpdate_Encrypted(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	jwe1 := "eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIn0..aXZpdml2aXZpdml2.Y2lwaGVydGV4dA.dGFndGFndGFndGFndGFn"
+	jwe2 := "eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIn0..aXZpdml2aXZpdml2.b3RoZXJ0ZXh0.dGFndGFndGFndGFndGFn"
+
+	response := request(t, s, "PUT", "/mytopic", jwe1, map[string]string{"Encoding": "jwe"})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	response = request(t, s, "PUT", "/mytopic/"+m.ID, jwe2, map[string]string{"Encoding": "jwe"})
+	require.Equal(t, 200, response.Code)
+	updated := toMessage(t, response.Body.String())
+	require.Equal(t, jwe2, updated.Message)
+	require.Equal(t, encodingJWE, updated.Encoding)
+
+	response = request(t, s, "PUT", "/mytopic/"+m.ID, "plain text", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "", toMessage(t, response.Body.String()).Encoding)
+}
+
 func TestServer_MatrixGateway_Discovery_Success(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	response := request(t, s, "GET", "/_matrix/push/v1/notify", "", nil)
@@ -2135,6 +2363,210 @@ func TestServer_PublishAttachmentAccountStats(t *testing.T) {
 	require.Equal(t, int64(1), account.Stats.Messages)
 }
 
+func TestServer_PublishAttachment_S3(t *testing.T) {
+	content := "text file!" + util.RandomString(4990) // > 4096
+	s3Server, objects := newTestS3Server(t)
+	c := newTestConfig(t)
+	c.AttachmentCacheDir = ""
+	c.AttachmentS3URL = newTestS3URL(s3Server, "mybucket/attachments")
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", content, nil)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, int64(5000), msg.Attachment.Size)
+	require.Equal(t, content, objects.Get("/mybucket/attachments/"+msg.ID))
+
+	// GET is streamed through the server
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "5000", response.Header().Get("Content-Length"))
+	require.Equal(t, content, response.Body.String())
+
+	// Expired attachments are removed from the bucket
+	_, err := s.messageCache.db.Exec("UPDATE messages SET attachment_expires = 1 WHERE mid = ?", msg.ID)
+	require.Nil(t, err)
+	s.execManager()
+	require.Equal(t, 0, objects.Len())
+	require.Equal(t, 404, request(t, s, "GET", path, "", nil).Code)
+}
+
+func TestServer_PublishAttachment_S3_Redirect(t *testing.T) {
+	s3Server, _ := newTestS3Server(t)
+	c := newTestConfig(t)
+	c.AttachmentCacheDir = ""
+	c.AttachmentS3URL = newTestS3URL(s3Server, "mybucket")
+	c.AttachmentS3Redirect = true
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic?f=some file.txt", "this is an attachment", nil)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+
+	// GET redirects to a presigned URL, which can be downloaded directly from the bucket
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 302, response.Code)
+	location := response.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, s3Server.URL+"/mybucket/"+msg.ID+"?"))
+
+	resp, err := http.Get(location)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, `attachment; filename="some file.txt"`, resp.Header.Get("Content-Disposition"))
+	b, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "this is an attachment", string(b))
+
+	// HEAD is still answered by the server
+	response = request(t, s, "HEAD", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "21", response.Header().Get("Content-Length"))
+
+	// Unknown attachments are not redirected
+	require.Equal(t, 404, request(t, s, "GET", "/file/abcdefghijkl.txt", "", nil).Code)
+}
+
+func TestServer_PublishAttachment_TotalSizeFromDatabase(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentTotalSizeLimit = 10000
+	s := newTestServer(t, c)
+	content := util.RandomString(5000) // > 4096
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", content, nil).Code)
+	require.Equal(t, int64(5000), s.fileCache.Size())
+
+	// Another replica sharing the same database and storage picks up the size on startup
+	s2 := newTestServer(t, c)
+	require.Equal(t, int64(5000), s2.fileCache.Size())
+	require.Equal(t, 200, request(t, s2, "PUT", "/mytopic", content, nil).Code)
+	require.Equal(t, 413, request(t, s2, "PUT", "/mytopic", content, nil).Code)
+
+	// ... and after every manager run
+	s.execManager()
+	require.Equal(t, int64(10000), s.fileCache.Size())
+}
+
+func TestServer_PublishAttachment_ImageProcessing(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentImageProcessing = true
+	s := newTestServer(t, c)
+	content := testJPEGWithMetadata(t, testImage(640, 480, color.RGBA{R: 255, A: 255}), 1)
+
+	response := request(t, s, "PUT", "/mytopic?f=photo.jpg", string(content), nil)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "image/jpeg", msg.Attachment.Type)
+	require.Equal(t, "http://127.0.0.1:12345/file/"+msg.ID+".jpg", msg.Attachment.URL)
+	require.Equal(t, "http://127.0.0.1:12345/file/"+msg.ID+"_preview.jpg", msg.Attachment.Preview)
+	require.Less(t, msg.Attachment.Size, int64(len(content)))
+
+	// Metadata is stripped
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `attachment; filename="photo.jpg"`, response.Header().Get("Content-Disposition"))
+	require.NotContains(t, response.Body.String(), "Exif")
+	require.NotContains(t, response.Body.String(), "secret location")
+
+	// Preview is downscaled
+	previewPath := strings.TrimPrefix(msg.Attachment.Preview, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", previewPath, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "image/jpeg", response.Header().Get("Content-Type"))
+	require.Empty(t, response.Header().Get("Content-Disposition"))
+	preview, _, err := image.DecodeConfig(response.Body)
+	require.Nil(t, err)
+	require.Equal(t, 320, preview.Width)
+	require.Equal(t, 240, preview.Height)
+
+	// Preview is removed along with the attachment
+	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID+"_preview"))
+	_, err = s.messageCache.db.Exec("UPDATE messages SET attachment_expires = 1 WHERE mid = ?", msg.ID)
+	require.Nil(t, err)
+	s.execManager()
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID+"_preview"))
+	require.Equal(t, 404, request(t, s, "GET", previewPath, "", nil).Code)
+}
+
+func TestServer_PublishAttachment_ImageProcessing_Downscale(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentImageProcessing = true
+	c.AttachmentImageMaxDimension = 100
+	c.AttachmentFileSizeLimit = 100_000
+	s := newTestServer(t, c)
+
+	// Image with random pixels cannot be compressed, so it is larger than the file size limit
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	_, err := rand.Read(img.Pix)
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, img))
+	require.Greater(t, buf.Len(), 100_000)
+
+	response := request(t, s, "PUT", "/mytopic", buf.String(), nil)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "image/png", msg.Attachment.Type)
+	require.LessOrEqual(t, msg.Attachment.Size, int64(100_000))
+
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	downscaled, _, err := image.DecodeConfig(response.Body)
+	require.Nil(t, err)
+	require.Equal(t, 100, downscaled.Width)
+	require.Equal(t, 50, downscaled.Height)
+
+	// Other attachments are not downscaled, and the file size limit still applies
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(100_001), nil)
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, 41301, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishAttachment_ImageProcessing_TierBased(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                      "test",
+		MessageLimit:              10,
+		AttachmentFileSizeLimit:   50_000,
+		AttachmentTotalSizeLimit:  200_000,
+		AttachmentExpiryDuration:  time.Hour,
+		AttachmentBandwidthLimit:  100_000,
+		AttachmentImageProcessing: true,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+	content := string(testJPEGWithMetadata(t, testImage(50, 50, color.White), 1))
+
+	// Anonymous visitors use the config, i.e. no processing
+	response := request(t, s, "PUT", "/mytopic", content, nil)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Empty(t, msg.Attachment.Preview)
+	require.Equal(t, int64(len(content)), msg.Attachment.Size)
+
+	// Tier enables processing
+	response = request(t, s, "PUT", "/mytopic", content, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	msg = toMessage(t, response.Body.String())
+	require.NotEmpty(t, msg.Attachment.Preview)
+	require.Less(t, msg.Attachment.Size, int64(len(content)))
+
+	// Limits are exposed in the account API
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.True(t, account.Limits.AttachmentImageProcessing)
+}
+
 func TestServer_Visitor_XForwardedFor_None(t *testing.T) {
 	c := newTestConfig(t)
 	c.BehindProxy = true
@@ -2142,7 +2574,7 @@ func TestServer_Visitor_XForwardedFor_None(t *testing.T) {
 	r, _ := http.NewRequest("GET", "/bla", nil)
 	r.RemoteAddr = "8.9.10.11"
 	r.Header.Set("X-Forwarded-For", "  ") // Spaces, not empty!
-	v, err := s.maybeAuthenticate(r)
+	v, _, err := s.maybeAuthenticate(r)
 	require.Nil(t, err)
 	require.Equal(t, "8.9.10.11", v.ip.String())
 }
@@ -2154,7 +2586,7 @@ func TestServer_Visitor_XForwardedFor_Single(t *testing.T) {
 	r, _ := http.NewRequest("GET", "/bla", nil)
 	r.RemoteAddr = "8.9.10.11"
 	r.Header.Set("X-Forwarded-For", "1.1.1.1")
-	v, err := s.maybeAuthenticate(r)
+	v, _, err := s.maybeAuthenticate(r)
 	require.Nil(t, err)
 	require.Equal(t, "1.1.1.1", v.ip.String())
 }
@@ -2166,7 +2598,7 @@ func TestServer_Visitor_XForwardedFor_Multiple(t *testing.T) {
 	r, _ := http.NewRequest("GET", "/bla", nil)
 	r.RemoteAddr = "8.9.10.11"
 	r.Header.Set("X-Forwarded-For", "1.2.3.4 , 2.4.4.2,234.5.2.1 ")
-	v, err := s.maybeAuthenticate(r)
+	v, _, err := s.maybeAuthenticate(r)
 	require.Nil(t, err)
 	require.Equal(t, "234.5.2.1", v.ip.String())
 }
@@ -2221,6 +2653,53 @@ func TestServer_PublishWhileUpdatingStatsWithLotsOfMessages(t *testing.T) {
 	log.Info("Done: Waiting for all locks")
 }
 
+func TestServer_PublishWhilePruningMessages_FullTextSearch(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+	if s.messageCache.queries == sqliteQueriesNoFTS {
+		t.Skip("SQLite was built without FTS5, run with -tags sqlite_fts5")
+	}
+
+	// Add lots of expired messages, each of which has to be removed from the full-text index
+	messages := make([]*message, 0)
+	for i := 0; i < 10000; i++ {
+		messages = append(messages, newDefaultMessage("expired", fmt.Sprintf("disk %d is full", i)))
+	}
+	require.Nil(t, s.messageCache.addMessages(messages))
+
+	// Publish messages while the expired messages are deleted
+	prunedChan := make(chan bool)
+	go func() {
+		s.pruneMessages()
+		prunedChan <- true
+	}()
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("disk %d is fine", i), nil)
+		require.Equal(t, 200, response.Code)
+		require.True(t, time.Since(start) < 500*time.Millisecond)
+	}
+	select {
+	case <-prunedChan:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for pruning")
+	}
+
+	// Only the published messages are left, both in the cache and in the index
+	counts, err := s.messageCache.MessageCounts()
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"mytopic": 20}, counts)
+	found, err := s.messageCache.Search(&messageSearch{
+		Topics: []string{"expired", "mytopic"},
+		Text:   "disk",
+		Since:  time.Unix(0, 0),
+		Until:  time.Now().Add(time.Minute),
+		Limit:  100,
+	})
+	require.Nil(t, err)
+	require.Equal(t, 20, len(found))
+}
+
 func TestServer_AnonymousUser_And_NonTierUser_Are_Same_Visitor(t *testing.T) {
 	conf := newTestConfigWithAuthFile(t)
 	s := newTestServer(t, conf)
@@ -2853,6 +3332,510 @@ template ""}}`,
 	}
 }
 
+func TestServer_MessageUpdate(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+
+	response := request(t, s, "PUT", "/mytopic", "deploying ...", map[string]string{
+		"Title": "Deployment",
+		"Tags":  "hourglass",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	time.Sleep(500 * time.Millisecond) // Publishing is done asynchronously, this avoids races
+
+	response = request(t, s, "PUT", "/mytopic/"+m.ID, "deployed", map[string]string{
+		"Title":    "Deployment",
+		"Tags":     "white_check_mark",
+		"Priority": "4",
+	})
+	require.Equal(t, 200, response.Code)
+	updated := toMessage(t, response.Body.String())
+	require.Equal(t, messageEvent, updated.Event)
+	require.Equal(t, m.ID, updated.ID)
+	require.Equal(t, m.Time, updated.Time)
+	require.Equal(t, m.Expires, updated.Expires)
+	require.Equal(t, "deployed", updated.Message)
+
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, messageEvent, messages[1].Event)
+	require.Equal(t, "deploying ...", messages[1].Message)
+	require.Equal(t, messageUpdateEvent, messages[2].Event)
+	require.NotEqual(t, m.ID, messages[2].ID)
+	require.Equal(t, m.ID, messages[2].MessageID)
+	require.Equal(t, m.Expires, messages[2].Expires)
+	require.Equal(t, "deployed", messages[2].Message)
+	require.Equal(t, "Deployment", messages[2].Title)
+	require.Equal(t, []string{"white_check_mark"}, messages[2].Tags)
+	require.Equal(t, 4, messages[2].Priority)
+	updateEvent := messages[2]
+
+	// Polling returns the updated message, followed by the update event
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, messageEvent, messages[0].Event)
+	require.Equal(t, m.ID, messages[0].ID)
+	require.Equal(t, "deployed", messages[0].Message)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, updateEvent.ID, messages[1].ID)
+
+	// Clients that were offline receive the update event when they poll since the original message
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since="+m.ID, "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, messageUpdateEvent, messages[0].Event)
+	require.Equal(t, m.ID, messages[0].MessageID)
+	require.Equal(t, "deployed", messages[0].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since="+updateEvent.ID, "", nil)
+	require.Equal(t, 0, len(toMessages(t, response.Body.String())))
+
+	// Events cannot be updated themselves
+	response = request(t, s, "PUT", "/mytopic/"+updateEvent.ID, "deployed again", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_MessageUpdate_Invalid(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "some message", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	// Message does not exist
+	response = request(t, s, "PUT", "/mytopic/abcdefghijkl", "updated", nil)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+
+	// Message exists, but on a different topic
+	response = request(t, s, "PUT", "/othertopic/"+m.ID, "updated", nil)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+
+	// Delays and attachments cannot be changed
+	response = request(t, s, "PUT", "/mytopic/"+m.ID, "updated", map[string]string{
+		"Delay": "1h",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40047, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic/"+m.ID, "updated", map[string]string{
+		"Attach": "https://example.com/file.jpg",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40047, toHTTPError(t, response.Body.String()).Code)
+
+	// Anonymous messages can only be changed from the same IP address
+	response = request(t, s, "PUT", "/mytopic/"+m.ID, "updated", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4"
+	})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "DELETE", "/mytopic/"+m.ID, "", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4"
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_MessageUpdate_Scheduled(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+
+	response := request(t, s, "PUT", "/mytopic", "scheduled message", map[string]string{
+		"Delay": "1h",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	response = request(t, s, "PUT", "/mytopic/"+m.ID, "updated scheduled message", nil)
+	require.Equal(t, 200, response.Code)
+
+	// Scheduled messages are updated in the cache, but no event is sent
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&scheduled=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "updated scheduled message", messages[0].Message)
+	require.Equal(t, m.Time, messages[0].Time)
+}
+
+func TestServer_MessageDelete(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+
+	response := request(t, s, "PUT", "/mytopic", "text file!"+util.RandomString(4990), nil) // > 4096, so it's an attachment
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m.ID))
+	time.Sleep(500 * time.Millisecond) // Publishing is done asynchronously, this avoids races
+
+	response = request(t, s, "DELETE", "/mytopic/"+m.ID, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"success":true}`+"\n", response.Body.String())
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, m.ID))
+
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, messageEvent, messages[1].Event)
+	require.Equal(t, messageDeleteEvent, messages[2].Event)
+	require.NotEqual(t, m.ID, messages[2].ID)
+	require.Equal(t, m.ID, messages[2].MessageID)
+	require.Equal(t, "mytopic", messages[2].Topic)
+	require.Equal(t, "", messages[2].Message)
+
+	// Only the tombstone is left in the cache, so that clients that were offline receive it when they poll
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, messageDeleteEvent, messages[0].Event)
+	require.Equal(t, m.ID, messages[0].MessageID)
+	require.Nil(t, messages[0].Attachment)
+
+	response = request(t, s, "DELETE", "/mytopic/"+m.ID, "", nil)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_MessageDelete_Auth(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("marian", "marian", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "mytopic", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("marian", "mytopic", user.PermissionReadWrite))
+
+	response := request(t, s, "PUT", "/mytopic", "ben's message", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	// Other users cannot modify the message, even if they have write access to the topic
+	response = request(t, s, "PUT", "/mytopic/"+m.ID, "marian's update", map[string]string{
+		"Authorization": util.BasicAuth("marian", "marian"),
+	})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "DELETE", "/mytopic/"+m.ID, "", nil)
+	require.Equal(t, 403, response.Code)
+
+	// The owner can modify the message
+	response = request(t, s, "PUT", "/mytopic/"+m.ID, "ben's update", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ben's update", toMessage(t, response.Body.String()).Message)
+
+	// Admins can modify all messages
+	response = request(t, s, "DELETE", "/mytopic/"+m.ID, "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_Search(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "PUT", "/alerts", fmt.Sprintf("Disk full on server %d", i), nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/alerts", "CPU load is high", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/backups", "Backup failed, disk full", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/v1/search?topic=alerts,backups&q=disk&limit=4", "", nil)
+	require.Equal(t, 200, response.Code)
+	var page1 apiSearchResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&page1))
+	require.Equal(t, 4, len(page1.Messages))
+	require.NotEmpty(t, page1.NextCursor)
+
+	response = request(t, s, "GET", "/v1/search?topic=alerts,backups&q=disk&limit=4&cursor="+page1.NextCursor, "", nil)
+	require.Equal(t, 200, response.Code)
+	var page2 apiSearchResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&page2))
+	require.Equal(t, 2, len(page2.Messages))
+	require.Empty(t, page2.NextCursor)
+
+	ids := make(map[string]bool)
+	for _, m := range append(page1.Messages, page2.Messages...) {
+		require.Contains(t, strings.ToLower(m.Message), "disk")
+		ids[m.ID] = true
+	}
+	require.Equal(t, 6, len(ids))
+
+	response = request(t, s, "GET", "/v1/search?topic=alerts&since=1h", "", nil)
+	require.Equal(t, 200, response.Code)
+	var all apiSearchResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&all))
+	require.Equal(t, 6, len(all.Messages))
+
+	response = request(t, s, "GET", "/v1/search?topic=alerts&until=1h", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"messages":[]}`+"\n", response.Body.String())
+}
+
+func TestServer_Search_Invalid(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	for _, query := range []string{"q=disk", "topic=inv@lid", "topic=alerts&limit=1000", "topic=alerts&since=yesterday-ish", "topic=alerts&cursor=invalid"} {
+		response := request(t, s, "GET", "/v1/search?"+query, "", nil)
+		require.Equal(t, 400, response.Code, query)
+	}
+}
+
+func TestServer_Search_Auth(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("ben", "secret", user.PermissionWrite))
+
+	response := request(t, s, "PUT", "/alerts", "disk full", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/v1/search?topic=alerts&q=disk", "", nil)
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", "/v1/search?topic=alerts,secret&q=disk", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", "/v1/search?topic=alerts&q=disk", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	var result apiSearchResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&result))
+	require.Equal(t, 1, len(result.Messages))
+	require.Equal(t, "disk full", result.Messages[0].Message)
+}
+
+func TestServer_EncryptionAtRest(t *testing.T) {
+	c := newTestConfigWithEncryption(t)
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "my secret message", map[string]string{
+		"Title": "secret title",
+		"Tags":  "secret-tag",
+		"Click": "https://example.com/secret",
+	})
+	require.Equal(t, 200, response.Code)
+	content := "secret file " + util.RandomString(encryptionChunkSize) // > 1 chunk
+	response = request(t, s, "PUT", "/mytopic", content, map[string]string{
+		"Filename": "secret.txt",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	// Messages and attachments are decrypted transparently
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "my secret message", messages[0].Message)
+	require.Equal(t, "secret title", messages[0].Title)
+	require.Equal(t, []string{"secret-tag"}, messages[0].Tags)
+	require.Equal(t, "https://example.com/secret", messages[0].Click)
+	require.Equal(t, "secret.txt", messages[1].Attachment.Name)
+	require.Equal(t, int64(len(content)), messages[1].Attachment.Size)
+
+	path := strings.TrimPrefix(m.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, fmt.Sprintf("%d", len(content)), response.Header().Get("Content-Length"))
+	require.Equal(t, `attachment; filename="secret.txt"`, response.Header().Get("Content-Disposition"))
+	require.Equal(t, content, response.Body.String())
+
+	response = request(t, s, "HEAD", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, fmt.Sprintf("%d", len(content)), response.Header().Get("Content-Length"))
+
+	// Nothing is stored in plaintext
+	require.Nil(t, s.messageCache.Close())
+	for _, file := range []string{c.CacheFile, c.CacheFile + "-wal", filepath.Join(c.AttachmentCacheDir, m.ID)} {
+		b, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		require.Nil(t, err)
+		for _, secret := range []string{"my secret message", "secret title", "secret-tag", "example.com/secret", "secret.txt", "secret file"} {
+			require.NotContains(t, string(b), secret, file)
+		}
+	}
+}
+
+func TestServer_EncryptionAtRest_PlaintextWithPrefix(t *testing.T) {
+	// Messages that look like ciphertext must not break polling, with or without encryption
+	for _, c := range []*Config{newTestConfig(t), newTestConfigWithEncryption(t)} {
+		s := newTestServer(t, c)
+		require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "ntfyenc1:deadbeef:AAAA", nil).Code)
+		response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+		require.Equal(t, 200, response.Code)
+		messages := toMessages(t, response.Body.String())
+		require.Equal(t, 1, len(messages))
+		require.Equal(t, "ntfyenc1:deadbeef:AAAA", messages[0].Message)
+	}
+}
+
+func TestServer_EncryptionAtRest_Reencrypt(t *testing.T) {
+	// Publish messages without encryption
+	c := newTestConfig(t)
+	s := newTestServer(t, c)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "not yet encrypted", nil).Code)
+	response := request(t, s, "PUT", "/mytopic?f=file.txt", "attachment not yet encrypted", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Nil(t, s.messageCache.Close())
+
+	// Enable encryption and encrypt existing data
+	c.EncryptionKeyFile = filepath.Join(t.TempDir(), "encryption.keys")
+	_, err := RotateEncryptionKey(c.EncryptionKeyFile)
+	require.Nil(t, err)
+	messages, attachments, err := Reencrypt(c)
+	require.Nil(t, err)
+	require.Equal(t, 2, messages)
+	require.Equal(t, 1, attachments)
+	b, err := os.ReadFile(filepath.Join(c.AttachmentCacheDir, m.ID))
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "attachment not yet encrypted")
+
+	// Rotate the key, and re-encrypt everything with the new key
+	newKeyID, err := RotateEncryptionKey(c.EncryptionKeyFile)
+	require.Nil(t, err)
+	messages, attachments, err = Reencrypt(c)
+	require.Nil(t, err)
+	require.Equal(t, 2, messages)
+	require.Equal(t, 1, attachments)
+	f, err := os.Open(filepath.Join(c.AttachmentCacheDir, m.ID))
+	require.Nil(t, err)
+	keyID, err := encryptedFileKeyID(f)
+	f.Close()
+	require.Nil(t, err)
+	require.Equal(t, newKeyID, keyID)
+
+	// Attachments already encrypted with the primary key are skipped
+	_, attachments, err = Reencrypt(c)
+	require.Nil(t, err)
+	require.Equal(t, 0, attachments)
+
+	// Only the new key is needed to read the data
+	keys, err := os.ReadFile(c.EncryptionKeyFile)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(c.EncryptionKeyFile, []byte(strings.Split(string(keys), "\n")[0]), 0600))
+	s = newTestServer(t, c)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	polled := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(polled))
+	require.Equal(t, "not yet encrypted", polled[0].Message)
+	require.Equal(t, "file.txt", polled[1].Attachment.Name)
+	response = request(t, s, "GET", strings.TrimPrefix(m.Attachment.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "attachment not yet encrypted", response.Body.String())
+}
+
+func TestServer_EncryptionAtRest_PlaintextAttachmentWithPrefix(t *testing.T) {
+	// A plaintext attachment that starts like an encrypted file is still read as plaintext after encryption is enabled
+	c := newTestConfig(t)
+	s := newTestServer(t, c)
+	content := encryptionPrefix + "deadbeef" + util.RandomString(100)
+	response := request(t, s, "PUT", "/mytopic?f=file.txt", content, nil)
+	require.Equal(t, 200, response.Code)
+	path := strings.TrimPrefix(toMessage(t, response.Body.String()).Attachment.URL, "http://127.0.0.1:12345")
+	require.Nil(t, s.messageCache.Close())
+
+	c.EncryptionKeyFile = filepath.Join(t.TempDir(), "encryption.keys")
+	_, err := RotateEncryptionKey(c.EncryptionKeyFile)
+	require.Nil(t, err)
+	s = newTestServer(t, c)
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+	require.Nil(t, s.messageCache.Close())
+
+	// It is encrypted like any other plaintext attachment
+	_, attachments, err := Reencrypt(c)
+	require.Nil(t, err)
+	require.Equal(t, 1, attachments)
+	s = newTestServer(t, c)
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+}
+
+func TestServer_EncryptionAtRest_Reencrypt_SkipsBrokenAttachments(t *testing.T) {
+	c := newTestConfigWithEncryption(t)
+	s := newTestServer(t, c)
+	ids := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic?f=file.txt", fmt.Sprintf("attachment %d", i), nil)
+		require.Equal(t, 200, response.Code)
+		ids = append(ids, toMessage(t, response.Body.String()).ID)
+	}
+	require.Nil(t, s.messageCache.Close())
+	require.Nil(t, os.WriteFile(filepath.Join(c.AttachmentCacheDir, ids[1]), []byte("broken"), 0600))
+
+	// The broken attachment is skipped, all others are re-encrypted
+	newKeyID, err := RotateEncryptionKey(c.EncryptionKeyFile)
+	require.Nil(t, err)
+	_, attachments, err := Reencrypt(c)
+	require.Error(t, err)
+	require.Equal(t, 2, attachments)
+	for _, id := range []string{ids[0], ids[2]} {
+		f, err := os.Open(filepath.Join(c.AttachmentCacheDir, id))
+		require.Nil(t, err)
+		keyID, err := encryptedFileKeyID(f)
+		f.Close()
+		require.Nil(t, err)
+		require.Equal(t, newKeyID, keyID)
+	}
+}
+
+func TestServer_EncryptionAtRest_Search(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithEncryption(t))
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "disk full", nil).Code)
+
+	response := request(t, s, "GET", "/v1/search?topic=alerts", "", nil)
+	require.Equal(t, 200, response.Code)
+	var result apiSearchResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&result))
+	require.Equal(t, 1, len(result.Messages))
+	require.Equal(t, "disk full", result.Messages[0].Message)
+
+	response = request(t, s, "GET", "/v1/search?topic=alerts&q=disk", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40058, toHTTPError(t, response.Body.String()).Code)
+}
+
 func newTestConfig(t *testing.T) *Config {
 	conf := NewConfig()
 	conf.BaseURL = "http://127.0.0.1:12345"
@@ -2875,6 +3858,14 @@ func newTestConfigWithAuthFile(t *testing.T) *Config {
 	return conf
 }
 
+func newTestConfigWithEncryption(t *testing.T) *Config {
+	conf := newTestConfig(t)
+	conf.EncryptionKeyFile = filepath.Join(t.TempDir(), "encryption.keys")
+	_, err := RotateEncryptionKey(conf.EncryptionKeyFile)
+	require.Nil(t, err)
+	return conf
+}
+
 func newTestConfigWithWebPush(t *testing.T) *Config {
 	conf := newTestConfig(t)
 	privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	uploadIDLength          = 24   // Upload IDs only identify an upload, access requires the upload secret
+	uploadSecretLength      = 32   // Upload secrets are required to resume, cancel or attach an upload, see uploadAuthorized
+	uploadChunkSuffixLength = 8    // Chunks are stored as <upload ID>_<suffix>, see fileCache.WriteChunk
+	uploadChunksMax         = 1000 // Max. number of chunks per upload, to limit the number of files
+	uploadLengthHeader      = "Upload-Length"
+	uploadOffsetHeader      = "Upload-Offset"
+)
+
+// handleUploadCreate reserves a resumable upload of the size given in the Upload-Length header. The reserved
+// size counts towards the visitor's attachment limits right away (not just the bytes received), and the upload
+// expires after the attachment expiry duration if it is not attached to a message. Chunks can be appended with
+// handleUploadAppend. The response contains the upload secret, which is required to resume, cancel or attach the
+// upload, and which is never returned again.
+func (s *Server) handleUploadCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	size, err := strconv.ParseInt(r.Header.Get(uploadLengthHeader), 10, 64)
+	if err != nil || size <= 0 {
+		return errHTTPBadRequestUploadLengthInvalid
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return err
+	}
+	if size > s.attachmentInputSizeLimit(vinfo) || size > vinfo.Stats.AttachmentTotalSizeRemaining {
+		return errHTTPEntityTooLargeAttachment.With(v).Fields(log.Context{
+			"upload_length":                   size,
+			"attachment_total_size_remaining": vinfo.Stats.AttachmentTotalSizeRemaining,
+			"attachment_file_size_limit":      vinfo.Limits.AttachmentFileSizeLimit,
+		})
+	}
+	u := &upload{
+		ID:        util.RandomString(uploadIDLength),
+		Secret:    util.RandomSecretString(uploadSecretLength),
+		Sender:    v.IP(),
+		Size:      size,
+		Encrypted: s.fileCache.Encrypted(),
+		Expires:   time.Now().Add(vinfo.Limits.AttachmentExpiryDuration).Unix(),
+	}
+	if user := v.User(); user != nil {
+		u.User = user.ID
+	}
+	if err := s.messageCache.AddUpload(u); err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagUpload).Field("upload_id", u.ID).Debug("Created upload of %d bytes", size)
+	s.writeUploadHeaders(w, u)
+	return s.writeJSON(w, &apiUploadResponse{
+		ID:      u.ID,
+		Secret:  u.Secret,
+		Size:    u.Size,
+		Offset:  u.Received,
+		Expires: u.Expires,
+	})
+}
+
+// handleUploadHead returns the number of bytes received so far in the Upload-Offset header, so that an
+// interrupted upload can be resumed from there
+func (s *Server) handleUploadHead(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u, err := s.uploadFromPath(r, v)
+	if err != nil {
+		return err
+	}
+	s.writeUploadHeaders(w, u)
+	w.Header().Set("Cache-Control", "no-store")
+	return nil
+}
+
+// handleUploadAppend appends the request body as a new chunk to an upload. The Upload-Offset header must match
+// the number of bytes received so far, so that a chunk is never stored twice. Each chunk is stored under its own
+// ID, and only becomes part of the upload once the upload state is updated. If another request (possibly on
+// another replica) appended a chunk in the meantime, the chunk is removed and a conflict is returned. The attachment
+// limits are not checked again here, since the full size was already reserved in handleUploadCreate.
+func (s *Server) handleUploadAppend(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u, err := s.uploadFromPath(r, v)
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		return errHTTPBadRequestUploadOffsetInvalid
+	} else if offset != u.Received {
+		return errHTTPConflictUploadOffset
+	} else if len(u.Chunks) >= uploadChunksMax {
+		return errHTTPBadRequestUploadTooManyChunks
+	}
+	chunkID := fmt.Sprintf("%s_%s", u.ID, util.RandomString(uploadChunkSuffixLength))
+	size, err := s.fileCache.WriteChunk(chunkID, u.Encrypted, r.Body, v.BandwidthLimiter(), util.NewFixedLimiter(u.Size-u.Received))
+	if errors.Is(err, util.ErrLimitReached) {
+		return errHTTPEntityTooLargeAttachment.With(v)
+	} else if err != nil {
+		return err
+	}
+	previousReceived := u.Received
+	u.Received += size
+	u.Chunks = append(u.Chunks, chunkID)
+	if err := s.messageCache.UpdateUpload(u, previousReceived); err != nil {
+		if removeErr := s.fileCache.RemoveChunks(chunkID); removeErr != nil {
+			logvr(v, r).Tag(tagUpload).Err(removeErr).Warn("Unable to remove chunk of upload %s", u.ID)
+		}
+		if errors.Is(err, errUploadConflict) {
+			return errHTTPConflictUploadOffset
+		}
+		return err
+	}
+	logvr(v, r).Tag(tagUpload).Field("upload_id", u.ID).Debug("Received %d bytes, %d of %d bytes total", size, u.Received, u.Size)
+	return s.writeUpload(w, u)
+}
+
+// handleUploadDelete cancels an upload, and removes all of its chunks
+func (s *Server) handleUploadDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u, err := s.uploadFromPath(r, v)
+	if err != nil {
+		return err
+	}
+	if err := s.removeUpload(u); err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagUpload).Field("upload_id", u.ID).Debug("Deleted upload")
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleUploadAsAttachment attaches a completed upload to the message, see handlePublishBody. The request body
+// is the message (or an encrypted message if end-to-end encryption is used). The upload is written to the file
+// cache as if it was the request body, i.e. the content type is detected and images are processed. The bandwidth
+// was already counted when the chunks were received.
+func (s *Server) handleUploadAsAttachment(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser, uploadID string) error {
+	if s.fileCache == nil || s.config.BaseURL == "" {
+		return errHTTPBadRequestAttachmentsDisallowed.With(m)
+	} else if m.Attachment != nil && m.Attachment.URL != "" {
+		return errHTTPBadRequestAttachmentURLInvalid.Wrap("cannot combine attachment URL and upload").With(m)
+	}
+	if len(body.PeekedBytes) > 0 { // Empty body should not override message (publish via GET!)
+		if !utf8.Valid(body.PeekedBytes) {
+			return errHTTPBadRequestMessageNotUTF8.With(m)
+		} else if m.Encoding == encodingJWE && body.LimitReached {
+			return errHTTPEntityTooLargeEncryptedMessage.With(m)
+		}
+		m.Message = strings.TrimSpace(string(body.PeekedBytes))
+	}
+	if m.Encoding == encodingJWE && !isJWE(m.Message) {
+		return errHTTPBadRequestEncryptedMessageInvalid.With(m)
+	}
+	u, err := s.messageCache.Upload(uploadID)
+	if errors.Is(err, errUploadNotFound) {
+		return errHTTPNotFoundUpload.With(m)
+	} else if err != nil {
+		return err
+	} else if !uploadAuthorized(u, v, readUploadSecret(r)) {
+		return errHTTPForbidden.With(m)
+	} else if u.Received != u.Size {
+		return errHTTPBadRequestUploadIncomplete.With(m)
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return err
+	}
+	if uploadOwnedBy(u, v) {
+		vinfo.Stats.AttachmentTotalSizeRemaining += u.Size // The upload is counted twice until it is removed below
+	}
+	reader, err := s.fileCache.OpenChunks(u.Chunks, u.Encrypted)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	peeked, err := util.Peek(reader, s.config.MessageSizeLimit)
+	if err != nil {
+		return err
+	}
+	if err := s.writeAttachment(v, vinfo, m, peeked); err != nil {
+		return err
+	}
+	if err := s.removeUpload(u); err != nil {
+		logvm(v, m).Tag(tagUpload).Err(err).Warn("Unable to remove upload %s", u.ID)
+	}
+	logvm(v, m).Tag(tagUpload).Field("upload_id", u.ID).Debug("Attached upload to message")
+	return nil
+}
+
+// uploadFromPath returns the upload referenced in the request path, if the request carries the upload secret,
+// see uploadAuthorized
+func (s *Server) uploadFromPath(r *http.Request, v *visitor) (*upload, error) {
+	matches := apiUploadsSingleRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return nil, errHTTPInternalErrorInvalidPath
+	}
+	u, err := s.messageCache.Upload(matches[1])
+	if errors.Is(err, errUploadNotFound) {
+		return nil, errHTTPNotFoundUpload
+	} else if err != nil {
+		return nil, err
+	} else if !uploadAuthorized(u, v, readUploadSecret(r)) {
+		return nil, errHTTPForbidden.With(v)
+	}
+	return u, nil
+}
+
+func (s *Server) removeUpload(u *upload) error {
+	if err := s.fileCache.RemoveChunks(u.Chunks...); err != nil {
+		return err
+	}
+	return s.messageCache.RemoveUpload(u.ID)
+}
+
+func (s *Server) writeUpload(w http.ResponseWriter, u *upload) error {
+	s.writeUploadHeaders(w, u)
+	return s.writeJSON(w, &apiUploadResponse{
+		ID:      u.ID,
+		Size:    u.Size,
+		Offset:  u.Received,
+		Expires: u.Expires,
+	})
+}
+
+func (s *Server) writeUploadHeaders(w http.ResponseWriter, u *upload) {
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(u.Received, 10))
+	w.Header().Set(uploadLengthHeader, strconv.FormatInt(u.Size, 10))
+	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("Access-Control-Expose-Headers", uploadOffsetHeader+", "+uploadLengthHeader)
+}
+
+// uploadAuthorized returns true if the given secret matches the upload secret. Uploads created by a user can
+// additionally only be accessed by that user. The IP address is deliberately not checked, so that anonymous
+// uploads can be resumed after switching networks.
+func uploadAuthorized(u *upload, v *visitor, secret string) bool {
+	if u.Secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(u.Secret)) != 1 {
+		return false
+	}
+	if u.User != "" {
+		return u.User == v.MaybeUserID()
+	}
+	return true
+}
+
+// readUploadSecret reads the upload secret from the Upload-Secret header (or X-Upload-Secret, or the query param)
+func readUploadSecret(r *http.Request) string {
+	return readParam(r, "x-upload-secret", "upload-secret")
+}
+
+// uploadOwnedBy returns true if the upload was created by the visitor, i.e. if it counts towards the
+// visitor's attachment limits (see messageCache.AttachmentBytesUsedByUser and AttachmentBytesUsedBySender)
+func uploadOwnedBy(u *upload, v *visitor) bool {
+	if user := v.User(); user != nil {
+		return u.User == user.ID
+	}
+	return u.User == "" && u.Sender == v.IP()
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_Upload_Resumable(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	content := util.RandomString(5000)
+
+	// Create upload
+	response := request(t, s, "POST", "/v1/uploads", "", map[string]string{
+		"Upload-Length": "5000",
+	})
+	require.Equal(t, 200, response.Code)
+	u := toUploadResponse(t, response.Body.String())
+	require.Len(t, u.ID, uploadIDLength)
+	require.Len(t, u.Secret, uploadSecretLength)
+	require.Equal(t, int64(5000), u.Size)
+	require.Equal(t, int64(0), u.Offset)
+	require.Greater(t, u.Expires, int64(0))
+
+	// Send first chunk
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, content[:2000], map[string]string{
+		"Upload-Offset": "0",
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "2000", response.Header().Get("Upload-Offset"))
+	require.Equal(t, int64(2000), toUploadResponse(t, response.Body.String()).Offset)
+
+	// Resume: offset is returned, and chunks with the wrong offset are rejected
+	response = request(t, s, "HEAD", "/v1/uploads/"+u.ID, "", map[string]string{
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "2000", response.Header().Get("Upload-Offset"))
+	require.Equal(t, "5000", response.Header().Get("Upload-Length"))
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, content[:2000], map[string]string{
+		"Upload-Offset": "0",
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40905, toHTTPError(t, response.Body.String()).Code)
+
+	// Send second chunk
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, content[2000:], map[string]string{
+		"Upload-Offset": "2000",
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "5000", response.Header().Get("Upload-Offset"))
+	require.Empty(t, toUploadResponse(t, response.Body.String()).Secret)
+
+	// Publish message with upload
+	response = request(t, s, "PUT", "/mytopic", "my video", map[string]string{
+		"Upload":        u.ID,
+		"Upload-Secret": u.Secret,
+		"Filename":      "video.txt",
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "my video", msg.Message)
+	require.Equal(t, "video.txt", msg.Attachment.Name)
+	require.Equal(t, "text/plain; charset=utf-8", msg.Attachment.Type)
+	require.Equal(t, int64(5000), msg.Attachment.Size)
+	require.Equal(t, fmt.Sprintf("http://127.0.0.1:12345/file/%s.txt", msg.ID), msg.Attachment.URL)
+
+	response = request(t, s, "GET", strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+
+	// Upload and chunks are removed
+	require.Equal(t, 404, request(t, s, "HEAD", "/v1/uploads/"+u.ID, "", map[string]string{
+		"Upload-Secret": u.Secret,
+	}).Code)
+	files, err := filepath.Glob(filepath.Join(s.config.AttachmentCacheDir, u.ID+"_*"))
+	require.Nil(t, err)
+	require.Empty(t, files)
+}
+
+func TestServer_Upload_Incomplete(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "POST", "/v1/uploads", "", map[string]string{
+		"Upload-Length": "100",
+	})
+	require.Equal(t, 200, response.Code)
+	u := toUploadResponse(t, response.Body.String())
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, strings.Repeat("x", 50), map[string]string{
+		"Upload-Offset": "0",
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"Upload":        u.ID,
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40061, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"Upload": "doesnotexist",
+	})
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40406, toHTTPError(t, response.Body.String()).Code)
+
+	// Cancel upload
+	response = request(t, s, "DELETE", "/v1/uploads/"+u.ID, "", map[string]string{
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 404, request(t, s, "HEAD", "/v1/uploads/"+u.ID, "", map[string]string{
+		"Upload-Secret": u.Secret,
+	}).Code)
+}
+
+func TestServer_Upload_Limits(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AttachmentFileSizeLimit = 1000
+	c.VisitorAttachmentTotalSizeLimit = 1500
+	s := newTestServer(t, c)
+
+	// Invalid length, or larger than the file size limit
+	response := request(t, s, "POST", "/v1/uploads", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/uploads", "", map[string]string{
+		"Upload-Length": "1001",
+	})
+	require.Equal(t, 413, response.Code)
+
+	// Reserved uploads count towards the total size limit, not just the bytes received
+	response = request(t, s, "POST", "/v1/uploads", "", map[string]string{
+		"Upload-Length": "1000",
+	})
+	require.Equal(t, 200, response.Code)
+	u := toUploadResponse(t, response.Body.String())
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, strings.Repeat("x", 800), map[string]string{
+		"Upload-Offset": "0",
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/v1/account", "", nil)
+	require.Equal(t, 200, response.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(1000), account.Stats.AttachmentTotalSize)
+	require.Equal(t, int64(500), account.Stats.AttachmentTotalSizeRemaining)
+
+	response = request(t, s, "POST", "/v1/uploads", "", map[string]string{
+		"Upload-Length": "501",
+	})
+	require.Equal(t, 413, response.Code)
+
+	// Chunks cannot exceed the upload length
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, strings.Repeat("x", 201), map[string]string{
+		"Upload-Offset": "800",
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 413, response.Code)
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, strings.Repeat("x", 200), map[string]string{
+		"Upload-Offset": "800",
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Finalizing does not count the upload twice
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"Upload":        u.ID,
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(1000), toMessage(t, response.Body.String()).Attachment.Size)
+
+	response = request(t, s, "GET", "/v1/account", "", nil)
+	require.Equal(t, 200, response.Code)
+	account, _ = util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(1000), account.Stats.AttachmentTotalSize)
+}
+
+func TestServer_Upload_OtherVisitor(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "POST", "/v1/uploads", "", map[string]string{
+		"Upload-Length": "100",
+	})
+	require.Equal(t, 200, response.Code)
+	u := toUploadResponse(t, response.Body.String())
+
+	// Without the secret, nobody can see, append to, cancel or attach the upload
+	wrongSecret := map[string]string{
+		"Upload-Secret": util.RandomString(uploadSecretLength),
+	}
+	require.Equal(t, 403, request(t, s, "HEAD", "/v1/uploads/"+u.ID, "", nil).Code)
+	require.Equal(t, 403, request(t, s, "HEAD", "/v1/uploads/"+u.ID, "", wrongSecret).Code)
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, strings.Repeat("x", 100), map[string]string{
+		"Upload-Offset": "0",
+	})
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40301, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, 403, request(t, s, "DELETE", "/v1/uploads/"+u.ID, "", wrongSecret).Code)
+
+	// Resume from a different IP address with the secret
+	otherIP := func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4"
+	}
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, strings.Repeat("x", 100), map[string]string{
+		"Upload-Offset": "0",
+		"Upload-Secret": u.Secret,
+	}, otherIP)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "100", response.Header().Get("Upload-Offset"))
+
+	// Publishing with the upload requires the secret as well
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"Upload": u.ID,
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/mytopic?upload="+u.ID+"&upload-secret="+u.Secret, "", nil, otherIP)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(100), toMessage(t, response.Body.String()).Attachment.Size)
+}
+
+func TestServer_Upload_OtherUser(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleAdmin))
+
+	response := request(t, s, "POST", "/v1/uploads", "", map[string]string{
+		"Upload-Length": "100",
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	u := toUploadResponse(t, response.Body.String())
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, strings.Repeat("x", 100), map[string]string{
+		"Upload-Offset": "0",
+		"Upload-Secret": u.Secret,
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Another user, or an anonymous visitor, cannot attach the upload, even with the secret
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"Upload":        u.ID,
+		"Upload-Secret": u.Secret,
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40301, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"Upload":        u.ID,
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 403, response.Code)
+
+	// The owner can
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"Upload":        u.ID,
+		"Upload-Secret": u.Secret,
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(100), toMessage(t, response.Body.String()).Attachment.Size)
+}
+
+func TestServer_Upload_Expired(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "POST", "/v1/uploads", "", map[string]string{
+		"Upload-Length": "100",
+	})
+	require.Equal(t, 200, response.Code)
+	u := toUploadResponse(t, response.Body.String())
+	response = request(t, s, "PATCH", "/v1/uploads/"+u.ID, strings.Repeat("x", 50), map[string]string{
+		"Upload-Offset": "0",
+		"Upload-Secret": u.Secret,
+	})
+	require.Equal(t, 200, response.Code)
+	files, err := filepath.Glob(filepath.Join(s.config.AttachmentCacheDir, u.ID+"_*"))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+
+	_, err = s.messageCache.db.Exec("UPDATE uploads SET expires = 1 WHERE id = ?", u.ID)
+	require.Nil(t, err)
+	s.execManager()
+	require.NoFileExists(t, files[0])
+	uploads, err := s.messageCache.UploadsExpired()
+	require.Nil(t, err)
+	require.Empty(t, uploads)
+	require.Equal(t, int64(0), s.fileCache.Size())
+}
+
+func TestServer_Upload_AttachmentsDisabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentCacheDir = ""
+	s := newTestServer(t, c)
+
+	response := request(t, s, "POST", "/v1/uploads", "", map[string]string{
+		"Upload-Length": "100",
+	})
+	require.Equal(t, 404, response.Code)
+}
+
+func toUploadResponse(t *testing.T, s string) *apiUploadResponse {
+	var u apiUploadResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&u))
+	return &u
+}
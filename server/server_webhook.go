@@ -0,0 +1,378 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	webhookMaxAttempts       = 8                // Deliveries are dropped after this many failed attempts
+	webhookMaxRetryDelay     = 6 * time.Hour    // Upper bound for the exponential backoff between attempts
+	webhookRequestTimeout    = 15 * time.Second // Timeout for a single webhook request
+	webhookDeliveryBatchSize = 100              // Max. number of deliveries sent per sender run
+	webhookResponseBytes     = 4096             // Number of response body bytes read (and discarded) per request
+	webhookErrorMaxLength    = 256              // Max. length of the last error stored for a webhook
+)
+
+// Headers sent along with every webhook request, see docs for how to verify the signature
+const (
+	webhookHeaderID        = "X-Ntfy-Webhook-ID"
+	webhookHeaderDelivery  = "X-Ntfy-Delivery-ID"
+	webhookHeaderTimestamp = "X-Ntfy-Timestamp"
+	webhookHeaderSignature = "X-Ntfy-Signature"
+)
+
+var (
+	errWebhookAddressNotAllowed = errors.New("address not allowed")
+
+	// webhookSharedAddressSpace is the carrier-grade NAT range (RFC 6598), which is not covered by netip.Addr.IsPrivate
+	webhookSharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// handleAccountWebhookAdd creates a webhook for a topic the user has read access to. The response
+// contains the webhook secret, which is used to sign the webhook requests. The secret is only returned
+// here, and not in the account response, see newAPIAccountWebhook.
+func (s *Server) handleAccountWebhookAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := requestUser(r)
+	req, err := readJSONWithLimit[apiAccountWebhookRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	if !topicRegex.MatchString(req.Topic) {
+		return errHTTPBadRequestTopicInvalid
+	} else if !user.AllowedWebhookURL(req.URL) {
+		return errHTTPBadRequestWebhookInvalid.Wrap("invalid URL, must start with http:// or https://")
+	} else if !s.webhookHostAllowed(req.URL) {
+		return errHTTPBadRequestWebhookInvalid.Wrap("invalid URL, private, loopback and link-local addresses are not allowed")
+	}
+	if err := s.userManager.Authorize(u, req.Topic, user.PermissionRead); err != nil {
+		return errHTTPForbidden
+	}
+	if req.Template != "" {
+		sample, err := json.Marshal(newDefaultMessage(req.Topic, "This is a test message"))
+		if err != nil {
+			return err
+		}
+		if _, err := replaceTemplate(req.Template, string(sample)); err != nil {
+			return err
+		}
+	}
+	logvr(v, r).
+		Tag(tagWebhook).
+		Fields(log.Context{
+			"topic":       req.Topic,
+			"webhook_url": req.URL,
+		}).
+		Debug("Adding webhook")
+	webhook, err := s.userManager.AddWebhook(u.ID, req.Topic, req.URL, req.Template)
+	if errors.Is(err, user.ErrTooManyWebhooks) {
+		return errHTTPTooManyRequestsLimitWebhooks
+	} else if errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestWebhookInvalid
+	} else if err != nil {
+		return err
+	}
+	response := newAPIAccountWebhook(webhook)
+	response.Secret = webhook.Secret
+	return s.writeJSON(w, response)
+}
+
+// handleAccountWebhookDelete deletes a webhook if it is owned by the current user. Queued deliveries are dropped.
+func (s *Server) handleAccountWebhookDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiAccountWebhookSingleRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	webhookID := matches[1]
+	logvr(v, r).
+		Tag(tagWebhook).
+		Field("webhook_id", webhookID).
+		Debug("Removing webhook")
+	if err := s.userManager.RemoveWebhook(v.User().ID, webhookID); errors.Is(err, user.ErrWebhookNotFound) {
+		return errHTTPNotFoundWebhook
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// enqueueWebhooks renders the message for all webhooks of the message's topic, and adds the resulting
+// deliveries to the persistent delivery queue. Webhooks whose owner can no longer read the topic are skipped.
+func (s *Server) enqueueWebhooks(v *visitor, m *message) {
+	if m.Event != messageEvent {
+		return
+	}
+	webhooks, err := s.userManager.WebhooksByTopic(m.Topic)
+	if err != nil {
+		logvm(v, m).Tag(tagWebhook).Err(err).Warn("Unable to retrieve webhooks")
+		return
+	} else if len(webhooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(m)
+	if err != nil {
+		logvm(v, m).Tag(tagWebhook).Err(err).Warn("Unable to marshal message")
+		return
+	}
+	deliveries := make([]*user.WebhookDelivery, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		ev := logvm(v, m).Tag(tagWebhook).Field("webhook_id", webhook.ID)
+		owner, err := s.userManager.UserByID(webhook.UserID)
+		if err != nil || owner.Deleted {
+			ev.Debug("Skipping webhook, owner not found or deleted")
+			continue
+		} else if err := s.userManager.Authorize(owner, m.Topic, user.PermissionRead); err != nil {
+			ev.Debug("Skipping webhook, owner is not allowed to read topic")
+			continue
+		}
+		body, contentType := string(payload), "application/json"
+		if webhook.Template != "" && m.Encoding != encodingJWE { // Templates cannot read encrypted messages, so they are sent as JSON
+			body, err = replaceTemplate(webhook.Template, string(payload))
+			if err != nil {
+				ev.Err(err).Warn("Unable to render webhook template")
+				continue
+			}
+			if !json.Valid([]byte(body)) {
+				contentType = "text/plain; charset=utf-8"
+			}
+		}
+		deliveries = append(deliveries, &user.WebhookDelivery{
+			WebhookID:   webhook.ID,
+			Body:        body,
+			ContentType: contentType,
+		})
+	}
+	if err := s.userManager.EnqueueWebhookDeliveries(deliveries...); err != nil {
+		logvm(v, m).Tag(tagWebhook).Err(err).Warn("Unable to queue webhook deliveries")
+		return
+	}
+	if len(deliveries) > 0 {
+		select {
+		case s.webhookTrigger <- struct{}{}:
+		default: // Sender is already triggered
+		}
+	}
+}
+
+func (s *Server) runWebhookSender() {
+	if !s.config.EnableWebhooks || s.userManager == nil {
+		return
+	}
+	for {
+		select {
+		case <-time.After(s.config.WebhookSenderInterval):
+		case <-s.webhookTrigger:
+		case <-s.closeChan:
+			return
+		}
+		if !s.isClusterLeader() {
+			continue // Deliveries are stored in the user database, and sent by the leader
+		}
+		if err := s.sendWebhookDeliveries(); err != nil {
+			log.Tag(tagWebhook).Err(err).Warn("Error sending webhook deliveries")
+		}
+	}
+}
+
+// sendWebhookDeliveries sends all due webhook deliveries. Deliveries for the same webhook are sent
+// sequentially (to preserve their order), different webhooks are sent in parallel.
+func (s *Server) sendWebhookDeliveries() error {
+	deliveries, err := s.userManager.WebhookDeliveriesDue(webhookDeliveryBatchSize)
+	if err != nil {
+		return err
+	}
+	byWebhook := make(map[string][]*user.WebhookDelivery)
+	for _, d := range deliveries {
+		byWebhook[d.WebhookID] = append(byWebhook[d.WebhookID], d)
+	}
+	var wg sync.WaitGroup
+	for _, webhookDeliveries := range byWebhook {
+		wg.Add(1)
+		go func(webhookDeliveries []*user.WebhookDelivery) {
+			defer wg.Done()
+			for _, d := range webhookDeliveries {
+				s.sendWebhookDelivery(d)
+			}
+		}(webhookDeliveries)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (s *Server) sendWebhookDelivery(d *user.WebhookDelivery) {
+	ev := log.Tag(tagWebhook).Fields(log.Context{
+		"webhook_id":          d.WebhookID,
+		"webhook_delivery_id": d.ID,
+		"webhook_attempt":     d.Attempts + 1,
+	})
+	if err := s.postWebhook(d); err != nil {
+		var nextAttempt time.Time
+		if d.Attempts+1 < webhookMaxAttempts {
+			nextAttempt = time.Now().Add(webhookRetryDelay(s.config.WebhookRetryDelay, d.Attempts))
+			ev.Err(err).Debug("Webhook delivery failed, retrying at %s", nextAttempt.Format(time.RFC3339))
+		} else {
+			ev.Err(err).Info("Webhook delivery failed, giving up after %d attempts", webhookMaxAttempts)
+		}
+		reason := err.Error()
+		if len(reason) > webhookErrorMaxLength {
+			reason = reason[:webhookErrorMaxLength]
+		}
+		if err := s.userManager.MarkWebhookDeliveryFailed(d, reason, nextAttempt); err != nil {
+			ev.Err(err).Warn("Unable to update webhook delivery")
+		}
+		return
+	}
+	ev.Debug("Webhook delivered")
+	if err := s.userManager.MarkWebhookDelivered(d); err != nil {
+		ev.Err(err).Warn("Unable to update webhook delivery")
+	}
+}
+
+func (s *Server) postWebhook(d *user.WebhookDelivery) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, d.URL, strings.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	req.Header.Set("Content-Type", d.ContentType)
+	req.Header.Set(webhookHeaderID, d.WebhookID)
+	req.Header.Set(webhookHeaderDelivery, d.ID)
+	req.Header.Set(webhookHeaderTimestamp, timestamp)
+	req.Header.Set(webhookHeaderSignature, "sha256="+webhookSignature(d.Secret, timestamp, d.Body))
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, webhookResponseBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// newWebhookClient creates the HTTP client used for webhook requests. Redirects are not followed, proxies are
+// not used, and every address is checked right before connecting (after DNS resolution), see webhookDialControl.
+func (s *Server) newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookRequestTimeout,
+		Control: s.webhookDialControl,
+	}
+	return &http.Client{
+		Timeout: webhookRequestTimeout,
+		Transport: &http.Transport{
+			Proxy:               nil, // A proxy would connect to the actual address, bypassing webhookDialControl
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookRequestTimeout,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     time.Minute,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse // Redirects are treated as failures
+		},
+	}
+}
+
+// webhookDialControl rejects connections to addresses that are not allowed, see webhookAddrAllowed. It is
+// called for every resolved address, so that webhooks cannot reach internal services (e.g. the cloud
+// metadata service at 169.254.169.254), not even via a hostname that resolves to an internal address.
+func (s *Server) webhookDialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	} else if !s.webhookAddrAllowed(addr) {
+		return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, addr.String())
+	}
+	return nil
+}
+
+// webhookAddrAllowed returns true if webhooks may be sent to the given address: public unicast addresses are
+// allowed, loopback, private, link-local, multicast and unspecified addresses only if they are in webhook-allowed-ips.
+func (s *Server) webhookAddrAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if util.ContainsIP(s.config.WebhookAllowedIPs, addr) {
+		return true
+	}
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !webhookSharedAddressSpace.Contains(addr)
+}
+
+// webhookHostAllowed rejects webhook URLs whose host is an IP address that is not allowed, or "localhost", so
+// that such webhooks are rejected right away. Hostnames are checked when connecting, see webhookDialControl.
+func (s *Server) webhookHostAllowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return s.webhookAddrAllowed(addr)
+	} else if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return s.webhookAddrAllowed(netip.IPv6Loopback())
+	}
+	return true
+}
+
+// webhookSignature computes the hex-encoded HMAC-SHA256 of "<timestamp>.<body>", using the webhook secret as key
+func webhookSignature(secret, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryDelay returns the delay before the next attempt, doubling the base delay for every failed attempt
+func webhookRetryDelay(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 0; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetryDelay {
+		return webhookMaxRetryDelay
+	}
+	return delay
+}
+
+// newAPIAccountWebhook converts the webhook to its API representation. The secret is left out, since it is
+// only shown once, when the webhook is created (see handleAccountWebhookAdd).
+func newAPIAccountWebhook(webhook *user.Webhook) *apiAccountWebhook {
+	status := &apiAccountWebhookStatus{
+		LastError: webhook.LastError,
+		Failures:  webhook.Failures,
+		Pending:   webhook.Pending,
+	}
+	if !webhook.LastAttempt.IsZero() {
+		status.LastAttempt = webhook.LastAttempt.Unix()
+	}
+	if !webhook.LastSuccess.IsZero() {
+		status.LastSuccess = webhook.LastSuccess.Unix()
+	}
+	return &apiAccountWebhook{
+		ID:       webhook.ID,
+		Topic:    webhook.Topic,
+		URL:      webhook.URL,
+		Template: webhook.Template,
+		Status:   status,
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_Webhook_AddAndDeliver(t *testing.T) {
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r)
+		bodies = append(bodies, string(body))
+	}))
+	defer receiver.Close()
+
+	s := newTestServer(t, newTestConfigWithWebhooks(t))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	// Add webhook
+	rr := request(t, s, "POST", "/v1/account/webhook", `{"topic":"mytopic","url":"`+receiver.URL+`/hook"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	webhook, _ := util.UnmarshalJSON[apiAccountWebhook](io.NopCloser(rr.Body))
+	require.True(t, strings.HasPrefix(webhook.ID, "wh_"))
+	require.Equal(t, "mytopic", webhook.Topic)
+	require.NotEmpty(t, webhook.Secret)
+
+	// Publish and deliver
+	response := request(t, s, "PUT", "/mytopic", "hi there", map[string]string{
+		"Title": "some title",
+	})
+	m := toMessage(t, response.Body.String())
+	waitFor(t, func() bool {
+		account := getAccount(t, s, "phil", "phil")
+		return len(account.Webhooks) == 1 && account.Webhooks[0].Status.Pending == 1
+	})
+	require.Nil(t, s.sendWebhookDeliveries())
+
+	mu.Lock()
+	require.Equal(t, 1, len(received))
+	r, body := received[0], bodies[0]
+	mu.Unlock()
+	require.Equal(t, "/hook", r.URL.Path)
+	require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	require.Equal(t, webhook.ID, r.Header.Get("X-Ntfy-Webhook-ID"))
+	require.True(t, strings.HasPrefix(r.Header.Get("X-Ntfy-Delivery-ID"), "wd_"))
+	require.Equal(t, "sha256="+webhookSignature(webhook.Secret, r.Header.Get("X-Ntfy-Timestamp"), body), r.Header.Get("X-Ntfy-Signature"))
+	delivered := toMessage(t, body)
+	require.Equal(t, m.ID, delivered.ID)
+	require.Equal(t, "some title", delivered.Title)
+	require.Equal(t, "hi there", delivered.Message)
+
+	// Status is visible in account, but not the secret
+	account := getAccount(t, s, "phil", "phil")
+	require.Equal(t, 1, len(account.Webhooks))
+	require.Equal(t, "", account.Webhooks[0].Secret)
+	require.Equal(t, int64(0), account.Webhooks[0].Status.Pending)
+	require.Equal(t, int64(0), account.Webhooks[0].Status.Failures)
+	require.True(t, account.Webhooks[0].Status.LastSuccess > 0)
+
+	// Delete webhook
+	rr = request(t, s, "DELETE", "/v1/account/webhook/"+webhook.ID, "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Nil(t, getAccount(t, s, "phil", "phil").Webhooks)
+}
+
+func TestServer_Webhook_TemplateAndRetry(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	var bodies []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies = append(bodies, string(body))
+	}))
+	defer receiver.Close()
+
+	conf := newTestConfigWithWebhooks(t)
+	conf.WebhookRetryDelay = time.Millisecond
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	rr := request(t, s, "POST", "/v1/account/webhook", `{"topic":"mytopic","url":"`+receiver.URL+`","template":"{{.title}}: {{.message}}"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	request(t, s, "PUT", "/mytopic", "disk is full", map[string]string{
+		"Title": "Alert",
+	})
+	waitFor(t, func() bool {
+		account := getAccount(t, s, "phil", "phil")
+		return len(account.Webhooks) == 1 && account.Webhooks[0].Status.Pending == 1
+	})
+
+	// First attempt fails, delivery stays queued
+	require.Nil(t, s.sendWebhookDeliveries())
+	account := getAccount(t, s, "phil", "phil")
+	require.Equal(t, int64(1), account.Webhooks[0].Status.Pending)
+	require.Equal(t, int64(1), account.Webhooks[0].Status.Failures)
+	require.Contains(t, account.Webhooks[0].Status.LastError, "503")
+	require.Equal(t, int64(0), account.Webhooks[0].Status.LastSuccess)
+
+	// Second attempt succeeds
+	waitFor(t, func() bool {
+		require.Nil(t, s.sendWebhookDeliveries())
+		return getAccount(t, s, "phil", "phil").Webhooks[0].Status.Pending == 0
+	})
+	account = getAccount(t, s, "phil", "phil")
+	require.Equal(t, int64(0), account.Webhooks[0].Status.Failures)
+	require.Equal(t, "", account.Webhooks[0].Status.LastError)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 2, requests)
+	require.Equal(t, []string{"Alert: disk is full"}, bodies)
+}
+
+func TestServer_Webhook_Invalid(t *testing.T) {
+	conf := newTestConfigWithWebhooks(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionRead))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	rr := request(t, s, "POST", "/v1/account/webhook", `{"topic":"mytopic","url":"ftp://example.com"}`, headers)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40050, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account/webhook", `{"topic":"mytopic","url":"https://example.com","template":"{{.title"}`, headers)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40043, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account/webhook", `{"topic":"not-allowed","url":"https://example.com"}`, headers)
+	require.Equal(t, 403, rr.Code)
+
+	rr = request(t, s, "POST", "/v1/account/webhook", `{"topic":"mytopic","url":"https://example.com"}`, nil)
+	require.Equal(t, 401, rr.Code)
+
+	rr = request(t, s, "DELETE", "/v1/account/webhook/wh_doesnotexist", "", headers)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, 40403, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_Webhook_PrivateAddress(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+	}))
+	defer receiver.Close()
+
+	conf := newTestConfigWithWebhooks(t)
+	conf.WebhookAllowedIPs = nil
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Private, loopback and link-local addresses are rejected right away ...
+	for _, u := range []string{"http://169.254.169.254/latest/meta-data", "http://127.0.0.1:8080", "http://[::1]/", "http://10.1.2.3", "http://localhost:2586", "http://[::ffff:192.168.1.1]/"} {
+		rr := request(t, s, "POST", "/v1/account/webhook", `{"topic":"mytopic","url":"`+u+`"}`, headers)
+		require.Equal(t, 400, rr.Code, u)
+		require.Equal(t, 40050, toHTTPError(t, rr.Body.String()).Code, u)
+	}
+
+	// ... hostnames are only checked when connecting, after they are resolved
+	rr := request(t, s, "POST", "/v1/account/webhook", `{"topic":"mytopic","url":"https://example.com/hook"}`, headers)
+	require.Equal(t, 200, rr.Code)
+	err := s.postWebhook(&user.WebhookDelivery{URL: receiver.URL, Body: "{}", ContentType: "application/json"})
+	require.ErrorIs(t, err, errWebhookAddressNotAllowed)
+	mu.Lock()
+	require.Equal(t, 0, requests)
+	mu.Unlock()
+
+	require.True(t, s.webhookAddrAllowed(netip.MustParseAddr("1.1.1.1")))
+	require.True(t, s.webhookAddrAllowed(netip.MustParseAddr("2606:4700:4700::1111")))
+	for _, addr := range []string{"127.0.0.1", "10.0.0.1", "172.16.0.1", "192.168.0.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1", "224.0.0.1"} {
+		require.False(t, s.webhookAddrAllowed(netip.MustParseAddr(addr)), addr)
+	}
+
+	// Private ranges can be allowed explicitly
+	s.config.WebhookAllowedIPs = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	require.Nil(t, s.postWebhook(&user.WebhookDelivery{URL: receiver.URL, Body: "{}", ContentType: "application/json"}))
+	mu.Lock()
+	require.Equal(t, 1, requests)
+	mu.Unlock()
+}
+
+func TestServer_Webhook_OwnerLostAccess(t *testing.T) {
+	conf := newTestConfigWithWebhooks(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionRead))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionWrite))
+
+	rr := request(t, s, "POST", "/v1/account/webhook", `{"topic":"mytopic","url":"https://example.com"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Nil(t, s.userManager.ResetAccess("phil", "mytopic"))
+
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	m := newDefaultMessage("mytopic", "secret stuff")
+	s.enqueueWebhooks(newVisitor(s.config, s.messageCache, s.userManager, netip.IPv4Unspecified(), nil), m)
+	webhooks, err := s.userManager.Webhooks(u.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(webhooks))
+	require.Equal(t, int64(0), webhooks[0].Pending)
+}
+
+func TestServer_Webhook_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	rr := request(t, s, "POST", "/v1/account/webhook", `{"topic":"mytopic","url":"https://example.com"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 404, rr.Code)
+}
+
+func TestServer_Webhook_RetryDelay(t *testing.T) {
+	require.Equal(t, 30*time.Second, webhookRetryDelay(30*time.Second, 0))
+	require.Equal(t, 60*time.Second, webhookRetryDelay(30*time.Second, 1))
+	require.Equal(t, 8*time.Minute, webhookRetryDelay(30*time.Second, 4))
+	require.Equal(t, webhookMaxRetryDelay, webhookRetryDelay(30*time.Second, 100))
+}
+
+func newTestConfigWithWebhooks(t *testing.T) *Config {
+	conf := newTestConfigWithAuthFile(t)
+	conf.EnableWebhooks = true
+	conf.WebhookAllowedIPs = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")} // Receivers are local test servers
+	return conf
+}
+
+func getAccount(t *testing.T, s *Server, username, password string) *apiAccountResponse {
+	rr := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth(username, password),
+	})
+	require.Equal(t, 200, rr.Code)
+	var account apiAccountResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&account))
+	return &account
+}
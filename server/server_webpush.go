@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/SherClockHolmes/webpush-go"
@@ -51,7 +52,7 @@ func (s *Server) handleWebPushUpdate(w http.ResponseWriter, r *http.Request, v *
 		return err
 	}
 	if s.userManager != nil {
-		u := v.User()
+		u := requestUser(r)
 		for _, t := range topics {
 			if err := s.userManager.Authorize(u, t.ID, user.PermissionRead); err != nil {
 				logvr(v, r).With(t).Err(err).Debug("Access to topic %s not authorized", t.ID)
@@ -82,6 +83,50 @@ func (s *Server) publishToWebPushEndpoints(v *visitor, m *message) {
 		logvm(v, m).Err(err).With(v, m).Warn("Unable to publish web push messages")
 		return
 	}
+	s.publishToWebPushSubscriptions(v, m, s.filterQuietHoursWebPushSubscriptions(v, m, subscriptions))
+}
+
+// publishToUserWebPushEndpoints publishes a message to the web push subscriptions of the given user only
+func (s *Server) publishToUserWebPushEndpoints(v *visitor, m *message, userID string) {
+	subscriptions, err := s.webPush.SubscriptionsForTopic(m.Topic)
+	if err != nil {
+		logvm(v, m).Err(err).With(v, m).Warn("Unable to publish web push messages")
+		return
+	}
+	subscriptions = slices.DeleteFunc(subscriptions, func(subscription *webPushSubscription) bool {
+		return subscription.UserID != userID
+	})
+	s.publishToWebPushSubscriptions(v, m, subscriptions)
+}
+
+// filterQuietHoursWebPushSubscriptions removes all subscriptions of users whose quiet hours are active
+func (s *Server) filterQuietHoursWebPushSubscriptions(v *visitor, m *message, subscriptions []*webPushSubscription) []*webPushSubscription {
+	if s.userManager == nil || m.Event != messageEvent {
+		return subscriptions
+	}
+	users := make(map[string]*user.User)
+	return slices.DeleteFunc(subscriptions, func(subscription *webPushSubscription) bool {
+		if subscription.UserID == "" {
+			return false
+		}
+		u, ok := users[subscription.UserID]
+		if !ok {
+			var err error
+			if u, err = s.userManager.UserByID(subscription.UserID); err != nil {
+				log.Tag(tagWebPush).Err(err).With(v, m, subscription).Warn("Unable to retrieve user for web push subscription")
+			}
+			users[subscription.UserID] = u
+		}
+		if q := s.quietHours(u, m); q != nil {
+			log.Tag(tagQuietHours).With(v, m, subscription).Debug("Not sending web push message, quiet hours of user %s active", u.Name)
+			s.holdForQuietHours(u, q, m, false, true)
+			return true
+		}
+		return false
+	})
+}
+
+func (s *Server) publishToWebPushSubscriptions(v *visitor, m *message, subscriptions []*webPushSubscription) {
 	log.Tag(tagWebPush).With(v, m).Debug("Publishing web push message to %d subscribers", len(subscriptions))
 	payload, err := json.Marshal(newWebPushPayload(fmt.Sprintf("%s/%s", s.config.BaseURL, m.Topic), m))
 	if err != nil {
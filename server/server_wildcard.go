@@ -0,0 +1,151 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// topicPatternSubscription is a wildcard subscription to one or more topic patterns (e.g. alerts-*). The subscriber
+// is attached to all existing topics matching the patterns when the subscription starts, and to all matching topics
+// that are created afterwards. Topics the visitor is not allowed to read are skipped.
+type topicPatternSubscription struct {
+	id         int
+	regex      *regexp.Regexp
+	v          *visitor
+	user       *user.User // User of the subscribe request, see requestUser; may be nil
+	subscriber subscriber
+	cancel     func()
+	explicit   []string       // Topics that were subscribed to explicitly (e.g. /alerts-*,mytopic/json), never attached
+	attached   map[*topic]int // Topic -> subscriber ID
+	closed     bool
+	mu         sync.Mutex
+}
+
+// isTopicPattern returns true if the given topic ID contains a '*' wildcard
+func isTopicPattern(id string) bool {
+	return strings.Contains(id, "*")
+}
+
+// topicPatternsFromPath returns the topic patterns from a subscribe path (e.g. /alerts-*,mytopic/json), or an
+// error if the path contains patterns, but wildcard subscriptions are not enabled.
+func (s *Server) topicPatternsFromPath(path string) ([]string, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return nil, errHTTPBadRequestTopicInvalid
+	}
+	patterns := make([]string, 0)
+	for _, id := range util.SplitNoEmpty(parts[1], ",") {
+		if isTopicPattern(id) {
+			patterns = append(patterns, id)
+		}
+	}
+	if len(patterns) > 0 && !s.config.EnableWildcardSubscriptions {
+		return nil, errHTTPBadRequestWildcardSubscriptionsDisabled
+	}
+	return patterns, nil
+}
+
+// subscribeTopicPatterns attaches the subscriber to all existing topics matching the patterns, and registers it,
+// so that it is attached to matching topics created later on. The topics passed in explicit are skipped, since the
+// subscriber is subscribed to them directly. The returned subscription must be passed to unsubscribeTopicPatterns.
+func (s *Server) subscribeTopicPatterns(v *visitor, u *user.User, patterns []string, explicit []*topic, sub subscriber, cancel func()) *topicPatternSubscription {
+	ps := &topicPatternSubscription{
+		regex:      newTopicPatternsRegex(patterns),
+		v:          v,
+		user:       u,
+		subscriber: sub,
+		cancel:     cancel,
+		explicit:   make([]string, 0),
+		attached:   make(map[*topic]int),
+	}
+	for _, t := range explicit {
+		ps.explicit = append(ps.explicit, t.ID)
+	}
+	// Registering the subscription and listing the existing topics must happen atomically, so that
+	// no topic is missed. Topics that are created concurrently may be attached twice, which
+	// attachTopicPatternSubscription ignores.
+	s.mu.Lock()
+	s.topicPatternSubID++
+	ps.id = s.topicPatternSubID
+	s.topicPatternSubs[ps.id] = ps
+	topics := make([]*topic, 0)
+	for _, t := range s.topics {
+		topics = append(topics, t)
+	}
+	s.mu.Unlock()
+	for _, t := range topics {
+		s.attachTopicPatternSubscription(ps, t)
+	}
+	logv(v).Tag(tagSubscribe).Debug("Subscribed to topic patterns %s", strings.Join(patterns, ","))
+	return ps
+}
+
+// unsubscribeTopicPatterns removes a wildcard subscription, and detaches the subscriber from all topics
+func (s *Server) unsubscribeTopicPatterns(ps *topicPatternSubscription) {
+	s.mu.Lock()
+	delete(s.topicPatternSubs, ps.id)
+	s.mu.Unlock()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.closed = true
+	for t, subscriberID := range ps.attached {
+		t.Unsubscribe(subscriberID)
+	}
+	ps.attached = make(map[*topic]int)
+}
+
+// attachTopicPatternSubscriptions attaches all matching wildcard subscriptions to the given (newly created) topics
+func (s *Server) attachTopicPatternSubscriptions(topics []*topic) {
+	s.mu.RLock()
+	subs := make([]*topicPatternSubscription, 0, len(s.topicPatternSubs))
+	for _, ps := range s.topicPatternSubs {
+		subs = append(subs, ps)
+	}
+	s.mu.RUnlock()
+	for _, ps := range subs {
+		for _, t := range topics {
+			s.attachTopicPatternSubscription(ps, t)
+		}
+	}
+}
+
+// attachTopicPatternSubscription subscribes the wildcard subscriber to the topic, if the topic matches the patterns,
+// the visitor is allowed to read it, and the subscriber is not already subscribed to it
+func (s *Server) attachTopicPatternSubscription(ps *topicPatternSubscription, t *topic) {
+	if !ps.regex.MatchString(t.ID) || util.Contains(ps.explicit, t.ID) {
+		return
+	} else if s.userManager != nil && s.userManager.Authorize(ps.user, t.ID, user.PermissionRead) != nil {
+		return
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.attached[t]; ok || ps.closed {
+		return
+	}
+	ps.attached[t] = t.Subscribe(ps.subscriber, ps.v.MaybeUserID(), ps.cancel)
+	logv(ps.v).Tag(tagSubscribe).With(t).Trace("Attached wildcard subscription to topic %s", t.ID)
+}
+
+// cachedTopicIDsFromPatterns returns the IDs of all topics in the message cache that match the given patterns,
+// and that the user is allowed to read. Topics passed in explicit are skipped.
+func (s *Server) cachedTopicIDsFromPatterns(u *user.User, patterns []string, explicit []string) ([]string, error) {
+	cachedTopics, err := s.messageCache.Topics()
+	if err != nil {
+		return nil, err
+	}
+	regex := newTopicPatternsRegex(patterns)
+	topicIDs := make([]string, 0)
+	for id := range cachedTopics {
+		if !regex.MatchString(id) || util.Contains(explicit, id) {
+			continue
+		} else if s.userManager != nil && s.userManager.Authorize(u, id, user.PermissionRead) != nil {
+			continue
+		}
+		topicIDs = append(topicIDs, id)
+	}
+	return topicIDs, nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_WildcardSubscriptions_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "GET", "/alerts-*/json?poll=1", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40054, toHTTPError(t, response.Body.String()).Code)
+
+	// Publishing to a pattern is never allowed
+	response = request(t, s, "PUT", "/alerts-*", "test", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_WildcardSubscriptions_Poll(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithWildcardSubscriptions(t))
+
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("alerts-db", "test 1", 1655740277)))
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("alerts-web", "test 2", 1655740283)))
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("mytopic", "test 3", 1655740285)))
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("alerts-db", "test 4", 1655740289)))
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("other-alerts", "test 5", 1655740293)))
+
+	response := request(t, s, "GET", "/alerts-*/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "test 1", messages[0].Message)
+	require.Equal(t, "alerts-db", messages[0].Topic)
+	require.Equal(t, "test 2", messages[1].Message)
+	require.Equal(t, "alerts-web", messages[1].Topic)
+	require.Equal(t, "test 4", messages[2].Message)
+
+	// Patterns and topics can be combined, and topics are not returned twice
+	response = request(t, s, "GET", "/alerts-db,*-alerts,mytopic,alerts-*/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 5, len(messages))
+	require.Equal(t, "test 1", messages[0].Message)
+	require.Equal(t, "test 2", messages[1].Message)
+	require.Equal(t, "test 3", messages[2].Message)
+	require.Equal(t, "test 4", messages[3].Message)
+	require.Equal(t, "test 5", messages[4].Message)
+}
+
+func TestServer_WildcardSubscriptions_NewTopics(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithWildcardSubscriptions(t))
+
+	_, err := s.topicFromID("alerts-db") // Existing topic
+	require.Nil(t, err)
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/alerts-*/json", subscribeRR)
+
+	response := request(t, s, "PUT", "/alerts-db", "existing topic", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/alerts-new", "new topic", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "other topic", nil)
+	require.Equal(t, 200, response.Code)
+	time.Sleep(200 * time.Millisecond)
+
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "alerts-*", messages[0].Topic)
+	received := []string{messages[1].Topic + ": " + messages[1].Message, messages[2].Topic + ": " + messages[2].Message}
+	require.ElementsMatch(t, []string{"alerts-db: existing topic", "alerts-new: new topic"}, received) // Publishing is async
+
+	// Subscriber is detached from all topics
+	require.Equal(t, 0, len(s.topicPatternSubs))
+	for _, id := range []string{"alerts-db", "alerts-new"} {
+		subscribers, _ := s.topics[id].Stats()
+		require.Equal(t, 0, subscribers)
+	}
+}
+
+func TestServer_WildcardSubscriptions_Auth(t *testing.T) {
+	c := newTestConfigWithWildcardSubscriptions(t)
+	c.AuthFile = newTestConfigWithAuthFile(t).AuthFile
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts-db", user.PermissionRead))
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts-web*", user.PermissionRead))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	auth := base64.RawURLEncoding.EncodeToString([]byte(util.BasicAuth("ben", "ben")))
+
+	// Only readable topics are polled
+	request(t, s, "PUT", "/alerts-db", "db message", admin)
+	request(t, s, "PUT", "/alerts-secret", "secret message", admin)
+	response := request(t, s, "GET", "/alerts-*/json?poll=1&auth="+auth, "", nil)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "db message", messages[0].Message)
+
+	// Only readable topics are attached, also if they are created later on
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, fmt.Sprintf("/alerts-*/json?auth=%s", auth), subscribeRR)
+	request(t, s, "PUT", "/alerts-secret", "another secret message", admin)
+	request(t, s, "PUT", "/alerts-secret2", "new secret message", admin)
+	request(t, s, "PUT", "/alerts-web1", "new web message", admin)
+	time.Sleep(200 * time.Millisecond)
+	subscribeCancel()
+
+	messages = toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "new web message", messages[1].Message)
+
+	// Explicitly listed topics still require access
+	response = request(t, s, "GET", "/alerts-*,alerts-secret/json?poll=1&auth="+auth, "", nil)
+	require.Equal(t, 403, response.Code)
+}
+
+func newTestConfigWithWildcardSubscriptions(t *testing.T) *Config {
+	conf := newTestConfig(t)
+	conf.EnableWildcardSubscriptions = true
+	return conf
+}
@@ -78,12 +78,15 @@ func (s *smtpSender) withCount(v *visitor, m *message, fn func() error) error {
 
 func formatMail(baseURL, senderIP, from, to string, m *message) (string, error) {
 	topicURL := baseURL + "/" + m.Topic
+	message := m.Message
+	if m.Encoding == encodingJWE {
+		message = encryptedMessageBody // The message cannot be rendered, since the server cannot decrypt it
+	}
 	subject := m.Title
 	if subject == "" {
-		subject = m.Message
+		subject = message
 	}
 	subject = strings.ReplaceAll(strings.ReplaceAll(subject, "\r", ""), "\n", " ")
-	message := m.Message
 	trailer := ""
 	if len(m.Tags) > 0 {
 		emojis, tags, err := toEmojis(m.Tags)
@@ -3,6 +3,7 @@ package server
 import (
 	"net/http"
 	"net/netip"
+	"strings"
 	"time"
 
 	"heckel.io/ntfy/v2/log"
@@ -13,10 +14,12 @@ import (
 
 // List of possible events
 const (
-	openEvent        = "open"
-	keepaliveEvent   = "keepalive"
-	messageEvent     = "message"
-	pollRequestEvent = "poll_request"
+	openEvent          = "open"
+	keepaliveEvent     = "keepalive"
+	messageEvent       = "message"
+	messageUpdateEvent = "message_update"
+	messageDeleteEvent = "message_delete"
+	pollRequestEvent   = "poll_request"
 )
 
 const (
@@ -39,8 +42,10 @@ type message struct {
 	Actions     []*action   `json:"actions,omitempty"`
 	Attachment  *attachment `json:"attachment,omitempty"`
 	PollID      string      `json:"poll_id,omitempty"`
+	MessageID   string      `json:"message_id,omitempty"`   // ID of the updated or deleted message (message_update and message_delete events)
 	ContentType string      `json:"content_type,omitempty"` // text/plain by default (if empty), or text/markdown
-	Encoding    string      `json:"encoding,omitempty"`     // empty for raw UTF-8, or "base64" for encoded bytes
+	Encoding    string      `json:"encoding,omitempty"`     // empty for raw UTF-8, "base64" for encoded bytes, or "jwe" for encrypted messages
+	Origin      []string    `json:"origin,omitempty"`       // Base URLs of the federated servers this message was relayed through
 	Sender      netip.Addr  `json:"-"`                      // IP address of uploader, used for rate limiting
 	User        string      `json:"-"`                      // UserID of the uploader, used to associated attachments
 }
@@ -63,19 +68,21 @@ func (m *message) Context() log.Context {
 }
 
 type attachment struct {
-	Name    string `json:"name"`
-	Type    string `json:"type,omitempty"`
-	Size    int64  `json:"size,omitempty"`
-	Expires int64  `json:"expires,omitempty"`
-	URL     string `json:"url"`
+	Name      string `json:"name"`
+	Type      string `json:"type,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Expires   int64  `json:"expires,omitempty"`
+	URL       string `json:"url"`
+	Preview   string `json:"preview,omitempty"` // URL of a downscaled preview image, see Config.AttachmentImageProcessing
+	Encrypted bool   `json:"-"`                 // Whether the file (and its preview) is encrypted at rest, see fileCache
 }
 
 type action struct {
 	ID      string            `json:"id"`
-	Action  string            `json:"action"`            // "view", "broadcast", or "http"
+	Action  string            `json:"action"`            // "view", "broadcast", "http" or "ack"
 	Label   string            `json:"label"`             // action button label
 	Clear   bool              `json:"clear"`             // clear notification after successful execution
-	URL     string            `json:"url,omitempty"`     // used in "view" and "http" actions
+	URL     string            `json:"url,omitempty"`     // used in "view" and "http" actions, set by the server for "ack" actions
 	Method  string            `json:"method,omitempty"`  // used in "http" action, default is POST (!)
 	Headers map[string]string `json:"headers,omitempty"` // used in "http" action
 	Body    string            `json:"body,omitempty"`    // used in "http" action
@@ -106,6 +113,7 @@ type publishMessage struct {
 	Email    string   `json:"email"`
 	Call     string   `json:"call"`
 	Delay    string   `json:"delay"`
+	Encoding string   `json:"encoding"`
 }
 
 // messageEncoder is a function that knows how to encode a message
@@ -137,6 +145,29 @@ func newDefaultMessage(topic, msg string) *message {
 	return newMessage(messageEvent, topic, msg)
 }
 
+// newMessageUpdateMessage is a convenience method to create a message_update event for the given (updated) message.
+// Like the message_delete event, it has its own ID and time, so that it is stored in the message cache, and replayed
+// to clients that poll with since=<id>. The attachment cannot be changed, so it is not included.
+func newMessageUpdateMessage(m *message) *message {
+	update := *m
+	update.ID = util.RandomString(messageIDLength)
+	update.Time = time.Now().Unix()
+	update.Event = messageUpdateEvent
+	update.MessageID = m.ID
+	update.Attachment = nil
+	return &update
+}
+
+// newMessageDeleteMessage is a convenience method to create a message_delete event (a tombstone) for the given message
+func newMessageDeleteMessage(m *message) *message {
+	tombstone := newMessage(messageDeleteEvent, m.Topic, "")
+	tombstone.Expires = m.Expires
+	tombstone.MessageID = m.ID
+	tombstone.Sender = m.Sender
+	tombstone.User = m.User
+	return tombstone
+}
+
 // newPollRequestMessage is a convenience method to create a poll request message
 func newPollRequestMessage(topic, pollID string) *message {
 	m := newMessage(pollRequestEvent, topic, newMessageBody)
@@ -192,6 +223,7 @@ type queryFilter struct {
 	Title    string
 	Tags     []string
 	Priority []int
+	Expr     filterExpr // Parsed filter expression, may be nil, see parseFilter
 }
 
 func parseQueryFilters(r *http.Request) (*queryFilter, error) {
@@ -207,24 +239,36 @@ func parseQueryFilters(r *http.Request) (*queryFilter, error) {
 		}
 		priorityFilter = append(priorityFilter, priority)
 	}
+	var exprFilter filterExpr
+	if filter := strings.TrimSpace(readParam(r, "x-filter", "filter", "fi")); filter != "" {
+		expr, err := parseFilter(filter)
+		if err != nil {
+			return nil, errHTTPBadRequestFilterInvalid.Wrap("%s", err.Error())
+		}
+		exprFilter = expr
+	}
 	return &queryFilter{
 		ID:       idFilter,
 		Message:  messageFilter,
 		Title:    titleFilter,
 		Tags:     tagsFilter,
 		Priority: priorityFilter,
+		Expr:     exprFilter,
 	}, nil
 }
 
 func (q *queryFilter) Pass(msg *message) bool {
-	if msg.Event != messageEvent {
-		return true // filters only apply to messages
+	if msg.Event != messageEvent && msg.Event != messageUpdateEvent {
+		return true // filters only apply to messages and message updates
 	} else if q.ID != "" && msg.ID != q.ID {
 		return false
-	} else if q.Message != "" && msg.Message != q.Message {
-		return false
-	} else if q.Title != "" && msg.Title != q.Title {
-		return false
+	}
+	if msg.Encoding != encodingJWE { // Title and message of encrypted messages are inside the JWE, so they cannot be filtered
+		if q.Message != "" && msg.Message != q.Message {
+			return false
+		} else if q.Title != "" && msg.Title != q.Title {
+			return false
+		}
 	}
 	messagePriority := msg.Priority
 	if messagePriority == 0 {
@@ -236,9 +280,28 @@ func (q *queryFilter) Pass(msg *message) bool {
 	if len(q.Tags) > 0 && !util.ContainsAll(msg.Tags, q.Tags) {
 		return false
 	}
+	if q.Expr != nil && !q.Expr.Matches(msg) {
+		return false
+	}
 	return true
 }
 
+// messageSearch describes a search over the message cache, see messageCache.Search
+type messageSearch struct {
+	Topics []string
+	Text   string // Free text, all words must match; may be empty
+	Since  time.Time
+	Until  time.Time
+	Cursor *searchCursor // Last message of the previous page, or nil for the first page
+	Limit  int
+}
+
+// searchCursor identifies the last message of a page of search results, see apiSearchResponse
+type searchCursor struct {
+	Time int64
+	ID   string
+}
+
 type apiHealthResponse struct {
 	Healthy bool `json:"healthy"`
 }
@@ -248,6 +311,11 @@ type apiStatsResponse struct {
 	MessagesRate float64 `json:"messages_rate"` // Average number of messages per second
 }
 
+type apiSearchResponse struct {
+	Messages   []*message `json:"messages"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
 type apiUserAddRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -282,6 +350,79 @@ type apiAccessResetRequest struct {
 	Topic    string `json:"topic"`
 }
 
+type apiGroupAddRequest struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type apiGroupResponse struct {
+	Name    string                  `json:"name"`
+	Members []string                `json:"members"`
+	Grants  []*apiUserGrantResponse `json:"grants,omitempty"`
+}
+
+type apiGroupDeleteRequest struct {
+	Name string `json:"name"`
+}
+
+type apiGroupMemberRequest struct {
+	Group    string `json:"group"`
+	Username string `json:"username"`
+}
+
+type apiGroupAccessAllowRequest struct {
+	Group      string `json:"group"`
+	Topic      string `json:"topic"` // This may be a pattern
+	Permission string `json:"permission"`
+}
+
+type apiGroupAccessResetRequest struct {
+	Group string `json:"group"`
+	Topic string `json:"topic"`
+}
+
+type apiRuleAddRequest struct {
+	Topic     string `json:"topic"` // This may be a pattern
+	Target    string `json:"target"`
+	Filter    string `json:"filter"`
+	Template  string `json:"template"`
+	RateLimit int    `json:"rate_limit"`
+}
+
+type apiRuleResponse struct {
+	ID        string `json:"id"`
+	Topic     string `json:"topic"` // This may be a pattern
+	Target    string `json:"target"`
+	Filter    string `json:"filter,omitempty"`
+	Template  string `json:"template,omitempty"`
+	RateLimit int    `json:"rate_limit"`
+}
+
+type apiRuleDeleteRequest struct {
+	ID string `json:"id"`
+}
+
+type apiEscalationPolicyAddRequest struct {
+	Topic string                    `json:"topic"` // This may be a pattern
+	Steps []*apiEscalationStepModel `json:"steps"`
+}
+
+type apiEscalationStepModel struct {
+	Delay  string `json:"delay"` // Duration, e.g. "5m"
+	Type   string `json:"type"`
+	Target string `json:"target"`
+}
+
+type apiEscalationPolicyResponse struct {
+	ID    string                    `json:"id"`
+	Topic string                    `json:"topic"` // This may be a pattern
+	Steps []*apiEscalationStepModel `json:"steps"`
+}
+
+type apiEscalationPolicyDeleteRequest struct {
+	ID string `json:"id"`
+}
+
 type apiAccountCreateRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -297,22 +438,38 @@ type apiAccountDeleteRequest struct {
 }
 
 type apiAccountTokenIssueRequest struct {
-	Label   *string `json:"label"`
-	Expires *int64  `json:"expires"` // Unix timestamp
+	Label      *string               `json:"label"`
+	Expires    *int64                `json:"expires"` // Unix timestamp
+	Scope      *apiAccountTokenScope `json:"scope"`
+	AllowedIPs []string              `json:"allowed_ips"` // IP addresses or CIDR ranges
 }
 
 type apiAccountTokenUpdateRequest struct {
-	Token   string  `json:"token"`
-	Label   *string `json:"label"`
-	Expires *int64  `json:"expires"` // Unix timestamp
+	Token      string   `json:"token"`
+	Label      *string  `json:"label"`
+	Expires    *int64   `json:"expires"`     // Unix timestamp
+	AllowedIPs []string `json:"allowed_ips"` // Unchanged if not set, empty list allows all
 }
 
 type apiAccountTokenResponse struct {
-	Token      string `json:"token"`
-	Label      string `json:"label,omitempty"`
-	LastAccess int64  `json:"last_access,omitempty"`
-	LastOrigin string `json:"last_origin,omitempty"`
-	Expires    int64  `json:"expires,omitempty"` // Unix timestamp
+	Token      string                `json:"token"`
+	Label      string                `json:"label,omitempty"`
+	LastAccess int64                 `json:"last_access,omitempty"`
+	LastOrigin string                `json:"last_origin,omitempty"`
+	Expires    int64                 `json:"expires,omitempty"` // Unix timestamp
+	Scope      *apiAccountTokenScope `json:"scope,omitempty"`
+	AllowedIPs []string              `json:"allowed_ips,omitempty"`
+}
+
+type apiAccountTokenScope struct {
+	Topics      []*apiAccountTokenScopeTopic `json:"topics,omitempty"`
+	PublishOnly bool                         `json:"publish_only,omitempty"`
+	NoAccount   bool                         `json:"no_account,omitempty"`
+}
+
+type apiAccountTokenScopeTopic struct {
+	Topic      string `json:"topic"` // This may be a pattern
+	Permission string `json:"permission"`
 }
 
 type apiAccountPhoneNumberVerifyRequest struct {
@@ -331,16 +488,17 @@ type apiAccountTier struct {
 }
 
 type apiAccountLimits struct {
-	Basis                    string `json:"basis,omitempty"` // "ip" or "tier"
-	Messages                 int64  `json:"messages"`
-	MessagesExpiryDuration   int64  `json:"messages_expiry_duration"`
-	Emails                   int64  `json:"emails"`
-	Calls                    int64  `json:"calls"`
-	Reservations             int64  `json:"reservations"`
-	AttachmentTotalSize      int64  `json:"attachment_total_size"`
-	AttachmentFileSize       int64  `json:"attachment_file_size"`
-	AttachmentExpiryDuration int64  `json:"attachment_expiry_duration"`
-	AttachmentBandwidth      int64  `json:"attachment_bandwidth"`
+	Basis                     string `json:"basis,omitempty"` // "ip" or "tier"
+	Messages                  int64  `json:"messages"`
+	MessagesExpiryDuration    int64  `json:"messages_expiry_duration"`
+	Emails                    int64  `json:"emails"`
+	Calls                     int64  `json:"calls"`
+	Reservations              int64  `json:"reservations"`
+	AttachmentTotalSize       int64  `json:"attachment_total_size"`
+	AttachmentFileSize        int64  `json:"attachment_file_size"`
+	AttachmentExpiryDuration  int64  `json:"attachment_expiry_duration"`
+	AttachmentBandwidth       int64  `json:"attachment_bandwidth"`
+	AttachmentImageProcessing bool   `json:"attachment_image_processing,omitempty"`
 }
 
 type apiAccountStats struct {
@@ -378,6 +536,7 @@ type apiAccountResponse struct {
 	Notification  *user.NotificationPrefs    `json:"notification,omitempty"`
 	Subscriptions []*user.Subscription       `json:"subscriptions,omitempty"`
 	Reservations  []*apiAccountReservation   `json:"reservations,omitempty"`
+	Webhooks      []*apiAccountWebhook       `json:"webhooks,omitempty"`
 	Tokens        []*apiAccountTokenResponse `json:"tokens,omitempty"`
 	PhoneNumbers  []string                   `json:"phone_numbers,omitempty"`
 	Tier          *apiAccountTier            `json:"tier,omitempty"`
@@ -391,6 +550,29 @@ type apiAccountReservationRequest struct {
 	Everyone string `json:"everyone"`
 }
 
+type apiAccountWebhook struct {
+	ID       string                   `json:"id"`
+	Topic    string                   `json:"topic"`
+	URL      string                   `json:"url"`
+	Template string                   `json:"template,omitempty"`
+	Secret   string                   `json:"secret,omitempty"` // Only set when the webhook is created
+	Status   *apiAccountWebhookStatus `json:"status"`
+}
+
+type apiAccountWebhookStatus struct {
+	LastAttempt int64  `json:"last_attempt,omitempty"`
+	LastSuccess int64  `json:"last_success,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	Failures    int64  `json:"failures"`
+	Pending     int64  `json:"pending"`
+}
+
+type apiAccountWebhookRequest struct {
+	Topic    string `json:"topic"`
+	URL      string `json:"url"`
+	Template string `json:"template"`
+}
+
 type apiConfigResponse struct {
 	BaseURL            string   `json:"base_url"`
 	AppRoot            string   `json:"app_root"`
@@ -400,7 +582,9 @@ type apiConfigResponse struct {
 	EnableCalls        bool     `json:"enable_calls"`
 	EnableEmails       bool     `json:"enable_emails"`
 	EnableReservations bool     `json:"enable_reservations"`
+	EnableWebhooks     bool     `json:"enable_webhooks"`
 	EnableWebPush      bool     `json:"enable_web_push"`
+	EnableOIDC         bool     `json:"enable_oidc"`
 	BillingContact     string   `json:"billing_contact"`
 	WebPushPublicKey   string   `json:"web_push_public_key"`
 	DisallowedTopics   []string `json:"disallowed_topics"`
@@ -477,8 +661,10 @@ type apiWebPushUpdateSubscriptionRequest struct {
 
 // List of possible Web Push events (see sw.js)
 const (
-	webPushMessageEvent  = "message"
-	webPushExpiringEvent = "subscription_expiring"
+	webPushMessageEvent       = "message"
+	webPushMessageUpdateEvent = "message_update"
+	webPushMessageDeleteEvent = "message_delete"
+	webPushExpiringEvent      = "subscription_expiring"
 )
 
 type webPushPayload struct {
@@ -488,8 +674,15 @@ type webPushPayload struct {
 }
 
 func newWebPushPayload(subscriptionID string, message *message) *webPushPayload {
+	event := webPushMessageEvent
+	switch message.Event {
+	case messageUpdateEvent:
+		event = webPushMessageUpdateEvent
+	case messageDeleteEvent:
+		event = webPushMessageDeleteEvent
+	}
 	return &webPushPayload{
-		Event:          webPushMessageEvent,
+		Event:          event,
 		SubscriptionID: subscriptionID,
 		Message:        message,
 	}
@@ -505,6 +698,37 @@ func newWebPushSubscriptionExpiringPayload() *webPushControlMessagePayload {
 	}
 }
 
+// escalation is the persisted state of a running escalation, see escalation policies in the user package
+type escalation struct {
+	MessageID string // Message that is being escalated
+	PolicyID  string // Escalation policy
+	Token     string // Secret token required to acknowledge the message (see "ack" action)
+	Step      int    // Index of the next policy step
+	Next      int64  // Unix time at which the next step is due
+}
+
+// upload is the state of a resumable upload, see handleUploadCreate. The data is stored in chunks in the
+// fileCache, and is turned into an attachment when a message referencing the upload is published.
+type upload struct {
+	ID        string     // Upload ID, used to reference the upload when publishing
+	Secret    string     // Secret required to resume, cancel or attach the upload, only returned on creation
+	Sender    netip.Addr // IP address of the uploader, used for rate limiting if there is no user
+	User      string     // User ID of the uploader, may be empty
+	Size      int64      // Total size of the upload, as announced when it was created
+	Received  int64      // Number of bytes received so far, i.e. the offset of the next chunk
+	Chunks    []string   // File IDs of the chunks received so far, in order
+	Encrypted bool       // Whether the chunks are encrypted at rest, see fileCache.WriteChunk
+	Expires   int64      // Unix time at which the upload expires, if it is not finalized
+}
+
+type apiUploadResponse struct {
+	ID      string `json:"id"`
+	Secret  string `json:"secret,omitempty"`
+	Size    int64  `json:"size"`
+	Offset  int64  `json:"offset"`
+	Expires int64  `json:"expires"`
+}
+
 type webPushSubscription struct {
 	ID       string
 	Endpoint string
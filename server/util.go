@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"heckel.io/ntfy/v2/util"
@@ -154,3 +156,30 @@ func maybeIgnoreSpecialHeader(name, value string) string {
 	}
 	return value
 }
+
+// isJWE returns true if the given string looks like a JWE in compact serialization (RFC 7516), i.e. five
+// base64url-encoded parts, the first of which is a JSON header with "alg" and "enc" fields. The server cannot
+// verify anything beyond that, since it does not know the key.
+func isJWE(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) != 5 {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if _, err := base64.RawURLEncoding.DecodeString(part); err != nil {
+			return false
+		}
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return false
+	}
+	return header.Alg != "" && header.Enc != ""
+}
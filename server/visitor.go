@@ -54,19 +54,20 @@ const (
 type visitor struct {
 	config              *Config
 	messageCache        *messageCache
-	userManager         *user.Manager      // May be nil
-	ip                  netip.Addr         // Visitor IP address
-	user                *user.User         // Only set if authenticated user, otherwise nil
-	requestLimiter      *rate.Limiter      // Rate limiter for (almost) all requests (including messages)
-	messagesLimiter     *util.FixedLimiter // Rate limiter for messages
-	emailsLimiter       *util.RateLimiter  // Rate limiter for emails
-	callsLimiter        *util.FixedLimiter // Rate limiter for calls
-	subscriptionLimiter *util.FixedLimiter // Fixed limiter for active subscriptions (ongoing connections)
-	bandwidthLimiter    *util.RateLimiter  // Limiter for attachment bandwidth downloads
-	accountLimiter      *rate.Limiter      // Rate limiter for account creation, may be nil
-	authLimiter         *rate.Limiter      // Limiter for incorrect login attempts, may be nil
-	firebase            time.Time          // Next allowed Firebase message
-	seen                time.Time          // Last seen time of this visitor (needed for removal of stale visitors)
+	userManager         *user.Manager            // May be nil
+	ip                  netip.Addr               // Visitor IP address
+	user                *user.User               // Only set if authenticated user, otherwise nil
+	requestLimiter      *rate.Limiter            // Rate limiter for (almost) all requests (including messages)
+	messagesLimiter     *util.FixedLimiter       // Rate limiter for messages
+	emailsLimiter       *util.RateLimiter        // Rate limiter for emails
+	callsLimiter        *util.FixedLimiter       // Rate limiter for calls
+	subscriptionLimiter *util.FixedLimiter       // Fixed limiter for active subscriptions (ongoing connections)
+	bandwidthLimiter    *util.RateLimiter        // Limiter for attachment bandwidth downloads
+	accountLimiter      *rate.Limiter            // Rate limiter for account creation, may be nil
+	authLimiter         *rate.Limiter            // Limiter for incorrect login attempts, may be nil
+	ruleLimiters        map[string]*rate.Limiter // Limiters for routed messages, keyed by rule ID (see RuleAllowed)
+	firebase            time.Time                // Next allowed Firebase message
+	seen                time.Time                // Last seen time of this visitor (needed for removal of stale visitors)
 	mu                  sync.RWMutex
 }
 
@@ -76,20 +77,21 @@ type visitorInfo struct {
 }
 
 type visitorLimits struct {
-	Basis                    visitorLimitBasis
-	RequestLimitBurst        int
-	RequestLimitReplenish    rate.Limit
-	MessageLimit             int64
-	MessageExpiryDuration    time.Duration
-	EmailLimit               int64
-	EmailLimitBurst          int
-	EmailLimitReplenish      rate.Limit
-	CallLimit                int64
-	ReservationsLimit        int64
-	AttachmentTotalSizeLimit int64
-	AttachmentFileSizeLimit  int64
-	AttachmentExpiryDuration time.Duration
-	AttachmentBandwidthLimit int64
+	Basis                     visitorLimitBasis
+	RequestLimitBurst         int
+	RequestLimitReplenish     rate.Limit
+	MessageLimit              int64
+	MessageExpiryDuration     time.Duration
+	EmailLimit                int64
+	EmailLimitBurst           int
+	EmailLimitReplenish       rate.Limit
+	CallLimit                 int64
+	ReservationsLimit         int64
+	AttachmentTotalSizeLimit  int64
+	AttachmentFileSizeLimit   int64
+	AttachmentExpiryDuration  time.Duration
+	AttachmentBandwidthLimit  int64
+	AttachmentImageProcessing bool
 }
 
 type visitorStats struct {
@@ -137,6 +139,7 @@ func newVisitor(conf *Config, messageCache *messageCache, userManager *user.Mana
 		bandwidthLimiter:    nil, // Set in resetLimiters
 		accountLimiter:      nil, // Set in resetLimiters, may be nil
 		authLimiter:         nil, // Set in resetLimiters, may be nil
+		ruleLimiters:        make(map[string]*rate.Limiter),
 	}
 	v.resetLimitersNoLock(messages, emails, calls, false)
 	return v
@@ -227,6 +230,15 @@ func (v *visitor) MessageAllowed() bool {
 	return v.messagesLimiter.Allow()
 }
 
+// CountRemoteMessage counts a message that was published by this visitor on another cluster replica
+// against the request and message limits, without rejecting it
+func (v *visitor) CountRemoteMessage() {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	v.requestLimiter.Allow()
+	v.messagesLimiter.Allow()
+}
+
 func (v *visitor) EmailAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
@@ -239,6 +251,19 @@ func (v *visitor) CallAllowed() bool {
 	return v.callsLimiter.Allow()
 }
 
+// RuleAllowed returns true if a message may be routed via the given rule. Each rule has its own limiter
+// per visitor, allowing a burst of limit messages, replenished over the course of an hour.
+func (v *visitor) RuleAllowed(ruleID string, limit int) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	limiter, ok := v.ruleLimiters[ruleID]
+	if !ok || limiter.Burst() != limit {
+		limiter = rate.NewLimiter(rate.Every(time.Hour/time.Duration(limit)), limit)
+		v.ruleLimiters[ruleID] = limiter
+	}
+	return limiter.Allow()
+}
+
 func (v *visitor) SubscriptionAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
@@ -417,20 +442,21 @@ func (v *visitor) limitsNoLock() *visitorLimits {
 
 func tierBasedVisitorLimits(conf *Config, tier *user.Tier) *visitorLimits {
 	return &visitorLimits{
-		Basis:                    visitorLimitBasisTier,
-		RequestLimitBurst:        util.MinMax(int(float64(tier.MessageLimit)*visitorMessageToRequestLimitBurstRate), conf.VisitorRequestLimitBurst, visitorMessageToRequestLimitBurstMax),
-		RequestLimitReplenish:    util.Max(rate.Every(conf.VisitorRequestLimitReplenish), dailyLimitToRate(tier.MessageLimit*visitorMessageToRequestLimitReplenishFactor)),
-		MessageLimit:             tier.MessageLimit,
-		MessageExpiryDuration:    tier.MessageExpiryDuration,
-		EmailLimit:               tier.EmailLimit,
-		EmailLimitBurst:          util.MinMax(int(float64(tier.EmailLimit)*visitorEmailLimitBurstRate), conf.VisitorEmailLimitBurst, visitorEmailLimitBurstMax),
-		EmailLimitReplenish:      dailyLimitToRate(tier.EmailLimit),
-		CallLimit:                tier.CallLimit,
-		ReservationsLimit:        tier.ReservationLimit,
-		AttachmentTotalSizeLimit: tier.AttachmentTotalSizeLimit,
-		AttachmentFileSizeLimit:  tier.AttachmentFileSizeLimit,
-		AttachmentExpiryDuration: tier.AttachmentExpiryDuration,
-		AttachmentBandwidthLimit: tier.AttachmentBandwidthLimit,
+		Basis:                     visitorLimitBasisTier,
+		RequestLimitBurst:         util.MinMax(int(float64(tier.MessageLimit)*visitorMessageToRequestLimitBurstRate), conf.VisitorRequestLimitBurst, visitorMessageToRequestLimitBurstMax),
+		RequestLimitReplenish:     util.Max(rate.Every(conf.VisitorRequestLimitReplenish), dailyLimitToRate(tier.MessageLimit*visitorMessageToRequestLimitReplenishFactor)),
+		MessageLimit:              tier.MessageLimit,
+		MessageExpiryDuration:     tier.MessageExpiryDuration,
+		EmailLimit:                tier.EmailLimit,
+		EmailLimitBurst:           util.MinMax(int(float64(tier.EmailLimit)*visitorEmailLimitBurstRate), conf.VisitorEmailLimitBurst, visitorEmailLimitBurstMax),
+		EmailLimitReplenish:       dailyLimitToRate(tier.EmailLimit),
+		CallLimit:                 tier.CallLimit,
+		ReservationsLimit:         tier.ReservationLimit,
+		AttachmentTotalSizeLimit:  tier.AttachmentTotalSizeLimit,
+		AttachmentFileSizeLimit:   tier.AttachmentFileSizeLimit,
+		AttachmentExpiryDuration:  tier.AttachmentExpiryDuration,
+		AttachmentBandwidthLimit:  tier.AttachmentBandwidthLimit,
+		AttachmentImageProcessing: tier.AttachmentImageProcessing,
 	}
 }
 
@@ -440,20 +466,21 @@ func configBasedVisitorLimits(conf *Config) *visitorLimits {
 		messagesLimit = int64(conf.VisitorMessageDailyLimit)
 	}
 	return &visitorLimits{
-		Basis:                    visitorLimitBasisIP,
-		RequestLimitBurst:        conf.VisitorRequestLimitBurst,
-		RequestLimitReplenish:    rate.Every(conf.VisitorRequestLimitReplenish),
-		MessageLimit:             messagesLimit,
-		MessageExpiryDuration:    conf.CacheDuration,
-		EmailLimit:               replenishDurationToDailyLimit(conf.VisitorEmailLimitReplenish), // Approximation!
-		EmailLimitBurst:          conf.VisitorEmailLimitBurst,
-		EmailLimitReplenish:      rate.Every(conf.VisitorEmailLimitReplenish),
-		CallLimit:                visitorDefaultCallsLimit,
-		ReservationsLimit:        visitorDefaultReservationsLimit,
-		AttachmentTotalSizeLimit: conf.VisitorAttachmentTotalSizeLimit,
-		AttachmentFileSizeLimit:  conf.AttachmentFileSizeLimit,
-		AttachmentExpiryDuration: conf.AttachmentExpiryDuration,
-		AttachmentBandwidthLimit: conf.VisitorAttachmentDailyBandwidthLimit,
+		Basis:                     visitorLimitBasisIP,
+		RequestLimitBurst:         conf.VisitorRequestLimitBurst,
+		RequestLimitReplenish:     rate.Every(conf.VisitorRequestLimitReplenish),
+		MessageLimit:              messagesLimit,
+		MessageExpiryDuration:     conf.CacheDuration,
+		EmailLimit:                replenishDurationToDailyLimit(conf.VisitorEmailLimitReplenish), // Approximation!
+		EmailLimitBurst:           conf.VisitorEmailLimitBurst,
+		EmailLimitReplenish:       rate.Every(conf.VisitorEmailLimitReplenish),
+		CallLimit:                 visitorDefaultCallsLimit,
+		ReservationsLimit:         visitorDefaultReservationsLimit,
+		AttachmentTotalSizeLimit:  conf.VisitorAttachmentTotalSizeLimit,
+		AttachmentFileSizeLimit:   conf.AttachmentFileSizeLimit,
+		AttachmentExpiryDuration:  conf.AttachmentExpiryDuration,
+		AttachmentBandwidthLimit:  conf.VisitorAttachmentDailyBandwidthLimit,
+		AttachmentImageProcessing: conf.AttachmentImageProcessing,
 	}
 }
 
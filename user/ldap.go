@@ -0,0 +1,702 @@
+package user
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file contains a minimal LDAPv3 client (RFC 4511), which supports exactly what is needed to authenticate
+// users and look up their groups: simple bind, subtree search with string filters (RFC 4515), and unbind.
+
+const (
+	ldapDefaultTimeout    = 10 * time.Second
+	ldapMessageBytesLimit = 1024 * 1024 // Max size of a single LDAP message read from the server
+	ldapUsernameParam     = "%u"        // Replaced with the (escaped) username in filters
+	ldapUserDNParam       = "%s"        // Replaced with the (escaped) username in the user filter, and the user DN in the group filter
+)
+
+// BER tags, see RFC 4511, section 4
+const (
+	berTagBoolean                = 0x01
+	berTagInteger                = 0x02
+	berTagOctetString            = 0x04
+	berTagEnumerated             = 0x0a
+	berTagSequence               = 0x30
+	berTagSet                    = 0x31
+	ldapTagBindRequest           = 0x60
+	ldapTagBindResponse          = 0x61
+	ldapTagUnbindRequest         = 0x42
+	ldapTagSearchRequest         = 0x63
+	ldapTagSearchResultEntry     = 0x64
+	ldapTagSearchResultDone      = 0x65
+	ldapTagSearchResultReference = 0x73
+	ldapTagSimpleAuth            = 0x80
+	ldapTagFilterAnd             = 0xa0
+	ldapTagFilterOr              = 0xa1
+	ldapTagFilterNot             = 0xa2
+	ldapTagFilterEquality        = 0xa3
+	ldapTagFilterSubstrings      = 0xa4
+	ldapTagFilterGreaterOrEqual  = 0xa5
+	ldapTagFilterLessOrEqual     = 0xa6
+	ldapTagFilterPresent         = 0x87
+	ldapTagFilterApprox          = 0xa8
+	ldapTagSubstringInitial      = 0x80
+	ldapTagSubstringAny          = 0x81
+	ldapTagSubstringFinal        = 0x82
+)
+
+const (
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+	ldapScopeSubtree             = 2
+	ldapDerefNever               = 0
+	ldapNoAttributes             = "1.1" // Special attribute list to request no attributes, see RFC 4511, section 4.5.1.8
+)
+
+var (
+	errLDAPInvalidFilter  = errors.New("invalid LDAP filter")
+	errLDAPInvalidMessage = errors.New("invalid LDAP message")
+	errLDAPUserAmbiguous  = errors.New("LDAP user filter matches more than one entry")
+)
+
+// LDAPConfig is the configuration of an LDAPDirectory
+type LDAPConfig struct {
+	URL            string        // Server URL, e.g. ldap://ldap.example.com or ldaps://ldap.example.com:636
+	BindDN         string        // DN used to search for users and groups; if empty, an anonymous bind is used
+	BindPassword   string        // Password of the bind DN
+	UserBaseDN     string        // Base DN to search for users, e.g. ou=people,dc=example,dc=com
+	UserFilter     string        // Filter to find a user, e.g. (uid=%s); %s is replaced with the username
+	GroupBaseDN    string        // Base DN to search for groups; if empty, group lookups are disabled
+	GroupFilter    string        // Filter to find a user's groups, e.g. (member=%s); %s is replaced with the user DN, %u with the username
+	GroupAttribute string        // Attribute of the group entries that holds the group name, e.g. cn
+	Timeout        time.Duration // Timeout for connecting and for each operation; defaults to 10 seconds
+	TLSConfig      *tls.Config   // TLS config for ldaps:// URLs, optional
+}
+
+// LDAPDirectory is a Directory backed by an LDAP server. Users are authenticated by searching for the user's
+// entry (using the bind DN, or anonymously), and then binding as the user with the given password. Groups are
+// the entries in the group base DN that match the group filter. A new connection is used for every call.
+type LDAPDirectory struct {
+	config  *LDAPConfig
+	network string
+	address string
+	tls     bool
+}
+
+var _ Directory = (*LDAPDirectory)(nil)
+
+// NewLDAPDirectory creates a new LDAPDirectory from the given config. It validates the URL and filters,
+// but does not connect to the server.
+func NewLDAPDirectory(config *LDAPConfig) (*LDAPDirectory, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL %s: %w", config.URL, err)
+	}
+	var useTLS bool
+	var defaultPort string
+	switch u.Scheme {
+	case "ldap":
+		defaultPort = "389"
+	case "ldaps":
+		useTLS, defaultPort = true, "636"
+	default:
+		return nil, fmt.Errorf("invalid LDAP URL %s: scheme must be ldap:// or ldaps://", config.URL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %s: host missing", config.URL)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	if config.UserBaseDN == "" || !strings.Contains(config.UserFilter, ldapUserDNParam) {
+		return nil, fmt.Errorf("invalid LDAP config: user base DN and user filter (containing %s) are required", ldapUserDNParam)
+	} else if _, err := ldapParseFilter(config.UserFilter); err != nil {
+		return nil, fmt.Errorf("invalid LDAP user filter %s: %w", config.UserFilter, err)
+	}
+	if config.GroupBaseDN != "" {
+		if config.GroupAttribute == "" {
+			return nil, errors.New("invalid LDAP config: group attribute is required")
+		} else if _, err := ldapParseFilter(config.GroupFilter); err != nil {
+			return nil, fmt.Errorf("invalid LDAP group filter %s: %w", config.GroupFilter, err)
+		}
+	}
+	return &LDAPDirectory{
+		config:  config,
+		network: "tcp",
+		address: net.JoinHostPort(u.Hostname(), port),
+		tls:     useTLS,
+	}, nil
+}
+
+// Authenticate checks the username and password against the LDAP server. It returns ErrUnauthenticated
+// if the user does not exist, or the password is wrong.
+func (d *LDAPDirectory) Authenticate(username, password string) error {
+	if username == "" || password == "" {
+		return ErrUnauthenticated // An empty password would result in an unauthenticated bind, which always succeeds
+	}
+	conn, err := d.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	dn, err := d.userDN(conn, username)
+	if err != nil {
+		return err
+	} else if dn == "" {
+		return ErrUnauthenticated
+	}
+	return conn.Bind(dn, password)
+}
+
+// Groups returns the names of the groups the user is a member of. If the user does not exist, or
+// group lookups are disabled (no group base DN), an empty list is returned.
+func (d *LDAPDirectory) Groups(username string) ([]string, error) {
+	if d.config.GroupBaseDN == "" {
+		return []string{}, nil
+	}
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dn, err := d.userDN(conn, username)
+	if err != nil {
+		return nil, err
+	} else if dn == "" {
+		return []string{}, nil
+	}
+	filter := strings.NewReplacer(ldapUserDNParam, ldapEscapeFilter(dn), ldapUsernameParam, ldapEscapeFilter(username)).Replace(d.config.GroupFilter)
+	entries, err := conn.Search(d.config.GroupBaseDN, filter, []string{d.config.GroupAttribute})
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0)
+	for _, entry := range entries {
+		if values := entry.Attributes[strings.ToLower(d.config.GroupAttribute)]; len(values) > 0 {
+			groups = append(groups, values[0])
+		}
+	}
+	return groups, nil
+}
+
+// userDN returns the DN of the given user, or an empty string if the user does not exist
+func (d *LDAPDirectory) userDN(conn *ldapConn, username string) (string, error) {
+	filter := strings.NewReplacer(ldapUserDNParam, ldapEscapeFilter(username), ldapUsernameParam, ldapEscapeFilter(username)).Replace(d.config.UserFilter)
+	entries, err := conn.Search(d.config.UserBaseDN, filter, []string{ldapNoAttributes})
+	if err != nil {
+		return "", err
+	} else if len(entries) == 0 {
+		return "", nil
+	} else if len(entries) > 1 {
+		return "", errLDAPUserAmbiguous
+	}
+	return entries[0].DN, nil
+}
+
+// connect opens a new connection, and binds as the configured bind DN (if any)
+func (d *LDAPDirectory) connect() (*ldapConn, error) {
+	timeout := d.config.Timeout
+	if timeout == 0 {
+		timeout = ldapDefaultTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if d.tls {
+		tlsConfig := d.config.TLSConfig
+		if tlsConfig == nil {
+			host, _, _ := net.SplitHostPort(d.address)
+			tlsConfig = &tls.Config{ServerName: host}
+		}
+		conn, err = tls.DialWithDialer(dialer, d.network, d.address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial(d.network, d.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &ldapConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: timeout,
+	}
+	if d.config.BindDN != "" {
+		if err := c.Bind(d.config.BindDN, d.config.BindPassword); err != nil {
+			c.Close()
+			if errors.Is(err, ErrUnauthenticated) {
+				return nil, fmt.Errorf("LDAP bind as %s failed: invalid credentials", d.config.BindDN)
+			}
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// ldapEntry is a search result entry; attribute names are lowercase
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// ldapConn is a connection to an LDAP server. Operations are synchronous, i.e. only one
+// operation is in flight at any time.
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	timeout   time.Duration
+	messageID int64
+}
+
+// Bind performs a simple bind. It returns ErrUnauthenticated if the credentials are invalid.
+func (c *ldapConn) Bind(dn, password string) error {
+	request := berEncode(ldapTagBindRequest,
+		berEncodeInt(berTagInteger, 3), // LDAP version
+		berEncodeString(berTagOctetString, dn),
+		berEncodeString(ldapTagSimpleAuth, password),
+	)
+	tag, content, err := c.roundTrip(request)
+	if err != nil {
+		return err
+	} else if tag != ldapTagBindResponse {
+		return errLDAPInvalidMessage
+	}
+	code, message, err := ldapParseResult(content)
+	if err != nil {
+		return err
+	} else if code == ldapResultInvalidCredentials {
+		return ErrUnauthenticated
+	} else if code != ldapResultSuccess {
+		return fmt.Errorf("LDAP bind failed with result code %d: %s", code, message)
+	}
+	return nil
+}
+
+// Search performs a subtree search, and returns all matching entries. Referrals are ignored.
+func (c *ldapConn) Search(baseDN, filter string, attributes []string) ([]*ldapEntry, error) {
+	encodedFilter, err := ldapParseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	encodedAttributes := make([][]byte, len(attributes))
+	for i, attribute := range attributes {
+		encodedAttributes[i] = berEncodeString(berTagOctetString, attribute)
+	}
+	request := berEncode(ldapTagSearchRequest,
+		berEncodeString(berTagOctetString, baseDN),
+		berEncodeInt(berTagEnumerated, ldapScopeSubtree),
+		berEncodeInt(berTagEnumerated, ldapDerefNever),
+		berEncodeInt(berTagInteger, 0), // No size limit
+		berEncodeInt(berTagInteger, int64(c.timeout.Seconds())),
+		berEncode(berTagBoolean, []byte{0x00}), // Types only: false
+		encodedFilter,
+		berEncode(berTagSequence, encodedAttributes...),
+	)
+	if err := c.write(request); err != nil {
+		return nil, err
+	}
+	entries := make([]*ldapEntry, 0)
+	for {
+		tag, content, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case ldapTagSearchResultEntry:
+			entry, err := ldapParseEntry(content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapTagSearchResultReference:
+			continue
+		case ldapTagSearchResultDone:
+			code, message, err := ldapParseResult(content)
+			if err != nil {
+				return nil, err
+			} else if code != ldapResultSuccess {
+				return nil, fmt.Errorf("LDAP search failed with result code %d: %s", code, message)
+			}
+			return entries, nil
+		default:
+			return nil, errLDAPInvalidMessage
+		}
+	}
+}
+
+// Close sends an unbind request, and closes the connection
+func (c *ldapConn) Close() error {
+	_ = c.write(berEncode(ldapTagUnbindRequest))
+	return c.conn.Close()
+}
+
+func (c *ldapConn) roundTrip(op []byte) (byte, []byte, error) {
+	if err := c.write(op); err != nil {
+		return 0, nil, err
+	}
+	return c.read()
+}
+
+// write wraps the protocol operation in an LDAPMessage with a new message ID, and sends it
+func (c *ldapConn) write(op []byte) error {
+	c.messageID++
+	message := berEncode(berTagSequence, berEncodeInt(berTagInteger, c.messageID), op)
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(message)
+	return err
+}
+
+// read reads the next LDAPMessage, and returns the tag and content of its protocol operation
+func (c *ldapConn) read() (byte, []byte, error) {
+	tag, message, err := berRead(c.reader)
+	if err != nil {
+		return 0, nil, err
+	} else if tag != berTagSequence {
+		return 0, nil, errLDAPInvalidMessage
+	}
+	_, id, rest, err := berDecode(message)
+	if err != nil {
+		return 0, nil, err
+	} else if messageID, err := berDecodeInt(id); err != nil || messageID != c.messageID {
+		return 0, nil, errLDAPInvalidMessage // This includes notices of disconnection (message ID 0)
+	}
+	opTag, op, _, err := berDecode(rest) // Controls are ignored
+	if err != nil {
+		return 0, nil, err
+	}
+	return opTag, op, nil
+}
+
+// ldapParseResult parses an LDAPResult, and returns the result code and diagnostic message
+func ldapParseResult(content []byte) (int64, string, error) {
+	_, code, rest, err := berDecode(content)
+	if err != nil {
+		return 0, "", err
+	}
+	resultCode, err := berDecodeInt(code)
+	if err != nil {
+		return 0, "", err
+	}
+	_, _, rest, err = berDecode(rest) // Matched DN
+	if err != nil {
+		return 0, "", err
+	}
+	_, message, _, err := berDecode(rest)
+	if err != nil {
+		return 0, "", err
+	}
+	return resultCode, string(message), nil
+}
+
+// ldapParseEntry parses a SearchResultEntry
+func ldapParseEntry(content []byte) (*ldapEntry, error) {
+	_, dn, rest, err := berDecode(content)
+	if err != nil {
+		return nil, err
+	}
+	_, attributes, _, err := berDecode(rest)
+	if err != nil {
+		return nil, err
+	}
+	entry := &ldapEntry{
+		DN:         string(dn),
+		Attributes: make(map[string][]string),
+	}
+	for len(attributes) > 0 {
+		var attribute []byte
+		_, attribute, attributes, err = berDecode(attributes)
+		if err != nil {
+			return nil, err
+		}
+		_, name, valueSet, err := berDecode(attribute)
+		if err != nil {
+			return nil, err
+		}
+		_, values, _, err := berDecode(valueSet)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(string(name))
+		for len(values) > 0 {
+			var value []byte
+			_, value, values, err = berDecode(values)
+			if err != nil {
+				return nil, err
+			}
+			entry.Attributes[key] = append(entry.Attributes[key], string(value))
+		}
+	}
+	return entry, nil
+}
+
+// ldapParseFilter parses a string filter as defined in RFC 4515, e.g. (&(objectClass=person)(uid=phil)),
+// and returns its BER encoding. Extensible match filters are not supported.
+func ldapParseFilter(filter string) ([]byte, error) {
+	encoded, rest, err := ldapParseFilterComponent(filter)
+	if err != nil {
+		return nil, err
+	} else if rest != "" {
+		return nil, errLDAPInvalidFilter
+	}
+	return encoded, nil
+}
+
+func ldapParseFilterComponent(filter string) ([]byte, string, error) {
+	if len(filter) < 3 || filter[0] != '(' {
+		return nil, "", errLDAPInvalidFilter
+	}
+	switch filter[1] {
+	case '&', '|':
+		tag := byte(ldapTagFilterAnd)
+		if filter[1] == '|' {
+			tag = ldapTagFilterOr
+		}
+		rest := filter[2:]
+		children := make([][]byte, 0)
+		for len(rest) > 0 && rest[0] == '(' {
+			child, r, err := ldapParseFilterComponent(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, child)
+			rest = r
+		}
+		if len(children) == 0 || len(rest) == 0 || rest[0] != ')' {
+			return nil, "", errLDAPInvalidFilter
+		}
+		return berEncode(tag, children...), rest[1:], nil
+	case '!':
+		child, rest, err := ldapParseFilterComponent(filter[2:])
+		if err != nil {
+			return nil, "", err
+		} else if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", errLDAPInvalidFilter
+		}
+		return berEncode(ldapTagFilterNot, child), rest[1:], nil
+	}
+	end := strings.IndexByte(filter, ')')
+	if end == -1 {
+		return nil, "", errLDAPInvalidFilter
+	}
+	item, err := ldapParseFilterItem(filter[1:end])
+	if err != nil {
+		return nil, "", err
+	}
+	return item, filter[end+1:], nil
+}
+
+// ldapParseFilterItem parses a simple filter item without the parentheses, e.g. uid=phil, cn=*, or mail=*@example.com
+func ldapParseFilterItem(item string) ([]byte, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq < 1 {
+		return nil, errLDAPInvalidFilter
+	}
+	attribute, value := item[:eq], item[eq+1:]
+	tag := byte(ldapTagFilterEquality)
+	switch attribute[len(attribute)-1] {
+	case '>':
+		tag, attribute = ldapTagFilterGreaterOrEqual, attribute[:len(attribute)-1]
+	case '<':
+		tag, attribute = ldapTagFilterLessOrEqual, attribute[:len(attribute)-1]
+	case '~':
+		tag, attribute = ldapTagFilterApprox, attribute[:len(attribute)-1]
+	}
+	if attribute == "" || strings.ContainsAny(attribute, "()*\\ ") {
+		return nil, errLDAPInvalidFilter
+	}
+	if tag == ldapTagFilterEquality && value == "*" {
+		return berEncodeString(ldapTagFilterPresent, attribute), nil
+	} else if tag == ldapTagFilterEquality && strings.Contains(value, "*") {
+		return ldapParseFilterSubstrings(attribute, value)
+	}
+	unescaped, err := ldapUnescapeFilterValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return berEncode(tag, berEncodeString(berTagOctetString, attribute), berEncodeString(berTagOctetString, unescaped)), nil
+}
+
+func ldapParseFilterSubstrings(attribute, value string) ([]byte, error) {
+	parts := strings.Split(value, "*")
+	substrings := make([][]byte, 0)
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		unescaped, err := ldapUnescapeFilterValue(part)
+		if err != nil {
+			return nil, err
+		}
+		tag := byte(ldapTagSubstringAny)
+		if i == 0 {
+			tag = ldapTagSubstringInitial
+		} else if i == len(parts)-1 {
+			tag = ldapTagSubstringFinal
+		}
+		substrings = append(substrings, berEncodeString(tag, unescaped))
+	}
+	return berEncode(ldapTagFilterSubstrings, berEncodeString(berTagOctetString, attribute), berEncode(berTagSequence, substrings...)), nil
+}
+
+// ldapUnescapeFilterValue decodes the \XX escape sequences in a filter value
+func ldapUnescapeFilterValue(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '(', ')', '*':
+			return "", errLDAPInvalidFilter
+		case '\\':
+			if i+2 >= len(value) {
+				return "", errLDAPInvalidFilter
+			}
+			n, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", errLDAPInvalidFilter
+			}
+			b.WriteByte(byte(n))
+			i += 2
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// ldapEscapeFilter escapes a value to be used in a filter, see RFC 4515, section 3
+func ldapEscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0x00:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// berEncode encodes a BER element with the given tag, concatenating the given contents
+func berEncode(tag byte, contents ...[]byte) []byte {
+	length := 0
+	for _, content := range contents {
+		length += len(content)
+	}
+	b := make([]byte, 0, length+6)
+	b = append(b, tag)
+	if length < 0x80 {
+		b = append(b, byte(length))
+	} else {
+		lengthBytes := make([]byte, 0, 4)
+		for l := length; l > 0; l >>= 8 {
+			lengthBytes = append([]byte{byte(l)}, lengthBytes...)
+		}
+		b = append(b, 0x80|byte(len(lengthBytes)))
+		b = append(b, lengthBytes...)
+	}
+	for _, content := range contents {
+		b = append(b, content...)
+	}
+	return b
+}
+
+func berEncodeString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+// berEncodeInt encodes an integer in the shortest two's complement form
+func berEncodeInt(tag byte, n int64) []byte {
+	b := make([]byte, 0, 8)
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if (n == 0 && b[0]&0x80 == 0) || (n == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return berEncode(tag, b)
+}
+
+// berDecode decodes the first BER element in b, and returns its tag, content, and the remaining bytes
+func berDecode(b []byte) (tag byte, content []byte, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errLDAPInvalidMessage
+	}
+	tag = b[0]
+	length, n, err := berDecodeLength(b[1:])
+	if err != nil {
+		return 0, nil, nil, err
+	} else if length > len(b)-1-n {
+		return 0, nil, nil, errLDAPInvalidMessage
+	}
+	start := 1 + n
+	return tag, b[start : start+length], b[start+length:], nil
+}
+
+// berDecodeLength decodes a definite length, and returns the length and the number of bytes it occupied
+func berDecodeLength(b []byte) (int, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errLDAPInvalidMessage
+	} else if b[0] < 0x80 {
+		return int(b[0]), 1, nil
+	}
+	n := int(b[0] & 0x7f)
+	if n == 0 || n > 4 || len(b) < 1+n {
+		return 0, 0, errLDAPInvalidMessage // Indefinite lengths are not allowed in LDAP
+	}
+	length := 0
+	for _, c := range b[1 : 1+n] {
+		length = length<<8 | int(c)
+	}
+	return length, 1 + n, nil
+}
+
+func berDecodeInt(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, errLDAPInvalidMessage
+	}
+	n := int64(int8(b[0])) // Sign extension
+	for _, c := range b[1:] {
+		n = n<<8 | int64(c)
+	}
+	return n, nil
+}
+
+// berRead reads a single BER element from the reader, and returns its tag and content
+func berRead(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[1] >= 0x80 {
+		n := int(header[1] & 0x7f)
+		if n == 0 || n > 4 {
+			return 0, nil, errLDAPInvalidMessage
+		}
+		header = header[:2+n]
+		if _, err := io.ReadFull(r, header[2:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	length, _, err := berDecodeLength(header[1:])
+	if err != nil {
+		return 0, nil, err
+	} else if length > ldapMessageBytesLimit {
+		return 0, nil, fmt.Errorf("LDAP message too large: %d bytes", length)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+	return header[0], content, nil
+}
@@ -0,0 +1,302 @@
+package user
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLDAPDirectory_Authenticate(t *testing.T) {
+	server := newTestLDAPServer(t)
+	directory := server.directory(t)
+
+	require.Nil(t, directory.Authenticate("phil", "philpass"))
+	require.Equal(t, ErrUnauthenticated, directory.Authenticate("phil", "wrong"))
+	require.Equal(t, ErrUnauthenticated, directory.Authenticate("phil", "")) // No unauthenticated bind
+	require.Equal(t, ErrUnauthenticated, directory.Authenticate("nobody", "philpass"))
+	require.Equal(t, ErrUnauthenticated, directory.Authenticate("*", "philpass")) // Escaped, no wildcard search
+	require.Nil(t, directory.Authenticate("ben", "benpass"))
+}
+
+func TestLDAPDirectory_Groups(t *testing.T) {
+	server := newTestLDAPServer(t)
+	directory := server.directory(t)
+
+	groups, err := directory.Groups("phil")
+	require.Nil(t, err)
+	require.Equal(t, []string{"ops", "Domain Users"}, groups)
+
+	groups, err = directory.Groups("ben")
+	require.Nil(t, err)
+	require.Equal(t, []string{"Domain Users"}, groups)
+
+	groups, err = directory.Groups("nobody")
+	require.Nil(t, err)
+	require.Empty(t, groups)
+}
+
+func TestLDAPDirectory_BindDN_Invalid(t *testing.T) {
+	server := newTestLDAPServer(t)
+	config := server.config()
+	config.BindPassword = "wrong"
+	directory, err := NewLDAPDirectory(config)
+	require.Nil(t, err)
+
+	err = directory.Authenticate("phil", "philpass")
+	require.Error(t, err)
+	require.NotEqual(t, ErrUnauthenticated, err)
+	require.Contains(t, err.Error(), "invalid credentials")
+}
+
+func TestLDAPDirectory_Unavailable(t *testing.T) {
+	server := newTestLDAPServer(t)
+	directory := server.directory(t)
+	server.listener.Close()
+
+	require.Error(t, directory.Authenticate("phil", "philpass"))
+	_, err := directory.Groups("phil")
+	require.Error(t, err)
+}
+
+func TestNewLDAPDirectory_Invalid(t *testing.T) {
+	for _, config := range []*LDAPConfig{
+		{URL: "http://ldap.example.com", UserBaseDN: "dc=example,dc=com", UserFilter: "(uid=%s)"},
+		{URL: "ldap://", UserBaseDN: "dc=example,dc=com", UserFilter: "(uid=%s)"},
+		{URL: "ldap://ldap.example.com", UserFilter: "(uid=%s)"},
+		{URL: "ldap://ldap.example.com", UserBaseDN: "dc=example,dc=com", UserFilter: "(uid=phil)"},
+		{URL: "ldap://ldap.example.com", UserBaseDN: "dc=example,dc=com", UserFilter: "(uid=%s"},
+		{URL: "ldap://ldap.example.com", UserBaseDN: "dc=example,dc=com", UserFilter: "(uid=%s)", GroupBaseDN: "dc=example,dc=com", GroupFilter: "(member=%s)"},
+		{URL: "ldap://ldap.example.com", UserBaseDN: "dc=example,dc=com", UserFilter: "(uid=%s)", GroupBaseDN: "dc=example,dc=com", GroupFilter: "member=%s", GroupAttribute: "cn"},
+	} {
+		_, err := NewLDAPDirectory(config)
+		require.Error(t, err, config)
+	}
+	directory, err := NewLDAPDirectory(&LDAPConfig{URL: "ldaps://ldap.example.com", UserBaseDN: "dc=example,dc=com", UserFilter: "(uid=%s)"})
+	require.Nil(t, err)
+	require.Equal(t, "ldap.example.com:636", directory.address)
+	require.True(t, directory.tls)
+}
+
+func TestLDAPParseFilter(t *testing.T) {
+	filter, err := ldapParseFilter("(uid=phil)")
+	require.Nil(t, err)
+	require.Equal(t, []byte{0xa3, 0x0b, 0x04, 0x03, 'u', 'i', 'd', 0x04, 0x04, 'p', 'h', 'i', 'l'}, filter)
+
+	filter, err = ldapParseFilter("(cn=*)")
+	require.Nil(t, err)
+	require.Equal(t, []byte{0x87, 0x02, 'c', 'n'}, filter)
+
+	filter, err = ldapParseFilter(`(cn=a\2ab)`)
+	require.Nil(t, err)
+	require.Equal(t, []byte{0xa3, 0x09, 0x04, 0x02, 'c', 'n', 0x04, 0x03, 'a', '*', 'b'}, filter)
+
+	for _, valid := range []string{
+		"(&(objectClass=person)(|(uid=phil)(mail=phil@example.com))(!(disabled=TRUE)))",
+		"(mail=*@example.com)",
+		"(cn=a*b*c)",
+		"(uidNumber>=1000)",
+	} {
+		_, err := ldapParseFilter(valid)
+		require.Nil(t, err, valid)
+	}
+	for _, invalid := range []string{"", "uid=phil", "(uid=phil", "(uid=phil))", "(&)", "(=phil)", `(uid=\2)`, "(uid=a(b)"} {
+		_, err := ldapParseFilter(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestLDAPEscapeFilter(t *testing.T) {
+	require.Equal(t, "phil", ldapEscapeFilter("phil"))
+	require.Equal(t, `\2a\28uid=\5c\29\00`, ldapEscapeFilter("*(uid=\\)\x00"))
+	require.Equal(t, `cn=a\5c,b,dc=example`, ldapEscapeFilter(`cn=a\,b,dc=example`))
+}
+
+func TestBEREncodeDecodeInt(t *testing.T) {
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, 65535, -1, -128, -129, 1 << 40} {
+		tag, content, rest, err := berDecode(berEncodeInt(berTagInteger, n))
+		require.Nil(t, err)
+		require.Equal(t, byte(berTagInteger), tag)
+		require.Empty(t, rest)
+		decoded, err := berDecodeInt(content)
+		require.Nil(t, err)
+		require.Equal(t, n, decoded)
+	}
+	long := berEncode(berTagOctetString, make([]byte, 300))
+	require.Equal(t, []byte{0x04, 0x82, 0x01, 0x2c}, long[:4])
+	_, content, _, err := berDecode(long)
+	require.Nil(t, err)
+	require.Len(t, content, 300)
+}
+
+// testLDAPServer is an in-process LDAP server stand-in. It supports simple binds, and subtree searches
+// with equality, presence, and/or/not filters, which is all that LDAPDirectory uses.
+type testLDAPServer struct {
+	listener  net.Listener
+	entries   []*ldapEntry
+	passwords map[string]string // DN -> password
+	searches  atomic.Int32
+}
+
+const (
+	testLDAPBindDN       = "cn=ntfy,ou=services,dc=example,dc=com"
+	testLDAPBindPassword = "ntfypass"
+)
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &testLDAPServer{
+		listener: listener,
+		entries: []*ldapEntry{
+			{DN: "uid=phil,ou=people,dc=example,dc=com", Attributes: map[string][]string{"objectclass": {"person"}, "uid": {"phil"}}},
+			{DN: "uid=ben,ou=people,dc=example,dc=com", Attributes: map[string][]string{"objectclass": {"person"}, "uid": {"ben"}}},
+			{DN: "cn=ops,ou=groups,dc=example,dc=com", Attributes: map[string][]string{"objectclass": {"groupOfNames"}, "cn": {"ops"}, "member": {"uid=phil,ou=people,dc=example,dc=com"}}},
+			{DN: "cn=Domain Users,ou=groups,dc=example,dc=com", Attributes: map[string][]string{"objectclass": {"groupOfNames"}, "cn": {"Domain Users"}, "member": {"uid=phil,ou=people,dc=example,dc=com", "uid=ben,ou=people,dc=example,dc=com"}}},
+		},
+		passwords: map[string]string{
+			testLDAPBindDN:                         testLDAPBindPassword,
+			"uid=phil,ou=people,dc=example,dc=com": "philpass",
+			"uid=ben,ou=people,dc=example,dc=com":  "benpass",
+		},
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *testLDAPServer) config() *LDAPConfig {
+	return &LDAPConfig{
+		URL:            "ldap://" + s.listener.Addr().String(),
+		BindDN:         testLDAPBindDN,
+		BindPassword:   testLDAPBindPassword,
+		UserBaseDN:     "ou=people,dc=example,dc=com",
+		UserFilter:     "(&(objectClass=person)(uid=%s))",
+		GroupBaseDN:    "ou=groups,dc=example,dc=com",
+		GroupFilter:    "(&(objectClass=groupOfNames)(member=%s))",
+		GroupAttribute: "cn",
+	}
+}
+
+func (s *testLDAPServer) directory(t *testing.T) *LDAPDirectory {
+	directory, err := NewLDAPDirectory(s.config())
+	require.Nil(t, err)
+	return directory
+}
+
+func (s *testLDAPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testLDAPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		_, message, err := berRead(reader)
+		if err != nil {
+			return
+		}
+		_, id, rest, err := berDecode(message)
+		if err != nil {
+			return
+		}
+		messageID, _ := berDecodeInt(id)
+		tag, op, _, err := berDecode(rest)
+		if err != nil {
+			return
+		}
+		switch tag {
+		case ldapTagBindRequest:
+			_, _, fields, _ := berDecode(op) // Version
+			_, dn, fields, _ := berDecode(fields)
+			_, password, _, _ := berDecode(fields)
+			code := int64(ldapResultSuccess)
+			if expected, ok := s.passwords[string(dn)]; !ok || expected != string(password) {
+				code = ldapResultInvalidCredentials
+			}
+			s.write(conn, messageID, berEncode(ldapTagBindResponse, testLDAPResult(code)...))
+		case ldapTagSearchRequest:
+			s.searches.Add(1)
+			_, baseDN, fields, _ := berDecode(op)
+			for i := 0; i < 5; i++ { // Scope, deref, size limit, time limit, types only
+				_, _, fields, _ = berDecode(fields)
+			}
+			filter := fields
+			for _, entry := range s.entries {
+				if strings.HasSuffix(entry.DN, ","+string(baseDN)) && testLDAPMatch(filter, entry) {
+					attributes := make([][]byte, 0)
+					for name, values := range entry.Attributes {
+						encodedValues := make([][]byte, len(values))
+						for i, value := range values {
+							encodedValues[i] = berEncodeString(berTagOctetString, value)
+						}
+						attributes = append(attributes, berEncode(berTagSequence, berEncodeString(berTagOctetString, name), berEncode(berTagSet, encodedValues...)))
+					}
+					s.write(conn, messageID, berEncode(ldapTagSearchResultEntry, berEncodeString(berTagOctetString, entry.DN), berEncode(berTagSequence, attributes...)))
+				}
+			}
+			s.write(conn, messageID, berEncode(ldapTagSearchResultDone, testLDAPResult(ldapResultSuccess)...))
+		case ldapTagUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *testLDAPServer) write(conn net.Conn, messageID int64, op []byte) {
+	conn.Write(berEncode(berTagSequence, berEncodeInt(berTagInteger, messageID), op))
+}
+
+func testLDAPResult(code int64) [][]byte {
+	return [][]byte{
+		berEncodeInt(berTagEnumerated, code),
+		berEncodeString(berTagOctetString, ""),
+		berEncodeString(berTagOctetString, ""),
+	}
+}
+
+// testLDAPMatch evaluates the first BER-encoded filter in b against the entry
+func testLDAPMatch(b []byte, entry *ldapEntry) bool {
+	tag, content, _, err := berDecode(b)
+	if err != nil {
+		return false
+	}
+	switch tag {
+	case ldapTagFilterAnd, ldapTagFilterOr:
+		for len(content) > 0 {
+			_, _, rest, err := berDecode(content)
+			if err != nil {
+				return false
+			}
+			matched := testLDAPMatch(content[:len(content)-len(rest)], entry)
+			if tag == ldapTagFilterOr && matched {
+				return true
+			} else if tag == ldapTagFilterAnd && !matched {
+				return false
+			}
+			content = rest
+		}
+		return tag == ldapTagFilterAnd
+	case ldapTagFilterNot:
+		return !testLDAPMatch(content, entry)
+	case ldapTagFilterPresent:
+		return len(entry.Attributes[strings.ToLower(string(content))]) > 0
+	case ldapTagFilterEquality:
+		_, attribute, rest, _ := berDecode(content)
+		_, value, _, _ := berDecode(rest)
+		for _, v := range entry.Attributes[strings.ToLower(string(attribute))] {
+			if strings.EqualFold(v, string(value)) {
+				return true
+			}
+		}
+	}
+	return false
+}
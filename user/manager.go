@@ -2,17 +2,11 @@
 package user
 
 import (
-	"database/sql"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"github.com/mattn/go-sqlite3"
-	"github.com/stripe/stripe-go/v74"
 	"golang.org/x/crypto/bcrypt"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
 	"net/netip"
-	"strings"
 	"sync"
 	"time"
 )
@@ -29,6 +23,21 @@ const (
 	tokenPrefix                     = "tk_"
 	tokenLength                     = 32
 	tokenMaxCount                   = 20 // Only keep this many tokens in the table per user
+	webhookIDPrefix                 = "wh_"
+	webhookIDLength                 = 12
+	webhookSecretLength             = 32
+	webhookMaxCount                 = 20 // Max number of webhooks per user
+	webhookURLMaxLength             = 2048
+	webhookDeliveryIDPrefix         = "wd_"
+	webhookDeliveryIDLength         = 16
+	ruleIDPrefix                    = "ru_"
+	ruleIDLength                    = 12
+	ruleDefaultRateLimit            = 60 // Routed messages per hour and publisher, if not set
+	escalationPolicyIDPrefix        = "es_"
+	escalationPolicyIDLength        = 12
+	escalationPolicyMaxSteps        = 10
+	directoryPasswordLength         = 32          // Random password of users provisioned from the directory, they log in via the directory
+	directoryGroupsRetryInterval    = time.Minute // Time until the groups of a user are queried again if the directory failed
 	tag                             = "user_manager"
 )
 
@@ -36,6 +45,7 @@ const (
 const (
 	DefaultUserStatsQueueWriterInterval = 33 * time.Second
 	DefaultUserPasswordBcryptCost       = 10
+	DefaultDirectoryGroupsCacheDuration = 5 * time.Minute
 )
 
 var (
@@ -44,445 +54,79 @@ var (
 	errNoRows             = errors.New("no rows found")
 )
 
-// Manager-related queries
-const (
-	createTablesQueries = `
-		BEGIN;
-		CREATE TABLE IF NOT EXISTS tier (
-			id TEXT PRIMARY KEY,
-			code TEXT NOT NULL,
-			name TEXT NOT NULL,
-			messages_limit INT NOT NULL,
-			messages_expiry_duration INT NOT NULL,
-			emails_limit INT NOT NULL,
-			calls_limit INT NOT NULL,
-			reservations_limit INT NOT NULL,
-			attachment_file_size_limit INT NOT NULL,
-			attachment_total_size_limit INT NOT NULL,
-			attachment_expiry_duration INT NOT NULL,
-			attachment_bandwidth_limit INT NOT NULL,
-			stripe_monthly_price_id TEXT,
-			stripe_yearly_price_id TEXT
-		);
-		CREATE UNIQUE INDEX idx_tier_code ON tier (code);
-		CREATE UNIQUE INDEX idx_tier_stripe_monthly_price_id ON tier (stripe_monthly_price_id);
-		CREATE UNIQUE INDEX idx_tier_stripe_yearly_price_id ON tier (stripe_yearly_price_id);
-		CREATE TABLE IF NOT EXISTS user (
-		    id TEXT PRIMARY KEY,
-			tier_id TEXT,
-			user TEXT NOT NULL,
-			pass TEXT NOT NULL,
-			role TEXT CHECK (role IN ('anonymous', 'admin', 'user')) NOT NULL,
-			prefs JSON NOT NULL DEFAULT '{}',
-			sync_topic TEXT NOT NULL,
-			stats_messages INT NOT NULL DEFAULT (0),
-			stats_emails INT NOT NULL DEFAULT (0),
-			stats_calls INT NOT NULL DEFAULT (0),
-			stripe_customer_id TEXT,
-			stripe_subscription_id TEXT,
-			stripe_subscription_status TEXT,
-			stripe_subscription_interval TEXT,
-			stripe_subscription_paid_until INT,
-			stripe_subscription_cancel_at INT,
-			created INT NOT NULL,
-			deleted INT,
-		    FOREIGN KEY (tier_id) REFERENCES tier (id)
-		);
-		CREATE UNIQUE INDEX idx_user ON user (user);
-		CREATE UNIQUE INDEX idx_user_stripe_customer_id ON user (stripe_customer_id);
-		CREATE UNIQUE INDEX idx_user_stripe_subscription_id ON user (stripe_subscription_id);
-		CREATE TABLE IF NOT EXISTS user_access (
-			user_id TEXT NOT NULL,
-			topic TEXT NOT NULL,
-			read INT NOT NULL,
-			write INT NOT NULL,
-			owner_user_id INT,
-			PRIMARY KEY (user_id, topic),
-			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
-		    FOREIGN KEY (owner_user_id) REFERENCES user (id) ON DELETE CASCADE
-		);
-		CREATE TABLE IF NOT EXISTS user_token (
-			user_id TEXT NOT NULL,
-			token TEXT NOT NULL,
-			label TEXT NOT NULL,
-			last_access INT NOT NULL,
-			last_origin TEXT NOT NULL,
-			expires INT NOT NULL,
-			PRIMARY KEY (user_id, token),
-			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
-		);
-		CREATE TABLE IF NOT EXISTS user_phone (
-			user_id TEXT NOT NULL,
-			phone_number TEXT NOT NULL,
-			PRIMARY KEY (user_id, phone_number),
-			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
-		);
-		CREATE TABLE IF NOT EXISTS schemaVersion (
-			id INT PRIMARY KEY,
-			version INT NOT NULL
-		);
-		INSERT INTO user (id, user, pass, role, sync_topic, created)
-		VALUES ('` + everyoneID + `', '*', '', 'anonymous', '', UNIXEPOCH())
-		ON CONFLICT (id) DO NOTHING;
-		COMMIT;
-	`
-
-	builtinStartupQueries = `
-		PRAGMA foreign_keys = ON;
-	`
-
-	selectUserByIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
-		FROM user u
-		LEFT JOIN tier t on t.id = u.tier_id
-		WHERE u.id = ?
-	`
-	selectUserByNameQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
-		FROM user u
-		LEFT JOIN tier t on t.id = u.tier_id
-		WHERE user = ?
-	`
-	selectUserByTokenQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
-		FROM user u
-		JOIN user_token tk on u.id = tk.user_id
-		LEFT JOIN tier t on t.id = u.tier_id
-		WHERE tk.token = ? AND (tk.expires = 0 OR tk.expires >= ?)
-	`
-	selectUserByStripeCustomerIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
-		FROM user u
-		LEFT JOIN tier t on t.id = u.tier_id
-		WHERE u.stripe_customer_id = ?
-	`
-	selectTopicPermsQuery = `
-		SELECT read, write
-		FROM user_access a
-		JOIN user u ON u.id = a.user_id
-		WHERE (u.user = ? OR u.user = ?) AND ? LIKE a.topic ESCAPE '\'
-		ORDER BY u.user DESC, LENGTH(a.topic) DESC, a.write DESC
-	`
-
-	insertUserQuery = `
-		INSERT INTO user (id, user, pass, role, sync_topic, created)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`
-	selectUsernamesQuery = `
-		SELECT user
-		FROM user
-		ORDER BY
-			CASE role
-				WHEN 'admin' THEN 1
-				WHEN 'anonymous' THEN 3
-				ELSE 2
-			END, user
-	`
-	selectUserCountQuery         = `SELECT COUNT(*) FROM user`
-	updateUserPassQuery          = `UPDATE user SET pass = ? WHERE user = ?`
-	updateUserRoleQuery          = `UPDATE user SET role = ? WHERE user = ?`
-	updateUserPrefsQuery         = `UPDATE user SET prefs = ? WHERE id = ?`
-	updateUserStatsQuery         = `UPDATE user SET stats_messages = ?, stats_emails = ?, stats_calls = ? WHERE id = ?`
-	updateUserStatsResetAllQuery = `UPDATE user SET stats_messages = 0, stats_emails = 0, stats_calls = 0`
-	updateUserDeletedQuery       = `UPDATE user SET deleted = ? WHERE id = ?`
-	deleteUsersMarkedQuery       = `DELETE FROM user WHERE deleted < ?`
-	deleteUserQuery              = `DELETE FROM user WHERE user = ?`
-
-	upsertUserAccessQuery = `
-		INSERT INTO user_access (user_id, topic, read, write, owner_user_id)
-		VALUES ((SELECT id FROM user WHERE user = ?), ?, ?, ?, (SELECT IIF(?='',NULL,(SELECT id FROM user WHERE user=?))))
-		ON CONFLICT (user_id, topic)
-		DO UPDATE SET read=excluded.read, write=excluded.write, owner_user_id=excluded.owner_user_id
-	`
-	selectUserAllAccessQuery = `
-		SELECT user_id, topic, read, write
-		FROM user_access
-		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
-	`
-	selectUserAccessQuery = `
-		SELECT topic, read, write
-		FROM user_access
-		WHERE user_id = (SELECT id FROM user WHERE user = ?)
-		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
-	`
-	selectUserReservationsQuery = `
-		SELECT a_user.topic, a_user.read, a_user.write, a_everyone.read AS everyone_read, a_everyone.write AS everyone_write
-		FROM user_access a_user
-		LEFT JOIN  user_access a_everyone ON a_user.topic = a_everyone.topic AND a_everyone.user_id = (SELECT id FROM user WHERE user = ?)
-		WHERE a_user.user_id = a_user.owner_user_id
-		  AND a_user.owner_user_id = (SELECT id FROM user WHERE user = ?)
-		ORDER BY a_user.topic
-	`
-	selectUserReservationsCountQuery = `
-		SELECT COUNT(*)
-		FROM user_access
-		WHERE user_id = owner_user_id 
-		  AND owner_user_id = (SELECT id FROM user WHERE user = ?)
-	`
-	selectUserReservationsOwnerQuery = `
-		SELECT owner_user_id
-		FROM user_access
-		WHERE topic = ?
-		  AND user_id = owner_user_id
-	`
-	selectUserHasReservationQuery = `
-		SELECT COUNT(*)
-		FROM user_access
-		WHERE user_id = owner_user_id
-		  AND owner_user_id = (SELECT id FROM user WHERE user = ?)
-		  AND topic = ?
-	`
-	selectOtherAccessCountQuery = `
-		SELECT COUNT(*)
-		FROM user_access
-		WHERE (topic = ? OR ? LIKE topic ESCAPE '\')
-		  AND (owner_user_id IS NULL OR owner_user_id != (SELECT id FROM user WHERE user = ?))
-	`
-	deleteAllAccessQuery  = `DELETE FROM user_access`
-	deleteUserAccessQuery = `
-		DELETE FROM user_access
-		WHERE user_id = (SELECT id FROM user WHERE user = ?)
-		   OR owner_user_id = (SELECT id FROM user WHERE user = ?)
-	`
-	deleteTopicAccessQuery = `
-		DELETE FROM user_access
-	   	WHERE (user_id = (SELECT id FROM user WHERE user = ?) OR owner_user_id = (SELECT id FROM user WHERE user = ?))
-	   	  AND topic = ?
-  	`
-
-	selectTokenCountQuery      = `SELECT COUNT(*) FROM user_token WHERE user_id = ?`
-	selectTokensQuery          = `SELECT token, label, last_access, last_origin, expires FROM user_token WHERE user_id = ?`
-	selectTokenQuery           = `SELECT token, label, last_access, last_origin, expires FROM user_token WHERE user_id = ? AND token = ?`
-	insertTokenQuery           = `INSERT INTO user_token (user_id, token, label, last_access, last_origin, expires) VALUES (?, ?, ?, ?, ?, ?)`
-	updateTokenExpiryQuery     = `UPDATE user_token SET expires = ? WHERE user_id = ? AND token = ?`
-	updateTokenLabelQuery      = `UPDATE user_token SET label = ? WHERE user_id = ? AND token = ?`
-	updateTokenLastAccessQuery = `UPDATE user_token SET last_access = ?, last_origin = ? WHERE token = ?`
-	deleteTokenQuery           = `DELETE FROM user_token WHERE user_id = ? AND token = ?`
-	deleteAllTokenQuery        = `DELETE FROM user_token WHERE user_id = ?`
-	deleteExpiredTokensQuery   = `DELETE FROM user_token WHERE expires > 0 AND expires < ?`
-	deleteExcessTokensQuery    = `
-		DELETE FROM user_token
-		WHERE user_id = ?
-		  AND (user_id, token) NOT IN (
-			SELECT user_id, token
-			FROM user_token
-			WHERE user_id = ?
-			ORDER BY expires DESC
-			LIMIT ?
-		)
-	`
-
-	selectPhoneNumbersQuery = `SELECT phone_number FROM user_phone WHERE user_id = ?`
-	insertPhoneNumberQuery  = `INSERT INTO user_phone (user_id, phone_number) VALUES (?, ?)`
-	deletePhoneNumberQuery  = `DELETE FROM user_phone WHERE user_id = ? AND phone_number = ?`
-
-	insertTierQuery = `
-		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
-	updateTierQuery = `
-		UPDATE tier
-		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?
-		WHERE code = ?
-	`
-	selectTiersQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
-		FROM tier
-	`
-	selectTierByCodeQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
-		FROM tier
-		WHERE code = ?
-	`
-	selectTierByPriceIDQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
-		FROM tier
-		WHERE (stripe_monthly_price_id = ? OR stripe_yearly_price_id = ?)
-	`
-	updateUserTierQuery = `UPDATE user SET tier_id = (SELECT id FROM tier WHERE code = ?) WHERE user = ?`
-	deleteUserTierQuery = `UPDATE user SET tier_id = null WHERE user = ?`
-	deleteTierQuery     = `DELETE FROM tier WHERE code = ?`
-
-	updateBillingQuery = `
-		UPDATE user
-		SET stripe_customer_id = ?, stripe_subscription_id = ?, stripe_subscription_status = ?, stripe_subscription_interval = ?, stripe_subscription_paid_until = ?, stripe_subscription_cancel_at = ?
-		WHERE user = ?
-	`
-)
-
-// Schema management queries
-const (
-	currentSchemaVersion     = 5
-	insertSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
-	updateSchemaVersion      = `UPDATE schemaVersion SET version = ? WHERE id = 1`
-	selectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
-
-	// 1 -> 2 (complex migration!)
-	migrate1To2CreateTablesQueries = `
-		ALTER TABLE user RENAME TO user_old;
-		CREATE TABLE IF NOT EXISTS tier (
-			id TEXT PRIMARY KEY,
-			code TEXT NOT NULL,
-			name TEXT NOT NULL,
-			messages_limit INT NOT NULL,
-			messages_expiry_duration INT NOT NULL,
-			emails_limit INT NOT NULL,
-			reservations_limit INT NOT NULL,
-			attachment_file_size_limit INT NOT NULL,
-			attachment_total_size_limit INT NOT NULL,
-			attachment_expiry_duration INT NOT NULL,
-			attachment_bandwidth_limit INT NOT NULL,
-			stripe_price_id TEXT
-		);
-		CREATE UNIQUE INDEX idx_tier_code ON tier (code);
-		CREATE UNIQUE INDEX idx_tier_price_id ON tier (stripe_price_id);
-		CREATE TABLE IF NOT EXISTS user (
-		    id TEXT PRIMARY KEY,
-			tier_id TEXT,
-			user TEXT NOT NULL,
-			pass TEXT NOT NULL,
-			role TEXT CHECK (role IN ('anonymous', 'admin', 'user')) NOT NULL,
-			prefs JSON NOT NULL DEFAULT '{}',
-			sync_topic TEXT NOT NULL,
-			stats_messages INT NOT NULL DEFAULT (0),
-			stats_emails INT NOT NULL DEFAULT (0),
-			stripe_customer_id TEXT,
-			stripe_subscription_id TEXT,
-			stripe_subscription_status TEXT,
-			stripe_subscription_paid_until INT,
-			stripe_subscription_cancel_at INT,
-			created INT NOT NULL,
-			deleted INT,
-		    FOREIGN KEY (tier_id) REFERENCES tier (id)
-		);
-		CREATE UNIQUE INDEX idx_user ON user (user);
-		CREATE UNIQUE INDEX idx_user_stripe_customer_id ON user (stripe_customer_id);
-		CREATE UNIQUE INDEX idx_user_stripe_subscription_id ON user (stripe_subscription_id);
-		CREATE TABLE IF NOT EXISTS user_access (
-			user_id TEXT NOT NULL,
-			topic TEXT NOT NULL,
-			read INT NOT NULL,
-			write INT NOT NULL,
-			owner_user_id INT,
-			PRIMARY KEY (user_id, topic),
-			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
-		    FOREIGN KEY (owner_user_id) REFERENCES user (id) ON DELETE CASCADE
-		);
-		CREATE TABLE IF NOT EXISTS user_token (
-			user_id TEXT NOT NULL,
-			token TEXT NOT NULL,
-			label TEXT NOT NULL,
-			last_access INT NOT NULL,
-			last_origin TEXT NOT NULL,
-			expires INT NOT NULL,
-			PRIMARY KEY (user_id, token),
-			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
-		);
-		CREATE TABLE IF NOT EXISTS schemaVersion (
-			id INT PRIMARY KEY,
-			version INT NOT NULL
-		);
-		INSERT INTO user (id, user, pass, role, sync_topic, created)
-		VALUES ('u_everyone', '*', '', 'anonymous', '', UNIXEPOCH())
-		ON CONFLICT (id) DO NOTHING;
-	`
-	migrate1To2SelectAllOldUsernamesNoTx = `SELECT user FROM user_old`
-	migrate1To2InsertUserNoTx            = `
-		INSERT INTO user (id, user, pass, role, sync_topic, created)
-		SELECT ?, user, pass, role, ?, UNIXEPOCH() FROM user_old WHERE user = ?
-	`
-	migrate1To2InsertFromOldTablesAndDropNoTx = `
-		INSERT INTO user_access (user_id, topic, read, write)
-		SELECT u.id, a.topic, a.read, a.write
-		FROM user u
-	 	JOIN access a ON u.user = a.user;
-
-		DROP TABLE access;
-		DROP TABLE user_old;
-	`
-
-	// 2 -> 3
-	migrate2To3UpdateQueries = `
-		ALTER TABLE user ADD COLUMN stripe_subscription_interval TEXT;
-		ALTER TABLE tier RENAME COLUMN stripe_price_id TO stripe_monthly_price_id;
-		ALTER TABLE tier ADD COLUMN stripe_yearly_price_id TEXT;
-		DROP INDEX IF EXISTS idx_tier_price_id;
-		CREATE UNIQUE INDEX idx_tier_stripe_monthly_price_id ON tier (stripe_monthly_price_id);
-		CREATE UNIQUE INDEX idx_tier_stripe_yearly_price_id ON tier (stripe_yearly_price_id);
-	`
-
-	// 3 -> 4
-	migrate3To4UpdateQueries = `
-		ALTER TABLE tier ADD COLUMN calls_limit INT NOT NULL DEFAULT (0);
-		ALTER TABLE user ADD COLUMN stats_calls INT NOT NULL DEFAULT (0);
-		CREATE TABLE IF NOT EXISTS user_phone (
-			user_id TEXT NOT NULL,
-			phone_number TEXT NOT NULL,
-			PRIMARY KEY (user_id, phone_number),
-			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
-		);
-	`
-
-	// 4 -> 5
-	migrate4To5UpdateQueries = `
-		UPDATE user_access SET topic = REPLACE(topic, '_', '\_');
-	`
-)
-
-var (
-	migrations = map[int]func(db *sql.DB) error{
-		1: migrateFrom1,
-		2: migrateFrom2,
-		3: migrateFrom3,
-		4: migrateFrom4,
-	}
-)
-
 // Manager is an implementation of Manager. It stores users and access control list
-// in a SQLite database.
+// in a Store, typically a SQLite or PostgreSQL database.
 type Manager struct {
-	db            *sql.DB
-	defaultAccess Permission              // Default permission if no ACL matches
-	statsQueue    map[string]*Stats       // "Queue" to asynchronously write user stats to the database (UserID -> Stats)
-	tokenQueue    map[string]*TokenUpdate // "Queue" to asynchronously write token access stats to the database (Token ID -> TokenUpdate)
-	bcryptCost    int                     // Makes testing easier
-	mu            sync.Mutex
+	store               Store
+	defaultAccess       Permission                       // Default permission if no ACL matches
+	statsQueue          map[string]*Stats                // "Queue" to asynchronously write user stats to the database (UserID -> Stats)
+	tokenQueue          map[string]*TokenUpdate          // "Queue" to asynchronously write token access stats to the database (Token ID -> TokenUpdate)
+	bcryptCost          int                              // Makes testing easier
+	directory           Directory                        // External user directory (e.g. LDAP), may be nil
+	groups              map[string]*directoryGroupsEntry // Cached directory groups (Username -> Groups)
+	groupsCacheDuration time.Duration
+	mu                  sync.Mutex
 }
 
 var _ Auther = (*Manager)(nil)
 
-// NewManager creates a new Manager instance
+// NewManager creates a new Manager instance. If filename is a PostgreSQL connection URL (postgres://...),
+// users are stored in PostgreSQL, otherwise in a SQLite database file.
 func NewManager(filename, startupQueries string, defaultAccess Permission, bcryptCost int, queueWriterInterval time.Duration) (*Manager, error) {
-	db, err := sql.Open("sqlite3", filename)
-	if err != nil {
-		return nil, err
+	var store Store
+	var err error
+	if util.IsPostgresURL(filename) {
+		store, err = NewPostgresStore(filename, startupQueries)
+	} else {
+		store, err = NewSQLiteStore(filename, startupQueries)
 	}
-	if err := setupDB(db); err != nil {
-		return nil, err
-	}
-	if err := runStartupQueries(db, startupQueries); err != nil {
+	if err != nil {
 		return nil, err
 	}
+	return NewManagerWithStore(store, defaultAccess, bcryptCost, queueWriterInterval), nil
+}
+
+// NewManagerWithStore creates a new Manager instance using the given Store
+func NewManagerWithStore(store Store, defaultAccess Permission, bcryptCost int, queueWriterInterval time.Duration) *Manager {
 	manager := &Manager{
-		db:            db,
+		store:         store,
 		defaultAccess: defaultAccess,
 		statsQueue:    make(map[string]*Stats),
 		tokenQueue:    make(map[string]*TokenUpdate),
 		bcryptCost:    bcryptCost,
+		groups:        make(map[string]*directoryGroupsEntry),
 	}
 	go manager.asyncQueueWriter(queueWriterInterval)
-	return manager, nil
+	return manager
+}
+
+// UseDirectory sets an external user directory (e.g. LDAP). Users that do not exist locally are then
+// authenticated against the directory, and provisioned locally on first login (see ProviderLDAP). For these
+// users, access control entries granted to their directory groups apply. Groups are cached for cacheDuration.
+func (a *Manager) UseDirectory(directory Directory, cacheDuration time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.directory = directory
+	a.groups = make(map[string]*directoryGroupsEntry)
+	a.groupsCacheDuration = cacheDuration
 }
 
 // Authenticate checks username and password and returns a User if correct, and the user has not been
 // marked as deleted. The method returns in constant-ish time, regardless of whether the user exists or
 // the password is correct or incorrect.
+//
+// If a directory is set (see UseDirectory), local users always take precedence: they are only ever checked
+// against their local password, even if a user with the same name exists in the directory. Users that do not
+// exist locally are checked against the directory, and provisioned locally on first login. Users provisioned
+// from the directory are only checked against the directory.
 func (a *Manager) Authenticate(username, password string) (*User, error) {
 	if username == Everyone {
 		return nil, ErrUnauthenticated
 	}
 	user, err := a.User(username)
-	if err != nil {
+	if errors.Is(err, ErrUserNotFound) && a.directory != nil {
+		return a.authenticateDirectory(username, password, nil)
+	} else if err != nil {
 		log.Tag(tag).Field("user_name", username).Err(err).Trace("Authentication of user failed (1)")
 		bcrypt.CompareHashAndPassword([]byte(userAuthIntentionalSlowDownHash), []byte("intentional slow-down to avoid timing attacks"))
 		return nil, ErrUnauthenticated
@@ -490,25 +134,62 @@ func (a *Manager) Authenticate(username, password string) (*User, error) {
 		log.Tag(tag).Field("user_name", username).Trace("Authentication of user failed (2): user marked deleted")
 		bcrypt.CompareHashAndPassword([]byte(userAuthIntentionalSlowDownHash), []byte("intentional slow-down to avoid timing attacks"))
 		return nil, ErrUnauthenticated
+	} else if user.Provider == ProviderLDAP {
+		if a.directory == nil {
+			log.Tag(tag).Field("user_name", username).Trace("Authentication of user failed (3): directory not configured")
+			return nil, ErrUnauthenticated
+		}
+		return a.authenticateDirectory(username, password, user)
 	} else if err := bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(password)); err != nil {
-		log.Tag(tag).Field("user_name", username).Err(err).Trace("Authentication of user failed (3)")
+		log.Tag(tag).Field("user_name", username).Err(err).Trace("Authentication of user failed (4)")
 		return nil, ErrUnauthenticated
 	}
 	return user, nil
 }
 
+// authenticateDirectory checks the username and password against the directory. If the user does not
+// exist locally (user is nil), it is created with a random password and ProviderLDAP, so that tokens,
+// reservations and settings can be attached to it.
+func (a *Manager) authenticateDirectory(username, password string, user *User) (*User, error) {
+	if err := a.directory.Authenticate(username, password); err != nil {
+		log.Tag(tag).Field("user_name", username).Err(err).Debug("Authentication of user against directory failed")
+		return nil, ErrUnauthenticated
+	} else if user != nil {
+		return user, nil
+	} else if !AllowedUsername(username) {
+		log.Tag(tag).Field("user_name", username).Debug("Authentication of user against directory failed: username not allowed")
+		return nil, ErrUnauthenticated
+	}
+	log.Tag(tag).Field("user_name", username).Info("Provisioning user %s from directory", username)
+	if err := a.addUser(username, util.RandomString(directoryPasswordLength), RoleUser, ProviderLDAP, ""); errors.Is(err, ErrUserExists) {
+		return nil, ErrUnauthenticated // Created locally in the meantime, local users take precedence
+	} else if err != nil {
+		return nil, err
+	}
+	return a.User(username)
+}
+
 // AuthenticateToken checks if the token exists and returns the associated User if it does.
-// The method sets the User.Token value to the token that was used for authentication.
+// The method sets the User.Token value to the token that was used for authentication, and
+// the User.TokenScope and User.TokenAllowedIPs values to the token's restrictions, if any.
+// The IP allowlists are not checked here, see User.AllowedFrom.
 func (a *Manager) AuthenticateToken(token string) (*User, error) {
 	if len(token) != tokenLength {
 		return nil, ErrUnauthenticated
 	}
-	user, err := a.userByToken(token)
+	user, err := a.store.UserByToken(token)
+	if err != nil {
+		log.Tag(tag).Field("token", token).Err(err).Trace("Authentication of token failed")
+		return nil, ErrUnauthenticated
+	}
+	t, err := a.store.Token(user.ID, token)
 	if err != nil {
 		log.Tag(tag).Field("token", token).Err(err).Trace("Authentication of token failed")
 		return nil, ErrUnauthenticated
 	}
 	user.Token = token
+	user.TokenScope = t.Scope
+	user.TokenAllowedIPs = t.AllowedIPs
 	return user, nil
 }
 
@@ -516,99 +197,42 @@ func (a *Manager) AuthenticateToken(token string) (*User, error) {
 // after a fixed duration unless ChangeToken is called. This function also prunes tokens for the
 // given user, if there are too many of them.
 func (a *Manager) CreateToken(userID, label string, expires time.Time, origin netip.Addr) (*Token, error) {
-	token := util.RandomLowerStringPrefix(tokenPrefix, tokenLength) // Lowercase only to support "<topic>+<token>@<domain>" email addresses
-	tx, err := a.db.Begin()
-	if err != nil {
-		return nil, err
-	}
-	defer tx.Rollback()
-	access := time.Now()
-	if _, err := tx.Exec(insertTokenQuery, userID, token, label, access.Unix(), origin.String(), expires.Unix()); err != nil {
-		return nil, err
-	}
-	rows, err := tx.Query(selectTokenCountQuery, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return nil, errNoRows
-	}
-	var tokenCount int
-	if err := rows.Scan(&tokenCount); err != nil {
-		return nil, err
-	}
-	if tokenCount >= tokenMaxCount {
-		// This pruning logic is done in two queries for efficiency. The SELECT above is a lookup
-		// on two indices, whereas the query below is a full table scan.
-		if _, err := tx.Exec(deleteExcessTokensQuery, userID, userID, tokenMaxCount); err != nil {
-			return nil, err
+	return a.CreateScopedToken(userID, label, expires, origin, nil, nil)
+}
+
+// CreateScopedToken is like CreateToken, but restricts what the token can be used for (see TokenScope), and
+// which IP ranges it can be used from. If scope is nil and allowedIPs is empty, the token is not restricted.
+func (a *Manager) CreateScopedToken(userID, label string, expires time.Time, origin netip.Addr, scope *TokenScope, allowedIPs []netip.Prefix) (*Token, error) {
+	if scope != nil {
+		for _, grant := range scope.Topics {
+			if !AllowedTopicPattern(grant.TopicPattern) {
+				return nil, ErrInvalidTokenScope
+			}
 		}
 	}
-	if err := tx.Commit(); err != nil {
-		return nil, err
-	}
-	return &Token{
-		Value:      token,
+	token := &Token{
+		Value:      util.RandomLowerStringPrefix(tokenPrefix, tokenLength), // Lowercase only to support "<topic>+<token>@<domain>" email addresses
 		Label:      label,
-		LastAccess: access,
+		LastAccess: time.Now(),
 		LastOrigin: origin,
 		Expires:    expires,
-	}, nil
+		Scope:      scope,
+		AllowedIPs: allowedIPs,
+	}
+	if err := a.store.CreateToken(userID, token, tokenMaxCount); err != nil {
+		return nil, err
+	}
+	return token, nil
 }
 
 // Tokens returns all existing tokens for the user with the given user ID
 func (a *Manager) Tokens(userID string) ([]*Token, error) {
-	rows, err := a.db.Query(selectTokensQuery, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	tokens := make([]*Token, 0)
-	for {
-		token, err := a.readToken(rows)
-		if err == ErrTokenNotFound {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		tokens = append(tokens, token)
-	}
-	return tokens, nil
+	return a.store.Tokens(userID)
 }
 
 // Token returns a specific token for a user
 func (a *Manager) Token(userID, token string) (*Token, error) {
-	rows, err := a.db.Query(selectTokenQuery, userID, token)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	return a.readToken(rows)
-}
-
-func (a *Manager) readToken(rows *sql.Rows) (*Token, error) {
-	var token, label, lastOrigin string
-	var lastAccess, expires int64
-	if !rows.Next() {
-		return nil, ErrTokenNotFound
-	}
-	if err := rows.Scan(&token, &label, &lastAccess, &lastOrigin, &expires); err != nil {
-		return nil, err
-	} else if err := rows.Err(); err != nil {
-		return nil, err
-	}
-	lastOriginIP, err := netip.ParseAddr(lastOrigin)
-	if err != nil {
-		lastOriginIP = netip.IPv4Unspecified()
-	}
-	return &Token{
-		Value:      token,
-		Label:      label,
-		LastAccess: time.Unix(lastAccess, 0),
-		LastOrigin: lastOriginIP,
-		Expires:    time.Unix(expires, 0),
-	}, nil
+	return a.store.Token(userID, token)
 }
 
 // ChangeToken updates a token's label and/or expiry date
@@ -616,22 +240,18 @@ func (a *Manager) ChangeToken(userID, token string, label *string, expires *time
 	if token == "" {
 		return nil, errNoTokenProvided
 	}
-	tx, err := a.db.Begin()
-	if err != nil {
+	if err := a.store.ChangeToken(userID, token, label, expires); err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
-	if label != nil {
-		if _, err := tx.Exec(updateTokenLabelQuery, *label, userID, token); err != nil {
-			return nil, err
-		}
-	}
-	if expires != nil {
-		if _, err := tx.Exec(updateTokenExpiryQuery, expires.Unix(), userID, token); err != nil {
-			return nil, err
-		}
+	return a.Token(userID, token)
+}
+
+// ChangeTokenAllowedIPs changes the IP ranges a token can be used from. An empty list allows all IP addresses.
+func (a *Manager) ChangeTokenAllowedIPs(userID, token string, allowedIPs []netip.Prefix) (*Token, error) {
+	if token == "" {
+		return nil, errNoTokenProvided
 	}
-	if err := tx.Commit(); err != nil {
+	if err := a.store.ChangeTokenAllowedIPs(userID, token, allowedIPs); err != nil {
 		return nil, err
 	}
 	return a.Token(userID, token)
@@ -642,95 +262,44 @@ func (a *Manager) RemoveToken(userID, token string) error {
 	if token == "" {
 		return errNoTokenProvided
 	}
-	if _, err := a.db.Exec(deleteTokenQuery, userID, token); err != nil {
-		return err
-	}
-	return nil
+	return a.store.RemoveToken(userID, token)
 }
 
 // RemoveExpiredTokens deletes all expired tokens from the database
 func (a *Manager) RemoveExpiredTokens() error {
-	if _, err := a.db.Exec(deleteExpiredTokensQuery, time.Now().Unix()); err != nil {
-		return err
-	}
-	return nil
+	return a.store.RemoveExpiredTokens()
 }
 
 // PhoneNumbers returns all phone numbers for the user with the given user ID
 func (a *Manager) PhoneNumbers(userID string) ([]string, error) {
-	rows, err := a.db.Query(selectPhoneNumbersQuery, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	phoneNumbers := make([]string, 0)
-	for {
-		phoneNumber, err := a.readPhoneNumber(rows)
-		if err == ErrPhoneNumberNotFound {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		phoneNumbers = append(phoneNumbers, phoneNumber)
-	}
-	return phoneNumbers, nil
-}
-
-func (a *Manager) readPhoneNumber(rows *sql.Rows) (string, error) {
-	var phoneNumber string
-	if !rows.Next() {
-		return "", ErrPhoneNumberNotFound
-	}
-	if err := rows.Scan(&phoneNumber); err != nil {
-		return "", err
-	} else if err := rows.Err(); err != nil {
-		return "", err
-	}
-	return phoneNumber, nil
+	return a.store.PhoneNumbers(userID)
 }
 
 // AddPhoneNumber adds a phone number to the user with the given user ID
 func (a *Manager) AddPhoneNumber(userID string, phoneNumber string) error {
-	if _, err := a.db.Exec(insertPhoneNumberQuery, userID, phoneNumber); err != nil {
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-			return ErrPhoneNumberExists
-		}
-		return err
-	}
-	return nil
+	return a.store.AddPhoneNumber(userID, phoneNumber)
 }
 
 // RemovePhoneNumber deletes a phone number from the user with the given user ID
 func (a *Manager) RemovePhoneNumber(userID string, phoneNumber string) error {
-	_, err := a.db.Exec(deletePhoneNumberQuery, userID, phoneNumber)
-	return err
+	return a.store.RemovePhoneNumber(userID, phoneNumber)
 }
 
 // RemoveDeletedUsers deletes all users that have been marked deleted for
 func (a *Manager) RemoveDeletedUsers() error {
-	if _, err := a.db.Exec(deleteUsersMarkedQuery, time.Now().Unix()); err != nil {
-		return err
-	}
-	return nil
+	return a.store.RemoveDeletedUsers()
 }
 
 // ChangeSettings persists the user settings
 func (a *Manager) ChangeSettings(userID string, prefs *Prefs) error {
-	b, err := json.Marshal(prefs)
-	if err != nil {
-		return err
-	}
-	if _, err := a.db.Exec(updateUserPrefsQuery, string(b), userID); err != nil {
-		return err
-	}
-	return nil
+	return a.store.ChangeSettings(userID, prefs)
 }
 
 // ResetStats resets all user stats in the user database. This touches all users.
 func (a *Manager) ResetStats() error {
 	a.mu.Lock() // Includes database query to avoid races!
 	defer a.mu.Unlock()
-	if _, err := a.db.Exec(updateUserStatsResetAllQuery); err != nil {
+	if err := a.store.ResetStats(); err != nil {
 		return err
 	}
 	a.statsQueue = make(map[string]*Stats)
@@ -775,27 +344,8 @@ func (a *Manager) writeUserStatsQueue() error {
 	statsQueue := a.statsQueue
 	a.statsQueue = make(map[string]*Stats)
 	a.mu.Unlock()
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
 	log.Tag(tag).Debug("Writing user stats queue for %d user(s)", len(statsQueue))
-	for userID, update := range statsQueue {
-		log.
-			Tag(tag).
-			Fields(log.Context{
-				"user_id":        userID,
-				"messages_count": update.Messages,
-				"emails_count":   update.Emails,
-				"calls_count":    update.Calls,
-			}).
-			Trace("Updating stats for user %s", userID)
-		if _, err := tx.Exec(updateUserStatsQuery, update.Messages, update.Emails, update.Calls, userID); err != nil {
-			return err
-		}
-	}
-	return tx.Commit()
+	return a.store.UpdateStats(statsQueue)
 }
 
 func (a *Manager) writeTokenUpdateQueue() error {
@@ -808,52 +358,113 @@ func (a *Manager) writeTokenUpdateQueue() error {
 	tokenQueue := a.tokenQueue
 	a.tokenQueue = make(map[string]*TokenUpdate)
 	a.mu.Unlock()
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
 	log.Tag(tag).Debug("Writing token update queue for %d token(s)", len(tokenQueue))
-	for tokenID, update := range tokenQueue {
-		log.Tag(tag).Trace("Updating token %s with last access time %v", tokenID, update.LastAccess.Unix())
-		if _, err := tx.Exec(updateTokenLastAccessQuery, update.LastAccess.Unix(), update.LastOrigin.String(), tokenID); err != nil {
-			return err
-		}
-	}
-	return tx.Commit()
+	return a.store.UpdateTokenLastAccess(tokenQueue)
 }
 
 // Authorize returns nil if the given user has access to the given topic using the desired
 // permission. The user param may be nil to signal an anonymous user.
+//
+// Access control entries of the user take precedence over entries of the user's groups (local and
+// directory groups, see UserGroups), which take precedence over entries of the Everyone user. If none
+// match, the default access applies.
+//
+// If the user logged in with a scoped token (see TokenScope), the token's scope must allow the access
+// as well. This also applies to admins.
 func (a *Manager) Authorize(user *User, topic string, perm Permission) error {
+	if user != nil && user.TokenScope != nil {
+		if err := user.TokenScope.Authorize(topic, perm); err != nil {
+			return err
+		}
+	}
 	if user != nil && user.Role == RoleAdmin {
 		return nil // Admin can do everything
 	}
 	username := Everyone
+	var groups []string
 	if user != nil {
+		var err error
 		username = user.Name
+		if groups, err = a.userGroups(user); err != nil {
+			return err
+		}
 	}
-	// Select the read/write permissions for this user/topic combo.
-	// - The query may return two rows (one for everyone, and one for the user), but prioritizes the user.
-	// - Furthermore, the query prioritizes more specific permissions (longer!) over more generic ones, e.g. "test*" > "*"
-	// - It also prioritizes write permissions over read permissions
-	rows, err := a.db.Query(selectTopicPermsQuery, Everyone, username, topic)
+	read, write, found, err := a.store.TopicPermission(username, groups, topic)
 	if err != nil {
 		return err
-	}
-	defer rows.Close()
-	if !rows.Next() {
+	} else if !found {
 		return a.resolvePerms(a.defaultAccess, perm)
 	}
-	var read, write bool
-	if err := rows.Scan(&read, &write); err != nil {
-		return err
-	} else if err := rows.Err(); err != nil {
-		return err
-	}
 	return a.resolvePerms(NewPermission(read, write), perm)
 }
 
+// UserGroups returns the names of all groups the given user is a member of: the local groups (see AddGroup),
+// and the directory groups, if the user was provisioned from the directory (see UseDirectory). Directory groups
+// are cached, so changes in the directory may take a while to be picked up.
+func (a *Manager) UserGroups(username string) ([]string, error) {
+	user, err := a.User(username)
+	if err != nil {
+		return nil, err
+	}
+	return a.userGroups(user)
+}
+
+func (a *Manager) userGroups(user *User) ([]string, error) {
+	groups, err := a.store.UserGroups(user.Name)
+	if err != nil {
+		return nil, err
+	} else if user.Provider != ProviderLDAP {
+		return groups, nil
+	}
+	for _, group := range a.directoryGroups(user.Name) {
+		if !util.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// directoryGroupsEntry holds the cached directory groups of a user, see directoryGroups
+type directoryGroupsEntry struct {
+	groups []string
+	next   time.Time // Time the directory is queried again
+	mu     sync.Mutex
+}
+
+// directoryGroups returns the directory groups of the user. The groups are cached for the groups cache duration.
+// If the directory cannot be queried, the error is logged, and the previously cached groups are used (or none,
+// if there are none), so that local access control entries still apply. The directory is then queried again
+// after directoryGroupsRetryInterval, and not on every request.
+func (a *Manager) directoryGroups(username string) []string {
+	a.mu.Lock()
+	if a.directory == nil {
+		a.mu.Unlock()
+		return nil
+	}
+	directory := a.directory
+	entry, ok := a.groups[username]
+	if !ok {
+		entry = &directoryGroupsEntry{}
+		a.groups[username] = entry
+	}
+	cacheDuration := a.groupsCacheDuration
+	a.mu.Unlock()
+	entry.mu.Lock() // Outside of the manager lock, since this may query the directory
+	defer entry.mu.Unlock()
+	if time.Now().Before(entry.next) {
+		return entry.groups
+	}
+	groups, err := directory.Groups(username)
+	if err != nil {
+		log.Tag(tag).Field("user_name", username).Err(err).Warn("Cannot retrieve groups of user %s from directory, using cached groups %v", username, entry.groups)
+		entry.next = time.Now().Add(min(directoryGroupsRetryInterval, cacheDuration))
+		return entry.groups
+	}
+	entry.groups = groups
+	entry.next = time.Now().Add(cacheDuration)
+	return entry.groups
+}
+
 func (a *Manager) resolvePerms(base, perm Permission) error {
 	if perm == PermissionRead && base.IsRead() {
 		return nil
@@ -865,6 +476,20 @@ func (a *Manager) resolvePerms(base, perm Permission) error {
 
 // AddUser adds a user with the given username, password and role
 func (a *Manager) AddUser(username, password string, role Role) error {
+	return a.addUser(username, password, role, ProviderLocal, "")
+}
+
+// AddProviderUser adds a user that was provisioned from an external identity provider, bound to the
+// provider's stable ID of the user (providerID), see UserByProviderID. It returns ErrUserExists if a user
+// with the given username or provider ID already exists, so that existing accounts are never taken over.
+func (a *Manager) AddProviderUser(username, password string, role Role, provider Provider, providerID string) error {
+	if provider == ProviderLocal || providerID == "" {
+		return ErrInvalidArgument
+	}
+	return a.addUser(username, password, role, provider, providerID)
+}
+
+func (a *Manager) addUser(username, password string, role Role, provider Provider, providerID string) error {
 	if !AllowedUsername(username) || !AllowedRole(role) {
 		return ErrInvalidArgument
 	}
@@ -873,14 +498,8 @@ func (a *Manager) AddUser(username, password string, role Role) error {
 		return err
 	}
 	userID := util.RandomStringPrefix(userIDPrefix, userIDLength)
-	syncTopic, now := util.RandomStringPrefix(syncTopicPrefix, syncTopicLength), time.Now().Unix()
-	if _, err = a.db.Exec(insertUserQuery, userID, username, hash, role, syncTopic, now); err != nil {
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-			return ErrUserExists
-		}
-		return err
-	}
-	return nil
+	syncTopic := util.RandomStringPrefix(syncTopicPrefix, syncTopicLength)
+	return a.store.AddUser(userID, username, string(hash), role, syncTopic, provider, providerID)
 }
 
 // RemoveUser deletes the user with the given username. The function returns nil on success, even
@@ -889,11 +508,7 @@ func (a *Manager) RemoveUser(username string) error {
 	if !AllowedUsername(username) {
 		return ErrInvalidArgument
 	}
-	// Rows in user_access, user_token, etc. are deleted via foreign keys
-	if _, err := a.db.Exec(deleteUserQuery, username); err != nil {
-		return err
-	}
-	return nil
+	return a.store.RemoveUser(username)
 }
 
 // MarkUserRemoved sets the deleted flag on the user, and deletes all access tokens. This prevents
@@ -902,293 +517,135 @@ func (a *Manager) MarkUserRemoved(user *User) error {
 	if !AllowedUsername(user.Name) {
 		return ErrInvalidArgument
 	}
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	if _, err := tx.Exec(deleteUserAccessQuery, user.Name, user.Name); err != nil {
-		return err
-	}
-	if _, err := tx.Exec(deleteAllTokenQuery, user.ID); err != nil {
-		return err
-	}
-	if _, err := tx.Exec(updateUserDeletedQuery, time.Now().Add(userHardDeleteAfterDuration).Unix(), user.ID); err != nil {
-		return err
-	}
-	return tx.Commit()
+	return a.store.MarkUserRemoved(user, time.Now().Add(userHardDeleteAfterDuration))
 }
 
 // Users returns a list of users. It always also returns the Everyone user ("*").
 func (a *Manager) Users() ([]*User, error) {
-	rows, err := a.db.Query(selectUsernamesQuery)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	usernames := make([]string, 0)
-	for rows.Next() {
-		var username string
-		if err := rows.Scan(&username); err != nil {
-			return nil, err
-		} else if err := rows.Err(); err != nil {
-			return nil, err
-		}
-		usernames = append(usernames, username)
-	}
-	rows.Close()
-	users := make([]*User, 0)
-	for _, username := range usernames {
-		user, err := a.User(username)
-		if err != nil {
-			return nil, err
-		}
-		users = append(users, user)
-	}
-	return users, nil
+	return a.store.Users()
 }
 
 // UsersCount returns the number of users in the databsae
 func (a *Manager) UsersCount() (int64, error) {
-	rows, err := a.db.Query(selectUserCountQuery)
-	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return 0, errNoRows
-	}
-	var count int64
-	if err := rows.Scan(&count); err != nil {
-		return 0, err
-	}
-	return count, nil
+	return a.store.UsersCount()
 }
 
 // User returns the user with the given username if it exists, or ErrUserNotFound otherwise.
 // You may also pass Everyone to retrieve the anonymous user and its Grant list.
 func (a *Manager) User(username string) (*User, error) {
-	rows, err := a.db.Query(selectUserByNameQuery, username)
-	if err != nil {
-		return nil, err
-	}
-	return a.readUser(rows)
+	return a.store.User(username)
 }
 
 // UserByID returns the user with the given ID if it exists, or ErrUserNotFound otherwise
 func (a *Manager) UserByID(id string) (*User, error) {
-	rows, err := a.db.Query(selectUserByIDQuery, id)
-	if err != nil {
-		return nil, err
-	}
-	return a.readUser(rows)
+	return a.store.UserByID(id)
+}
+
+// UserByProviderID returns the user provisioned from the given identity provider with the given provider ID
+// if it exists, or ErrUserNotFound otherwise
+func (a *Manager) UserByProviderID(provider Provider, providerID string) (*User, error) {
+	return a.store.UserByProviderID(provider, providerID)
 }
 
 // UserByStripeCustomer returns the user with the given Stripe customer ID if it exists, or ErrUserNotFound otherwise.
 func (a *Manager) UserByStripeCustomer(stripeCustomerID string) (*User, error) {
-	rows, err := a.db.Query(selectUserByStripeCustomerIDQuery, stripeCustomerID)
-	if err != nil {
-		return nil, err
-	}
-	return a.readUser(rows)
+	return a.store.UserByStripeCustomer(stripeCustomerID)
 }
 
-func (a *Manager) userByToken(token string) (*User, error) {
-	rows, err := a.db.Query(selectUserByTokenQuery, token, time.Now().Unix())
-	if err != nil {
-		return nil, err
-	}
-	return a.readUser(rows)
+// AllGrants returns all user-specific access control entries, mapped to their respective user IDs
+func (a *Manager) AllGrants() (map[string][]Grant, error) {
+	return a.store.AllGrants()
 }
 
-func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
-	defer rows.Close()
-	var id, username, hash, role, prefs, syncTopic string
-	var stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval, stripeMonthlyPriceID, stripeYearlyPriceID, tierID, tierCode, tierName sql.NullString
-	var messages, emails, calls int64
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
-	if !rows.Next() {
-		return nil, ErrUserNotFound
-	}
-	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
-		return nil, err
-	} else if err := rows.Err(); err != nil {
-		return nil, err
+// AllGroupGrants returns all group access control entries, mapped to their respective group names
+func (a *Manager) AllGroupGrants() (map[string][]Grant, error) {
+	return a.store.AllGroupGrants()
+}
+
+// Grants returns all user-specific access control entries. If a group principal is passed
+// (e.g. "group:ops", see GroupPrefix), the group's access control entries are returned.
+func (a *Manager) Grants(username string) ([]Grant, error) {
+	if group, ok := GroupPrincipal(username); ok {
+		return a.store.GroupGrants(group)
 	}
-	user := &User{
-		ID:        id,
-		Name:      username,
-		Hash:      hash,
-		Role:      Role(role),
-		Prefs:     &Prefs{},
-		SyncTopic: syncTopic,
-		Stats: &Stats{
-			Messages: messages,
-			Emails:   emails,
-			Calls:    calls,
-		},
-		Billing: &Billing{
-			StripeCustomerID:            stripeCustomerID.String,                                          // May be empty
-			StripeSubscriptionID:        stripeSubscriptionID.String,                                      // May be empty
-			StripeSubscriptionStatus:    stripe.SubscriptionStatus(stripeSubscriptionStatus.String),       // May be empty
-			StripeSubscriptionInterval:  stripe.PriceRecurringInterval(stripeSubscriptionInterval.String), // May be empty
-			StripeSubscriptionPaidUntil: time.Unix(stripeSubscriptionPaidUntil.Int64, 0),                  // May be zero
-			StripeSubscriptionCancelAt:  time.Unix(stripeSubscriptionCancelAt.Int64, 0),                   // May be zero
-		},
-		Deleted: deleted.Valid,
-	}
-	if err := json.Unmarshal([]byte(prefs), user.Prefs); err != nil {
-		return nil, err
+	return a.store.Grants(username)
+}
+
+// AddGroup creates a new local group with the given name. Use AddGroupMember to add users to it,
+// and AllowAccess with a group principal (e.g. "group:ops") to grant it access to topics.
+func (a *Manager) AddGroup(name string) error {
+	if !AllowedGroup(name) {
+		return ErrInvalidArgument
 	}
-	if tierCode.Valid {
-		// See readTier() when this is changed!
-		user.Tier = &Tier{
-			ID:                       tierID.String,
-			Code:                     tierCode.String,
-			Name:                     tierName.String,
-			MessageLimit:             messagesLimit.Int64,
-			MessageExpiryDuration:    time.Duration(messagesExpiryDuration.Int64) * time.Second,
-			EmailLimit:               emailsLimit.Int64,
-			CallLimit:                callsLimit.Int64,
-			ReservationLimit:         reservationsLimit.Int64,
-			AttachmentFileSizeLimit:  attachmentFileSizeLimit.Int64,
-			AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
-			AttachmentExpiryDuration: time.Duration(attachmentExpiryDuration.Int64) * time.Second,
-			AttachmentBandwidthLimit: attachmentBandwidthLimit.Int64,
-			StripeMonthlyPriceID:     stripeMonthlyPriceID.String, // May be empty
-			StripeYearlyPriceID:      stripeYearlyPriceID.String,  // May be empty
-		}
+	return a.store.AddGroup(name)
+}
+
+// RemoveGroup deletes the local group with the given name, including its members and access
+// control entries, or returns ErrGroupNotFound if it does not exist. Since access control entries
+// are granted by group name, this also removes the entries of a directory group with the same name.
+func (a *Manager) RemoveGroup(name string) error {
+	if !AllowedGroup(name) {
+		return ErrInvalidArgument
 	}
-	return user, nil
+	return a.store.RemoveGroup(name)
 }
 
-// AllGrants returns all user-specific access control entries, mapped to their respective user IDs
-func (a *Manager) AllGrants() (map[string][]Grant, error) {
-	rows, err := a.db.Query(selectUserAllAccessQuery)
-	if err != nil {
-		return nil, err
+// Groups returns all local groups and their members, ordered by name
+func (a *Manager) Groups() ([]*Group, error) {
+	return a.store.Groups()
+}
+
+// Group returns the local group with the given name and its members, or ErrGroupNotFound
+func (a *Manager) Group(name string) (*Group, error) {
+	return a.store.Group(name)
+}
+
+// AddGroupMember adds the given user to a local group. It returns ErrGroupNotFound or ErrUserNotFound
+// if the group or user do not exist. Adding a user that is already a member is not an error.
+func (a *Manager) AddGroupMember(group, username string) error {
+	if !AllowedGroup(group) || !AllowedUsername(username) {
+		return ErrInvalidArgument
 	}
-	defer rows.Close()
-	grants := make(map[string][]Grant, 0)
-	for rows.Next() {
-		var userID, topic string
-		var read, write bool
-		if err := rows.Scan(&userID, &topic, &read, &write); err != nil {
-			return nil, err
-		} else if err := rows.Err(); err != nil {
-			return nil, err
-		}
-		if _, ok := grants[userID]; !ok {
-			grants[userID] = make([]Grant, 0)
-		}
-		grants[userID] = append(grants[userID], Grant{
-			TopicPattern: fromSQLWildcard(topic),
-			Allow:        NewPermission(read, write),
-		})
+	if _, err := a.store.Group(group); err != nil {
+		return err
+	}
+	if _, err := a.store.User(username); err != nil {
+		return err
 	}
-	return grants, nil
+	return a.store.AddGroupMember(group, username)
 }
 
-// Grants returns all user-specific access control entries
-func (a *Manager) Grants(username string) ([]Grant, error) {
-	rows, err := a.db.Query(selectUserAccessQuery, username)
-	if err != nil {
-		return nil, err
+// RemoveGroupMember removes the given user from a local group. It returns ErrGroupNotFound if the
+// group does not exist. Removing a user that is not a member is not an error.
+func (a *Manager) RemoveGroupMember(group, username string) error {
+	if !AllowedGroup(group) || !AllowedUsername(username) {
+		return ErrInvalidArgument
 	}
-	defer rows.Close()
-	grants := make([]Grant, 0)
-	for rows.Next() {
-		var topic string
-		var read, write bool
-		if err := rows.Scan(&topic, &read, &write); err != nil {
-			return nil, err
-		} else if err := rows.Err(); err != nil {
-			return nil, err
-		}
-		grants = append(grants, Grant{
-			TopicPattern: fromSQLWildcard(topic),
-			Allow:        NewPermission(read, write),
-		})
+	if _, err := a.store.Group(group); err != nil {
+		return err
 	}
-	return grants, nil
+	return a.store.RemoveGroupMember(group, username)
 }
 
 // Reservations returns all user-owned topics, and the associated everyone-access
 func (a *Manager) Reservations(username string) ([]Reservation, error) {
-	rows, err := a.db.Query(selectUserReservationsQuery, Everyone, username)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	reservations := make([]Reservation, 0)
-	for rows.Next() {
-		var topic string
-		var ownerRead, ownerWrite bool
-		var everyoneRead, everyoneWrite sql.NullBool
-		if err := rows.Scan(&topic, &ownerRead, &ownerWrite, &everyoneRead, &everyoneWrite); err != nil {
-			return nil, err
-		} else if err := rows.Err(); err != nil {
-			return nil, err
-		}
-		reservations = append(reservations, Reservation{
-			Topic:    unescapeUnderscore(topic),
-			Owner:    NewPermission(ownerRead, ownerWrite),
-			Everyone: NewPermission(everyoneRead.Bool, everyoneWrite.Bool), // false if null
-		})
-	}
-	return reservations, nil
+	return a.store.Reservations(username)
 }
 
 // HasReservation returns true if the given topic access is owned by the user
 func (a *Manager) HasReservation(username, topic string) (bool, error) {
-	rows, err := a.db.Query(selectUserHasReservationQuery, username, escapeUnderscore(topic))
-	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return false, errNoRows
-	}
-	var count int64
-	if err := rows.Scan(&count); err != nil {
-		return false, err
-	}
-	return count > 0, nil
+	return a.store.HasReservation(username, topic)
 }
 
 // ReservationsCount returns the number of reservations owned by this user
 func (a *Manager) ReservationsCount(username string) (int64, error) {
-	rows, err := a.db.Query(selectUserReservationsCountQuery, username)
-	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return 0, errNoRows
-	}
-	var count int64
-	if err := rows.Scan(&count); err != nil {
-		return 0, err
-	}
-	return count, nil
+	return a.store.ReservationsCount(username)
 }
 
 // ReservationOwner returns user ID of the user that owns this topic, or an
 // empty string if it's not owned by anyone
 func (a *Manager) ReservationOwner(topic string) (string, error) {
-	rows, err := a.db.Query(selectUserReservationsOwnerQuery, escapeUnderscore(topic))
-	if err != nil {
-		return "", err
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return "", nil
-	}
-	var ownerUserID string
-	if err := rows.Scan(&ownerUserID); err != nil {
-		return "", err
-	}
-	return ownerUserID, nil
+	return a.store.ReservationOwner(topic)
 }
 
 // ChangePassword changes a user's password
@@ -1197,10 +654,16 @@ func (a *Manager) ChangePassword(username, password string) error {
 	if err != nil {
 		return err
 	}
-	if _, err := a.db.Exec(updateUserPassQuery, hash, username); err != nil {
-		return err
+	return a.store.ChangePassword(username, string(hash))
+}
+
+// ChangeAllowedIPs changes the IP ranges the user can log in from, with a password or with any of the
+// user's tokens. An empty list allows all IP addresses.
+func (a *Manager) ChangeAllowedIPs(username string, allowedIPs []netip.Prefix) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
 	}
-	return nil
+	return a.store.ChangeAllowedIPs(username, allowedIPs)
 }
 
 // ChangeRole changes a user's role. When a role is changed from RoleUser to RoleAdmin,
@@ -1209,11 +672,11 @@ func (a *Manager) ChangeRole(username string, role Role) error {
 	if !AllowedUsername(username) || !AllowedRole(role) {
 		return ErrInvalidArgument
 	}
-	if _, err := a.db.Exec(updateUserRoleQuery, string(role), username); err != nil {
+	if err := a.store.ChangeRole(username, role); err != nil {
 		return err
 	}
 	if role == RoleAdmin {
-		if _, err := a.db.Exec(deleteUserAccessQuery, username, username); err != nil {
+		if err := a.store.ResetAccess(username, ""); err != nil {
 			return err
 		}
 	}
@@ -1232,10 +695,7 @@ func (a *Manager) ChangeTier(username, tier string) error {
 	} else if err := a.checkReservationsLimit(username, t.ReservationLimit); err != nil {
 		return err
 	}
-	if _, err := a.db.Exec(updateUserTierQuery, tier, username); err != nil {
-		return err
-	}
-	return nil
+	return a.store.ChangeTier(username, tier)
 }
 
 // ResetTier removes the tier from the given user
@@ -1245,8 +705,7 @@ func (a *Manager) ResetTier(username string) error {
 	} else if err := a.checkReservationsLimit(username, 0); err != nil {
 		return err
 	}
-	_, err := a.db.Exec(deleteUserTierQuery, username)
-	return err
+	return a.store.ResetTier(username)
 }
 
 func (a *Manager) checkReservationsLimit(username string, reservationsLimit int64) error {
@@ -1271,18 +730,10 @@ func (a *Manager) AllowReservation(username string, topic string) error {
 	if (!AllowedUsername(username) && username != Everyone) || !AllowedTopic(topic) {
 		return ErrInvalidArgument
 	}
-	rows, err := a.db.Query(selectOtherAccessCountQuery, escapeUnderscore(topic), escapeUnderscore(topic), username)
+	otherCount, err := a.store.OtherAccessCount(username, topic)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return errNoRows
-	}
-	var otherCount int
-	if err := rows.Scan(&otherCount); err != nil {
-		return err
-	}
 	if otherCount > 0 {
 		return errTopicOwnedByOthers
 	}
@@ -1291,37 +742,44 @@ func (a *Manager) AllowReservation(username string, topic string) error {
 
 // AllowAccess adds or updates an entry in th access control list for a specific user. It controls
 // read/write access to a topic. The parameter topicPattern may include wildcards (*). The ACL entry
-// owner may either be a user (username), or the system (empty).
+// owner may either be a user (username), or the system (empty). Instead of a username, a group
+// principal may be passed (e.g. "group:ops", see GroupPrefix) to grant access to a group.
 func (a *Manager) AllowAccess(username string, topicPattern string, permission Permission) error {
-	if !AllowedUsername(username) && username != Everyone {
+	if !AllowedTopicPattern(topicPattern) {
 		return ErrInvalidArgument
-	} else if !AllowedTopicPattern(topicPattern) {
+	} else if group, ok := GroupPrincipal(username); ok {
+		if !AllowedGroup(group) {
+			return ErrInvalidArgument
+		}
+		return a.store.AllowGroupAccess(group, topicPattern, permission.IsRead(), permission.IsWrite())
+	} else if !AllowedUsername(username) && username != Everyone {
 		return ErrInvalidArgument
 	}
 	owner := ""
-	if _, err := a.db.Exec(upsertUserAccessQuery, username, toSQLWildcard(topicPattern), permission.IsRead(), permission.IsWrite(), owner, owner); err != nil {
-		return err
-	}
-	return nil
+	return a.store.AllowAccess(username, topicPattern, permission.IsRead(), permission.IsWrite(), owner)
 }
 
 // ResetAccess removes an access control list entry for a specific username/topic, or (if topic is
-// empty) for an entire user. The parameter topicPattern may include wildcards (*).
+// empty) for an entire user. The parameter topicPattern may include wildcards (*). The username may
+// also be a group principal (e.g. "group:ops"). If both are empty, all entries are removed, including
+// those of groups.
 func (a *Manager) ResetAccess(username string, topicPattern string) error {
-	if !AllowedUsername(username) && username != Everyone && username != "" {
+	if !AllowedTopicPattern(topicPattern) && topicPattern != "" {
 		return ErrInvalidArgument
-	} else if !AllowedTopicPattern(topicPattern) && topicPattern != "" {
+	} else if group, ok := GroupPrincipal(username); ok {
+		if !AllowedGroup(group) {
+			return ErrInvalidArgument
+		}
+		return a.store.ResetGroupAccess(group, topicPattern)
+	} else if !AllowedUsername(username) && username != Everyone && username != "" {
 		return ErrInvalidArgument
 	}
 	if username == "" && topicPattern == "" {
-		_, err := a.db.Exec(deleteAllAccessQuery, username)
-		return err
-	} else if topicPattern == "" {
-		_, err := a.db.Exec(deleteUserAccessQuery, username, username)
-		return err
+		if err := a.store.ResetGroupAccess("", ""); err != nil {
+			return err
+		}
 	}
-	_, err := a.db.Exec(deleteTopicAccessQuery, username, username, toSQLWildcard(topicPattern))
-	return err
+	return a.store.ResetAccess(username, topicPattern)
 }
 
 // AddReservation creates two access control entries for the given topic: one with full read/write access for the
@@ -1331,18 +789,7 @@ func (a *Manager) AddReservation(username string, topic string, everyone Permiss
 	if !AllowedUsername(username) || username == Everyone || !AllowedTopic(topic) {
 		return ErrInvalidArgument
 	}
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	if _, err := tx.Exec(upsertUserAccessQuery, username, escapeUnderscore(topic), true, true, username, username); err != nil {
-		return err
-	}
-	if _, err := tx.Exec(upsertUserAccessQuery, Everyone, escapeUnderscore(topic), everyone.IsRead(), everyone.IsWrite(), username, username); err != nil {
-		return err
-	}
-	return tx.Commit()
+	return a.store.AddReservation(username, topic, everyone)
 }
 
 // RemoveReservations deletes the access control entries associated with the given username/topic, as
@@ -1356,323 +803,204 @@ func (a *Manager) RemoveReservations(username string, topics ...string) error {
 			return ErrInvalidArgument
 		}
 	}
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	for _, topic := range topics {
-		if _, err := tx.Exec(deleteTopicAccessQuery, username, username, escapeUnderscore(topic)); err != nil {
-			return err
-		}
-		if _, err := tx.Exec(deleteTopicAccessQuery, Everyone, Everyone, escapeUnderscore(topic)); err != nil {
-			return err
-		}
-	}
-	return tx.Commit()
-}
-
-// DefaultAccess returns the default read/write access if no access control entry matches
-func (a *Manager) DefaultAccess() Permission {
-	return a.defaultAccess
+	return a.store.RemoveReservations(username, topics...)
 }
 
-// AddTier creates a new tier in the database
-func (a *Manager) AddTier(tier *Tier) error {
-	if tier.ID == "" {
-		tier.ID = util.RandomStringPrefix(tierIDPrefix, tierIDLength)
+// AddWebhook creates a new webhook for the given user and topic. Every message published to the topic is
+// POSTed to the URL, either as JSON, or rendered using the template (if non-empty). The returned webhook
+// contains a randomly generated secret, which is used to sign the requests.
+func (a *Manager) AddWebhook(userID, topic, url, template string) (*Webhook, error) {
+	if userID == "" || !AllowedTopic(topic) || !AllowedWebhookURL(url) {
+		return nil, ErrInvalidArgument
 	}
-	if _, err := a.db.Exec(insertTierQuery, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID)); err != nil {
-		return err
+	count, err := a.store.WebhooksCount(userID)
+	if err != nil {
+		return nil, err
+	} else if count >= webhookMaxCount {
+		return nil, ErrTooManyWebhooks
+	}
+	webhook := &Webhook{
+		ID:       util.RandomStringPrefix(webhookIDPrefix, webhookIDLength),
+		UserID:   userID,
+		Topic:    topic,
+		URL:      url,
+		Template: template,
+		Secret:   util.RandomSecretString(webhookSecretLength),
+	}
+	if err := a.store.AddWebhook(webhook); err != nil {
+		return nil, err
 	}
-	return nil
+	return webhook, nil
 }
 
-// UpdateTier updates a tier's properties in the database
-func (a *Manager) UpdateTier(tier *Tier) error {
-	if _, err := a.db.Exec(updateTierQuery, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), tier.Code); err != nil {
-		return err
-	}
-	return nil
+// Webhooks returns all webhooks of the given user, including their delivery status
+func (a *Manager) Webhooks(userID string) ([]*Webhook, error) {
+	return a.store.Webhooks(userID)
 }
 
-// RemoveTier deletes the tier with the given code
-func (a *Manager) RemoveTier(code string) error {
-	if !AllowedTier(code) {
-		return ErrInvalidArgument
-	}
-	// This fails if any user has this tier
-	if _, err := a.db.Exec(deleteTierQuery, code); err != nil {
-		return err
-	}
-	return nil
+// WebhooksByTopic returns all webhooks for the given topic, regardless of which user owns them
+func (a *Manager) WebhooksByTopic(topic string) ([]*Webhook, error) {
+	return a.store.WebhooksByTopic(topic)
 }
 
-// ChangeBilling updates a user's billing fields, namely the Stripe customer ID, and subscription information
-func (a *Manager) ChangeBilling(username string, billing *Billing) error {
-	if _, err := a.db.Exec(updateBillingQuery, nullString(billing.StripeCustomerID), nullString(billing.StripeSubscriptionID), nullString(string(billing.StripeSubscriptionStatus)), nullString(string(billing.StripeSubscriptionInterval)), nullInt64(billing.StripeSubscriptionPaidUntil.Unix()), nullInt64(billing.StripeSubscriptionCancelAt.Unix()), username); err != nil {
-		return err
+// RemoveWebhook deletes a webhook of the given user, including all queued deliveries,
+// or returns ErrWebhookNotFound if the user does not own a webhook with this ID
+func (a *Manager) RemoveWebhook(userID, webhookID string) error {
+	if userID == "" || webhookID == "" {
+		return ErrInvalidArgument
 	}
-	return nil
+	return a.store.RemoveWebhook(userID, webhookID)
 }
 
-// Tiers returns a list of all Tier structs
-func (a *Manager) Tiers() ([]*Tier, error) {
-	rows, err := a.db.Query(selectTiersQuery)
-	if err != nil {
-		return nil, err
+// EnqueueWebhookDeliveries adds the given deliveries to the persistent webhook delivery queue. Delivery IDs are
+// generated if not set, and deliveries without a next attempt time are due immediately.
+func (a *Manager) EnqueueWebhookDeliveries(deliveries ...*WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
 	}
-	defer rows.Close()
-	tiers := make([]*Tier, 0)
-	for {
-		tier, err := a.readTier(rows)
-		if err == ErrTierNotFound {
-			break
-		} else if err != nil {
-			return nil, err
+	for _, d := range deliveries {
+		if d.ID == "" {
+			d.ID = util.RandomStringPrefix(webhookDeliveryIDPrefix, webhookDeliveryIDLength)
+		}
+		if d.NextAttempt.IsZero() {
+			d.NextAttempt = time.Now()
 		}
-		tiers = append(tiers, tier)
 	}
-	return tiers, nil
+	return a.store.AddWebhookDeliveries(deliveries)
 }
 
-// Tier returns a Tier based on the code, or ErrTierNotFound if it does not exist
-func (a *Manager) Tier(code string) (*Tier, error) {
-	rows, err := a.db.Query(selectTierByCodeQuery, code)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	return a.readTier(rows)
+// WebhookDeliveriesDue returns up to limit queued webhook deliveries that are due to be sent
+func (a *Manager) WebhookDeliveriesDue(limit int) ([]*WebhookDelivery, error) {
+	return a.store.WebhookDeliveriesDue(time.Now(), limit)
 }
 
-// TierByStripePrice returns a Tier based on the Stripe price ID, or ErrTierNotFound if it does not exist
-func (a *Manager) TierByStripePrice(priceID string) (*Tier, error) {
-	rows, err := a.db.Query(selectTierByPriceIDQuery, priceID, priceID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	return a.readTier(rows)
+// MarkWebhookDelivered removes a successfully sent delivery from the queue, and updates the webhook status
+func (a *Manager) MarkWebhookDelivered(delivery *WebhookDelivery) error {
+	return a.store.MarkWebhookDelivered(delivery, time.Now())
+}
+
+// MarkWebhookDeliveryFailed updates the webhook status after a failed delivery attempt. The delivery is
+// retried at nextAttempt, or removed from the queue if nextAttempt is zero.
+func (a *Manager) MarkWebhookDeliveryFailed(delivery *WebhookDelivery, reason string, nextAttempt time.Time) error {
+	return a.store.MarkWebhookDeliveryFailed(delivery, time.Now(), reason, nextAttempt)
 }
 
-func (a *Manager) readTier(rows *sql.Rows) (*Tier, error) {
-	var id, code, name string
-	var stripeMonthlyPriceID, stripeYearlyPriceID sql.NullString
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit sql.NullInt64
-	if !rows.Next() {
-		return nil, ErrTierNotFound
+// AddRule creates a new routing rule. The rule ID is generated, and the rate limit defaults to
+// ruleDefaultRateLimit if not set. Filter and template are not validated here.
+func (a *Manager) AddRule(rule *Rule) error {
+	if !AllowedTopicPattern(rule.Topic) || !AllowedTopic(rule.Target) || rule.RateLimit < 0 {
+		return ErrInvalidArgument
 	}
-	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
-		return nil, err
-	} else if err := rows.Err(); err != nil {
-		return nil, err
+	rule.ID = util.RandomStringPrefix(ruleIDPrefix, ruleIDLength)
+	if rule.RateLimit == 0 {
+		rule.RateLimit = ruleDefaultRateLimit
 	}
-	// When changed, note readUser() as well
-	return &Tier{
-		ID:                       id,
-		Code:                     code,
-		Name:                     name,
-		MessageLimit:             messagesLimit.Int64,
-		MessageExpiryDuration:    time.Duration(messagesExpiryDuration.Int64) * time.Second,
-		EmailLimit:               emailsLimit.Int64,
-		CallLimit:                callsLimit.Int64,
-		ReservationLimit:         reservationsLimit.Int64,
-		AttachmentFileSizeLimit:  attachmentFileSizeLimit.Int64,
-		AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
-		AttachmentExpiryDuration: time.Duration(attachmentExpiryDuration.Int64) * time.Second,
-		AttachmentBandwidthLimit: attachmentBandwidthLimit.Int64,
-		StripeMonthlyPriceID:     stripeMonthlyPriceID.String, // May be empty
-		StripeYearlyPriceID:      stripeYearlyPriceID.String,  // May be empty
-	}, nil
+	return a.store.AddRule(rule)
 }
 
-// Close closes the underlying database
-func (a *Manager) Close() error {
-	return a.db.Close()
+// Rules returns all routing rules
+func (a *Manager) Rules() ([]*Rule, error) {
+	return a.store.Rules()
 }
 
-// toSQLWildcard converts a wildcard string to a SQL wildcard string. It only allows '*' as wildcards,
-// and escapes '_', assuming '\' as escape character.
-func toSQLWildcard(s string) string {
-	return escapeUnderscore(strings.ReplaceAll(s, "*", "%"))
+// RulesForTopic returns all routing rules whose topic pattern matches the given topic
+func (a *Manager) RulesForTopic(topic string) ([]*Rule, error) {
+	return a.store.RulesForTopic(topic)
 }
 
-// fromSQLWildcard converts a SQL wildcard string to a wildcard string. It converts '%' to '*',
-// and removes the '\_' escape character.
-func fromSQLWildcard(s string) string {
-	return strings.ReplaceAll(unescapeUnderscore(s), "%", "*")
+// RemoveRule deletes the routing rule with the given ID, or returns ErrRuleNotFound
+func (a *Manager) RemoveRule(id string) error {
+	if id == "" {
+		return ErrInvalidArgument
+	}
+	return a.store.RemoveRule(id)
 }
 
-func escapeUnderscore(s string) string {
-	return strings.ReplaceAll(s, "_", "\\_")
+// AddEscalationPolicy creates a new escalation policy. The policy ID is generated.
+func (a *Manager) AddEscalationPolicy(policy *EscalationPolicy) error {
+	if !AllowedTopicPattern(policy.Topic) || len(policy.Steps) == 0 || len(policy.Steps) > escalationPolicyMaxSteps {
+		return ErrInvalidArgument
+	}
+	for _, step := range policy.Steps {
+		if !AllowedEscalationStep(step) {
+			return ErrInvalidArgument
+		}
+	}
+	policy.ID = util.RandomStringPrefix(escalationPolicyIDPrefix, escalationPolicyIDLength)
+	return a.store.AddEscalationPolicy(policy)
 }
 
-func unescapeUnderscore(s string) string {
-	return strings.ReplaceAll(s, "\\_", "_")
+// EscalationPolicies returns all escalation policies
+func (a *Manager) EscalationPolicies() ([]*EscalationPolicy, error) {
+	return a.store.EscalationPolicies()
 }
 
-func runStartupQueries(db *sql.DB, startupQueries string) error {
-	if _, err := db.Exec(startupQueries); err != nil {
-		return err
-	}
-	if _, err := db.Exec(builtinStartupQueries); err != nil {
-		return err
-	}
-	return nil
+// EscalationPoliciesForTopic returns all escalation policies whose topic pattern matches the given topic
+func (a *Manager) EscalationPoliciesForTopic(topic string) ([]*EscalationPolicy, error) {
+	return a.store.EscalationPoliciesForTopic(topic)
 }
 
-func setupDB(db *sql.DB) error {
-	// If 'schemaVersion' table does not exist, this must be a new database
-	rowsSV, err := db.Query(selectSchemaVersionQuery)
-	if err != nil {
-		return setupNewDB(db)
-	}
-	defer rowsSV.Close()
+// EscalationPolicy returns the escalation policy with the given ID, or ErrEscalationPolicyNotFound
+func (a *Manager) EscalationPolicy(id string) (*EscalationPolicy, error) {
+	return a.store.EscalationPolicy(id)
+}
 
-	// If 'schemaVersion' table exists, read version and potentially upgrade
-	schemaVersion := 0
-	if !rowsSV.Next() {
-		return errors.New("cannot determine schema version: database file may be corrupt")
-	}
-	if err := rowsSV.Scan(&schemaVersion); err != nil {
-		return err
+// RemoveEscalationPolicy deletes the escalation policy with the given ID, or returns ErrEscalationPolicyNotFound
+func (a *Manager) RemoveEscalationPolicy(id string) error {
+	if id == "" {
+		return ErrInvalidArgument
 	}
-	rowsSV.Close()
+	return a.store.RemoveEscalationPolicy(id)
+}
 
-	// Do migrations
-	if schemaVersion == currentSchemaVersion {
-		return nil
-	} else if schemaVersion > currentSchemaVersion {
-		return fmt.Errorf("unexpected schema version: version %d is higher than current version %d", schemaVersion, currentSchemaVersion)
-	}
-	for i := schemaVersion; i < currentSchemaVersion; i++ {
-		fn, ok := migrations[i]
-		if !ok {
-			return fmt.Errorf("cannot find migration step from schema version %d to %d", i, i+1)
-		} else if err := fn(db); err != nil {
-			return err
-		}
-	}
-	return nil
+// DefaultAccess returns the default read/write access if no access control entry matches
+func (a *Manager) DefaultAccess() Permission {
+	return a.defaultAccess
 }
 
-func setupNewDB(db *sql.DB) error {
-	if _, err := db.Exec(createTablesQueries); err != nil {
-		return err
-	}
-	if _, err := db.Exec(insertSchemaVersion, currentSchemaVersion); err != nil {
-		return err
+// AddTier creates a new tier in the database
+func (a *Manager) AddTier(tier *Tier) error {
+	if tier.ID == "" {
+		tier.ID = util.RandomStringPrefix(tierIDPrefix, tierIDLength)
 	}
-	return nil
+	return a.store.AddTier(tier)
 }
 
-func migrateFrom1(db *sql.DB) error {
-	log.Tag(tag).Info("Migrating user database schema: from 1 to 2")
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	// Rename user -> user_old, and create new tables
-	if _, err := tx.Exec(migrate1To2CreateTablesQueries); err != nil {
-		return err
-	}
-	// Insert users from user_old into new user table, with ID and sync_topic
-	rows, err := tx.Query(migrate1To2SelectAllOldUsernamesNoTx)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-	usernames := make([]string, 0)
-	for rows.Next() {
-		var username string
-		if err := rows.Scan(&username); err != nil {
-			return err
-		}
-		usernames = append(usernames, username)
-	}
-	if err := rows.Close(); err != nil {
-		return err
-	}
-	for _, username := range usernames {
-		userID := util.RandomStringPrefix(userIDPrefix, userIDLength)
-		syncTopic := util.RandomStringPrefix(syncTopicPrefix, syncTopicLength)
-		if _, err := tx.Exec(migrate1To2InsertUserNoTx, userID, syncTopic, username); err != nil {
-			return err
-		}
-	}
-	// Migrate old "access" table to "user_access" and drop "access" and "user_old"
-	if _, err := tx.Exec(migrate1To2InsertFromOldTablesAndDropNoTx); err != nil {
-		return err
-	}
-	if _, err := tx.Exec(updateSchemaVersion, 2); err != nil {
-		return err
-	}
-	if err := tx.Commit(); err != nil {
-		return err
-	}
-	return nil
+// UpdateTier updates a tier's properties in the database
+func (a *Manager) UpdateTier(tier *Tier) error {
+	return a.store.UpdateTier(tier)
 }
 
-func migrateFrom2(db *sql.DB) error {
-	log.Tag(tag).Info("Migrating user database schema: from 2 to 3")
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	if _, err := tx.Exec(migrate2To3UpdateQueries); err != nil {
-		return err
-	}
-	if _, err := tx.Exec(updateSchemaVersion, 3); err != nil {
-		return err
+// RemoveTier deletes the tier with the given code
+func (a *Manager) RemoveTier(code string) error {
+	if !AllowedTier(code) {
+		return ErrInvalidArgument
 	}
-	return tx.Commit()
+	// This fails if any user has this tier
+	return a.store.RemoveTier(code)
 }
 
-func migrateFrom3(db *sql.DB) error {
-	log.Tag(tag).Info("Migrating user database schema: from 3 to 4")
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	if _, err := tx.Exec(migrate3To4UpdateQueries); err != nil {
-		return err
-	}
-	if _, err := tx.Exec(updateSchemaVersion, 4); err != nil {
-		return err
-	}
-	return tx.Commit()
+// ChangeBilling updates a user's billing fields, namely the Stripe customer ID, and subscription information
+func (a *Manager) ChangeBilling(username string, billing *Billing) error {
+	return a.store.ChangeBilling(username, billing)
 }
 
-func migrateFrom4(db *sql.DB) error {
-	log.Tag(tag).Info("Migrating user database schema: from 4 to 5")
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	if _, err := tx.Exec(migrate4To5UpdateQueries); err != nil {
-		return err
-	}
-	if _, err := tx.Exec(updateSchemaVersion, 5); err != nil {
-		return err
-	}
-	return tx.Commit()
+// Tiers returns a list of all Tier structs
+func (a *Manager) Tiers() ([]*Tier, error) {
+	return a.store.Tiers()
 }
 
-func nullString(s string) sql.NullString {
-	if s == "" {
-		return sql.NullString{}
-	}
-	return sql.NullString{String: s, Valid: true}
+// Tier returns a Tier based on the code, or ErrTierNotFound if it does not exist
+func (a *Manager) Tier(code string) (*Tier, error) {
+	return a.store.Tier(code)
 }
 
-func nullInt64(v int64) sql.NullInt64 {
-	if v == 0 {
-		return sql.NullInt64{}
-	}
-	return sql.NullInt64{Int64: v, Valid: true}
+// TierByStripePrice returns a Tier based on the Stripe price ID, or ErrTierNotFound if it does not exist
+func (a *Manager) TierByStripePrice(priceID string) (*Tier, error) {
+	return a.store.TierByStripePrice(priceID)
+}
+
+// Close closes the underlying database
+func (a *Manager) Close() error {
+	return a.store.Close()
 }
@@ -2,12 +2,15 @@ package user
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"github.com/stripe/stripe-go/v74"
 	"golang.org/x/crypto/bcrypt"
 	"heckel.io/ntfy/v2/util"
 	"net/netip"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -17,1066 +20,1858 @@ import (
 const minBcryptTimingMillis = int64(50) // Ideally should be >100ms, but this should also run on a Raspberry Pi without massive resources
 
 func TestManager_FullScenario_Default_DenyAll(t *testing.T) {
-	a := newTestManagerFromFile(t, filepath.Join(t.TempDir(), "user.db"), "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
-	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
-	require.Nil(t, a.AddUser("john", "john", RoleUser))
-	require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite))
-	require.Nil(t, a.AllowAccess("ben", "readme", PermissionRead))
-	require.Nil(t, a.AllowAccess("ben", "writeme", PermissionWrite))
-	require.Nil(t, a.AllowAccess("ben", "everyonewrite", PermissionDenyAll)) // How unfair!
-	require.Nil(t, a.AllowAccess("john", "*", PermissionRead))
-	require.Nil(t, a.AllowAccess("john", "mytopic*", PermissionReadWrite))
-	require.Nil(t, a.AllowAccess("john", "mytopic_ro*", PermissionRead))
-	require.Nil(t, a.AllowAccess("john", "mytopic_deny*", PermissionDenyAll))
-	require.Nil(t, a.AllowAccess(Everyone, "announcements", PermissionRead))
-	require.Nil(t, a.AllowAccess(Everyone, "everyonewrite", PermissionReadWrite))
-	require.Nil(t, a.AllowAccess(Everyone, "up*", PermissionWrite)) // Everyone can write to /up*
-
-	phil, err := a.Authenticate("phil", "phil")
-	require.Nil(t, err)
-	require.Equal(t, "phil", phil.Name)
-	require.True(t, strings.HasPrefix(phil.Hash, "$2a$10$"))
-	require.Equal(t, RoleAdmin, phil.Role)
-
-	philGrants, err := a.Grants("phil")
-	require.Nil(t, err)
-	require.Equal(t, []Grant{}, philGrants)
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManagerFromFile(t, filename, "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
+		require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.AddUser("john", "john", RoleUser))
+		require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("ben", "readme", PermissionRead))
+		require.Nil(t, a.AllowAccess("ben", "writeme", PermissionWrite))
+		require.Nil(t, a.AllowAccess("ben", "everyonewrite", PermissionDenyAll)) // How unfair!
+		require.Nil(t, a.AllowAccess("john", "*", PermissionRead))
+		require.Nil(t, a.AllowAccess("john", "mytopic*", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("john", "mytopic_ro*", PermissionRead))
+		require.Nil(t, a.AllowAccess("john", "mytopic_deny*", PermissionDenyAll))
+		require.Nil(t, a.AllowAccess(Everyone, "announcements", PermissionRead))
+		require.Nil(t, a.AllowAccess(Everyone, "everyonewrite", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess(Everyone, "up*", PermissionWrite)) // Everyone can write to /up*
+
+		phil, err := a.Authenticate("phil", "phil")
+		require.Nil(t, err)
+		require.Equal(t, "phil", phil.Name)
+		require.True(t, strings.HasPrefix(phil.Hash, "$2a$10$"))
+		require.Equal(t, RoleAdmin, phil.Role)
 
-	ben, err := a.Authenticate("ben", "ben")
-	require.Nil(t, err)
-	require.Equal(t, "ben", ben.Name)
-	require.True(t, strings.HasPrefix(ben.Hash, "$2a$10$"))
-	require.Equal(t, RoleUser, ben.Role)
+		philGrants, err := a.Grants("phil")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{}, philGrants)
 
-	benGrants, err := a.Grants("ben")
-	require.Nil(t, err)
-	require.Equal(t, []Grant{
-		{"everyonewrite", PermissionDenyAll},
-		{"mytopic", PermissionReadWrite},
-		{"writeme", PermissionWrite},
-		{"readme", PermissionRead},
-	}, benGrants)
-
-	john, err := a.Authenticate("john", "john")
-	require.Nil(t, err)
-	require.Equal(t, "john", john.Name)
-	require.True(t, strings.HasPrefix(john.Hash, "$2a$10$"))
-	require.Equal(t, RoleUser, john.Role)
+		ben, err := a.Authenticate("ben", "ben")
+		require.Nil(t, err)
+		require.Equal(t, "ben", ben.Name)
+		require.True(t, strings.HasPrefix(ben.Hash, "$2a$10$"))
+		require.Equal(t, RoleUser, ben.Role)
 
-	johnGrants, err := a.Grants("john")
-	require.Nil(t, err)
-	require.Equal(t, []Grant{
-		{"mytopic_deny*", PermissionDenyAll},
-		{"mytopic_ro*", PermissionRead},
-		{"mytopic*", PermissionReadWrite},
-		{"*", PermissionRead},
-	}, johnGrants)
-
-	notben, err := a.Authenticate("ben", "this is wrong")
-	require.Nil(t, notben)
-	require.Equal(t, ErrUnauthenticated, err)
+		benGrants, err := a.Grants("ben")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{
+			{"everyonewrite", PermissionDenyAll},
+			{"mytopic", PermissionReadWrite},
+			{"writeme", PermissionWrite},
+			{"readme", PermissionRead},
+		}, benGrants)
+
+		john, err := a.Authenticate("john", "john")
+		require.Nil(t, err)
+		require.Equal(t, "john", john.Name)
+		require.True(t, strings.HasPrefix(john.Hash, "$2a$10$"))
+		require.Equal(t, RoleUser, john.Role)
 
-	// Admin can do everything
-	require.Nil(t, a.Authorize(phil, "sometopic", PermissionWrite))
-	require.Nil(t, a.Authorize(phil, "mytopic", PermissionRead))
-	require.Nil(t, a.Authorize(phil, "readme", PermissionWrite))
-	require.Nil(t, a.Authorize(phil, "writeme", PermissionWrite))
-	require.Nil(t, a.Authorize(phil, "announcements", PermissionWrite))
-	require.Nil(t, a.Authorize(phil, "everyonewrite", PermissionWrite))
-
-	// User cannot do everything
-	require.Nil(t, a.Authorize(ben, "mytopic", PermissionWrite))
-	require.Nil(t, a.Authorize(ben, "mytopic", PermissionRead))
-	require.Nil(t, a.Authorize(ben, "readme", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "readme", PermissionWrite))
-	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "writeme", PermissionRead))
-	require.Nil(t, a.Authorize(ben, "writeme", PermissionWrite))
-	require.Nil(t, a.Authorize(ben, "writeme", PermissionWrite))
-	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "everyonewrite", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "everyonewrite", PermissionWrite))
-	require.Nil(t, a.Authorize(ben, "announcements", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "announcements", PermissionWrite))
-
-	// User john should have
-	//  "deny" to mytopic_deny*,
-	//    "ro" to mytopic_ro*,
-	//    "rw" to mytopic*,
-	//    "ro" to the rest
-	require.Equal(t, ErrUnauthorized, a.Authorize(john, "mytopic_deny_case", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(john, "mytopic_deny_case", PermissionWrite))
-	require.Nil(t, a.Authorize(john, "mytopic_ro_test_case", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(john, "mytopic_ro_test_case", PermissionWrite))
-	require.Nil(t, a.Authorize(john, "mytopic_case1", PermissionRead))
-	require.Nil(t, a.Authorize(john, "mytopic_case1", PermissionWrite))
-	require.Nil(t, a.Authorize(john, "readme", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(john, "writeme", PermissionWrite))
-
-	// Everyone else can do barely anything
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "sometopicnotinthelist", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "sometopicnotinthelist", PermissionWrite))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "mytopic", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "mytopic", PermissionWrite))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "readme", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "readme", PermissionWrite))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "writeme", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "writeme", PermissionWrite))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "announcements", PermissionWrite))
-	require.Nil(t, a.Authorize(nil, "announcements", PermissionRead))
-	require.Nil(t, a.Authorize(nil, "everyonewrite", PermissionRead))
-	require.Nil(t, a.Authorize(nil, "everyonewrite", PermissionWrite))
-	require.Nil(t, a.Authorize(nil, "up1234", PermissionWrite)) // Wildcard permission
-	require.Nil(t, a.Authorize(nil, "up5678", PermissionWrite))
+		johnGrants, err := a.Grants("john")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{
+			{"mytopic_deny*", PermissionDenyAll},
+			{"mytopic_ro*", PermissionRead},
+			{"mytopic*", PermissionReadWrite},
+			{"*", PermissionRead},
+		}, johnGrants)
+
+		notben, err := a.Authenticate("ben", "this is wrong")
+		require.Nil(t, notben)
+		require.Equal(t, ErrUnauthenticated, err)
+
+		// Admin can do everything
+		require.Nil(t, a.Authorize(phil, "sometopic", PermissionWrite))
+		require.Nil(t, a.Authorize(phil, "mytopic", PermissionRead))
+		require.Nil(t, a.Authorize(phil, "readme", PermissionWrite))
+		require.Nil(t, a.Authorize(phil, "writeme", PermissionWrite))
+		require.Nil(t, a.Authorize(phil, "announcements", PermissionWrite))
+		require.Nil(t, a.Authorize(phil, "everyonewrite", PermissionWrite))
+
+		// User cannot do everything
+		require.Nil(t, a.Authorize(ben, "mytopic", PermissionWrite))
+		require.Nil(t, a.Authorize(ben, "mytopic", PermissionRead))
+		require.Nil(t, a.Authorize(ben, "readme", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "readme", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "writeme", PermissionRead))
+		require.Nil(t, a.Authorize(ben, "writeme", PermissionWrite))
+		require.Nil(t, a.Authorize(ben, "writeme", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "everyonewrite", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "everyonewrite", PermissionWrite))
+		require.Nil(t, a.Authorize(ben, "announcements", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "announcements", PermissionWrite))
+
+		// User john should have
+		//  "deny" to mytopic_deny*,
+		//    "ro" to mytopic_ro*,
+		//    "rw" to mytopic*,
+		//    "ro" to the rest
+		require.Equal(t, ErrUnauthorized, a.Authorize(john, "mytopic_deny_case", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(john, "mytopic_deny_case", PermissionWrite))
+		require.Nil(t, a.Authorize(john, "mytopic_ro_test_case", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(john, "mytopic_ro_test_case", PermissionWrite))
+		require.Nil(t, a.Authorize(john, "mytopic_case1", PermissionRead))
+		require.Nil(t, a.Authorize(john, "mytopic_case1", PermissionWrite))
+		require.Nil(t, a.Authorize(john, "readme", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(john, "writeme", PermissionWrite))
+
+		// Everyone else can do barely anything
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "sometopicnotinthelist", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "sometopicnotinthelist", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "mytopic", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "mytopic", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "readme", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "readme", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "writeme", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "writeme", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "announcements", PermissionWrite))
+		require.Nil(t, a.Authorize(nil, "announcements", PermissionRead))
+		require.Nil(t, a.Authorize(nil, "everyonewrite", PermissionRead))
+		require.Nil(t, a.Authorize(nil, "everyonewrite", PermissionWrite))
+		require.Nil(t, a.Authorize(nil, "up1234", PermissionWrite)) // Wildcard permission
+		require.Nil(t, a.Authorize(nil, "up5678", PermissionWrite))
+	})
 }
 
 func TestManager_Access_Order_LengthWriteRead(t *testing.T) {
-	// This test validates issue #914 / #917, i.e. that write permissions are prioritized over read permissions,
-	// and longer ACL rules are prioritized as well.
+	forEachBackend(t, func(t *testing.T, filename string) {
+		// This test validates issue #914 / #917, i.e. that write permissions are prioritized over read permissions,
+		// and longer ACL rules are prioritized as well.
 
-	a := newTestManagerFromFile(t, filepath.Join(t.TempDir(), "user.db"), "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
-	require.Nil(t, a.AllowAccess("ben", "test*", PermissionReadWrite))
-	require.Nil(t, a.AllowAccess("ben", "*", PermissionRead))
+		a := newTestManagerFromFile(t, filename, "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.AllowAccess("ben", "test*", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("ben", "*", PermissionRead))
 
-	ben, err := a.Authenticate("ben", "ben")
-	require.Nil(t, err)
-	require.Nil(t, a.Authorize(ben, "any-topic-can-be-read", PermissionRead))
-	require.Nil(t, a.Authorize(ben, "this-too", PermissionRead))
-	require.Nil(t, a.Authorize(ben, "test123", PermissionWrite))
+		ben, err := a.Authenticate("ben", "ben")
+		require.Nil(t, err)
+		require.Nil(t, a.Authorize(ben, "any-topic-can-be-read", PermissionRead))
+		require.Nil(t, a.Authorize(ben, "this-too", PermissionRead))
+		require.Nil(t, a.Authorize(ben, "test123", PermissionWrite))
+	})
 }
 
 func TestManager_AddUser_Invalid(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Equal(t, ErrInvalidArgument, a.AddUser("  invalid  ", "pass", RoleAdmin))
-	require.Equal(t, ErrInvalidArgument, a.AddUser("validuser", "pass", "invalid-role"))
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Equal(t, ErrInvalidArgument, a.AddUser("  invalid  ", "pass", RoleAdmin))
+		require.Equal(t, ErrInvalidArgument, a.AddUser("validuser", "pass", "invalid-role"))
+	})
+}
+
+func TestManager_AddProviderUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("phil", "pass", RoleAdmin))
+		require.Nil(t, a.AddProviderUser("ben", "pass", RoleUser, ProviderOIDC, "https://idp.example.com|1234"))
+
+		ben, err := a.UserByProviderID(ProviderOIDC, "https://idp.example.com|1234")
+		require.Nil(t, err)
+		require.Equal(t, "ben", ben.Name)
+		require.Equal(t, ProviderOIDC, ben.Provider)
+		require.Equal(t, "https://idp.example.com|1234", ben.ProviderID)
+
+		// Neither the username nor the provider ID can be taken twice
+		require.Equal(t, ErrUserExists, a.AddProviderUser("phil", "pass", RoleUser, ProviderOIDC, "https://idp.example.com|5678"))
+		require.Equal(t, ErrUserExists, a.AddProviderUser("ben2", "pass", RoleUser, ProviderOIDC, "https://idp.example.com|1234"))
+		require.Equal(t, ErrInvalidArgument, a.AddProviderUser("ben3", "pass", RoleUser, ProviderOIDC, ""))
+
+		_, err = a.UserByProviderID(ProviderOIDC, "https://idp.example.com|5678")
+		require.Equal(t, ErrUserNotFound, err)
+		_, err = a.UserByProviderID(ProviderLDAP, "https://idp.example.com|1234")
+		require.Equal(t, ErrUserNotFound, err)
+		phil, err := a.User("phil")
+		require.Nil(t, err)
+		require.Equal(t, ProviderLocal, phil.Provider)
+		require.Equal(t, "", phil.ProviderID)
+	})
 }
 
 func TestManager_AddUser_Timing(t *testing.T) {
-	a := newTestManagerFromFile(t, filepath.Join(t.TempDir(), "user.db"), "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
-	start := time.Now().UnixMilli()
-	require.Nil(t, a.AddUser("user", "pass", RoleAdmin))
-	require.GreaterOrEqual(t, time.Now().UnixMilli()-start, minBcryptTimingMillis)
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManagerFromFile(t, filename, "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
+		start := time.Now().UnixMilli()
+		require.Nil(t, a.AddUser("user", "pass", RoleAdmin))
+		require.GreaterOrEqual(t, time.Now().UnixMilli()-start, minBcryptTimingMillis)
+	})
 }
 
 func TestManager_AddUser_And_Query(t *testing.T) {
-	a := newTestManagerFromFile(t, filepath.Join(t.TempDir(), "user.db"), "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
-	require.Nil(t, a.AddUser("user", "pass", RoleAdmin))
-	require.Nil(t, a.ChangeBilling("user", &Billing{
-		StripeCustomerID:            "acct_123",
-		StripeSubscriptionID:        "sub_123",
-		StripeSubscriptionStatus:    stripe.SubscriptionStatusActive,
-		StripeSubscriptionInterval:  stripe.PriceRecurringIntervalMonth,
-		StripeSubscriptionPaidUntil: time.Now().Add(time.Hour),
-		StripeSubscriptionCancelAt:  time.Unix(0, 0),
-	}))
-
-	u, err := a.User("user")
-	require.Nil(t, err)
-	require.Equal(t, "user", u.Name)
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManagerFromFile(t, filename, "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
+		require.Nil(t, a.AddUser("user", "pass", RoleAdmin))
+		require.Nil(t, a.ChangeBilling("user", &Billing{
+			StripeCustomerID:            "acct_123",
+			StripeSubscriptionID:        "sub_123",
+			StripeSubscriptionStatus:    stripe.SubscriptionStatusActive,
+			StripeSubscriptionInterval:  stripe.PriceRecurringIntervalMonth,
+			StripeSubscriptionPaidUntil: time.Now().Add(time.Hour),
+			StripeSubscriptionCancelAt:  time.Unix(0, 0),
+		}))
+
+		u, err := a.User("user")
+		require.Nil(t, err)
+		require.Equal(t, "user", u.Name)
 
-	u2, err := a.UserByID(u.ID)
-	require.Nil(t, err)
-	require.Equal(t, u.Name, u2.Name)
+		u2, err := a.UserByID(u.ID)
+		require.Nil(t, err)
+		require.Equal(t, u.Name, u2.Name)
 
-	u3, err := a.UserByStripeCustomer("acct_123")
-	require.Nil(t, err)
-	require.Equal(t, u.ID, u3.ID)
+		u3, err := a.UserByStripeCustomer("acct_123")
+		require.Nil(t, err)
+		require.Equal(t, u.ID, u3.ID)
+	})
 }
 
 func TestManager_MarkUserRemoved_RemoveDeletedUsers(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
 
-	// Create user, add reservations and token
-	require.Nil(t, a.AddUser("user", "pass", RoleAdmin))
-	require.Nil(t, a.AddReservation("user", "mytopic", PermissionRead))
+		// Create user, add reservations and token
+		require.Nil(t, a.AddUser("user", "pass", RoleAdmin))
+		require.Nil(t, a.AddReservation("user", "mytopic", PermissionRead))
 
-	u, err := a.User("user")
-	require.Nil(t, err)
-	require.False(t, u.Deleted)
+		u, err := a.User("user")
+		require.Nil(t, err)
+		require.False(t, u.Deleted)
 
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
-	require.Nil(t, err)
+		token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
+		require.Nil(t, err)
 
-	u, err = a.Authenticate("user", "pass")
-	require.Nil(t, err)
+		u, err = a.Authenticate("user", "pass")
+		require.Nil(t, err)
 
-	_, err = a.AuthenticateToken(token.Value)
-	require.Nil(t, err)
+		_, err = a.AuthenticateToken(token.Value)
+		require.Nil(t, err)
 
-	reservations, err := a.Reservations("user")
-	require.Nil(t, err)
-	require.Equal(t, 1, len(reservations))
+		reservations, err := a.Reservations("user")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(reservations))
 
-	// Mark deleted: cannot auth anymore, and all reservations are gone
-	require.Nil(t, a.MarkUserRemoved(u))
+		// Mark deleted: cannot auth anymore, and all reservations are gone
+		require.Nil(t, a.MarkUserRemoved(u))
 
-	_, err = a.Authenticate("user", "pass")
-	require.Equal(t, ErrUnauthenticated, err)
+		_, err = a.Authenticate("user", "pass")
+		require.Equal(t, ErrUnauthenticated, err)
 
-	_, err = a.AuthenticateToken(token.Value)
-	require.Equal(t, ErrUnauthenticated, err)
+		_, err = a.AuthenticateToken(token.Value)
+		require.Equal(t, ErrUnauthenticated, err)
 
-	reservations, err = a.Reservations("user")
-	require.Nil(t, err)
-	require.Equal(t, 0, len(reservations))
+		reservations, err = a.Reservations("user")
+		require.Nil(t, err)
+		require.Equal(t, 0, len(reservations))
 
-	// Make sure user is still there
-	u, err = a.User("user")
-	require.Nil(t, err)
-	require.True(t, u.Deleted)
+		// Make sure user is still there
+		u, err = a.User("user")
+		require.Nil(t, err)
+		require.True(t, u.Deleted)
 
-	_, err = a.db.Exec("UPDATE user SET deleted = ? WHERE id = ?", time.Now().Add(-1*(userHardDeleteAfterDuration+time.Hour)).Unix(), u.ID)
-	require.Nil(t, err)
-	require.Nil(t, a.RemoveDeletedUsers())
+		_, err = testDB(a).Exec(`UPDATE "user" SET deleted = ? WHERE id = ?`, time.Now().Add(-1*(userHardDeleteAfterDuration+time.Hour)).Unix(), u.ID)
+		require.Nil(t, err)
+		require.Nil(t, a.RemoveDeletedUsers())
 
-	_, err = a.User("user")
-	require.Equal(t, ErrUserNotFound, err)
+		_, err = a.User("user")
+		require.Equal(t, ErrUserNotFound, err)
+	})
 }
 
 func TestManager_CreateToken_Only_Lower(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
 
-	// Create user, add reservations and token
-	require.Nil(t, a.AddUser("user", "pass", RoleAdmin))
-	u, err := a.User("user")
-	require.Nil(t, err)
+		// Create user, add reservations and token
+		require.Nil(t, a.AddUser("user", "pass", RoleAdmin))
+		u, err := a.User("user")
+		require.Nil(t, err)
 
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
-	require.Nil(t, err)
-	require.Equal(t, token.Value, strings.ToLower(token.Value))
+		token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
+		require.Nil(t, err)
+		require.Equal(t, token.Value, strings.ToLower(token.Value))
+	})
 }
 
 func TestManager_UserManagement(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
-	require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite))
-	require.Nil(t, a.AllowAccess("ben", "readme", PermissionRead))
-	require.Nil(t, a.AllowAccess("ben", "writeme", PermissionWrite))
-	require.Nil(t, a.AllowAccess("ben", "everyonewrite", PermissionDenyAll)) // How unfair!
-	require.Nil(t, a.AllowAccess(Everyone, "announcements", PermissionRead))
-	require.Nil(t, a.AllowAccess(Everyone, "everyonewrite", PermissionReadWrite))
-
-	// Query user details
-	phil, err := a.User("phil")
-	require.Nil(t, err)
-	require.Equal(t, "phil", phil.Name)
-	require.True(t, strings.HasPrefix(phil.Hash, "$2a$04$")) // Min cost for testing
-	require.Equal(t, RoleAdmin, phil.Role)
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("ben", "readme", PermissionRead))
+		require.Nil(t, a.AllowAccess("ben", "writeme", PermissionWrite))
+		require.Nil(t, a.AllowAccess("ben", "everyonewrite", PermissionDenyAll)) // How unfair!
+		require.Nil(t, a.AllowAccess(Everyone, "announcements", PermissionRead))
+		require.Nil(t, a.AllowAccess(Everyone, "everyonewrite", PermissionReadWrite))
+
+		// Query user details
+		phil, err := a.User("phil")
+		require.Nil(t, err)
+		require.Equal(t, "phil", phil.Name)
+		require.True(t, strings.HasPrefix(phil.Hash, "$2a$04$")) // Min cost for testing
+		require.Equal(t, RoleAdmin, phil.Role)
 
-	philGrants, err := a.Grants("phil")
-	require.Nil(t, err)
-	require.Equal(t, []Grant{}, philGrants)
+		philGrants, err := a.Grants("phil")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{}, philGrants)
 
-	ben, err := a.User("ben")
-	require.Nil(t, err)
-	require.Equal(t, "ben", ben.Name)
-	require.True(t, strings.HasPrefix(ben.Hash, "$2a$04$")) // Min cost for testing
-	require.Equal(t, RoleUser, ben.Role)
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, "ben", ben.Name)
+		require.True(t, strings.HasPrefix(ben.Hash, "$2a$04$")) // Min cost for testing
+		require.Equal(t, RoleUser, ben.Role)
 
-	benGrants, err := a.Grants("ben")
-	require.Nil(t, err)
-	require.Equal(t, []Grant{
-		{"everyonewrite", PermissionDenyAll},
-		{"mytopic", PermissionReadWrite},
-		{"writeme", PermissionWrite},
-		{"readme", PermissionRead},
-	}, benGrants)
-
-	everyone, err := a.User(Everyone)
-	require.Nil(t, err)
-	require.Equal(t, "*", everyone.Name)
-	require.Equal(t, "", everyone.Hash)
-	require.Equal(t, RoleAnonymous, everyone.Role)
+		benGrants, err := a.Grants("ben")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{
+			{"everyonewrite", PermissionDenyAll},
+			{"mytopic", PermissionReadWrite},
+			{"writeme", PermissionWrite},
+			{"readme", PermissionRead},
+		}, benGrants)
+
+		everyone, err := a.User(Everyone)
+		require.Nil(t, err)
+		require.Equal(t, "*", everyone.Name)
+		require.Equal(t, "", everyone.Hash)
+		require.Equal(t, RoleAnonymous, everyone.Role)
 
-	everyoneGrants, err := a.Grants(Everyone)
-	require.Nil(t, err)
-	require.Equal(t, []Grant{
-		{"everyonewrite", PermissionReadWrite},
-		{"announcements", PermissionRead},
-	}, everyoneGrants)
-
-	// Ben: Before revoking
-	require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite)) // Overwrite!
-	require.Nil(t, a.AllowAccess("ben", "readme", PermissionRead))
-	require.Nil(t, a.AllowAccess("ben", "writeme", PermissionWrite))
-	require.Nil(t, a.Authorize(ben, "mytopic", PermissionRead))
-	require.Nil(t, a.Authorize(ben, "mytopic", PermissionWrite))
-	require.Nil(t, a.Authorize(ben, "readme", PermissionRead))
-	require.Nil(t, a.Authorize(ben, "writeme", PermissionWrite))
-
-	// Revoke access for "ben" to "mytopic", then check again
-	require.Nil(t, a.ResetAccess("ben", "mytopic"))
-	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionWrite)) // Revoked
-	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionRead))  // Revoked
-	require.Nil(t, a.Authorize(ben, "readme", PermissionRead))                      // Unchanged
-	require.Nil(t, a.Authorize(ben, "writeme", PermissionWrite))                    // Unchanged
-
-	// Revoke rest of the access
-	require.Nil(t, a.ResetAccess("ben", ""))
-	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "readme", PermissionRead))    // Revoked
-	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "wrtiteme", PermissionWrite)) // Revoked
-
-	// User list
-	users, err := a.Users()
-	require.Nil(t, err)
-	require.Equal(t, 3, len(users))
-	require.Equal(t, "phil", users[0].Name)
-	require.Equal(t, "ben", users[1].Name)
-	require.Equal(t, "*", users[2].Name)
+		everyoneGrants, err := a.Grants(Everyone)
+		require.Nil(t, err)
+		require.Equal(t, []Grant{
+			{"everyonewrite", PermissionReadWrite},
+			{"announcements", PermissionRead},
+		}, everyoneGrants)
+
+		// Ben: Before revoking
+		require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite)) // Overwrite!
+		require.Nil(t, a.AllowAccess("ben", "readme", PermissionRead))
+		require.Nil(t, a.AllowAccess("ben", "writeme", PermissionWrite))
+		require.Nil(t, a.Authorize(ben, "mytopic", PermissionRead))
+		require.Nil(t, a.Authorize(ben, "mytopic", PermissionWrite))
+		require.Nil(t, a.Authorize(ben, "readme", PermissionRead))
+		require.Nil(t, a.Authorize(ben, "writeme", PermissionWrite))
+
+		// Revoke access for "ben" to "mytopic", then check again
+		require.Nil(t, a.ResetAccess("ben", "mytopic"))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionWrite)) // Revoked
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionRead))  // Revoked
+		require.Nil(t, a.Authorize(ben, "readme", PermissionRead))                      // Unchanged
+		require.Nil(t, a.Authorize(ben, "writeme", PermissionWrite))                    // Unchanged
+
+		// Revoke rest of the access
+		require.Nil(t, a.ResetAccess("ben", ""))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "readme", PermissionRead))    // Revoked
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "wrtiteme", PermissionWrite)) // Revoked
+
+		// User list
+		users, err := a.Users()
+		require.Nil(t, err)
+		require.Equal(t, 3, len(users))
+		require.Equal(t, "phil", users[0].Name)
+		require.Equal(t, "ben", users[1].Name)
+		require.Equal(t, "*", users[2].Name)
 
-	// Remove user
-	require.Nil(t, a.RemoveUser("ben"))
-	_, err = a.User("ben")
-	require.Equal(t, ErrUserNotFound, err)
+		// Remove user
+		require.Nil(t, a.RemoveUser("ben"))
+		_, err = a.User("ben")
+		require.Equal(t, ErrUserNotFound, err)
 
-	users, err = a.Users()
-	require.Nil(t, err)
-	require.Equal(t, 2, len(users))
-	require.Equal(t, "phil", users[0].Name)
-	require.Equal(t, "*", users[1].Name)
+		users, err = a.Users()
+		require.Nil(t, err)
+		require.Equal(t, 2, len(users))
+		require.Equal(t, "phil", users[0].Name)
+		require.Equal(t, "*", users[1].Name)
+	})
 }
 
 func TestManager_ChangePassword(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
 
-	_, err := a.Authenticate("phil", "phil")
-	require.Nil(t, err)
+		_, err := a.Authenticate("phil", "phil")
+		require.Nil(t, err)
 
-	require.Nil(t, a.ChangePassword("phil", "newpass"))
-	_, err = a.Authenticate("phil", "phil")
-	require.Equal(t, ErrUnauthenticated, err)
-	_, err = a.Authenticate("phil", "newpass")
-	require.Nil(t, err)
+		require.Nil(t, a.ChangePassword("phil", "newpass"))
+		_, err = a.Authenticate("phil", "phil")
+		require.Equal(t, ErrUnauthenticated, err)
+		_, err = a.Authenticate("phil", "newpass")
+		require.Nil(t, err)
+	})
 }
 
 func TestManager_ChangeRole(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
-	require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite))
-	require.Nil(t, a.AllowAccess("ben", "readme", PermissionRead))
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("ben", "readme", PermissionRead))
 
-	ben, err := a.User("ben")
-	require.Nil(t, err)
-	require.Equal(t, RoleUser, ben.Role)
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, RoleUser, ben.Role)
 
-	benGrants, err := a.Grants("ben")
-	require.Nil(t, err)
-	require.Equal(t, 2, len(benGrants))
+		benGrants, err := a.Grants("ben")
+		require.Nil(t, err)
+		require.Equal(t, 2, len(benGrants))
 
-	require.Nil(t, a.ChangeRole("ben", RoleAdmin))
+		require.Nil(t, a.ChangeRole("ben", RoleAdmin))
 
-	ben, err = a.User("ben")
-	require.Nil(t, err)
-	require.Equal(t, RoleAdmin, ben.Role)
+		ben, err = a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, RoleAdmin, ben.Role)
 
-	benGrants, err = a.Grants("ben")
-	require.Nil(t, err)
-	require.Equal(t, 0, len(benGrants))
+		benGrants, err = a.Grants("ben")
+		require.Nil(t, err)
+		require.Equal(t, 0, len(benGrants))
+	})
 }
 
 func TestManager_Reservations(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
-	require.Nil(t, a.AddReservation("ben", "ztopic_", PermissionDenyAll))
-	require.Nil(t, a.AddReservation("ben", "readme", PermissionRead))
-	require.Nil(t, a.AllowAccess("ben", "something-else", PermissionRead))
-
-	reservations, err := a.Reservations("ben")
-	require.Nil(t, err)
-	require.Equal(t, 2, len(reservations))
-	require.Equal(t, Reservation{
-		Topic:    "readme",
-		Owner:    PermissionReadWrite,
-		Everyone: PermissionRead,
-	}, reservations[0])
-	require.Equal(t, Reservation{
-		Topic:    "ztopic_",
-		Owner:    PermissionReadWrite,
-		Everyone: PermissionDenyAll,
-	}, reservations[1])
-
-	b, err := a.HasReservation("ben", "readme")
-	require.Nil(t, err)
-	require.True(t, b)
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.AddReservation("ben", "ztopic_", PermissionDenyAll))
+		require.Nil(t, a.AddReservation("ben", "readme", PermissionRead))
+		require.Nil(t, a.AllowAccess("ben", "something-else", PermissionRead))
+
+		reservations, err := a.Reservations("ben")
+		require.Nil(t, err)
+		require.Equal(t, 2, len(reservations))
+		require.Equal(t, Reservation{
+			Topic:    "readme",
+			Owner:    PermissionReadWrite,
+			Everyone: PermissionRead,
+		}, reservations[0])
+		require.Equal(t, Reservation{
+			Topic:    "ztopic_",
+			Owner:    PermissionReadWrite,
+			Everyone: PermissionDenyAll,
+		}, reservations[1])
+
+		b, err := a.HasReservation("ben", "readme")
+		require.Nil(t, err)
+		require.True(t, b)
 
-	b, err = a.HasReservation("ben", "ztopic_")
-	require.Nil(t, err)
-	require.True(t, b)
+		b, err = a.HasReservation("ben", "ztopic_")
+		require.Nil(t, err)
+		require.True(t, b)
 
-	b, err = a.HasReservation("ben", "ztopicX") // _ != X (used to be a SQL wildcard issue)
-	require.Nil(t, err)
-	require.False(t, b)
+		b, err = a.HasReservation("ben", "ztopicX") // _ != X (used to be a SQL wildcard issue)
+		require.Nil(t, err)
+		require.False(t, b)
 
-	b, err = a.HasReservation("notben", "readme")
-	require.Nil(t, err)
-	require.False(t, b)
+		b, err = a.HasReservation("notben", "readme")
+		require.Nil(t, err)
+		require.False(t, b)
 
-	b, err = a.HasReservation("ben", "something-else")
-	require.Nil(t, err)
-	require.False(t, b)
+		b, err = a.HasReservation("ben", "something-else")
+		require.Nil(t, err)
+		require.False(t, b)
 
-	count, err := a.ReservationsCount("ben")
-	require.Nil(t, err)
-	require.Equal(t, int64(2), count)
+		count, err := a.ReservationsCount("ben")
+		require.Nil(t, err)
+		require.Equal(t, int64(2), count)
 
-	count, err = a.ReservationsCount("phil")
-	require.Nil(t, err)
-	require.Equal(t, int64(0), count)
+		count, err = a.ReservationsCount("phil")
+		require.Nil(t, err)
+		require.Equal(t, int64(0), count)
 
-	err = a.AllowReservation("phil", "readme")
-	require.Equal(t, errTopicOwnedByOthers, err)
+		err = a.AllowReservation("phil", "readme")
+		require.Equal(t, errTopicOwnedByOthers, err)
 
-	err = a.AllowReservation("phil", "ztopic_")
-	require.Equal(t, errTopicOwnedByOthers, err)
+		err = a.AllowReservation("phil", "ztopic_")
+		require.Equal(t, errTopicOwnedByOthers, err)
 
-	err = a.AllowReservation("phil", "ztopicX")
-	require.Nil(t, err)
+		err = a.AllowReservation("phil", "ztopicX")
+		require.Nil(t, err)
 
-	err = a.AllowReservation("phil", "not-reserved")
-	require.Nil(t, err)
+		err = a.AllowReservation("phil", "not-reserved")
+		require.Nil(t, err)
 
-	// Now remove them again
-	require.Nil(t, a.RemoveReservations("ben", "ztopic_", "readme"))
+		// Now remove them again
+		require.Nil(t, a.RemoveReservations("ben", "ztopic_", "readme"))
 
-	count, err = a.ReservationsCount("ben")
-	require.Nil(t, err)
-	require.Equal(t, int64(0), count)
+		count, err = a.ReservationsCount("ben")
+		require.Nil(t, err)
+		require.Equal(t, int64(0), count)
+	})
 }
 
 func TestManager_ChangeRoleFromTierUserToAdmin(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddTier(&Tier{
-		Code:                     "pro",
-		Name:                     "ntfy Pro",
-		StripeMonthlyPriceID:     "price123",
-		MessageLimit:             5_000,
-		MessageExpiryDuration:    3 * 24 * time.Hour,
-		EmailLimit:               50,
-		ReservationLimit:         5,
-		AttachmentFileSizeLimit:  52428800,
-		AttachmentTotalSizeLimit: 524288000,
-		AttachmentExpiryDuration: 24 * time.Hour,
-	}))
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
-	require.Nil(t, a.ChangeTier("ben", "pro"))
-	require.Nil(t, a.AddReservation("ben", "mytopic", PermissionDenyAll))
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddTier(&Tier{
+			Code:                     "pro",
+			Name:                     "ntfy Pro",
+			StripeMonthlyPriceID:     "price123",
+			MessageLimit:             5_000,
+			MessageExpiryDuration:    3 * 24 * time.Hour,
+			EmailLimit:               50,
+			ReservationLimit:         5,
+			AttachmentFileSizeLimit:  52428800,
+			AttachmentTotalSizeLimit: 524288000,
+			AttachmentExpiryDuration: 24 * time.Hour,
+		}))
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.ChangeTier("ben", "pro"))
+		require.Nil(t, a.AddReservation("ben", "mytopic", PermissionDenyAll))
+
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, RoleUser, ben.Role)
+		require.Equal(t, "pro", ben.Tier.Code)
+		require.Equal(t, int64(5000), ben.Tier.MessageLimit)
+		require.Equal(t, 3*24*time.Hour, ben.Tier.MessageExpiryDuration)
+		require.Equal(t, int64(50), ben.Tier.EmailLimit)
+		require.Equal(t, int64(5), ben.Tier.ReservationLimit)
+		require.Equal(t, int64(52428800), ben.Tier.AttachmentFileSizeLimit)
+		require.Equal(t, int64(524288000), ben.Tier.AttachmentTotalSizeLimit)
+		require.Equal(t, 24*time.Hour, ben.Tier.AttachmentExpiryDuration)
+
+		benGrants, err := a.Grants("ben")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(benGrants))
+		require.Equal(t, PermissionReadWrite, benGrants[0].Allow)
 
-	ben, err := a.User("ben")
-	require.Nil(t, err)
-	require.Equal(t, RoleUser, ben.Role)
-	require.Equal(t, "pro", ben.Tier.Code)
-	require.Equal(t, int64(5000), ben.Tier.MessageLimit)
-	require.Equal(t, 3*24*time.Hour, ben.Tier.MessageExpiryDuration)
-	require.Equal(t, int64(50), ben.Tier.EmailLimit)
-	require.Equal(t, int64(5), ben.Tier.ReservationLimit)
-	require.Equal(t, int64(52428800), ben.Tier.AttachmentFileSizeLimit)
-	require.Equal(t, int64(524288000), ben.Tier.AttachmentTotalSizeLimit)
-	require.Equal(t, 24*time.Hour, ben.Tier.AttachmentExpiryDuration)
+		everyoneGrants, err := a.Grants(Everyone)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(everyoneGrants))
+		require.Equal(t, PermissionDenyAll, everyoneGrants[0].Allow)
 
-	benGrants, err := a.Grants("ben")
-	require.Nil(t, err)
-	require.Equal(t, 1, len(benGrants))
-	require.Equal(t, PermissionReadWrite, benGrants[0].Allow)
+		benReservations, err := a.Reservations("ben")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(benReservations))
+		require.Equal(t, "mytopic", benReservations[0].Topic)
+		require.Equal(t, PermissionReadWrite, benReservations[0].Owner)
+		require.Equal(t, PermissionDenyAll, benReservations[0].Everyone)
 
-	everyoneGrants, err := a.Grants(Everyone)
-	require.Nil(t, err)
-	require.Equal(t, 1, len(everyoneGrants))
-	require.Equal(t, PermissionDenyAll, everyoneGrants[0].Allow)
+		// Switch to admin, this should remove all grants and owned ACL entries
+		require.Nil(t, a.ChangeRole("ben", RoleAdmin))
 
-	benReservations, err := a.Reservations("ben")
-	require.Nil(t, err)
-	require.Equal(t, 1, len(benReservations))
-	require.Equal(t, "mytopic", benReservations[0].Topic)
-	require.Equal(t, PermissionReadWrite, benReservations[0].Owner)
-	require.Equal(t, PermissionDenyAll, benReservations[0].Everyone)
+		benGrants, err = a.Grants("ben")
+		require.Nil(t, err)
+		require.Equal(t, 0, len(benGrants))
 
-	// Switch to admin, this should remove all grants and owned ACL entries
-	require.Nil(t, a.ChangeRole("ben", RoleAdmin))
+		everyoneGrants, err = a.Grants(Everyone)
+		require.Nil(t, err)
+		require.Equal(t, 0, len(everyoneGrants))
+	})
+}
 
-	benGrants, err = a.Grants("ben")
-	require.Nil(t, err)
-	require.Equal(t, 0, len(benGrants))
+func TestManager_Token_Valid(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
 
-	everyoneGrants, err = a.Grants(Everyone)
-	require.Nil(t, err)
-	require.Equal(t, 0, len(everyoneGrants))
+		u, err := a.User("ben")
+		require.Nil(t, err)
+
+		// Create token for user
+		token, err := a.CreateToken(u.ID, "some label", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+		require.Nil(t, err)
+		require.NotEmpty(t, token.Value)
+		require.Equal(t, "some label", token.Label)
+		require.True(t, time.Now().Add(71*time.Hour).Unix() < token.Expires.Unix())
+
+		u2, err := a.AuthenticateToken(token.Value)
+		require.Nil(t, err)
+		require.Equal(t, u.Name, u2.Name)
+		require.Equal(t, token.Value, u2.Token)
+
+		token2, err := a.Token(u.ID, token.Value)
+		require.Nil(t, err)
+		require.Equal(t, token.Value, token2.Value)
+		require.Equal(t, "some label", token2.Label)
+
+		tokens, err := a.Tokens(u.ID)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(tokens))
+		require.Equal(t, "some label", tokens[0].Label)
+
+		tokens, err = a.Tokens("u_notauser")
+		require.Nil(t, err)
+		require.Equal(t, 0, len(tokens))
+
+		// Remove token and auth again
+		require.Nil(t, a.RemoveToken(u2.ID, u2.Token))
+		u3, err := a.AuthenticateToken(token.Value)
+		require.Equal(t, ErrUnauthenticated, err)
+		require.Nil(t, u3)
+
+		tokens, err = a.Tokens(u.ID)
+		require.Nil(t, err)
+		require.Equal(t, 0, len(tokens))
+	})
 }
 
-func TestManager_Token_Valid(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+func TestManager_Token_Scope(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
+		require.Nil(t, a.AllowAccess("ben", "ci-*", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("ben", "alerts", PermissionReadWrite))
 
-	u, err := a.User("ben")
-	require.Nil(t, err)
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+		scope, err := ParseTokenScope([]string{"ci-*:ro", "ci-results:wo", "secret:rw"})
+		require.Nil(t, err)
+		token, err := a.CreateScopedToken(ben.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), scope, nil)
+		require.Nil(t, err)
+		require.Equal(t, "ci-*:read-only,ci-results:write-only,secret:read-write", token.Scope.String())
 
-	// Create token for user
-	token, err := a.CreateToken(u.ID, "some label", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
-	require.Nil(t, err)
-	require.NotEmpty(t, token.Value)
-	require.Equal(t, "some label", token.Label)
-	require.True(t, time.Now().Add(71*time.Hour).Unix() < token.Expires.Unix())
+		u, err := a.AuthenticateToken(token.Value)
+		require.Nil(t, err)
+		require.Equal(t, scope, u.TokenScope)
+		require.Nil(t, a.Authorize(u, "ci-builds", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(u, "ci-builds", PermissionWrite))
+		require.Nil(t, a.Authorize(u, "ci-results", PermissionWrite)) // More specific pattern wins
+		require.Equal(t, ErrUnauthorized, a.Authorize(u, "ci-results", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(u, "alerts", PermissionRead)) // Not in scope
+		require.Equal(t, ErrUnauthorized, a.Authorize(u, "secret", PermissionRead)) // In scope, but user has no access
+
+		// Password login and unscoped tokens are not restricted
+		u, err = a.Authenticate("ben", "ben")
+		require.Nil(t, err)
+		require.Nil(t, u.TokenScope)
+		require.Nil(t, a.Authorize(u, "alerts", PermissionRead))
 
-	u2, err := a.AuthenticateToken(token.Value)
-	require.Nil(t, err)
-	require.Equal(t, u.Name, u2.Name)
-	require.Equal(t, token.Value, u2.Token)
+		// Scope is persisted
+		tokens, err := a.Tokens(ben.ID)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(tokens))
+		require.Equal(t, scope, tokens[0].Scope)
 
-	token2, err := a.Token(u.ID, token.Value)
-	require.Nil(t, err)
-	require.Equal(t, token.Value, token2.Value)
-	require.Equal(t, "some label", token2.Label)
+		// Publish-only scope also applies to admins
+		phil, err := a.User("phil")
+		require.Nil(t, err)
+		token, err = a.CreateScopedToken(phil.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), &TokenScope{PublishOnly: true}, nil)
+		require.Nil(t, err)
+		u, err = a.AuthenticateToken(token.Value)
+		require.Nil(t, err)
+		require.False(t, u.TokenScope.AccountAllowed())
+		require.Nil(t, a.Authorize(u, "anything", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(u, "anything", PermissionRead))
+	})
+}
+
+func TestManager_AllowedIPs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+		require.Nil(t, ben.AllowedIPs)
+
+		// Token allowlist
+		tokenAllowedIPs, err := ParseAllowedIPs([]string{"10.0.0.0/8", "192.168.1.5"})
+		require.Nil(t, err)
+		token, err := a.CreateScopedToken(ben.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), nil, tokenAllowedIPs)
+		require.Nil(t, err)
+		u, err := a.AuthenticateToken(token.Value)
+		require.Nil(t, err)
+		require.Nil(t, u.TokenScope)
+		require.Equal(t, "10.0.0.0/8,192.168.1.5/32", AllowedIPsString(u.TokenAllowedIPs))
+		require.True(t, u.AllowedFrom(netip.MustParseAddr("10.1.2.3")))
+		require.True(t, u.AllowedFrom(netip.MustParseAddr("192.168.1.5")))
+		require.False(t, u.AllowedFrom(netip.MustParseAddr("192.168.1.6")))
+
+		// User allowlist applies to password and token logins
+		require.Nil(t, a.ChangeAllowedIPs("ben", []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}))
+		u, err = a.Authenticate("ben", "ben")
+		require.Nil(t, err)
+		require.Equal(t, "10.1.0.0/16", AllowedIPsString(u.AllowedIPs))
+		require.Nil(t, u.TokenAllowedIPs)
+		require.True(t, u.AllowedFrom(netip.MustParseAddr("10.1.2.3")))
+		require.False(t, u.AllowedFrom(netip.MustParseAddr("10.2.2.3")))
+		u, err = a.AuthenticateToken(token.Value)
+		require.Nil(t, err)
+		require.True(t, u.AllowedFrom(netip.MustParseAddr("10.1.2.3")))
+		require.False(t, u.AllowedFrom(netip.MustParseAddr("10.2.2.3")))    // Allowed by token, but not by user
+		require.False(t, u.AllowedFrom(netip.MustParseAddr("192.168.1.5"))) // Allowed by token, but not by user
+
+		// Remove restrictions
+		require.Nil(t, a.ChangeAllowedIPs("ben", nil))
+		token, err = a.ChangeTokenAllowedIPs(ben.ID, token.Value, nil)
+		require.Nil(t, err)
+		require.Nil(t, token.AllowedIPs)
+		u, err = a.AuthenticateToken(token.Value)
+		require.Nil(t, err)
+		require.True(t, u.AllowedFrom(netip.MustParseAddr("1.2.3.4")))
+
+		_, err = a.ChangeTokenAllowedIPs(ben.ID, "tk_doesnotexist", nil)
+		require.Equal(t, ErrTokenNotFound, err)
+	})
+}
 
-	tokens, err := a.Tokens(u.ID)
+func TestParseAllowedIPs(t *testing.T) {
+	allowedIPs, err := ParseAllowedIPs([]string{"10.1.2.3/8,fd00::1", " 1.2.3.4 "})
 	require.Nil(t, err)
-	require.Equal(t, 1, len(tokens))
-	require.Equal(t, "some label", tokens[0].Label)
+	require.Equal(t, "10.0.0.0/8,fd00::1/128,1.2.3.4/32", AllowedIPsString(allowedIPs))
 
-	tokens, err = a.Tokens("u_notauser")
+	allowedIPs, err = ParseAllowedIPs([]string{""})
 	require.Nil(t, err)
-	require.Equal(t, 0, len(tokens))
+	require.Nil(t, allowedIPs)
 
-	// Remove token and auth again
-	require.Nil(t, a.RemoveToken(u2.ID, u2.Token))
-	u3, err := a.AuthenticateToken(token.Value)
-	require.Equal(t, ErrUnauthenticated, err)
-	require.Nil(t, u3)
+	_, err = ParseAllowedIPs([]string{"10.0.0.0/33"})
+	require.Equal(t, ErrInvalidAllowedIPs, err)
+	_, err = ParseAllowedIPs([]string{"example.com"})
+	require.Equal(t, ErrInvalidAllowedIPs, err)
+}
 
-	tokens, err = a.Tokens(u.ID)
+func TestParseTokenScope(t *testing.T) {
+	scope, err := ParseTokenScope([]string{})
 	require.Nil(t, err)
-	require.Equal(t, 0, len(tokens))
+	require.Nil(t, scope)
+
+	scope, err = ParseTokenScope([]string{"alerts*:rw,no-account", "publish-only"})
+	require.Nil(t, err)
+	require.Equal(t, &TokenScope{Topics: []Grant{{"alerts*", PermissionReadWrite}}, PublishOnly: true, NoAccount: true}, scope)
+	require.False(t, scope.AccountAllowed())
+	require.True(t, (&TokenScope{Topics: scope.Topics}).AccountAllowed())
+	require.True(t, (*TokenScope)(nil).AccountAllowed())
+
+	_, err = ParseTokenScope([]string{"alerts"})
+	require.Equal(t, ErrInvalidTokenScope, err)
+	_, err = ParseTokenScope([]string{"alerts:rwx"})
+	require.Equal(t, ErrInvalidTokenScope, err)
+	_, err = ParseTokenScope([]string{"alerts/x:rw"})
+	require.Equal(t, ErrInvalidTokenScope, err)
 }
 
 func TestManager_Token_Invalid(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
 
-	u, err := a.AuthenticateToken(strings.Repeat("x", 32)) // 32 == token length
-	require.Nil(t, u)
-	require.Equal(t, ErrUnauthenticated, err)
+		u, err := a.AuthenticateToken(strings.Repeat("x", 32)) // 32 == token length
+		require.Nil(t, u)
+		require.Equal(t, ErrUnauthenticated, err)
 
-	u, err = a.AuthenticateToken("not long enough anyway")
-	require.Nil(t, u)
-	require.Equal(t, ErrUnauthenticated, err)
+		u, err = a.AuthenticateToken("not long enough anyway")
+		require.Nil(t, u)
+		require.Equal(t, ErrUnauthenticated, err)
+	})
 }
 
 func TestManager_Token_NotFound(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	_, err := a.Token("u_bla", "notfound")
-	require.Equal(t, ErrTokenNotFound, err)
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		_, err := a.Token("u_bla", "notfound")
+		require.Equal(t, ErrTokenNotFound, err)
+	})
 }
 
 func TestManager_Token_Expire(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
 
-	u, err := a.User("ben")
-	require.Nil(t, err)
+		u, err := a.User("ben")
+		require.Nil(t, err)
+
+		// Create tokens for user
+		token1, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+		require.Nil(t, err)
+		require.NotEmpty(t, token1.Value)
+		require.True(t, time.Now().Add(71*time.Hour).Unix() < token1.Expires.Unix())
+
+		token2, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+		require.Nil(t, err)
+		require.NotEmpty(t, token2.Value)
+		require.NotEqual(t, token1.Value, token2.Value)
+		require.True(t, time.Now().Add(71*time.Hour).Unix() < token2.Expires.Unix())
+
+		// See that tokens work
+		_, err = a.AuthenticateToken(token1.Value)
+		require.Nil(t, err)
+
+		_, err = a.AuthenticateToken(token2.Value)
+		require.Nil(t, err)
+
+		// Modify token expiration in database
+		_, err = testDB(a).Exec("UPDATE user_token SET expires = 1 WHERE token = ?", token1.Value)
+		require.Nil(t, err)
+
+		// Now token1 shouldn't work anymore
+		_, err = a.AuthenticateToken(token1.Value)
+		require.Equal(t, ErrUnauthenticated, err)
+
+		result, err := testDB(a).Query("SELECT * from user_token WHERE token = ?", token1.Value)
+		require.Nil(t, err)
+		require.True(t, result.Next()) // Still a matching row
+		require.Nil(t, result.Close())
+
+		// Expire tokens and check database rows
+		require.Nil(t, a.RemoveExpiredTokens())
+
+		result, err = testDB(a).Query("SELECT * from user_token WHERE token = ?", token1.Value)
+		require.Nil(t, err)
+		require.False(t, result.Next()) // No matching row!
+		require.Nil(t, result.Close())
+	})
+}
+
+func TestManager_Token_Extend(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+
+		// Try to extend token for user without token
+		u, err := a.User("ben")
+		require.Nil(t, err)
+
+		_, err = a.ChangeToken(u.ID, u.Token, util.String("some label"), util.Time(time.Now().Add(time.Hour)))
+		require.Equal(t, errNoTokenProvided, err)
+
+		// Create token for user
+		token, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+		require.Nil(t, err)
+		require.NotEmpty(t, token.Value)
+
+		userWithToken, err := a.AuthenticateToken(token.Value)
+		require.Nil(t, err)
+
+		extendedToken, err := a.ChangeToken(userWithToken.ID, userWithToken.Token, util.String("changed label"), util.Time(time.Now().Add(100*time.Hour)))
+		require.Nil(t, err)
+		require.Equal(t, token.Value, extendedToken.Value)
+		require.Equal(t, "changed label", extendedToken.Label)
+		require.True(t, token.Expires.Unix() < extendedToken.Expires.Unix())
+		require.True(t, time.Now().Add(99*time.Hour).Unix() < extendedToken.Expires.Unix())
+	})
+}
+
+func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		// Tests that tokens are automatically deleted when the maximum number of tokens is reached
+
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+
+		phil, err := a.User("phil")
+		require.Nil(t, err)
+
+		// Create 2 tokens for phil
+		philTokens := make([]string, 0)
+		token, err := a.CreateToken(phil.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+		require.Nil(t, err)
+		require.NotEmpty(t, token.Value)
+		philTokens = append(philTokens, token.Value)
+
+		token, err = a.CreateToken(phil.ID, "", time.Unix(0, 0), netip.IPv4Unspecified())
+		require.Nil(t, err)
+		require.NotEmpty(t, token.Value)
+		philTokens = append(philTokens, token.Value)
+
+		// Create 22 tokens for ben (only 20 allowed!)
+		baseTime := time.Now().Add(24 * time.Hour)
+		benTokens := make([]string, 0)
+		for i := 0; i < 22; i++ { //
+			token, err := a.CreateToken(ben.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+			require.Nil(t, err)
+			require.NotEmpty(t, token.Value)
+			benTokens = append(benTokens, token.Value)
+
+			// Manually modify expiry date to avoid sorting issues (this is a hack)
+			_, err = testDB(a).Exec(`UPDATE user_token SET expires=? WHERE token=?`, baseTime.Add(time.Duration(i)*time.Minute).Unix(), token.Value)
+			require.Nil(t, err)
+		}
+
+		// Ben: The first 2 tokens should have been wiped and should not work anymore!
+		_, err = a.AuthenticateToken(benTokens[0])
+		require.Equal(t, ErrUnauthenticated, err)
+
+		_, err = a.AuthenticateToken(benTokens[1])
+		require.Equal(t, ErrUnauthenticated, err)
+
+		// Ben: The other tokens should still work
+		for i := 2; i < 22; i++ {
+			userWithToken, err := a.AuthenticateToken(benTokens[i])
+			require.Nil(t, err, "token[%d]=%s failed", i, benTokens[i])
+			require.Equal(t, "ben", userWithToken.Name)
+			require.Equal(t, benTokens[i], userWithToken.Token)
+		}
+
+		// Phil: All tokens should still work
+		for i := 0; i < 2; i++ {
+			userWithToken, err := a.AuthenticateToken(philTokens[i])
+			require.Nil(t, err, "token[%d]=%s failed", i, philTokens[i])
+			require.Equal(t, "phil", userWithToken.Name)
+			require.Equal(t, philTokens[i], userWithToken.Token)
+		}
+
+		var benCount int
+		rows, err := testDB(a).Query(`SELECT COUNT(*) FROM user_token WHERE user_id=?`, ben.ID)
+		require.Nil(t, err)
+		require.True(t, rows.Next())
+		require.Nil(t, rows.Scan(&benCount))
+		require.Equal(t, 20, benCount)
+
+		var philCount int
+		rows, err = testDB(a).Query(`SELECT COUNT(*) FROM user_token WHERE user_id=?`, phil.ID)
+		require.Nil(t, err)
+		require.True(t, rows.Next())
+		require.Nil(t, rows.Scan(&philCount))
+		require.Equal(t, 2, philCount)
+	})
+}
+
+func TestManager_EnqueueStats_ResetStats(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a, err := NewManager(filename, "", PermissionReadWrite, bcrypt.MinCost, 1500*time.Millisecond)
+		require.Nil(t, err)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+
+		// Baseline: No messages or emails
+		u, err := a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, int64(0), u.Stats.Messages)
+		require.Equal(t, int64(0), u.Stats.Emails)
+		a.EnqueueUserStats(u.ID, &Stats{
+			Messages: 11,
+			Emails:   2,
+		})
+
+		// Still no change, because it's queued asynchronously
+		u, err = a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, int64(0), u.Stats.Messages)
+		require.Equal(t, int64(0), u.Stats.Emails)
+
+		// After 2 seconds they should be persisted
+		time.Sleep(2 * time.Second)
+
+		u, err = a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, int64(11), u.Stats.Messages)
+		require.Equal(t, int64(2), u.Stats.Emails)
+
+		// Now reset stats (enqueued stats will be thrown out)
+		a.EnqueueUserStats(u.ID, &Stats{
+			Messages: 99,
+			Emails:   23,
+		})
+		require.Nil(t, a.ResetStats())
+
+		u, err = a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, int64(0), u.Stats.Messages)
+		require.Equal(t, int64(0), u.Stats.Emails)
+	})
+}
+
+func TestManager_EnqueueTokenUpdate(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a, err := NewManager(filename, "", PermissionReadWrite, bcrypt.MinCost, 500*time.Millisecond)
+		require.Nil(t, err)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+
+		// Create user and token
+		u, err := a.User("ben")
+		require.Nil(t, err)
+
+		token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
+		require.Nil(t, err)
+
+		// Queue token update
+		a.EnqueueTokenUpdate(token.Value, &TokenUpdate{
+			LastAccess: time.Unix(111, 0).UTC(),
+			LastOrigin: netip.MustParseAddr("1.2.3.3"),
+		})
+
+		// Token has not changed yet.
+		token2, err := a.Token(u.ID, token.Value)
+		require.Nil(t, err)
+		require.Equal(t, token.LastAccess.Unix(), token2.LastAccess.Unix())
+		require.Equal(t, token.LastOrigin, token2.LastOrigin)
+
+		// After a second or so they should be persisted
+		time.Sleep(time.Second)
+
+		token3, err := a.Token(u.ID, token.Value)
+		require.Nil(t, err)
+		require.Equal(t, time.Unix(111, 0).UTC().Unix(), token3.LastAccess.Unix())
+		require.Equal(t, netip.MustParseAddr("1.2.3.3"), token3.LastOrigin)
+	})
+}
 
-	// Create tokens for user
-	token1, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
-	require.Nil(t, err)
-	require.NotEmpty(t, token1.Value)
-	require.True(t, time.Now().Add(71*time.Hour).Unix() < token1.Expires.Unix())
+func TestManager_ChangeSettings(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a, err := NewManager(filename, "", PermissionReadWrite, bcrypt.MinCost, 1500*time.Millisecond)
+		require.Nil(t, err)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
 
-	token2, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
-	require.Nil(t, err)
-	require.NotEmpty(t, token2.Value)
-	require.NotEqual(t, token1.Value, token2.Value)
-	require.True(t, time.Now().Add(71*time.Hour).Unix() < token2.Expires.Unix())
+		// No settings
+		u, err := a.User("ben")
+		require.Nil(t, err)
+		require.Nil(t, u.Prefs.Subscriptions)
+		require.Nil(t, u.Prefs.Notification)
+		require.Nil(t, u.Prefs.Language)
+
+		// Save with new settings
+		prefs := &Prefs{
+			Language: util.String("de"),
+			Notification: &NotificationPrefs{
+				Sound:       util.String("ding"),
+				MinPriority: util.Int(2),
+			},
+			Subscriptions: []*Subscription{
+				{
+					BaseURL:     "https://ntfy.sh",
+					Topic:       "mytopic",
+					DisplayName: util.String("My Topic"),
+				},
+			},
+		}
+		require.Nil(t, a.ChangeSettings(u.ID, prefs))
 
-	// See that tokens work
-	_, err = a.AuthenticateToken(token1.Value)
-	require.Nil(t, err)
+		// Read again
+		u, err = a.User("ben")
+		require.Nil(t, err)
+		require.Equal(t, util.String("de"), u.Prefs.Language)
+		require.Equal(t, util.String("ding"), u.Prefs.Notification.Sound)
+		require.Equal(t, util.Int(2), u.Prefs.Notification.MinPriority)
+		require.Nil(t, u.Prefs.Notification.DeleteAfter)
+		require.Equal(t, "https://ntfy.sh", u.Prefs.Subscriptions[0].BaseURL)
+		require.Equal(t, "mytopic", u.Prefs.Subscriptions[0].Topic)
+		require.Equal(t, util.String("My Topic"), u.Prefs.Subscriptions[0].DisplayName)
+	})
+}
 
-	_, err = a.AuthenticateToken(token2.Value)
-	require.Nil(t, err)
+func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+
+		// Create tier and user
+		require.Nil(t, a.AddTier(&Tier{
+			Code:                     "supporter",
+			Name:                     "Supporter",
+			MessageLimit:             1,
+			MessageExpiryDuration:    time.Second,
+			EmailLimit:               1,
+			ReservationLimit:         1,
+			AttachmentFileSizeLimit:  1,
+			AttachmentTotalSizeLimit: 1,
+			AttachmentExpiryDuration: time.Second,
+			AttachmentBandwidthLimit: 1,
+			StripeMonthlyPriceID:     "price_1",
+		}))
+		require.Nil(t, a.AddTier(&Tier{
+			Code:                      "pro",
+			Name:                      "Pro",
+			MessageLimit:              123,
+			MessageExpiryDuration:     86400 * time.Second,
+			EmailLimit:                32,
+			ReservationLimit:          2,
+			AttachmentFileSizeLimit:   1231231,
+			AttachmentTotalSizeLimit:  123123,
+			AttachmentExpiryDuration:  10800 * time.Second,
+			AttachmentBandwidthLimit:  21474836480,
+			AttachmentImageProcessing: true,
+			StripeMonthlyPriceID:      "price_2",
+		}))
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+		require.Nil(t, a.ChangeTier("phil", "pro"))
+
+		ti, err := a.Tier("pro")
+		require.Nil(t, err)
 
-	// Modify token expiration in database
-	_, err = a.db.Exec("UPDATE user_token SET expires = 1 WHERE token = ?", token1.Value)
-	require.Nil(t, err)
+		u, err := a.User("phil")
+		require.Nil(t, err)
 
-	// Now token1 shouldn't work anymore
-	_, err = a.AuthenticateToken(token1.Value)
-	require.Equal(t, ErrUnauthenticated, err)
+		// These are populated by different SQL queries
+		require.Equal(t, ti, u.Tier)
+
+		// Fields
+		require.True(t, strings.HasPrefix(ti.ID, "ti_"))
+		require.Equal(t, "pro", ti.Code)
+		require.Equal(t, "Pro", ti.Name)
+		require.Equal(t, int64(123), ti.MessageLimit)
+		require.Equal(t, 86400*time.Second, ti.MessageExpiryDuration)
+		require.Equal(t, int64(32), ti.EmailLimit)
+		require.Equal(t, int64(2), ti.ReservationLimit)
+		require.Equal(t, int64(1231231), ti.AttachmentFileSizeLimit)
+		require.Equal(t, int64(123123), ti.AttachmentTotalSizeLimit)
+		require.Equal(t, 10800*time.Second, ti.AttachmentExpiryDuration)
+		require.Equal(t, int64(21474836480), ti.AttachmentBandwidthLimit)
+		require.True(t, ti.AttachmentImageProcessing)
+		require.Equal(t, "price_2", ti.StripeMonthlyPriceID)
+
+		// Update tier
+		ti.EmailLimit = 999999
+		require.Nil(t, a.UpdateTier(ti))
+
+		// List tiers
+		tiers, err := a.Tiers()
+		require.Nil(t, err)
+		require.Equal(t, 2, len(tiers))
+
+		ti = tiers[0]
+		require.Equal(t, "supporter", ti.Code)
+		require.Equal(t, "Supporter", ti.Name)
+		require.Equal(t, int64(1), ti.MessageLimit)
+		require.Equal(t, time.Second, ti.MessageExpiryDuration)
+		require.Equal(t, int64(1), ti.EmailLimit)
+		require.Equal(t, int64(1), ti.ReservationLimit)
+		require.Equal(t, int64(1), ti.AttachmentFileSizeLimit)
+		require.Equal(t, int64(1), ti.AttachmentTotalSizeLimit)
+		require.Equal(t, time.Second, ti.AttachmentExpiryDuration)
+		require.Equal(t, int64(1), ti.AttachmentBandwidthLimit)
+		require.Equal(t, "price_1", ti.StripeMonthlyPriceID)
+
+		ti = tiers[1]
+		require.Equal(t, "pro", ti.Code)
+		require.Equal(t, "Pro", ti.Name)
+		require.Equal(t, int64(123), ti.MessageLimit)
+		require.Equal(t, 86400*time.Second, ti.MessageExpiryDuration)
+		require.Equal(t, int64(999999), ti.EmailLimit) // Updatedd!
+		require.Equal(t, int64(2), ti.ReservationLimit)
+		require.Equal(t, int64(1231231), ti.AttachmentFileSizeLimit)
+		require.Equal(t, int64(123123), ti.AttachmentTotalSizeLimit)
+		require.Equal(t, 10800*time.Second, ti.AttachmentExpiryDuration)
+		require.Equal(t, int64(21474836480), ti.AttachmentBandwidthLimit)
+		require.Equal(t, "price_2", ti.StripeMonthlyPriceID)
+
+		ti, err = a.TierByStripePrice("price_1")
+		require.Nil(t, err)
+		require.Equal(t, "supporter", ti.Code)
+		require.Equal(t, "Supporter", ti.Name)
+		require.Equal(t, int64(1), ti.MessageLimit)
+		require.Equal(t, time.Second, ti.MessageExpiryDuration)
+		require.Equal(t, int64(1), ti.EmailLimit)
+		require.Equal(t, int64(1), ti.ReservationLimit)
+		require.Equal(t, int64(1), ti.AttachmentFileSizeLimit)
+		require.Equal(t, int64(1), ti.AttachmentTotalSizeLimit)
+		require.Equal(t, time.Second, ti.AttachmentExpiryDuration)
+		require.Equal(t, int64(1), ti.AttachmentBandwidthLimit)
+		require.Equal(t, "price_1", ti.StripeMonthlyPriceID)
+
+		// Cannot remove tier, since user has this tier
+		require.Error(t, a.RemoveTier("pro"))
+
+		// CAN remove this tier
+		require.Nil(t, a.RemoveTier("supporter"))
+
+		tiers, err = a.Tiers()
+		require.Nil(t, err)
+		require.Equal(t, 1, len(tiers))
+		require.Equal(t, "pro", tiers[0].Code)
+		require.Equal(t, "pro", tiers[0].Code)
+	})
+}
 
-	result, err := a.db.Query("SELECT * from user_token WHERE token = ?", token1.Value)
-	require.Nil(t, err)
-	require.True(t, result.Next()) // Still a matching row
-	require.Nil(t, result.Close())
+func TestAccount_Tier_Create_With_ID(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
 
-	// Expire tokens and check database rows
-	require.Nil(t, a.RemoveExpiredTokens())
+		require.Nil(t, a.AddTier(&Tier{
+			ID:   "ti_123",
+			Code: "pro",
+		}))
 
-	result, err = a.db.Query("SELECT * from user_token WHERE token = ?", token1.Value)
-	require.Nil(t, err)
-	require.False(t, result.Next()) // No matching row!
-	require.Nil(t, result.Close())
+		ti, err := a.Tier("pro")
+		require.Nil(t, err)
+		require.Equal(t, "ti_123", ti.ID)
+	})
 }
 
-func TestManager_Token_Extend(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+func TestManager_Tier_Change_And_Reset(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+
+		// Create tier and user
+		require.Nil(t, a.AddTier(&Tier{
+			Code:             "supporter",
+			Name:             "Supporter",
+			ReservationLimit: 3,
+		}))
+		require.Nil(t, a.AddTier(&Tier{
+			Code:             "pro",
+			Name:             "Pro",
+			ReservationLimit: 4,
+		}))
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+		require.Nil(t, a.ChangeTier("phil", "pro"))
+
+		// Add 10 reservations (pro tier allows that)
+		for i := 0; i < 4; i++ {
+			require.Nil(t, a.AddReservation("phil", fmt.Sprintf("topic%d", i), PermissionWrite))
+		}
+
+		// Downgrading will not work (too many reservations)
+		require.Equal(t, ErrTooManyReservations, a.ChangeTier("phil", "supporter"))
+
+		// Downgrade after removing a reservation
+		require.Nil(t, a.RemoveReservations("phil", "topic0"))
+		require.Nil(t, a.ChangeTier("phil", "supporter"))
+
+		// Resetting will not work (too many reservations)
+		require.Equal(t, ErrTooManyReservations, a.ResetTier("phil"))
+
+		// Resetting after removing all reservations
+		require.Nil(t, a.RemoveReservations("phil", "topic1", "topic2", "topic3"))
+		require.Nil(t, a.ResetTier("phil"))
+	})
+}
 
-	// Try to extend token for user without token
-	u, err := a.User("ben")
-	require.Nil(t, err)
+func TestUser_PhoneNumberAddListRemove(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
 
-	_, err = a.ChangeToken(u.ID, u.Token, util.String("some label"), util.Time(time.Now().Add(time.Hour)))
-	require.Equal(t, errNoTokenProvided, err)
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+		phil, err := a.User("phil")
+		require.Nil(t, err)
+		require.Nil(t, a.AddPhoneNumber(phil.ID, "+1234567890"))
 
-	// Create token for user
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
-	require.Nil(t, err)
-	require.NotEmpty(t, token.Value)
+		phoneNumbers, err := a.PhoneNumbers(phil.ID)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(phoneNumbers))
+		require.Equal(t, "+1234567890", phoneNumbers[0])
 
-	userWithToken, err := a.AuthenticateToken(token.Value)
-	require.Nil(t, err)
+		require.Nil(t, a.RemovePhoneNumber(phil.ID, "+1234567890"))
+		phoneNumbers, err = a.PhoneNumbers(phil.ID)
+		require.Nil(t, err)
+		require.Equal(t, 0, len(phoneNumbers))
 
-	extendedToken, err := a.ChangeToken(userWithToken.ID, userWithToken.Token, util.String("changed label"), util.Time(time.Now().Add(100*time.Hour)))
-	require.Nil(t, err)
-	require.Equal(t, token.Value, extendedToken.Value)
-	require.Equal(t, "changed label", extendedToken.Label)
-	require.True(t, token.Expires.Unix() < extendedToken.Expires.Unix())
-	require.True(t, time.Now().Add(99*time.Hour).Unix() < extendedToken.Expires.Unix())
+		// Paranoia check: We do NOT want to keep phone numbers in there
+		rows, err := testDB(a).Query(`SELECT * FROM user_phone`)
+		require.Nil(t, err)
+		require.False(t, rows.Next())
+		require.Nil(t, rows.Close())
+	})
 }
 
-func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
-	// Tests that tokens are automatically deleted when the maximum number of tokens is reached
+func TestUser_PhoneNumberAdd_Multiple_Users_Same_Number(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
 
-	a := newTestManager(t, PermissionDenyAll)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
-	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		phil, err := a.User("phil")
+		require.Nil(t, err)
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+		require.Nil(t, a.AddPhoneNumber(phil.ID, "+1234567890"))
+		require.Nil(t, a.AddPhoneNumber(ben.ID, "+1234567890"))
+	})
+}
 
-	ben, err := a.User("ben")
-	require.Nil(t, err)
+func TestManager_Topic_Wildcard_With_Asterisk_Underscore(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		f := filename
+		a := newTestManagerFromFile(t, f, "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
+		require.Nil(t, a.AllowAccess(Everyone, "*_", PermissionRead))
+		require.Nil(t, a.AllowAccess(Everyone, "__*_", PermissionRead))
+		require.Nil(t, a.Authorize(nil, "allowed_", PermissionRead))
+		require.Nil(t, a.Authorize(nil, "__allowed_", PermissionRead))
+		require.Nil(t, a.Authorize(nil, "_allowed_", PermissionRead)) // The "%" in "%\_" matches the first "_"
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "notallowed", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "_notallowed", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "__notallowed", PermissionRead))
+	})
+}
 
-	phil, err := a.User("phil")
-	require.Nil(t, err)
+func TestManager_Topic_Wildcard_With_Underscore(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		f := filename
+		a := newTestManagerFromFile(t, f, "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
+		require.Nil(t, a.AllowAccess(Everyone, "mytopic_", PermissionReadWrite))
+		require.Nil(t, a.Authorize(nil, "mytopic_", PermissionRead))
+		require.Nil(t, a.Authorize(nil, "mytopic_", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "mytopicX", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "mytopicX", PermissionWrite))
+	})
+}
 
-	// Create 2 tokens for phil
-	philTokens := make([]string, 0)
-	token, err := a.CreateToken(phil.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
-	require.Nil(t, err)
-	require.NotEmpty(t, token.Value)
-	philTokens = append(philTokens, token.Value)
+func TestToFromSQLWildcard(t *testing.T) {
+	require.Equal(t, "up%", toSQLWildcard("up*"))
+	require.Equal(t, "up\\_%", toSQLWildcard("up_*"))
+	require.Equal(t, "foo", toSQLWildcard("foo"))
 
-	token, err = a.CreateToken(phil.ID, "", time.Unix(0, 0), netip.IPv4Unspecified())
-	require.Nil(t, err)
-	require.NotEmpty(t, token.Value)
-	philTokens = append(philTokens, token.Value)
+	require.Equal(t, "up*", fromSQLWildcard("up%"))
+	require.Equal(t, "up_*", fromSQLWildcard("up\\_%"))
+	require.Equal(t, "foo", fromSQLWildcard("foo"))
 
-	// Create 22 tokens for ben (only 20 allowed!)
-	baseTime := time.Now().Add(24 * time.Hour)
-	benTokens := make([]string, 0)
-	for i := 0; i < 22; i++ { //
-		token, err := a.CreateToken(ben.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
-		require.Nil(t, err)
-		require.NotEmpty(t, token.Value)
-		benTokens = append(benTokens, token.Value)
+	require.Equal(t, "up*", fromSQLWildcard(toSQLWildcard("up*")))
+	require.Equal(t, "up_*", fromSQLWildcard(toSQLWildcard("up_*")))
+	require.Equal(t, "foo", fromSQLWildcard(toSQLWildcard("foo")))
+}
 
-		// Manually modify expiry date to avoid sorting issues (this is a hack)
-		_, err = a.db.Exec(`UPDATE user_token SET expires=? WHERE token=?`, baseTime.Add(time.Duration(i)*time.Minute).Unix(), token.Value)
+func TestManager_Webhooks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+		phil, err := a.User("phil")
 		require.Nil(t, err)
-	}
-
-	// Ben: The first 2 tokens should have been wiped and should not work anymore!
-	_, err = a.AuthenticateToken(benTokens[0])
-	require.Equal(t, ErrUnauthenticated, err)
 
-	_, err = a.AuthenticateToken(benTokens[1])
-	require.Equal(t, ErrUnauthenticated, err)
+		webhook1, err := a.AddWebhook(ben.ID, "alerts", "https://example.com/hook", "")
+		require.Nil(t, err)
+		require.True(t, strings.HasPrefix(webhook1.ID, "wh_"))
+		require.Equal(t, 32, len(webhook1.Secret))
+		webhook2, err := a.AddWebhook(ben.ID, "backups", "http://10.0.0.1:8080/ntfy", `{"text":"{{.message}}"}`)
+		require.Nil(t, err)
+		webhook3, err := a.AddWebhook(phil.ID, "alerts", "https://phil.example.com", "")
+		require.Nil(t, err)
 
-	// Ben: The other tokens should still work
-	for i := 2; i < 22; i++ {
-		userWithToken, err := a.AuthenticateToken(benTokens[i])
-		require.Nil(t, err, "token[%d]=%s failed", i, benTokens[i])
-		require.Equal(t, "ben", userWithToken.Name)
-		require.Equal(t, benTokens[i], userWithToken.Token)
-	}
+		webhooks, err := a.Webhooks(ben.ID)
+		require.Nil(t, err)
+		require.Equal(t, 2, len(webhooks))
+		w1, w2 := findWebhook(t, webhooks, webhook1.ID), findWebhook(t, webhooks, webhook2.ID)
+		require.Equal(t, ben.ID, w1.UserID)
+		require.Equal(t, "alerts", w1.Topic)
+		require.Equal(t, "https://example.com/hook", w1.URL)
+		require.Equal(t, "", w1.Template)
+		require.Equal(t, webhook1.Secret, w1.Secret)
+		require.True(t, w1.LastAttempt.IsZero())
+		require.Equal(t, `{"text":"{{.message}}"}`, w2.Template)
+
+		webhooks, err = a.WebhooksByTopic("alerts")
+		require.Nil(t, err)
+		require.Equal(t, 2, len(webhooks))
+		require.ElementsMatch(t, []string{webhook1.ID, webhook3.ID}, []string{webhooks[0].ID, webhooks[1].ID})
 
-	// Phil: All tokens should still work
-	for i := 0; i < 2; i++ {
-		userWithToken, err := a.AuthenticateToken(philTokens[i])
-		require.Nil(t, err, "token[%d]=%s failed", i, philTokens[i])
-		require.Equal(t, "phil", userWithToken.Name)
-		require.Equal(t, philTokens[i], userWithToken.Token)
-	}
+		// Only the owner can remove a webhook
+		require.Equal(t, ErrWebhookNotFound, a.RemoveWebhook(phil.ID, webhook1.ID))
+		require.Nil(t, a.RemoveWebhook(ben.ID, webhook1.ID))
+		require.Equal(t, ErrWebhookNotFound, a.RemoveWebhook(ben.ID, webhook1.ID))
 
-	var benCount int
-	rows, err := a.db.Query(`SELECT COUNT(*) FROM user_token WHERE user_id=?`, ben.ID)
-	require.Nil(t, err)
-	require.True(t, rows.Next())
-	require.Nil(t, rows.Scan(&benCount))
-	require.Equal(t, 20, benCount)
+		webhooks, err = a.WebhooksByTopic("alerts")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(webhooks))
+		require.Equal(t, webhook3.ID, webhooks[0].ID)
 
-	var philCount int
-	rows, err = a.db.Query(`SELECT COUNT(*) FROM user_token WHERE user_id=?`, phil.ID)
-	require.Nil(t, err)
-	require.True(t, rows.Next())
-	require.Nil(t, rows.Scan(&philCount))
-	require.Equal(t, 2, philCount)
+		// Webhooks are removed with the user
+		require.Nil(t, a.RemoveUser("phil"))
+		webhooks, err = a.WebhooksByTopic("alerts")
+		require.Nil(t, err)
+		require.Empty(t, webhooks)
+	})
 }
 
-func TestManager_EnqueueStats_ResetStats(t *testing.T) {
-	a, err := NewManager(filepath.Join(t.TempDir(), "db"), "", PermissionReadWrite, bcrypt.MinCost, 1500*time.Millisecond)
-	require.Nil(t, err)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+func TestManager_Webhooks_Invalid(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		u, err := a.User("ben")
+		require.Nil(t, err)
 
-	// Baseline: No messages or emails
-	u, err := a.User("ben")
-	require.Nil(t, err)
-	require.Equal(t, int64(0), u.Stats.Messages)
-	require.Equal(t, int64(0), u.Stats.Emails)
-	a.EnqueueUserStats(u.ID, &Stats{
-		Messages: 11,
-		Emails:   2,
+		_, err = a.AddWebhook(u.ID, "inv@lid", "https://example.com", "")
+		require.Equal(t, ErrInvalidArgument, err)
+		_, err = a.AddWebhook(u.ID, "alerts", "ftp://example.com", "")
+		require.Equal(t, ErrInvalidArgument, err)
+		_, err = a.AddWebhook(u.ID, "alerts", "https://example.com/with space", "")
+		require.Equal(t, ErrInvalidArgument, err)
+		_, err = a.AddWebhook(u.ID, "alerts", "https://example.com/"+strings.Repeat("x", 2048), "")
+		require.Equal(t, ErrInvalidArgument, err)
+
+		for i := 0; i < webhookMaxCount; i++ {
+			_, err := a.AddWebhook(u.ID, "alerts", fmt.Sprintf("https://example.com/%d", i), "")
+			require.Nil(t, err)
+		}
+		_, err = a.AddWebhook(u.ID, "alerts", "https://example.com/too-many", "")
+		require.Equal(t, ErrTooManyWebhooks, err)
 	})
+}
 
-	// Still no change, because it's queued asynchronously
-	u, err = a.User("ben")
-	require.Nil(t, err)
-	require.Equal(t, int64(0), u.Stats.Messages)
-	require.Equal(t, int64(0), u.Stats.Emails)
+func TestManager_WebhookDeliveries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		u, err := a.User("ben")
+		require.Nil(t, err)
+		webhook1, err := a.AddWebhook(u.ID, "alerts", "https://example.com/1", "")
+		require.Nil(t, err)
+		webhook2, err := a.AddWebhook(u.ID, "alerts", "https://example.com/2", "")
+		require.Nil(t, err)
 
-	// After 2 seconds they should be persisted
-	time.Sleep(2 * time.Second)
+		require.Nil(t, a.EnqueueWebhookDeliveries(
+			&WebhookDelivery{WebhookID: webhook1.ID, Body: `{"message":"first"}`, ContentType: "application/json"},
+			&WebhookDelivery{WebhookID: webhook2.ID, Body: "second", ContentType: "text/plain"},
+			&WebhookDelivery{WebhookID: webhook1.ID, Body: "later", ContentType: "text/plain", NextAttempt: time.Now().Add(time.Hour)},
+		))
+		webhooks, err := a.Webhooks(u.ID)
+		require.Nil(t, err)
+		require.Equal(t, int64(2), findWebhook(t, webhooks, webhook1.ID).Pending)
+		require.Equal(t, int64(1), findWebhook(t, webhooks, webhook2.ID).Pending)
 
-	u, err = a.User("ben")
-	require.Nil(t, err)
-	require.Equal(t, int64(11), u.Stats.Messages)
-	require.Equal(t, int64(2), u.Stats.Emails)
+		deliveries, err := a.WebhookDeliveriesDue(10)
+		require.Nil(t, err)
+		require.Equal(t, 2, len(deliveries))
+		bodies := []string{deliveries[0].Body, deliveries[1].Body}
+		require.ElementsMatch(t, []string{`{"message":"first"}`, "second"}, bodies)
+		for _, d := range deliveries {
+			require.True(t, strings.HasPrefix(d.ID, "wd_"))
+			if d.WebhookID == webhook1.ID {
+				require.Equal(t, "https://example.com/1", d.URL)
+				require.Equal(t, webhook1.Secret, d.Secret)
+				require.Equal(t, "application/json", d.ContentType)
+				require.Equal(t, 0, d.Attempts)
+				require.Nil(t, a.MarkWebhookDelivered(d))
+			} else {
+				require.Nil(t, a.MarkWebhookDeliveryFailed(d, "HTTP 500 Internal Server Error", time.Now().Add(time.Minute)))
+			}
+		}
+
+		// Successful delivery is removed, failed one is rescheduled
+		deliveries, err = a.WebhookDeliveriesDue(10)
+		require.Nil(t, err)
+		require.Empty(t, deliveries)
+		webhooks, err = a.Webhooks(u.ID)
+		require.Nil(t, err)
+		w1, w2 := findWebhook(t, webhooks, webhook1.ID), findWebhook(t, webhooks, webhook2.ID)
+		require.Equal(t, int64(1), w1.Pending)
+		require.False(t, w1.LastSuccess.IsZero())
+		require.Equal(t, int64(0), w1.Failures)
+		require.Equal(t, int64(1), w2.Pending)
+		require.True(t, w2.LastSuccess.IsZero())
+		require.False(t, w2.LastAttempt.IsZero())
+		require.Equal(t, "HTTP 500 Internal Server Error", w2.LastError)
+		require.Equal(t, int64(1), w2.Failures)
+
+		// Giving up removes the delivery
+		_, err = testDB(a).Exec(`UPDATE user_webhook_delivery SET next_attempt = 0`)
+		require.Nil(t, err)
+		deliveries, err = a.WebhookDeliveriesDue(1)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(deliveries))
+		require.Nil(t, a.MarkWebhookDeliveryFailed(deliveries[0], "timeout", time.Time{}))
+		deliveries, err = a.WebhookDeliveriesDue(10)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(deliveries))
 
-	// Now reset stats (enqueued stats will be thrown out)
-	a.EnqueueUserStats(u.ID, &Stats{
-		Messages: 99,
-		Emails:   23,
+		// Removing the webhook removes its queued deliveries
+		require.Nil(t, a.RemoveWebhook(u.ID, deliveries[0].WebhookID))
+		deliveries, err = a.WebhookDeliveriesDue(10)
+		require.Nil(t, err)
+		require.Empty(t, deliveries)
 	})
-	require.Nil(t, a.ResetStats())
-
-	u, err = a.User("ben")
-	require.Nil(t, err)
-	require.Equal(t, int64(0), u.Stats.Messages)
-	require.Equal(t, int64(0), u.Stats.Emails)
 }
 
-func TestManager_EnqueueTokenUpdate(t *testing.T) {
-	a, err := NewManager(filepath.Join(t.TempDir(), "db"), "", PermissionReadWrite, bcrypt.MinCost, 500*time.Millisecond)
-	require.Nil(t, err)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+func TestManager_Webhooks_MarkUserRemoved(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		u, err := a.User("ben")
+		require.Nil(t, err)
+		_, err = a.AddWebhook(u.ID, "alerts", "https://example.com", "")
+		require.Nil(t, err)
 
-	// Create user and token
-	u, err := a.User("ben")
-	require.Nil(t, err)
+		require.Nil(t, a.MarkUserRemoved(u))
+		webhooks, err := a.WebhooksByTopic("alerts")
+		require.Nil(t, err)
+		require.Empty(t, webhooks)
+	})
+}
 
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
-	require.Nil(t, err)
+func findWebhook(t *testing.T, webhooks []*Webhook, id string) *Webhook {
+	for _, w := range webhooks {
+		if w.ID == id {
+			return w
+		}
+	}
+	t.Fatalf("webhook %s not found", id)
+	return nil
+}
 
-	// Queue token update
-	a.EnqueueTokenUpdate(token.Value, &TokenUpdate{
-		LastAccess: time.Unix(111, 0).UTC(),
-		LastOrigin: netip.MustParseAddr("1.2.3.3"),
-	})
+func TestManager_Rules(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		ci := &Rule{Topic: "ci_*", Target: "oncall", Filter: "priority>=4"}
+		require.Nil(t, a.AddRule(ci))
+		require.True(t, strings.HasPrefix(ci.ID, "ru_"))
+		require.Equal(t, ruleDefaultRateLimit, ci.RateLimit)
+		db := &Rule{Topic: "alerts", Target: "dba-team", Filter: "tags~db", Template: "DB: {{.message}}", RateLimit: 5}
+		require.Nil(t, a.AddRule(db))
+
+		rules, err := a.Rules()
+		require.Nil(t, err)
+		require.Equal(t, 2, len(rules))
 
-	// Token has not changed yet.
-	token2, err := a.Token(u.ID, token.Value)
-	require.Nil(t, err)
-	require.Equal(t, token.LastAccess.Unix(), token2.LastAccess.Unix())
-	require.Equal(t, token.LastOrigin, token2.LastOrigin)
+		rules, err = a.RulesForTopic("ci_build")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(rules))
+		require.Equal(t, ci.ID, rules[0].ID)
+		require.Equal(t, "ci_*", rules[0].Topic)
+		require.Equal(t, "oncall", rules[0].Target)
+		require.Equal(t, "priority>=4", rules[0].Filter)
 
-	// After a second or so they should be persisted
-	time.Sleep(time.Second)
+		rules, err = a.RulesForTopic("ciXbuild") // '_' is not a wildcard
+		require.Nil(t, err)
+		require.Empty(t, rules)
 
-	token3, err := a.Token(u.ID, token.Value)
-	require.Nil(t, err)
-	require.Equal(t, time.Unix(111, 0).UTC().Unix(), token3.LastAccess.Unix())
-	require.Equal(t, netip.MustParseAddr("1.2.3.3"), token3.LastOrigin)
+		rules, err = a.RulesForTopic("alerts")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(rules))
+		require.Equal(t, "DB: {{.message}}", rules[0].Template)
+		require.Equal(t, 5, rules[0].RateLimit)
+
+		require.Nil(t, a.RemoveRule(db.ID))
+		require.Equal(t, ErrRuleNotFound, a.RemoveRule(db.ID))
+		rules, err = a.Rules()
+		require.Nil(t, err)
+		require.Equal(t, 1, len(rules))
+		require.Equal(t, ci.ID, rules[0].ID)
+	})
 }
 
-func TestManager_ChangeSettings(t *testing.T) {
-	a, err := NewManager(filepath.Join(t.TempDir(), "db"), "", PermissionReadWrite, bcrypt.MinCost, 1500*time.Millisecond)
-	require.Nil(t, err)
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+func TestManager_Rules_Invalid(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Equal(t, ErrInvalidArgument, a.AddRule(&Rule{Topic: "", Target: "oncall"}))
+		require.Equal(t, ErrInvalidArgument, a.AddRule(&Rule{Topic: "ci_*", Target: "on*"}))
+		require.Equal(t, ErrInvalidArgument, a.AddRule(&Rule{Topic: "ci_*", Target: "oncall", RateLimit: -1}))
+		require.Equal(t, ErrInvalidArgument, a.RemoveRule(""))
+	})
+}
 
-	// No settings
-	u, err := a.User("ben")
-	require.Nil(t, err)
-	require.Nil(t, u.Prefs.Subscriptions)
-	require.Nil(t, u.Prefs.Notification)
-	require.Nil(t, u.Prefs.Language)
-
-	// Save with new settings
-	prefs := &Prefs{
-		Language: util.String("de"),
-		Notification: &NotificationPrefs{
-			Sound:       util.String("ding"),
-			MinPriority: util.Int(2),
-		},
-		Subscriptions: []*Subscription{
-			{
-				BaseURL:     "https://ntfy.sh",
-				Topic:       "mytopic",
-				DisplayName: util.String("My Topic"),
+func TestManager_EscalationPolicies(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		pager := &EscalationPolicy{
+			Topic: "pager_*",
+			Steps: []*EscalationStep{
+				{Delay: 5 * time.Minute, Type: EscalationCall, Target: "+12223334444"},
+				{Delay: 10 * time.Minute, Type: EscalationEmail, Target: "oncall@example.com"},
 			},
-		},
-	}
-	require.Nil(t, a.ChangeSettings(u.ID, prefs))
+		}
+		require.Nil(t, a.AddEscalationPolicy(pager))
+		require.True(t, strings.HasPrefix(pager.ID, "es_"))
+		db := &EscalationPolicy{
+			Topic: "db-alerts",
+			Steps: []*EscalationStep{
+				{Type: EscalationPublish, Target: "dba-team"},
+			},
+		}
+		require.Nil(t, a.AddEscalationPolicy(db))
 
-	// Read again
-	u, err = a.User("ben")
-	require.Nil(t, err)
-	require.Equal(t, util.String("de"), u.Prefs.Language)
-	require.Equal(t, util.String("ding"), u.Prefs.Notification.Sound)
-	require.Equal(t, util.Int(2), u.Prefs.Notification.MinPriority)
-	require.Nil(t, u.Prefs.Notification.DeleteAfter)
-	require.Equal(t, "https://ntfy.sh", u.Prefs.Subscriptions[0].BaseURL)
-	require.Equal(t, "mytopic", u.Prefs.Subscriptions[0].Topic)
-	require.Equal(t, util.String("My Topic"), u.Prefs.Subscriptions[0].DisplayName)
-}
+		policies, err := a.EscalationPolicies()
+		require.Nil(t, err)
+		require.Equal(t, 2, len(policies))
 
-func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-
-	// Create tier and user
-	require.Nil(t, a.AddTier(&Tier{
-		Code:                     "supporter",
-		Name:                     "Supporter",
-		MessageLimit:             1,
-		MessageExpiryDuration:    time.Second,
-		EmailLimit:               1,
-		ReservationLimit:         1,
-		AttachmentFileSizeLimit:  1,
-		AttachmentTotalSizeLimit: 1,
-		AttachmentExpiryDuration: time.Second,
-		AttachmentBandwidthLimit: 1,
-		StripeMonthlyPriceID:     "price_1",
-	}))
-	require.Nil(t, a.AddTier(&Tier{
-		Code:                     "pro",
-		Name:                     "Pro",
-		MessageLimit:             123,
-		MessageExpiryDuration:    86400 * time.Second,
-		EmailLimit:               32,
-		ReservationLimit:         2,
-		AttachmentFileSizeLimit:  1231231,
-		AttachmentTotalSizeLimit: 123123,
-		AttachmentExpiryDuration: 10800 * time.Second,
-		AttachmentBandwidthLimit: 21474836480,
-		StripeMonthlyPriceID:     "price_2",
-	}))
-	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
-	require.Nil(t, a.ChangeTier("phil", "pro"))
-
-	ti, err := a.Tier("pro")
-	require.Nil(t, err)
+		policies, err = a.EscalationPoliciesForTopic("pager_phil")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(policies))
+		require.Equal(t, pager.ID, policies[0].ID)
+		require.Equal(t, "pager_*", policies[0].Topic)
+		require.Equal(t, pager.Steps, policies[0].Steps)
 
-	u, err := a.User("phil")
-	require.Nil(t, err)
+		policies, err = a.EscalationPoliciesForTopic("pagerXphil") // '_' is not a wildcard
+		require.Nil(t, err)
+		require.Empty(t, policies)
 
-	// These are populated by different SQL queries
-	require.Equal(t, ti, u.Tier)
-
-	// Fields
-	require.True(t, strings.HasPrefix(ti.ID, "ti_"))
-	require.Equal(t, "pro", ti.Code)
-	require.Equal(t, "Pro", ti.Name)
-	require.Equal(t, int64(123), ti.MessageLimit)
-	require.Equal(t, 86400*time.Second, ti.MessageExpiryDuration)
-	require.Equal(t, int64(32), ti.EmailLimit)
-	require.Equal(t, int64(2), ti.ReservationLimit)
-	require.Equal(t, int64(1231231), ti.AttachmentFileSizeLimit)
-	require.Equal(t, int64(123123), ti.AttachmentTotalSizeLimit)
-	require.Equal(t, 10800*time.Second, ti.AttachmentExpiryDuration)
-	require.Equal(t, int64(21474836480), ti.AttachmentBandwidthLimit)
-	require.Equal(t, "price_2", ti.StripeMonthlyPriceID)
-
-	// Update tier
-	ti.EmailLimit = 999999
-	require.Nil(t, a.UpdateTier(ti))
-
-	// List tiers
-	tiers, err := a.Tiers()
-	require.Nil(t, err)
-	require.Equal(t, 2, len(tiers))
-
-	ti = tiers[0]
-	require.Equal(t, "supporter", ti.Code)
-	require.Equal(t, "Supporter", ti.Name)
-	require.Equal(t, int64(1), ti.MessageLimit)
-	require.Equal(t, time.Second, ti.MessageExpiryDuration)
-	require.Equal(t, int64(1), ti.EmailLimit)
-	require.Equal(t, int64(1), ti.ReservationLimit)
-	require.Equal(t, int64(1), ti.AttachmentFileSizeLimit)
-	require.Equal(t, int64(1), ti.AttachmentTotalSizeLimit)
-	require.Equal(t, time.Second, ti.AttachmentExpiryDuration)
-	require.Equal(t, int64(1), ti.AttachmentBandwidthLimit)
-	require.Equal(t, "price_1", ti.StripeMonthlyPriceID)
-
-	ti = tiers[1]
-	require.Equal(t, "pro", ti.Code)
-	require.Equal(t, "Pro", ti.Name)
-	require.Equal(t, int64(123), ti.MessageLimit)
-	require.Equal(t, 86400*time.Second, ti.MessageExpiryDuration)
-	require.Equal(t, int64(999999), ti.EmailLimit) // Updatedd!
-	require.Equal(t, int64(2), ti.ReservationLimit)
-	require.Equal(t, int64(1231231), ti.AttachmentFileSizeLimit)
-	require.Equal(t, int64(123123), ti.AttachmentTotalSizeLimit)
-	require.Equal(t, 10800*time.Second, ti.AttachmentExpiryDuration)
-	require.Equal(t, int64(21474836480), ti.AttachmentBandwidthLimit)
-	require.Equal(t, "price_2", ti.StripeMonthlyPriceID)
-
-	ti, err = a.TierByStripePrice("price_1")
-	require.Nil(t, err)
-	require.Equal(t, "supporter", ti.Code)
-	require.Equal(t, "Supporter", ti.Name)
-	require.Equal(t, int64(1), ti.MessageLimit)
-	require.Equal(t, time.Second, ti.MessageExpiryDuration)
-	require.Equal(t, int64(1), ti.EmailLimit)
-	require.Equal(t, int64(1), ti.ReservationLimit)
-	require.Equal(t, int64(1), ti.AttachmentFileSizeLimit)
-	require.Equal(t, int64(1), ti.AttachmentTotalSizeLimit)
-	require.Equal(t, time.Second, ti.AttachmentExpiryDuration)
-	require.Equal(t, int64(1), ti.AttachmentBandwidthLimit)
-	require.Equal(t, "price_1", ti.StripeMonthlyPriceID)
-
-	// Cannot remove tier, since user has this tier
-	require.Error(t, a.RemoveTier("pro"))
-
-	// CAN remove this tier
-	require.Nil(t, a.RemoveTier("supporter"))
-
-	tiers, err = a.Tiers()
-	require.Nil(t, err)
-	require.Equal(t, 1, len(tiers))
-	require.Equal(t, "pro", tiers[0].Code)
-	require.Equal(t, "pro", tiers[0].Code)
+		policy, err := a.EscalationPolicy(db.ID)
+		require.Nil(t, err)
+		require.Equal(t, "db-alerts", policy.Topic)
+		require.Equal(t, EscalationPublish, policy.Steps[0].Type)
+		require.Equal(t, time.Duration(0), policy.Steps[0].Delay)
+
+		require.Nil(t, a.RemoveEscalationPolicy(db.ID))
+		require.Equal(t, ErrEscalationPolicyNotFound, a.RemoveEscalationPolicy(db.ID))
+		_, err = a.EscalationPolicy(db.ID)
+		require.Equal(t, ErrEscalationPolicyNotFound, err)
+	})
 }
 
-func TestAccount_Tier_Create_With_ID(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
+func TestManager_EscalationPolicies_Invalid(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		call := &EscalationStep{Type: EscalationCall, Target: "+12223334444"}
+		require.Equal(t, ErrInvalidArgument, a.AddEscalationPolicy(&EscalationPolicy{Topic: "", Steps: []*EscalationStep{call}}))
+		require.Equal(t, ErrInvalidArgument, a.AddEscalationPolicy(&EscalationPolicy{Topic: "pager"}))
+		require.Equal(t, ErrInvalidArgument, a.AddEscalationPolicy(&EscalationPolicy{Topic: "pager", Steps: []*EscalationStep{{Type: EscalationCall, Target: "12223334444"}}}))
+		require.Equal(t, ErrInvalidArgument, a.AddEscalationPolicy(&EscalationPolicy{Topic: "pager", Steps: []*EscalationStep{{Type: EscalationEmail, Target: "not an email"}}}))
+		require.Equal(t, ErrInvalidArgument, a.AddEscalationPolicy(&EscalationPolicy{Topic: "pager", Steps: []*EscalationStep{{Type: EscalationPublish, Target: "team*"}}}))
+		require.Equal(t, ErrInvalidArgument, a.AddEscalationPolicy(&EscalationPolicy{Topic: "pager", Steps: []*EscalationStep{{Type: "sms", Target: "+12223334444"}}}))
+		require.Equal(t, ErrInvalidArgument, a.AddEscalationPolicy(&EscalationPolicy{Topic: "pager", Steps: []*EscalationStep{{Delay: -time.Second, Type: EscalationCall, Target: "+12223334444"}}}))
+		require.Equal(t, ErrInvalidArgument, a.RemoveEscalationPolicy(""))
+	})
+}
 
-	require.Nil(t, a.AddTier(&Tier{
-		ID:   "ti_123",
-		Code: "pro",
-	}))
+func TestManager_GroupAccess(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		a.UseDirectory(&testDirectory{
+			passwords: map[string]string{"phil": "phil", "ben": "ben"},
+			groups: map[string][]string{
+				"phil": {"ops", "Domain Users"},
+				"ben":  {"Domain Users"},
+			},
+		}, time.Minute)
+		phil, err := a.Authenticate("phil", "phil") // Provisioned from the directory
+		require.Nil(t, err)
+		ben, err := a.Authenticate("ben", "ben")
+		require.Nil(t, err)
+		require.Nil(t, a.AllowAccess("group:ops", "al*", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("group:Domain Users", "alerts", PermissionRead))
+		require.Nil(t, a.AllowAccess("group:Domain Users", "secret", PermissionDenyAll))
+		require.Nil(t, a.AllowAccess(Everyone, "secret", PermissionRead))
+		require.Nil(t, a.AllowAccess(Everyone, "public", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("ben", "alerts", PermissionReadWrite))
+
+		// The most specific group entry wins
+		require.Nil(t, a.Authorize(phil, "alerts", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "alerts", PermissionWrite))
+		require.Nil(t, a.Authorize(phil, "alerts-prod", PermissionWrite))
+
+		// User entries take precedence over group entries
+		require.Nil(t, a.Authorize(ben, "alerts", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts-prod", PermissionRead))
+
+		// Group entries take precedence over Everyone entries, which still apply otherwise
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "secret", PermissionRead))
+		require.Nil(t, a.Authorize(nil, "secret", PermissionRead))
+		require.Nil(t, a.Authorize(phil, "public", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(nil, "alerts", PermissionRead))
+
+		// Grants
+		grants, err := a.Grants("group:Domain Users")
+		require.Nil(t, err)
+		require.Equal(t, []Grant{
+			{TopicPattern: "alerts", Allow: PermissionRead},
+			{TopicPattern: "secret", Allow: PermissionDenyAll},
+		}, grants)
+		allGrants, err := a.AllGroupGrants()
+		require.Nil(t, err)
+		require.Len(t, allGrants, 2)
+		require.Equal(t, []Grant{{TopicPattern: "al*", Allow: PermissionReadWrite}}, allGrants["ops"])
+
+		// Reset
+		require.Nil(t, a.ResetAccess("group:Domain Users", "secret"))
+		require.Nil(t, a.Authorize(phil, "secret", PermissionRead))
+		require.Nil(t, a.ResetAccess("group:ops", ""))
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "alerts-prod", PermissionWrite))
+		require.Nil(t, a.ResetAccess("", ""))
+		allGrants, err = a.AllGroupGrants()
+		require.Nil(t, err)
+		require.Empty(t, allGrants)
 
-	ti, err := a.Tier("pro")
-	require.Nil(t, err)
-	require.Equal(t, "ti_123", ti.ID)
+		// Invalid group names
+		require.Equal(t, ErrInvalidArgument, a.AllowAccess("group:", "alerts", PermissionRead))
+		require.Equal(t, ErrInvalidArgument, a.AllowAccess("group:a,b", "alerts", PermissionRead))
+		require.Equal(t, ErrInvalidArgument, a.ResetAccess("group:(ops)", ""))
+	})
 }
 
-func TestManager_Tier_Change_And_Reset(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
-
-	// Create tier and user
-	require.Nil(t, a.AddTier(&Tier{
-		Code:             "supporter",
-		Name:             "Supporter",
-		ReservationLimit: 3,
-	}))
-	require.Nil(t, a.AddTier(&Tier{
-		Code:             "pro",
-		Name:             "Pro",
-		ReservationLimit: 4,
-	}))
-	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
-	require.Nil(t, a.ChangeTier("phil", "pro"))
-
-	// Add 10 reservations (pro tier allows that)
-	for i := 0; i < 4; i++ {
-		require.Nil(t, a.AddReservation("phil", fmt.Sprintf("topic%d", i), PermissionWrite))
-	}
+func TestManager_Groups(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+		require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+		require.Nil(t, a.AddUser("emma", "emma", RoleUser))
+		require.Nil(t, a.AddGroup("oncall"))
+		require.Nil(t, a.AddGroup("ops"))
+		require.Equal(t, ErrGroupExists, a.AddGroup("ops"))
+		require.Nil(t, a.AddGroupMember("oncall", "phil"))
+		require.Nil(t, a.AddGroupMember("oncall", "ben"))
+		require.Nil(t, a.AddGroupMember("oncall", "ben")) // Already a member
+		require.Nil(t, a.AddGroupMember("ops", "phil"))
+		require.Nil(t, a.AllowAccess("group:oncall", "alerts*", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("group:ops", "alerts-db", PermissionRead))
+		require.Nil(t, a.AllowAccess("ben", "alerts-db", PermissionDenyAll))
+		require.Nil(t, a.AllowAccess(Everyone, "alerts-public", PermissionRead))
+
+		groups, err := a.Groups()
+		require.Nil(t, err)
+		require.Equal(t, []*Group{
+			{Name: "oncall", Members: []string{"ben", "phil"}},
+			{Name: "ops", Members: []string{"phil"}},
+		}, groups)
+		userGroups, err := a.UserGroups("phil")
+		require.Nil(t, err)
+		require.Equal(t, []string{"oncall", "ops"}, userGroups)
 
-	// Downgrading will not work (too many reservations)
-	require.Equal(t, ErrTooManyReservations, a.ChangeTier("phil", "supporter"))
+		phil, err := a.User("phil")
+		require.Nil(t, err)
+		ben, err := a.User("ben")
+		require.Nil(t, err)
+		emma, err := a.User("emma")
+		require.Nil(t, err)
 
-	// Downgrade after removing a reservation
-	require.Nil(t, a.RemoveReservations("phil", "topic0"))
-	require.Nil(t, a.ChangeTier("phil", "supporter"))
+		// User > group > everyone; among groups, the most specific entry wins
+		require.Nil(t, a.Authorize(phil, "alerts", PermissionWrite))
+		require.Nil(t, a.Authorize(ben, "alerts", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(emma, "alerts", PermissionRead))
+		require.Nil(t, a.Authorize(phil, "alerts-db", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "alerts-db", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts-db", PermissionRead))
+		require.Nil(t, a.Authorize(emma, "alerts-public", PermissionRead))
+		require.Nil(t, a.Authorize(phil, "alerts-public", PermissionWrite))
+
+		// Remove member
+		require.Nil(t, a.RemoveGroupMember("oncall", "ben"))
+		require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts", PermissionWrite))
+		group, err := a.Group("oncall")
+		require.Nil(t, err)
+		require.Equal(t, []string{"phil"}, group.Members)
+
+		// Remove group, including its access control entries
+		require.Nil(t, a.RemoveGroup("oncall"))
+		require.Equal(t, ErrGroupNotFound, a.RemoveGroup("oncall"))
+		_, err = a.Group("oncall")
+		require.Equal(t, ErrGroupNotFound, err)
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "alerts", PermissionWrite))
+		grants, err := a.Grants("group:oncall")
+		require.Nil(t, err)
+		require.Empty(t, grants)
 
-	// Resetting will not work (too many reservations)
-	require.Equal(t, ErrTooManyReservations, a.ResetTier("phil"))
+		// Removing a user removes its memberships
+		require.Nil(t, a.RemoveUser("phil"))
+		group, err = a.Group("ops")
+		require.Nil(t, err)
+		require.Empty(t, group.Members)
 
-	// Resetting after removing all reservations
-	require.Nil(t, a.RemoveReservations("phil", "topic1", "topic2", "topic3"))
-	require.Nil(t, a.ResetTier("phil"))
+		// Invalid
+		require.Equal(t, ErrGroupNotFound, a.AddGroupMember("nope", "ben"))
+		require.Equal(t, ErrUserNotFound, a.AddGroupMember("ops", "nope"))
+		require.Equal(t, ErrInvalidArgument, a.AddGroup("a,b"))
+		require.Equal(t, ErrInvalidArgument, a.AddGroupMember("ops", Everyone))
+	})
 }
 
-func TestUser_PhoneNumberAddListRemove(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
+func TestManager_Groups_ConflictingEntries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filename string) {
+		a := newTestManager(t, filename, PermissionDenyAll)
+		require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+		require.Nil(t, a.AddGroup("oncall"))
+		require.Nil(t, a.AddGroup("contractors"))
+		require.Nil(t, a.AddGroup("readers"))
+		require.Nil(t, a.AddGroupMember("oncall", "phil"))
+		require.Nil(t, a.AddGroupMember("contractors", "phil"))
+		require.Nil(t, a.AddGroupMember("readers", "phil"))
+		require.Nil(t, a.AllowAccess("group:oncall", "alerts*", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("group:contractors", "alerts*", PermissionDenyAll))
+		require.Nil(t, a.AllowAccess("group:oncall", "builds", PermissionReadWrite))
+		require.Nil(t, a.AllowAccess("group:readers", "builds", PermissionRead))
+		require.Nil(t, a.AllowAccess("group:contractors", "alerts-public", PermissionRead))
+		require.Nil(t, a.AllowAccess("group:readers", "reports", PermissionRead))
+		require.Nil(t, a.AllowAccess("group:oncall", "reports", PermissionWrite))
+
+		phil, err := a.User("phil")
+		require.Nil(t, err)
 
-	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
-	phil, err := a.User("phil")
-	require.Nil(t, err)
-	require.Nil(t, a.AddPhoneNumber(phil.ID, "+1234567890"))
+		// Deny wins over allow for equally specific entries of different groups
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "alerts-db", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "alerts-db", PermissionWrite))
+
+		// Only permissions granted by all equally specific entries apply
+		require.Nil(t, a.Authorize(phil, "builds", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "builds", PermissionWrite))
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "reports", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "reports", PermissionWrite))
+
+		// More specific entries still take precedence
+		require.Nil(t, a.Authorize(phil, "alerts-public", PermissionRead))
+		require.Equal(t, ErrUnauthorized, a.Authorize(phil, "alerts-public", PermissionWrite))
+	})
+}
 
-	phoneNumbers, err := a.PhoneNumbers(phil.ID)
+func TestManager_Groups_WithDirectory(t *testing.T) {
+	a := newTestManager(t, filepath.Join(t.TempDir(), "user.db"), PermissionDenyAll)
+	directory := &testDirectory{
+		passwords: map[string]string{"phil": "phil"},
+		groups: map[string][]string{
+			"phil": {"ops", "Domain Users"},
+			"ben":  {"Domain Users"},
+		},
+	}
+	a.UseDirectory(directory, time.Minute)
+	_, err := a.Authenticate("phil", "phil")
 	require.Nil(t, err)
-	require.Equal(t, 1, len(phoneNumbers))
-	require.Equal(t, "+1234567890", phoneNumbers[0])
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddGroup("oncall"))
+	require.Nil(t, a.AddGroup("ops"))
+	require.Nil(t, a.AddGroupMember("oncall", "phil"))
+	require.Nil(t, a.AddGroupMember("ops", "phil"))
+	require.Nil(t, a.AddGroupMember("oncall", "ben"))
 
-	require.Nil(t, a.RemovePhoneNumber(phil.ID, "+1234567890"))
-	phoneNumbers, err = a.PhoneNumbers(phil.ID)
+	// Local and directory groups are merged
+	groups, err := a.UserGroups("phil")
 	require.Nil(t, err)
-	require.Equal(t, 0, len(phoneNumbers))
+	require.Equal(t, []string{"oncall", "ops", "Domain Users"}, groups)
 
-	// Paranoia check: We do NOT want to keep phone numbers in there
-	rows, err := a.db.Query(`SELECT * FROM user_phone`)
+	// The directory is only queried for users provisioned from the directory
+	groups, err = a.UserGroups("ben")
 	require.Nil(t, err)
-	require.False(t, rows.Next())
-	require.Nil(t, rows.Close())
-}
+	require.Equal(t, []string{"oncall"}, groups)
+	require.Equal(t, 1, directory.lookups)
 
-func TestUser_PhoneNumberAdd_Multiple_Users_Same_Number(t *testing.T) {
-	a := newTestManager(t, PermissionDenyAll)
+	// If the directory fails, the cached groups are used, and the directory is not queried on every request
+	directory.err = errors.New("directory unavailable")
+	a.groups["phil"].next = time.Time{} // Expire cache
+	for i := 0; i < 3; i++ {
+		groups, err = a.UserGroups("phil")
+		require.Nil(t, err)
+		require.Equal(t, []string{"oncall", "ops", "Domain Users"}, groups)
+	}
+	require.Equal(t, 2, directory.lookups)
 
-	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
-	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
-	phil, err := a.User("phil")
+	// Without cached groups, only the local groups apply
+	directory.passwords["emma"] = "emma"
+	_, err = a.Authenticate("emma", "emma")
 	require.Nil(t, err)
-	ben, err := a.User("ben")
+	require.Nil(t, a.AddGroupMember("oncall", "emma"))
+	groups, err = a.UserGroups("emma")
 	require.Nil(t, err)
-	require.Nil(t, a.AddPhoneNumber(phil.ID, "+1234567890"))
-	require.Nil(t, a.AddPhoneNumber(ben.ID, "+1234567890"))
-}
-
-func TestManager_Topic_Wildcard_With_Asterisk_Underscore(t *testing.T) {
-	f := filepath.Join(t.TempDir(), "user.db")
-	a := newTestManagerFromFile(t, f, "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
-	require.Nil(t, a.AllowAccess(Everyone, "*_", PermissionRead))
-	require.Nil(t, a.AllowAccess(Everyone, "__*_", PermissionRead))
-	require.Nil(t, a.Authorize(nil, "allowed_", PermissionRead))
-	require.Nil(t, a.Authorize(nil, "__allowed_", PermissionRead))
-	require.Nil(t, a.Authorize(nil, "_allowed_", PermissionRead)) // The "%" in "%\_" matches the first "_"
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "notallowed", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "_notallowed", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "__notallowed", PermissionRead))
-}
-
-func TestManager_Topic_Wildcard_With_Underscore(t *testing.T) {
-	f := filepath.Join(t.TempDir(), "user.db")
-	a := newTestManagerFromFile(t, f, "", PermissionDenyAll, DefaultUserPasswordBcryptCost, DefaultUserStatsQueueWriterInterval)
-	require.Nil(t, a.AllowAccess(Everyone, "mytopic_", PermissionReadWrite))
-	require.Nil(t, a.Authorize(nil, "mytopic_", PermissionRead))
-	require.Nil(t, a.Authorize(nil, "mytopic_", PermissionWrite))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "mytopicX", PermissionRead))
-	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "mytopicX", PermissionWrite))
+	require.Equal(t, []string{"oncall"}, groups)
 }
 
-func TestToFromSQLWildcard(t *testing.T) {
-	require.Equal(t, "up%", toSQLWildcard("up*"))
-	require.Equal(t, "up\\_%", toSQLWildcard("up_*"))
-	require.Equal(t, "foo", toSQLWildcard("foo"))
+func TestManager_Directory_Authenticate(t *testing.T) {
+	server := newTestLDAPServer(t)
+	a := newTestManager(t, filepath.Join(t.TempDir(), "user.db"), PermissionDenyAll)
+	a.UseDirectory(server.directory(t), time.Minute)
+	require.Nil(t, a.AddUser("ben", "localpass", RoleUser))
 
-	require.Equal(t, "up*", fromSQLWildcard("up%"))
-	require.Equal(t, "up_*", fromSQLWildcard("up\\_%"))
-	require.Equal(t, "foo", fromSQLWildcard("foo"))
+	// Directory users are created on first login
+	_, err := a.User("phil")
+	require.Equal(t, ErrUserNotFound, err)
+	phil, err := a.Authenticate("phil", "philpass")
+	require.Nil(t, err)
+	require.Equal(t, "phil", phil.Name)
+	require.Equal(t, RoleUser, phil.Role)
+	phil2, err := a.Authenticate("phil", "philpass")
+	require.Nil(t, err)
+	require.Equal(t, phil.ID, phil2.ID)
+	_, err = a.Authenticate("phil", "wrong")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("nobody", "philpass")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.User("nobody")
+	require.Equal(t, ErrUserNotFound, err)
 
-	require.Equal(t, "up*", fromSQLWildcard(toSQLWildcard("up*")))
-	require.Equal(t, "up_*", fromSQLWildcard(toSQLWildcard("up_*")))
-	require.Equal(t, "foo", fromSQLWildcard(toSQLWildcard("foo")))
+	// Local users take precedence, they are never authenticated against the directory
+	ben, err := a.Authenticate("ben", "localpass")
+	require.Nil(t, err)
+	require.Equal(t, ProviderLocal, ben.Provider)
+	_, err = a.Authenticate("ben", "benpass")
+	require.Equal(t, ErrUnauthenticated, err)
+	require.Equal(t, ProviderLDAP, phil.Provider)
+
+	// Group entries apply, and groups are cached (one user and one group search). Groups of local users
+	// are not looked up in the directory.
+	require.Nil(t, a.AllowAccess("group:ops", "alerts", PermissionReadWrite))
+	searches := server.searches.Load()
+	require.Nil(t, a.Authorize(phil, "alerts", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts", PermissionRead))
+	require.Nil(t, a.Authorize(phil, "alerts", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts", PermissionRead))
+	require.Equal(t, searches+2, server.searches.Load())
+
+	// Local users still work if the directory is not available
+	server.listener.Close()
+	_, err = a.Authenticate("ben", "localpass")
+	require.Nil(t, err)
+	_, err = a.Authenticate("phil", "philpass")
+	require.Equal(t, ErrUnauthenticated, err)
+	require.Nil(t, a.Authorize(phil, "alerts", PermissionWrite)) // Groups are still cached
 }
 
 func TestMigrationFrom1(t *testing.T) {
@@ -1122,7 +1917,7 @@ func TestMigrationFrom1(t *testing.T) {
 
 	// Create manager to trigger migration
 	a := newTestManagerFromFile(t, filename, "", PermissionDenyAll, bcrypt.MinCost, DefaultUserStatsQueueWriterInterval)
-	checkSchemaVersion(t, a.db)
+	checkSchemaVersion(t, testDB(a).db)
 
 	users, err := a.Users()
 	require.Nil(t, err)
@@ -1265,7 +2060,7 @@ func TestMigrationFrom4(t *testing.T) {
 
 	// Create manager to trigger migration
 	a := newTestManagerFromFile(t, filename, "", PermissionDenyAll, bcrypt.MinCost, DefaultUserStatsQueueWriterInterval)
-	checkSchemaVersion(t, a.db)
+	checkSchemaVersion(t, testDB(a).db)
 
 	// Add another
 	require.Nil(t, a.AllowAccess(Everyone, "left_*", PermissionReadWrite))
@@ -1321,8 +2116,8 @@ func checkSchemaVersion(t *testing.T, db *sql.DB) {
 	require.Nil(t, rows.Close())
 }
 
-func newTestManager(t *testing.T, defaultAccess Permission) *Manager {
-	return newTestManagerFromFile(t, filepath.Join(t.TempDir(), "user.db"), "", defaultAccess, bcrypt.MinCost, DefaultUserStatsQueueWriterInterval)
+func newTestManager(t *testing.T, filename string, defaultAccess Permission) *Manager {
+	return newTestManagerFromFile(t, filename, "", defaultAccess, bcrypt.MinCost, DefaultUserStatsQueueWriterInterval)
 }
 
 func newTestManagerFromFile(t *testing.T, filename, startupQueries string, defaultAccess Permission, bcryptCost int, statsWriterInterval time.Duration) *Manager {
@@ -1330,3 +2125,104 @@ func newTestManagerFromFile(t *testing.T, filename, startupQueries string, defau
 	require.Nil(t, err)
 	return a
 }
+
+// forEachBackend runs the given test function against a SQLite database file, and against a PostgreSQL
+// database (as a subtest each). The filename passed to the function is either a SQLite filename, or a
+// PostgreSQL connection URL; both can be passed to NewManager. The PostgreSQL subtest is skipped
+// unless NTFY_TEST_DATABASE_URL is set.
+func forEachBackend(t *testing.T, f func(t *testing.T, filename string)) {
+	t.Run("sqlite", func(t *testing.T) {
+		f(t, filepath.Join(t.TempDir(), "user.db"))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		f(t, newPostgresTestDSN(t))
+	})
+}
+
+// newPostgresTestDSN returns a connection URL pointing to a new, empty schema in the PostgreSQL database
+// defined by NTFY_TEST_DATABASE_URL. The schema is dropped after the test. If the environment variable
+// is not set, the test is skipped.
+func newPostgresTestDSN(t *testing.T) string {
+	dsn := os.Getenv("NTFY_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("NTFY_TEST_DATABASE_URL not set, skipping PostgreSQL test")
+	}
+	schema := util.RandomLowerStringPrefix("ntfy_test_", 10)
+	db, err := sql.Open("pgx", dsn)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		db.Exec(fmt.Sprintf("DROP SCHEMA %s CASCADE", schema))
+		db.Close()
+	})
+	_, err = db.Exec(fmt.Sprintf("CREATE SCHEMA %s", schema))
+	require.Nil(t, err)
+	u, err := url.Parse(dsn)
+	require.Nil(t, err)
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// testDatabase gives tests direct access to the database behind a Manager. Queries use '?' placeholders,
+// which are converted for PostgreSQL. To work with both backends, the "user" table must be quoted.
+type testDatabase struct {
+	db       *sql.DB
+	postgres bool
+}
+
+func testDB(a *Manager) *testDatabase {
+	store := a.store.(*sqlStore)
+	return &testDatabase{
+		db:       store.db,
+		postgres: store.queries == postgresQueries,
+	}
+}
+
+func (d *testDatabase) Exec(query string, args ...any) (sql.Result, error) {
+	return d.db.Exec(d.rebind(query), args...)
+}
+
+func (d *testDatabase) Query(query string, args ...any) (*sql.Rows, error) {
+	return d.db.Query(d.rebind(query), args...)
+}
+
+func (d *testDatabase) rebind(query string) string {
+	if !d.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString(fmt.Sprintf("$%d", n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// testDirectory is a Directory with fixed groups, and no users
+type testDirectory struct {
+	passwords map[string]string
+	groups    map[string][]string
+	err       error // Returned by Groups, if set
+	lookups   int   // Number of calls to Groups
+}
+
+func (d *testDirectory) Authenticate(username, password string) error {
+	if p, ok := d.passwords[username]; ok && p == password {
+		return nil
+	}
+	return ErrUnauthenticated
+}
+
+func (d *testDirectory) Groups(username string) ([]string, error) {
+	d.lookups++
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.groups[username], nil
+}
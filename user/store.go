@@ -0,0 +1,1713 @@
+package user
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Store is the storage backend behind the Manager. It persists users, tokens, access control entries,
+// reservations, phone numbers and tiers. Business logic (password hashing, input validation, limits, etc.)
+// lives in the Manager; the Store only reads and writes data.
+//
+// Topic patterns passed to and returned from the Store use the ntfy wildcard syntax ("*").
+type Store interface {
+	// User returns the user with the given username, or ErrUserNotFound
+	User(username string) (*User, error)
+
+	// UserByID returns the user with the given user ID, or ErrUserNotFound
+	UserByID(id string) (*User, error)
+
+	// UserByToken returns the user the given (non-expired) token belongs to, or ErrUserNotFound
+	UserByToken(token string) (*User, error)
+
+	// UserByStripeCustomer returns the user with the given Stripe customer ID, or ErrUserNotFound
+	UserByStripeCustomer(stripeCustomerID string) (*User, error)
+
+	// Users returns all users, ordered by role and username, including the Everyone user
+	Users() ([]*User, error)
+
+	// UsersCount returns the number of users, including the Everyone user
+	UsersCount() (int64, error)
+
+	// UserByProviderID returns the user provisioned from the given identity provider with the given
+	// provider-specific ID, or ErrUserNotFound
+	UserByProviderID(provider Provider, providerID string) (*User, error)
+
+	// AddUser inserts a new user, or returns ErrUserExists if a user with that name (or provider ID) already exists
+	AddUser(id, username, hash string, role Role, syncTopic string, provider Provider, providerID string) error
+
+	// RemoveUser deletes the user with the given username, including tokens, grants, etc.
+	RemoveUser(username string) error
+
+	// MarkUserRemoved removes all grants, tokens and webhooks of the user, and marks it to be deleted at the given time
+	MarkUserRemoved(user *User, deleteAfter time.Time) error
+
+	// RemoveDeletedUsers deletes all users whose deletion time has passed
+	RemoveDeletedUsers() error
+
+	// ChangePassword updates the password hash of a user
+	ChangePassword(username, hash string) error
+
+	// ChangeRole updates the role of a user
+	ChangeRole(username string, role Role) error
+
+	// ChangeAllowedIPs updates the IP ranges a user can log in from; an empty list allows all
+	ChangeAllowedIPs(username string, allowedIPs []netip.Prefix) error
+
+	// ChangeSettings persists the user preferences
+	ChangeSettings(userID string, prefs *Prefs) error
+
+	// ChangeTier sets the tier of a user, using the tier code
+	ChangeTier(username, tierCode string) error
+
+	// ResetTier removes the tier from a user
+	ResetTier(username string) error
+
+	// ChangeBilling updates the billing fields of a user
+	ChangeBilling(username string, billing *Billing) error
+
+	// UpdateStats writes the stats for the given users (user ID -> stats)
+	UpdateStats(stats map[string]*Stats) error
+
+	// ResetStats resets the stats of all users
+	ResetStats() error
+
+	// CreateToken stores a new token, and prunes the oldest tokens of the user if there are more than maxCount
+	CreateToken(userID string, token *Token, maxCount int) error
+
+	// Tokens returns all tokens of the user with the given user ID
+	Tokens(userID string) ([]*Token, error)
+
+	// Token returns a specific token of a user, or ErrTokenNotFound
+	Token(userID, token string) (*Token, error)
+
+	// ChangeToken updates the label and/or expiry date of a token, if non-nil
+	ChangeToken(userID, token string, label *string, expires *time.Time) error
+
+	// ChangeTokenAllowedIPs updates the IP ranges a token can be used from; an empty list allows all
+	ChangeTokenAllowedIPs(userID, token string, allowedIPs []netip.Prefix) error
+
+	// RemoveToken deletes a token of a user
+	RemoveToken(userID, token string) error
+
+	// RemoveExpiredTokens deletes all expired tokens
+	RemoveExpiredTokens() error
+
+	// UpdateTokenLastAccess writes the last access time and origin for the given tokens (token -> update)
+	UpdateTokenLastAccess(updates map[string]*TokenUpdate) error
+
+	// TopicPermission returns the most specific access control entry matching the given topic, preferring
+	// entries of the given user over entries of the given groups, and those over entries of the Everyone
+	// user. If no entry matches, found is false.
+	TopicPermission(username string, groups []string, topic string) (read, write, found bool, err error)
+
+	// AllGrants returns all access control entries, mapped to their respective user IDs
+	AllGrants() (map[string][]Grant, error)
+
+	// Grants returns all access control entries of a user
+	Grants(username string) ([]Grant, error)
+
+	// AllowAccess adds or updates an access control entry. The owner may be a username, or empty.
+	AllowAccess(username, topicPattern string, read, write bool, owner string) error
+
+	// ResetAccess removes the access control entry for a username/topic, all entries of a user (if
+	// topicPattern is empty), or all entries entirely (if both are empty)
+	ResetAccess(username, topicPattern string) error
+
+	// AllGroupGrants returns all group access control entries, mapped to their respective group names
+	AllGroupGrants() (map[string][]Grant, error)
+
+	// GroupGrants returns all access control entries of a group
+	GroupGrants(group string) ([]Grant, error)
+
+	// AllowGroupAccess adds or updates an access control entry for a group
+	AllowGroupAccess(group, topicPattern string, read, write bool) error
+
+	// ResetGroupAccess removes the access control entry for a group/topic, all entries of a group (if
+	// topicPattern is empty), or all group entries entirely (if both are empty)
+	ResetGroupAccess(group, topicPattern string) error
+
+	// AddGroup inserts a new local group, or returns ErrGroupExists
+	AddGroup(name string) error
+
+	// RemoveGroup deletes a local group, including its members and access control entries, or returns ErrGroupNotFound
+	RemoveGroup(name string) error
+
+	// Groups returns all local groups and their members, ordered by name
+	Groups() ([]*Group, error)
+
+	// Group returns the local group with the given name and its members, or ErrGroupNotFound
+	Group(name string) (*Group, error)
+
+	// AddGroupMember adds a user to a local group; adding an existing member is not an error
+	AddGroupMember(group, username string) error
+
+	// RemoveGroupMember removes a user from a local group
+	RemoveGroupMember(group, username string) error
+
+	// UserGroups returns the names of the local groups the user is a member of, ordered by name
+	UserGroups(username string) ([]string, error)
+
+	// AddReservation creates the owner and Everyone access control entries for a reserved topic
+	AddReservation(username, topic string, everyone Permission) error
+
+	// RemoveReservations deletes the owner and Everyone access control entries for the given topics
+	RemoveReservations(username string, topics ...string) error
+
+	// Reservations returns all topics owned by the user, and the associated Everyone access
+	Reservations(username string) ([]Reservation, error)
+
+	// HasReservation returns true if the given topic is owned by the user
+	HasReservation(username, topic string) (bool, error)
+
+	// ReservationsCount returns the number of topics owned by the user
+	ReservationsCount(username string) (int64, error)
+
+	// ReservationOwner returns the user ID of the owner of the topic, or an empty string
+	ReservationOwner(topic string) (string, error)
+
+	// OtherAccessCount returns the number of access control entries matching the topic that are not owned by the user
+	OtherAccessCount(username, topic string) (int, error)
+
+	// PhoneNumbers returns all phone numbers of a user
+	PhoneNumbers(userID string) ([]string, error)
+
+	// AddPhoneNumber adds a phone number to a user, or returns ErrPhoneNumberExists
+	AddPhoneNumber(userID, phoneNumber string) error
+
+	// RemovePhoneNumber removes a phone number from a user
+	RemovePhoneNumber(userID, phoneNumber string) error
+
+	// AddTier inserts a new tier
+	AddTier(tier *Tier) error
+
+	// UpdateTier updates a tier, identified by its code
+	UpdateTier(tier *Tier) error
+
+	// RemoveTier deletes a tier; this fails if any user has this tier
+	RemoveTier(code string) error
+
+	// Tiers returns all tiers
+	Tiers() ([]*Tier, error)
+
+	// Tier returns the tier with the given code, or ErrTierNotFound
+	Tier(code string) (*Tier, error)
+
+	// TierByStripePrice returns the tier with the given Stripe monthly or yearly price ID, or ErrTierNotFound
+	TierByStripePrice(priceID string) (*Tier, error)
+
+	// AddWebhook inserts a new webhook
+	AddWebhook(webhook *Webhook) error
+
+	// Webhooks returns all webhooks of the user with the given user ID, including their delivery status
+	Webhooks(userID string) ([]*Webhook, error)
+
+	// WebhooksByTopic returns all webhooks for the given topic, regardless of the owner. The Pending field is not set.
+	WebhooksByTopic(topic string) ([]*Webhook, error)
+
+	// WebhooksCount returns the number of webhooks of the user with the given user ID
+	WebhooksCount(userID string) (int64, error)
+
+	// RemoveWebhook deletes a webhook of a user, including its queued deliveries, or returns ErrWebhookNotFound
+	RemoveWebhook(userID, webhookID string) error
+
+	// AddWebhookDeliveries adds deliveries to the webhook delivery queue
+	AddWebhookDeliveries(deliveries []*WebhookDelivery) error
+
+	// WebhookDeliveriesDue returns up to limit queued deliveries whose next attempt is due, oldest first
+	WebhookDeliveriesDue(now time.Time, limit int) ([]*WebhookDelivery, error)
+
+	// MarkWebhookDelivered removes a delivery from the queue, and resets the failure status of its webhook
+	MarkWebhookDelivered(delivery *WebhookDelivery, deliveredAt time.Time) error
+
+	// MarkWebhookDeliveryFailed records a failed attempt for the webhook, and reschedules the delivery
+	// to the given time. If nextAttempt is zero, the delivery is removed from the queue.
+	MarkWebhookDeliveryFailed(delivery *WebhookDelivery, attemptedAt time.Time, reason string, nextAttempt time.Time) error
+
+	// AddRule inserts a new routing rule
+	AddRule(rule *Rule) error
+
+	// Rules returns all routing rules, oldest first
+	Rules() ([]*Rule, error)
+
+	// RulesForTopic returns all routing rules whose topic pattern matches the given topic, oldest first
+	RulesForTopic(topic string) ([]*Rule, error)
+
+	// RemoveRule deletes a routing rule, or returns ErrRuleNotFound
+	RemoveRule(id string) error
+
+	// AddEscalationPolicy inserts a new escalation policy
+	AddEscalationPolicy(policy *EscalationPolicy) error
+
+	// EscalationPolicies returns all escalation policies, oldest first
+	EscalationPolicies() ([]*EscalationPolicy, error)
+
+	// EscalationPoliciesForTopic returns all escalation policies whose topic pattern matches the given topic, oldest first
+	EscalationPoliciesForTopic(topic string) ([]*EscalationPolicy, error)
+
+	// EscalationPolicy returns the escalation policy with the given ID, or ErrEscalationPolicyNotFound
+	EscalationPolicy(id string) (*EscalationPolicy, error)
+
+	// RemoveEscalationPolicy deletes an escalation policy, or returns ErrEscalationPolicyNotFound
+	RemoveEscalationPolicy(id string) error
+
+	// Close closes the underlying database
+	Close() error
+}
+
+// storeQueries holds the dialect-specific queries used by the sqlStore. All queries for a given
+// operation must take the same arguments in the same order in all dialects.
+type storeQueries struct {
+	selectUserByID                  string
+	selectUserByName                string
+	selectUserByToken               string
+	selectUserByStripeCustomerID    string
+	selectUserByProviderID          string
+	selectTopicPerms                string
+	insertUser                      string
+	selectUsernames                 string
+	selectUserCount                 string
+	updateUserPass                  string
+	updateUserRole                  string
+	updateUserAllowedIPs            string
+	updateUserPrefs                 string
+	updateUserStats                 string
+	updateUserStatsResetAll         string
+	updateUserDeleted               string
+	deleteUsersMarked               string
+	deleteUser                      string
+	upsertUserAccess                string
+	selectUserAllAccess             string
+	selectUserAccess                string
+	selectUserReservations          string
+	selectUserReservationsCount     string
+	selectUserReservationsOwner     string
+	selectUserHasReservation        string
+	selectOtherAccessCount          string
+	deleteAllAccess                 string
+	deleteUserAccess                string
+	deleteTopicAccess               string
+	selectGroupTopicPerms           string
+	upsertGroupAccess               string
+	selectGroupAllAccess            string
+	selectGroupAccess               string
+	deleteAllGroupAccess            string
+	deleteGroupAccess               string
+	deleteGroupTopicAccess          string
+	insertGroup                     string
+	deleteGroup                     string
+	selectGroups                    string
+	selectGroup                     string
+	insertGroupMember               string
+	deleteGroupMember               string
+	deleteUserGroupMembers          string
+	selectUserGroups                string
+	selectTokenCount                string
+	selectTokens                    string
+	selectToken                     string
+	insertToken                     string
+	updateTokenExpiry               string
+	updateTokenLabel                string
+	updateTokenAllowedIPs           string
+	updateTokenLastAccess           string
+	deleteToken                     string
+	deleteAllToken                  string
+	deleteExpiredTokens             string
+	deleteExcessTokens              string
+	selectPhoneNumbers              string
+	insertPhoneNumber               string
+	deletePhoneNumber               string
+	insertTier                      string
+	updateTier                      string
+	selectTiers                     string
+	selectTierByCode                string
+	selectTierByPriceID             string
+	updateUserTier                  string
+	deleteUserTier                  string
+	deleteTier                      string
+	updateBilling                   string
+	insertWebhook                   string
+	selectWebhooks                  string
+	selectWebhooksByTopic           string
+	selectWebhookCount              string
+	updateWebhookSuccess            string
+	updateWebhookFailure            string
+	deleteWebhook                   string
+	deleteAllWebhooks               string
+	insertWebhookDelivery           string
+	selectWebhookDeliveriesDue      string
+	updateWebhookDelivery           string
+	deleteWebhookDelivery           string
+	insertRule                      string
+	selectRules                     string
+	selectRulesByTopic              string
+	deleteRule                      string
+	insertEscalationPolicy          string
+	selectEscalationPolicies        string
+	selectEscalationPoliciesByTopic string
+	selectEscalationPolicy          string
+	deleteEscalationPolicy          string
+}
+
+// sqlStore is a Store implementation backed by a database/sql database. The SQL dialect is
+// defined by the queries, and by the function that detects unique constraint violations.
+type sqlStore struct {
+	db                *sql.DB
+	queries           *storeQueries
+	isUniqueViolation func(err error) bool
+}
+
+var _ Store = (*sqlStore)(nil)
+
+func (s *sqlStore) User(username string) (*User, error) {
+	rows, err := s.db.Query(s.queries.selectUserByName, username)
+	if err != nil {
+		return nil, err
+	}
+	return s.readUser(rows)
+}
+
+func (s *sqlStore) UserByID(id string) (*User, error) {
+	rows, err := s.db.Query(s.queries.selectUserByID, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.readUser(rows)
+}
+
+func (s *sqlStore) UserByToken(token string) (*User, error) {
+	rows, err := s.db.Query(s.queries.selectUserByToken, token, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return s.readUser(rows)
+}
+
+func (s *sqlStore) UserByStripeCustomer(stripeCustomerID string) (*User, error) {
+	rows, err := s.db.Query(s.queries.selectUserByStripeCustomerID, stripeCustomerID)
+	if err != nil {
+		return nil, err
+	}
+	return s.readUser(rows)
+}
+
+func (s *sqlStore) UserByProviderID(provider Provider, providerID string) (*User, error) {
+	rows, err := s.db.Query(s.queries.selectUserByProviderID, string(provider), providerID)
+	if err != nil {
+		return nil, err
+	}
+	return s.readUser(rows)
+}
+
+func (s *sqlStore) Users() ([]*User, error) {
+	rows, err := s.db.Query(s.queries.selectUsernames)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usernames := make([]string, 0)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	rows.Close()
+	users := make([]*User, 0)
+	for _, username := range usernames {
+		user, err := s.User(username)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (s *sqlStore) UsersCount() (int64, error) {
+	rows, err := s.db.Query(s.queries.selectUserCount)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errNoRows
+	}
+	var count int64
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *sqlStore) AddUser(id, username, hash string, role Role, syncTopic string, provider Provider, providerID string) error {
+	if _, err := s.db.Exec(s.queries.insertUser, id, username, hash, string(role), syncTopic, string(provider), providerID, time.Now().Unix()); err != nil {
+		if s.isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) RemoveUser(username string) error {
+	// Rows in user_access, user_token, etc. are deleted via foreign keys
+	if _, err := s.db.Exec(s.queries.deleteUser, username); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) MarkUserRemoved(user *User, deleteAfter time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.queries.deleteUserAccess, user.Name, user.Name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.queries.deleteAllToken, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.queries.deleteUserGroupMembers, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.queries.deleteAllWebhooks, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.queries.updateUserDeleted, deleteAfter.Unix(), user.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) RemoveDeletedUsers() error {
+	if _, err := s.db.Exec(s.queries.deleteUsersMarked, time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) ChangePassword(username, hash string) error {
+	if _, err := s.db.Exec(s.queries.updateUserPass, hash, username); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) ChangeRole(username string, role Role) error {
+	if _, err := s.db.Exec(s.queries.updateUserRole, string(role), username); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) ChangeAllowedIPs(username string, allowedIPs []netip.Prefix) error {
+	if _, err := s.db.Exec(s.queries.updateUserAllowedIPs, AllowedIPsString(allowedIPs), username); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) ChangeSettings(userID string, prefs *Prefs) error {
+	b, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(s.queries.updateUserPrefs, string(b), userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) ChangeTier(username, tierCode string) error {
+	if _, err := s.db.Exec(s.queries.updateUserTier, tierCode, username); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) ResetTier(username string) error {
+	_, err := s.db.Exec(s.queries.deleteUserTier, username)
+	return err
+}
+
+func (s *sqlStore) ChangeBilling(username string, billing *Billing) error {
+	if _, err := s.db.Exec(s.queries.updateBilling, nullString(billing.StripeCustomerID), nullString(billing.StripeSubscriptionID), nullString(string(billing.StripeSubscriptionStatus)), nullString(string(billing.StripeSubscriptionInterval)), nullInt64(billing.StripeSubscriptionPaidUntil.Unix()), nullInt64(billing.StripeSubscriptionCancelAt.Unix()), username); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) UpdateStats(stats map[string]*Stats) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for userID, update := range stats {
+		log.
+			Tag(tag).
+			Fields(log.Context{
+				"user_id":        userID,
+				"messages_count": update.Messages,
+				"emails_count":   update.Emails,
+				"calls_count":    update.Calls,
+			}).
+			Trace("Updating stats for user %s", userID)
+		if _, err := tx.Exec(s.queries.updateUserStats, update.Messages, update.Emails, update.Calls, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ResetStats() error {
+	if _, err := s.db.Exec(s.queries.updateUserStatsResetAll); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) CreateToken(userID string, token *Token, maxCount int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.queries.insertToken, userID, token.Value, token.Label, token.LastAccess.Unix(), token.LastOrigin.String(), token.Expires.Unix(), token.Scope.String(), AllowedIPsString(token.AllowedIPs)); err != nil {
+		return err
+	}
+	rows, err := tx.Query(s.queries.selectTokenCount, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return errNoRows
+	}
+	var tokenCount int
+	if err := rows.Scan(&tokenCount); err != nil {
+		return err
+	}
+	rows.Close()
+	if tokenCount >= maxCount {
+		// This pruning logic is done in two queries for efficiency. The SELECT above is a lookup
+		// on two indices, whereas the query below is a full table scan.
+		if _, err := tx.Exec(s.queries.deleteExcessTokens, userID, userID, maxCount); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Tokens(userID string) ([]*Token, error) {
+	rows, err := s.db.Query(s.queries.selectTokens, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]*Token, 0)
+	for {
+		token, err := s.readToken(rows)
+		if err == ErrTokenNotFound {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (s *sqlStore) Token(userID, token string) (*Token, error) {
+	rows, err := s.db.Query(s.queries.selectToken, userID, token)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return s.readToken(rows)
+}
+
+func (s *sqlStore) readToken(rows *sql.Rows) (*Token, error) {
+	var token, label, lastOrigin, scope, allowedIPs string
+	var lastAccess, expires int64
+	if !rows.Next() {
+		return nil, ErrTokenNotFound
+	}
+	if err := rows.Scan(&token, &label, &lastAccess, &lastOrigin, &expires, &scope, &allowedIPs); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	lastOriginIP, err := netip.ParseAddr(lastOrigin)
+	if err != nil {
+		lastOriginIP = netip.IPv4Unspecified()
+	}
+	tokenScope, err := ParseTokenScope([]string{scope})
+	if err != nil {
+		return nil, err
+	}
+	tokenAllowedIPs, err := ParseAllowedIPs([]string{allowedIPs})
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		Value:      token,
+		Label:      label,
+		LastAccess: time.Unix(lastAccess, 0),
+		LastOrigin: lastOriginIP,
+		Expires:    time.Unix(expires, 0),
+		Scope:      tokenScope,
+		AllowedIPs: tokenAllowedIPs,
+	}, nil
+}
+
+func (s *sqlStore) ChangeToken(userID, token string, label *string, expires *time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if label != nil {
+		if _, err := tx.Exec(s.queries.updateTokenLabel, *label, userID, token); err != nil {
+			return err
+		}
+	}
+	if expires != nil {
+		if _, err := tx.Exec(s.queries.updateTokenExpiry, expires.Unix(), userID, token); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ChangeTokenAllowedIPs(userID, token string, allowedIPs []netip.Prefix) error {
+	if _, err := s.db.Exec(s.queries.updateTokenAllowedIPs, AllowedIPsString(allowedIPs), userID, token); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) RemoveToken(userID, token string) error {
+	if _, err := s.db.Exec(s.queries.deleteToken, userID, token); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) RemoveExpiredTokens() error {
+	if _, err := s.db.Exec(s.queries.deleteExpiredTokens, time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) UpdateTokenLastAccess(updates map[string]*TokenUpdate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for tokenID, update := range updates {
+		log.Tag(tag).Trace("Updating token %s with last access time %v", tokenID, update.LastAccess.Unix())
+		if _, err := tx.Exec(s.queries.updateTokenLastAccess, update.LastAccess.Unix(), update.LastOrigin.String(), tokenID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) TopicPermission(username string, groups []string, topic string) (read, write, found bool, err error) {
+	// Select the read/write permissions for this user/topic combo.
+	// - The query may return two rows (one for everyone, and one for the user), but prioritizes the user.
+	// - Furthermore, the query prioritizes more specific permissions (longer!) over more generic ones, e.g. "test*" > "*"
+	// - It also prioritizes write permissions over read permissions
+	// - If the best match is not the user's own, group entries take precedence over the Everyone entry
+	rows, err := s.db.Query(s.queries.selectTopicPerms, Everyone, username, topic)
+	if err != nil {
+		return false, false, false, err
+	}
+	defer rows.Close()
+	var name string
+	if rows.Next() {
+		if err := rows.Scan(&name, &read, &write); err != nil {
+			return false, false, false, err
+		}
+		found = true
+	}
+	if err := rows.Err(); err != nil {
+		return false, false, false, err
+	}
+	rows.Close()
+	if found && name == username && username != Everyone {
+		return read, write, true, nil
+	} else if len(groups) > 0 {
+		groupRead, groupWrite, groupFound, err := s.groupTopicPermission(groups, topic)
+		if err != nil {
+			return false, false, false, err
+		} else if groupFound {
+			return groupRead, groupWrite, true, nil
+		}
+	}
+	return read, write, found, nil
+}
+
+// groupTopicPermission returns the most specific access control entry of any of the given groups matching
+// the topic. Like for users, longer topic patterns take precedence. If several groups have entries with equally
+// specific patterns, deny wins, i.e. a permission is only granted if all of these entries grant it.
+func (s *sqlStore) groupTopicPermission(groups []string, topic string) (read, write, found bool, err error) {
+	rows, err := s.db.Query(s.queries.selectGroupTopicPerms, topic)
+	if err != nil {
+		return false, false, false, err
+	}
+	defer rows.Close()
+	specificity := -1
+	for rows.Next() {
+		var group string
+		var length int
+		var groupRead, groupWrite bool
+		if err := rows.Scan(&group, &length, &groupRead, &groupWrite); err != nil {
+			return false, false, false, err
+		} else if !util.Contains(groups, group) {
+			continue
+		} else if found && length < specificity {
+			break // Rows are ordered by specificity, so all remaining entries are less specific
+		}
+		if !found {
+			read, write, found, specificity = groupRead, groupWrite, true, length
+		} else {
+			read, write = read && groupRead, write && groupWrite
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, false, false, err
+	}
+	return read, write, found, nil
+}
+
+func (s *sqlStore) AllGrants() (map[string][]Grant, error) {
+	rows, err := s.db.Query(s.queries.selectUserAllAccess)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grants := make(map[string][]Grant, 0)
+	for rows.Next() {
+		var userID, topic string
+		var read, write bool
+		if err := rows.Scan(&userID, &topic, &read, &write); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if _, ok := grants[userID]; !ok {
+			grants[userID] = make([]Grant, 0)
+		}
+		grants[userID] = append(grants[userID], Grant{
+			TopicPattern: fromSQLWildcard(topic),
+			Allow:        NewPermission(read, write),
+		})
+	}
+	return grants, nil
+}
+
+func (s *sqlStore) Grants(username string) ([]Grant, error) {
+	rows, err := s.db.Query(s.queries.selectUserAccess, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grants := make([]Grant, 0)
+	for rows.Next() {
+		var topic string
+		var read, write bool
+		if err := rows.Scan(&topic, &read, &write); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		grants = append(grants, Grant{
+			TopicPattern: fromSQLWildcard(topic),
+			Allow:        NewPermission(read, write),
+		})
+	}
+	return grants, nil
+}
+
+func (s *sqlStore) AllowAccess(username, topicPattern string, read, write bool, owner string) error {
+	if _, err := s.db.Exec(s.queries.upsertUserAccess, username, toSQLWildcard(topicPattern), read, write, owner, owner); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) ResetAccess(username, topicPattern string) error {
+	if username == "" && topicPattern == "" {
+		_, err := s.db.Exec(s.queries.deleteAllAccess)
+		return err
+	} else if topicPattern == "" {
+		_, err := s.db.Exec(s.queries.deleteUserAccess, username, username)
+		return err
+	}
+	_, err := s.db.Exec(s.queries.deleteTopicAccess, username, username, toSQLWildcard(topicPattern))
+	return err
+}
+
+func (s *sqlStore) AllGroupGrants() (map[string][]Grant, error) {
+	rows, err := s.db.Query(s.queries.selectGroupAllAccess)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grants := make(map[string][]Grant, 0)
+	for rows.Next() {
+		var group, topic string
+		var read, write bool
+		if err := rows.Scan(&group, &topic, &read, &write); err != nil {
+			return nil, err
+		}
+		grants[group] = append(grants[group], Grant{
+			TopicPattern: fromSQLWildcard(topic),
+			Allow:        NewPermission(read, write),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+func (s *sqlStore) GroupGrants(group string) ([]Grant, error) {
+	rows, err := s.db.Query(s.queries.selectGroupAccess, group)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grants := make([]Grant, 0)
+	for rows.Next() {
+		var topic string
+		var read, write bool
+		if err := rows.Scan(&topic, &read, &write); err != nil {
+			return nil, err
+		}
+		grants = append(grants, Grant{
+			TopicPattern: fromSQLWildcard(topic),
+			Allow:        NewPermission(read, write),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+func (s *sqlStore) AllowGroupAccess(group, topicPattern string, read, write bool) error {
+	_, err := s.db.Exec(s.queries.upsertGroupAccess, group, toSQLWildcard(topicPattern), read, write)
+	return err
+}
+
+func (s *sqlStore) ResetGroupAccess(group, topicPattern string) error {
+	if group == "" && topicPattern == "" {
+		_, err := s.db.Exec(s.queries.deleteAllGroupAccess)
+		return err
+	} else if topicPattern == "" {
+		_, err := s.db.Exec(s.queries.deleteGroupAccess, group)
+		return err
+	}
+	_, err := s.db.Exec(s.queries.deleteGroupTopicAccess, group, toSQLWildcard(topicPattern))
+	return err
+}
+
+func (s *sqlStore) AddGroup(name string) error {
+	if _, err := s.db.Exec(s.queries.insertGroup, name); err != nil {
+		if s.isUniqueViolation(err) {
+			return ErrGroupExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) RemoveGroup(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Rows in user_group_member are deleted via foreign keys
+	result, err := tx.Exec(s.queries.deleteGroup, name)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrGroupNotFound
+	}
+	if _, err := tx.Exec(s.queries.deleteGroupAccess, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Groups() ([]*Group, error) {
+	rows, err := s.db.Query(s.queries.selectGroups)
+	if err != nil {
+		return nil, err
+	}
+	return s.readGroups(rows)
+}
+
+func (s *sqlStore) Group(name string) (*Group, error) {
+	rows, err := s.db.Query(s.queries.selectGroup, name)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.readGroups(rows)
+	if err != nil {
+		return nil, err
+	} else if len(groups) == 0 {
+		return nil, ErrGroupNotFound
+	}
+	return groups[0], nil
+}
+
+// readGroups reads groups from rows of (group name, member username) pairs, ordered by group name.
+// Groups without members have a single row with an empty username.
+func (s *sqlStore) readGroups(rows *sql.Rows) ([]*Group, error) {
+	defer rows.Close()
+	groups := make([]*Group, 0)
+	for rows.Next() {
+		var name, username string
+		if err := rows.Scan(&name, &username); err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].Name != name {
+			groups = append(groups, &Group{Name: name, Members: make([]string, 0)})
+		}
+		if username != "" {
+			group := groups[len(groups)-1]
+			group.Members = append(group.Members, username)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (s *sqlStore) AddGroupMember(group, username string) error {
+	_, err := s.db.Exec(s.queries.insertGroupMember, group, username)
+	return err
+}
+
+func (s *sqlStore) RemoveGroupMember(group, username string) error {
+	_, err := s.db.Exec(s.queries.deleteGroupMember, group, username)
+	return err
+}
+
+func (s *sqlStore) UserGroups(username string) ([]string, error) {
+	rows, err := s.db.Query(s.queries.selectUserGroups, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make([]string, 0)
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (s *sqlStore) AddReservation(username, topic string, everyone Permission) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.queries.upsertUserAccess, username, escapeUnderscore(topic), true, true, username, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.queries.upsertUserAccess, Everyone, escapeUnderscore(topic), everyone.IsRead(), everyone.IsWrite(), username, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) RemoveReservations(username string, topics ...string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, topic := range topics {
+		if _, err := tx.Exec(s.queries.deleteTopicAccess, username, username, escapeUnderscore(topic)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(s.queries.deleteTopicAccess, Everyone, Everyone, escapeUnderscore(topic)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Reservations(username string) ([]Reservation, error) {
+	rows, err := s.db.Query(s.queries.selectUserReservations, Everyone, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reservations := make([]Reservation, 0)
+	for rows.Next() {
+		var topic string
+		var ownerRead, ownerWrite bool
+		var everyoneRead, everyoneWrite sql.NullBool
+		if err := rows.Scan(&topic, &ownerRead, &ownerWrite, &everyoneRead, &everyoneWrite); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, Reservation{
+			Topic:    unescapeUnderscore(topic),
+			Owner:    NewPermission(ownerRead, ownerWrite),
+			Everyone: NewPermission(everyoneRead.Bool, everyoneWrite.Bool), // false if null
+		})
+	}
+	return reservations, nil
+}
+
+func (s *sqlStore) HasReservation(username, topic string) (bool, error) {
+	rows, err := s.db.Query(s.queries.selectUserHasReservation, username, escapeUnderscore(topic))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, errNoRows
+	}
+	var count int64
+	if err := rows.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *sqlStore) ReservationsCount(username string) (int64, error) {
+	rows, err := s.db.Query(s.queries.selectUserReservationsCount, username)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errNoRows
+	}
+	var count int64
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *sqlStore) ReservationOwner(topic string) (string, error) {
+	rows, err := s.db.Query(s.queries.selectUserReservationsOwner, escapeUnderscore(topic))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", nil
+	}
+	var ownerUserID string
+	if err := rows.Scan(&ownerUserID); err != nil {
+		return "", err
+	}
+	return ownerUserID, nil
+}
+
+func (s *sqlStore) OtherAccessCount(username, topic string) (int, error) {
+	rows, err := s.db.Query(s.queries.selectOtherAccessCount, escapeUnderscore(topic), escapeUnderscore(topic), username)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errNoRows
+	}
+	var otherCount int
+	if err := rows.Scan(&otherCount); err != nil {
+		return 0, err
+	}
+	return otherCount, nil
+}
+
+func (s *sqlStore) PhoneNumbers(userID string) ([]string, error) {
+	rows, err := s.db.Query(s.queries.selectPhoneNumbers, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	phoneNumbers := make([]string, 0)
+	for {
+		phoneNumber, err := s.readPhoneNumber(rows)
+		if err == ErrPhoneNumberNotFound {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		phoneNumbers = append(phoneNumbers, phoneNumber)
+	}
+	return phoneNumbers, nil
+}
+
+func (s *sqlStore) readPhoneNumber(rows *sql.Rows) (string, error) {
+	var phoneNumber string
+	if !rows.Next() {
+		return "", ErrPhoneNumberNotFound
+	}
+	if err := rows.Scan(&phoneNumber); err != nil {
+		return "", err
+	} else if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return phoneNumber, nil
+}
+
+func (s *sqlStore) AddPhoneNumber(userID, phoneNumber string) error {
+	if _, err := s.db.Exec(s.queries.insertPhoneNumber, userID, phoneNumber); err != nil {
+		if s.isUniqueViolation(err) {
+			return ErrPhoneNumberExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) RemovePhoneNumber(userID, phoneNumber string) error {
+	_, err := s.db.Exec(s.queries.deletePhoneNumber, userID, phoneNumber)
+	return err
+}
+
+func (s *sqlStore) AddTier(tier *Tier) error {
+	if _, err := s.db.Exec(s.queries.insertTier, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, tier.AttachmentImageProcessing, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) UpdateTier(tier *Tier) error {
+	if _, err := s.db.Exec(s.queries.updateTier, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, tier.AttachmentImageProcessing, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), tier.Code); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) RemoveTier(code string) error {
+	if _, err := s.db.Exec(s.queries.deleteTier, code); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) Tiers() ([]*Tier, error) {
+	rows, err := s.db.Query(s.queries.selectTiers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tiers := make([]*Tier, 0)
+	for {
+		tier, err := s.readTier(rows)
+		if err == ErrTierNotFound {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+func (s *sqlStore) Tier(code string) (*Tier, error) {
+	rows, err := s.db.Query(s.queries.selectTierByCode, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return s.readTier(rows)
+}
+
+func (s *sqlStore) TierByStripePrice(priceID string) (*Tier, error) {
+	rows, err := s.db.Query(s.queries.selectTierByPriceID, priceID, priceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return s.readTier(rows)
+}
+
+func (s *sqlStore) AddWebhook(webhook *Webhook) error {
+	if _, err := s.db.Exec(s.queries.insertWebhook, webhook.ID, webhook.UserID, webhook.Topic, webhook.URL, webhook.Template, webhook.Secret, time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) Webhooks(userID string) ([]*Webhook, error) {
+	rows, err := s.db.Query(s.queries.selectWebhooks, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.readWebhooks(rows)
+}
+
+func (s *sqlStore) WebhooksByTopic(topic string) ([]*Webhook, error) {
+	rows, err := s.db.Query(s.queries.selectWebhooksByTopic, topic)
+	if err != nil {
+		return nil, err
+	}
+	return s.readWebhooks(rows)
+}
+
+func (s *sqlStore) readWebhooks(rows *sql.Rows) ([]*Webhook, error) {
+	defer rows.Close()
+	webhooks := make([]*Webhook, 0)
+	for rows.Next() {
+		var id, userID, topic, url, template, secret, lastError string
+		var lastAttempt, lastSuccess, failures, pending int64
+		if err := rows.Scan(&id, &userID, &topic, &url, &template, &secret, &lastAttempt, &lastSuccess, &lastError, &failures, &pending); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &Webhook{
+			ID:          id,
+			UserID:      userID,
+			Topic:       topic,
+			URL:         url,
+			Template:    template,
+			Secret:      secret,
+			LastAttempt: unixOrZero(lastAttempt),
+			LastSuccess: unixOrZero(lastSuccess),
+			LastError:   lastError,
+			Failures:    failures,
+			Pending:     pending,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (s *sqlStore) WebhooksCount(userID string) (int64, error) {
+	rows, err := s.db.Query(s.queries.selectWebhookCount, userID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errNoRows
+	}
+	var count int64
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *sqlStore) RemoveWebhook(userID, webhookID string) error {
+	result, err := s.db.Exec(s.queries.deleteWebhook, userID, webhookID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) AddWebhookDeliveries(deliveries []*WebhookDelivery) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, d := range deliveries {
+		if _, err := tx.Exec(s.queries.insertWebhookDelivery, d.ID, d.WebhookID, d.Body, d.ContentType, d.Attempts, d.NextAttempt.Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) WebhookDeliveriesDue(now time.Time, limit int) ([]*WebhookDelivery, error) {
+	rows, err := s.db.Query(s.queries.selectWebhookDeliveriesDue, now.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := make([]*WebhookDelivery, 0)
+	for rows.Next() {
+		var id, webhookID, url, secret, body, contentType string
+		var attempts int
+		var nextAttempt int64
+		if err := rows.Scan(&id, &webhookID, &url, &secret, &body, &contentType, &attempts, &nextAttempt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &WebhookDelivery{
+			ID:          id,
+			WebhookID:   webhookID,
+			URL:         url,
+			Secret:      secret,
+			Body:        body,
+			ContentType: contentType,
+			Attempts:    attempts,
+			NextAttempt: time.Unix(nextAttempt, 0),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (s *sqlStore) MarkWebhookDelivered(delivery *WebhookDelivery, deliveredAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.queries.deleteWebhookDelivery, delivery.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.queries.updateWebhookSuccess, deliveredAt.Unix(), deliveredAt.Unix(), delivery.WebhookID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) MarkWebhookDeliveryFailed(delivery *WebhookDelivery, attemptedAt time.Time, reason string, nextAttempt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if nextAttempt.IsZero() {
+		if _, err := tx.Exec(s.queries.deleteWebhookDelivery, delivery.ID); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.Exec(s.queries.updateWebhookDelivery, delivery.Attempts+1, nextAttempt.Unix(), delivery.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(s.queries.updateWebhookFailure, attemptedAt.Unix(), reason, delivery.WebhookID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) AddRule(rule *Rule) error {
+	if _, err := s.db.Exec(s.queries.insertRule, rule.ID, toSQLWildcard(rule.Topic), rule.Target, rule.Filter, rule.Template, rule.RateLimit, time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) Rules() ([]*Rule, error) {
+	rows, err := s.db.Query(s.queries.selectRules)
+	if err != nil {
+		return nil, err
+	}
+	return s.readRules(rows)
+}
+
+func (s *sqlStore) RulesForTopic(topic string) ([]*Rule, error) {
+	rows, err := s.db.Query(s.queries.selectRulesByTopic, topic)
+	if err != nil {
+		return nil, err
+	}
+	return s.readRules(rows)
+}
+
+func (s *sqlStore) readRules(rows *sql.Rows) ([]*Rule, error) {
+	defer rows.Close()
+	rules := make([]*Rule, 0)
+	for rows.Next() {
+		var id, topic, target, filter, template string
+		var rateLimit int
+		if err := rows.Scan(&id, &topic, &target, &filter, &template, &rateLimit); err != nil {
+			return nil, err
+		}
+		rules = append(rules, &Rule{
+			ID:        id,
+			Topic:     fromSQLWildcard(topic),
+			Target:    target,
+			Filter:    filter,
+			Template:  template,
+			RateLimit: rateLimit,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (s *sqlStore) RemoveRule(id string) error {
+	result, err := s.db.Exec(s.queries.deleteRule, id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrRuleNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) AddEscalationPolicy(policy *EscalationPolicy) error {
+	steps, err := json.Marshal(policy.Steps)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(s.queries.insertEscalationPolicy, policy.ID, toSQLWildcard(policy.Topic), string(steps), time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) EscalationPolicies() ([]*EscalationPolicy, error) {
+	rows, err := s.db.Query(s.queries.selectEscalationPolicies)
+	if err != nil {
+		return nil, err
+	}
+	return s.readEscalationPolicies(rows)
+}
+
+func (s *sqlStore) EscalationPoliciesForTopic(topic string) ([]*EscalationPolicy, error) {
+	rows, err := s.db.Query(s.queries.selectEscalationPoliciesByTopic, topic)
+	if err != nil {
+		return nil, err
+	}
+	return s.readEscalationPolicies(rows)
+}
+
+func (s *sqlStore) EscalationPolicy(id string) (*EscalationPolicy, error) {
+	rows, err := s.db.Query(s.queries.selectEscalationPolicy, id)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := s.readEscalationPolicies(rows)
+	if err != nil {
+		return nil, err
+	} else if len(policies) == 0 {
+		return nil, ErrEscalationPolicyNotFound
+	}
+	return policies[0], nil
+}
+
+func (s *sqlStore) readEscalationPolicies(rows *sql.Rows) ([]*EscalationPolicy, error) {
+	defer rows.Close()
+	policies := make([]*EscalationPolicy, 0)
+	for rows.Next() {
+		var id, topic, stepsJSON string
+		if err := rows.Scan(&id, &topic, &stepsJSON); err != nil {
+			return nil, err
+		}
+		steps := make([]*EscalationStep, 0)
+		if err := json.Unmarshal([]byte(stepsJSON), &steps); err != nil {
+			return nil, err
+		}
+		policies = append(policies, &EscalationPolicy{
+			ID:    id,
+			Topic: fromSQLWildcard(topic),
+			Steps: steps,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (s *sqlStore) RemoveEscalationPolicy(id string) error {
+	result, err := s.db.Exec(s.queries.deleteEscalationPolicy, id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrEscalationPolicyNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) readUser(rows *sql.Rows) (*User, error) {
+	defer rows.Close()
+	var id, username, hash, role, prefs, syncTopic, allowedIPs, provider, providerID string
+	var stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval, stripeMonthlyPriceID, stripeYearlyPriceID, tierID, tierCode, tierName sql.NullString
+	var messages, emails, calls int64
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
+	var attachmentImageProcessing sql.NullBool
+	if !rows.Next() {
+		return nil, ErrUserNotFound
+	}
+	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &allowedIPs, &provider, &providerID, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &attachmentImageProcessing, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	user := &User{
+		ID:         id,
+		Name:       username,
+		Hash:       hash,
+		Provider:   Provider(provider),
+		ProviderID: providerID,
+		Role:       Role(role),
+		Prefs:      &Prefs{},
+		SyncTopic:  syncTopic,
+		Stats: &Stats{
+			Messages: messages,
+			Emails:   emails,
+			Calls:    calls,
+		},
+		Billing: &Billing{
+			StripeCustomerID:            stripeCustomerID.String,                                          // May be empty
+			StripeSubscriptionID:        stripeSubscriptionID.String,                                      // May be empty
+			StripeSubscriptionStatus:    stripe.SubscriptionStatus(stripeSubscriptionStatus.String),       // May be empty
+			StripeSubscriptionInterval:  stripe.PriceRecurringInterval(stripeSubscriptionInterval.String), // May be empty
+			StripeSubscriptionPaidUntil: time.Unix(stripeSubscriptionPaidUntil.Int64, 0),                  // May be zero
+			StripeSubscriptionCancelAt:  time.Unix(stripeSubscriptionCancelAt.Int64, 0),                   // May be zero
+		},
+		Deleted: deleted.Valid,
+	}
+	if err := json.Unmarshal([]byte(prefs), user.Prefs); err != nil {
+		return nil, err
+	}
+	allowedIPPrefixes, err := ParseAllowedIPs([]string{allowedIPs})
+	if err != nil {
+		return nil, err
+	}
+	user.AllowedIPs = allowedIPPrefixes
+	if tierCode.Valid {
+		// See readTier() when this is changed!
+		user.Tier = &Tier{
+			ID:                        tierID.String,
+			Code:                      tierCode.String,
+			Name:                      tierName.String,
+			MessageLimit:              messagesLimit.Int64,
+			MessageExpiryDuration:     time.Duration(messagesExpiryDuration.Int64) * time.Second,
+			EmailLimit:                emailsLimit.Int64,
+			CallLimit:                 callsLimit.Int64,
+			ReservationLimit:          reservationsLimit.Int64,
+			AttachmentFileSizeLimit:   attachmentFileSizeLimit.Int64,
+			AttachmentTotalSizeLimit:  attachmentTotalSizeLimit.Int64,
+			AttachmentExpiryDuration:  time.Duration(attachmentExpiryDuration.Int64) * time.Second,
+			AttachmentBandwidthLimit:  attachmentBandwidthLimit.Int64,
+			AttachmentImageProcessing: attachmentImageProcessing.Bool,
+			StripeMonthlyPriceID:      stripeMonthlyPriceID.String, // May be empty
+			StripeYearlyPriceID:       stripeYearlyPriceID.String,  // May be empty
+		}
+	}
+	return user, nil
+}
+
+func (s *sqlStore) readTier(rows *sql.Rows) (*Tier, error) {
+	var id, code, name string
+	var stripeMonthlyPriceID, stripeYearlyPriceID sql.NullString
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit sql.NullInt64
+	var attachmentImageProcessing sql.NullBool
+	if !rows.Next() {
+		return nil, ErrTierNotFound
+	}
+	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &attachmentImageProcessing, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// When changed, note readUser() as well
+	return &Tier{
+		ID:                        id,
+		Code:                      code,
+		Name:                      name,
+		MessageLimit:              messagesLimit.Int64,
+		MessageExpiryDuration:     time.Duration(messagesExpiryDuration.Int64) * time.Second,
+		EmailLimit:                emailsLimit.Int64,
+		CallLimit:                 callsLimit.Int64,
+		ReservationLimit:          reservationsLimit.Int64,
+		AttachmentFileSizeLimit:   attachmentFileSizeLimit.Int64,
+		AttachmentTotalSizeLimit:  attachmentTotalSizeLimit.Int64,
+		AttachmentExpiryDuration:  time.Duration(attachmentExpiryDuration.Int64) * time.Second,
+		AttachmentBandwidthLimit:  attachmentBandwidthLimit.Int64,
+		AttachmentImageProcessing: attachmentImageProcessing.Bool,
+		StripeMonthlyPriceID:      stripeMonthlyPriceID.String, // May be empty
+		StripeYearlyPriceID:       stripeYearlyPriceID.String,  // May be empty
+	}, nil
+}
+
+// toSQLWildcard converts a wildcard string to a SQL wildcard string. It only allows '*' as wildcards,
+// and escapes '_', assuming '\' as escape character.
+func toSQLWildcard(s string) string {
+	return escapeUnderscore(strings.ReplaceAll(s, "*", "%"))
+}
+
+// fromSQLWildcard converts a SQL wildcard string to a wildcard string. It converts '%' to '*',
+// and removes the '\_' escape character.
+func fromSQLWildcard(s string) string {
+	return strings.ReplaceAll(unescapeUnderscore(s), "%", "*")
+}
+
+func escapeUnderscore(s string) string {
+	return strings.ReplaceAll(s, "_", "\\_")
+}
+
+func unescapeUnderscore(s string) string {
+	return strings.ReplaceAll(s, "\\_", "_")
+}
+
+func nullString(s string) sql.NullString {
+	if s == "" {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: s, Valid: true}
+}
+
+func unixOrZero(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(v, 0)
+}
+
+func nullInt64(v int64) sql.NullInt64 {
+	if v == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: v, Valid: true}
+}
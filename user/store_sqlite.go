@@ -0,0 +1,1148 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+// SQLite queries
+const (
+	createTablesQueries = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS tier (
+			id TEXT PRIMARY KEY,
+			code TEXT NOT NULL,
+			name TEXT NOT NULL,
+			messages_limit INT NOT NULL,
+			messages_expiry_duration INT NOT NULL,
+			emails_limit INT NOT NULL,
+			calls_limit INT NOT NULL,
+			reservations_limit INT NOT NULL,
+			attachment_file_size_limit INT NOT NULL,
+			attachment_total_size_limit INT NOT NULL,
+			attachment_expiry_duration INT NOT NULL,
+			attachment_bandwidth_limit INT NOT NULL,
+			attachment_image_processing INT NOT NULL DEFAULT 0,
+			stripe_monthly_price_id TEXT,
+			stripe_yearly_price_id TEXT
+		);
+		CREATE UNIQUE INDEX idx_tier_code ON tier (code);
+		CREATE UNIQUE INDEX idx_tier_stripe_monthly_price_id ON tier (stripe_monthly_price_id);
+		CREATE UNIQUE INDEX idx_tier_stripe_yearly_price_id ON tier (stripe_yearly_price_id);
+		CREATE TABLE IF NOT EXISTS user (
+		    id TEXT PRIMARY KEY,
+			tier_id TEXT,
+			user TEXT NOT NULL,
+			pass TEXT NOT NULL,
+			role TEXT CHECK (role IN ('anonymous', 'admin', 'user')) NOT NULL,
+			prefs JSON NOT NULL DEFAULT '{}',
+			sync_topic TEXT NOT NULL,
+			stats_messages INT NOT NULL DEFAULT (0),
+			stats_emails INT NOT NULL DEFAULT (0),
+			stats_calls INT NOT NULL DEFAULT (0),
+			stripe_customer_id TEXT,
+			stripe_subscription_id TEXT,
+			stripe_subscription_status TEXT,
+			stripe_subscription_interval TEXT,
+			stripe_subscription_paid_until INT,
+			stripe_subscription_cancel_at INT,
+			created INT NOT NULL,
+			deleted INT,
+			allowed_ips TEXT NOT NULL DEFAULT '',
+			provider TEXT NOT NULL DEFAULT '',
+			provider_id TEXT NOT NULL DEFAULT '',
+		    FOREIGN KEY (tier_id) REFERENCES tier (id)
+		);
+		CREATE UNIQUE INDEX idx_user ON user (user);
+		CREATE UNIQUE INDEX idx_user_provider_id ON user (provider, provider_id) WHERE provider_id != '';
+		CREATE UNIQUE INDEX idx_user_stripe_customer_id ON user (stripe_customer_id);
+		CREATE UNIQUE INDEX idx_user_stripe_subscription_id ON user (stripe_subscription_id);
+		CREATE TABLE IF NOT EXISTS user_access (
+			user_id TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			owner_user_id INT,
+			PRIMARY KEY (user_id, topic),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
+		    FOREIGN KEY (owner_user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS group_access (
+			group_name TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			PRIMARY KEY (group_name, topic)
+		);
+		CREATE TABLE IF NOT EXISTS user_group (
+			name TEXT NOT NULL PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS user_group_member (
+			group_name TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			PRIMARY KEY (group_name, user_id),
+			FOREIGN KEY (group_name) REFERENCES user_group (name) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_user_group_member_user_id ON user_group_member (user_id);
+		CREATE TABLE IF NOT EXISTS user_token (
+			user_id TEXT NOT NULL,
+			token TEXT NOT NULL,
+			label TEXT NOT NULL,
+			last_access INT NOT NULL,
+			last_origin TEXT NOT NULL,
+			expires INT NOT NULL,
+			scope TEXT NOT NULL DEFAULT '',
+			allowed_ips TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (user_id, token),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_phone (
+			user_id TEXT NOT NULL,
+			phone_number TEXT NOT NULL,
+			PRIMARY KEY (user_id, phone_number),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_webhook (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			url TEXT NOT NULL,
+			template TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			last_attempt INT NOT NULL DEFAULT (0),
+			last_success INT NOT NULL DEFAULT (0),
+			last_error TEXT NOT NULL DEFAULT (''),
+			failures INT NOT NULL DEFAULT (0),
+			created INT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_user_webhook_topic ON user_webhook (topic);
+		CREATE TABLE IF NOT EXISTS user_webhook_delivery (
+			id TEXT PRIMARY KEY,
+			webhook_id TEXT NOT NULL,
+			body TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			attempts INT NOT NULL,
+			next_attempt INT NOT NULL,
+			FOREIGN KEY (webhook_id) REFERENCES user_webhook (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_user_webhook_delivery_next_attempt ON user_webhook_delivery (next_attempt);
+		CREATE TABLE IF NOT EXISTS topic_rule (
+			id TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			target TEXT NOT NULL,
+			filter TEXT NOT NULL,
+			template TEXT NOT NULL,
+			rate_limit INT NOT NULL,
+			created INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS topic_escalation (
+			id TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			steps TEXT NOT NULL,
+			created INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS schemaVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);
+		INSERT INTO user (id, user, pass, role, sync_topic, created)
+		VALUES ('` + everyoneID + `', '*', '', 'anonymous', '', UNIXEPOCH())
+		ON CONFLICT (id) DO NOTHING;
+		COMMIT;
+	`
+
+	builtinStartupQueries = `
+		PRAGMA foreign_keys = ON;
+	`
+
+	selectUserByIDQuery = `
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.allowed_ips, u.provider, u.provider_id, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.attachment_image_processing, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		FROM user u
+		LEFT JOIN tier t on t.id = u.tier_id
+		WHERE u.id = ?
+	`
+	selectUserByNameQuery = `
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.allowed_ips, u.provider, u.provider_id, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.attachment_image_processing, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		FROM user u
+		LEFT JOIN tier t on t.id = u.tier_id
+		WHERE user = ?
+	`
+	selectUserByTokenQuery = `
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.allowed_ips, u.provider, u.provider_id, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.attachment_image_processing, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		FROM user u
+		JOIN user_token tk on u.id = tk.user_id
+		LEFT JOIN tier t on t.id = u.tier_id
+		WHERE tk.token = ? AND (tk.expires = 0 OR tk.expires >= ?)
+	`
+	selectUserByStripeCustomerIDQuery = `
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.allowed_ips, u.provider, u.provider_id, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.attachment_image_processing, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		FROM user u
+		LEFT JOIN tier t on t.id = u.tier_id
+		WHERE u.stripe_customer_id = ?
+	`
+	selectUserByProviderIDQuery = `
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.allowed_ips, u.provider, u.provider_id, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.attachment_image_processing, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		FROM user u
+		LEFT JOIN tier t on t.id = u.tier_id
+		WHERE u.provider = ? AND u.provider_id = ?
+	`
+	selectTopicPermsQuery = `
+		SELECT u.user, read, write
+		FROM user_access a
+		JOIN user u ON u.id = a.user_id
+		WHERE (u.user = ? OR u.user = ?) AND ? LIKE a.topic ESCAPE '\'
+		ORDER BY u.user DESC, LENGTH(a.topic) DESC, a.write DESC
+	`
+
+	insertUserQuery = `
+		INSERT INTO user (id, user, pass, role, sync_topic, provider, provider_id, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	selectUsernamesQuery = `
+		SELECT user
+		FROM user
+		ORDER BY
+			CASE role
+				WHEN 'admin' THEN 1
+				WHEN 'anonymous' THEN 3
+				ELSE 2
+			END, user
+	`
+	selectUserCountQuery         = `SELECT COUNT(*) FROM user`
+	updateUserPassQuery          = `UPDATE user SET pass = ? WHERE user = ?`
+	updateUserRoleQuery          = `UPDATE user SET role = ? WHERE user = ?`
+	updateUserAllowedIPsQuery    = `UPDATE user SET allowed_ips = ? WHERE user = ?`
+	updateUserPrefsQuery         = `UPDATE user SET prefs = ? WHERE id = ?`
+	updateUserStatsQuery         = `UPDATE user SET stats_messages = ?, stats_emails = ?, stats_calls = ? WHERE id = ?`
+	updateUserStatsResetAllQuery = `UPDATE user SET stats_messages = 0, stats_emails = 0, stats_calls = 0`
+	updateUserDeletedQuery       = `UPDATE user SET deleted = ? WHERE id = ?`
+	deleteUsersMarkedQuery       = `DELETE FROM user WHERE deleted < ?`
+	deleteUserQuery              = `DELETE FROM user WHERE user = ?`
+
+	upsertUserAccessQuery = `
+		INSERT INTO user_access (user_id, topic, read, write, owner_user_id)
+		VALUES ((SELECT id FROM user WHERE user = ?), ?, ?, ?, (SELECT IIF(?='',NULL,(SELECT id FROM user WHERE user=?))))
+		ON CONFLICT (user_id, topic)
+		DO UPDATE SET read=excluded.read, write=excluded.write, owner_user_id=excluded.owner_user_id
+	`
+	selectUserAllAccessQuery = `
+		SELECT user_id, topic, read, write
+		FROM user_access
+		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
+	`
+	selectUserAccessQuery = `
+		SELECT topic, read, write
+		FROM user_access
+		WHERE user_id = (SELECT id FROM user WHERE user = ?)
+		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
+	`
+	selectUserReservationsQuery = `
+		SELECT a_user.topic, a_user.read, a_user.write, a_everyone.read AS everyone_read, a_everyone.write AS everyone_write
+		FROM user_access a_user
+		LEFT JOIN  user_access a_everyone ON a_user.topic = a_everyone.topic AND a_everyone.user_id = (SELECT id FROM user WHERE user = ?)
+		WHERE a_user.user_id = a_user.owner_user_id
+		  AND a_user.owner_user_id = (SELECT id FROM user WHERE user = ?)
+		ORDER BY a_user.topic
+	`
+	selectUserReservationsCountQuery = `
+		SELECT COUNT(*)
+		FROM user_access
+		WHERE user_id = owner_user_id 
+		  AND owner_user_id = (SELECT id FROM user WHERE user = ?)
+	`
+	selectUserReservationsOwnerQuery = `
+		SELECT owner_user_id
+		FROM user_access
+		WHERE topic = ?
+		  AND user_id = owner_user_id
+	`
+	selectUserHasReservationQuery = `
+		SELECT COUNT(*)
+		FROM user_access
+		WHERE user_id = owner_user_id
+		  AND owner_user_id = (SELECT id FROM user WHERE user = ?)
+		  AND topic = ?
+	`
+	selectOtherAccessCountQuery = `
+		SELECT COUNT(*)
+		FROM user_access
+		WHERE (topic = ? OR ? LIKE topic ESCAPE '\')
+		  AND (owner_user_id IS NULL OR owner_user_id != (SELECT id FROM user WHERE user = ?))
+	`
+	deleteAllAccessQuery  = `DELETE FROM user_access`
+	deleteUserAccessQuery = `
+		DELETE FROM user_access
+		WHERE user_id = (SELECT id FROM user WHERE user = ?)
+		   OR owner_user_id = (SELECT id FROM user WHERE user = ?)
+	`
+	deleteTopicAccessQuery = `
+		DELETE FROM user_access
+	   	WHERE (user_id = (SELECT id FROM user WHERE user = ?) OR owner_user_id = (SELECT id FROM user WHERE user = ?))
+	   	  AND topic = ?
+  	`
+
+	selectGroupTopicPermsQuery = `
+		SELECT group_name, LENGTH(topic), read, write
+		FROM group_access
+		WHERE ? LIKE topic ESCAPE '\'
+		ORDER BY LENGTH(topic) DESC
+	`
+	upsertGroupAccessQuery = `
+		INSERT INTO group_access (group_name, topic, read, write)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (group_name, topic)
+		DO UPDATE SET read=excluded.read, write=excluded.write
+	`
+	selectGroupAllAccessQuery = `
+		SELECT group_name, topic, read, write
+		FROM group_access
+		ORDER BY group_name, LENGTH(topic) DESC, write DESC, read DESC, topic
+	`
+	selectGroupAccessQuery = `
+		SELECT topic, read, write
+		FROM group_access
+		WHERE group_name = ?
+		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
+	`
+	deleteAllGroupAccessQuery   = `DELETE FROM group_access`
+	deleteGroupAccessQuery      = `DELETE FROM group_access WHERE group_name = ?`
+	deleteGroupTopicAccessQuery = `DELETE FROM group_access WHERE group_name = ? AND topic = ?`
+
+	insertGroupQuery  = `INSERT INTO user_group (name) VALUES (?)`
+	deleteGroupQuery  = `DELETE FROM user_group WHERE name = ?`
+	selectGroupsQuery = `
+		SELECT g.name, COALESCE(u.user, '')
+		FROM user_group g
+		LEFT JOIN user_group_member m ON m.group_name = g.name
+		LEFT JOIN user u ON u.id = m.user_id
+		ORDER BY g.name, u.user
+	`
+	selectGroupQuery = `
+		SELECT g.name, COALESCE(u.user, '')
+		FROM user_group g
+		LEFT JOIN user_group_member m ON m.group_name = g.name
+		LEFT JOIN user u ON u.id = m.user_id
+		WHERE g.name = ?
+		ORDER BY u.user
+	`
+	insertGroupMemberQuery = `
+		INSERT INTO user_group_member (group_name, user_id)
+		SELECT ?, id FROM user WHERE user = ?
+		ON CONFLICT (group_name, user_id) DO NOTHING
+	`
+	deleteGroupMemberQuery      = `DELETE FROM user_group_member WHERE group_name = ? AND user_id = (SELECT id FROM user WHERE user = ?)`
+	deleteUserGroupMembersQuery = `DELETE FROM user_group_member WHERE user_id = ?`
+	selectUserGroupsQuery       = `
+		SELECT m.group_name
+		FROM user_group_member m
+		JOIN user u ON u.id = m.user_id
+		WHERE u.user = ?
+		ORDER BY m.group_name
+	`
+
+	selectTokenCountQuery      = `SELECT COUNT(*) FROM user_token WHERE user_id = ?`
+	selectTokensQuery          = `SELECT token, label, last_access, last_origin, expires, scope, allowed_ips FROM user_token WHERE user_id = ?`
+	selectTokenQuery           = `SELECT token, label, last_access, last_origin, expires, scope, allowed_ips FROM user_token WHERE user_id = ? AND token = ?`
+	insertTokenQuery           = `INSERT INTO user_token (user_id, token, label, last_access, last_origin, expires, scope, allowed_ips) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	updateTokenExpiryQuery     = `UPDATE user_token SET expires = ? WHERE user_id = ? AND token = ?`
+	updateTokenLabelQuery      = `UPDATE user_token SET label = ? WHERE user_id = ? AND token = ?`
+	updateTokenAllowedIPsQuery = `UPDATE user_token SET allowed_ips = ? WHERE user_id = ? AND token = ?`
+	updateTokenLastAccessQuery = `UPDATE user_token SET last_access = ?, last_origin = ? WHERE token = ?`
+	deleteTokenQuery           = `DELETE FROM user_token WHERE user_id = ? AND token = ?`
+	deleteAllTokenQuery        = `DELETE FROM user_token WHERE user_id = ?`
+	deleteExpiredTokensQuery   = `DELETE FROM user_token WHERE expires > 0 AND expires < ?`
+	deleteExcessTokensQuery    = `
+		DELETE FROM user_token
+		WHERE user_id = ?
+		  AND (user_id, token) NOT IN (
+			SELECT user_id, token
+			FROM user_token
+			WHERE user_id = ?
+			ORDER BY expires DESC
+			LIMIT ?
+		)
+	`
+
+	selectPhoneNumbersQuery = `SELECT phone_number FROM user_phone WHERE user_id = ?`
+	insertPhoneNumberQuery  = `INSERT INTO user_phone (user_id, phone_number) VALUES (?, ?)`
+	deletePhoneNumberQuery  = `DELETE FROM user_phone WHERE user_id = ? AND phone_number = ?`
+
+	insertTierQuery = `
+		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, attachment_image_processing, stripe_monthly_price_id, stripe_yearly_price_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	updateTierQuery = `
+		UPDATE tier
+		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, attachment_image_processing = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?
+		WHERE code = ?
+	`
+	selectTiersQuery = `
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, attachment_image_processing, stripe_monthly_price_id, stripe_yearly_price_id
+		FROM tier
+	`
+	selectTierByCodeQuery = `
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, attachment_image_processing, stripe_monthly_price_id, stripe_yearly_price_id
+		FROM tier
+		WHERE code = ?
+	`
+	selectTierByPriceIDQuery = `
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, attachment_image_processing, stripe_monthly_price_id, stripe_yearly_price_id
+		FROM tier
+		WHERE (stripe_monthly_price_id = ? OR stripe_yearly_price_id = ?)
+	`
+	updateUserTierQuery = `UPDATE user SET tier_id = (SELECT id FROM tier WHERE code = ?) WHERE user = ?`
+	deleteUserTierQuery = `UPDATE user SET tier_id = null WHERE user = ?`
+	deleteTierQuery     = `DELETE FROM tier WHERE code = ?`
+
+	updateBillingQuery = `
+		UPDATE user
+		SET stripe_customer_id = ?, stripe_subscription_id = ?, stripe_subscription_status = ?, stripe_subscription_interval = ?, stripe_subscription_paid_until = ?, stripe_subscription_cancel_at = ?
+		WHERE user = ?
+	`
+
+	insertWebhookQuery = `
+		INSERT INTO user_webhook (id, user_id, topic, url, template, secret, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	selectWebhooksQuery = `
+		SELECT w.id, w.user_id, w.topic, w.url, w.template, w.secret, w.last_attempt, w.last_success, w.last_error, w.failures, (SELECT COUNT(*) FROM user_webhook_delivery d WHERE d.webhook_id = w.id)
+		FROM user_webhook w
+		WHERE w.user_id = ?
+		ORDER BY w.created, w.id
+	`
+	selectWebhooksByTopicQuery = `
+		SELECT w.id, w.user_id, w.topic, w.url, w.template, w.secret, w.last_attempt, w.last_success, w.last_error, w.failures, 0
+		FROM user_webhook w
+		WHERE w.topic = ?
+		ORDER BY w.created, w.id
+	`
+	selectWebhookCountQuery         = `SELECT COUNT(*) FROM user_webhook WHERE user_id = ?`
+	updateWebhookSuccessQuery       = `UPDATE user_webhook SET last_attempt = ?, last_success = ?, last_error = '', failures = 0 WHERE id = ?`
+	updateWebhookFailureQuery       = `UPDATE user_webhook SET last_attempt = ?, last_error = ?, failures = failures + 1 WHERE id = ?`
+	deleteWebhookQuery              = `DELETE FROM user_webhook WHERE user_id = ? AND id = ?`
+	deleteAllWebhooksQuery          = `DELETE FROM user_webhook WHERE user_id = ?`
+	insertWebhookDeliveryQuery      = `INSERT INTO user_webhook_delivery (id, webhook_id, body, content_type, attempts, next_attempt) VALUES (?, ?, ?, ?, ?, ?)`
+	selectWebhookDeliveriesDueQuery = `
+		SELECT d.id, d.webhook_id, w.url, w.secret, d.body, d.content_type, d.attempts, d.next_attempt
+		FROM user_webhook_delivery d
+		JOIN user_webhook w ON w.id = d.webhook_id
+		WHERE d.next_attempt <= ?
+		ORDER BY d.next_attempt, d.id
+		LIMIT ?
+	`
+	updateWebhookDeliveryQuery = `UPDATE user_webhook_delivery SET attempts = ?, next_attempt = ? WHERE id = ?`
+	deleteWebhookDeliveryQuery = `DELETE FROM user_webhook_delivery WHERE id = ?`
+
+	insertRuleQuery = `
+		INSERT INTO topic_rule (id, topic, target, filter, template, rate_limit, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	selectRulesQuery = `
+		SELECT id, topic, target, filter, template, rate_limit
+		FROM topic_rule
+		ORDER BY created, id
+	`
+	selectRulesByTopicQuery = `
+		SELECT id, topic, target, filter, template, rate_limit
+		FROM topic_rule
+		WHERE ? LIKE topic ESCAPE '\'
+		ORDER BY created, id
+	`
+	deleteRuleQuery = `DELETE FROM topic_rule WHERE id = ?`
+
+	insertEscalationPolicyQuery = `
+		INSERT INTO topic_escalation (id, topic, steps, created)
+		VALUES (?, ?, ?, ?)
+	`
+	selectEscalationPoliciesQuery = `
+		SELECT id, topic, steps
+		FROM topic_escalation
+		ORDER BY created, id
+	`
+	selectEscalationPoliciesByTopicQuery = `
+		SELECT id, topic, steps
+		FROM topic_escalation
+		WHERE ? LIKE topic ESCAPE '\'
+		ORDER BY created, id
+	`
+	selectEscalationPolicyQuery = `SELECT id, topic, steps FROM topic_escalation WHERE id = ?`
+	deleteEscalationPolicyQuery = `DELETE FROM topic_escalation WHERE id = ?`
+)
+
+// Schema management queries
+const (
+	currentSchemaVersion     = 15
+	insertSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
+	updateSchemaVersion      = `UPDATE schemaVersion SET version = ? WHERE id = 1`
+	selectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
+
+	// 1 -> 2 (complex migration!)
+	migrate1To2CreateTablesQueries = `
+		ALTER TABLE user RENAME TO user_old;
+		CREATE TABLE IF NOT EXISTS tier (
+			id TEXT PRIMARY KEY,
+			code TEXT NOT NULL,
+			name TEXT NOT NULL,
+			messages_limit INT NOT NULL,
+			messages_expiry_duration INT NOT NULL,
+			emails_limit INT NOT NULL,
+			reservations_limit INT NOT NULL,
+			attachment_file_size_limit INT NOT NULL,
+			attachment_total_size_limit INT NOT NULL,
+			attachment_expiry_duration INT NOT NULL,
+			attachment_bandwidth_limit INT NOT NULL,
+			stripe_price_id TEXT
+		);
+		CREATE UNIQUE INDEX idx_tier_code ON tier (code);
+		CREATE UNIQUE INDEX idx_tier_price_id ON tier (stripe_price_id);
+		CREATE TABLE IF NOT EXISTS user (
+		    id TEXT PRIMARY KEY,
+			tier_id TEXT,
+			user TEXT NOT NULL,
+			pass TEXT NOT NULL,
+			role TEXT CHECK (role IN ('anonymous', 'admin', 'user')) NOT NULL,
+			prefs JSON NOT NULL DEFAULT '{}',
+			sync_topic TEXT NOT NULL,
+			stats_messages INT NOT NULL DEFAULT (0),
+			stats_emails INT NOT NULL DEFAULT (0),
+			stripe_customer_id TEXT,
+			stripe_subscription_id TEXT,
+			stripe_subscription_status TEXT,
+			stripe_subscription_paid_until INT,
+			stripe_subscription_cancel_at INT,
+			created INT NOT NULL,
+			deleted INT,
+		    FOREIGN KEY (tier_id) REFERENCES tier (id)
+		);
+		CREATE UNIQUE INDEX idx_user ON user (user);
+		CREATE UNIQUE INDEX idx_user_stripe_customer_id ON user (stripe_customer_id);
+		CREATE UNIQUE INDEX idx_user_stripe_subscription_id ON user (stripe_subscription_id);
+		CREATE TABLE IF NOT EXISTS user_access (
+			user_id TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			owner_user_id INT,
+			PRIMARY KEY (user_id, topic),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
+		    FOREIGN KEY (owner_user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_token (
+			user_id TEXT NOT NULL,
+			token TEXT NOT NULL,
+			label TEXT NOT NULL,
+			last_access INT NOT NULL,
+			last_origin TEXT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (user_id, token),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS schemaVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);
+		INSERT INTO user (id, user, pass, role, sync_topic, created)
+		VALUES ('u_everyone', '*', '', 'anonymous', '', UNIXEPOCH())
+		ON CONFLICT (id) DO NOTHING;
+	`
+	migrate1To2SelectAllOldUsernamesNoTx = `SELECT user FROM user_old`
+	migrate1To2InsertUserNoTx            = `
+		INSERT INTO user (id, user, pass, role, sync_topic, created)
+		SELECT ?, user, pass, role, ?, UNIXEPOCH() FROM user_old WHERE user = ?
+	`
+	migrate1To2InsertFromOldTablesAndDropNoTx = `
+		INSERT INTO user_access (user_id, topic, read, write)
+		SELECT u.id, a.topic, a.read, a.write
+		FROM user u
+	 	JOIN access a ON u.user = a.user;
+
+		DROP TABLE access;
+		DROP TABLE user_old;
+	`
+
+	// 2 -> 3
+	migrate2To3UpdateQueries = `
+		ALTER TABLE user ADD COLUMN stripe_subscription_interval TEXT;
+		ALTER TABLE tier RENAME COLUMN stripe_price_id TO stripe_monthly_price_id;
+		ALTER TABLE tier ADD COLUMN stripe_yearly_price_id TEXT;
+		DROP INDEX IF EXISTS idx_tier_price_id;
+		CREATE UNIQUE INDEX idx_tier_stripe_monthly_price_id ON tier (stripe_monthly_price_id);
+		CREATE UNIQUE INDEX idx_tier_stripe_yearly_price_id ON tier (stripe_yearly_price_id);
+	`
+
+	// 3 -> 4
+	migrate3To4UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN calls_limit INT NOT NULL DEFAULT (0);
+		ALTER TABLE user ADD COLUMN stats_calls INT NOT NULL DEFAULT (0);
+		CREATE TABLE IF NOT EXISTS user_phone (
+			user_id TEXT NOT NULL,
+			phone_number TEXT NOT NULL,
+			PRIMARY KEY (user_id, phone_number),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+	`
+
+	// 4 -> 5
+	migrate4To5UpdateQueries = `
+		UPDATE user_access SET topic = REPLACE(topic, '_', '\_');
+	`
+
+	// 5 -> 6
+	migrate5To6UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_webhook (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			url TEXT NOT NULL,
+			template TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			last_attempt INT NOT NULL DEFAULT (0),
+			last_success INT NOT NULL DEFAULT (0),
+			last_error TEXT NOT NULL DEFAULT (''),
+			failures INT NOT NULL DEFAULT (0),
+			created INT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_user_webhook_topic ON user_webhook (topic);
+		CREATE TABLE IF NOT EXISTS user_webhook_delivery (
+			id TEXT PRIMARY KEY,
+			webhook_id TEXT NOT NULL,
+			body TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			attempts INT NOT NULL,
+			next_attempt INT NOT NULL,
+			FOREIGN KEY (webhook_id) REFERENCES user_webhook (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_user_webhook_delivery_next_attempt ON user_webhook_delivery (next_attempt);
+	`
+
+	// 6 -> 7
+	migrate6To7UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS topic_rule (
+			id TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			target TEXT NOT NULL,
+			filter TEXT NOT NULL,
+			template TEXT NOT NULL,
+			rate_limit INT NOT NULL,
+			created INT NOT NULL
+		);
+	`
+
+	// 7 -> 8
+	migrate7To8UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS topic_escalation (
+			id TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			steps TEXT NOT NULL,
+			created INT NOT NULL
+		);
+	`
+
+	// 8 -> 9
+	migrate8To9UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN attachment_image_processing INT NOT NULL DEFAULT 0;
+	`
+
+	// 9 -> 10
+	migrate9To10UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS group_access (
+			group_name TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			PRIMARY KEY (group_name, topic)
+		);
+	`
+
+	// 10 -> 11
+	migrate10To11UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_group (
+			name TEXT NOT NULL PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS user_group_member (
+			group_name TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			PRIMARY KEY (group_name, user_id),
+			FOREIGN KEY (group_name) REFERENCES user_group (name) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_user_group_member_user_id ON user_group_member (user_id);
+	`
+
+	// 11 -> 12
+	migrate11To12UpdateQueries = `
+		ALTER TABLE user_token ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+	`
+
+	// 12 -> 13
+	migrate12To13UpdateQueries = `
+		ALTER TABLE user ADD COLUMN allowed_ips TEXT NOT NULL DEFAULT '';
+		ALTER TABLE user_token ADD COLUMN allowed_ips TEXT NOT NULL DEFAULT '';
+	`
+
+	// 13 -> 14
+	migrate13To14UpdateQueries = `
+		ALTER TABLE user ADD COLUMN provider TEXT NOT NULL DEFAULT '';
+	`
+
+	// 14 -> 15
+	migrate14To15UpdateQueries = `
+		ALTER TABLE user ADD COLUMN provider_id TEXT NOT NULL DEFAULT '';
+		CREATE UNIQUE INDEX idx_user_provider_id ON user (provider, provider_id) WHERE provider_id != '';
+	`
+)
+
+var (
+	migrations = map[int]func(db *sql.DB) error{
+		1:  migrateFrom1,
+		2:  migrateFrom2,
+		3:  migrateFrom3,
+		4:  migrateFrom4,
+		5:  migrateFrom5,
+		6:  migrateFrom6,
+		7:  migrateFrom7,
+		8:  migrateFrom8,
+		9:  migrateFrom9,
+		10: migrateFrom10,
+		11: migrateFrom11,
+		12: migrateFrom12,
+		13: migrateFrom13,
+		14: migrateFrom14,
+	}
+)
+
+var sqliteQueries = &storeQueries{
+	selectUserByID:                  selectUserByIDQuery,
+	selectUserByName:                selectUserByNameQuery,
+	selectUserByToken:               selectUserByTokenQuery,
+	selectUserByStripeCustomerID:    selectUserByStripeCustomerIDQuery,
+	selectUserByProviderID:          selectUserByProviderIDQuery,
+	selectTopicPerms:                selectTopicPermsQuery,
+	insertUser:                      insertUserQuery,
+	selectUsernames:                 selectUsernamesQuery,
+	selectUserCount:                 selectUserCountQuery,
+	updateUserPass:                  updateUserPassQuery,
+	updateUserRole:                  updateUserRoleQuery,
+	updateUserAllowedIPs:            updateUserAllowedIPsQuery,
+	updateUserPrefs:                 updateUserPrefsQuery,
+	updateUserStats:                 updateUserStatsQuery,
+	updateUserStatsResetAll:         updateUserStatsResetAllQuery,
+	updateUserDeleted:               updateUserDeletedQuery,
+	deleteUsersMarked:               deleteUsersMarkedQuery,
+	deleteUser:                      deleteUserQuery,
+	upsertUserAccess:                upsertUserAccessQuery,
+	selectUserAllAccess:             selectUserAllAccessQuery,
+	selectUserAccess:                selectUserAccessQuery,
+	selectUserReservations:          selectUserReservationsQuery,
+	selectUserReservationsCount:     selectUserReservationsCountQuery,
+	selectUserReservationsOwner:     selectUserReservationsOwnerQuery,
+	selectUserHasReservation:        selectUserHasReservationQuery,
+	selectOtherAccessCount:          selectOtherAccessCountQuery,
+	deleteAllAccess:                 deleteAllAccessQuery,
+	deleteUserAccess:                deleteUserAccessQuery,
+	deleteTopicAccess:               deleteTopicAccessQuery,
+	selectGroupTopicPerms:           selectGroupTopicPermsQuery,
+	upsertGroupAccess:               upsertGroupAccessQuery,
+	selectGroupAllAccess:            selectGroupAllAccessQuery,
+	selectGroupAccess:               selectGroupAccessQuery,
+	deleteAllGroupAccess:            deleteAllGroupAccessQuery,
+	deleteGroupAccess:               deleteGroupAccessQuery,
+	deleteGroupTopicAccess:          deleteGroupTopicAccessQuery,
+	insertGroup:                     insertGroupQuery,
+	deleteGroup:                     deleteGroupQuery,
+	selectGroups:                    selectGroupsQuery,
+	selectGroup:                     selectGroupQuery,
+	insertGroupMember:               insertGroupMemberQuery,
+	deleteGroupMember:               deleteGroupMemberQuery,
+	deleteUserGroupMembers:          deleteUserGroupMembersQuery,
+	selectUserGroups:                selectUserGroupsQuery,
+	selectTokenCount:                selectTokenCountQuery,
+	selectTokens:                    selectTokensQuery,
+	selectToken:                     selectTokenQuery,
+	insertToken:                     insertTokenQuery,
+	updateTokenExpiry:               updateTokenExpiryQuery,
+	updateTokenLabel:                updateTokenLabelQuery,
+	updateTokenAllowedIPs:           updateTokenAllowedIPsQuery,
+	updateTokenLastAccess:           updateTokenLastAccessQuery,
+	deleteToken:                     deleteTokenQuery,
+	deleteAllToken:                  deleteAllTokenQuery,
+	deleteExpiredTokens:             deleteExpiredTokensQuery,
+	deleteExcessTokens:              deleteExcessTokensQuery,
+	selectPhoneNumbers:              selectPhoneNumbersQuery,
+	insertPhoneNumber:               insertPhoneNumberQuery,
+	deletePhoneNumber:               deletePhoneNumberQuery,
+	insertTier:                      insertTierQuery,
+	updateTier:                      updateTierQuery,
+	selectTiers:                     selectTiersQuery,
+	selectTierByCode:                selectTierByCodeQuery,
+	selectTierByPriceID:             selectTierByPriceIDQuery,
+	updateUserTier:                  updateUserTierQuery,
+	deleteUserTier:                  deleteUserTierQuery,
+	deleteTier:                      deleteTierQuery,
+	updateBilling:                   updateBillingQuery,
+	insertWebhook:                   insertWebhookQuery,
+	selectWebhooks:                  selectWebhooksQuery,
+	selectWebhooksByTopic:           selectWebhooksByTopicQuery,
+	selectWebhookCount:              selectWebhookCountQuery,
+	updateWebhookSuccess:            updateWebhookSuccessQuery,
+	updateWebhookFailure:            updateWebhookFailureQuery,
+	deleteWebhook:                   deleteWebhookQuery,
+	deleteAllWebhooks:               deleteAllWebhooksQuery,
+	insertWebhookDelivery:           insertWebhookDeliveryQuery,
+	selectWebhookDeliveriesDue:      selectWebhookDeliveriesDueQuery,
+	updateWebhookDelivery:           updateWebhookDeliveryQuery,
+	deleteWebhookDelivery:           deleteWebhookDeliveryQuery,
+	insertRule:                      insertRuleQuery,
+	selectRules:                     selectRulesQuery,
+	selectRulesByTopic:              selectRulesByTopicQuery,
+	deleteRule:                      deleteRuleQuery,
+	insertEscalationPolicy:          insertEscalationPolicyQuery,
+	selectEscalationPolicies:        selectEscalationPoliciesQuery,
+	selectEscalationPoliciesByTopic: selectEscalationPoliciesByTopicQuery,
+	selectEscalationPolicy:          selectEscalationPolicyQuery,
+	deleteEscalationPolicy:          deleteEscalationPolicyQuery,
+}
+
+// NewSQLiteStore creates a new Store backed by a SQLite database file. The database is created if
+// it does not exist, and migrated to the current schema version if necessary.
+func NewSQLiteStore(filename, startupQueries string) (Store, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupSQLiteDB(db); err != nil {
+		return nil, err
+	}
+	if err := runStartupQueries(db, startupQueries); err != nil {
+		return nil, err
+	}
+	return &sqlStore{
+		db:                db,
+		queries:           sqliteQueries,
+		isUniqueViolation: isSQLiteUniqueViolation,
+	}, nil
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+func runStartupQueries(db *sql.DB, startupQueries string) error {
+	if _, err := db.Exec(startupQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(builtinStartupQueries); err != nil {
+		return err
+	}
+	return nil
+}
+
+func setupSQLiteDB(db *sql.DB) error {
+	// If 'schemaVersion' table does not exist, this must be a new database
+	rowsSV, err := db.Query(selectSchemaVersionQuery)
+	if err != nil {
+		return setupNewSQLiteDB(db)
+	}
+	defer rowsSV.Close()
+
+	// If 'schemaVersion' table exists, read version and potentially upgrade
+	schemaVersion := 0
+	if !rowsSV.Next() {
+		return errors.New("cannot determine schema version: database file may be corrupt")
+	}
+	if err := rowsSV.Scan(&schemaVersion); err != nil {
+		return err
+	}
+	rowsSV.Close()
+
+	// Do migrations
+	if schemaVersion == currentSchemaVersion {
+		return nil
+	} else if schemaVersion > currentSchemaVersion {
+		return fmt.Errorf("unexpected schema version: version %d is higher than current version %d", schemaVersion, currentSchemaVersion)
+	}
+	for i := schemaVersion; i < currentSchemaVersion; i++ {
+		fn, ok := migrations[i]
+		if !ok {
+			return fmt.Errorf("cannot find migration step from schema version %d to %d", i, i+1)
+		} else if err := fn(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setupNewSQLiteDB(db *sql.DB) error {
+	if _, err := db.Exec(createTablesQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(insertSchemaVersion, currentSchemaVersion); err != nil {
+		return err
+	}
+	return nil
+}
+
+func migrateFrom1(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 1 to 2")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Rename user -> user_old, and create new tables
+	if _, err := tx.Exec(migrate1To2CreateTablesQueries); err != nil {
+		return err
+	}
+	// Insert users from user_old into new user table, with ID and sync_topic
+	rows, err := tx.Query(migrate1To2SelectAllOldUsernamesNoTx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	usernames := make([]string, 0)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return err
+		}
+		usernames = append(usernames, username)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		userID := util.RandomStringPrefix(userIDPrefix, userIDLength)
+		syncTopic := util.RandomStringPrefix(syncTopicPrefix, syncTopicLength)
+		if _, err := tx.Exec(migrate1To2InsertUserNoTx, userID, syncTopic, username); err != nil {
+			return err
+		}
+	}
+	// Migrate old "access" table to "user_access" and drop "access" and "user_old"
+	if _, err := tx.Exec(migrate1To2InsertFromOldTablesAndDropNoTx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 2); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func migrateFrom2(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 2 to 3")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate2To3UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 3); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom3(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 3 to 4")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate3To4UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 4); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom4(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 4 to 5")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate4To5UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 5); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom5(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 5 to 6")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate5To6UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 6); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom6(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 6 to 7")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate6To7UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 7); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom7(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 7 to 8")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate7To8UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 8); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom8(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 8 to 9")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate8To9UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 9); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom9(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 9 to 10")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate9To10UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 10); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom10(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 10 to 11")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate10To11UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 11); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom11(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 11 to 12")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate11To12UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 12); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom12(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 12 to 13")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate12To13UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 13); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom13(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 13 to 14")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate13To14UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 14); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom14(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 14 to 15")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate14To15UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 15); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -2,9 +2,12 @@ package user
 
 import (
 	"errors"
+	"fmt"
 	"github.com/stripe/stripe-go/v74"
 	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
 	"net/netip"
+	"path"
 	"regexp"
 	"strings"
 	"time"
@@ -12,17 +15,22 @@ import (
 
 // User is a struct that represents a user
 type User struct {
-	ID        string
-	Name      string
-	Hash      string // password hash (bcrypt)
-	Token     string // Only set if token was used to log in
-	Role      Role
-	Prefs     *Prefs
-	Tier      *Tier
-	Stats     *Stats
-	Billing   *Billing
-	SyncTopic string
-	Deleted   bool
+	ID              string
+	Name            string
+	Hash            string         // password hash (bcrypt)
+	Token           string         // Only set if token was used to log in
+	TokenScope      *TokenScope    // Only set if a scoped token was used to log in
+	TokenAllowedIPs []netip.Prefix // Only set if a token with an IP allowlist was used to log in
+	AllowedIPs      []netip.Prefix // If set, the user can only log in from these IP ranges
+	Provider        Provider       // External identity provider the user was provisioned from, empty for local users
+	ProviderID      string         // Stable ID of the user at the identity provider (e.g. OIDC issuer and subject), may be empty
+	Role            Role
+	Prefs           *Prefs
+	Tier            *Tier
+	Stats           *Stats
+	Billing         *Billing
+	SyncTopic       string
+	Deleted         bool
 }
 
 // TierID returns the ID of the User.Tier, or an empty string if the user has no tier,
@@ -34,6 +42,14 @@ func (u *User) TierID() string {
 	return u.Tier.ID
 }
 
+// AllowedFrom returns true if the user may log in from the given IP address, i.e. if it is within the allowed
+// IP ranges of the user, and within those of the token the user logged in with (if any). An empty allowlist
+// allows all IP addresses.
+func (u *User) AllowedFrom(ip netip.Addr) bool {
+	return (len(u.AllowedIPs) == 0 || util.ContainsIP(u.AllowedIPs, ip)) &&
+		(len(u.TokenAllowedIPs) == 0 || util.ContainsIP(u.TokenAllowedIPs, ip))
+}
+
 // IsAdmin returns true if the user is an admin
 func (u *User) IsAdmin() bool {
 	return u != nil && u.Role == RoleAdmin
@@ -56,6 +72,18 @@ type Auther interface {
 	Authorize(user *User, topic string, perm Permission) error
 }
 
+// Directory is an external user directory (e.g. LDAP), which users can authenticate against in addition
+// to the local users, see Manager.UseDirectory
+type Directory interface {
+	// Authenticate checks the username and password against the directory, and returns
+	// ErrUnauthenticated if they are not correct
+	Authenticate(username, password string) error
+
+	// Groups returns the names of the groups the user is a member of, or an empty list if
+	// the user does not exist in the directory
+	Groups(username string) ([]string, error)
+}
+
 // Token represents a user token, including expiry date
 type Token struct {
 	Value      string
@@ -63,6 +91,145 @@ type Token struct {
 	LastAccess time.Time
 	LastOrigin netip.Addr
 	Expires    time.Time
+	Scope      *TokenScope    // May be nil, if the token is not restricted
+	AllowedIPs []netip.Prefix // If set, the token can only be used from these IP ranges
+}
+
+// TokenScope restricts what a token can be used for. A token without a scope can do everything
+// its user can do; a scoped token can never do more than its user can do.
+type TokenScope struct {
+	Topics      []Grant // If set, only topics matching these patterns can be accessed, see Authorize
+	PublishOnly bool    // Only publishing is allowed, no subscribing and no account API (implies NoAccount)
+	NoAccount   bool    // The account API cannot be used
+}
+
+// TokenScope options, see ParseTokenScope
+const (
+	tokenScopePublishOnly = "publish-only"
+	tokenScopeNoAccount   = "no-account"
+)
+
+// ParseTokenScope parses a list of scope entries, each of which is either a topic pattern with a permission
+// (e.g. "alerts*:rw" or "ci-results:write-only"), or one of the options "publish-only" and "no-account".
+// Entries may also be comma-separated. It returns nil if the list is empty.
+func ParseTokenScope(entries []string) (*TokenScope, error) {
+	scope := &TokenScope{}
+	empty := true
+	for _, entry := range entries {
+		for _, s := range strings.Split(entry, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			empty = false
+			switch s {
+			case tokenScopePublishOnly:
+				scope.PublishOnly = true
+			case tokenScopeNoAccount:
+				scope.NoAccount = true
+			default:
+				pattern, perm, ok := strings.Cut(s, ":")
+				if !ok || !AllowedTopicPattern(pattern) {
+					return nil, ErrInvalidTokenScope
+				}
+				allow, err := ParsePermission(perm)
+				if err != nil {
+					return nil, ErrInvalidTokenScope
+				}
+				scope.Topics = append(scope.Topics, Grant{TopicPattern: pattern, Allow: allow})
+			}
+		}
+	}
+	if empty {
+		return nil, nil
+	}
+	return scope, nil
+}
+
+// Authorize returns nil if the scope allows the given permission on the topic. If topic patterns are set,
+// the most specific (longest) matching pattern decides. A nil scope allows everything.
+func (s *TokenScope) Authorize(topic string, perm Permission) error {
+	if s == nil {
+		return nil
+	} else if s.PublishOnly && perm != PermissionWrite {
+		return ErrUnauthorized
+	} else if len(s.Topics) == 0 {
+		return nil
+	}
+	var match *Grant
+	for i, grant := range s.Topics {
+		if !topicPatternMatches(grant.TopicPattern, topic) {
+			continue
+		}
+		if match == nil || len(grant.TopicPattern) > len(match.TopicPattern) || (len(grant.TopicPattern) == len(match.TopicPattern) && grant.Allow > match.Allow) {
+			match = &s.Topics[i]
+		}
+	}
+	if match == nil || (perm == PermissionRead && !match.Allow.IsRead()) || (perm == PermissionWrite && !match.Allow.IsWrite()) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// AccountAllowed returns true if the scope allows using the account API. A nil scope allows everything.
+func (s *TokenScope) AccountAllowed() bool {
+	return s == nil || (!s.PublishOnly && !s.NoAccount)
+}
+
+// String returns the scope in the format understood by ParseTokenScope, e.g. "alerts*:read-write,no-account"
+func (s *TokenScope) String() string {
+	if s == nil {
+		return ""
+	}
+	entries := make([]string, 0)
+	for _, grant := range s.Topics {
+		entries = append(entries, fmt.Sprintf("%s:%s", grant.TopicPattern, grant.Allow.String()))
+	}
+	if s.PublishOnly {
+		entries = append(entries, tokenScopePublishOnly)
+	}
+	if s.NoAccount {
+		entries = append(entries, tokenScopeNoAccount)
+	}
+	return strings.Join(entries, ",")
+}
+
+// ParseAllowedIPs parses a list of IP addresses (e.g. "10.1.2.3") and IP ranges in CIDR notation (e.g. "10.0.0.0/8"),
+// as used for User.AllowedIPs and Token.AllowedIPs. Entries may also be comma-separated.
+func ParseAllowedIPs(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		for _, s := range strings.Split(entry, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if prefix, err := netip.ParsePrefix(s); err == nil {
+				prefixes = append(prefixes, prefix.Masked())
+			} else if ip, err := netip.ParseAddr(s); err == nil {
+				prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			} else {
+				return nil, ErrInvalidAllowedIPs
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+// AllowedIPsString returns the list of IP ranges in the format understood by ParseAllowedIPs, e.g. "10.0.0.0/8,1.2.3.4/32"
+func AllowedIPsString(prefixes []netip.Prefix) string {
+	entries := make([]string, 0)
+	for _, prefix := range prefixes {
+		entries = append(entries, prefix.String())
+	}
+	return strings.Join(entries, ",")
+}
+
+// topicPatternMatches returns true if the topic matches the topic pattern, in which '*' matches any
+// number of characters. Topic patterns cannot contain any other special characters, see AllowedTopicPattern.
+func topicPatternMatches(pattern, topic string) bool {
+	matched, err := path.Match(pattern, topic)
+	return err == nil && matched
 }
 
 // TokenUpdate holds information about the last access time and origin IP address of a token
@@ -80,20 +247,21 @@ type Prefs struct {
 
 // Tier represents a user's account type, including its account limits
 type Tier struct {
-	ID                       string        // Tier identifier (ti_...)
-	Code                     string        // Code of the tier
-	Name                     string        // Name of the tier
-	MessageLimit             int64         // Daily message limit
-	MessageExpiryDuration    time.Duration // Cache duration for messages
-	EmailLimit               int64         // Daily email limit
-	CallLimit                int64         // Daily phone call limit
-	ReservationLimit         int64         // Number of topic reservations allowed by user
-	AttachmentFileSizeLimit  int64         // Max file size per file (bytes)
-	AttachmentTotalSizeLimit int64         // Total file size for all files of this user (bytes)
-	AttachmentExpiryDuration time.Duration // Duration after which attachments will be deleted
-	AttachmentBandwidthLimit int64         // Daily bandwidth limit for the user
-	StripeMonthlyPriceID     string        // Monthly price ID for paid tiers (price_...)
-	StripeYearlyPriceID      string        // Yearly price ID for paid tiers (price_...)
+	ID                        string        // Tier identifier (ti_...)
+	Code                      string        // Code of the tier
+	Name                      string        // Name of the tier
+	MessageLimit              int64         // Daily message limit
+	MessageExpiryDuration     time.Duration // Cache duration for messages
+	EmailLimit                int64         // Daily email limit
+	CallLimit                 int64         // Daily phone call limit
+	ReservationLimit          int64         // Number of topic reservations allowed by user
+	AttachmentFileSizeLimit   int64         // Max file size per file (bytes)
+	AttachmentTotalSizeLimit  int64         // Total file size for all files of this user (bytes)
+	AttachmentExpiryDuration  time.Duration // Duration after which attachments will be deleted
+	AttachmentBandwidthLimit  int64         // Daily bandwidth limit for the user
+	AttachmentImageProcessing bool          // Generate previews and strip metadata of image attachments
+	StripeMonthlyPriceID      string        // Monthly price ID for paid tiers (price_...)
+	StripeYearlyPriceID       string        // Yearly price ID for paid tiers (price_...)
 }
 
 // Context returns fields for the log
@@ -123,9 +291,84 @@ func (s *Subscription) Context() log.Context {
 
 // NotificationPrefs represents the user's notification settings
 type NotificationPrefs struct {
-	Sound       *string `json:"sound,omitempty"`
-	MinPriority *int    `json:"min_priority,omitempty"`
-	DeleteAfter *int    `json:"delete_after,omitempty"`
+	Sound       *string       `json:"sound,omitempty"`
+	MinPriority *int          `json:"min_priority,omitempty"`
+	DeleteAfter *int          `json:"delete_after,omitempty"`
+	QuietHours  []*QuietHours `json:"quiet_hours,omitempty"`
+}
+
+// QuietHours represents a do-not-disturb schedule, during which the server holds back push
+// notifications, emails and phone calls for the user. Schedules may span midnight (e.g. 22:00-07:00),
+// in which case Days refers to the day the schedule starts on.
+type QuietHours struct {
+	Start       string   `json:"start"`                  // Time of day, e.g. "22:00"
+	End         string   `json:"end"`                    // Time of day, e.g. "07:00"
+	Timezone    string   `json:"timezone,omitempty"`     // IANA time zone, e.g. "Europe/Berlin" (default: UTC)
+	Days        []string `json:"days,omitempty"`         // Days of the week, e.g. "mon", "sat" (default: all days)
+	MinPriority int      `json:"min_priority,omitempty"` // Messages with at least this priority bypass the quiet hours (0 = none)
+	Summary     bool     `json:"summary,omitempty"`      // Send a summary of held back notifications when the quiet hours end
+}
+
+// Validate checks that the schedule's times, time zone, days and priority threshold can be parsed
+func (q *QuietHours) Validate() error {
+	start, errStart := time.Parse(quietHoursTimeFormat, q.Start)
+	end, errEnd := time.Parse(quietHoursTimeFormat, q.End)
+	if errStart != nil || errEnd != nil || start.Equal(end) {
+		return ErrInvalidArgument
+	} else if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return ErrInvalidArgument
+	} else if q.MinPriority < 0 || q.MinPriority > 5 {
+		return ErrInvalidArgument
+	}
+	for _, day := range q.Days {
+		if _, ok := quietHoursDays[strings.ToLower(day)]; !ok {
+			return ErrInvalidArgument
+		}
+	}
+	return nil
+}
+
+// Active returns true if the given time is within the schedule. Invalid schedules are never active.
+func (q *QuietHours) Active(t time.Time) bool {
+	start, errStart := time.Parse(quietHoursTimeFormat, q.Start)
+	end, errEnd := time.Parse(quietHoursTimeFormat, q.End)
+	location, errLocation := time.LoadLocation(q.Timezone)
+	if errStart != nil || errEnd != nil || errLocation != nil {
+		return false
+	}
+	local := t.In(location)
+	now := local.Hour()*60 + local.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if from < to {
+		return now >= from && now < to && q.activeOn(local.Weekday())
+	}
+	return (now >= from && q.activeOn(local.Weekday())) || (now < to && q.activeOn(local.AddDate(0, 0, -1).Weekday()))
+}
+
+func (q *QuietHours) activeOn(weekday time.Weekday) bool {
+	if len(q.Days) == 0 {
+		return true
+	}
+	for _, day := range q.Days {
+		if d, ok := quietHoursDays[strings.ToLower(day)]; ok && d == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveQuietHours returns the user's quiet hours schedule that is active at the given time, and that
+// is not bypassed by the given message priority, or nil if there is none
+func (u *User) ActiveQuietHours(t time.Time, priority int) *QuietHours {
+	if u == nil || u.Prefs == nil || u.Prefs.Notification == nil {
+		return nil
+	}
+	for _, q := range u.Prefs.Notification.QuietHours {
+		if q.Active(t) && (q.MinPriority == 0 || priority < q.MinPriority) {
+			return q
+		}
+	}
+	return nil
 }
 
 // Stats is a struct holding daily user statistics
@@ -145,12 +388,19 @@ type Billing struct {
 	StripeSubscriptionCancelAt  time.Time
 }
 
-// Grant is a struct that represents an access control entry to a topic by a user
+// Grant is a struct that represents an access control entry to a topic by a user or group
 type Grant struct {
 	TopicPattern string // May include wildcard (*)
 	Allow        Permission
 }
 
+// Group is a named set of users. Access control entries granted to the group (see GroupPrefix)
+// apply to all of its members.
+type Group struct {
+	Name    string
+	Members []string // Usernames, sorted
+}
+
 // Reservation is a struct that represents the ownership over a topic by a user
 type Reservation struct {
 	Topic    string
@@ -158,6 +408,67 @@ type Reservation struct {
 	Everyone Permission
 }
 
+// Webhook is an outbound HTTP callback owned by a user. Every message published to the topic
+// is POSTed to the URL, see WebhookDelivery.
+type Webhook struct {
+	ID          string
+	UserID      string
+	Topic       string
+	URL         string
+	Template    string // Template for the request body; the message is sent as JSON if empty
+	Secret      string // Key used to sign the request body (HMAC-SHA256)
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   string
+	Failures    int64 // Number of consecutive failed delivery attempts
+	Pending     int64 // Number of queued deliveries
+}
+
+// WebhookDelivery is a queued request to a webhook. Deliveries are persisted, so that they survive restarts.
+type WebhookDelivery struct {
+	ID          string
+	WebhookID   string
+	URL         string // Only set when reading from the queue
+	Secret      string // Only set when reading from the queue
+	Body        string
+	ContentType string
+	Attempts    int
+	NextAttempt time.Time
+}
+
+// Rule is a server-side routing rule. Messages published to a topic matching Topic (and Filter, if set)
+// are republished to the Target topic, optionally transformed using Template.
+type Rule struct {
+	ID        string
+	Topic     string // Source topic pattern, may include '*' wildcards
+	Target    string // Target topic
+	Filter    string // Filter expression, see server package; matches all messages if empty
+	Template  string // Template for the message text; the message text is copied if empty
+	RateLimit int    // Max. number of routed messages per hour and publisher
+}
+
+// EscalationPolicy is a server-side escalation chain. For every message published to a topic matching Topic,
+// the Steps are executed one after the other, until the message is acknowledged (see "ack" action in server package).
+type EscalationPolicy struct {
+	ID    string
+	Topic string // Topic pattern, may include '*' wildcards
+	Steps []*EscalationStep
+}
+
+// EscalationStep is a single step of an escalation policy
+type EscalationStep struct {
+	Delay  time.Duration `json:"delay"`  // Delay after the previous step, or after the message was published (first step)
+	Type   string        `json:"type"`   // Escalation type, see EscalationCall, EscalationEmail and EscalationPublish
+	Target string        `json:"target"` // Phone number, e-mail address or topic, depending on the type
+}
+
+// Escalation step types
+const (
+	EscalationCall    = "call"    // Phone call via Twilio
+	EscalationEmail   = "email"   // E-mail
+	EscalationPublish = "publish" // Republish the message to another topic
+)
+
 // Permission represents a read or write permission to a topic
 type Permission uint8
 
@@ -234,17 +545,48 @@ const (
 	RoleAnonymous = Role("anonymous")
 )
 
+// Provider is the external identity provider a user was provisioned from
+type Provider string
+
+// Identity providers
+const (
+	ProviderLocal = Provider("")     // Users created locally, e.g. via "ntfy user add" or signup
+	ProviderLDAP  = Provider("ldap") // Users provisioned from the directory on first login, see Manager.UseDirectory
+	ProviderOIDC  = Provider("oidc") // Users provisioned via OpenID Connect single sign-on, see Manager.AddProviderUser
+)
+
 // Everyone is a special username representing anonymous users
 const (
 	Everyone   = "*"
 	everyoneID = "u_everyone"
 )
 
+// GroupPrefix is the prefix of group principals, e.g. "group:ops". Access control entries can be granted
+// to groups by passing a group principal instead of a username to Manager.AllowAccess. This works for
+// local groups (see Manager.AddGroup) as well as for directory groups (see Manager.UseDirectory).
+const GroupPrefix = "group:"
+
+const quietHoursTimeFormat = "15:04"
+
+var quietHoursDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
 var (
 	allowedUsernameRegex     = regexp.MustCompile(`^[-_.+@a-zA-Z0-9]+$`)    // Does not include Everyone (*)
 	allowedTopicRegex        = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)  // No '*'
 	allowedTopicPatternRegex = regexp.MustCompile(`^[-_*A-Za-z0-9]{1,64}$`) // Adds '*' for wildcards!
 	allowedTierRegex         = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+	allowedGroupRegex        = regexp.MustCompile(`^[-_.+@ A-Za-z0-9]{1,64}$`) // Includes spaces, e.g. "Domain Users"
+	allowedWebhookURLRegex   = regexp.MustCompile(`^https?://[^\s]+$`)
+	allowedPhoneNumberRegex  = regexp.MustCompile(`^\+\d{1,100}$`)
+	allowedEmailRegex        = regexp.MustCompile(`^[^\s@]+@[^\s@]+$`)
 )
 
 // AllowedRole returns true if the given role can be used for new users
@@ -257,6 +599,16 @@ func AllowedUsername(username string) bool {
 	return allowedUsernameRegex.MatchString(username)
 }
 
+// AllowedGroup returns true if the given group name is valid
+func AllowedGroup(group string) bool {
+	return allowedGroupRegex.MatchString(group)
+}
+
+// GroupPrincipal returns the group name if the given principal is a group principal (see GroupPrefix)
+func GroupPrincipal(principal string) (string, bool) {
+	return strings.CutPrefix(principal, GroupPrefix)
+}
+
 // AllowedTopic returns true if the given topic name is valid
 func AllowedTopic(topic string) bool {
 	return allowedTopicRegex.MatchString(topic)
@@ -272,16 +624,45 @@ func AllowedTier(tier string) bool {
 	return allowedTierRegex.MatchString(tier)
 }
 
+// AllowedWebhookURL returns true if the given URL can be used as a webhook URL
+func AllowedWebhookURL(url string) bool {
+	return len(url) <= webhookURLMaxLength && allowedWebhookURLRegex.MatchString(url)
+}
+
+// AllowedEscalationStep returns true if the given escalation step has a valid type, target and delay
+func AllowedEscalationStep(step *EscalationStep) bool {
+	if step == nil || step.Delay < 0 {
+		return false
+	}
+	switch step.Type {
+	case EscalationCall:
+		return allowedPhoneNumberRegex.MatchString(step.Target)
+	case EscalationEmail:
+		return allowedEmailRegex.MatchString(step.Target)
+	case EscalationPublish:
+		return AllowedTopic(step.Target)
+	}
+	return false
+}
+
 // Error constants used by the package
 var (
-	ErrUnauthenticated     = errors.New("unauthenticated")
-	ErrUnauthorized        = errors.New("unauthorized")
-	ErrInvalidArgument     = errors.New("invalid argument")
-	ErrUserNotFound        = errors.New("user not found")
-	ErrUserExists          = errors.New("user already exists")
-	ErrTierNotFound        = errors.New("tier not found")
-	ErrTokenNotFound       = errors.New("token not found")
-	ErrPhoneNumberNotFound = errors.New("phone number not found")
-	ErrTooManyReservations = errors.New("new tier has lower reservation limit")
-	ErrPhoneNumberExists   = errors.New("phone number already exists")
+	ErrUnauthenticated          = errors.New("unauthenticated")
+	ErrUnauthorized             = errors.New("unauthorized")
+	ErrInvalidArgument          = errors.New("invalid argument")
+	ErrUserNotFound             = errors.New("user not found")
+	ErrUserExists               = errors.New("user already exists")
+	ErrTierNotFound             = errors.New("tier not found")
+	ErrGroupNotFound            = errors.New("group not found")
+	ErrGroupExists              = errors.New("group already exists")
+	ErrTokenNotFound            = errors.New("token not found")
+	ErrInvalidTokenScope        = errors.New("invalid token scope")
+	ErrInvalidAllowedIPs        = errors.New("invalid IP address or range")
+	ErrPhoneNumberNotFound      = errors.New("phone number not found")
+	ErrTooManyReservations      = errors.New("new tier has lower reservation limit")
+	ErrPhoneNumberExists        = errors.New("phone number already exists")
+	ErrWebhookNotFound          = errors.New("webhook not found")
+	ErrTooManyWebhooks          = errors.New("too many webhooks")
+	ErrRuleNotFound             = errors.New("rule not found")
+	ErrEscalationPolicyNotFound = errors.New("escalation policy not found")
 )
@@ -3,6 +3,7 @@ package user
 import (
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestPermission(t *testing.T) {
@@ -73,3 +74,52 @@ func TestUsernameRegex(t *testing.T) {
 	require.True(t, AllowedUsername(usernameEmailAlias))
 	require.False(t, AllowedUsername(usernameInvalid))
 }
+
+func TestQuietHours_Validate(t *testing.T) {
+	require.Nil(t, (&QuietHours{Start: "22:00", End: "07:00"}).Validate())
+	require.Nil(t, (&QuietHours{Start: "09:00", End: "17:30", Timezone: "America/New_York", Days: []string{"Mon", "fri"}, MinPriority: 4}).Validate())
+	require.Equal(t, ErrInvalidArgument, (&QuietHours{Start: "22:00"}).Validate())
+	require.Equal(t, ErrInvalidArgument, (&QuietHours{Start: "7am", End: "9am"}).Validate())
+	require.Equal(t, ErrInvalidArgument, (&QuietHours{Start: "22:00", End: "22:00"}).Validate())
+	require.Equal(t, ErrInvalidArgument, (&QuietHours{Start: "22:00", End: "07:00", Timezone: "Nowhere"}).Validate())
+	require.Equal(t, ErrInvalidArgument, (&QuietHours{Start: "22:00", End: "07:00", Days: []string{"monday"}}).Validate())
+	require.Equal(t, ErrInvalidArgument, (&QuietHours{Start: "22:00", End: "07:00", MinPriority: -1}).Validate())
+}
+
+func TestQuietHours_Active(t *testing.T) {
+	// Overnight schedule, starting on Fridays only
+	q := &QuietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Berlin", Days: []string{"fri"}}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.Nil(t, err)
+	require.False(t, q.Active(time.Date(2024, 5, 3, 21, 59, 0, 0, berlin)))  // Fri
+	require.True(t, q.Active(time.Date(2024, 5, 3, 22, 0, 0, 0, berlin)))    // Fri
+	require.True(t, q.Active(time.Date(2024, 5, 4, 6, 59, 0, 0, berlin)))    // Sat
+	require.False(t, q.Active(time.Date(2024, 5, 4, 7, 0, 0, 0, berlin)))    // Sat
+	require.False(t, q.Active(time.Date(2024, 5, 4, 23, 0, 0, 0, berlin)))   // Sat
+	require.False(t, q.Active(time.Date(2024, 5, 3, 4, 0, 0, 0, berlin)))    // Fri, window started on Thursday
+	require.True(t, q.Active(time.Date(2024, 5, 3, 20, 30, 0, 0, time.UTC))) // 22:30 in Berlin
+
+	// Same-day schedule, all days
+	q = &QuietHours{Start: "12:00", End: "13:00"}
+	require.True(t, q.Active(time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)))
+	require.False(t, q.Active(time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)))
+	require.False(t, q.Active(time.Date(2024, 5, 1, 11, 59, 0, 0, time.UTC)))
+}
+
+func TestUser_ActiveQuietHours(t *testing.T) {
+	noon := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	u := &User{
+		Prefs: &Prefs{
+			Notification: &NotificationPrefs{
+				QuietHours: []*QuietHours{
+					{Start: "12:00", End: "13:00", MinPriority: 4},
+				},
+			},
+		},
+	}
+	require.NotNil(t, u.ActiveQuietHours(noon, 3))
+	require.Nil(t, u.ActiveQuietHours(noon, 4))
+	require.Nil(t, u.ActiveQuietHours(noon.Add(time.Hour), 1))
+	require.Nil(t, (&User{}).ActiveQuietHours(noon, 1))
+	require.Nil(t, (*User)(nil).ActiveQuietHours(noon, 1))
+}
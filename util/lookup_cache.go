@@ -54,3 +54,11 @@ func (c *LookupCache[T]) Value() (T, error) {
 	}
 	return *c.value, nil
 }
+
+// Expire marks the cached value as out-of-date, so that the next call to Value retrieves it
+// via the lookup function
+func (c *LookupCache[T]) Expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value = nil
+}
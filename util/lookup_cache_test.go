@@ -61,3 +61,23 @@ func TestLookupCache_Error(t *testing.T) {
 	require.Equal(t, "", v)
 	require.True(t, time.Since(start) >= 200*time.Millisecond)
 }
+
+func TestLookupCache_Expire(t *testing.T) {
+	i := 0
+	c := NewLookupCache[int](func() (int, error) {
+		i++
+		return i, nil
+	}, time.Hour)
+
+	v, err := c.Value()
+	require.Nil(t, err)
+	require.Equal(t, 1, v)
+	v, err = c.Value()
+	require.Nil(t, err)
+	require.Equal(t, 1, v)
+
+	c.Expire()
+	v, err = c.Value()
+	require.Nil(t, err)
+	require.Equal(t, 2, v)
+}
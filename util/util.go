@@ -2,12 +2,14 @@ package util
 
 import (
 	"bytes"
+	crand "crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/big"
 	"math/rand"
 	"net/netip"
 	"os"
@@ -48,6 +50,12 @@ func FileExists(filename string) bool {
 	return stat != nil
 }
 
+// IsPostgresURL returns true if the given string is a PostgreSQL connection URL (postgres:// or postgresql://),
+// as opposed to a file name. It is used to select the database backend for the cache and auth database.
+func IsPostgresURL(s string) bool {
+	return strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://")
+}
+
 // Contains returns true if needle is contained in haystack
 func Contains[T comparable](haystack []T, needle T) bool {
 	for _, s := range haystack {
@@ -78,6 +86,16 @@ func ContainsAll[T comparable](haystack []T, needles []T) bool {
 	return true
 }
 
+// ContainsAny returns true if any one of the needles is contained in haystack
+func ContainsAny[T comparable](haystack []T, needles []T) bool {
+	for _, needle := range needles {
+		if Contains(haystack, needle) {
+			return true
+		}
+	}
+	return false
+}
+
 // SplitNoEmpty splits a string using strings.Split, but filters out empty strings
 func SplitNoEmpty(s string, sep string) []string {
 	res := make([]string, 0)
@@ -122,6 +140,21 @@ func RandomLowerStringPrefix(prefix string, length int) string {
 	return randomStringPrefixWithCharset(prefix, length, randomStringLowerCaseCharset)
 }
 
+// RandomSecretString returns a random string with a given length. Unlike RandomString, it uses crypto/rand,
+// so that the string cannot be guessed, and can be used as a secret (e.g. a signing key or a one-time token).
+func RandomSecretString(length int) string {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(randomStringCharset)))
+	for i := range b {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			panic(err) // Only happens if the operating system's random number generator fails
+		}
+		b[i] = randomStringCharset[n.Int64()]
+	}
+	return string(b)
+}
+
 func randomStringPrefixWithCharset(prefix string, length int, charset string) string {
 	randomMutex.Lock() // Who would have thought that random.Intn() is not thread-safe?!
 	defer randomMutex.Unlock()
@@ -15,6 +15,7 @@ var config = {
   enable_emails: true,
   enable_calls: true,
   enable_web_push: true,
+  enable_oidc: false,
   billing_contact: "",
   web_push_public_key: "",
   disallowed_topics: ["docs", "static", "file", "app", "account", "settings", "signup", "login", "v1"],
@@ -62,6 +62,42 @@ const handlePushMessage = async (data) => {
   );
 };
 
+/**
+ * Handle a received web push message update (the message was edited). The stored notification with the ID in
+ * "message_id" is replaced, and the notification is shown again (same tag, so it replaces the existing one).
+ */
+const handlePushMessageUpdate = async (data) => {
+  const { subscription_id: subscriptionId, message: update } = data;
+  const message = { ...update, id: update.message_id, event: "message", message_id: undefined };
+  const db = await dbAsync();
+  const exists = await db.notifications.get(message.id);
+  if (exists) {
+    await db.notifications.put({ ...exists, ...message, time: exists.time, subscriptionId, new: 1 });
+  } else {
+    await addNotification({ subscriptionId, message });
+  }
+  await self.registration.showNotification(
+    ...toNotificationParams({
+      subscriptionId,
+      message,
+      defaultTitle: message.topic,
+      topicRoute: new URL(message.topic, self.location.origin).toString(),
+    })
+  );
+};
+
+/**
+ * Handle a received web push message deletion. The stored notification with the ID in "message_id" is removed,
+ * and the notification is closed if it is still shown.
+ */
+const handlePushMessageDelete = async (data) => {
+  const { message } = data;
+  const db = await dbAsync();
+  await db.notifications.delete(message.message_id);
+  const notifications = await self.registration.getNotifications();
+  notifications.filter((n) => n.data?.message?.id === message.message_id).forEach((n) => n.close());
+};
+
 /**
  * Handle a received web push subscription expiring.
  */
@@ -98,6 +134,10 @@ const handlePushUnknown = async (data) => {
 const handlePush = async (data) => {
   if (data.event === "message") {
     await handlePushMessage(data);
+  } else if (data.event === "message_update") {
+    await handlePushMessageUpdate(data);
+  } else if (data.event === "message_delete") {
+    await handlePushMessageDelete(data);
   } else if (data.event === "subscription_expiring") {
     await handlePushSubscriptionExpiring(data);
   } else {
@@ -139,7 +179,7 @@ const handleClick = async (event) => {
 
       if (action.action === "view") {
         self.clients.openWindow(action.url);
-      } else if (action.action === "http") {
+      } else if (action.action === "http" || action.action === "ack") {
         try {
           const response = await fetch(action.url, {
             method: action.method ?? "POST",
@@ -51,12 +51,15 @@ class Connection {
         if (data.event === "open") {
           return;
         }
-        const relevantAndValid = data.event === "message" && "id" in data && "time" in data && "message" in data;
+        const relevantAndValid =
+          (data.event === "message_delete" && "id" in data && "message_id" in data) ||
+          (data.event === "message" && "id" in data && "time" in data && "message" in data) ||
+          (data.event === "message_update" && "id" in data && "message_id" in data && "message" in data);
         if (!relevantAndValid) {
           console.log(`[Connection, ${this.shortUrl}, ${this.connectionId}] Unexpected message. Ignoring.`);
           return;
         }
-        this.since = data.id;
+        this.since = data.id; // Updates and deletes are stored on the server as well, so they are not replayed
         this.onNotification(this.subscriptionId, data);
       } catch (e) {
         console.log(`[Connection, ${this.shortUrl}, ${this.connectionId}] Error handling message: ${e}`);
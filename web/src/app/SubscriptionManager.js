@@ -194,15 +194,53 @@ class SubscriptionManager {
   }
 
   /** Adds/replaces notifications, will not throw if they exist */
+  /** Adds polled notifications, and applies the "message_update" and "message_delete" events among them in order */
   async addNotifications(subscriptionId, notifications) {
-    const notificationsWithSubscriptionId = notifications.map((notification) => ({ ...notification, subscriptionId }));
+    const notificationsWithSubscriptionId = notifications
+      .filter((notification) => notification.event === "message")
+      .map((notification) => ({ ...notification, subscriptionId }));
     const lastNotificationId = notifications.at(-1).id;
     await this.db.notifications.bulkPut(notificationsWithSubscriptionId);
+    for (const notification of notifications) {
+      if (notification.event === "message_update") {
+        // eslint-disable-next-line no-await-in-loop
+        await this.replaceNotification(subscriptionId, notification);
+      } else if (notification.event === "message_delete") {
+        // eslint-disable-next-line no-await-in-loop
+        await this.deleteNotification(notification.message_id);
+      }
+    }
     await this.db.subscriptions.update(subscriptionId, {
       last: lastNotificationId,
     });
   }
 
+  /**
+   * Replaces the content of an existing notification with the content of a "message_update" event,
+   * or returns false if it does not exist. The ID and time of the notification are kept.
+   */
+  async replaceNotification(subscriptionId, notification) {
+    const exists = await this.db.notifications.get(notification.message_id);
+    if (!exists) {
+      return false;
+    }
+    try {
+      await this.db.notifications.put({
+        ...exists,
+        ...notification,
+        id: exists.id,
+        time: exists.time,
+        event: "message",
+        message_id: undefined,
+        subscriptionId,
+        new: 1,
+      });
+    } catch (e) {
+      console.error(`[SubscriptionManager] Error replacing notification`, e);
+    }
+    return true;
+  }
+
   async updateNotification(notification) {
     const exists = await this.db.notifications.get(notification.id);
     if (!exists) {
@@ -71,7 +71,7 @@ export const toNotificationParams = ({ subscriptionId, message, defaultTitle, to
         topicRoute,
       },
       actions: message.actions
-        ?.filter(({ action }) => action === "view" || action === "http")
+        ?.filter(({ action }) => action === "view" || action === "http" || action === "ack")
         .map(({ label }) => ({
           action: label,
           title: label,
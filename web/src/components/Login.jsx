@@ -1,5 +1,5 @@
 import * as React from "react";
-import { useState } from "react";
+import { useEffect, useState } from "react";
 import { Typography, TextField, Button, Box, IconButton, InputAdornment } from "@mui/material";
 import WarningAmberIcon from "@mui/icons-material/WarningAmber";
 import { NavLink } from "react-router-dom";
@@ -10,6 +10,8 @@ import AvatarBox from "./AvatarBox";
 import session from "../app/Session";
 import routes from "./routes";
 import { UnauthorizedError } from "../app/errors";
+import { oidcLoginUrl } from "../app/utils";
+import config from "../app/config";
 
 const Login = () => {
   const { t } = useTranslation();
@@ -18,6 +20,21 @@ const Login = () => {
   const [password, setPassword] = useState("");
   const [showPassword, setShowPassword] = useState(false);
 
+  // After single sign-on, the server redirects here with the token in the URL fragment (see handleOIDCCallback)
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.hash.substring(1));
+    const ssoUsername = params.get("username");
+    const ssoToken = params.get("token");
+    if (ssoUsername && ssoToken) {
+      window.history.replaceState(null, "", window.location.pathname);
+      (async () => {
+        console.log(`[Login] Single sign-on for user ${ssoUsername} successful`);
+        await session.store(ssoUsername, ssoToken);
+        window.location.href = routes.app;
+      })();
+    }
+  }, []);
+
   const handleSubmit = async (event) => {
     event.preventDefault();
     const user = { username, password };
@@ -86,6 +103,11 @@ const Login = () => {
         <Button type="submit" fullWidth variant="contained" disabled={username === "" || password === ""} sx={{ mt: 2, mb: 2 }}>
           {t("login_form_button_submit")}
         </Button>
+        {config.enable_oidc && (
+          <Button fullWidth variant="outlined" href={oidcLoginUrl(config.base_url)} sx={{ mb: 2 }}>
+            {t("login_form_button_sso")}
+          </Button>
+        )}
         {error && (
           <Box
             sx={{
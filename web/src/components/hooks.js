@@ -50,7 +50,14 @@ export const useConnectionListeners = (account, subscriptions, users, webPushTop
       };
 
       const handleNotification = async (subscriptionId, notification) => {
-        const added = await subscriptionManager.addNotification(subscriptionId, notification);
+        if (notification.event === "message_delete") {
+          await subscriptionManager.deleteNotification(notification.message_id);
+          return;
+        }
+        const added =
+          notification.event === "message_update"
+            ? await subscriptionManager.replaceNotification(subscriptionId, notification)
+            : await subscriptionManager.addNotification(subscriptionId, notification);
         if (added) {
           await subscriptionManager.notify(subscriptionId, notification);
         }